@@ -78,6 +78,24 @@ type SessionProvider struct {
 type ApplyOpsResponse struct {
 	Ok     bool   `bson:"ok"`
 	ErrMsg string `bson:"errmsg"`
+	Code   int    `bson:"code"`
+
+	// Applied is the number of ops the server attempted, and Results holds
+	// whether each of them succeeded, in order. Ops beyond those in Results
+	// were not attempted.
+	Applied int    `bson:"applied"`
+	Results []bool `bson:"results"`
+
+	// WriteConcernError, if set, says that the ops were applied but that
+	// the write concern of the command wasn't satisfied.
+	WriteConcernError *WriteConcernError `bson:"writeConcernError"`
+}
+
+// WriteConcernError represents the write concern error in the response to a
+// write command, such as a timeout waiting for replication.
+type WriteConcernError struct {
+	Code   int    `bson:"code"`
+	ErrMsg string `bson:"errmsg"`
 }
 
 // Oplog represents a MongoDB oplog document.
@@ -85,6 +85,11 @@ func SplitAndValidateNamespace(namespace string) (string, string, error) {
 // collection), returning an error if it is invalid.
 func ValidateFullNamespace(namespace string) error {
 
+	// the namespace cannot be empty
+	if namespace == "" {
+		return fmt.Errorf("namespace cannot be an empty string")
+	}
+
 	// the namespace must be shorter than 123 bytes
 	if len([]byte(namespace)) > 122 {
 		return fmt.Errorf("namespace %v is too long (>= 123 bytes)", namespace)
@@ -93,9 +98,10 @@ func ValidateFullNamespace(namespace string) error {
 	// find the first instance of "." in the namespace
 	firstDotIndex := strings.Index(namespace, ".")
 
-	// the namespace cannot begin with a dot
+	// the namespace cannot begin with a dot, which would leave the database
+	// name empty
 	if firstDotIndex == 0 {
-		return fmt.Errorf("namespace %v begins with a '.'", namespace)
+		return fmt.Errorf("namespace %v begins with a '.', so has an empty db name", namespace)
 	}
 
 	// the namespace cannot end with a dot
@@ -119,8 +125,10 @@ func ValidateFullNamespace(namespace string) error {
 		return fmt.Errorf("database name is invalid: %v", dbValidationErr)
 	}
 
-	// validate the collection name, if necessary
-	if collection != "" {
+	// validate the collection name, if necessary. The server's own
+	// collections with a '$' in their names are allowed here, since a
+	// namespace may name one, such as the master/slave oplog.
+	if collection != "" && !isReservedCollection(collection) {
 		collValidationErr := ValidateCollectionName(collection)
 		if collValidationErr != nil {
 			return fmt.Errorf("collection name is invalid: %v",
@@ -133,6 +141,14 @@ func ValidateFullNamespace(namespace string) error {
 
 }
 
+// isReservedCollection returns whether a collection is one of the server's
+// own collections whose names contain a '$': the master/slave oplog and the
+// command pseudo-collections.
+func isReservedCollection(collection string) bool {
+	return collection == "oplog.$main" || collection == "$cmd" ||
+		strings.HasPrefix(collection, "$cmd.")
+}
+
 // ValidateDBName validates that a string is a valid name for a mongodb
 // database. An error is returned if it is not valid.
 func ValidateDBName(database string) error {
@@ -145,7 +161,7 @@ func ValidateDBName(database string) error {
 	// check for illegal characters
 	for _, illegalRune := range InvalidDBChars {
 		if strings.ContainsRune(database, illegalRune) {
-			return fmt.Errorf("illegal character '%c' found in db name '%v'", illegalRune, database)
+			return fmt.Errorf("illegal character %q found in db name '%v'", illegalRune, database)
 		}
 	}
 
@@ -175,10 +191,15 @@ func ValidateCollectionGrammar(collection string) error {
 		return fmt.Errorf("collection name cannot be an empty string")
 	}
 
+	// collection names cannot begin with a dot
+	if strings.HasPrefix(collection, ".") {
+		return fmt.Errorf("collection name '%v' is not allowed to begin with '.'", collection)
+	}
+
 	// check for illegal characters
 	for _, illegalRune := range InvalidCollectionChars {
 		if strings.ContainsRune(collection, illegalRune) {
-			return fmt.Errorf("illegal character '%c' found in '%v'", illegalRune, collection)
+			return fmt.Errorf("illegal character %q found in '%v'", illegalRune, collection)
 		}
 	}
 
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"fmt"
 	"github.com/mongodb/mongo-tools/common/testutil"
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 )
 
@@ -108,3 +110,58 @@ func TestInvalidNames(t *testing.T) {
 	})
 
 }
+
+func TestSplitAndValidateNamespace(t *testing.T) {
+
+	testutil.VerifyTestType(t, "unit")
+
+	Convey("When splitting and validating namespaces", t, func() {
+
+		valid := []struct {
+			namespace, database, collection string
+		}{
+			{"db", "db", ""},
+			{"db.col", "db", "col"},
+			{"db.col.with.dots", "db", "col.with.dots"},
+			{"local.oplog.rs", "local", "oplog.rs"},
+			{"local.oplog.$main", "local", "oplog.$main"},
+			{"admin.$cmd", "admin", "$cmd"},
+			{"admin.$cmd.sys.inprog", "admin", "$cmd.sys.inprog"},
+			{"db." + strings.Repeat("c", 119), "db", strings.Repeat("c", 119)},
+		}
+		for _, test := range valid {
+			Convey(fmt.Sprintf("%q is valid", test.namespace), func() {
+				database, collection, err := SplitAndValidateNamespace(test.namespace)
+				So(err, ShouldBeNil)
+				So(database, ShouldEqual, test.database)
+				So(collection, ShouldEqual, test.collection)
+			})
+		}
+
+		invalid := []struct {
+			namespace, reason string
+		}{
+			{"", "empty"},
+			{".col", "empty db name"},
+			{"db.", "ends with a '.'"},
+			{"db..col", "begin with '.'"},
+			{"db.col$", "illegal character '$'"},
+			{"db.oplog.$other", "illegal character '$'"},
+			{"local.$main", "illegal character '$'"},
+			{"db.col\x00", `illegal character '\x00'`},
+			{"d\x00b.col", `illegal character '\x00'`},
+			{"d$b.col", "illegal character '$'"},
+			{"db space.col", "illegal character ' '"},
+			{"db.system.col", "system."},
+			{"db." + strings.Repeat("c", 120), "too long"},
+			{strings.Repeat("d", 64) + ".col", "longer than 63"},
+		}
+		for _, test := range invalid {
+			Convey(fmt.Sprintf("%q is invalid", test.namespace), func() {
+				_, _, err := SplitAndValidateNamespace(test.namespace)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, test.reason)
+			})
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package mongooplog
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// maxBatchOps is the maximum number of ops sent in a single applyOps.
+	maxBatchOps = 10000
+
+	// applyOpsHeadroom is the space reserved beyond the applyOps array, for
+	// the options of the applyOps command, the wire protocol message header
+	// and any fields the driver adds to the command.
+	applyOpsHeadroom = 16 * 1024
+
+	// maxBatchBytes is the maximum size of the applyOps command document.
+	maxBatchBytes = db.MaxBSONSize - applyOpsHeadroom
+)
+
+// applyOpsEnvelopeSize is the size of an applyOps command document containing
+// an empty array: the document's length and terminator, the array's type byte
+// and "applyOps" key, and the empty array's length and terminator.
+var applyOpsEnvelopeSize = 4 + 1 + len("applyOps") + 1 + 4 + 1 + 1
+
+// oplogBatch accumulates oplog entries to be applied with a single applyOps,
+// keeping track of the size of the resulting command so that it never exceeds
+// the limits of the server.
+type oplogBatch struct {
+	ops []db.Oplog
+
+	// size is the size in bytes of the applyOps command document containing
+	// the ops in the batch
+	size int
+
+	maxOps  int
+	maxSize int
+}
+
+func newOplogBatch(maxOps, maxSize int) *oplogBatch {
+	return &oplogBatch{
+		maxOps:  maxOps,
+		maxSize: maxSize,
+		size:    applyOpsEnvelopeSize,
+	}
+}
+
+// oplogSize returns the size of the oplog entry when marshaled to BSON.
+func oplogSize(op db.Oplog) (int, error) {
+	raw, err := bson.Marshal(op)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling oplog entry: %v", err)
+	}
+	return len(raw), nil
+}
+
+// documentSize returns the size of the document an op inserts or replaces, or
+// of its update modifiers, when marshaled to BSON.
+func documentSize(op db.Oplog) (int, error) {
+	raw, err := bson.Marshal(op.Object)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling oplog entry document: %v", err)
+	}
+	return len(raw), nil
+}
+
+// elementSize returns the space taken by the op in the applyOps array when it
+// is stored at the given index: the type byte, the index as a string key with
+// its terminator, and the document itself.
+func elementSize(index, opSize int) int {
+	return 1 + len(strconv.Itoa(index)) + 1 + opSize
+}
+
+// fits returns whether an op of the given size can be added without the batch
+// exceeding its size limit. An empty batch accepts any op, so that an op larger
+// than the limit is still applied on its own.
+func (b *oplogBatch) fits(opSize int) bool {
+	if len(b.ops) == 0 {
+		return true
+	}
+	return b.size+elementSize(len(b.ops), opSize) <= b.maxSize
+}
+
+// add appends an op of the given size to the batch.
+func (b *oplogBatch) add(op db.Oplog, opSize int) {
+	b.size += elementSize(len(b.ops), opSize)
+	b.ops = append(b.ops, op)
+}
+
+// full returns whether the batch holds the maximum number of ops.
+func (b *oplogBatch) full() bool {
+	return len(b.ops) >= b.maxOps
+}
+
+// empty returns whether the batch holds no ops.
+func (b *oplogBatch) empty() bool {
+	return len(b.ops) == 0
+}
+
+// reset empties the batch.
+func (b *oplogBatch) reset() {
+	b.ops = b.ops[:0]
+	b.size = applyOpsEnvelopeSize
+}
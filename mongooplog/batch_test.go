@@ -0,0 +1,98 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"testing"
+)
+
+func TestOplogBatchSize(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a batch limited to the server's max command size", t, func() {
+		batch := newOplogBatch(maxBatchOps, maxBatchBytes)
+		var batches [][]db.Oplog
+
+		flush := func() {
+			ops := make([]db.Oplog, len(batch.ops))
+			copy(ops, batch.ops)
+			batches = append(batches, ops)
+			batch.reset()
+		}
+
+		addAll := func(ops []db.Oplog) {
+			for _, op := range ops {
+				size, err := oplogSize(op)
+				So(err, ShouldBeNil)
+				if !batch.fits(size) {
+					flush()
+				}
+				batch.add(op, size)
+				if batch.full() {
+					flush()
+				}
+			}
+			if !batch.empty() {
+				flush()
+			}
+		}
+
+		Convey("the tracked size should match the marshaled command", func() {
+			for i := 0; i < 20; i++ {
+				op := db.Oplog{
+					Operation: "i",
+					Namespace: "test.data",
+					Object:    bson.D{{"_id", i}, {"s", strings.Repeat("x", i*100)}},
+				}
+				size, err := oplogSize(op)
+				So(err, ShouldBeNil)
+				batch.add(op, size)
+			}
+			raw, err := bson.Marshal(bson.M{"applyOps": batch.ops})
+			So(err, ShouldBeNil)
+			So(batch.size, ShouldEqual, len(raw))
+		})
+
+		Convey("no batch of large ops should exceed the limit", func() {
+			var ops []db.Oplog
+			for i := 0; i < 50; i++ {
+				ops = append(ops, db.Oplog{
+					Operation: "i",
+					Namespace: "test.data",
+					Object:    bson.D{{"_id", i}, {"s", strings.Repeat("x", 1024*1024+i*997)}},
+				})
+			}
+			addAll(ops)
+
+			So(len(batches), ShouldBeGreaterThan, 1)
+			total := 0
+			for _, ops := range batches {
+				raw, err := bson.Marshal(bson.M{"applyOps": ops})
+				So(err, ShouldBeNil)
+				So(len(raw), ShouldBeLessThanOrEqualTo, maxBatchBytes)
+				total += len(ops)
+			}
+			So(total, ShouldEqual, 50)
+		})
+
+		Convey("many small ops should be split by count", func() {
+			var ops []db.Oplog
+			for i := 0; i < maxBatchOps+1; i++ {
+				ops = append(ops, db.Oplog{
+					Operation: "i",
+					Namespace: "test.data",
+					Object:    bson.D{{"_id", i}},
+				})
+			}
+			addAll(ops)
+
+			So(len(batches), ShouldEqual, 2)
+			So(len(batches[0]), ShouldEqual, maxBatchOps)
+			So(len(batches[1]), ShouldEqual, 1)
+		})
+	})
+}
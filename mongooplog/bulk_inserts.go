@@ -0,0 +1,112 @@
+package mongooplog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// opRun is a run of consecutive ops of a batch applied with one command: an
+// insert command for a run of inserts into one collection, and applyOps for
+// the others.
+type opRun struct {
+	ops     []db.Oplog
+	inserts bool
+}
+
+// splitInsertRuns splits a batch into the runs of inserts into one collection
+// and the runs of other ops between them, in order.
+func splitInsertRuns(ops []db.Oplog) []opRun {
+	runs := []opRun{}
+	for i, op := range ops {
+		inserts := bulkInsertable(op)
+		if len(runs) > 0 {
+			last := &runs[len(runs)-1]
+			if last.inserts == inserts && (!inserts || ops[i-1].Namespace == op.Namespace) {
+				last.ops = append(last.ops, op)
+				continue
+			}
+		}
+		runs = append(runs, opRun{ops: []db.Oplog{op}, inserts: inserts})
+	}
+	return runs
+}
+
+// bulkInsertable returns whether an op can be applied with an insert command.
+// Inserts into system collections, such as the index builds of older servers
+// written as inserts into system.indexes, are left to applyOps.
+func bulkInsertable(op db.Oplog) bool {
+	if op.Operation != "i" || len(op.Object) == 0 {
+		return false
+	}
+	dbName, collName := common.SplitNamespace(op.Namespace)
+	return dbName != "" && collName != "" && !strings.HasPrefix(collName, "system.")
+}
+
+// insertResponse is the response to an insert command.
+type insertResponse struct {
+	Ok          bool   `bson:"ok"`
+	ErrMsg      string `bson:"errmsg"`
+	N           int    `bson:"n"`
+	WriteErrors []struct {
+		Index  int    `bson:"index"`
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+	WriteConcernError *db.WriteConcernError `bson:"writeConcernError"`
+}
+
+// insert applies a run of inserts into one collection with a single insert
+// command, which the destination runs faster than applyOps. With
+// --unorderedInserts the documents after one that fails to insert are still
+// inserted, but the run fails all the same. A run whose command fails to reach
+// the destination is applied with applyOps instead, retrying it as for the
+// ops of a batch without --bulkInserts.
+func (dest *sessionDestination) insert(ops []db.Oplog) error {
+	dbName, collName := common.SplitNamespace(ops[0].Namespace)
+	documents := make([]bson.D, len(ops))
+	for i, op := range ops {
+		documents[i] = op.Object
+	}
+	command := bson.D{
+		{"insert", collName},
+		{"documents", documents},
+		{"ordered", !dest.options.UnorderedInserts},
+	}
+	if dest.options.BypassDocumentValidation {
+		command = append(command, bson.DocElem{"bypassDocumentValidation", true})
+	}
+	command = withWriteConcern(command, dest.writeConcern)
+
+	res := &insertResponse{}
+	err := dest.run(dbName, command, res)
+	if err != nil {
+		if isTransientError(err) {
+			log.Logvf(log.Always, "network error inserting %v ops, applying them with applyOps: %v", len(ops), err)
+			return dest.applyOps(ops)
+		}
+		return newError(ExitApplyError, "error inserting ops: %v", err)
+	}
+	if !res.Ok {
+		return newError(ExitApplyError, "server gave error inserting ops: %v", res.ErrMsg)
+	}
+	if len(res.WriteErrors) == 0 {
+		return dest.checkWriteConcern(res.WriteConcernError, len(ops))
+	}
+	failed := []string{}
+	for _, writeErr := range res.WriteErrors {
+		if writeErr.Index >= len(ops) {
+			continue
+		}
+		op := ops[writeErr.Index]
+		failed = append(failed, fmt.Sprintf("op %v of %v in batch failed: op `%v` on `%v` with Timestamp %v, _id %v: %v",
+			writeErr.Index+1, len(ops), op.Operation, op.Namespace, op.Timestamp>>32, opID(op), writeErr.ErrMsg))
+	}
+	first := res.WriteErrors[0]
+	return withDetails(newError(ExitApplyError, "error inserting ops: %v (code %v; %v of %v ops inserted, %v failed)",
+		first.ErrMsg, first.Code, res.N, len(ops), len(res.WriteErrors)), failed)
+}
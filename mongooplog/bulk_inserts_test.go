@@ -0,0 +1,112 @@
+package mongooplog
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/options"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestSplitInsertRuns(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When splitting a batch into runs for --bulkInserts", t, func() {
+		insert := func(ns string, id int) db.Oplog {
+			return db.Oplog{Operation: "i", Namespace: ns, Object: bson.D{{"_id", id}}}
+		}
+		update := db.Oplog{Operation: "u", Namespace: "app.users", Query: bson.D{{"_id", 1}}}
+
+		Convey("a batch of inserts into one collection should be a single run", func() {
+			runs := splitInsertRuns([]db.Oplog{insert("app.users", 1), insert("app.users", 2)})
+			So(len(runs), ShouldEqual, 1)
+			So(runs[0].inserts, ShouldBeTrue)
+			So(len(runs[0].ops), ShouldEqual, 2)
+		})
+
+		Convey("inserts into another collection and other ops should start new runs, in order", func() {
+			runs := splitInsertRuns([]db.Oplog{
+				insert("app.users", 1),
+				insert("app.users", 2),
+				insert("app.events", 1),
+				update,
+				{Operation: "n", Namespace: ""},
+				insert("app.users", 3),
+			})
+			So(len(runs), ShouldEqual, 4)
+			So(len(runs[0].ops), ShouldEqual, 2)
+			So(runs[1].ops[0].Namespace, ShouldEqual, "app.events")
+			So(runs[2].inserts, ShouldBeFalse)
+			So(len(runs[2].ops), ShouldEqual, 2)
+			So(runs[3].inserts, ShouldBeTrue)
+			So(runs[3].ops[0].Object, ShouldResemble, bson.D{{"_id", 3}})
+		})
+
+		Convey("inserts into system collections should be left to applyOps", func() {
+			So(bulkInsertable(insert("app.system.indexes", 1)), ShouldBeFalse)
+			So(bulkInsertable(insert("app.users", 1)), ShouldBeTrue)
+			So(bulkInsertable(db.Oplog{Operation: "i", Namespace: "app.users"}), ShouldBeFalse)
+		})
+	})
+}
+
+// benchmarkInserts applies batches of inserts to the test server with the
+// given destination options, to compare applying them with applyOps and with
+// --bulkInserts.
+func benchmarkInserts(b *testing.B, destOptions DestinationOptions) {
+	if !testutil.HasTestType(testutil.IntegrationTestType) {
+		b.SkipNow()
+	}
+	ssl := testutil.GetSSLOptions()
+	auth := testutil.GetAuthOptions()
+	provider, err := db.NewSessionProvider(options.ToolOptions{
+		SSL:        &ssl,
+		Auth:       &auth,
+		Kerberos:   &options.Kerberos{},
+		Connection: &options.Connection{Host: "localhost", Port: db.DefaultTestPort},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	session, err := provider.GetSession()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dest := &sessionDestination{session: session, options: &destOptions}
+	defer dest.Close()
+	coll := session.DB("mongooplog_test").C("bulk_inserts")
+	defer coll.DropCollection()
+
+	batch := make([]db.Oplog, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range batch {
+			batch[j] = db.Oplog{
+				Operation: "i",
+				Namespace: "mongooplog_test.bulk_inserts",
+				Object:    bson.D{{"_id", i*len(batch) + j}, {"name", fmt.Sprintf("user %v", j)}, {"visits", j}},
+			}
+		}
+		if err := dest.apply(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertsWithApplyOps and BenchmarkBulkInserts apply batches of a
+// thousand inserts, as copying a collection does.
+func BenchmarkInsertsWithApplyOps(b *testing.B) {
+	benchmarkInserts(b, DestinationOptions{})
+}
+
+func BenchmarkBulkInserts(b *testing.B) {
+	benchmarkInserts(b, DestinationOptions{BulkInserts: true})
+}
+
+func BenchmarkUnorderedBulkInserts(b *testing.B) {
+	benchmarkInserts(b, DestinationOptions{BulkInserts: true, UnorderedInserts: true})
+}
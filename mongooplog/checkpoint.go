@@ -0,0 +1,128 @@
+package mongooplog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogCheckpoint records the timestamp of the last applied oplog entry in a
+// file, so that a later run can resume after it, whether it reads a file or
+// tails a source server. The file holds the timestamp's seconds and increment,
+// separated by a comma.
+type oplogCheckpoint struct {
+	path string
+}
+
+// load returns the recorded timestamp, or 0 if nothing has been recorded yet.
+func (c *oplogCheckpoint) load() (bson.MongoTimestamp, error) {
+	contents, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading checkpoint: %v", err)
+	}
+	ts, err := parseCheckpoint(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, fmt.Errorf("error reading checkpoint `%v`: %v", c.path, err)
+	}
+	return ts, nil
+}
+
+// save records the timestamp, replacing the file atomically so that a crash
+// never leaves a partial checkpoint.
+func (c *oplogCheckpoint) save(ts bson.MongoTimestamp) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	_, err = fmt.Fprintf(tmp, "%v,%v\n", uint32(ts>>32), uint32(ts))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing checkpoint: %v", err)
+	}
+	return nil
+}
+
+// appliedTimestamp holds the timestamp of the latest oplog entry applied. It is
+// safe for concurrent use.
+type appliedTimestamp struct {
+	sync.Mutex
+	ts bson.MongoTimestamp
+}
+
+func (a *appliedTimestamp) get() bson.MongoTimestamp {
+	a.Lock()
+	defer a.Unlock()
+	return a.ts
+}
+
+// advance records the timestamp of an applied entry, unless a later one has
+// already been recorded.
+func (a *appliedTimestamp) advance(ts bson.MongoTimestamp) {
+	a.Lock()
+	defer a.Unlock()
+	if ts > a.ts {
+		a.ts = ts
+	}
+}
+
+func parseCheckpoint(s string) (bson.MongoTimestamp, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("expected <seconds>,<increment>, got `%v`", s)
+	}
+	secs, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seconds `%v`", parts[0])
+	}
+	inc, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid increment `%v`", parts[1])
+	}
+	return bson.MongoTimestamp(secs<<32 | inc), nil
+}
+
+// resumeSource tails the oplog of a source server from the op recorded in the
+// checkpoint, or from --seconds ago if there is none. If the source oplog no
+// longer holds the checkpoint, ops would be lost, so it fails unless
+// --checkpointFallback is set, in which case it starts from --seconds ago.
+func (mo *MongoOplog) resumeSource(provider *db.SessionProvider, host, oplogDB, oplogColl string,
+	checkpoint *oplogCheckpoint, resumeAfter bson.MongoTimestamp) (*mgo.Session, oplogIter, error) {
+
+	tsField := mo.SourceOptions.TimestampField
+	threshold := oplogThreshold(mo.SourceOptions)
+	if resumeAfter == 0 {
+		return tailSource(provider, host, oplogDB, oplogColl, tsField, threshold, mo.SourceOptions.AllowGaps)
+	}
+
+	session, iter, err := tailSource(provider, host, oplogDB, oplogColl, tsField, resumeAfter, false)
+	if ExitCode(err) != ExitOplogGap {
+		return session, iter, err
+	}
+	if !mo.SourceOptions.CheckpointFallback {
+		return nil, nil, withDetails(newError(ExitOplogGap, "source `%v` no longer holds the op at checkpoint "+
+			"`%v` with Timestamp %v, so the ops after it can't be applied; remove the checkpoint "+
+			"to start from --seconds ago, or use --checkpointFallback to do so automatically",
+			host, checkpoint.path, resumeAfter>>32), ErrorDetails(err))
+	}
+	log.Logvf(log.Always, "warning: source `%v` no longer holds the op at checkpoint with "+
+		"Timestamp %v; starting from --seconds ago instead", host, resumeAfter>>32)
+	return tailSource(provider, host, oplogDB, oplogColl, tsField, threshold, mo.SourceOptions.AllowGaps)
+}
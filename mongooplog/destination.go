@@ -0,0 +1,346 @@
+package mongooplog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/json"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogDestination is where mongooplog sends batches of oplog entries.
+type oplogDestination interface {
+	// apply applies or stores the ops, in order.
+	apply(ops []db.Oplog) error
+
+	// updateFormats returns the update oplog entry formats the destination
+	// accepts.
+	updateFormats() updateFormats
+
+	Close() error
+}
+
+// sessionDestination applies oplog entries to a live server with applyOps, or
+// with insert commands for runs of inserts with --bulkInserts.
+type sessionDestination struct {
+	session *mgo.Session
+	options *DestinationOptions
+	formats updateFormats
+
+	// provider, if set, is used to replace the session when retrying after
+	// an error, to reach the new primary after a failover
+	provider *db.SessionProvider
+
+	// latencies, if set, records how long each applyOps or insert command
+	// takes
+	latencies *latencyMeter
+
+	// writeConcern, if set, is the write concern of the applyOps and insert
+	// commands, instead of the destination's default
+	writeConcern bson.D
+}
+
+// connectDestination connects to the destination server, and to each server
+// given with --fanOut, applying ops to all of them if there are several.
+func (mo *MongoOplog) connectDestination() (oplogDestination, error) {
+	// purely for logging
+	destServerStr := mo.ToolOptions.Host
+	if mo.ToolOptions.Port != "" {
+		destServerStr = destServerStr + ":" + mo.ToolOptions.Port
+	}
+	dest, err := mo.connectHost(mo.SessionProviderTo, destServerStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(mo.FanOutSessionProviders) == 0 {
+		return dest, nil
+	}
+
+	fanOut := newFanOutDestination(mo.DestinationOptions.ContinueOnError)
+	fanOut.add(destServerStr, dest)
+	for i, provider := range mo.FanOutSessionProviders {
+		host := mo.DestinationOptions.FanOut[i]
+		dest, err := mo.connectHost(provider, host)
+		if err != nil {
+			fanOut.Close()
+			return nil, err
+		}
+		fanOut.add(host, dest)
+	}
+	log.Logvf(log.Always, "applying ops to %v destinations", len(fanOut.targets))
+	return fanOut, nil
+}
+
+// destinationSessions returns the session of each destination server that ops
+// are applied to, along with its host.
+func (mo *MongoOplog) destinationSessions(dest oplogDestination) ([]string, []*mgo.Session) {
+	hosts := []string{mo.ToolOptions.Host}
+	dests := []oplogDestination{dest}
+	if fanOut, ok := dest.(*fanOutDestination); ok {
+		hosts, dests = nil, nil
+		for _, target := range fanOut.targets {
+			hosts = append(hosts, target.host)
+			dests = append(dests, target.dest)
+		}
+	}
+	sessionHosts := []string{}
+	sessions := []*mgo.Session{}
+	for i, dest := range dests {
+		if sessionDest, ok := dest.(*sessionDestination); ok {
+			sessionHosts = append(sessionHosts, hosts[i])
+			sessions = append(sessions, sessionDest.session)
+		}
+	}
+	return sessionHosts, sessions
+}
+
+// connectHost connects to a destination server with the given provider.
+func (mo *MongoOplog) connectHost(provider *db.SessionProvider, host string) (*sessionDestination, error) {
+	toSession, err := provider.GetSession()
+	if err != nil {
+		return nil, newError(ExitConnectionError, "error connecting to destination db `%v`: %v", host, err)
+	}
+	toSession.SetSocketTimeout(0)
+	log.Logvf(log.DebugLow, "successfully connected to destination server `%v`", host)
+
+	// find out which update formats the destination can apply
+	destInfo, err := toSession.BuildInfo()
+	if err != nil {
+		toSession.Close()
+		return nil, newError(ExitConnectionError, "error getting destination server `%v` version: %v", host, err)
+	}
+
+	var writeConcern bson.D
+	if mo.DestinationOptions.WriteConcern != "" {
+		nodeType, err := provider.GetNodeType()
+		if err != nil {
+			toSession.Close()
+			return nil, newError(ExitConnectionError, "error getting destination server `%v` type: %v", host, err)
+		}
+		safety, err := db.BuildWriteConcern(mo.DestinationOptions.WriteConcern, nodeType)
+		if err != nil {
+			toSession.Close()
+			return nil, fmt.Errorf("invalid --writeConcern: %v", err)
+		}
+		writeConcern = writeConcernDocument(safety)
+	}
+
+	return &sessionDestination{
+		session:      toSession,
+		options:      mo.DestinationOptions,
+		formats:      updateFormatsForVersion(destInfo.VersionArray),
+		provider:     provider,
+		latencies:    &latencyMeter{},
+		writeConcern: writeConcern,
+	}, nil
+}
+
+func (dest *sessionDestination) apply(ops []db.Oplog) error {
+	if !dest.options.BulkInserts {
+		return dest.applyOps(ops)
+	}
+	for _, run := range splitInsertRuns(ops) {
+		var err error
+		if run.inserts {
+			err = dest.insert(run.ops)
+		} else {
+			err = dest.applyOps(run.ops)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOps applies the ops with a single applyOps command.
+func (dest *sessionDestination) applyOps(ops []db.Oplog) error {
+	res := &db.ApplyOpsResponse{}
+	command := withWriteConcern(applyOpsCommand(ops, dest.options), dest.writeConcern)
+	err := dest.runApplyOps(command, res)
+
+	if err != nil {
+		if isTransientError(err) {
+			return newError(ExitConnectionError, "error applying ops: %v", err)
+		}
+		return withDetails(newError(ExitApplyError, "error applying ops: %v%v", err, applyOpsSummary(len(ops), res)),
+			describeFailedOps(ops, res))
+	}
+
+	// check the server's response for an issue
+	if !res.Ok {
+		return withDetails(newError(ExitApplyError, "server gave error applying ops: %v%v", res.ErrMsg,
+			applyOpsSummary(len(ops), res)), describeFailedOps(ops, res))
+	}
+	return dest.checkWriteConcern(res.WriteConcernError, len(ops))
+}
+
+// runApplyOps runs the applyOps command on the destination, reconnecting and
+// retrying it after transient errors with exponential backoff. Network errors
+// are retried up to RetryAttempts times, and errors saying that there is no
+// primary for up to FailoverTimeout, to survive a failover of the destination.
+func (dest *sessionDestination) runApplyOps(command bson.D, res *db.ApplyOpsResponse) error {
+	retryAttempts := dest.options.RetryAttempts
+	failoverDeadline := time.Now().Add(time.Duration(dest.options.FailoverTimeout) * time.Second)
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		*res = db.ApplyOpsResponse{}
+		err := dest.run("admin", command, res)
+		if err == nil || !isTransientError(err) {
+			return err
+		}
+		failover := isFailoverError(err) && time.Now().Add(delay).Before(failoverDeadline)
+		if attempt > retryAttempts && !failover {
+			return err
+		}
+		if failover {
+			log.Logvf(log.Always, "destination has no primary applying ops (attempt %v), "+
+				"reconnecting and retrying in %v: %v", attempt, delay, err)
+		} else {
+			log.Logvf(log.Always, "network error applying ops (attempt %v of %v), reconnecting and retrying in %v: %v",
+				attempt, retryAttempts+1, delay, err)
+		}
+		time.Sleep(delay)
+		dest.reconnect()
+		delay = nextRetryDelay(delay)
+	}
+}
+
+// run runs a command on a database of the destination, timing it unless it
+// fails to reach the destination.
+func (dest *sessionDestination) run(dbName string, command bson.D, res interface{}) error {
+	start := time.Now()
+	err := dest.session.DB(dbName).Run(command, res)
+	if dest.latencies != nil && (err == nil || !isTransientError(err)) {
+		dest.latencies.add(time.Since(start))
+	}
+	return err
+}
+
+// reconnect replaces the session with a new one from the provider, which
+// connects to the current primary of a replica set. Without a provider, or if
+// connecting fails, the session is refreshed instead.
+func (dest *sessionDestination) reconnect() {
+	if dest.provider == nil {
+		dest.session.Refresh()
+		return
+	}
+	session, err := dest.provider.GetSession()
+	if err != nil {
+		log.Logvf(log.Always, "error reconnecting to destination: %v", err)
+		dest.session.Refresh()
+		return
+	}
+	session.SetSocketTimeout(0)
+	dest.session.Close()
+	dest.session = session
+	log.Logv(log.Always, "reconnected to destination")
+}
+
+// failedOps returns the indexes of the ops in the batch that the server reports
+// as failed.
+func failedOps(res *db.ApplyOpsResponse) []int {
+	failed := []int{}
+	for i, ok := range res.Results {
+		if !ok {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// describeFailedOps describes each op in the batch that the server reports as
+// failed.
+func describeFailedOps(ops []db.Oplog, res *db.ApplyOpsResponse) []string {
+	described := []string{}
+	for _, i := range failedOps(res) {
+		if i >= len(ops) {
+			break
+		}
+		op := ops[i]
+		described = append(described, fmt.Sprintf("op %v of %v in batch failed: op `%v` on `%v` with Timestamp %v, on %v",
+			i+1, len(ops), op.Operation, op.Namespace, op.Timestamp>>32, opDocument(op)))
+	}
+	return described
+}
+
+// applyOpsSummary describes how much of the batch was applied, or returns an
+// empty string if the response has no such details.
+func applyOpsSummary(numOps int, res *db.ApplyOpsResponse) string {
+	if res.Results == nil && res.Code == 0 {
+		return ""
+	}
+	summary := fmt.Sprintf(" (code %v; %v of %v ops attempted", res.Code, res.Applied, numOps)
+	if failed := failedOps(res); len(failed) > 0 {
+		summary += fmt.Sprintf(", %v failed", len(failed))
+	}
+	return summary + ")"
+}
+
+// opID returns the _id of the document an op affects, if known.
+func opID(op db.Oplog) interface{} {
+	doc := op.Object
+	if op.Operation == "u" {
+		doc = op.Query
+	}
+	for _, elem := range doc {
+		if elem.Name == "_id" {
+			return elem.Value
+		}
+	}
+	return "unknown"
+}
+
+// opCriteria returns the criteria selecting the document an update or delete
+// applies to: the o2 of an update, or the o of a delete. They hold the _id of
+// the document, along with the shard key in a sharded collection, but ops on
+// collections without an _id index, such as capped collections created before
+// 4.0, select their document by its other fields. Other ops have none.
+func opCriteria(op db.Oplog) bson.D {
+	switch op.Operation {
+	case "u":
+		return op.Query
+	case "d":
+		return op.Object
+	}
+	return nil
+}
+
+// opDocument describes the document an op affects for logging, by its _id
+// if it has one, and otherwise by the criteria of an update or delete.
+func opDocument(op db.Oplog) string {
+	if id := opID(op); id != "unknown" {
+		return fmt.Sprintf("the document with _id %v", id)
+	}
+	if criteria := opCriteria(op); len(criteria) > 0 {
+		return fmt.Sprintf("the document matching %v", extendedJSON(criteria))
+	}
+	return "an unknown document"
+}
+
+// extendedJSON formats a document as extended JSON for logging, falling back
+// to its Go representation.
+func extendedJSON(doc bson.D) string {
+	extendedDoc, err := bsonutil.ConvertBSONValueToJSON(doc)
+	if err != nil {
+		return fmt.Sprintf("%v", doc)
+	}
+	out, err := json.Marshal(extendedDoc)
+	if err != nil {
+		return fmt.Sprintf("%v", doc)
+	}
+	return string(out)
+}
+
+func (dest *sessionDestination) updateFormats() updateFormats {
+	return dest.formats
+}
+
+func (dest *sessionDestination) Close() error {
+	dest.session.Close()
+	return nil
+}
@@ -0,0 +1,94 @@
+package mongooplog
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// Exit codes for the kinds of failure of mongooplog, in addition to those in
+// the util package.
+const (
+	// ExitConnectionError means a source or destination could not be reached.
+	ExitConnectionError int = 5
+
+	// ExitApplyError means the destination failed to apply ops.
+	ExitApplyError int = 6
+
+	// ExitOplogGap means the source oplog has rolled over past the start.
+	ExitOplogGap int = 7
+
+	// ExitPreflightFailed means --preflight found ops the destination would
+	// reject.
+	ExitPreflightFailed int = 8
+
+	// ExitResumeBehind means --verifyResume found a destination that doesn't
+	// hold the op at the checkpoint.
+	ExitResumeBehind int = 9
+
+	// ExitCountMismatch means --verifyCounts found a namespace holding a
+	// different number of documents on a destination than on the source.
+	ExitCountMismatch int = 10
+)
+
+// Error is an error returned by mongooplog, along with the exit code for its
+// kind of failure.
+type Error struct {
+	Code int
+	Err  error
+
+	// Details are the diagnostics that led to the error, such as the ops of
+	// a batch that failed, which are logged along with it even with --quiet.
+	Details []string
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// ExitCode returns the exit code for an error returned by New or Run.
+func ExitCode(err error) int {
+	if err == nil {
+		return util.ExitClean
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return util.ExitError
+}
+
+// ErrorDetails returns the diagnostics that led to an error returned by New
+// or Run.
+func ErrorDetails(err error) []string {
+	if e, ok := err.(*Error); ok {
+		return e.Details
+	}
+	return nil
+}
+
+// newError returns an error with the given exit code.
+func newError(code int, format string, a ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// annotateError prefixes the message of err with the given context, keeping
+// its exit code.
+func annotateError(err error, context string) error {
+	if e, ok := err.(*Error); ok {
+		return &Error{Code: e.Code, Err: fmt.Errorf("%v: %v", context, e.Err), Details: e.Details}
+	}
+	return fmt.Errorf("%v: %v", context, err)
+}
+
+// withDetails attaches the diagnostics that led to an error to it, keeping
+// its exit code.
+func withDetails(err error, details []string) error {
+	if len(details) == 0 {
+		return err
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		return &Error{Code: util.ExitError, Err: err, Details: details}
+	}
+	return &Error{Code: e.Code, Err: e.Err, Details: append(append([]string{}, e.Details...), details...)}
+}
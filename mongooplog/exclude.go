@@ -0,0 +1,204 @@
+package mongooplog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/mongorestore/ns"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// excludeFilter matches the oplog entries on the namespaces given with
+// --exclude, which aren't applied. Commands have the namespace <db>.$cmd, so
+// they are only excluded by patterns matching their whole database, such as
+// mydb.*.
+type excludeFilter struct {
+	matcher *ns.Matcher
+}
+
+// newExcludeFilter returns a filter for the namespace patterns, or nil if
+// there are none.
+func newExcludeFilter(patterns []string) (*excludeFilter, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	matcher, err := ns.NewMatcher(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &excludeFilter{matcher: matcher}, nil
+}
+
+// excluded returns whether the entry with the given namespace and op type is
+// excluded. No-ops are never excluded, as merging the oplogs of several
+// sources relies on them.
+func (f *excludeFilter) excluded(namespace, operation string) bool {
+	return f != nil && operation != "n" && f.matcher.Has(namespace)
+}
+
+// oplogEntryHead returns the namespace and op type of a marshaled oplog entry,
+// reading its top-level elements only up to where both are found and skipping
+// the others without decoding them, which, unlike unmarshaling into a struct
+// of the two fields, doesn't decode the document of the op.
+func oplogEntryHead(data []byte) (namespace, operation string, err error) {
+	if len(data) < 5 {
+		return "", "", fmt.Errorf("oplog entry of %v bytes is too short", len(data))
+	}
+	foundNS, foundOp := false, false
+	pos := 4
+	for pos < len(data) && data[pos] != 0 && !(foundNS && foundOp) {
+		kind := data[pos]
+		end := bytes.IndexByte(data[pos+1:], 0)
+		if end < 0 {
+			return "", "", fmt.Errorf("oplog entry has an unterminated field name")
+		}
+		name := string(data[pos+1 : pos+1+end])
+		pos += end + 2
+
+		size, err := bsonValueSize(kind, data[pos:])
+		if err != nil {
+			return "", "", fmt.Errorf("field `%v` of oplog entry: %v", name, err)
+		}
+		if kind == 0x02 && (name == "ns" || name == "op") {
+			value := string(data[pos+4 : pos+size-1])
+			if name == "ns" {
+				namespace, foundNS = value, true
+			} else {
+				operation, foundOp = value, true
+			}
+		}
+		pos += size
+	}
+	return namespace, operation, nil
+}
+
+// bsonValueSize returns the size of a BSON value of the given type at the
+// start of data.
+func bsonValueSize(kind byte, data []byte) (int, error) {
+	int32At := func(pos int) (int, error) {
+		if len(data) < pos+4 {
+			return 0, fmt.Errorf("value is truncated")
+		}
+		return int(int32(binary.LittleEndian.Uint32(data[pos:]))), nil
+	}
+	size := 0
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max and min keys
+	case 0x08: // bool
+		size = 1
+	case 0x10: // int32
+		size = 4
+	case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp and int64
+		size = 8
+	case 0x07: // ObjectId
+		size = 12
+	case 0x13: // decimal
+		size = 16
+	case 0x02, 0x0D, 0x0E: // string, JavaScript and symbol
+		n, err := int32At(0)
+		if err != nil {
+			return 0, err
+		}
+		size = 4 + n
+	case 0x0C: // DBPointer
+		n, err := int32At(0)
+		if err != nil {
+			return 0, err
+		}
+		size = 4 + n + 12
+	case 0x03, 0x04, 0x0F: // document, array and JavaScript with scope
+		n, err := int32At(0)
+		if err != nil {
+			return 0, err
+		}
+		size = n
+	case 0x05: // binary
+		n, err := int32At(0)
+		if err != nil {
+			return 0, err
+		}
+		size = 5 + n
+	case 0x0B: // regular expression, as two C strings
+		pattern := bytes.IndexByte(data, 0)
+		if pattern < 0 {
+			return 0, fmt.Errorf("value is truncated")
+		}
+		options := bytes.IndexByte(data[pattern+1:], 0)
+		if options < 0 {
+			return 0, fmt.Errorf("value is truncated")
+		}
+		size = pattern + options + 2
+	default:
+		return 0, fmt.Errorf("unknown BSON type 0x%x", kind)
+	}
+	if size < 0 || size > len(data) || (kind == 0x02 && size < 5) {
+		return 0, fmt.Errorf("value is truncated")
+	}
+	return size, nil
+}
+
+// excludingOplogIter skips the excluded entries of an oplog read from a
+// server, deciding from the namespace and op type of each before decoding the
+// rest of it, which saves most of the work of decoding the entries skipped on
+// a busy oplog. It reads entries into a *db.Oplog, or into a
+// *bson.Raw to be decoded by another iterator.
+type excludingOplogIter struct {
+	oplogIter
+	filter *excludeFilter
+	skips  *skipCounter
+	err    error
+}
+
+// Next reads the next entry that isn't excluded into result.
+func (it *excludingOplogIter) Next(result interface{}) bool {
+	if it.err != nil {
+		return false
+	}
+	raw := bson.Raw{}
+	for it.oplogIter.Next(&raw) {
+		namespace, operation, err := oplogEntryHead(raw.Data)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if it.filter.excluded(namespace, operation) {
+			it.skips.skip(skipReasonExcluded)
+			continue
+		}
+		switch out := result.(type) {
+		case *bson.Raw:
+			*out = raw
+		case *db.Oplog:
+			*out = db.Oplog{}
+			it.err = raw.Unmarshal(out)
+		default:
+			it.err = fmt.Errorf("can't read an oplog entry into %T", result)
+		}
+		return it.err == nil
+	}
+	return false
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *excludingOplogIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.oplogIter.Err()
+}
+
+// excludeFromSource makes an iterator over the oplog of a source server, as
+// returned by tailSource, skip the excluded entries before decoding them. An
+// iterator reading timestamps from another field decodes the entries left.
+func excludeFromSource(iter oplogIter, filter *excludeFilter, skips *skipCounter) oplogIter {
+	if filter == nil {
+		return iter
+	}
+	if tsIter, ok := iter.(*timestampFieldIter); ok {
+		tsIter.oplogIter = &excludingOplogIter{oplogIter: tsIter.oplogIter, filter: filter, skips: skips}
+		return tsIter
+	}
+	return &excludingOplogIter{oplogIter: iter, filter: filter, skips: skips}
+}
@@ -0,0 +1,202 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// marshaledOplogIter yields oplog entries already marshaled, as a cursor
+// reads them off the wire.
+type marshaledOplogIter struct {
+	entries [][]byte
+}
+
+func newMarshaledOplogIter(entries []bson.D) *marshaledOplogIter {
+	it := &marshaledOplogIter{}
+	for _, entry := range entries {
+		data, err := bson.Marshal(entry)
+		if err != nil {
+			panic(err)
+		}
+		it.entries = append(it.entries, data)
+	}
+	return it
+}
+
+func (it *marshaledOplogIter) Next(result interface{}) bool {
+	if len(it.entries) == 0 {
+		return false
+	}
+	data := it.entries[0]
+	it.entries = it.entries[1:]
+	return bson.Unmarshal(data, result) == nil
+}
+
+func (it *marshaledOplogIter) Err() error    { return nil }
+func (it *marshaledOplogIter) Timeout() bool { return false }
+func (it *marshaledOplogIter) Close() error  { return nil }
+
+// noisyOplog returns entries of which most are inserts of large documents
+// into an excluded database.
+func noisyOplog(count int) []bson.D {
+	payload := make([]bson.D, 20)
+	for i := range payload {
+		payload[i] = bson.D{{"field", i}, {"value", "a string value of some length"}}
+	}
+	entries := []bson.D{}
+	for i := 0; i < count; i++ {
+		ns := "logs.events"
+		if i%10 == 0 {
+			ns = "app.users"
+		}
+		entries = append(entries, bson.D{
+			{"ts", bson.MongoTimestamp(int64(i+1) << 32)},
+			{"h", int64(i)},
+			{"v", 2},
+			{"op", "i"},
+			{"ns", ns},
+			{"o", bson.D{{"_id", i}, {"payload", payload}}},
+		})
+	}
+	return entries
+}
+
+// readNaively reads every entry in full and then skips the excluded ones.
+func readNaively(iter oplogIter, filter *excludeFilter) []db.Oplog {
+	ops := []db.Oplog{}
+	op := db.Oplog{}
+	for iter.Next(&op) {
+		if !filter.excluded(op.Namespace, op.Operation) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func TestExcludeFilter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a filter excluding a database and a collection", t, func() {
+		filter, err := newExcludeFilter([]string{"logs.*", "app.sessions"})
+		So(err, ShouldBeNil)
+
+		Convey("ops on them should be excluded", func() {
+			So(filter.excluded("logs.events", "i"), ShouldBeTrue)
+			So(filter.excluded("logs.$cmd", "c"), ShouldBeTrue)
+			So(filter.excluded("app.sessions", "u"), ShouldBeTrue)
+			So(filter.excluded("app.users", "i"), ShouldBeFalse)
+			So(filter.excluded("app.$cmd", "c"), ShouldBeFalse)
+		})
+
+		Convey("no-ops should never be excluded", func() {
+			So(filter.excluded("logs.events", "n"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Without patterns there should be no filter", t, func() {
+		filter, err := newExcludeFilter(nil)
+		So(err, ShouldBeNil)
+		So(filter, ShouldBeNil)
+		So(filter.excluded("logs.events", "i"), ShouldBeFalse)
+	})
+
+	Convey("Skipping excluded entries before decoding them", t, func() {
+		filter, err := newExcludeFilter([]string{"logs.*"})
+		So(err, ShouldBeNil)
+		entries := noisyOplog(100)
+
+		Convey("should read the same entries as skipping them after", func() {
+			skips := newSkipCounter()
+			iter := excludeFromSource(newMarshaledOplogIter(entries), filter, skips)
+			ops := readNaively(iter, nil)
+			So(iter.Err(), ShouldBeNil)
+			So(len(ops), ShouldEqual, 10)
+			So(ops, ShouldResemble, readNaively(newMarshaledOplogIter(entries), filter))
+			So(skips.Counts(), ShouldResemble, map[string]int64{skipReasonExcluded: 90})
+		})
+
+		Convey("should leave the timestamps of another field to be read", func() {
+			docs := []bson.D{
+				{{"op", "i"}, {"ns", "logs.events"}, {"o", bson.D{{"_id", 1}}}, {"at", bson.MongoTimestamp(1 << 32)}},
+				{{"op", "i"}, {"ns", "app.users"}, {"o", bson.D{{"_id", 2}}}, {"at", bson.MongoTimestamp(2 << 32)}},
+			}
+			iter := excludeFromSource(&timestampFieldIter{oplogIter: newMarshaledOplogIter(docs), field: "at"},
+				filter, newSkipCounter())
+			ops := readNaively(iter, nil)
+			So(iter.Err(), ShouldBeNil)
+			So(len(ops), ShouldEqual, 1)
+			So(ops[0].Namespace, ShouldEqual, "app.users")
+			So(ops[0].Timestamp, ShouldEqual, bson.MongoTimestamp(2<<32))
+		})
+	})
+}
+
+func TestOplogEntryHead(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When reading the namespace and op type of a marshaled entry", t, func() {
+
+		Convey("the fields before them should be skipped whatever their type", func() {
+			data, err := bson.Marshal(bson.D{
+				{"ts", bson.MongoTimestamp(1 << 32)},
+				{"f", 1.5},
+				{"b", true},
+				{"d", bson.D{{"a", 1}}},
+				{"a", []int{1, 2}},
+				{"bin", bson.Binary{Kind: 0, Data: []byte{1, 2, 3}}},
+				{"id", bson.NewObjectId()},
+				{"re", bson.RegEx{Pattern: "^a", Options: "i"}},
+				{"nil", nil},
+				{"i64", int64(1)},
+				{"op", "u"},
+				{"o", bson.D{{"$set", bson.D{{"ns", "not.this"}}}}},
+				{"ns", "app.users"},
+			})
+			So(err, ShouldBeNil)
+			namespace, operation, err := oplogEntryHead(data)
+			So(err, ShouldBeNil)
+			So(namespace, ShouldEqual, "app.users")
+			So(operation, ShouldEqual, "u")
+		})
+
+		Convey("a truncated entry should be an error", func() {
+			data, err := bson.Marshal(bson.D{{"o", bson.D{{"_id", 1}}}, {"ns", "app.users"}})
+			So(err, ShouldBeNil)
+			_, _, err = oplogEntryHead(data[:12])
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func benchmarkExclude(b *testing.B, read func(oplogIter, *excludeFilter) []db.Oplog) {
+	filter, err := newExcludeFilter([]string{"logs.*"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	marshaled := newMarshaledOplogIter(noisyOplog(1000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter := &marshaledOplogIter{entries: marshaled.entries}
+		if ops := read(iter, filter); len(ops) != 100 {
+			b.Fatalf("expected 100 ops, got %v", len(ops))
+		}
+	}
+}
+
+// BenchmarkExcludeNaively decodes every entry of a noisy oplog before
+// skipping the excluded ones, and BenchmarkExcludeBeforeDecoding skips them
+// from their namespace and op type alone.
+func BenchmarkExcludeNaively(b *testing.B) {
+	benchmarkExclude(b, readNaively)
+}
+
+func BenchmarkExcludeBeforeDecoding(b *testing.B) {
+	benchmarkExclude(b, func(iter oplogIter, filter *excludeFilter) []db.Oplog {
+		return readNaively(excludeFromSource(iter, filter, newSkipCounter()), nil)
+	})
+}
@@ -0,0 +1,248 @@
+package mongooplog
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fanOutQueueBatches is the number of batches a destination of a fan-out may
+// fall behind by before applying more ops waits for it.
+const fanOutQueueBatches = 16
+
+// fanOutDestination applies each batch of oplog entries to several
+// destinations at once, as given with --fanOut, so as to build several copies
+// of the source. Each destination applies the batches queued for it on its own
+// goroutine, so that a slow destination only holds up the others once it falls
+// fanOutQueueBatches batches behind.
+type fanOutDestination struct {
+	targets []*fanOutTarget
+
+	// continueOnError is whether to leave a destination behind when it fails
+	// to apply a batch and keep applying to the others, instead of stopping
+	continueOnError bool
+
+	// mu guards the progress of the destinations and the errors below, which
+	// are updated as the destinations apply their batches
+	mu sync.Mutex
+
+	// failed is the error of a destination that failed without
+	// continueOnError, and lastErr that of the last destination to fail
+	failed  error
+	lastErr error
+
+	// closed is whether the destinations are being closed, after which the
+	// batches still queued are dropped
+	closed    bool
+	closeOnce sync.Once
+}
+
+// fanOutTarget is one of the destinations of a fanOutDestination.
+type fanOutTarget struct {
+	host string
+	dest oplogDestination
+
+	// queue holds the batches to apply to the destination, and pending
+	// counts those not yet applied; done is closed once the queue is
+	queue   chan []db.Oplog
+	pending sync.WaitGroup
+	done    chan struct{}
+
+	// applied is the number of ops applied to the destination, and last the
+	// timestamp of the last of them
+	applied int
+	last    bson.MongoTimestamp
+
+	// err is the error the destination failed with, after which no more ops
+	// are applied to it
+	err error
+}
+
+// newFanOutDestination returns a destination that applies ops to each of the
+// destinations added to it.
+func newFanOutDestination(continueOnError bool) *fanOutDestination {
+	return &fanOutDestination{continueOnError: continueOnError}
+}
+
+// add adds a destination to apply ops to, named by its host for logging, and
+// starts applying the batches queued for it.
+func (f *fanOutDestination) add(host string, dest oplogDestination) {
+	target := &fanOutTarget{
+		host:  host,
+		dest:  dest,
+		queue: make(chan []db.Oplog, fanOutQueueBatches),
+		done:  make(chan struct{}),
+	}
+	f.targets = append(f.targets, target)
+	go f.run(target)
+}
+
+// run applies the batches queued for the destination until its queue is
+// closed. Once the destination, or the run, has failed, or the destinations
+// are being closed, the batches left are dropped.
+func (f *fanOutDestination) run(target *fanOutTarget) {
+	defer close(target.done)
+	for ops := range target.queue {
+		f.mu.Lock()
+		skip := target.err != nil || f.failed != nil || f.closed
+		f.mu.Unlock()
+		if !skip {
+			f.record(target, ops, target.dest.apply(ops))
+		}
+		target.pending.Done()
+	}
+}
+
+// record records the outcome of applying a batch to a destination. With
+// continueOnError, a destination that fails is logged and left behind;
+// otherwise its failure stops the run.
+func (f *fanOutDestination) record(target *fanOutTarget, ops []db.Oplog, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		target.applied += len(ops)
+		target.last = ops[len(ops)-1].Timestamp
+		return
+	}
+	err = annotateError(err, fmt.Sprintf("destination `%v`", target.host))
+	target.err = err
+	f.lastErr = err
+	if !f.continueOnError {
+		if f.failed == nil {
+			f.failed = err
+		}
+		return
+	}
+	for _, detail := range ErrorDetails(err) {
+		log.Logv(log.Always, detail)
+	}
+	log.Logvf(log.Always, "%v; no longer applying ops to it, after the last applied with Timestamp %v",
+		err, target.last>>32)
+}
+
+// live returns the destinations that haven't failed.
+func (f *fanOutDestination) live() []*fanOutTarget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	live := []*fanOutTarget{}
+	for _, target := range f.targets {
+		if target.err == nil {
+			live = append(live, target)
+		}
+	}
+	return live
+}
+
+// err returns the error that stops the run: that of a destination that failed
+// without continueOnError, or the last one once every destination has failed.
+func (f *fanOutDestination) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed != nil {
+		return f.failed
+	}
+	for _, target := range f.targets {
+		if target.err == nil {
+			return nil
+		}
+	}
+	return annotateError(f.lastErr, "every destination has failed")
+}
+
+// apply queues the ops for every destination that hasn't failed, waiting only
+// for those whose queues are full. A failure is returned by a later call to
+// apply, or by wait, once the destination has applied the ops.
+func (f *fanOutDestination) apply(ops []db.Oplog) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	// the caller reuses the batch once it has been applied
+	batch := append([]db.Oplog(nil), ops...)
+	for _, target := range f.live() {
+		target.pending.Add(1)
+		target.queue <- batch
+	}
+	return nil
+}
+
+// wait waits for every destination to apply the batches queued for it, and
+// returns the error that stops the run, if any.
+func (f *fanOutDestination) wait() error {
+	for _, target := range f.targets {
+		target.pending.Wait()
+	}
+	return f.err()
+}
+
+// appliedThrough returns the timestamp of the last op applied to every
+// destination that hasn't failed, or zero if there is none yet.
+func (f *fanOutDestination) appliedThrough() bson.MongoTimestamp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var through bson.MongoTimestamp
+	first := true
+	for _, target := range f.targets {
+		if target.err != nil {
+			continue
+		}
+		if first || target.last < through {
+			through = target.last
+			first = false
+		}
+	}
+	return through
+}
+
+// progress describes how far each destination has got.
+func (f *fanOutDestination) progress() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	progress := []string{}
+	for _, target := range f.targets {
+		status := fmt.Sprintf("destination `%v`: %v ops applied, last Timestamp %v",
+			target.host, target.applied, target.last>>32)
+		if target.err != nil {
+			status += fmt.Sprintf(", stopped after error: %v", target.err)
+		} else if sessionDest, ok := target.dest.(*sessionDestination); ok && sessionDest.latencies != nil {
+			status += fmt.Sprintf("; %v", sessionDest.latencies.take())
+		}
+		progress = append(progress, status)
+	}
+	return progress
+}
+
+// updateFormats returns the update formats every destination accepts, so
+// that updates are translated for the oldest of them.
+func (f *fanOutDestination) updateFormats() updateFormats {
+	formats := updateFormats{delta: true, classicMarker: true}
+	for _, target := range f.targets {
+		targetFormats := target.dest.updateFormats()
+		formats.delta = formats.delta && targetFormats.delta
+		formats.classicMarker = formats.classicMarker && targetFormats.classicMarker
+	}
+	return formats
+}
+
+// Close drops the batches still queued, waits for those being applied, and
+// closes every destination.
+func (f *fanOutDestination) Close() error {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		f.closed = true
+		f.mu.Unlock()
+		for _, target := range f.targets {
+			close(target.queue)
+			<-target.done
+		}
+	})
+	var err error
+	for _, target := range f.targets {
+		if closeErr := target.dest.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+// recordingDestination records the ops applied to it, failing once it has
+// been given failAfter batches if failAfter is positive.
+type recordingDestination struct {
+	formats   updateFormats
+	failAfter int
+	batches   [][]db.Oplog
+	closed    bool
+}
+
+func (dest *recordingDestination) apply(ops []db.Oplog) error {
+	if dest.failAfter > 0 && len(dest.batches) >= dest.failAfter {
+		return newError(ExitApplyError, "duplicate key")
+	}
+	dest.batches = append(dest.batches, ops)
+	return nil
+}
+
+func (dest *recordingDestination) updateFormats() updateFormats {
+	return dest.formats
+}
+
+func (dest *recordingDestination) Close() error {
+	dest.closed = true
+	return nil
+}
+
+// blockingDestination applies no ops until unblock is closed.
+type blockingDestination struct {
+	recordingDestination
+	unblock chan struct{}
+}
+
+func (dest *blockingDestination) apply(ops []db.Oplog) error {
+	<-dest.unblock
+	return dest.recordingDestination.apply(ops)
+}
+
+func TestFanOutDestination(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With ops fanned out to several destinations", t, func() {
+		first := &recordingDestination{formats: updateFormats{delta: true}}
+		second := &recordingDestination{formats: updateFormats{classicMarker: true}, failAfter: 1}
+		batch := func(ts int) []db.Oplog {
+			return []db.Oplog{{Timestamp: bson.MongoTimestamp(ts << 32), Operation: "i", Namespace: "test.c"}}
+		}
+
+		Convey("each batch should be applied to every destination", func() {
+			fanOut := newFanOutDestination(false)
+			fanOut.add("first", first)
+			fanOut.add("second", second)
+			So(fanOut.apply(batch(1)), ShouldBeNil)
+			So(fanOut.wait(), ShouldBeNil)
+			So(first.batches, ShouldResemble, [][]db.Oplog{batch(1)})
+			So(second.batches, ShouldResemble, [][]db.Oplog{batch(1)})
+			So(fanOut.appliedThrough(), ShouldEqual, batch(1)[0].Timestamp)
+
+			Convey("and a failure should stop the run", func() {
+				So(fanOut.apply(batch(2)), ShouldBeNil)
+				err := fanOut.wait()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "destination `second`")
+				So(ExitCode(err), ShouldEqual, ExitApplyError)
+			})
+		})
+
+		Convey("updates should be translated for every destination", func() {
+			fanOut := newFanOutDestination(false)
+			fanOut.add("first", first)
+			fanOut.add("second", second)
+			So(fanOut.updateFormats(), ShouldResemble, updateFormats{})
+		})
+
+		Convey("with continueOnError, a failed destination should be left behind", func() {
+			fanOut := newFanOutDestination(true)
+			fanOut.add("first", first)
+			fanOut.add("second", second)
+			So(fanOut.apply(batch(1)), ShouldBeNil)
+			So(fanOut.apply(batch(2)), ShouldBeNil)
+			So(fanOut.apply(batch(3)), ShouldBeNil)
+			So(fanOut.wait(), ShouldBeNil)
+			So(len(first.batches), ShouldEqual, 3)
+			So(len(second.batches), ShouldEqual, 1)
+
+			progress := fanOut.progress()
+			So(progress[0], ShouldEqual, "destination `first`: 3 ops applied, last Timestamp 3")
+			So(progress[1], ShouldStartWith, "destination `second`: 1 ops applied, last Timestamp 1, stopped after error")
+
+			Convey("and the run should stop once every destination has failed", func() {
+				first.failAfter = 3
+				So(fanOut.apply(batch(4)), ShouldBeNil)
+				err := fanOut.wait()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "every destination has failed")
+				So(ExitCode(err), ShouldEqual, ExitApplyError)
+			})
+		})
+
+		Convey("a slow destination should not hold up the others", func() {
+			slow := &blockingDestination{unblock: make(chan struct{})}
+			fanOut := newFanOutDestination(false)
+			fanOut.add("first", first)
+			fanOut.add("slow", slow)
+			So(fanOut.apply(batch(1)), ShouldBeNil)
+			So(fanOut.apply(batch(2)), ShouldBeNil)
+			for i := 0; i < 100 && fanOut.progress()[0] != "destination `first`: 2 ops applied, last Timestamp 2"; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(fanOut.progress()[0], ShouldEqual, "destination `first`: 2 ops applied, last Timestamp 2")
+			So(fanOut.appliedThrough(), ShouldEqual, bson.MongoTimestamp(0))
+
+			close(slow.unblock)
+			So(fanOut.wait(), ShouldBeNil)
+			So(fanOut.appliedThrough(), ShouldEqual, batch(2)[0].Timestamp)
+			So(fanOut.Close(), ShouldBeNil)
+		})
+
+		Convey("closing should close every destination", func() {
+			fanOut := newFanOutDestination(false)
+			fanOut.add("first", first)
+			fanOut.add("second", second)
+			So(fanOut.Close(), ShouldBeNil)
+			So(first.closed && second.closed, ShouldBeTrue)
+		})
+	})
+}
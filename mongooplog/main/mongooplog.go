@@ -2,7 +2,6 @@
 package main
 
 import (
-	"github.com/mongodb/mongo-tools/common/db"
 	"github.com/mongodb/mongo-tools/common/log"
 	"github.com/mongodb/mongo-tools/common/options"
 	"github.com/mongodb/mongo-tools/common/signals"
@@ -19,8 +18,8 @@ func main() {
 	// add the mongooplog-specific options
 	sourceOpts := &mongooplog.SourceOptions{}
 	opts.AddOptions(sourceOpts)
-
-	log.Logvf(log.Always, "warning: mongooplog is deprecated, and will be removed completely in a future release")
+	destOpts := &mongooplog.DestinationOptions{}
+	opts.AddOptions(destOpts)
 
 	// parse the command line options
 	args, err := opts.Parse()
@@ -50,47 +49,46 @@ func main() {
 	log.SetVerbosity(opts.Verbosity)
 	signals.Handle()
 
-	// connect directly, unless a replica set name is explicitly specified
-	_, setName := util.ParseConnectionString(opts.Host)
-	opts.Direct = (setName == "")
-	opts.ReplicaSetName = setName
+	log.Logvf(log.Always, "warning: mongooplog is deprecated, and will be removed completely in a future release")
 
 	// validate the mongooplog options
-	if sourceOpts.From == "" {
-		log.Logvf(log.Always, "command line error: need to specify --from")
+	oplogOpts := mongooplog.Options{
+		Source:      *sourceOpts,
+		Destination: *destOpts,
+		Tool:        opts,
+	}
+	if err := oplogOpts.Validate(); err != nil {
+		logError("command line error: %v", err)
 		os.Exit(util.ExitBadOptions)
 	}
 
-	// create a session provider for the destination server
-	sessionProviderTo, err := db.NewSessionProvider(*opts)
-	defer sessionProviderTo.Close()
+	// initialize mongooplog, connecting to the source and destination
+	oplog, err := mongooplog.New("", "", oplogOpts)
 	if err != nil {
-		log.Logvf(log.Always, "error connecting to destination host: %v", err)
-		os.Exit(util.ExitError)
+		logRunError("", err)
+		os.Exit(mongooplog.ExitCode(err))
 	}
+	defer oplog.Close()
 
-	// create a session provider for the source server
-	opts.Connection.Host = sourceOpts.From
-	opts.Connection.Port = ""
-	sessionProviderFrom, err := db.NewSessionProvider(*opts)
-	defer sessionProviderFrom.Close()
-	if err != nil {
-		log.Logvf(log.Always, "error connecting to source host: %v", err)
-		os.Exit(util.ExitError)
+	// kick it off
+	if err := oplog.Run(); err != nil {
+		logRunError("error: ", err)
+		os.Exit(mongooplog.ExitCode(err))
 	}
 
-	// initialize mongooplog
-	oplog := mongooplog.MongoOplog{
-		ToolOptions:         opts,
-		SourceOptions:       sourceOpts,
-		SessionProviderFrom: sessionProviderFrom,
-		SessionProviderTo:   sessionProviderTo,
-	}
+}
 
-	// kick it off
-	if err := oplog.Run(); err != nil {
-		log.Logvf(log.Always, "error: %v", err)
-		os.Exit(util.ExitError)
+// logRunError logs an error returned by mongooplog, after the diagnostics
+// that led to it, even when --quiet suppresses all other output.
+func logRunError(prefix string, err error) {
+	for _, detail := range mongooplog.ErrorDetails(err) {
+		logError("%v", detail)
 	}
+	logError("%v%v", prefix, err)
+}
 
+// logError logs an error even when --quiet suppresses all other output.
+func logError(format string, a ...interface{}) {
+	log.SetVerbosity(nil)
+	log.Logvf(log.Always, format, a...)
 }
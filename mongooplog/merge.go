@@ -0,0 +1,106 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+)
+
+// oplogIter is an iterator over oplog entries, such as a tailing cursor on a
+// source server's oplog.
+type oplogIter interface {
+	Next(result interface{}) bool
+	Err() error
+	Timeout() bool
+	Close() error
+}
+
+// mergedOplogIter merges the oplogs of several sources, such as the shards of a
+// sharded cluster, into a single stream ordered by timestamp. An entry is only
+// yielded once every source has an entry available, so that no source can
+// later produce an entry that should have come before it. Sources that are idle
+// hold up the stream until they write an entry, which the periodic no-ops
+// written by the server guarantee; no-ops must therefore be filtered out after
+// merging rather than before.
+type mergedOplogIter struct {
+	iters []oplogIter
+
+	// heads holds the next entry from each source, or nil if it has yet to be
+	// read
+	heads []*db.Oplog
+
+	// done marks the sources that have been exhausted
+	done []bool
+
+	err error
+}
+
+func newMergedOplogIter(iters []oplogIter) *mergedOplogIter {
+	return &mergedOplogIter{
+		iters: iters,
+		heads: make([]*db.Oplog, len(iters)),
+		done:  make([]bool, len(iters)),
+	}
+}
+
+// Next reads the entry with the lowest timestamp across all sources into the
+// result, which must be a *db.Oplog. It returns false once every source is
+// exhausted or if any source fails.
+func (m *mergedOplogIter) Next(result interface{}) bool {
+	if m.err != nil {
+		return false
+	}
+	for i, iter := range m.iters {
+		if m.heads[i] != nil || m.done[i] {
+			continue
+		}
+		head := &db.Oplog{}
+		// a tailing cursor times out when its source is idle, but can be
+		// resumed; keep waiting on it so that ordering is preserved
+		for !iter.Next(head) {
+			if err := iter.Err(); err != nil {
+				m.err = err
+				return false
+			}
+			if !iter.Timeout() {
+				m.done[i] = true
+				head = nil
+				break
+			}
+		}
+		m.heads[i] = head
+	}
+
+	next := -1
+	for i, head := range m.heads {
+		if head != nil && (next < 0 || head.Timestamp < m.heads[next].Timestamp) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return false
+	}
+	*result.(*db.Oplog) = *m.heads[next]
+	m.heads[next] = nil
+	return true
+}
+
+// Err returns the first error encountered by any of the sources.
+func (m *mergedOplogIter) Err() error {
+	return m.err
+}
+
+// Timeout always returns false, since timeouts of the underlying sources are
+// waited out.
+func (m *mergedOplogIter) Timeout() bool {
+	return false
+}
+
+// Close closes all of the sources, returning the first error encountered.
+func (m *mergedOplogIter) Close() error {
+	var err error
+	for _, iter := range m.iters {
+		if closeErr := iter.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
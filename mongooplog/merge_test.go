@@ -0,0 +1,80 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// fakeOplogIter yields a fixed list of entries, timing out once before each
+// entry when timeouts is set.
+type fakeOplogIter struct {
+	entries  []db.Oplog
+	timeouts bool
+	timedOut bool
+	closed   bool
+}
+
+func (f *fakeOplogIter) Next(result interface{}) bool {
+	if len(f.entries) == 0 {
+		f.timedOut = false
+		return false
+	}
+	if f.timeouts && !f.timedOut {
+		f.timedOut = true
+		return false
+	}
+	f.timedOut = false
+	*result.(*db.Oplog) = f.entries[0]
+	f.entries = f.entries[1:]
+	return true
+}
+
+func (f *fakeOplogIter) Err() error    { return nil }
+func (f *fakeOplogIter) Timeout() bool { return f.timedOut }
+func (f *fakeOplogIter) Close() error {
+	f.closed = true
+	return nil
+}
+
+func fakeEntries(shard string, timestamps ...int) []db.Oplog {
+	entries := []db.Oplog{}
+	for _, ts := range timestamps {
+		entries = append(entries, db.Oplog{
+			Timestamp: bson.MongoTimestamp(ts),
+			Operation: "i",
+			Namespace: shard + ".data",
+		})
+	}
+	return entries
+}
+
+func TestMergedOplogIter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When merging the oplogs of several shards", t, func() {
+		shardA := &fakeOplogIter{entries: fakeEntries("a", 1, 4, 5, 9)}
+		shardB := &fakeOplogIter{entries: fakeEntries("b", 2, 3, 8), timeouts: true}
+		shardC := &fakeOplogIter{entries: fakeEntries("c", 6, 7)}
+		merged := newMergedOplogIter([]oplogIter{shardA, shardB, shardC})
+
+		Convey("entries should be yielded in timestamp order", func() {
+			timestamps := []bson.MongoTimestamp{}
+			entry := &db.Oplog{}
+			for merged.Next(entry) {
+				timestamps = append(timestamps, entry.Timestamp)
+			}
+			So(merged.Err(), ShouldBeNil)
+			So(timestamps, ShouldResemble,
+				[]bson.MongoTimestamp{1, 2, 3, 4, 5, 6, 7, 8, 9})
+		})
+
+		Convey("closing should close every shard", func() {
+			So(merged.Close(), ShouldBeNil)
+			So(shardA.closed && shardB.closed && shardC.closed, ShouldBeTrue)
+		})
+	})
+}
@@ -3,15 +3,28 @@ package mongooplog
 
 import (
 	"fmt"
+	"github.com/mongodb/mongo-tools/common/bsonutil"
 	"github.com/mongodb/mongo-tools/common/db"
 	"github.com/mongodb/mongo-tools/common/log"
 	"github.com/mongodb/mongo-tools/common/options"
 	"github.com/mongodb/mongo-tools/common/util"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// initialRetryDelay is how long to wait before retrying a failed applyOps
+	// for the first time.
+	initialRetryDelay = 500 * time.Millisecond
+
+	// maxRetryDelay caps the backoff between applyOps retries.
+	maxRetryDelay = 30 * time.Second
+)
+
 // MongoOplog is a container for the user-specified options for running mongooplog.
 type MongoOplog struct {
 	// standard tool options
@@ -20,180 +33,716 @@ type MongoOplog struct {
 	// mongooplog-specific options
 	SourceOptions *SourceOptions
 
+	// mongooplog-specific options for the destination server
+	DestinationOptions *DestinationOptions
+
 	// session provider for the source server
 	SessionProviderFrom *db.SessionProvider
 
+	// session providers for each shard listed in --mergeShards, used in place
+	// of SessionProviderFrom when set
+	ShardSessionProviders []*db.SessionProvider
+
 	// session provider for the destination server
 	SessionProviderTo *db.SessionProvider
+
+	// session providers for each host listed in --fanOut, to which ops are
+	// applied as well as to the destination server
+	FanOutSessionProviders []*db.SessionProvider
+
+	// Transform, if set, is called on each oplog entry before it is applied
+	Transform Transform
+
+	// counts of the oplog entries that were not applied, by reason
+	skips *skipCounter
+
+	// the namespaces whose oplog entries are not applied
+	exclude *excludeFilter
+
+	// the timestamp of the latest oplog entry applied
+	applied appliedTimestamp
+}
+
+// Transform rewrites an oplog entry before it is applied to the destination.
+// It may modify and return the entry it is given, or return a different one.
+// Returning a nil entry drops it, and returning an error stops mongooplog.
+type Transform func(*db.Oplog) (*db.Oplog, error)
+
+// SkippedOps returns the number of oplog entries that were not applied to the
+// destination, by the reason they were skipped.
+func (mo *MongoOplog) SkippedOps() map[string]int64 {
+	if mo.skips == nil {
+		return map[string]int64{}
+	}
+	return mo.skips.Counts()
+}
+
+// LastApplied returns the timestamp of the latest oplog entry applied to the
+// destination, or written to --out, or zero if there is none yet. It is updated
+// after each batch is applied, only ever moves forward, and may be called while
+// Run runs, such as to check the health of an embedded mongooplog. With
+// --checkpoint, it starts at the checkpoint and moves on once the checkpoint of
+// each batch is saved, so it matches the checkpoint file. With --fanOut, it is
+// the last op every destination has applied.
+func (mo *MongoOplog) LastApplied() bson.MongoTimestamp {
+	return mo.applied.get()
 }
 
 // Run executes the mongooplog program.
 func (mo *MongoOplog) Run() error {
 
-	// split up the oplog namespace we are using
-	oplogDB, oplogColl, err :=
-		util.SplitAndValidateNamespace(mo.SourceOptions.OplogNS)
+	mo.skips = newSkipCounter()
 
+	// split up the oplog namespaces we are using
+	namespaces, err := splitOplogNamespaces(mo.SourceOptions.OplogNS)
 	if err != nil {
 		return err
 	}
-
-	// the full oplog namespace needs to be specified
-	if oplogColl == "" {
-		return fmt.Errorf("the oplog namespace must specify a collection")
+	if len(namespaces) == 0 {
+		namespaces = []oplogNamespace{{"local", "oplog.rs"}}
 	}
 
-	log.Logvf(log.DebugLow, "using oplog namespace `%v.%v`", oplogDB, oplogColl)
+	for _, ns := range namespaces {
+		log.Logvf(log.DebugLow, "using oplog namespace `%v`", ns)
+	}
 
-	// connect to the destination server
-	toSession, err := mo.SessionProviderTo.GetSession()
+	mo.exclude, err = newExcludeFilter(mo.SourceOptions.Exclude)
 	if err != nil {
-		return fmt.Errorf("error connecting to destination db: %v", err)
+		return err
 	}
-	defer toSession.Close()
-	toSession.SetSocketTimeout(0)
 
-	// purely for logging
-	destServerStr := mo.ToolOptions.Host
-	if mo.ToolOptions.Port != "" {
-		destServerStr = destServerStr + ":" + mo.ToolOptions.Port
+	// connect to the destination server, or open the output file
+	var dest oplogDestination
+	if mo.DestinationOptions.Out != "" {
+		dest, err = newOplogFileWriter(mo.DestinationOptions.Out)
+	} else {
+		dest, err = mo.connectDestination()
 	}
-	log.Logvf(log.DebugLow, "successfully connected to destination server `%v`", destServerStr)
-
-	// connect to the source server
-	fromSession, err := mo.SessionProviderFrom.GetSession()
 	if err != nil {
-		return fmt.Errorf("error connecting to source db: %v", err)
+		return err
+	}
+	defer dest.Close()
+	formats := dest.updateFormats()
+
+	// resume after the last op applied by a previous run
+	var checkpoint *oplogCheckpoint
+	var resumeAfter bson.MongoTimestamp
+	if mo.SourceOptions.Checkpoint != "" {
+		checkpoint = &oplogCheckpoint{path: mo.SourceOptions.Checkpoint}
+		resumeAfter, err = checkpoint.load()
+		if err != nil {
+			return err
+		}
+		if resumeAfter != 0 {
+			log.Logvf(log.Always, "resuming after checkpoint with Timestamp: %v", resumeAfter>>32)
+		}
+		mo.applied.advance(resumeAfter)
+		if resumeAfter != 0 && mo.SourceOptions.VerifyResume {
+			if err := mo.verifyResume(dest, namespaces, resumeAfter); err != nil {
+				return err
+			}
+		}
 	}
-	defer fromSession.Close()
-	fromSession.SetSocketTimeout(0)
-
-	log.Logvf(log.DebugLow, "successfully connected to source server `%v`", mo.SourceOptions.From)
 
-	// set slave ok
-	fromSession.SetMode(mgo.Eventual, true)
+	// read the ops from a file, or else tail the oplogs of the source servers
+	var tail oplogIter
+	var startTs bson.MongoTimestamp
+
+	// with --preflight, read a live source only up to its latest op
+	var preflightStop bson.MongoTimestamp
+	live := false
+	if mo.SourceOptions.Ops != "" {
+		ops, err := readOpsFile(mo.SourceOptions.Ops)
+		if err != nil {
+			return err
+		}
+		log.Logvf(log.Always, "applying the %v oplog entries in `%v`", len(ops), mo.SourceOptions.Ops)
+		tail = &sliceOplogIter{ops: ops}
+	} else if mo.SourceOptions.In != "" {
+		if mo.SourceOptions.StartTs != "" {
+			if startTs, err = parseTimestamp(mo.SourceOptions.StartTs); err != nil {
+				return fmt.Errorf("invalid --startTs: %v", err)
+			}
+		}
+		// seek past the ops before the start or the checkpoint, whichever is
+		// later
+		seekTs := startTs
+		if resumeAfter != 0 && resumeAfter >= seekTs {
+			seekTs = resumeAfter + 1
+		}
+		log.Logvf(log.DebugLow, "reading oplog entries from `%v`", mo.SourceOptions.In)
+		tail, err = openOplogFile(mo.SourceOptions.In, seekTs)
+		if err != nil {
+			return err
+		}
+	} else {
+		// tail the oplogs of the shards to merge, or else the single source server
+		providers := []*db.SessionProvider{mo.SessionProviderFrom}
+		hosts := []string{mo.SourceOptions.From}
+		if len(mo.ShardSessionProviders) > 0 {
+			providers = mo.ShardSessionProviders
+			hosts = mo.SourceOptions.MergeShards
+		}
+		// tail every oplog namespace of every source
+		live = true
+		iters := []oplogIter{}
+		for i, provider := range providers {
+			for _, ns := range namespaces {
+				fromSession, iter, err := mo.resumeSource(provider, hosts[i], ns.db, ns.coll, checkpoint, resumeAfter)
+				if err != nil {
+					return err
+				}
+				defer fromSession.Close()
+				// preflight reads up to the latest op, which mustn't be
+				// skipped before it is seen
+				if !mo.DestinationOptions.Preflight {
+					iter = excludeFromSource(iter, mo.exclude, mo.skips)
+				}
+				iters = append(iters, iter)
+
+				if mo.DestinationOptions.Preflight {
+					oplog := fromSession.DB(ns.db).C(ns.coll)
+					latest, err := latestOplogTimestamp(oplog, mo.SourceOptions.TimestampField)
+					if err != nil {
+						return newError(ExitConnectionError, "error finding the latest op of `%v` on `%v`: %v",
+							ns, hosts[i], err)
+					}
+					// a source with no ops since the start has none to read
+					if resumeAfter != 0 && latest <= resumeAfter ||
+						resumeAfter == 0 && latest < oplogThreshold(mo.SourceOptions) {
+						continue
+					}
+					if preflightStop == 0 || latest < preflightStop {
+						preflightStop = latest
+					}
+				}
+			}
+		}
 
-	// get the tailing cursor for the source server's oplog
-	tail := buildTailingCursor(fromSession.DB(oplogDB).C(oplogColl),
-		mo.SourceOptions)
+		tail = iters[0]
+		if len(iters) > 1 {
+			log.Logvf(log.DebugLow, "merging %v oplogs of %v sources by timestamp", len(iters), len(providers))
+			tail = newMergedOplogIter(iters)
+		}
+	}
 	defer tail.Close()
 
+	if mo.DestinationOptions.Preflight {
+		return mo.preflight(dest, tail, startTs, resumeAfter, preflightStop, live)
+	}
+
 	// read the cursor dry, applying ops to the destination
 	// server in the process
 	oplogEntry := &db.Oplog{}
-	res := &db.ApplyOpsResponse{}
 
 	log.Logv(log.DebugLow, "applying oplog entries...")
 
 	oplogChan := make(chan db.Oplog)
 	timer := time.NewTicker(5 * time.Second)
+	skipTimer := time.NewTicker(skipLogInterval)
+	defer skipTimer.Stop()
+	progressTimer := time.NewTicker(progressLogInterval)
+	defer progressTimer.Stop()
+	meter := newThroughputMeter(time.Now())
+
+	// report the skipped ops when done, however we got there
+	defer func() {
+		if mo.skips.total() > 0 {
+			log.Logvf(log.Always, "skipped oplog entries: %v", mo.skips)
+		}
+	}()
 
-	opCount := 0
+	// opCount counts the ops sent to be applied, which the tailing goroutine
+	// adds to while batches are applied
+	var opCount int64
+	var tailErr error
 	go func() {
+		defer close(oplogChan)
 		for tail.Next(oplogEntry) {
+			meter.addRead(1)
 
 			// skip noops
 			if oplogEntry.Operation == "n" {
 				log.Logvf(log.DebugHigh, "skipping no-op for namespace `%v`", oplogEntry.Namespace)
+				mo.skips.skip(skipReasonNoop)
+				continue
+			}
+
+			// skip ops on excluded namespaces, unless the iterators over
+			// the oplogs of source servers have already skipped them
+			if mo.exclude.excluded(oplogEntry.Namespace, oplogEntry.Operation) {
+				mo.skips.skip(skipReasonExcluded)
+				continue
+			}
+
+			// skip ops before the requested start
+			if oplogEntry.Timestamp < startTs {
+				mo.skips.skip(skipReasonStartTs)
+				continue
+			}
+
+			// skip ops applied before the checkpoint
+			if oplogEntry.Timestamp <= resumeAfter {
+				mo.skips.skip(skipReasonCheckpoint)
 				continue
 			}
 
 			oplogChan <- *oplogEntry
-			opCount++
 
 			// print the first oplog to confirm with the target's latest oplog.
-			if opCount == 1 {
+			if atomic.AddInt64(&opCount, 1) == 1 {
 				log.Logvf(log.Always, "Got first oplog with Timestamp: %v", oplogEntry.Timestamp>>32)
 				log.Logvf(log.Always, "If this newer than target's last oplog, stop this.")
 			}
 		}
 
 		// make sure there was no tailing error
-		if err := tail.Err(); err != nil {
-			log.Logvf(log.Always, "error querying oplog: %v", err)
+		if tailErr = tail.Err(); tailErr != nil {
 			return
 		}
 
-		log.Logvf(log.DebugLow, "done applying %v oplog entries", opCount)
+		log.Logvf(log.DebugLow, "done applying %v oplog entries", atomic.LoadInt64(&opCount))
+		log.Logvf(log.DebugLow, "skipped %v oplog entries (%v)", mo.skips.total(), mo.skips)
 		return
 	}()
 
-	opsToApply := []db.Oplog{}
-	maxSize := 10000
+	batch := newOplogBatch(maxBatchOps, maxBatchBytes)
+
+	// the namespaces to compare with the source once done
+	var counted *countedNamespaces
+	if mo.DestinationOptions.VerifyCounts {
+		counted = newCountedNamespaces()
+	}
+
+	// record the last op applied, which the destinations of a fan-out apply
+	// in the background, so only the ops every one of them has applied count
+	record := func(last bson.MongoTimestamp) error {
+		if fanOut, ok := dest.(*fanOutDestination); ok {
+			last = fanOut.appliedThrough()
+		}
+		if last <= mo.applied.get() {
+			return nil
+		}
+		if checkpoint != nil {
+			if err := checkpoint.save(last); err != nil {
+				return err
+			}
+		}
+		mo.applied.advance(last)
+		return nil
+	}
+
+	// apply the batch, recording the last op in it once it has been applied
+	flush := func() error {
+		last := batch.ops[len(batch.ops)-1].Timestamp
+		applied := len(batch.ops)
+		if err := applyBatch(dest, batch, atomic.LoadInt64(&opCount)); err != nil {
+			return err
+		}
+		meter.addApplied(applied)
+		return record(last)
+	}
+
 	for {
 		select {
+		case <-skipTimer.C:
+			if mo.skips.total() > 0 {
+				log.Logvf(log.Info, "skipped oplog entries so far: %v", mo.skips)
+			}
+
+		case <-progressTimer.C:
+			log.Logvf(log.Always, "%v", meter.take(time.Now()))
+			switch castDest := dest.(type) {
+			case *sessionDestination:
+				if castDest.latencies != nil {
+					log.Logvf(log.Always, "%v", castDest.latencies.take())
+				}
+			case *fanOutDestination:
+				for _, progress := range castDest.progress() {
+					log.Logvf(log.Always, "%v", progress)
+				}
+			}
+
 		case <-timer.C:
-			if len(opsToApply) == 0 {
+			if batch.empty() {
 				continue
 			}
 
-			// apply the operation
-			err := toSession.Run(bson.M{"applyOps": opsToApply}, res)
+			if err := flush(); err != nil {
+				return err
+			}
+
+		case opEntry, ok := <-oplogChan:
+			if !ok {
+				// the source is exhausted; apply what is left
+				if !batch.empty() {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				if fanOut, ok := dest.(*fanOutDestination); ok {
+					if err := fanOut.wait(); err != nil {
+						return err
+					}
+					if err := record(0); err != nil {
+						return err
+					}
+				}
+				if tailErr != nil {
+					if mo.SourceOptions.In != "" {
+						return fmt.Errorf("error reading `%v`: %v", mo.SourceOptions.In, tailErr)
+					}
+					return newError(ExitConnectionError, "error querying oplog: %v", tailErr)
+				}
+				if counted != nil {
+					return mo.verifyCounts(dest, counted)
+				}
+				return nil
+			}
+
+			// give the caller a chance to rewrite or drop the op
+			sourceNS := opEntry.Namespace
+			opEntry, keep, err := mo.transform(opEntry)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
 
+			// rewrite updates the destination can't apply as they are
+			opEntry, err = translateUpdate(opEntry, formats)
 			if err != nil {
-				return fmt.Errorf("error applying ops: %v", err)
+				return err
 			}
 
-			// check the server's response for an issue
-			if !res.Ok {
-				return fmt.Errorf("server gave error applying ops: %v", res.ErrMsg)
+			// skip ops the destination would reject for their size
+			oversized, err := mo.oversized(opEntry)
+			if err != nil {
+				return err
+			}
+			if oversized {
+				continue
 			}
 
-			log.Logvf(log.Always, "%v oplogs have been applied, total: %v. Last: %v", len(opsToApply), opCount, opsToApply[len(opsToApply)-1].Timestamp>>32)
+			size, err := oplogSize(opEntry)
+			if err != nil {
+				return err
+			}
 
-			// reset the opsToApply silce
-			opsToApply = opsToApply[:0]
+			// if the op would push the batch over the size limit, send.
+			if !batch.fits(size) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
 
-		case opEntry := <-oplogChan:
 			// prepare the op to be applied
-			opsToApply = append(opsToApply, opEntry)
+			batch.add(opEntry, size)
+			if counted != nil {
+				counted.observe(sourceNS, opEntry)
+			}
 
 			// if there are too many oplogs, send.
-			if len(opsToApply) >= maxSize {
-				// apply the operation
-				err := toSession.Run(bson.M{"applyOps": opsToApply}, res)
-
-				if err != nil {
-					return fmt.Errorf("error applying ops: %v", err)
+			if batch.full() {
+				if err := flush(); err != nil {
+					return err
 				}
+			}
+		}
+	}
+}
 
-				// check the server's response for an issue
-				if !res.Ok {
-					return fmt.Errorf("server gave error applying ops: %v", res.ErrMsg)
-				}
+// oplogNamespace is a namespace holding oplog entries to tail.
+type oplogNamespace struct {
+	db, coll string
+}
 
-				log.Logvf(log.Always, "%v oplogs have been applied, total: %v. Last: %v", len(opsToApply), opCount, opEntry.Timestamp>>32)
+func (ns oplogNamespace) String() string {
+	return ns.db + "." + ns.coll
+}
 
-				// reset the opsToApply silce
-				opsToApply = opsToApply[:0]
-			}
+// splitOplogNamespaces splits and validates the namespaces given in --oplogns,
+// each of which must name a collection.
+func splitOplogNamespaces(namespaces []string) ([]oplogNamespace, error) {
+	split := []oplogNamespace{}
+	seen := map[string]bool{}
+	for _, namespace := range namespaces {
+		oplogDB, oplogColl, err := util.SplitAndValidateNamespace(namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		// the full oplog namespace needs to be specified
+		if oplogColl == "" {
+			return nil, fmt.Errorf("the oplog namespace `%v` must specify a collection", namespace)
+		}
+		if seen[namespace] {
+			return nil, fmt.Errorf("the oplog namespace `%v` is given more than once", namespace)
 		}
+		seen[namespace] = true
+		split = append(split, oplogNamespace{oplogDB, oplogColl})
+	}
+	return split, nil
+}
+
+// transform applies the Transform, if any, to an op, returning the op to apply
+// and whether it should be applied at all.
+func (mo *MongoOplog) transform(op db.Oplog) (db.Oplog, bool, error) {
+	if mo.Transform == nil {
+		return op, true, nil
+	}
+	transformed, err := mo.Transform(&op)
+	if err != nil {
+		return op, false, fmt.Errorf("error transforming op on `%v` with Timestamp %v: %v",
+			op.Namespace, op.Timestamp>>32, err)
+	}
+	if transformed == nil {
+		log.Logvf(log.DebugHigh, "transform dropped op on `%v`", op.Namespace)
+		mo.skips.skip(skipReasonTransform)
+		return op, false, nil
+	}
+	return *transformed, true, nil
+}
+
+// oversized returns whether the document of an op is larger than
+// --maxDocSize, logging and counting it as skipped if so.
+func (mo *MongoOplog) oversized(op db.Oplog) (bool, error) {
+	maxDocSize := mo.DestinationOptions.MaxDocSize
+	if maxDocSize <= 0 {
+		return false, nil
+	}
+	size, err := documentSize(op)
+	if err != nil || size <= maxDocSize {
+		return false, err
+	}
+	log.Logvf(log.Always, "skipping op `%v` on `%v` with Timestamp %v on %v: its document of %v bytes "+
+		"is larger than --maxDocSize %v", op.Operation, op.Namespace, op.Timestamp>>32, opDocument(op), size, maxDocSize)
+	mo.skips.skip(skipReasonOversized)
+	return true, nil
+}
+
+// tailSource connects to a source server and returns a tailing cursor over its
+// oplog, or another capped collection of oplog entries whose timestamps are in
+// tsField, starting from the threshold. The returned session must be closed by
+// the caller.
+func tailSource(provider *db.SessionProvider, host, oplogDB, oplogColl, tsField string,
+	threshold bson.MongoTimestamp, allowGaps bool) (*mgo.Session, oplogIter, error) {
+
+	// connect to the source server
+	fromSession, err := provider.GetSession()
+	if err != nil {
+		return nil, nil, newError(ExitConnectionError, "error connecting to source db `%v`: %v", host, err)
+	}
+	fromSession.SetSocketTimeout(0)
+
+	log.Logvf(log.DebugLow, "successfully connected to source server `%v`", host)
+
+	// set slave ok
+	fromSession.SetMode(mgo.Eventual, true)
+
+	// make sure the oplog exists and hasn't rolled over past where we start
+	oplog := fromSession.DB(oplogDB).C(oplogColl)
+	err = checkOplogCollection(oplog)
+	if err != nil {
+		fromSession.Close()
+		return nil, nil, annotateError(err, fmt.Sprintf("source `%v`", host))
+	}
+	err = checkOplogRollover(oplog, tsField, threshold, allowGaps)
+	if err != nil {
+		fromSession.Close()
+		return nil, nil, annotateError(err, fmt.Sprintf("source `%v`", host))
+	}
+
+	// get the tailing cursor for the source server's oplog
+	iter := buildTailingCursor(oplog, tsField, threshold)
+	if tsField != defaultTimestampField {
+		return fromSession, &timestampFieldIter{oplogIter: iter, field: tsField}, nil
+	}
+	return fromSession, iter, nil
+}
+
+// applyBatch sends the ops in the batch to the destination and empties the
+// batch.
+func applyBatch(dest oplogDestination, batch *oplogBatch, opCount int64) error {
+	if err := dest.apply(batch.ops); err != nil {
+		return err
+	}
+
+	log.Logvf(log.Always, "%v oplogs have been applied, total: %v. Last: %v", len(batch.ops), opCount, batch.ops[len(batch.ops)-1].Timestamp>>32)
+
+	// reset the batch
+	batch.reset()
+	return nil
+}
+
+// applyOpsCommand builds the applyOps command for the ops, with the options
+// requested for the destination.
+func applyOpsCommand(ops []db.Oplog, destOptions *DestinationOptions) bson.D {
+	command := bson.D{{"applyOps", ops}}
+	if destOptions.BypassDocumentValidation {
+		command = append(command, bson.DocElem{"bypassDocumentValidation", true})
+	}
+	if destOptions.AlwaysUpsert != "" {
+		command = append(command, bson.DocElem{"alwaysUpsert", destOptions.AlwaysUpsert == "true"})
 	}
+	return command
+}
+
+// isTransientError returns whether the error is due to the connection to the
+// server, and so may succeed if retried, as opposed to an error in applying
+// the ops themselves such as a duplicate key error.
+func isTransientError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return db.IsConnectionError(err) || isFailoverError(err)
+}
+
+// notPrimaryCodes are the codes of the errors returned by a server that is no
+// longer, or not yet, the primary: NotMaster, NotMasterNoSlaveOk,
+// PrimarySteppedDown, InterruptedDueToReplStateChange, InterruptedAtShutdown
+// and ShutdownInProgress.
+var notPrimaryCodes = map[int]bool{
+	10107: true,
+	13435: true,
+	189:   true,
+	11602: true,
+	11600: true,
+	91:    true,
 }
 
-// get the cursor for the oplog collection, based on the options
-// passed in to mongooplog
-func buildTailingCursor(oplog *mgo.Collection,
-	sourceOptions *SourceOptions) *mgo.Iter {
+// isFailoverError returns whether the error says that the server isn't the
+// primary, or that there is no primary to connect to, as happens while a
+// replica set fails over.
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if queryErr, ok := err.(*mgo.QueryError); ok && notPrimaryCodes[queryErr.Code] {
+		return true
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "not master") ||
+		msg == db.ErrNoReachableServers ||
+		strings.HasPrefix(msg, db.ErrCouldNotContactPrimaryPrefix) ||
+		strings.HasPrefix(msg, db.ErrCouldNotFindPrimaryPrefix)
+}
+
+// nextRetryDelay doubles the delay between retries, up to maxRetryDelay.
+func nextRetryDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
 
-	// how many seconds in the past we need
-	secondsInPast := time.Duration(sourceOptions.Seconds) * time.Second
+// get the cursor for the oplog collection, starting from the given
+// threshold
+func buildTailingCursor(oplog *mgo.Collection, tsField string,
+	threshold bson.MongoTimestamp) *mgo.Iter {
+
+	// build the oplog query
+	oplogQuery := bson.M{
+		tsField: bson.M{
+			"$gte": threshold,
+		},
+	}
+
+	// the oplogReplay optimization only applies to the ts field of the oplog
+	query := oplog.Find(oplogQuery)
+	if tsField == defaultTimestampField {
+		query = query.LogReplay()
+	}
+
+	// wait up to 10min for an new oplog
+	return query.Tail(600 * time.Second)
+}
+
+// oplogThreshold returns the timestamp from which oplog entries are applied,
+// based on the options passed in to mongooplog
+func oplogThreshold(sourceOptions *SourceOptions) bson.MongoTimestamp {
 	// the time threshold for oplog queries
-	threshold := time.Now().Add(-secondsInPast)
+	threshold := time.Now().Add(-sourceOptions.lookback())
 	// convert to a unix timestamp (seconds since epoch)
 	thresholdAsUnix := threshold.Unix()
 
 	// shift it appropriately, to prepare it to be converted to an
 	// oplog timestamp
-	thresholdShifted := uint64(thresholdAsUnix) << 32
+	return bson.MongoTimestamp(uint64(thresholdAsUnix) << 32)
+}
 
-	// build the oplog query
-	oplogQuery := bson.M{
-		"ts": bson.M{
-			"$gte": bson.MongoTimestamp(thresholdShifted),
-		},
+// checkOplogCollection makes sure that the oplog collection exists and is
+// capped, since tailing anything else silently yields no entries.
+func checkOplogCollection(oplog *mgo.Collection) error {
+	collInfo, err := db.GetCollectionOptions(oplog)
+	if err != nil {
+		return fmt.Errorf("error checking oplog collection `%v`: %v", oplog.FullName, err)
+	}
+	if collInfo == nil {
+		return fmt.Errorf("oplog collection `%v` not found; is the source a replica set?", oplog.FullName)
+	}
+	if !isCapped(collInfo) {
+		return fmt.Errorf("oplog collection `%v` is not capped and can't be tailed", oplog.FullName)
 	}
+	return nil
+}
 
-	// wait up to 10min for an new oplog
-	return oplog.Find(oplogQuery).LogReplay().Tail(600 * time.Second)
+// isCapped returns whether the collection info returned by listCollections
+// describes a capped collection.
+func isCapped(collInfo *bson.D) bool {
+	collOptions, err := bsonutil.FindValueByKey("options", collInfo)
+	if err != nil {
+		return false
+	}
+	optionsDoc, ok := collOptions.(bson.D)
+	if !ok {
+		return false
+	}
+	capped, err := bsonutil.FindValueByKey("capped", &optionsDoc)
+	return err == nil && util.IsTruthy(capped)
+}
+
+// checkOplogRollover makes sure that the source oplog still contains the
+// entries from the threshold onwards. If it has rolled over past the threshold,
+// it returns an error unless gaps are allowed, in which case it only warns.
+func checkOplogRollover(oplog *mgo.Collection, tsField string, threshold bson.MongoTimestamp, allowGaps bool) error {
+	oldest := bson.M{}
+	err := oplog.Find(nil).Sort("$natural").Limit(1).Select(bson.M{tsField: 1}).One(oldest)
+	if err == mgo.ErrNotFound {
+		// an empty oplog has nothing to miss
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error finding oldest oplog entry: %v", err)
+	}
+	oldestTimestamp, ok := oldest[tsField].(bson.MongoTimestamp)
+	if !ok {
+		return fmt.Errorf("oldest oplog entry has no timestamp in `%v`", tsField)
+	}
+
+	gap := oplogGap(threshold, oldestTimestamp)
+	if gap <= 0 {
+		return nil
+	}
+
+	rollover := fmt.Sprintf("the source oplog has rolled over: the oldest entry "+
+		"is from %v but entries from %v were requested, so %v of history is lost",
+		time.Unix(int64(oldestTimestamp>>32), 0), time.Unix(int64(threshold>>32), 0), gap)
+	if !allowGaps {
+		return withDetails(newError(ExitOplogGap, "source oplog is missing %v of history; "+
+			"use --allowGaps to apply the remaining entries anyway", gap), []string{rollover})
+	}
+	log.Logvf(log.Always, "warning: %v", rollover)
+	return nil
+}
+
+// oplogGap returns how much history is missing between the threshold and the
+// oldest available oplog entry, or 0 if there is none.
+func oplogGap(threshold, oldest bson.MongoTimestamp) time.Duration {
+	if oldest <= threshold {
+		return 0
+	}
+	return time.Duration((oldest>>32)-(threshold>>32)) * time.Second
 }
@@ -1,13 +1,19 @@
 package mongooplog
 
 import (
+	"fmt"
 	"github.com/mongodb/mongo-tools/common/db"
 	"github.com/mongodb/mongo-tools/common/options"
 	"github.com/mongodb/mongo-tools/common/testutil"
+	"github.com/mongodb/mongo-tools/common/util"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBasicOps(t *testing.T) {
@@ -34,15 +40,19 @@ func TestBasicOps(t *testing.T) {
 
 		// specify localhost:33333 as the source host
 		sourceOpts = &SourceOptions{
-			Seconds: 84600,            // the default
-			OplogNS: "local.oplog.rs", // the default
+			Seconds: 84600,                      // the default
+			OplogNS: []string{"local.oplog.rs"}, // the default
 		}
 
 		Convey("all operations should be applied correctly, without"+
 			" error", func() {
 
 			// set the "oplog" we will use
-			sourceOpts.OplogNS = "mongooplog_test.oplog"
+			sourceOpts.OplogNS = []string{"mongooplog_test.oplog"}
+
+			// the fake oplog's first entry is in the future, which would
+			// otherwise look like the oplog has rolled over
+			sourceOpts.AllowGaps = true
 
 			// initialize a session provider for the source
 			sourceSP, err := db.NewSessionProvider(*opts)
@@ -113,6 +123,7 @@ func TestBasicOps(t *testing.T) {
 			oplog := MongoOplog{
 				ToolOptions:         opts,
 				SourceOptions:       sourceOpts,
+				DestinationOptions:  &DestinationOptions{},
 				SessionProviderFrom: sourceSP,
 				SessionProviderTo:   destSP,
 			}
@@ -133,3 +144,311 @@ func TestBasicOps(t *testing.T) {
 	})
 
 }
+
+func TestOplogGap(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When comparing the start threshold to the oldest oplog entry", t, func() {
+		threshold := bson.MongoTimestamp(1000 << 32)
+
+		Convey("there should be no gap if the oldest entry is older", func() {
+			So(oplogGap(threshold, bson.MongoTimestamp(900<<32)), ShouldEqual, 0)
+			So(oplogGap(threshold, threshold), ShouldEqual, 0)
+		})
+
+		Convey("the gap should be the history lost if the oplog has rolled"+
+			" over", func() {
+			So(oplogGap(threshold, bson.MongoTimestamp(1090<<32|5)),
+				ShouldEqual, 90*time.Second)
+		})
+	})
+}
+
+func TestApplyOpsRetry(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When applying ops fails", t, func() {
+
+		Convey("network errors should be retried", func() {
+			So(isTransientError(io.EOF), ShouldBeTrue)
+			So(isTransientError(fmt.Errorf(db.ErrNoReachableServers)), ShouldBeTrue)
+			So(isTransientError(&net.OpError{Op: "read", Err: fmt.Errorf("connection reset by peer")}), ShouldBeTrue)
+		})
+
+		Convey("errors applying the ops should not be retried", func() {
+			So(isTransientError(fmt.Errorf("E11000 duplicate key error")), ShouldBeFalse)
+		})
+
+		Convey("errors from a destination without a primary should be retried as failovers", func() {
+			So(isFailoverError(&mgo.QueryError{Code: 10107, Message: "not master"}), ShouldBeTrue)
+			So(isFailoverError(&mgo.QueryError{Code: 189, Message: "primary stepped down"}), ShouldBeTrue)
+			So(isFailoverError(fmt.Errorf("not master and slaveOk=false")), ShouldBeTrue)
+			So(isFailoverError(fmt.Errorf(db.ErrNoReachableServers)), ShouldBeTrue)
+			So(isTransientError(&mgo.QueryError{Code: 11602, Message: "interrupted"}), ShouldBeTrue)
+			So(isFailoverError(io.EOF), ShouldBeFalse)
+			So(isFailoverError(&mgo.QueryError{Code: 11000, Message: "E11000 duplicate key error"}), ShouldBeFalse)
+		})
+
+		Convey("the backoff should double up to the maximum delay", func() {
+			So(nextRetryDelay(initialRetryDelay), ShouldEqual, 2*initialRetryDelay)
+			So(nextRetryDelay(maxRetryDelay/2+time.Second), ShouldEqual, maxRetryDelay)
+		})
+	})
+}
+
+func TestApplyOpsCommand(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When building the applyOps command", t, func() {
+		ops := []db.Oplog{{Operation: "i", Namespace: "test.data"}}
+
+		Convey("no options should be set by default", func() {
+			command := applyOpsCommand(ops, &DestinationOptions{})
+			So(command, ShouldResemble, bson.D{{"applyOps", ops}})
+		})
+
+		Convey("the requested options should follow the ops", func() {
+			command := applyOpsCommand(ops, &DestinationOptions{
+				BypassDocumentValidation: true,
+				AlwaysUpsert:             "true",
+			})
+			So(command, ShouldResemble, bson.D{
+				{"applyOps", ops},
+				{"bypassDocumentValidation", true},
+				{"alwaysUpsert", true},
+			})
+		})
+
+		Convey("upserting should be turned off when asked", func() {
+			command := applyOpsCommand(ops, &DestinationOptions{AlwaysUpsert: "false"})
+			So(command, ShouldResemble, bson.D{{"applyOps", ops}, {"alwaysUpsert", false}})
+		})
+	})
+}
+
+func TestApplyOpsFailure(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a batch that failed on its second op", t, func() {
+		ops := []db.Oplog{
+			{Operation: "i", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+			{Operation: "u", Namespace: "test.data", Object: bson.D{{"$set", bson.D{{"a", 1}}}}, Query: bson.D{{"_id", 2}}},
+			{Operation: "d", Namespace: "test.data", Object: bson.D{{"_id", 3}}},
+		}
+		raw, err := bson.Marshal(bson.D{
+			{"applied", 2},
+			{"code", 11000},
+			{"errmsg", "E11000 duplicate key error"},
+			{"results", []bool{true, false}},
+			{"ok", 0},
+		})
+		So(err, ShouldBeNil)
+		res := &db.ApplyOpsResponse{}
+		So(bson.Unmarshal(raw, res), ShouldBeNil)
+
+		Convey("the response should capture the per-op results", func() {
+			So(res.Ok, ShouldBeFalse)
+			So(res.Code, ShouldEqual, 11000)
+			So(res.Applied, ShouldEqual, 2)
+			So(failedOps(res), ShouldResemble, []int{1})
+		})
+
+		Convey("the summary should say how much of the batch was applied", func() {
+			So(applyOpsSummary(len(ops), res), ShouldEqual, " (code 11000; 2 of 3 ops attempted, 1 failed)")
+			So(applyOpsSummary(len(ops), &db.ApplyOpsResponse{}), ShouldEqual, "")
+		})
+
+		Convey("the failed op should be identified by its _id", func() {
+			So(opID(ops[1]), ShouldEqual, 2)
+			So(opID(ops[2]), ShouldEqual, 3)
+			So(opID(db.Oplog{Operation: "c"}), ShouldEqual, "unknown")
+			So(opDocument(ops[1]), ShouldEqual, "the document with _id 2")
+		})
+
+		Convey("the failed op should be described along with the error", func() {
+			So(describeFailedOps(ops, res), ShouldResemble, []string{"op 2 of 3 in batch failed: op `u` " +
+				"on `test.data` with Timestamp 0, on the document with _id 2"})
+		})
+
+		Convey("updates and deletes without an _id should be identified by their criteria", func() {
+			update := db.Oplog{Operation: "u", Query: bson.D{{"seq", 7}}, Object: bson.D{{"$set", bson.D{{"a", 1}}}}}
+			So(opCriteria(update), ShouldResemble, bson.D{{"seq", 7}})
+			So(opDocument(update), ShouldEqual, `the document matching {"seq":7}`)
+			remove := db.Oplog{Operation: "d", Object: bson.D{{"seq", 8}}}
+			So(opCriteria(remove), ShouldResemble, bson.D{{"seq", 8}})
+			So(opCriteria(db.Oplog{Operation: "i", Object: bson.D{{"seq", 9}}}), ShouldBeNil)
+			So(opDocument(db.Oplog{Operation: "c"}), ShouldEqual, "an unknown document")
+		})
+	})
+}
+
+func TestIsCapped(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When checking the oplog collection's info", t, func() {
+
+		Convey("capped collections should be recognized", func() {
+			So(isCapped(&bson.D{
+				{"name", "oplog.rs"},
+				{"options", bson.D{{"capped", true}, {"size", 1024}}},
+			}), ShouldBeTrue)
+		})
+
+		Convey("other collections should not be", func() {
+			So(isCapped(&bson.D{{"name", "oplog.rs"}, {"options", bson.D{}}}), ShouldBeFalse)
+			So(isCapped(&bson.D{{"name", "oplog.rs"}}), ShouldBeFalse)
+			So(isCapped(&bson.D{
+				{"name", "oplog.rs"},
+				{"options", bson.D{{"capped", false}}},
+			}), ShouldBeFalse)
+		})
+	})
+}
+
+func TestSplitOplogNamespaces(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When splitting the oplog namespaces", t, func() {
+
+		Convey("each should be split into its database and collection", func() {
+			namespaces, err := splitOplogNamespaces([]string{"local.oplog.rs", "changes.log.0"})
+			So(err, ShouldBeNil)
+			So(namespaces, ShouldResemble, []oplogNamespace{{"local", "oplog.rs"}, {"changes", "log.0"}})
+			So(namespaces[1].String(), ShouldEqual, "changes.log.0")
+		})
+
+		Convey("namespaces without a collection or given twice should be rejected", func() {
+			_, err := splitOplogNamespaces([]string{"local"})
+			So(err, ShouldNotBeNil)
+			_, err = splitOplogNamespaces([]string{"changes.log", "changes.log"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestExitCode(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("Errors should map to the exit code of their kind of failure", t, func() {
+		So(ExitCode(nil), ShouldEqual, util.ExitClean)
+		So(ExitCode(fmt.Errorf("generic")), ShouldEqual, util.ExitError)
+		So(ExitCode(newError(ExitApplyError, "apply")), ShouldEqual, ExitApplyError)
+
+		Convey("annotating an error should keep its exit code", func() {
+			err := annotateError(newError(ExitOplogGap, "gap"), "source `a`")
+			So(err.Error(), ShouldEqual, "source `a`: gap")
+			So(ExitCode(err), ShouldEqual, ExitOplogGap)
+			So(ExitCode(annotateError(fmt.Errorf("other"), "b")), ShouldEqual, util.ExitError)
+		})
+
+		Convey("the diagnostics attached to an error should be kept with it", func() {
+			err := withDetails(newError(ExitApplyError, "apply"), []string{"op 1 failed"})
+			err = annotateError(withDetails(err, []string{"op 2 failed"}), "destination `a`")
+			So(ErrorDetails(err), ShouldResemble, []string{"op 1 failed", "op 2 failed"})
+			So(ExitCode(err), ShouldEqual, ExitApplyError)
+			So(ErrorDetails(fmt.Errorf("other")), ShouldBeNil)
+			So(ExitCode(withDetails(fmt.Errorf("other"), []string{"why"})), ShouldEqual, util.ExitError)
+		})
+	})
+}
+
+func TestTransform(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a transform on the ops to apply", t, func() {
+		mo := &MongoOplog{skips: newSkipCounter()}
+		op := db.Oplog{
+			Timestamp: bson.MongoTimestamp(1 << 32),
+			Operation: "i",
+			Namespace: "test.users",
+			Object:    bson.D{{"_id", 1}},
+		}
+
+		Convey("ops should be unchanged without a transform", func() {
+			result, keep, err := mo.transform(op)
+			So(err, ShouldBeNil)
+			So(keep, ShouldBeTrue)
+			So(result, ShouldResemble, op)
+		})
+
+		Convey("ops should be applied as rewritten", func() {
+			mo.Transform = func(op *db.Oplog) (*db.Oplog, error) {
+				op.Object = append(op.Object, bson.DocElem{"migratedAt", 1})
+				return op, nil
+			}
+			result, keep, err := mo.transform(op)
+			So(err, ShouldBeNil)
+			So(keep, ShouldBeTrue)
+			So(result.Object, ShouldResemble, bson.D{{"_id", 1}, {"migratedAt", 1}})
+		})
+
+		Convey("ops the transform drops should be skipped", func() {
+			mo.Transform = func(op *db.Oplog) (*db.Oplog, error) {
+				return nil, nil
+			}
+			_, keep, err := mo.transform(op)
+			So(err, ShouldBeNil)
+			So(keep, ShouldBeFalse)
+			So(mo.skips.Counts()[skipReasonTransform], ShouldEqual, 1)
+		})
+
+		Convey("a transform error should stop the run", func() {
+			mo.Transform = func(op *db.Oplog) (*db.Oplog, error) {
+				return nil, fmt.Errorf("bad op")
+			}
+			_, keep, err := mo.transform(op)
+			So(keep, ShouldBeFalse)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "bad op")
+		})
+	})
+}
+
+func TestOversized(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a maximum document size for the destination", t, func() {
+		mo := &MongoOplog{
+			DestinationOptions: &DestinationOptions{MaxDocSize: 100},
+			skips:              newSkipCounter(),
+		}
+		op := db.Oplog{
+			Timestamp: bson.MongoTimestamp(1 << 32),
+			Operation: "i",
+			Namespace: "test.users",
+			Object:    bson.D{{"_id", 1}},
+		}
+
+		Convey("ops with smaller documents should be applied", func() {
+			oversized, err := mo.oversized(op)
+			So(err, ShouldBeNil)
+			So(oversized, ShouldBeFalse)
+			So(mo.skips.total(), ShouldEqual, 0)
+		})
+
+		Convey("ops with larger documents should be skipped and counted", func() {
+			op.Object = append(op.Object, bson.DocElem{"name", strings.Repeat("x", 100)})
+			oversized, err := mo.oversized(op)
+			So(err, ShouldBeNil)
+			So(oversized, ShouldBeTrue)
+			So(mo.skips.Counts()[skipReasonOversized], ShouldEqual, 1)
+		})
+
+		Convey("no op should be skipped without a maximum", func() {
+			mo.DestinationOptions.MaxDocSize = 0
+			op.Object = append(op.Object, bson.DocElem{"name", strings.Repeat("x", 100)})
+			oversized, err := mo.oversized(op)
+			So(err, ShouldBeNil)
+			So(oversized, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,354 @@
+package mongooplog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/options"
+	"github.com/mongodb/mongo-tools/common/util"
+	"gopkg.in/mgo.v2"
+)
+
+// defaultOplogNS is the oplog namespace used when none is given.
+const defaultOplogNS = "local.oplog.rs"
+
+// defaultDialTimeout is the dial timeout in seconds used when none is given.
+const defaultDialTimeout = 3
+
+// Options holds the settings for a MongoOplog created with New.
+type Options struct {
+	// Source holds the settings for reading from the source server. Unlike
+	// on the command line, a zero Seconds starts from the current time, a
+	// missing OplogNS defaults to local.oplog.rs and a missing TimestampField
+	// defaults to ts.
+	Source SourceOptions
+
+	// Destination holds the settings for applying to the destination
+	// server. Unlike on the command line, a zero RetryAttempts disables
+	// retries, a zero FailoverTimeout disables waiting out failovers, and a
+	// zero PreflightSamples checks no documents against validators.
+	Destination DestinationOptions
+
+	// Tool holds the settings shared by the source and destination
+	// connections, such as SSL and the default credentials. If nil,
+	// defaults are used.
+	Tool *options.ToolOptions
+
+	// Transform, if set, is called on each oplog entry before it is
+	// applied, and can rewrite or drop it.
+	Transform Transform
+}
+
+// Validate checks that the options describe a single source.
+func (opts *Options) Validate() error {
+	sources := 0
+	for _, set := range []bool{
+		opts.Source.From != "",
+		len(opts.Source.MergeShards) != 0,
+		opts.Source.In != "",
+		opts.Source.Ops != "",
+	} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0:
+		return fmt.Errorf("need to specify --from, --mergeShards, --in or --ops")
+	case sources > 1:
+		return fmt.Errorf("can only specify one of --from, --mergeShards, --in and --ops")
+	case opts.Source.Ops != "" && opts.Source.Checkpoint != "":
+		return fmt.Errorf("--checkpoint can't be used with --ops")
+	case opts.Source.CheckpointFallback && (opts.Source.Checkpoint == "" || opts.Source.In != ""):
+		return fmt.Errorf("--checkpointFallback can only be used with --checkpoint when tailing a source")
+	case opts.Source.VerifyResume && (opts.Source.Checkpoint == "" || opts.Destination.Out != ""):
+		return fmt.Errorf("--verifyResume can only be used with --checkpoint when applying ops to a destination")
+	case opts.Source.StartTs != "" && opts.Source.In == "":
+		return fmt.Errorf("--startTs can only be used with --in")
+	case opts.Source.Since != "" && opts.Source.From == "" && len(opts.Source.MergeShards) == 0:
+		return fmt.Errorf("--since can only be used with --from or --mergeShards")
+	case opts.Destination.MaxDocSize < 0:
+		return fmt.Errorf("--maxDocSize must not be negative")
+	case opts.Destination.FailoverTimeout < 0:
+		return fmt.Errorf("--failoverTimeout must not be negative")
+	case len(opts.Destination.FanOut) != 0 && opts.Destination.Out != "":
+		return fmt.Errorf("--fanOut can't be used with --out")
+	case opts.Destination.ContinueOnError && len(opts.Destination.FanOut) == 0 && opts.Destination.WriteConcern == "":
+		return fmt.Errorf("--continueOnError can only be used with --fanOut or --writeConcern")
+	case opts.Destination.ContinueOnError && len(opts.Destination.FanOut) != 0 && opts.Source.Checkpoint != "":
+		// the checkpoint would move on past the ops a destination left behind
+		// never applied
+		return fmt.Errorf("--checkpoint can't be used with --fanOut and --continueOnError")
+	case opts.Destination.WriteConcern != "" && opts.Destination.Out != "":
+		return fmt.Errorf("--writeConcern can't be used with --out")
+	case opts.Destination.BulkInserts && opts.Destination.Out != "":
+		return fmt.Errorf("--bulkInserts can't be used with --out")
+	case opts.Destination.UnorderedInserts && !opts.Destination.BulkInserts:
+		return fmt.Errorf("--unorderedInserts can only be used with --bulkInserts")
+	case opts.Destination.VerifyCounts && (opts.Source.From == "" && len(opts.Source.MergeShards) == 0 ||
+		opts.Destination.Out != "" || opts.Destination.Preflight):
+		return fmt.Errorf("--verifyCounts can only be used with --from or --mergeShards when applying ops to a destination")
+	case opts.Destination.Preflight && opts.Destination.Out != "":
+		return fmt.Errorf("--preflight can't be used with --out")
+	case opts.Destination.PreflightSamples < 0:
+		return fmt.Errorf("--preflightSamples must not be negative")
+	case opts.Source.hasSSLOverrides() && opts.Source.From == "" && len(opts.Source.MergeShards) == 0:
+		return fmt.Errorf("--sourceSslCAFile, --sourceSslPEMKeyFile and --sourceSslPEMKeyPassword can only be used with --from or --mergeShards")
+	case strings.ContainsAny(opts.Source.TimestampField, ".$"):
+		return fmt.Errorf("--timestampField must name a top-level field")
+	}
+	if _, err := splitOplogNamespaces(opts.Source.OplogNS); err != nil {
+		return err
+	}
+	if _, err := newExcludeFilter(opts.Source.Exclude); err != nil {
+		return fmt.Errorf("invalid --exclude: %v", err)
+	}
+	if opts.Destination.WriteConcern != "" {
+		if err := validateWriteConcern(opts.Destination.WriteConcern); err != nil {
+			return fmt.Errorf("invalid --writeConcern: %v", err)
+		}
+	}
+	if opts.Source.StartTs != "" {
+		if _, err := parseTimestamp(opts.Source.StartTs); err != nil {
+			return fmt.Errorf("invalid --startTs: %v", err)
+		}
+	}
+	if opts.Source.Since != "" {
+		if _, err := parseSince(opts.Source.Since); err != nil {
+			return fmt.Errorf("invalid --since: %v", err)
+		}
+	}
+	return nil
+}
+
+// New creates a MongoOplog that applies the oplog of the server at sourceURI to
+// the server at destURI. The URIs are either mongodb:// connection strings or
+// host strings as accepted by --host. Credentials in a URI take precedence over
+// those in opts. An empty sourceURI uses opts.Source.From or MergeShards, and an
+// empty destURI uses the host and port of opts.Tool. If opts.Destination.Out is
+// set, ops are written to that file and no destination server is used, and if
+// opts.Source.In or Ops is set, ops are read from that file instead of a source
+// server.
+func New(sourceURI, destURI string, opts Options) (*MongoOplog, error) {
+	toolOpts := opts.Tool
+	if toolOpts == nil {
+		toolOpts = options.New("mongooplog", Usage,
+			options.EnabledOptions{Auth: true, Connection: true, Namespace: false})
+		toolOpts.Connection.Timeout = defaultDialTimeout
+	}
+
+	sourceOpts := opts.Source
+	if len(sourceOpts.OplogNS) == 0 {
+		sourceOpts.OplogNS = []string{defaultOplogNS}
+	}
+	if sourceOpts.TimestampField == "" {
+		sourceOpts.TimestampField = defaultTimestampField
+	}
+	if sourceURI != "" {
+		host, auth, err := parseConnectionURI(sourceURI)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing source URI: %v", err)
+		}
+		sourceOpts.From = host
+		if auth.Username != "" {
+			sourceOpts.SourceUsername = auth.Username
+			sourceOpts.SourcePassword = auth.Password
+		}
+		if auth.Source != "" {
+			sourceOpts.SourceAuthDB = auth.Source
+		}
+	}
+
+	destOpts := opts.Destination
+	var destHost, destPort string
+	if toolOpts.Connection != nil {
+		destHost, destPort = toolOpts.Host, toolOpts.Port
+	}
+	if destURI != "" {
+		host, auth, err := parseConnectionURI(destURI)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing destination URI: %v", err)
+		}
+		destHost, destPort = host, ""
+		if auth.Username != "" {
+			destOpts.DestUsername = auth.Username
+			destOpts.DestPassword = auth.Password
+		}
+		if auth.Source != "" {
+			destOpts.DestAuthDB = auth.Source
+		}
+	}
+
+	validated := Options{Source: sourceOpts, Destination: destOpts}
+	if err := validated.Validate(); err != nil {
+		return nil, err
+	}
+
+	// the source may have its own certificates, when it is in a different
+	// PKI domain than the destination; check that the certificate files of
+	// both can be read before connecting, to fail with a clearer error than
+	// the SSL handshake gives
+	sourceToolOpts := *toolOpts
+	sourceToolOpts.SSL = sourceOpts.SSL(toolOpts.SSL)
+	if sourceOpts.From != "" || len(sourceOpts.MergeShards) != 0 {
+		if err := checkSSLFiles(sourceToolOpts.SSL); err != nil {
+			return nil, fmt.Errorf("error with source SSL options: %v", err)
+		}
+	}
+	if destOpts.Out == "" {
+		if err := checkSSLFiles(toolOpts.SSL); err != nil {
+			return nil, fmt.Errorf("error with destination SSL options: %v", err)
+		}
+	}
+
+	// create a session provider for the destination server, which the tool
+	// options describe as they do on the command line, unless ops are written
+	// to a file instead
+	destToolOpts := hostToolOptions(*toolOpts, destHost, destPort, destOpts.Auth(toolOpts.Auth))
+	var sessionProviderTo *db.SessionProvider
+	if destOpts.Out == "" {
+		var err error
+		sessionProviderTo, err = db.NewSessionProvider(destToolOpts)
+		if err != nil {
+			return nil, newError(ExitConnectionError, "error connecting to destination host: %v", err)
+		}
+	}
+
+	mo := &MongoOplog{
+		ToolOptions:        &destToolOpts,
+		SourceOptions:      &sourceOpts,
+		DestinationOptions: &destOpts,
+		SessionProviderTo:  sessionProviderTo,
+		Transform:          opts.Transform,
+	}
+
+	// create a session provider for each host to fan out to, which may give
+	// its own credentials in a URI; the host strings replace the URIs so that
+	// credentials aren't logged
+	destOpts.FanOut = append([]string{}, destOpts.FanOut...)
+	for i, uri := range destOpts.FanOut {
+		host, auth, err := parseConnectionURI(uri)
+		if err != nil {
+			mo.Close()
+			return nil, fmt.Errorf("error parsing --fanOut URI: %v", err)
+		}
+		destOpts.FanOut[i] = host
+		fanOutAuth := overrideAuth(destOpts.Auth(toolOpts.Auth), auth.Username, auth.Password, auth.Source)
+		provider, err := newSessionProvider(*toolOpts, host, "", fanOutAuth)
+		if err != nil {
+			mo.Close()
+			return nil, newError(ExitConnectionError, "error connecting to destination host `%v`: %v", host, err)
+		}
+		mo.FanOutSessionProviders = append(mo.FanOutSessionProviders, provider)
+	}
+
+	// create a session provider for the source server, or for each of the
+	// shards whose oplogs are merged
+	sourceAuth := sourceOpts.Auth(toolOpts.Auth)
+	for _, host := range sourceOpts.MergeShards {
+		provider, err := newSessionProvider(sourceToolOpts, host, "", sourceAuth)
+		if err != nil {
+			mo.Close()
+			return nil, newError(ExitConnectionError, "error connecting to source host `%v`: %v", host, err)
+		}
+		mo.ShardSessionProviders = append(mo.ShardSessionProviders, provider)
+	}
+	if sourceOpts.From != "" {
+		var err error
+		mo.SessionProviderFrom, err = newSessionProvider(sourceToolOpts, sourceOpts.From, "", sourceAuth)
+		if err != nil {
+			mo.Close()
+			return nil, newError(ExitConnectionError, "error connecting to source host: %v", err)
+		}
+	}
+	return mo, nil
+}
+
+// Close closes the session providers of the MongoOplog.
+func (mo *MongoOplog) Close() {
+	providers := []*db.SessionProvider{mo.SessionProviderFrom, mo.SessionProviderTo}
+	providers = append(providers, mo.ShardSessionProviders...)
+	for _, provider := range append(providers, mo.FanOutSessionProviders...) {
+		if provider != nil {
+			provider.Close()
+		}
+	}
+}
+
+// newSessionProvider creates a session provider for the given host, using the
+// base tool options with the host and credentials replaced.
+func newSessionProvider(base options.ToolOptions, host, port string, auth *options.Auth) (*db.SessionProvider, error) {
+	return db.NewSessionProvider(hostToolOptions(base, host, port, auth))
+}
+
+// hostToolOptions returns a copy of the base tool options that connects to the
+// given host with the given credentials.
+func hostToolOptions(base options.ToolOptions, host, port string, auth *options.Auth) options.ToolOptions {
+	timeout := defaultDialTimeout
+	if base.Connection != nil {
+		timeout = base.Connection.Timeout
+	}
+	base.Connection = &options.Connection{
+		Host:    host,
+		Port:    port,
+		Timeout: timeout,
+	}
+	base.Auth = auth
+
+	// connect directly, unless a replica set name is explicitly specified
+	_, setName := util.ParseConnectionString(host)
+	base.Direct = (setName == "")
+	base.ReplicaSetName = setName
+	return base
+}
+
+// checkSSLFiles checks that the certificate files named by the SSL options, if
+// SSL is used, exist and can be read.
+func checkSSLFiles(ssl *options.SSL) error {
+	if ssl == nil || !ssl.UseSSL {
+		return nil
+	}
+	for _, file := range []struct{ name, path string }{
+		{"CA file", ssl.SSLCAFile},
+		{"PEM key file", ssl.SSLPEMKeyFile},
+		{"CRL file", ssl.SSLCRLFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		f, err := os.Open(file.path)
+		if err != nil {
+			return fmt.Errorf("can't read %v: %v", file.name, err)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// parseConnectionURI returns the host string and credentials given by a
+// mongodb:// URI, or the string itself if it is a plain host string.
+func parseConnectionURI(uri string) (string, options.Auth, error) {
+	if !strings.HasPrefix(uri, "mongodb://") {
+		return uri, options.Auth{}, nil
+	}
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return "", options.Auth{}, err
+	}
+	host := strings.Join(info.Addrs, ",")
+	if info.ReplicaSetName != "" {
+		host = info.ReplicaSetName + "/" + host
+	}
+	auth := options.Auth{
+		Username:  info.Username,
+		Password:  info.Password,
+		Source:    info.Source,
+		Mechanism: info.Mechanism,
+	}
+	if auth.Source == "" && info.Username != "" {
+		auth.Source = info.Database
+	}
+	return host, auth, nil
+}
@@ -0,0 +1,249 @@
+package mongooplog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/json"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogFileWriter writes oplog entries to a file rather than applying them to
+// a server. Entries are written as a stream of BSON documents, or as one
+// extended JSON document per line if the file name ends in .json, and are
+// gzipped if the name ends in .gz.
+type oplogFileWriter struct {
+	path string
+	json bool
+	file *os.File
+	gzip *gzip.Writer
+	out  *bufio.Writer
+}
+
+// oplogFileFormat returns whether the file at path holds extended JSON rather
+// than BSON, and whether it is gzipped, based on its name.
+func oplogFileFormat(path string) (isJSON, isGzip bool) {
+	if strings.HasSuffix(path, ".gz") {
+		path = strings.TrimSuffix(path, ".gz")
+		isGzip = true
+	}
+	return strings.HasSuffix(path, ".json"), isGzip
+}
+
+// newOplogFileWriter opens the file at path for appending, creating it if
+// needed.
+func newOplogFileWriter(path string) (*oplogFileWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening output file: %v", err)
+	}
+	w := &oplogFileWriter{
+		path: path,
+		file: file,
+	}
+	isJSON, isGzip := oplogFileFormat(path)
+	var out io.Writer = file
+	if isGzip {
+		w.gzip = gzip.NewWriter(file)
+		out = w.gzip
+	}
+	w.json = isJSON
+	w.out = bufio.NewWriter(out)
+	return w, nil
+}
+
+// apply writes the ops to the file and flushes them, so that the file holds
+// every batch that has been reported as applied.
+func (w *oplogFileWriter) apply(ops []db.Oplog) error {
+	for _, op := range ops {
+		raw, err := w.marshal(op)
+		if err != nil {
+			return newError(ExitApplyError, "error writing ops: %v", err)
+		}
+		if _, err := w.out.Write(raw); err != nil {
+			return newError(ExitApplyError, "error writing ops: %v", err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		return newError(ExitApplyError, "error writing ops: %v", err)
+	}
+	return nil
+}
+
+// marshal returns the op as it is written to the file.
+func (w *oplogFileWriter) marshal(op db.Oplog) ([]byte, error) {
+	raw, err := bson.Marshal(op)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling oplog entry: %v", err)
+	}
+	if !w.json {
+		return raw, nil
+	}
+	doc := bson.D{}
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("error unmarshaling oplog entry: %v", err)
+	}
+	extendedDoc, err := bsonutil.ConvertBSONValueToJSON(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error converting BSON to extended JSON: %v", err)
+	}
+	jsonOut, err := json.Marshal(extendedDoc)
+	if err != nil {
+		return nil, fmt.Errorf("error converting BSON to extended JSON: %v", err)
+	}
+	return append(jsonOut, '\n'), nil
+}
+
+func (w *oplogFileWriter) flush() error {
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	if w.gzip != nil {
+		return w.gzip.Flush()
+	}
+	return nil
+}
+
+// updateFormats accepts every format, since the entries are stored as they
+// were read from the source.
+func (w *oplogFileWriter) updateFormats() updateFormats {
+	return updateFormats{delta: true, classicMarker: true}
+}
+
+// Close flushes any buffered output and closes the file.
+func (w *oplogFileWriter) Close() error {
+	err := w.flush()
+	if w.gzip != nil {
+		if closeErr := w.gzip.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := w.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// oplogFileReader reads back the oplog entries in a file written by an
+// oplogFileWriter, in the order they were written. It implements oplogIter so
+// that the entries are applied the same way as those tailed from a server.
+type oplogFileReader struct {
+	file *os.File
+	gzip *gzip.Reader
+
+	// bson is set for BSON files, and lines for extended JSON files
+	bson  *db.DecodedBSONSource
+	lines *bufio.Scanner
+	line  int
+
+	err error
+}
+
+// newOplogFileReader opens the file at path for reading.
+func newOplogFileReader(path string) (*oplogFileReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	r := &oplogFileReader{file: file}
+	isJSON, isGzip := oplogFileFormat(path)
+	var in io.Reader = file
+	if isGzip {
+		if r.gzip, err = gzip.NewReader(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error reading gzipped input file: %v", err)
+		}
+		in = r.gzip
+	}
+	if isJSON {
+		r.lines = bufio.NewScanner(in)
+		r.lines.Buffer(make([]byte, 64*1024), db.MaxBSONSize*2)
+	} else {
+		r.bson = db.NewDecodedBSONSource(db.NewBSONSource(ioutil.NopCloser(in)))
+	}
+	return r, nil
+}
+
+// Next reads the next entry into the result, which must be a *db.Oplog. It
+// returns false at the end of the file or on error.
+func (r *oplogFileReader) Next(result interface{}) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.bson != nil {
+		if r.bson.Next(result) {
+			return true
+		}
+		r.err = r.bson.Err()
+		return false
+	}
+
+	for r.lines.Scan() {
+		r.line++
+		if len(bytes.TrimSpace(r.lines.Bytes())) == 0 {
+			continue
+		}
+		if r.err = unmarshalJSONOplog(r.lines.Bytes(), result.(*db.Oplog)); r.err != nil {
+			r.err = fmt.Errorf("line %v: %v", r.line, r.err)
+			return false
+		}
+		return true
+	}
+	r.err = r.lines.Err()
+	return false
+}
+
+// unmarshalJSONOplog parses a line of extended JSON into an oplog entry.
+func unmarshalJSONOplog(line []byte, op *db.Oplog) error {
+	doc, err := json.UnmarshalBsonD(line)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling extended JSON: %v", err)
+	}
+	doc, err = bsonutil.GetExtendedBsonD(doc)
+	if err != nil {
+		return fmt.Errorf("error converting extended JSON to BSON: %v", err)
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("error marshaling oplog entry: %v", err)
+	}
+	return bson.Unmarshal(raw, op)
+}
+
+// seek moves to the given offset of an uncompressed BSON file, which must be
+// the start of an entry. It must be called before the first Next.
+func (r *oplogFileReader) seek(offset int64) error {
+	if r.bson == nil || r.gzip != nil {
+		return fmt.Errorf("can only seek in uncompressed BSON files")
+	}
+	if _, err := r.file.Seek(offset, 0); err != nil {
+		return fmt.Errorf("error seeking in input file: %v", err)
+	}
+	return nil
+}
+
+// Err returns the error that ended reading, if any.
+func (r *oplogFileReader) Err() error {
+	return r.err
+}
+
+// Timeout always returns false, since a file has a definite end.
+func (r *oplogFileReader) Timeout() bool {
+	return false
+}
+
+// Close closes the file.
+func (r *oplogFileReader) Close() error {
+	if r.gzip != nil {
+		r.gzip.Close()
+	}
+	return r.file.Close()
+}
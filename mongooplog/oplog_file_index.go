@@ -0,0 +1,245 @@
+package mongooplog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// oplogIndexInterval is the number of entries between the entries of a
+// timestamp index.
+const oplogIndexInterval = 1024
+
+// oplogIndexSuffix is added to the name of an oplog file for the file its
+// timestamp index is cached in.
+const oplogIndexSuffix = ".tsidx"
+
+var oplogIndexMagic = [8]byte{'M', 'O', 'T', 'S', 'I', 'D', 'X', '1'}
+
+// oplogIndexHeader identifies the oplog file an index was built from, so that
+// a cached index is rebuilt if the file changes.
+type oplogIndexHeader struct {
+	Magic   [8]byte
+	Size    int64
+	ModTime int64
+
+	// Sorted is false if the entries of the file are out of timestamp order,
+	// in which case the index can't be used to seek
+	Sorted bool
+}
+
+// oplogIndexEntry is the timestamp of an entry of the file and its offset.
+type oplogIndexEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// oplogFileIndex is a sparse index of the timestamps of an uncompressed BSON
+// oplog file, such as the oplog.bson written by mongodump --oplog, for seeking
+// to the entries at or after a timestamp without reading the entries before.
+type oplogFileIndex struct {
+	header  oplogIndexHeader
+	entries []oplogIndexEntry
+}
+
+// parseTimestamp parses a timestamp given as <seconds>[:<increment>], where
+// seconds are since the UNIX epoch and the increment orders the ops within a
+// second.
+func parseTimestamp(ts string) (bson.MongoTimestamp, error) {
+	fields := strings.Split(ts, ":")
+	if len(fields) > 2 {
+		return 0, fmt.Errorf("too many : characters")
+	}
+	seconds, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing timestamp seconds: %v", err)
+	}
+	var increment uint64
+	if len(fields) == 2 && fields[1] != "" {
+		if increment, err = strconv.ParseUint(fields[1], 10, 32); err != nil {
+			return 0, fmt.Errorf("error parsing timestamp increment: %v", err)
+		}
+	}
+	return bson.MongoTimestamp(seconds<<32 | increment), nil
+}
+
+// openOplogFile opens the oplog file at path for reading the entries at or
+// after start. Uncompressed BSON files are read from the entry found with their
+// timestamp index, which is built and cached on first use; others are read
+// from the beginning.
+func openOplogFile(path string, start bson.MongoTimestamp) (*oplogFileReader, error) {
+	r, err := newOplogFileReader(path)
+	if err != nil || start == 0 {
+		return r, err
+	}
+	if isJSON, isGzip := oplogFileFormat(path); isJSON || isGzip {
+		log.Logvf(log.DebugLow, "`%v` can't be indexed, reading from its beginning", path)
+		return r, nil
+	}
+
+	index, err := loadOplogFileIndex(path)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if !index.header.Sorted {
+		log.Logvf(log.Always, "the entries of `%v` are out of timestamp order, reading from its beginning", path)
+		return r, nil
+	}
+	offset := index.find(start)
+	log.Logvf(log.DebugLow, "seeking to offset %v of `%v` for Timestamp: %v", offset, path, start>>32)
+	if err := r.seek(offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// loadOplogFileIndex returns the timestamp index of the oplog file at path,
+// reading it from its cache file if that is up to date, or else building it
+// and caching it.
+func loadOplogFileIndex(path string) (*oplogFileIndex, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	header := oplogIndexHeader{
+		Magic:   oplogIndexMagic,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	}
+
+	indexPath := path + oplogIndexSuffix
+	if index, err := readOplogFileIndex(indexPath); err == nil && index.header.Size == header.Size &&
+		index.header.ModTime == header.ModTime {
+		log.Logvf(log.DebugLow, "using the timestamp index in `%v`", indexPath)
+		return index, nil
+	}
+
+	log.Logvf(log.Always, "building a timestamp index of `%v`", path)
+	index, err := buildOplogFileIndex(path, header)
+	if err != nil {
+		return nil, err
+	}
+	// the index is only a cache, so the file can still be read without it
+	if err := index.writeFile(indexPath); err != nil {
+		log.Logvf(log.Always, "error caching the timestamp index of `%v`: %v", path, err)
+	}
+	return index, nil
+}
+
+// buildOplogFileIndex reads the oplog file at path, indexing the timestamp of
+// every oplogIndexInterval'th entry.
+func buildOplogFileIndex(path string, header oplogIndexHeader) (*oplogFileIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %v", err)
+	}
+	defer file.Close()
+
+	index := &oplogFileIndex{header: header}
+	index.header.Sorted = true
+	source := db.NewBSONSource(ioutil.NopCloser(bufio.NewReader(file)))
+	var offset int64
+	var last bson.MongoTimestamp
+	for count := 0; ; count++ {
+		raw := source.LoadNext()
+		if raw == nil {
+			break
+		}
+		entry := struct {
+			Timestamp bson.MongoTimestamp `bson:"ts"`
+		}{}
+		if err := bson.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("error reading input file at offset %v: %v", offset, err)
+		}
+		if entry.Timestamp < last {
+			index.header.Sorted = false
+		}
+		last = entry.Timestamp
+		if count%oplogIndexInterval == 0 {
+			index.entries = append(index.entries, oplogIndexEntry{int64(entry.Timestamp), offset})
+		}
+		offset += int64(len(raw))
+	}
+	if err := source.Err(); err != nil {
+		return nil, fmt.Errorf("error reading input file at offset %v: %v", offset, err)
+	}
+	return index, nil
+}
+
+// find returns the offset of the indexed entry closest before the first entry
+// at or after start, from which reading finds all the entries at or after it.
+func (index *oplogFileIndex) find(start bson.MongoTimestamp) int64 {
+	i := sort.Search(len(index.entries), func(i int) bool {
+		return index.entries[i].Timestamp >= int64(start)
+	})
+	if i == 0 {
+		return 0
+	}
+	return index.entries[i-1].Offset
+}
+
+// readOplogFileIndex reads an index written by writeFile.
+func readOplogFileIndex(path string) (*oplogFileIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	in := bufio.NewReader(file)
+	index := &oplogFileIndex{}
+	if err := binary.Read(in, binary.LittleEndian, &index.header); err != nil {
+		return nil, err
+	}
+	if index.header.Magic != oplogIndexMagic {
+		return nil, fmt.Errorf("`%v` isn't a timestamp index", path)
+	}
+	for {
+		var entry oplogIndexEntry
+		if err := binary.Read(in, binary.LittleEndian, &entry); err != nil {
+			if err == io.EOF {
+				return index, nil
+			}
+			return nil, err
+		}
+		index.entries = append(index.entries, entry)
+	}
+}
+
+// writeFile writes the index to the file at path, replacing any file there
+// only once the index is completely written.
+func (index *oplogFileIndex) writeFile(path string) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(file)
+	err = binary.Write(out, binary.LittleEndian, index.header)
+	if err == nil {
+		err = binary.Write(out, binary.LittleEndian, index.entries)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
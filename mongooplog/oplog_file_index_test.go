@@ -0,0 +1,122 @@
+package mongooplog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeOplogFile writes n inserts with timestamps 1..n seconds to path.
+func writeOplogFile(path string, n int) error {
+	w, err := newOplogFileWriter(path)
+	if err != nil {
+		return err
+	}
+	ops := make([]db.Oplog, n)
+	for i := range ops {
+		ops[i] = db.Oplog{
+			Timestamp: bson.MongoTimestamp(int64(i+1) << 32),
+			Operation: "i",
+			Namespace: "test.data",
+			Object:    bson.D{{"_id", i + 1}},
+		}
+	}
+	if err := w.apply(ops); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// firstTimestamp returns the timestamp of the first entry read from r, in
+// seconds.
+func firstTimestamp(r *oplogFileReader) int64 {
+	op := db.Oplog{}
+	if !r.Next(&op) {
+		return -1
+	}
+	return int64(op.Timestamp >> 32)
+}
+
+func TestParseTimestamp(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("Timestamps should parse with or without an increment", t, func() {
+		ts, err := parseTimestamp("1500000000:7")
+		So(err, ShouldBeNil)
+		So(ts, ShouldEqual, bson.MongoTimestamp(1500000000<<32|7))
+		ts, err = parseTimestamp("1500000000")
+		So(err, ShouldBeNil)
+		So(ts, ShouldEqual, bson.MongoTimestamp(1500000000<<32))
+
+		for _, invalid := range []string{"", "1:2:3", "x", "1:x", "-1", "4294967296"} {
+			_, err = parseTimestamp(invalid)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestOplogFileIndex(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With an oplog file of several index intervals", t, func() {
+		dir, err := ioutil.TempDir("", "mongooplog")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		n := 3*oplogIndexInterval + 10
+		path := filepath.Join(dir, "oplog.bson")
+		So(writeOplogFile(path, n), ShouldBeNil)
+
+		Convey("opening it at a timestamp should seek near the entry", func() {
+			start := bson.MongoTimestamp(int64(2*oplogIndexInterval+5) << 32)
+			r, err := openOplogFile(path, start)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			first := firstTimestamp(r)
+			So(first, ShouldBeLessThanOrEqualTo, int64(start>>32))
+			So(first, ShouldBeGreaterThan, int64(start>>32)-oplogIndexInterval)
+
+			Convey("and cache the index alongside it", func() {
+				index, err := readOplogFileIndex(path + oplogIndexSuffix)
+				So(err, ShouldBeNil)
+				So(index.header.Sorted, ShouldBeTrue)
+				So(len(index.entries), ShouldEqual, 4)
+			})
+		})
+
+		Convey("timestamps before the first entry should read from the beginning", func() {
+			r, err := openOplogFile(path, 1)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			So(firstTimestamp(r), ShouldEqual, 1)
+		})
+
+		Convey("a stale cached index should be rebuilt", func() {
+			_, err := loadOplogFileIndex(path)
+			So(err, ShouldBeNil)
+			So(writeOplogFile(path, oplogIndexInterval), ShouldBeNil)
+			index, err := loadOplogFileIndex(path)
+			So(err, ShouldBeNil)
+			So(len(index.entries), ShouldEqual, 5)
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(index.header.Size, ShouldEqual, info.Size())
+		})
+
+		Convey("an unsorted file should be read from the beginning", func() {
+			So(writeOplogFile(path, 1), ShouldBeNil)
+			r, err := openOplogFile(path, bson.MongoTimestamp(int64(n)<<32))
+			So(err, ShouldBeNil)
+			defer r.Close()
+			So(firstTimestamp(r), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package mongooplog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/options"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOplogFileWriter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a temporary directory and some ops", t, func() {
+		dir, err := ioutil.TempDir("", "mongooplog")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		ops := []db.Oplog{
+			{Timestamp: bson.MongoTimestamp(1 << 32), Operation: "i", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+			{Timestamp: bson.MongoTimestamp(2 << 32), Operation: "d", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+		}
+
+		Convey("ops written to a BSON file should read back in order", func() {
+			path := filepath.Join(dir, "ops.bson")
+			w, err := newOplogFileWriter(path)
+			So(err, ShouldBeNil)
+			So(w.apply(ops[:1]), ShouldBeNil)
+			So(w.apply(ops[1:]), ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+
+			file, err := os.Open(path)
+			So(err, ShouldBeNil)
+			source := db.NewDecodedBSONSource(db.NewBSONSource(file))
+			defer source.Close()
+
+			var read []db.Oplog
+			op := db.Oplog{}
+			for source.Next(&op) {
+				read = append(read, op)
+				op = db.Oplog{}
+			}
+			So(source.Err(), ShouldBeNil)
+			So(len(read), ShouldEqual, 2)
+			So(read[0].Operation, ShouldEqual, "i")
+			So(read[1].Operation, ShouldEqual, "d")
+			So(read[1].Timestamp, ShouldEqual, ops[1].Timestamp)
+		})
+
+		Convey("ops written to a gzipped JSON file should be one per line", func() {
+			path := filepath.Join(dir, "ops.json.gz")
+			w, err := newOplogFileWriter(path)
+			So(err, ShouldBeNil)
+			So(w.apply(ops), ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+
+			file, err := os.Open(path)
+			So(err, ShouldBeNil)
+			defer file.Close()
+			gz, err := gzip.NewReader(file)
+			So(err, ShouldBeNil)
+
+			var lines []string
+			scanner := bufio.NewScanner(gz)
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			So(scanner.Err(), ShouldBeNil)
+			So(len(lines), ShouldEqual, 2)
+			So(lines[0], ShouldContainSubstring, `"op":"i"`)
+			So(lines[0], ShouldContainSubstring, `"$timestamp"`)
+			So(strings.HasPrefix(lines[1], "{"), ShouldBeTrue)
+		})
+
+		Convey("ops should read back from a file of either format", func() {
+			for _, name := range []string{"ops.bson", "ops.bson.gz", "ops.json", "ops.json.gz"} {
+				path := filepath.Join(dir, name)
+				w, err := newOplogFileWriter(path)
+				So(err, ShouldBeNil)
+				So(w.apply(ops), ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+
+				r, err := newOplogFileReader(path)
+				So(err, ShouldBeNil)
+				var read []db.Oplog
+				op := db.Oplog{}
+				for r.Next(&op) {
+					read = append(read, op)
+				}
+				So(r.Err(), ShouldBeNil)
+				So(r.Close(), ShouldBeNil)
+
+				So(len(read), ShouldEqual, 2)
+				for i := range ops {
+					So(read[i].Timestamp, ShouldEqual, ops[i].Timestamp)
+					So(read[i].Operation, ShouldEqual, ops[i].Operation)
+					So(read[i].Namespace, ShouldEqual, ops[i].Namespace)
+					So(len(read[i].Object), ShouldEqual, 1)
+					So(read[i].Object[0].Name, ShouldEqual, "_id")
+				}
+			}
+		})
+
+		Convey("a malformed JSON line should report its line number", func() {
+			path := filepath.Join(dir, "bad.json")
+			So(ioutil.WriteFile(path, []byte("{\"op\":\"i\"}\n{oops\n"), 0644), ShouldBeNil)
+
+			r, err := newOplogFileReader(path)
+			So(err, ShouldBeNil)
+			defer r.Close()
+			op := db.Oplog{}
+			So(r.Next(&op), ShouldBeTrue)
+			So(r.Next(&op), ShouldBeFalse)
+			So(r.Err(), ShouldNotBeNil)
+			So(r.Err().Error(), ShouldContainSubstring, "line 2")
+		})
+	})
+}
+
+func TestOplogCheckpoint(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a checkpoint in a temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "mongooplog")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+		checkpoint := &oplogCheckpoint{path: filepath.Join(dir, "ckpt")}
+
+		Convey("a missing file should resume from the start", func() {
+			ts, err := checkpoint.load()
+			So(err, ShouldBeNil)
+			So(ts, ShouldEqual, 0)
+		})
+
+		Convey("a saved timestamp should load back", func() {
+			ts := bson.MongoTimestamp(1500000000<<32 | 7)
+			So(checkpoint.save(ts), ShouldBeNil)
+			So(checkpoint.save(ts+1), ShouldBeNil)
+			loaded, err := checkpoint.load()
+			So(err, ShouldBeNil)
+			So(loaded, ShouldEqual, ts+1)
+		})
+
+		Convey("a corrupt file should be an error", func() {
+			So(ioutil.WriteFile(checkpoint.path, []byte("garbage"), 0644), ShouldBeNil)
+			_, err := checkpoint.load()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestLastApplied(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With ops in a file too large to apply in one batch", t, func() {
+		dir, err := ioutil.TempDir("", "mongooplog")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+
+		in := filepath.Join(dir, "in.bson")
+		w, err := newOplogFileWriter(in)
+		So(err, ShouldBeNil)
+		padding := strings.Repeat("x", 5*1024*1024)
+		for i := 1; i <= 6; i++ {
+			op := db.Oplog{Timestamp: bson.MongoTimestamp(int64(i) << 32), Operation: "i",
+				Namespace: "test.data", Object: bson.D{{"_id", i}, {"padding", padding}}}
+			So(w.apply([]db.Oplog{op}), ShouldBeNil)
+		}
+		So(w.Close(), ShouldBeNil)
+
+		checkpoint := filepath.Join(dir, "ckpt")
+		So(ioutil.WriteFile(checkpoint, []byte("1,0\n"), 0644), ShouldBeNil)
+
+		oplog := &MongoOplog{
+			ToolOptions:        &options.ToolOptions{Connection: &options.Connection{}},
+			SourceOptions:      &SourceOptions{In: in, Checkpoint: checkpoint},
+			DestinationOptions: &DestinationOptions{Out: filepath.Join(dir, "out.bson")},
+		}
+
+		Convey("the last applied timestamp should start at the checkpoint and only advance", func() {
+			So(oplog.LastApplied(), ShouldEqual, 0)
+			var seen []bson.MongoTimestamp
+			oplog.Transform = func(op *db.Oplog) (*db.Oplog, error) {
+				seen = append(seen, oplog.LastApplied())
+				return op, nil
+			}
+			So(oplog.Run(), ShouldBeNil)
+
+			So(len(seen), ShouldEqual, 5)
+			So(seen[0], ShouldEqual, bson.MongoTimestamp(1<<32))
+			advanced := false
+			for i := 1; i < len(seen); i++ {
+				So(seen[i], ShouldBeGreaterThanOrEqualTo, seen[i-1])
+				if seen[i] > seen[i-1] {
+					advanced = true
+				}
+			}
+			So(advanced, ShouldBeTrue)
+
+			// and match the checkpoint once done
+			So(oplog.LastApplied(), ShouldEqual, bson.MongoTimestamp(6<<32))
+			saved, err := (&oplogCheckpoint{path: checkpoint}).load()
+			So(err, ShouldBeNil)
+			So(saved, ShouldEqual, oplog.LastApplied())
+		})
+	})
+}
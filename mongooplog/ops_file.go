@@ -0,0 +1,100 @@
+package mongooplog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// readOpsFile reads every oplog entry in a file given with --ops, checking
+// that each is well-formed, so that none are applied if any is not.
+func readOpsFile(path string) ([]db.Oplog, error) {
+	reader, err := newOplogFileReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ops := []db.Oplog{}
+	for {
+		op := db.Oplog{}
+		if !reader.Next(&op) {
+			break
+		}
+		if err := validateOplogEntry(op); err != nil {
+			return nil, fmt.Errorf("entry %v of `%v` is not a valid oplog entry: %v", len(ops)+1, path, err)
+		}
+		ops = append(ops, op)
+	}
+	if err := reader.Err(); err != nil {
+		return nil, fmt.Errorf("error reading `%v`: %v", path, err)
+	}
+	return ops, nil
+}
+
+// validateOplogEntry checks that an oplog entry has the fields that applyOps
+// needs for its type of op.
+func validateOplogEntry(op db.Oplog) error {
+	switch op.Operation {
+	case "i", "u", "d", "c", "n":
+	case "":
+		return fmt.Errorf("missing op")
+	default:
+		return fmt.Errorf("unknown op `%v`", op.Operation)
+	}
+	if op.Operation == "n" {
+		return nil
+	}
+
+	if op.Operation == "c" {
+		if !strings.HasSuffix(op.Namespace, ".$cmd") {
+			return fmt.Errorf("command ns `%v` must be <database>.$cmd", op.Namespace)
+		}
+		if err := util.ValidateDBName(strings.TrimSuffix(op.Namespace, ".$cmd")); err != nil {
+			return err
+		}
+	} else if _, collection, err := util.SplitAndValidateNamespace(op.Namespace); err != nil {
+		return err
+	} else if collection == "" {
+		return fmt.Errorf("ns `%v` must name a collection", op.Namespace)
+	}
+	switch {
+	case len(op.Object) == 0:
+		return fmt.Errorf("missing o")
+	case op.Operation == "u" && len(op.Query) == 0:
+		return fmt.Errorf("update is missing o2")
+	}
+	return nil
+}
+
+// sliceOplogIter iterates over oplog entries held in memory.
+type sliceOplogIter struct {
+	ops []db.Oplog
+}
+
+// Next reads the next entry into the result, which must be a *db.Oplog.
+func (s *sliceOplogIter) Next(result interface{}) bool {
+	if len(s.ops) == 0 {
+		return false
+	}
+	*result.(*db.Oplog) = s.ops[0]
+	s.ops = s.ops[1:]
+	return true
+}
+
+// Err always returns nil, since the entries are already read.
+func (s *sliceOplogIter) Err() error {
+	return nil
+}
+
+// Timeout always returns false, since there is a definite end.
+func (s *sliceOplogIter) Timeout() bool {
+	return false
+}
+
+// Close does nothing.
+func (s *sliceOplogIter) Close() error {
+	return nil
+}
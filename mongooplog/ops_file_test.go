@@ -0,0 +1,88 @@
+package mongooplog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestValidateOplogEntry(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When validating oplog entries", t, func() {
+
+		Convey("well-formed entries should be accepted", func() {
+			for _, op := range []db.Oplog{
+				{Operation: "i", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+				{Operation: "u", Namespace: "test.data", Object: bson.D{{"$set", bson.D{{"a", 1}}}}, Query: bson.D{{"_id", 1}}},
+				{Operation: "d", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+				{Operation: "c", Namespace: "test.$cmd", Object: bson.D{{"drop", "data"}}},
+				{Operation: "n", Object: bson.D{{"msg", "noop"}}},
+			} {
+				So(validateOplogEntry(op), ShouldBeNil)
+			}
+		})
+
+		Convey("malformed entries should be rejected", func() {
+			for _, op := range []db.Oplog{
+				{Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+				{Operation: "x", Namespace: "test.data", Object: bson.D{{"_id", 1}}},
+				{Operation: "i", Object: bson.D{{"_id", 1}}},
+				{Operation: "i", Namespace: "test", Object: bson.D{{"_id", 1}}},
+				{Operation: "i", Namespace: "test.data"},
+				{Operation: "u", Namespace: "test.data", Object: bson.D{{"$set", bson.D{{"a", 1}}}}},
+				{Operation: "c", Namespace: "test.data", Object: bson.D{{"drop", "data"}}},
+				{Operation: "c", Namespace: "te st.$cmd", Object: bson.D{{"drop", "data"}}},
+			} {
+				So(validateOplogEntry(op), ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestReadOpsFile(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "mongooplog")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+		path := filepath.Join(dir, "repair.json")
+
+		Convey("the entries of a well-formed file should be read in order", func() {
+			So(ioutil.WriteFile(path, []byte(
+				`{"op": "i", "ns": "test.data", "o": {"_id": 1, "a": 1}}`+"\n\n"+
+					`{"op": "d", "ns": "test.data", "o": {"_id": 2}}`+"\n"), 0644), ShouldBeNil)
+			ops, err := readOpsFile(path)
+			So(err, ShouldBeNil)
+			So(len(ops), ShouldEqual, 2)
+
+			iter := &sliceOplogIter{ops: ops}
+			op := db.Oplog{}
+			So(iter.Next(&op), ShouldBeTrue)
+			So(op.Operation, ShouldEqual, "i")
+			So(iter.Next(&op), ShouldBeTrue)
+			So(op.Operation, ShouldEqual, "d")
+			So(iter.Next(&op), ShouldBeFalse)
+			So(iter.Err(), ShouldBeNil)
+		})
+
+		Convey("a malformed entry should fail the whole file", func() {
+			So(ioutil.WriteFile(path, []byte(
+				`{"op": "i", "ns": "test.data", "o": {"_id": 1}}`+"\n"+
+					`{"op": "u", "ns": "test.data", "o": {"$set": {"a": 1}}}`+"\n"), 0644), ShouldBeNil)
+			_, err := readOpsFile(path)
+			So(err, ShouldNotBeNil)
+			So(strings.Contains(err.Error(), "entry 2"), ShouldBeTrue)
+		})
+	})
+}
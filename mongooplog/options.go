@@ -1,6 +1,10 @@
 package mongooplog
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/options"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -12,12 +16,150 @@ See http://docs.mongodb.org/manual/reference/program/mongooplog/ for more inform
 
 // SourceOptions defines the set of options to use in retrieving oplog data from the source server.
 type SourceOptions struct {
-	From    string              `long:"from" value-name:"<hostname>" description:"specify the host for mongooplog to retrive operations from"`
-	OplogNS string              `long:"oplogns" value-name:"<namespace>" description:"specify the namespace in the --from host where the oplog lives (default 'local.oplog.rs') " default:"local.oplog.rs" default-mask:"-"`
-	Seconds bson.MongoTimestamp `long:"seconds" value-name:"<seconds>" short:"s" description:"specify a number of seconds for mongooplog to pull from the remote host" default:"86400"  default-mask:"-"`
+	From           string              `long:"from" value-name:"<hostname>" description:"specify the host for mongooplog to retrive operations from"`
+	OplogNS        []string            `long:"oplogns" value-name:"<namespace>" description:"specify the namespace in the --from host where the oplog lives (default 'local.oplog.rs'); may be specified multiple times to tail several collections of oplog entries, merging them in timestamp order, which waits on any of them that receives no entries" default:"local.oplog.rs" default-mask:"-"`
+	TimestampField string              `long:"timestampField" value-name:"<field>" description:"field holding the timestamp of each entry in --oplogns, for tailing a capped collection of oplog entries other than the oplog (default 'ts')" default:"ts" default-mask:"-"`
+	Seconds        bson.MongoTimestamp `long:"seconds" value-name:"<seconds>" short:"s" description:"specify a number of seconds for mongooplog to pull from the remote host" default:"86400"  default-mask:"-"`
+	SourceUsername string              `long:"sourceUsername" value-name:"<username>" description:"username for authenticating to the --from host (defaults to --username)"`
+	SourcePassword string              `long:"sourcePassword" value-name:"<password>" description:"password for authenticating to the --from host (defaults to --password)"`
+	SourceAuthDB   string              `long:"sourceAuthDB" value-name:"<database-name>" description:"database that holds the --from host user's credentials (defaults to --authenticationDatabase)"`
+	AllowGaps      bool                `long:"allowGaps" description:"apply ops even if the source oplog has rolled over past the requested start, leaving a gap"`
+	MergeShards    []string            `long:"mergeShards" value-name:"<hostname>" description:"tail the oplogs of each of the given shard hosts instead of --from, merging them in timestamp order (may be specified multiple times)"`
+	In             string              `long:"in" value-name:"<filename>" description:"apply the ops in a file written with --out instead of tailing a host; --seconds is ignored"`
+	Ops            string              `long:"ops" value-name:"<filename>" description:"apply exactly the oplog entries in this file, BSON or extended JSON as for --in, such as a few written by hand to repair drift, after checking that each is well-formed; --seconds is ignored"`
+	StartTs        string              `long:"startTs" value-name:"<seconds>[:<increment>]" description:"with --in, apply only the ops at or after this timestamp, seeking to it in uncompressed BSON files with a timestamp index built on first use and cached in <filename>.tsidx"`
+	Checkpoint     string              `long:"checkpoint" value-name:"<filename>" description:"record the last applied op in this file after each batch and resume after it on the next run, instead of from --seconds ago"`
+
+	Exclude []string `long:"exclude" value-name:"<namespace-pattern>" description:"skip the ops on namespaces matching this pattern, e.g. 'mydb.logs' or 'mydb.*', counting them with the other skipped ops; commands are only skipped by a pattern matching their whole database, and ops read from a server are matched before being fully decoded (may be specified multiple times)"`
+
+	Since string `long:"since" value-name:"<duration>" description:"pull ops from this long ago, as a duration such as 90m, 2h or 36h, instead of --seconds"`
+
+	CheckpointFallback bool `long:"checkpointFallback" description:"when tailing with --checkpoint, start from --seconds ago if the source oplog has rolled over past the checkpoint, instead of failing"`
+	VerifyResume       bool `long:"verifyResume" description:"when resuming with --checkpoint, first check that the destination holds the op at the checkpoint, and fail if it doesn't, as when the batch it ended was rolled back after the checkpoint was written"`
+
+	SourceSSLCAFile         string `long:"sourceSslCAFile" value-name:"<filename>" description:"the .pem file containing the root certificate chain of the certificate authority of the --from host, when it differs from the destination's (defaults to --sslCAFile)"`
+	SourceSSLPEMKeyFile     string `long:"sourceSslPEMKeyFile" value-name:"<filename>" description:"the .pem file containing the client certificate and key for the --from host, when it differs from the destination's (defaults to --sslPEMKeyFile)"`
+	SourceSSLPEMKeyPassword string `long:"sourceSslPEMKeyPassword" value-name:"<password>" description:"the password to decrypt the --sourceSslPEMKeyFile, if necessary (defaults to --sslPEMKeyPassword)"`
 }
 
 // Name returns a human-readable group name for source options.
 func (_ *SourceOptions) Name() string {
 	return "source"
 }
+
+// Auth returns the auth options to use for the source server, which are the
+// given shared auth options overridden by any source credentials.
+func (sourceOptions *SourceOptions) Auth(shared *options.Auth) *options.Auth {
+	return overrideAuth(shared, sourceOptions.SourceUsername,
+		sourceOptions.SourcePassword, sourceOptions.SourceAuthDB)
+}
+
+// SSL returns the SSL options to use for the source server, which are the
+// given shared SSL options overridden by any source certificates.
+func (sourceOptions *SourceOptions) SSL(shared *options.SSL) *options.SSL {
+	ssl := options.SSL{}
+	if shared != nil {
+		ssl = *shared
+	}
+	if sourceOptions.SourceSSLCAFile != "" {
+		ssl.SSLCAFile = sourceOptions.SourceSSLCAFile
+	}
+	if sourceOptions.SourceSSLPEMKeyFile != "" && sourceOptions.SourceSSLPEMKeyFile != ssl.SSLPEMKeyFile {
+		ssl.SSLPEMKeyFile = sourceOptions.SourceSSLPEMKeyFile
+		ssl.SSLPEMKeyPassword = ""
+	}
+	if sourceOptions.SourceSSLPEMKeyPassword != "" {
+		ssl.SSLPEMKeyPassword = sourceOptions.SourceSSLPEMKeyPassword
+	}
+	return &ssl
+}
+
+// lookback returns how far back in the source oplog to start, which is
+// --since if set and --seconds otherwise. --since must have been validated.
+func (sourceOptions *SourceOptions) lookback() time.Duration {
+	if sourceOptions.Since != "" {
+		since, _ := parseSince(sourceOptions.Since)
+		return since
+	}
+	return time.Duration(sourceOptions.Seconds) * time.Second
+}
+
+// parseSince parses the duration given with --since, which must be positive.
+func parseSince(since string) (time.Duration, error) {
+	duration, err := time.ParseDuration(since)
+	if err != nil {
+		return 0, fmt.Errorf("expected a duration such as 90m or 2h, got `%v`", since)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration `%v` must be positive", since)
+	}
+	return duration, nil
+}
+
+// hasSSLOverrides returns whether any source certificates are set.
+func (sourceOptions *SourceOptions) hasSSLOverrides() bool {
+	return sourceOptions.SourceSSLCAFile != "" || sourceOptions.SourceSSLPEMKeyFile != "" ||
+		sourceOptions.SourceSSLPEMKeyPassword != ""
+}
+
+// DestinationOptions defines the set of options to use in applying oplog data to the destination server.
+type DestinationOptions struct {
+	DestUsername  string `long:"destUsername" value-name:"<username>" description:"username for authenticating to the destination host (defaults to --username)"`
+	DestPassword  string `long:"destPassword" value-name:"<password>" description:"password for authenticating to the destination host (defaults to --password)"`
+	DestAuthDB    string `long:"destAuthDB" value-name:"<database-name>" description:"database that holds the destination host user's credentials (defaults to --authenticationDatabase)"`
+	MaxDocSize    int    `long:"maxDocSize" value-name:"<bytes>" description:"skip and log ops whose document is larger than this many bytes, instead of sending them to a destination that would reject them"`
+	RetryAttempts int    `long:"retryAttempts" value-name:"<count>" description:"number of times to retry applying a batch of ops after a network error (defaults to 3)" default:"3" default-mask:"-"`
+
+	FailoverTimeout int `long:"failoverTimeout" value-name:"<seconds>" description:"keep reconnecting and retrying a batch of ops for up to this many seconds while the destination has no primary, as during a failover of a destination given as <setname>/<hosts> (defaults to 60)" default:"60" default-mask:"-"`
+
+	BypassDocumentValidation bool   `long:"bypassDocumentValidation" description:"bypass document validation on the destination when applying ops"`
+	AlwaysUpsert             string `long:"alwaysUpsert" value-name:"true|false" optional:"true" optional-value:"true" choice:"true" choice:"false" description:"whether to apply updates as upserts, inserting documents missing from the destination; the destination upserts unless given --alwaysUpsert=false, which leaves updates of missing documents unapplied"`
+
+	BulkInserts      bool `long:"bulkInserts" description:"apply each run of inserts into one collection with an insert command instead of applyOps, which is faster for a window of mostly inserts, such as an initial copy; the other ops are still applied with applyOps, and inserts of documents already on the destination fail"`
+	UnorderedInserts bool `long:"unorderedInserts" description:"with --bulkInserts, keep inserting the documents of a run after one fails to insert, which lets the destination insert them in parallel, before failing"`
+
+	FanOut          []string `long:"fanOut" value-name:"<hostname>" description:"also apply ops to this host, in parallel with the destination host, to build several copies of the source at once; each destination applies batches on its own and may fall up to 16 batches behind the others; may be a mongodb:// URI with its own credentials, and may be specified multiple times"`
+	ContinueOnError bool     `long:"continueOnError" description:"with --fanOut, keep applying ops to the other destinations when one fails to apply a batch, leaving it behind, instead of stopping (which can't be combined with --checkpoint); with --writeConcern, keep applying ops after a batch whose write concern isn't satisfied"`
+
+	WriteConcern string `long:"writeConcern" value-name:"<write-concern>" description:"write concern to apply ops with, e.g. --writeConcern majority, --writeConcern '{w: 2, wtimeout: 5000, j: true}', instead of the destination's default; a batch whose write concern isn't satisfied, as when wtimeout passes, fails the run, or with --continueOnError is logged and applying carries on"`
+
+	VerifyCounts bool `long:"verifyCounts" description:"once the source is exhausted, compare the number of documents in each namespace the applied ops touched on the source with that on the destination, and fail if they differ; a namespace whose source count changes while it is checked is only warned about, as it is still being written to"`
+
+	Preflight        bool `long:"preflight" description:"instead of applying ops, read them as they would be applied, up to the latest op when tailing, and check each namespace they touch against the destination: that its collection exists or is created by the ops, and that a sample of the documents written to it pass its validator; report the problems found and exit"`
+	PreflightSamples int  `long:"preflightSamples" value-name:"<count>" description:"number of documents of each namespace to check against its validator with --preflight (defaults to 100)" default:"100" default-mask:"-"`
+
+	Out string `long:"out" value-name:"<filename>" description:"append ops to a file instead of applying them to the destination host; written as extended JSON if the name ends in .json, BSON otherwise, and gzipped if it ends in .gz"`
+}
+
+// Name returns a human-readable group name for destination options.
+func (_ *DestinationOptions) Name() string {
+	return "destination"
+}
+
+// Auth returns the auth options to use for the destination server, which are
+// the given shared auth options overridden by any destination credentials.
+func (destOptions *DestinationOptions) Auth(shared *options.Auth) *options.Auth {
+	return overrideAuth(shared, destOptions.DestUsername,
+		destOptions.DestPassword, destOptions.DestAuthDB)
+}
+
+// overrideAuth returns a copy of the shared auth options with the given
+// credentials replacing the shared ones where they are set. A different
+// username never inherits the shared password.
+func overrideAuth(shared *options.Auth, username, password, authDB string) *options.Auth {
+	auth := options.Auth{}
+	if shared != nil {
+		auth = *shared
+	}
+	if username != "" && username != auth.Username {
+		auth.Username = username
+		auth.Password = ""
+	}
+	if password != "" {
+		auth.Password = password
+	}
+	if authDB != "" {
+		auth.Source = authDB
+	}
+	return &auth
+}
@@ -0,0 +1,303 @@
+package mongooplog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common"
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// documentValidationFailure is the code of the error a server gives when a
+// document fails the validator of its collection.
+const documentValidationFailure = 121
+
+// preflightCheck collects what the ops read with --preflight do to each
+// namespace, to check them against a destination before applying them.
+type preflightCheck struct {
+	namespaces map[string]*preflightNamespace
+
+	// samples is the most documents of each namespace kept to check against
+	// its validator
+	samples int
+
+	// alwaysUpsert is whether updates are applied as upserts, which create
+	// their collection as inserts do; applyOps upserts unless told not to
+	alwaysUpsert bool
+}
+
+// preflightNamespace holds what the ops read with --preflight do to a
+// namespace.
+type preflightNamespace struct {
+	ops int64
+
+	// creates is whether a command op creates the collection, and inserts
+	// whether an insert or upsert would create it implicitly
+	creates bool
+	inserts bool
+
+	// samples holds the first documents the ops write whole to the
+	// collection
+	samples []bson.D
+}
+
+func newPreflightCheck(samples int, alwaysUpsert bool) *preflightCheck {
+	return &preflightCheck{
+		namespaces:   map[string]*preflightNamespace{},
+		samples:      samples,
+		alwaysUpsert: alwaysUpsert,
+	}
+}
+
+func (p *preflightCheck) namespace(ns string) *preflightNamespace {
+	info, ok := p.namespaces[ns]
+	if !ok {
+		info = &preflightNamespace{}
+		p.namespaces[ns] = info
+	}
+	return info
+}
+
+// observe records what an op does to its namespace. Commands other than
+// those creating a collection aren't checked.
+func (p *preflightCheck) observe(op db.Oplog) {
+	switch op.Operation {
+	case "c":
+		if len(op.Object) == 0 || op.Object[0].Name != "create" {
+			return
+		}
+		dbName, _ := common.SplitNamespace(op.Namespace)
+		p.namespace(fmt.Sprintf("%v.%v", dbName, op.Object[0].Value)).creates = true
+	case "i":
+		info := p.namespace(op.Namespace)
+		info.ops++
+		info.inserts = true
+		p.sample(info, op.Object)
+	case "u":
+		info := p.namespace(op.Namespace)
+		info.ops++
+		if p.alwaysUpsert {
+			info.inserts = true
+		}
+		// a replacement holds the whole document, unlike an update with
+		// operators
+		if len(op.Object) > 0 && !strings.HasPrefix(op.Object[0].Name, "$") {
+			p.sample(info, op.Object)
+		}
+	case "d":
+		p.namespace(op.Namespace).ops++
+	}
+}
+
+func (p *preflightCheck) sample(info *preflightNamespace, doc bson.D) {
+	if len(info.samples) < p.samples {
+		info.samples = append(info.samples, doc)
+	}
+}
+
+// check checks each namespace against a destination, returning the problems
+// applying the ops to it would run into. Documents are checked against a
+// validator by inserting them into a scratch collection with the same
+// validator, which is dropped afterwards, so the destination's collections
+// are left as they are.
+func (p *preflightCheck) check(session *mgo.Session, host string, bypassValidation bool) ([]string, error) {
+	names := make([]string, 0, len(p.namespaces))
+	for ns := range p.namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, ns := range names {
+		info := p.namespaces[ns]
+		dbName, collName := common.SplitNamespace(ns)
+		collInfo, err := db.GetCollectionOptions(session.DB(dbName).C(collName))
+		if err != nil {
+			return nil, fmt.Errorf("error checking `%v` on `%v`: %v", ns, host, err)
+		}
+
+		if collInfo == nil {
+			if !info.creates && !info.inserts {
+				problems = append(problems, fmt.Sprintf("`%v` doesn't exist on `%v`, and none of its %v ops "+
+					"create it", ns, host, info.ops))
+			}
+			continue
+		}
+		if info.creates {
+			problems = append(problems, fmt.Sprintf("`%v` already exists on `%v`, so the op creating it "+
+				"would fail", ns, host))
+		}
+		if bypassValidation {
+			continue
+		}
+
+		validation := collectionValidation(collInfo)
+		if validation == nil || len(info.samples) == 0 {
+			continue
+		}
+		rejected, err := validateSamples(session.DB(dbName), validation, info.samples)
+		if err != nil {
+			return nil, fmt.Errorf("error checking documents of `%v` on `%v`: %v", ns, host, err)
+		}
+		for _, problem := range rejected {
+			problems = append(problems, fmt.Sprintf("`%v` on `%v` %v", ns, host, problem))
+		}
+	}
+	return problems, nil
+}
+
+// collectionValidation returns the validation options of the collection
+// described by the info returned by listCollections, if it has a validator
+// that rejects documents.
+func collectionValidation(collInfo *bson.D) bson.D {
+	collOptions, err := bsonutil.FindValueByKey("options", collInfo)
+	if err != nil {
+		return nil
+	}
+	optionsDoc, ok := collOptions.(bson.D)
+	if !ok {
+		return nil
+	}
+	validation := bson.D{}
+	hasValidator := false
+	for _, elem := range optionsDoc {
+		switch elem.Name {
+		case "validator":
+			hasValidator = true
+			validation = append(validation, elem)
+		case "validationLevel":
+			if elem.Value == "off" {
+				return nil
+			}
+			validation = append(validation, elem)
+		case "validationAction":
+			if elem.Value == "warn" {
+				return nil
+			}
+		}
+	}
+	if !hasValidator {
+		return nil
+	}
+	return validation
+}
+
+// validateSamples inserts the documents into a scratch collection of the
+// database with the given validation options, returning a description of
+// each that is rejected.
+func validateSamples(database *mgo.Database, validation bson.D, samples []bson.D) ([]string, error) {
+	scratch := database.C("mongooplog.preflight." + bson.NewObjectId().Hex())
+	create := append(bson.D{{"create", scratch.Name}}, validation...)
+	if err := database.Run(create, nil); err != nil {
+		return nil, fmt.Errorf("error creating scratch collection: %v", err)
+	}
+	defer func() {
+		if err := scratch.DropCollection(); err != nil {
+			log.Logvf(log.Always, "warning: error dropping scratch collection `%v`: %v", scratch.FullName, err)
+		}
+	}()
+
+	rejected := []string{}
+	for _, doc := range samples {
+		err := scratch.Insert(doc)
+		switch {
+		case err == nil, mgo.IsDup(err):
+		case errorCode(err) == documentValidationFailure:
+			rejected = append(rejected, fmt.Sprintf("would reject the document with _id %v: %v",
+				opID(db.Oplog{Object: doc}), err))
+		default:
+			return nil, err
+		}
+	}
+	return rejected, nil
+}
+
+// errorCode returns the code of an error returned by the server, or zero.
+func errorCode(err error) int {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return e.Code
+	case *mgo.QueryError:
+		return e.Code
+	}
+	return 0
+}
+
+// preflight reads the ops as Run would apply them, without applying them,
+// and checks them against each destination server. When tailing, it stops
+// at the latest op of the source, stopAt, rather than waiting for more.
+func (mo *MongoOplog) preflight(dest oplogDestination, tail oplogIter, startTs, resumeAfter,
+	stopAt bson.MongoTimestamp, live bool) error {
+
+	check := newPreflightCheck(mo.DestinationOptions.PreflightSamples, mo.DestinationOptions.AlwaysUpsert != "false")
+	read := 0
+	oplogEntry := &db.Oplog{}
+	for !live || stopAt != 0 {
+		if !tail.Next(oplogEntry) {
+			break
+		}
+		if oplogEntry.Operation != "n" && oplogEntry.Timestamp >= startTs && oplogEntry.Timestamp > resumeAfter &&
+			!mo.exclude.excluded(oplogEntry.Namespace, oplogEntry.Operation) {
+			op, keep, err := mo.transform(*oplogEntry)
+			if err != nil {
+				return err
+			}
+			if keep {
+				check.observe(op)
+				read++
+			}
+		}
+		if live && oplogEntry.Timestamp >= stopAt {
+			break
+		}
+	}
+	if err := tail.Err(); err != nil {
+		if mo.SourceOptions.In != "" {
+			return fmt.Errorf("error reading `%v`: %v", mo.SourceOptions.In, err)
+		}
+		return newError(ExitConnectionError, "error querying oplog: %v", err)
+	}
+	log.Logvf(log.Always, "preflight: read %v oplog entries on %v namespaces", read, len(check.namespaces))
+
+	// check against every destination server
+	hosts, sessions := mo.destinationSessions(dest)
+	problems := []string{}
+	for i, session := range sessions {
+		found, err := check.check(session, hosts[i], mo.DestinationOptions.BypassDocumentValidation)
+		if err != nil {
+			return fmt.Errorf("preflight: %v", err)
+		}
+		problems = append(problems, found...)
+	}
+
+	if len(problems) > 0 {
+		details := make([]string, len(problems))
+		for i, problem := range problems {
+			details[i] = "preflight: " + problem
+		}
+		return withDetails(newError(ExitPreflightFailed, "preflight found %v problems applying the ops",
+			len(problems)), details)
+	}
+	log.Logv(log.Always, "preflight: found no problems applying the ops")
+	return nil
+}
+
+// latestOplogTimestamp returns the timestamp of the latest entry of an oplog,
+// or zero if it is empty.
+func latestOplogTimestamp(oplog *mgo.Collection, tsField string) (bson.MongoTimestamp, error) {
+	latest := bson.M{}
+	err := oplog.Find(nil).Sort("-$natural").Select(bson.M{tsField: 1}).One(&latest)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	ts, _ := latest[tsField].(bson.MongoTimestamp)
+	return ts, nil
+}
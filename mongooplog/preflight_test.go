@@ -0,0 +1,80 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestPreflightCheck(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With the ops of a preflight check", t, func() {
+		check := newPreflightCheck(2, false)
+		for _, op := range []db.Oplog{
+			{Operation: "c", Namespace: "app.$cmd", Object: bson.D{{"create", "events"}}},
+			{Operation: "c", Namespace: "app.$cmd", Object: bson.D{{"drop", "old"}}},
+			{Operation: "i", Namespace: "app.events", Object: bson.D{{"_id", 1}}},
+			{Operation: "i", Namespace: "app.events", Object: bson.D{{"_id", 2}}},
+			{Operation: "i", Namespace: "app.events", Object: bson.D{{"_id", 3}}},
+			{Operation: "u", Namespace: "app.users", Object: bson.D{{"$set", bson.D{{"a", 1}}}},
+				Query: bson.D{{"_id", 1}}},
+			{Operation: "u", Namespace: "app.users", Object: bson.D{{"_id", 2}, {"a", 1}},
+				Query: bson.D{{"_id", 2}}},
+			{Operation: "d", Namespace: "app.sessions", Object: bson.D{{"_id", 1}}},
+		} {
+			check.observe(op)
+		}
+
+		Convey("the ops should be counted by namespace", func() {
+			So(len(check.namespaces), ShouldEqual, 3)
+			So(check.namespaces["app.events"].ops, ShouldEqual, 3)
+			So(check.namespaces["app.users"].ops, ShouldEqual, 2)
+			So(check.namespaces["app.sessions"].ops, ShouldEqual, 1)
+		})
+
+		Convey("creating a collection should be told apart from inserting"+
+			" into it", func() {
+			So(check.namespaces["app.events"].creates, ShouldBeTrue)
+			So(check.namespaces["app.events"].inserts, ShouldBeTrue)
+			So(check.namespaces["app.users"].creates, ShouldBeFalse)
+			So(check.namespaces["app.users"].inserts, ShouldBeFalse)
+		})
+
+		Convey("only whole documents should be sampled, up to the limit", func() {
+			So(check.namespaces["app.events"].samples, ShouldResemble,
+				[]bson.D{{{"_id", 1}}, {{"_id", 2}}})
+			So(check.namespaces["app.users"].samples, ShouldResemble,
+				[]bson.D{{{"_id", 2}, {"a", 1}}})
+			So(check.namespaces["app.sessions"].samples, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Updates applied as upserts should create their collection", t, func() {
+		check := newPreflightCheck(2, true)
+		check.observe(db.Oplog{Operation: "u", Namespace: "app.users",
+			Object: bson.D{{"$set", bson.D{{"a", 1}}}}, Query: bson.D{{"_id", 1}}})
+		So(check.namespaces["app.users"].inserts, ShouldBeTrue)
+	})
+
+	Convey("Only validators that reject documents should be checked", t, func() {
+		collInfo := func(options bson.D) *bson.D {
+			return &bson.D{{"name", "users"}, {"options", options}}
+		}
+		validator := bson.D{{"a", bson.D{{"$exists", true}}}}
+
+		So(collectionValidation(collInfo(bson.D{})), ShouldBeNil)
+		So(collectionValidation(collInfo(bson.D{{"validator", validator}})), ShouldResemble,
+			bson.D{{"validator", validator}})
+		So(collectionValidation(collInfo(bson.D{{"validator", validator}, {"validationLevel", "moderate"},
+			{"validationAction", "error"}})), ShouldResemble,
+			bson.D{{"validator", validator}, {"validationLevel", "moderate"}})
+		So(collectionValidation(collInfo(bson.D{{"validator", validator}, {"validationAction", "warn"}})),
+			ShouldBeNil)
+		So(collectionValidation(collInfo(bson.D{{"validator", validator}, {"validationLevel", "off"}})),
+			ShouldBeNil)
+	})
+}
@@ -0,0 +1,77 @@
+package mongooplog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// skipLogInterval is how often the counts of skipped ops are logged.
+const skipLogInterval = time.Minute
+
+// Reasons for which an oplog entry is not applied to the destination.
+const (
+	skipReasonNoop       = "noop"
+	skipReasonCheckpoint = "checkpoint"
+	skipReasonStartTs    = "startTs"
+	skipReasonTransform  = "transform"
+	skipReasonOversized  = "oversized"
+	skipReasonExcluded   = "excluded"
+)
+
+// skipCounter counts the oplog entries that were skipped, by reason. It is safe
+// for concurrent use.
+type skipCounter struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func newSkipCounter() *skipCounter {
+	return &skipCounter{counts: make(map[string]int64)}
+}
+
+// skip records that an entry was skipped for the given reason.
+func (c *skipCounter) skip(reason string) {
+	c.Lock()
+	c.counts[reason]++
+	c.Unlock()
+}
+
+// Counts returns a copy of the number of entries skipped for each reason.
+func (c *skipCounter) Counts() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for reason, count := range c.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// total returns the number of entries skipped for any reason.
+func (c *skipCounter) total() int64 {
+	c.Lock()
+	defer c.Unlock()
+	var total int64
+	for _, count := range c.counts {
+		total += count
+	}
+	return total
+}
+
+// String returns the counts by reason, sorted by reason.
+func (c *skipCounter) String() string {
+	counts := c.Counts()
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%v: %v", reason, counts[reason]))
+	}
+	return strings.Join(parts, ", ")
+}
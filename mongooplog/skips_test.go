@@ -0,0 +1,33 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSkipCounter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a counter of skipped ops", t, func() {
+		skips := newSkipCounter()
+
+		Convey("nothing should be reported before any skips", func() {
+			So(skips.total(), ShouldEqual, 0)
+			So(skips.String(), ShouldEqual, "")
+		})
+
+		Convey("skips should be counted by reason", func() {
+			skips.skip(skipReasonNoop)
+			skips.skip("other")
+			skips.skip(skipReasonNoop)
+			So(skips.total(), ShouldEqual, 3)
+			So(skips.Counts(), ShouldResemble, map[string]int64{
+				skipReasonNoop: 2,
+				"other":        1,
+			})
+			So(skips.String(), ShouldEqual, "noop: 2, other: 1")
+		})
+	})
+}
@@ -0,0 +1,127 @@
+package mongooplog
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressLogInterval is how often the read and apply throughput is logged.
+const progressLogInterval = 10 * time.Second
+
+// throughputMeter counts the ops read from the source and applied to the
+// destination, so that the rates of the two can be compared to tell which side
+// is the bottleneck. The counts are safe for concurrent use.
+type throughputMeter struct {
+	read    int64
+	applied int64
+
+	// the counts and time when the rates were last taken
+	lastRead    int64
+	lastApplied int64
+	lastTime    time.Time
+}
+
+func newThroughputMeter(now time.Time) *throughputMeter {
+	return &throughputMeter{lastTime: now}
+}
+
+// addRead counts ops read from the source.
+func (m *throughputMeter) addRead(n int) {
+	atomic.AddInt64(&m.read, int64(n))
+}
+
+// addApplied counts ops applied to the destination.
+func (m *throughputMeter) addApplied(n int) {
+	atomic.AddInt64(&m.applied, int64(n))
+}
+
+// throughput is the rates of reading and applying ops over an interval.
+type throughput struct {
+	readPerSec    float64
+	appliedPerSec float64
+	read          int64
+	applied       int64
+}
+
+func (t throughput) String() string {
+	return fmt.Sprintf("read %.1f ops/sec from the source, applied %.1f ops/sec to the destination (%v read, %v applied in total)",
+		t.readPerSec, t.appliedPerSec, t.read, t.applied)
+}
+
+// take returns the rates since the last time they were taken. It must not be
+// called concurrently.
+func (m *throughputMeter) take(now time.Time) throughput {
+	read, applied := atomic.LoadInt64(&m.read), atomic.LoadInt64(&m.applied)
+	t := throughput{read: read, applied: applied}
+	if elapsed := now.Sub(m.lastTime).Seconds(); elapsed > 0 {
+		t.readPerSec = float64(read-m.lastRead) / elapsed
+		t.appliedPerSec = float64(applied-m.lastApplied) / elapsed
+	}
+	m.lastRead, m.lastApplied, m.lastTime = read, applied, now
+	return t
+}
+
+// latencyMeter records how long each applyOps command takes on the
+// destination, so that a destination under pressure can be told apart from a
+// source that is slow to read. Durations may be added concurrently.
+type latencyMeter struct {
+	mu        sync.Mutex
+	durations durations
+}
+
+// add records the duration of an applyOps command.
+func (m *latencyMeter) add(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations = append(m.durations, d)
+}
+
+// latencies summarizes the applyOps latencies over an interval.
+type latencies struct {
+	count int
+	min   time.Duration
+	avg   time.Duration
+	max   time.Duration
+	p99   time.Duration
+}
+
+func (l latencies) String() string {
+	if l.count == 0 {
+		return "no applyOps commands run on the destination"
+	}
+	return fmt.Sprintf("applyOps latency over %v batches: min %v, avg %v, max %v, p99 %v",
+		l.count, l.min, l.avg, l.max, l.p99)
+}
+
+// take returns the latencies since the last time they were taken.
+func (m *latencyMeter) take() latencies {
+	m.mu.Lock()
+	taken := m.durations
+	m.durations = nil
+	m.mu.Unlock()
+
+	l := latencies{count: len(taken)}
+	if l.count == 0 {
+		return l
+	}
+	sort.Sort(taken)
+	var total time.Duration
+	for _, d := range taken {
+		total += d
+	}
+	l.min, l.max = taken[0], taken[l.count-1]
+	l.avg = total / time.Duration(l.count)
+	// the smallest latency at least 99% of the batches were applied within
+	l.p99 = taken[(l.count*99+99)/100-1]
+	return l
+}
+
+// durations sorts durations in increasing order.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
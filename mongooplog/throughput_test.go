@@ -0,0 +1,69 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestThroughputMeter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a throughput meter", t, func() {
+		start := time.Unix(1000, 0)
+		meter := newThroughputMeter(start)
+
+		Convey("reads and applies should be measured separately", func() {
+			meter.addRead(300)
+			meter.addApplied(100)
+			rates := meter.take(start.Add(10 * time.Second))
+			So(rates.readPerSec, ShouldEqual, 30)
+			So(rates.appliedPerSec, ShouldEqual, 10)
+			So(rates.read, ShouldEqual, 300)
+			So(rates.applied, ShouldEqual, 100)
+
+			Convey("and rates should cover only the latest interval", func() {
+				meter.addApplied(200)
+				rates := meter.take(start.Add(20 * time.Second))
+				So(rates.readPerSec, ShouldEqual, 0)
+				So(rates.appliedPerSec, ShouldEqual, 20)
+				So(rates.applied, ShouldEqual, 300)
+			})
+		})
+	})
+}
+
+func TestLatencyMeter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a latency meter", t, func() {
+		meter := &latencyMeter{}
+
+		Convey("no latencies should be reported before any batch is applied", func() {
+			So(meter.take().count, ShouldEqual, 0)
+		})
+
+		Convey("the latencies of the batches applied should be summarized", func() {
+			for i := 100; i >= 1; i-- {
+				meter.add(time.Duration(i) * time.Millisecond)
+			}
+			l := meter.take()
+			So(l.count, ShouldEqual, 100)
+			So(l.min, ShouldEqual, time.Millisecond)
+			So(l.max, ShouldEqual, 100*time.Millisecond)
+			So(l.avg, ShouldEqual, 50500*time.Microsecond)
+			So(l.p99, ShouldEqual, 99*time.Millisecond)
+
+			Convey("and only those of the latest interval", func() {
+				meter.add(5 * time.Millisecond)
+				l := meter.take()
+				So(l.count, ShouldEqual, 1)
+				So(l.min, ShouldEqual, 5*time.Millisecond)
+				So(l.p99, ShouldEqual, 5*time.Millisecond)
+			})
+		})
+	})
+}
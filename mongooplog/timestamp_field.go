@@ -0,0 +1,57 @@
+package mongooplog
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultTimestampField is the field holding the timestamp of an oplog entry.
+const defaultTimestampField = "ts"
+
+// timestampFieldIter reads oplog entries whose timestamp is held in a field
+// other than ts, such as those copied into a capped change collection by a
+// custom capture process, setting the Timestamp of each from that field.
+type timestampFieldIter struct {
+	oplogIter
+	field string
+	err   error
+}
+
+// Next reads the next entry into result, which must be a *db.Oplog.
+func (it *timestampFieldIter) Next(result interface{}) bool {
+	op, ok := result.(*db.Oplog)
+	if !ok {
+		it.err = fmt.Errorf("can't read an oplog entry into %T", result)
+		return false
+	}
+	raw := bson.Raw{}
+	if it.err != nil || !it.oplogIter.Next(&raw) {
+		return false
+	}
+
+	*op = db.Oplog{}
+	if it.err = raw.Unmarshal(op); it.err != nil {
+		return false
+	}
+	fields := bson.M{}
+	if it.err = raw.Unmarshal(fields); it.err != nil {
+		return false
+	}
+	ts, ok := fields[it.field].(bson.MongoTimestamp)
+	if !ok {
+		it.err = fmt.Errorf("entry has no timestamp in `%v`: %v", it.field, fields[it.field])
+		return false
+	}
+	op.Timestamp = ts
+	return true
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *timestampFieldIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.oplogIter.Err()
+}
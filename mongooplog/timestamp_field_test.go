@@ -0,0 +1,72 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// rawDocIter yields a fixed list of documents, as a cursor reading them into
+// bson.Raw would.
+type rawDocIter struct {
+	docs []bson.D
+}
+
+func (r *rawDocIter) Next(result interface{}) bool {
+	if len(r.docs) == 0 {
+		return false
+	}
+	data, err := bson.Marshal(r.docs[0])
+	if err != nil {
+		panic(err)
+	}
+	r.docs = r.docs[1:]
+	return bson.Unmarshal(data, result) == nil
+}
+
+func (r *rawDocIter) Err() error    { return nil }
+func (r *rawDocIter) Timeout() bool { return false }
+func (r *rawDocIter) Close() error  { return nil }
+
+func TestTimestampFieldIter(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("With a change collection timestamped in another field", t, func() {
+		entry := func(ts bson.MongoTimestamp) bson.D {
+			return bson.D{
+				{"capturedAt", ts},
+				{"op", "i"},
+				{"ns", "test.users"},
+				{"o", bson.D{{"_id", 1}}},
+			}
+		}
+
+		Convey("entries should be read with their timestamps", func() {
+			iter := &timestampFieldIter{
+				oplogIter: &rawDocIter{docs: []bson.D{entry(1 << 32), entry(2 << 32)}},
+				field:     "capturedAt",
+			}
+			op := db.Oplog{}
+			So(iter.Next(&op), ShouldBeTrue)
+			So(op.Timestamp, ShouldEqual, bson.MongoTimestamp(1<<32))
+			So(op.Operation, ShouldEqual, "i")
+			So(op.Namespace, ShouldEqual, "test.users")
+			So(iter.Next(&op), ShouldBeTrue)
+			So(op.Timestamp, ShouldEqual, bson.MongoTimestamp(2<<32))
+			So(iter.Next(&op), ShouldBeFalse)
+			So(iter.Err(), ShouldBeNil)
+		})
+
+		Convey("an entry without a timestamp should stop the iteration", func() {
+			iter := &timestampFieldIter{
+				oplogIter: &rawDocIter{docs: []bson.D{{{"op", "i"}}}},
+				field:     "capturedAt",
+			}
+			So(iter.Next(&db.Oplog{}), ShouldBeFalse)
+			So(iter.Err(), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,239 @@
+package mongooplog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The formats of the object of an update oplog entry, as given by its $v field.
+// Entries without $v are replacements or plain modifier updates.
+const (
+	updateVersionClassic = 1
+	updateVersionDelta   = 2
+)
+
+// updateFormats describes the update oplog entry formats a destination server
+// can apply.
+type updateFormats struct {
+	// delta is whether $v:2 delta updates can be applied (4.9 and later)
+	delta bool
+
+	// classicMarker is whether $v:1 updates can be applied (before 5.1)
+	classicMarker bool
+}
+
+// updateFormatsForVersion returns the update formats supported by a server of
+// the given version.
+func updateFormatsForVersion(version []int) updateFormats {
+	return updateFormats{
+		delta:         versionAtLeast(version, 4, 9),
+		classicMarker: !versionAtLeast(version, 5, 1),
+	}
+}
+
+func versionAtLeast(version []int, atLeast ...int) bool {
+	for i := range atLeast {
+		if i == len(version) {
+			return false
+		}
+		if version[i] != atLeast[i] {
+			return version[i] > atLeast[i]
+		}
+	}
+	return true
+}
+
+// updateVersion returns the format version of an update's object, or 0 if it
+// has none.
+func updateVersion(object bson.D) (int, error) {
+	for _, elem := range object {
+		if elem.Name != "$v" {
+			continue
+		}
+		switch v := elem.Value.(type) {
+		case int:
+			return v, nil
+		case int32:
+			return int(v), nil
+		case int64:
+			return int(v), nil
+		case float64:
+			return int(v), nil
+		}
+		return 0, fmt.Errorf("unexpected $v value %#v", elem.Value)
+	}
+	return 0, nil
+}
+
+// translateUpdate rewrites an update oplog entry, if needed, into a classic
+// modifier update that the destination can apply. Other entries are returned
+// unchanged.
+func translateUpdate(op db.Oplog, formats updateFormats) (db.Oplog, error) {
+	if op.Operation != "u" {
+		return op, nil
+	}
+	version, err := updateVersion(op.Object)
+	if err != nil {
+		return op, fmt.Errorf("update of `%v`: %v", op.Namespace, err)
+	}
+
+	switch {
+	case version == updateVersionDelta && !formats.delta:
+		object, err := deltaToModifiers(op.Object)
+		if err != nil {
+			return op, fmt.Errorf("cannot translate $v:2 update of `%v` for the destination: %v", op.Namespace, err)
+		}
+		op.Object = object
+	case version == updateVersionClassic && !formats.classicMarker:
+		object := bson.D{}
+		for _, elem := range op.Object {
+			if elem.Name != "$v" {
+				object = append(object, elem)
+			}
+		}
+		op.Object = object
+	case version > updateVersionDelta:
+		return op, fmt.Errorf("update of `%v` has unsupported format $v:%v", op.Namespace, version)
+	}
+	return op, nil
+}
+
+// deltaToModifiers converts the object of a $v:2 delta update into an update
+// using $set and $unset.
+func deltaToModifiers(object bson.D) (bson.D, error) {
+	var diff bson.D
+	for _, elem := range object {
+		if elem.Name == "diff" {
+			var err error
+			if diff, err = asD(elem.Value); err != nil {
+				return nil, fmt.Errorf("diff: %v", err)
+			}
+		}
+	}
+	if diff == nil {
+		return nil, fmt.Errorf("$v:2 update has no diff")
+	}
+
+	set, unset := bson.D{}, bson.D{}
+	if err := flattenObjectDiff(diff, "", &set, &unset); err != nil {
+		return nil, err
+	}
+	modifiers := bson.D{}
+	if len(set) > 0 {
+		modifiers = append(modifiers, bson.DocElem{"$set", set})
+	}
+	if len(unset) > 0 {
+		modifiers = append(modifiers, bson.DocElem{"$unset", unset})
+	}
+	if len(modifiers) == 0 {
+		// an empty diff is a no-op update, which $set can't express
+		// without fields
+		return nil, fmt.Errorf("$v:2 update has an empty diff")
+	}
+	return modifiers, nil
+}
+
+// flattenObjectDiff adds the changes of a diff on a document at the given path
+// prefix to the $set and $unset documents.
+func flattenObjectDiff(diff bson.D, prefix string, set, unset *bson.D) error {
+	for _, section := range diff {
+		switch {
+		case section.Name == "u" || section.Name == "i":
+			fields, err := asD(section.Value)
+			if err != nil {
+				return fmt.Errorf("%v%v: %v", prefix, section.Name, err)
+			}
+			for _, field := range fields {
+				*set = append(*set, bson.DocElem{prefix + field.Name, field.Value})
+			}
+		case section.Name == "d":
+			fields, err := asD(section.Value)
+			if err != nil {
+				return fmt.Errorf("%v%v: %v", prefix, section.Name, err)
+			}
+			for _, field := range fields {
+				*unset = append(*unset, bson.DocElem{prefix + field.Name, ""})
+			}
+		case strings.HasPrefix(section.Name, "s"):
+			if err := flattenSubDiff(section, prefix+section.Name[1:], set, unset); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown diff section `%v%v`", prefix, section.Name)
+		}
+	}
+	return nil
+}
+
+// flattenArrayDiff adds the changes of a diff on an array at the given path to
+// the $set and $unset documents.
+func flattenArrayDiff(diff bson.D, path string, set, unset *bson.D) error {
+	for _, section := range diff {
+		switch {
+		case section.Name == "a":
+			// marks the diff as an array diff
+		case section.Name == "l":
+			// a new length beyond the updated elements can't be expressed
+			// with $set, since shrinking an array requires removing elements
+			return fmt.Errorf("`%v` is resized, which has no classic equivalent", path)
+		case strings.HasPrefix(section.Name, "u"):
+			index, err := arrayIndex(section.Name[1:], path)
+			if err != nil {
+				return err
+			}
+			*set = append(*set, bson.DocElem{path + "." + index, section.Value})
+		case strings.HasPrefix(section.Name, "s"):
+			index, err := arrayIndex(section.Name[1:], path)
+			if err != nil {
+				return err
+			}
+			if err := flattenSubDiff(section, path+"."+index, set, unset); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown array diff section `%v.%v`", path, section.Name)
+		}
+	}
+	return nil
+}
+
+// flattenSubDiff flattens a nested diff, which is either an object or an array
+// diff, at the given path.
+func flattenSubDiff(section bson.DocElem, path string, set, unset *bson.D) error {
+	subDiff, err := asD(section.Value)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	for _, elem := range subDiff {
+		if elem.Name == "a" {
+			return flattenArrayDiff(subDiff, path, set, unset)
+		}
+	}
+	return flattenObjectDiff(subDiff, path+".", set, unset)
+}
+
+func arrayIndex(index, path string) (string, error) {
+	if _, err := strconv.Atoi(index); err != nil {
+		return "", fmt.Errorf("invalid array index `%v` in diff of `%v`", index, path)
+	}
+	return index, nil
+}
+
+// asD returns the value as a bson.D, if it is a document.
+func asD(value interface{}) (bson.D, error) {
+	switch v := value.(type) {
+	case bson.D:
+		return v, nil
+	case bson.M:
+		doc := bson.D{}
+		for key, elem := range v {
+			doc = append(doc, bson.DocElem{key, elem})
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("expected a document, got %T", value)
+}
@@ -0,0 +1,115 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+var (
+	// a $v:1 update, as written by servers before 5.0
+	classicUpdate = db.Oplog{
+		Operation: "u",
+		Namespace: "test.data",
+		Object: bson.D{
+			{"$v", 1},
+			{"$set", bson.D{{"a", 1}, {"b.c", "x"}}},
+			{"$unset", bson.D{{"d", true}}},
+		},
+		Query: bson.D{{"_id", 1}},
+	}
+
+	// a $v:2 update, as written by servers from 5.0 on
+	deltaUpdate = db.Oplog{
+		Operation: "u",
+		Namespace: "test.data",
+		Object: bson.D{
+			{"$v", 2},
+			{"diff", bson.D{
+				{"u", bson.D{{"a", 1}}},
+				{"d", bson.D{{"d", false}}},
+				{"i", bson.D{{"e", "new"}}},
+				{"sb", bson.D{{"u", bson.D{{"c", "x"}}}}},
+				{"sarr", bson.D{{"a", true}, {"u1", 5}, {"s2", bson.D{{"i", bson.D{{"f", 6}}}}}}},
+			}},
+		},
+		Query: bson.D{{"_id", 1}},
+	}
+)
+
+func TestTranslateUpdate(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When translating update oplog entries", t, func() {
+
+		Convey("the supported formats should depend on the server version", func() {
+			So(updateFormatsForVersion([]int{4, 4, 1}), ShouldResemble,
+				updateFormats{delta: false, classicMarker: true})
+			So(updateFormatsForVersion([]int{5, 0, 0}), ShouldResemble,
+				updateFormats{delta: true, classicMarker: true})
+			So(updateFormatsForVersion([]int{6, 0, 0}), ShouldResemble,
+				updateFormats{delta: true, classicMarker: false})
+		})
+
+		Convey("$v:2 updates should be converted for older destinations", func() {
+			op, err := translateUpdate(deltaUpdate, updateFormats{classicMarker: true})
+			So(err, ShouldBeNil)
+			So(op.Object, ShouldResemble, bson.D{
+				{"$set", bson.D{{"a", 1}, {"e", "new"}, {"b.c", "x"}, {"arr.1", 5}, {"arr.2.f", 6}}},
+				{"$unset", bson.D{{"d", ""}}},
+			})
+			So(op.Query, ShouldResemble, deltaUpdate.Query)
+		})
+
+		Convey("$v:2 updates should be unchanged for newer destinations", func() {
+			op, err := translateUpdate(deltaUpdate, updateFormats{delta: true})
+			So(err, ShouldBeNil)
+			So(op, ShouldResemble, deltaUpdate)
+		})
+
+		Convey("$v:1 updates should lose their marker for newer"+
+			" destinations", func() {
+			op, err := translateUpdate(classicUpdate, updateFormats{delta: true})
+			So(err, ShouldBeNil)
+			So(op.Object, ShouldResemble, classicUpdate.Object[1:])
+
+			op, err = translateUpdate(classicUpdate, updateFormats{classicMarker: true})
+			So(err, ShouldBeNil)
+			So(op, ShouldResemble, classicUpdate)
+		})
+
+		Convey("the o2 criteria of an update without an _id should be kept", func() {
+			capped := deltaUpdate
+			capped.Query = bson.D{{"seq", 7}, {"region", "eu"}}
+			op, err := translateUpdate(capped, updateFormats{classicMarker: true})
+			So(err, ShouldBeNil)
+			So(op.Query, ShouldResemble, capped.Query)
+			So(opCriteria(op), ShouldResemble, capped.Query)
+		})
+
+		Convey("updates that can't be translated should fail", func() {
+			resize := deltaUpdate
+			resize.Object = bson.D{
+				{"$v", 2},
+				{"diff", bson.D{{"sarr", bson.D{{"a", true}, {"l", 1}}}}},
+			}
+			_, err := translateUpdate(resize, updateFormats{classicMarker: true})
+			So(err, ShouldNotBeNil)
+
+			unknown := deltaUpdate
+			unknown.Object = bson.D{{"$v", 3}}
+			_, err = translateUpdate(unknown, updateFormats{delta: true})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("other ops should be unchanged", func() {
+			insert := db.Oplog{Operation: "i", Object: bson.D{{"$v", 2}}}
+			op, err := translateUpdate(insert, updateFormats{})
+			So(err, ShouldBeNil)
+			So(op, ShouldResemble, insert)
+		})
+	})
+}
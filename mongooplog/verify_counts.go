@@ -0,0 +1,155 @@
+package mongooplog
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mongodb/mongo-tools/common"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+)
+
+// countedNamespaces collects the namespaces touched by the applied ops, to
+// compare their document counts with --verifyCounts once Run is done. Each
+// namespace of the destination is paired with the namespace of the source its
+// ops were read from, which differ when the Transform renames ops.
+type countedNamespaces struct {
+	sources map[string]string
+}
+
+func newCountedNamespaces() *countedNamespaces {
+	return &countedNamespaces{sources: map[string]string{}}
+}
+
+// observe records the namespace an op read from sourceNS writes to. Commands
+// other than those creating a collection don't touch a namespace whose
+// documents can be counted.
+func (c *countedNamespaces) observe(sourceNS string, op db.Oplog) {
+	switch op.Operation {
+	case "i", "u", "d":
+		c.sources[op.Namespace] = sourceNS
+	case "c":
+		if len(op.Object) == 0 || op.Object[0].Name != "create" {
+			return
+		}
+		collName, ok := op.Object[0].Value.(string)
+		if !ok {
+			return
+		}
+		dbName, _ := common.SplitNamespace(op.Namespace)
+		sourceDB, _ := common.SplitNamespace(sourceNS)
+		c.sources[dbName+"."+collName] = sourceDB + "." + collName
+	}
+}
+
+// names returns the destination namespaces, sorted.
+func (c *countedNamespaces) names() []string {
+	names := make([]string, 0, len(c.sources))
+	for ns := range c.sources {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// countComparison is the document counts of a namespace on the source and a
+// destination. The source is counted before and after the destination, and a
+// source whose count changed in between is being written to.
+type countComparison struct {
+	sourceBefore, sourceAfter, dest int
+}
+
+// mismatched returns whether the destination's count differs from the
+// source's.
+func (c countComparison) mismatched() bool {
+	return c.dest != c.sourceBefore || c.dest != c.sourceAfter
+}
+
+// changing returns whether the source was written to while it was counted, in
+// which case a mismatch may only be the ops not yet applied.
+func (c countComparison) changing() bool {
+	return c.sourceBefore != c.sourceAfter
+}
+
+// verifyCounts compares the number of documents in each namespace the applied
+// ops touched on the source with that on every destination server, once the
+// source is exhausted. It is a quick check that nothing was lost, not a diff
+// of the documents. Since the source may still be written to, a mismatch in a
+// namespace whose source count changes while it is checked is only logged as
+// a warning; other mismatches fail the run, and are logged with its error.
+func (mo *MongoOplog) verifyCounts(dest oplogDestination, counted *countedNamespaces) error {
+	providers := []*db.SessionProvider{mo.SessionProviderFrom}
+	sourceHosts := []string{mo.SourceOptions.From}
+	if len(mo.ShardSessionProviders) > 0 {
+		providers = mo.ShardSessionProviders
+		sourceHosts = mo.SourceOptions.MergeShards
+	}
+	sources := make([]*mgo.Session, 0, len(providers))
+	for i, provider := range providers {
+		session, err := provider.GetSession()
+		if err != nil {
+			return newError(ExitConnectionError, "error connecting to source db `%v`: %v", sourceHosts[i], err)
+		}
+		defer session.Close()
+		session.SetMode(mgo.Eventual, true)
+		sources = append(sources, session)
+	}
+
+	hosts, sessions := mo.destinationSessions(dest)
+	mismatches := []string{}
+	for _, ns := range counted.names() {
+		sourceNS := counted.sources[ns]
+		for i, session := range sessions {
+			comparison := countComparison{}
+			var err error
+			if comparison.sourceBefore, err = countAcross(sources, sourceNS); err != nil {
+				return newError(ExitConnectionError, "error counting `%v` on the source: %v", sourceNS, err)
+			}
+			if comparison.dest, err = countNamespace(session, ns); err != nil {
+				return newError(ExitConnectionError, "error counting `%v` on `%v`: %v", ns, hosts[i], err)
+			}
+			if comparison.sourceAfter, err = countAcross(sources, sourceNS); err != nil {
+				return newError(ExitConnectionError, "error counting `%v` on the source: %v", sourceNS, err)
+			}
+			if !comparison.mismatched() {
+				log.Logvf(log.DebugLow, "verified `%v` holds %v documents on `%v`", ns, comparison.dest, hosts[i])
+				continue
+			}
+			if comparison.changing() {
+				log.Logvf(log.Always, "warning: `%v` holds %v documents on `%v`, but `%v` on the source went from "+
+					"%v to %v while it was counted, so the ops not yet applied may account for it",
+					ns, comparison.dest, hosts[i], sourceNS, comparison.sourceBefore, comparison.sourceAfter)
+				continue
+			}
+			mismatches = append(mismatches, fmt.Sprintf("count mismatch: `%v` holds %v documents on `%v`, "+
+				"but `%v` holds %v on the source", ns, comparison.dest, hosts[i], sourceNS, comparison.sourceAfter))
+		}
+	}
+	if len(mismatches) > 0 {
+		return withDetails(newError(ExitCountMismatch, "--verifyCounts found %v document counts differing "+
+			"from the source's", len(mismatches)), mismatches)
+	}
+	log.Logvf(log.Always, "verified the document counts of %v namespaces", len(counted.sources))
+	return nil
+}
+
+// countAcross returns the number of documents in a namespace summed over the
+// sessions, which are the shards of a collection when merging shards.
+func countAcross(sessions []*mgo.Session, ns string) (int, error) {
+	total := 0
+	for _, session := range sessions {
+		count, err := countNamespace(session, ns)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// countNamespace returns the number of documents in a namespace.
+func countNamespace(session *mgo.Session, ns string) (int, error) {
+	dbName, collName := common.SplitNamespace(ns)
+	return session.DB(dbName).C(collName).Count()
+}
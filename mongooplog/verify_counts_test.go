@@ -0,0 +1,57 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestCountedNamespaces(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When collecting the namespaces to verify the counts of", t, func() {
+		counted := newCountedNamespaces()
+
+		Convey("inserts, updates and deletes should touch their namespace", func() {
+			counted.observe("app.users", db.Oplog{Operation: "i", Namespace: "app.users", Object: bson.D{{"_id", 1}}})
+			counted.observe("app.events", db.Oplog{Operation: "d", Namespace: "app.events", Object: bson.D{{"_id", 2}}})
+			counted.observe("app.users", db.Oplog{Operation: "u", Namespace: "app.users", Query: bson.D{{"_id", 1}}})
+			So(counted.names(), ShouldResemble, []string{"app.events", "app.users"})
+		})
+
+		Convey("a create command should touch the collection it creates", func() {
+			counted.observe("app.$cmd", db.Oplog{Operation: "c", Namespace: "app.$cmd", Object: bson.D{{"create", "logs"}}})
+			counted.observe("app.$cmd", db.Oplog{Operation: "c", Namespace: "app.$cmd", Object: bson.D{{"drop", "old"}}})
+			So(counted.names(), ShouldResemble, []string{"app.logs"})
+			So(counted.sources["app.logs"], ShouldEqual, "app.logs")
+		})
+
+		Convey("a renamed op should be paired with the namespace it was read from", func() {
+			counted.observe("app.users", db.Oplog{Operation: "i", Namespace: "copy.users", Object: bson.D{{"_id", 1}}})
+			counted.observe("app.$cmd", db.Oplog{Operation: "c", Namespace: "copy.$cmd", Object: bson.D{{"create", "logs"}}})
+			So(counted.sources, ShouldResemble, map[string]string{"copy.users": "app.users", "copy.logs": "app.logs"})
+		})
+	})
+
+	Convey("When comparing the counts of a namespace", t, func() {
+
+		Convey("equal counts should match", func() {
+			So(countComparison{sourceBefore: 5, sourceAfter: 5, dest: 5}.mismatched(), ShouldBeFalse)
+		})
+
+		Convey("a destination behind a quiet source should mismatch", func() {
+			comparison := countComparison{sourceBefore: 5, sourceAfter: 5, dest: 4}
+			So(comparison.mismatched(), ShouldBeTrue)
+			So(comparison.changing(), ShouldBeFalse)
+		})
+
+		Convey("a source written to while counted should be changing", func() {
+			comparison := countComparison{sourceBefore: 5, sourceAfter: 7, dest: 5}
+			So(comparison.mismatched(), ShouldBeTrue)
+			So(comparison.changing(), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,244 @@
+package mongooplog
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common"
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// verifyResume checks, before resuming after the checkpoint, that every
+// destination server holds the op at the checkpoint. A checkpoint is written
+// once its batch is applied, but a destination can still lose the batch, as
+// when its primary steps down before replicating it and rolls it back, and
+// resuming after the checkpoint would then skip the ops of the batch for good.
+// Only the op at the checkpoint is checked, by looking up the document it
+// wrote by its _id, or by the criteria of a delete, or of an update without
+// an _id that leaves them alone; ops whose effect can't be checked that way
+// are logged and resumed after.
+func (mo *MongoOplog) verifyResume(dest oplogDestination, namespaces []oplogNamespace,
+	resumeAfter bson.MongoTimestamp) error {
+
+	op, found, err := mo.checkpointOp(namespaces, resumeAfter)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Logvf(log.Always, "warning: can't verify the resume, as the source doesn't hold the op at "+
+			"checkpoint with Timestamp: %v", resumeAfter>>32)
+		return nil
+	}
+	op, keep, err := mo.transform(op)
+	if err != nil {
+		return err
+	}
+	if !keep {
+		log.Logvf(log.Always, "warning: can't verify the resume, as the op at checkpoint with Timestamp: %v "+
+			"is dropped by the transform", resumeAfter>>32)
+		return nil
+	}
+	filter, present, ok := resumeCheck(op)
+	if !ok {
+		log.Logvf(log.Always, "warning: can't verify the resume from the op at checkpoint with Timestamp: %v, "+
+			"a `%v` op on `%v`", resumeAfter>>32, op.Operation, op.Namespace)
+		return nil
+	}
+
+	dbName, collName := common.SplitNamespace(op.Namespace)
+	hosts, sessions := mo.destinationSessions(dest)
+	for i, session := range sessions {
+		count, err := session.DB(dbName).C(collName).Find(filter).Count()
+		if err != nil {
+			return newError(ExitConnectionError, "error verifying the resume on `%v`: %v", hosts[i], err)
+		}
+		if (count > 0) == present {
+			continue
+		}
+		problem := fmt.Sprintf("%v is missing from `%v`", opDocument(op), op.Namespace)
+		if !present {
+			problem = fmt.Sprintf("%v deleted from `%v` is still there", opDocument(op), op.Namespace)
+		}
+		return newError(ExitResumeBehind, "destination `%v` doesn't hold the op at checkpoint `%v` with "+
+			"Timestamp: %v, as %v; the batch the checkpoint ended may have been rolled back, so to reapply "+
+			"its ops, replace the checkpoint with the timestamp of an earlier op or remove it and start "+
+			"from --seconds or --since ago", hosts[i], mo.SourceOptions.Checkpoint, resumeAfter>>32, problem)
+	}
+	log.Logvf(log.Always, "verified that the destination holds the op at checkpoint with Timestamp: %v",
+		resumeAfter>>32)
+	return nil
+}
+
+// resumeCheck returns how to check that a destination holds an op: the
+// document matching the filter is present after an insert or update, and
+// absent after a delete. An insert is matched by its _id, and a delete by its
+// criteria. An update is matched by the _id in its criteria, as the other
+// fields of the criteria, such as a shard key, may be the ones it changes;
+// the criteria of an update without an _id are only used as the filter when
+// the update leaves every field of them alone. ok is false for other ops, for
+// inserts without an _id, and for updates without an _id that change a field
+// of their criteria.
+func resumeCheck(op db.Oplog) (filter bson.D, present bool, ok bool) {
+	switch op.Operation {
+	case "i":
+		for _, elem := range op.Object {
+			if elem.Name == "_id" {
+				return bson.D{elem}, true, true
+			}
+		}
+		return nil, false, false
+	case "u":
+		criteria := opCriteria(op)
+		for _, elem := range criteria {
+			if elem.Name == "_id" {
+				return bson.D{elem}, true, true
+			}
+		}
+		if len(criteria) == 0 || updateModifies(op.Object, criteria) {
+			return nil, false, false
+		}
+		return criteria, true, true
+	case "d":
+		criteria := opCriteria(op)
+		return criteria, false, len(criteria) > 0
+	}
+	return nil, false, false
+}
+
+// updateModifies returns whether an update changes a field of the criteria,
+// either as a replacement document that doesn't hold the field's value or
+// through an update operator naming the field, a path within it or a document
+// holding it.
+func updateModifies(update bson.D, criteria bson.D) bool {
+	replacement := true
+	for _, elem := range update {
+		if strings.HasPrefix(elem.Name, "$") {
+			replacement = false
+			break
+		}
+	}
+	if replacement {
+		for _, field := range criteria {
+			value, found := lookupField(update, field.Name)
+			if !found || !reflect.DeepEqual(value, field.Value) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, elem := range update {
+		fields, isDoc := elem.Value.(bson.D)
+		if !isDoc {
+			continue
+		}
+		for _, modified := range fields {
+			paths := []string{modified.Name}
+			if to, isString := modified.Value.(string); isString && elem.Name == "$rename" {
+				paths = append(paths, to)
+			}
+			for _, path := range paths {
+				for _, field := range criteria {
+					if path == field.Name || strings.HasPrefix(path, field.Name+".") ||
+						strings.HasPrefix(field.Name, path+".") {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// lookupField returns the value of a dotted path within a document.
+func lookupField(doc bson.D, path string) (interface{}, bool) {
+	name, rest := path, ""
+	if i := strings.Index(path, "."); i >= 0 {
+		name, rest = path[:i], path[i+1:]
+	}
+	for _, elem := range doc {
+		if elem.Name != name {
+			continue
+		}
+		if rest == "" {
+			return elem.Value, true
+		}
+		sub, isDoc := elem.Value.(bson.D)
+		if !isDoc {
+			return nil, false
+		}
+		return lookupField(sub, rest)
+	}
+	return nil, false
+}
+
+// checkpointOp reads the op at the checkpoint from the source, returning
+// whether the source still holds it.
+func (mo *MongoOplog) checkpointOp(namespaces []oplogNamespace,
+	resumeAfter bson.MongoTimestamp) (db.Oplog, bool, error) {
+
+	op := db.Oplog{}
+	if mo.SourceOptions.In != "" {
+		iter, err := openOplogFile(mo.SourceOptions.In, resumeAfter)
+		if err != nil {
+			return op, false, err
+		}
+		defer iter.Close()
+		for iter.Next(&op) {
+			if op.Timestamp >= resumeAfter {
+				return op, op.Timestamp == resumeAfter, nil
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return op, false, fmt.Errorf("error reading `%v`: %v", mo.SourceOptions.In, err)
+		}
+		return op, false, nil
+	}
+
+	providers := []*db.SessionProvider{mo.SessionProviderFrom}
+	hosts := []string{mo.SourceOptions.From}
+	if len(mo.ShardSessionProviders) > 0 {
+		providers = mo.ShardSessionProviders
+		hosts = mo.SourceOptions.MergeShards
+	}
+	for i, provider := range providers {
+		session, err := provider.GetSession()
+		if err != nil {
+			return op, false, newError(ExitConnectionError, "error connecting to source db `%v`: %v", hosts[i], err)
+		}
+		session.SetMode(mgo.Eventual, true)
+		for _, ns := range namespaces {
+			found, err := findOplogEntry(session.DB(ns.db).C(ns.coll), mo.SourceOptions.TimestampField,
+				resumeAfter, &op)
+			if err != nil {
+				session.Close()
+				return op, false, newError(ExitConnectionError, "error querying oplog `%v` on `%v`: %v",
+					ns, hosts[i], err)
+			}
+			if found {
+				session.Close()
+				return op, true, nil
+			}
+		}
+		session.Close()
+	}
+	return op, false, nil
+}
+
+// findOplogEntry reads the entry of an oplog with the given timestamp into op,
+// returning whether there is one.
+func findOplogEntry(oplog *mgo.Collection, tsField string, ts bson.MongoTimestamp, op *db.Oplog) (bool, error) {
+	var iter oplogIter = oplog.Find(bson.M{tsField: ts}).Iter()
+	if tsField != defaultTimestampField {
+		iter = &timestampFieldIter{oplogIter: iter, field: tsField}
+	}
+	found := iter.Next(op)
+	err := iter.Err()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return found, err
+}
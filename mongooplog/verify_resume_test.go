@@ -0,0 +1,108 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestResumeCheck(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When checking that a destination holds an op", t, func() {
+
+		Convey("an insert's document should be present, by its _id", func() {
+			filter, present, ok := resumeCheck(db.Oplog{Operation: "i", Object: bson.D{{"_id", 1}, {"a", 2}}})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"_id", 1}})
+		})
+
+		Convey("an update's document should be present, by the _id in its o2", func() {
+			filter, present, ok := resumeCheck(db.Oplog{
+				Operation: "u",
+				Query:     bson.D{{"_id", "x"}, {"region", "eu"}},
+				Object:    bson.D{{"$set", bson.D{{"a", 1}}}},
+			})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"_id", "x"}})
+		})
+
+		Convey("an update changing the shard key in its o2 should be matched by its _id alone", func() {
+			filter, present, ok := resumeCheck(db.Oplog{
+				Operation: "u",
+				Query:     bson.D{{"_id", "x"}, {"region", "eu"}},
+				Object:    bson.D{{"$set", bson.D{{"region", "us"}}}},
+			})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"_id", "x"}})
+
+			filter, present, ok = resumeCheck(db.Oplog{
+				Operation: "u",
+				Query:     bson.D{{"_id", "x"}, {"region", "eu"}},
+				Object:    bson.D{{"_id", "x"}, {"region", "us"}, {"a", 1}},
+			})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"_id", "x"}})
+		})
+
+		Convey("a delete's document should be absent", func() {
+			filter, present, ok := resumeCheck(db.Oplog{Operation: "d", Object: bson.D{{"_id", 3}}})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeFalse)
+			So(filter, ShouldResemble, bson.D{{"_id", 3}})
+		})
+
+		Convey("updates and deletes without an _id should be checked by their criteria", func() {
+			filter, present, ok := resumeCheck(db.Oplog{
+				Operation: "u",
+				Query:     bson.D{{"seq", 7}},
+				Object:    bson.D{{"$set", bson.D{{"a", 1}}}},
+			})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"seq", 7}})
+
+			filter, present, ok = resumeCheck(db.Oplog{Operation: "d", Object: bson.D{{"seq", 8}}})
+			So(ok, ShouldBeTrue)
+			So(present, ShouldBeFalse)
+			So(filter, ShouldResemble, bson.D{{"seq", 8}})
+		})
+
+		Convey("commands, inserts without an _id and updates without an o2 can't be checked", func() {
+			_, _, ok := resumeCheck(db.Oplog{Operation: "c", Object: bson.D{{"drop", "events"}}})
+			So(ok, ShouldBeFalse)
+			_, _, ok = resumeCheck(db.Oplog{Operation: "i", Object: bson.D{{"a", 1}}})
+			So(ok, ShouldBeFalse)
+			_, _, ok = resumeCheck(db.Oplog{Operation: "u", Object: bson.D{{"$set", bson.D{{"a", 1}}}}})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("updates without an _id that change a field of their criteria can't be checked", func() {
+			for _, update := range []bson.D{
+				{{"$set", bson.D{{"seq", 8}}}},
+				{{"$inc", bson.D{{"seq.n", 1}}}},
+				{{"$unset", bson.D{{"pos", ""}}}},
+				{{"$rename", bson.D{{"a", "seq"}}}},
+				{{"seq", 8}, {"a", 1}},
+			} {
+				_, _, ok := resumeCheck(db.Oplog{Operation: "u", Query: bson.D{{"seq", 7}, {"pos.x", 1}}, Object: update})
+				So(ok, ShouldBeFalse)
+			}
+
+			filter, _, ok := resumeCheck(db.Oplog{
+				Operation: "u",
+				Query:     bson.D{{"seq", 7}},
+				Object:    bson.D{{"seq", 7}, {"a", 1}},
+			})
+			So(ok, ShouldBeTrue)
+			So(filter, ShouldResemble, bson.D{{"seq", 7}})
+		})
+	})
+}
@@ -0,0 +1,71 @@
+package mongooplog
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// validateWriteConcern checks that a --writeConcern spec parses, and that it
+// asks for the ops to be acknowledged, which mongooplog needs to know whether
+// a batch was applied.
+func validateWriteConcern(spec string) error {
+	safety, err := db.BuildWriteConcern(spec, db.ReplSet)
+	if err != nil {
+		return err
+	}
+	if safety == nil {
+		return fmt.Errorf("'%v' is unacknowledged, but ops must be acknowledged to know that they were applied", spec)
+	}
+	return nil
+}
+
+// writeConcernDocument returns the writeConcern field of a command for the
+// write concern.
+func writeConcernDocument(safety *mgo.Safe) bson.D {
+	var doc bson.D
+	if safety.WMode != "" {
+		doc = append(doc, bson.DocElem{"w", safety.WMode})
+	} else {
+		doc = append(doc, bson.DocElem{"w", safety.W})
+	}
+	if safety.J {
+		doc = append(doc, bson.DocElem{"j", true})
+	}
+	if safety.FSync {
+		doc = append(doc, bson.DocElem{"fsync", true})
+	}
+	if safety.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{"wtimeout", safety.WTimeout})
+	}
+	return doc
+}
+
+// withWriteConcern returns the command with the write concern added, or as it
+// is if there is none.
+func withWriteConcern(command bson.D, writeConcern bson.D) bson.D {
+	if writeConcern == nil {
+		return command
+	}
+	return append(command, bson.DocElem{"writeConcern", writeConcern})
+}
+
+// checkWriteConcern returns an error if the destination applied a batch of
+// ops without satisfying the write concern, as when it times out waiting for
+// replication. With --continueOnError, the error is only logged, since the
+// ops were applied all the same.
+func (dest *sessionDestination) checkWriteConcern(wcErr *db.WriteConcernError, numOps int) error {
+	if wcErr == nil {
+		return nil
+	}
+	if dest.options.ContinueOnError {
+		log.Logvf(log.Always, "warning: %v ops were applied, but not with write concern %v: %v (code %v)",
+			numOps, dest.options.WriteConcern, wcErr.ErrMsg, wcErr.Code)
+		return nil
+	}
+	return newError(ExitApplyError, "%v ops were applied, but not with write concern %v: %v (code %v)",
+		numOps, dest.options.WriteConcern, wcErr.ErrMsg, wcErr.Code)
+}
@@ -0,0 +1,49 @@
+package mongooplog
+
+import (
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/mongodb/mongo-tools/common/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestWriteConcern(t *testing.T) {
+
+	testutil.VerifyTestType(t, testutil.UnitTestType)
+
+	Convey("When applying ops with a write concern", t, func() {
+
+		Convey("the write concern should be added to the commands", func() {
+			doc := writeConcernDocument(&mgo.Safe{WMode: "majority", J: true, WTimeout: 5000})
+			So(doc, ShouldResemble, bson.D{{"w", "majority"}, {"j", true}, {"wtimeout", 5000}})
+			So(writeConcernDocument(&mgo.Safe{W: 2}), ShouldResemble, bson.D{{"w", 2}})
+
+			command := withWriteConcern(bson.D{{"applyOps", []db.Oplog{}}}, bson.D{{"w", 2}})
+			So(command, ShouldResemble, bson.D{{"applyOps", []db.Oplog{}}, {"writeConcern", bson.D{{"w", 2}}}})
+			So(withWriteConcern(bson.D{{"ping", 1}}, nil), ShouldResemble, bson.D{{"ping", 1}})
+		})
+
+		Convey("only acknowledged write concerns should be accepted", func() {
+			So(validateWriteConcern("majority"), ShouldBeNil)
+			So(validateWriteConcern("{w: 2, wtimeout: 5000}"), ShouldBeNil)
+			So(validateWriteConcern("{w: 0}"), ShouldNotBeNil)
+			So(validateWriteConcern("{w: -1}"), ShouldNotBeNil)
+		})
+
+		Convey("an unsatisfied write concern should fail the batch", func() {
+			wcErr := &db.WriteConcernError{Code: 64, ErrMsg: "waiting for replication timed out"}
+			dest := &sessionDestination{options: &DestinationOptions{WriteConcern: "majority"}}
+			So(dest.checkWriteConcern(nil, 3), ShouldBeNil)
+			err := dest.checkWriteConcern(wcErr, 3)
+			So(err, ShouldNotBeNil)
+			So(ExitCode(err), ShouldEqual, ExitApplyError)
+
+			Convey("unless --continueOnError is given", func() {
+				dest.options.ContinueOnError = true
+				So(dest.checkWriteConcern(wcErr, 3), ShouldBeNil)
+			})
+		})
+	})
+}
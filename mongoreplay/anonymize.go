@@ -0,0 +1,311 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// anonymizedString is the placeholder used in place of string literals.
+const anonymizedString = "x"
+
+// preservedOperators are query operators whose arguments describe the shape of
+// the query rather than the data being queried, and so are left untouched.
+var preservedOperators = map[string]bool{
+	"$exists":        true,
+	"$type":          true,
+	"$options":       true,
+	"$meta":          true,
+	"$near":          true,
+	"$nearSphere":    true,
+	"$geoWithin":     true,
+	"$geoIntersects": true,
+	"$within":        true,
+	"$language":      true,
+}
+
+// anonymizedWhere is the placeholder used in place of the JavaScript of a
+// $where clause, which keeps the clause, and so how the query is run, while
+// matching every document it's given.
+const anonymizedWhere = "true"
+
+// filterFields maps command names to the fields of the command that hold a
+// query filter.
+var filterFields = map[string]string{
+	"find":          "filter",
+	"count":         "query",
+	"distinct":      "query",
+	"findAndModify": "query",
+	"findandmodify": "query",
+}
+
+// anonymizeOp replaces the literal values in the query filters of the given op
+// with placeholders of the same type. The shape of each filter is kept intact
+// so that the query selects the same indexes on the target. It returns an error
+// if the op's bson cannot be read.
+func anonymizeOp(op Op) error {
+	var err error
+	switch castOp := op.(type) {
+	case *QueryOp:
+		castOp.Query, err = anonymizeQuery(castOp.Query, strings.HasSuffix(castOp.Collection, "$cmd"))
+	case *CommandGetMore, *MsgGetMore:
+		// getmores carry no filter, and their cursorIDs must be preserved
+	case *CommandOp:
+		var args bson.D
+		args, err = anonymizeCommand(castOp.CommandArgs)
+		if err == nil {
+			castOp.CommandArgs = &args
+		}
+	case *MsgOp:
+		if err = castOp.foldSequences(); err == nil {
+			err = castOp.editBody(func(doc bson.D) (bson.D, error) {
+				return anonymizeCommand(doc)
+			})
+		}
+	case *UpdateOp:
+		castOp.Selector, err = anonymizeFilter(castOp.Selector)
+	case *DeleteOp:
+		castOp.Selector, err = anonymizeFilter(castOp.Selector)
+	}
+	if err != nil {
+		return fmt.Errorf("error anonymizing op: %v", err)
+	}
+	return nil
+}
+
+// anonymizeQuery anonymizes the query document of an OP_QUERY, which is either
+// a command, a bare filter, or a filter wrapped along with query modifiers.
+func anonymizeQuery(query interface{}, isCommand bool) (interface{}, error) {
+	if isCommand {
+		doc, err := anonymizeCommand(query)
+		return &doc, err
+	}
+	doc, err := toBSOND(query)
+	if err != nil {
+		return nil, err
+	}
+	for i, elem := range doc {
+		if elem.Name == "$query" || elem.Name == "query" {
+			doc[i].Value, err = anonymizeFilter(elem.Value)
+			return &doc, err
+		}
+	}
+	return anonymizeFilter(&doc)
+}
+
+// anonymizeCommand anonymizes the filters contained in a command document.
+func anonymizeCommand(command interface{}) (bson.D, error) {
+	doc, err := toBSOND(command)
+	if err != nil || len(doc) == 0 {
+		return doc, err
+	}
+	commandName := doc[0].Name
+	for i, elem := range doc {
+		switch {
+		case elem.Name == filterFields[commandName]:
+			doc[i].Value, err = anonymizeFilter(elem.Value)
+		case commandName == "update" && elem.Name == "updates",
+			commandName == "delete" && elem.Name == "deletes":
+			doc[i].Value, err = anonymizeEach(elem.Value, func(stmt bson.D) error {
+				return anonymizeField(stmt, "q", anonymizeFilter)
+			})
+		case commandName == "aggregate" && elem.Name == "pipeline":
+			doc[i].Value, err = anonymizeEach(elem.Value, func(stage bson.D) error {
+				return anonymizeField(stage, "$match", anonymizeFilter)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// anonymizeEach calls fn on each document in an array of documents.
+func anonymizeEach(value interface{}, fn func(bson.D) error) (interface{}, error) {
+	elems, ok := value.([]interface{})
+	if !ok {
+		return value, nil
+	}
+	for i, elem := range elems {
+		doc, err := toBSOND(elem)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(doc); err != nil {
+			return nil, err
+		}
+		elems[i] = doc
+	}
+	return elems, nil
+}
+
+// anonymizeField replaces the value of the named field of doc with the result
+// of calling fn on it.
+func anonymizeField(doc bson.D, name string, fn func(interface{}) (interface{}, error)) error {
+	for i, elem := range doc {
+		if elem.Name == name {
+			value, err := fn(elem.Value)
+			if err != nil {
+				return err
+			}
+			doc[i].Value = value
+		}
+	}
+	return nil
+}
+
+// anonymizeFilter anonymizes a query filter document.
+func anonymizeFilter(filter interface{}) (interface{}, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	doc, err := toBSOND(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, anonymizeDoc(doc)
+}
+
+func anonymizeDoc(doc bson.D) error {
+	for i, elem := range doc {
+		// values in _id are preserved so that ops routed by _id still
+		// reach the same documents
+		if elem.Name == "_id" || strings.HasPrefix(elem.Name, "_id.") ||
+			preservedOperators[elem.Name] {
+			continue
+		}
+		var value interface{}
+		var err error
+		switch elem.Name {
+		case "$where":
+			value = anonymizeWhere(elem.Value)
+		case "$mod":
+			value, err = anonymizeMod(elem.Value)
+		case "$regex":
+			if pattern, ok := elem.Value.(string); ok {
+				value = anonymizePattern(pattern)
+				break
+			}
+			fallthrough
+		default:
+			value, err = anonymizeValue(elem.Value)
+		}
+		if err != nil {
+			return err
+		}
+		doc[i].Value = value
+	}
+	return nil
+}
+
+// anonymizeWhere returns a placeholder for the JavaScript of a $where clause,
+// of the same bson type. The scope of JavaScript with a scope is dropped.
+func anonymizeWhere(value interface{}) interface{} {
+	if _, ok := value.(bson.JavaScript); ok {
+		return bson.JavaScript{Code: anonymizedWhere}
+	}
+	return anonymizedWhere
+}
+
+// anonymizeMod returns a placeholder for the [divisor, remainder] of a $mod,
+// keeping the divisor, as a divisor of zero is refused by the server.
+func anonymizeMod(value interface{}) (interface{}, error) {
+	args, ok := value.([]interface{})
+	if !ok || len(args) != 2 {
+		return anonymizeValue(value)
+	}
+	remainder, err := anonymizeValue(args[1])
+	return []interface{}{args[0], remainder}, err
+}
+
+// anonymizePattern returns a placeholder for a regular expression, keeping a
+// leading anchor so that the regex can still use index bounds.
+func anonymizePattern(pattern string) string {
+	if strings.HasPrefix(pattern, "^") {
+		return "^" + anonymizedString
+	}
+	return anonymizedString
+}
+
+// anonymizeValue returns a placeholder with the same bson type as the given
+// value, recursing into documents and arrays.
+func anonymizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bson.D:
+		return v, anonymizeDoc(v)
+	case *bson.D, bson.Raw, *bson.Raw, bson.M:
+		doc, err := toBSOND(v)
+		if err != nil {
+			return nil, err
+		}
+		return doc, anonymizeDoc(doc)
+	case []interface{}:
+		for i, elem := range v {
+			anonymized, err := anonymizeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = anonymized
+		}
+		return v, nil
+	case string:
+		// strings starting with a $ are field paths and variables, as in
+		// $expr, which are part of the query's shape
+		if strings.HasPrefix(v, "$") {
+			return v, nil
+		}
+		return anonymizedString, nil
+	case bson.Symbol:
+		return bson.Symbol(anonymizedString), nil
+	case int:
+		return 0, nil
+	case int32:
+		return int32(0), nil
+	case int64:
+		return int64(0), nil
+	case float64:
+		return float64(0), nil
+	case bool:
+		return false, nil
+	case time.Time:
+		return time.Unix(0, 0), nil
+	case bson.ObjectId:
+		return bson.ObjectId(strings.Repeat("\x00", 12)), nil
+	case bson.MongoTimestamp:
+		return bson.MongoTimestamp(0), nil
+	case []byte:
+		return []byte{}, nil
+	case bson.Binary:
+		return bson.Binary{Kind: v.Kind}, nil
+	case bson.RegEx:
+		return bson.RegEx{Pattern: anonymizePattern(v.Pattern), Options: v.Options}, nil
+	}
+	return value, nil
+}
+
+// toBSOND converts a bson document in any of the forms used by parsed ops into
+// a bson.D.
+func toBSOND(value interface{}) (bson.D, error) {
+	switch v := value.(type) {
+	case bson.D:
+		return v, nil
+	case *bson.D:
+		return *v, nil
+	case bson.Raw:
+		doc := bson.D{}
+		err := v.Unmarshal(&doc)
+		return doc, err
+	case *bson.Raw:
+		return toBSOND(*v)
+	case bson.M:
+		doc := bson.D{}
+		for key, elem := range v {
+			doc = append(doc, bson.DocElem{Name: key, Value: elem})
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unexpected document type %T", value)
+}
@@ -0,0 +1,124 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestAnonymizeQueryFilter(t *testing.T) {
+	filter := bson.D{
+		{Name: "_id", Value: 12345},
+		{Name: "name", Value: "alice"},
+		{Name: "age", Value: bson.D{{Name: "$gt", Value: int64(30)}}},
+		{Name: "tags", Value: bson.D{{Name: "$in", Value: []interface{}{"a", "b"}}}},
+		{Name: "email", Value: bson.D{{Name: "$exists", Value: true}}},
+		{Name: "city", Value: bson.RegEx{Pattern: "^New", Options: "i"}},
+		{Name: "street", Value: bson.D{{Name: "$regex", Value: "^Main"}, {Name: "$options", Value: "i"}}},
+		{Name: "state", Value: bson.D{{Name: "$regex", Value: "York$"}}},
+		{Name: "$where", Value: "this.name == 'alice'"},
+	}
+	rawFilter, err := bson.Marshal(filter)
+	if err != nil {
+		t.Fatalf("couldn't marshal filter: %v", err)
+	}
+	op := &QueryOp{}
+	op.Collection = "test.test"
+	op.Query = &bson.Raw{Kind: 0x03, Data: rawFilter}
+
+	if err := anonymizeOp(op); err != nil {
+		t.Fatalf("couldn't anonymize op: %v", err)
+	}
+	expected := bson.D{
+		{Name: "_id", Value: 12345},
+		{Name: "name", Value: "x"},
+		{Name: "age", Value: bson.D{{Name: "$gt", Value: int64(0)}}},
+		{Name: "tags", Value: bson.D{{Name: "$in", Value: []interface{}{"x", "x"}}}},
+		{Name: "email", Value: bson.D{{Name: "$exists", Value: true}}},
+		{Name: "city", Value: bson.RegEx{Pattern: "^x", Options: "i"}},
+		{Name: "street", Value: bson.D{{Name: "$regex", Value: "^x"}, {Name: "$options", Value: "i"}}},
+		{Name: "state", Value: bson.D{{Name: "$regex", Value: "x"}}},
+		{Name: "$where", Value: "true"},
+	}
+	anonymized, ok := op.Query.(*bson.D)
+	if !ok {
+		t.Fatalf("anonymized query has unexpected type %T", op.Query)
+	}
+	if !reflect.DeepEqual(*anonymized, expected) {
+		t.Errorf("anonymized filter was %#v, expected %#v", *anonymized, expected)
+	}
+}
+
+func TestAnonymizeCommand(t *testing.T) {
+	op := &CommandOp{}
+	op.CommandName = "find"
+	op.CommandArgs = &bson.D{
+		{Name: "find", Value: "test"},
+		{Name: "filter", Value: bson.D{{Name: "name", Value: "alice"}}},
+		{Name: "limit", Value: 10},
+	}
+	if err := anonymizeOp(op); err != nil {
+		t.Fatalf("couldn't anonymize op: %v", err)
+	}
+	expected := bson.D{
+		{Name: "find", Value: "test"},
+		{Name: "filter", Value: &bson.D{{Name: "name", Value: "x"}}},
+		{Name: "limit", Value: 10},
+	}
+	if !reflect.DeepEqual(*op.CommandArgs.(*bson.D), expected) {
+		t.Errorf("anonymized command was %#v, expected %#v", op.CommandArgs, expected)
+	}
+
+	getMore := &CommandGetMore{}
+	getMore.CommandArgs = &bson.D{{Name: "getMore", Value: int64(5)}}
+	if err := anonymizeOp(getMore); err != nil {
+		t.Fatalf("couldn't anonymize op: %v", err)
+	}
+	cursorIDs, err := getMore.getCursorIDs()
+	if err != nil {
+		t.Fatalf("couldn't get cursorIDs: %v", err)
+	}
+	if len(cursorIDs) != 1 || cursorIDs[0] != 5 {
+		t.Errorf("getmore cursorIDs were changed to %v", cursorIDs)
+	}
+}
+
+func TestAnonymizeMod(t *testing.T) {
+	doc := bson.D{{Name: "n", Value: bson.D{{Name: "$mod", Value: []interface{}{4, 3}}}}}
+	if err := anonymizeDoc(doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "n", Value: bson.D{{Name: "$mod", Value: []interface{}{4, 0}}}}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("anonymized $mod was %#v, expected %#v", doc, expected)
+	}
+}
+
+func TestAnonymizeText(t *testing.T) {
+	doc := bson.D{{Name: "$text", Value: bson.D{
+		{Name: "$search", Value: "coffee shop"},
+		{Name: "$language", Value: "es"},
+	}}}
+	if err := anonymizeDoc(doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "$text", Value: bson.D{
+		{Name: "$search", Value: "x"},
+		{Name: "$language", Value: "es"},
+	}}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("anonymized $text was %#v, expected %#v", doc, expected)
+	}
+}
+
+func TestAnonymizeExpr(t *testing.T) {
+	doc := bson.D{{Name: "$expr", Value: bson.D{{Name: "$eq", Value: []interface{}{"$status", "open"}}}}}
+	if err := anonymizeDoc(doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "$expr", Value: bson.D{{Name: "$eq", Value: []interface{}{"$status", "x"}}}}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("anonymized $expr was %#v, expected %#v", doc, expected)
+	}
+}
@@ -556,6 +556,11 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 		a.insertIntoConn(t, conn, timestamp)
 	} else if diff := conn.nextSeq.Difference(seq); diff > 0 {
 		a.insertIntoConn(t, conn, timestamp)
+		if t.RST {
+			// nothing will fill the gap before a reset, so push through what
+			// was buffered now, rather than when the connection times out
+			a.flushReset(conn)
+		}
 	} else {
 		bytes, conn.nextSeq = byteSpan(conn.nextSeq, seq, bytes)
 		a.ret = append(a.ret, tcpassembly.Reassembly{
@@ -621,6 +626,18 @@ func (a *Assembler) skipFlush(conn *connection) {
 	a.sendToConnection(conn)
 }
 
+// flushReset pushes through all of the bytes buffered for a connection that
+// was reset, skipping those it was waiting for, and closes it.
+func (a *Assembler) flushReset(conn *connection) {
+	if len(a.ret) > 0 {
+		a.sendToConnection(conn)
+	}
+	for !conn.closed {
+		a.skipFlush(conn)
+	}
+	a.ret = a.ret[:0]
+}
+
 func (p *StreamPool) remove(conn *connection) {
 	p.mu.Lock()
 	delete(p.conns, conn.key)
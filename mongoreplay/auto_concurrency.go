@@ -0,0 +1,69 @@
+package mongoreplay
+
+import "fmt"
+
+// connectionPool spreads the ops of the recorded connections over a fixed
+// number of connections to the target. Each recorded connection is played on
+// one pooled connection, so its ops stay in order, and it is given the pooled
+// connection playing the fewest open recorded connections when its first op
+// is played. Pooled connections stay open until the end of the playback.
+type connectionPool struct {
+	// recorded holds the pooled connection each recorded connection plays on
+	recorded map[string]int
+
+	// open holds the number of open recorded connections each pooled
+	// connection plays
+	open []int
+}
+
+func newConnectionPool(size int) *connectionPool {
+	return &connectionPool{
+		recorded: map[string]int{},
+		open:     make([]int, size),
+	}
+}
+
+// size returns the number of pooled connections.
+func (pool *connectionPool) size() int {
+	return len(pool.open)
+}
+
+// connection returns the pooled connection to play the ops of the recorded
+// connection on.
+func (pool *connectionPool) connection(recorded string) string {
+	slot, ok := pool.recorded[recorded]
+	if !ok {
+		for i := range pool.open {
+			if pool.open[i] < pool.open[slot] {
+				slot = i
+			}
+		}
+		pool.recorded[recorded] = slot
+		pool.open[slot]++
+	}
+	return fmt.Sprintf("pooled %v", slot)
+}
+
+// release frees the pooled connection of the recorded connection an EOF op
+// ends, in either direction.
+func (pool *connectionPool) release(op *RecordedOp) {
+	for _, recorded := range []string{op.ConnectionString(), op.ReversedConnectionString()} {
+		if slot, ok := pool.recorded[recorded]; ok {
+			pool.open[slot]--
+			delete(pool.recorded, recorded)
+		}
+	}
+}
+
+// autoConcurrency returns the number of connections to play a tape on to
+// match the most ops it had in flight at once, capped at maxConnections.
+func autoConcurrency(peakInFlight, maxConnections int) int {
+	connections := peakInFlight
+	if connections > maxConnections {
+		connections = maxConnections
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	return connections
+}
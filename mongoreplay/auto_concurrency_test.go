@@ -0,0 +1,49 @@
+package mongoreplay
+
+import "testing"
+
+func TestPooledPlaybackConnection(t *testing.T) {
+	request := func(src string) *RecordedOp {
+		op := &RecordedOp{SrcEndpoint: src, DstEndpoint: "server"}
+		op.RawOp.Header.OpCode = OpCodeQuery
+		return op
+	}
+	a, b, c := request("a"), request("b"), request("c")
+	reply := &RecordedOp{SrcEndpoint: "server", DstEndpoint: "a"}
+	reply.RawOp.Header.OpCode = OpCodeReply
+
+	context := NewExecutionContext(&StatCollector{})
+	context.Connections = newConnectionPool(2)
+	first, second := context.playbackConnection(a), context.playbackConnection(b)
+	if first == second {
+		t.Errorf("expected the first two recorded connections on different pooled connections")
+	}
+	if context.playbackConnection(reply) != first || context.playbackConnection(a) != first {
+		t.Errorf("expected the ops of a recorded connection to stay on its pooled connection")
+	}
+	if connection := context.playbackConnection(c); connection != first {
+		t.Errorf("expected the third recorded connection on the first pooled connection, got %v", connection)
+	}
+
+	// once the second recorded connection ends, its pooled connection is the
+	// least used
+	context.Connections.release(&RecordedOp{SrcEndpoint: "server", DstEndpoint: "b", EOF: true})
+	if connection := context.playbackConnection(request("d")); connection != second {
+		t.Errorf("expected a new recorded connection on the freed pooled connection, got %v", connection)
+	}
+}
+
+func TestAutoConcurrency(t *testing.T) {
+	for _, test := range []struct {
+		peak, max, expected int
+	}{
+		{peak: 3, max: 1000, expected: 3},
+		{peak: 3000, max: 1000, expected: 1000},
+		{peak: 0, max: 1000, expected: 1},
+	} {
+		if connections := autoConcurrency(test.peak, test.max); connections != test.expected {
+			t.Errorf("expected %v connections for a peak of %v capped at %v, got %v",
+				test.expected, test.peak, test.max, connections)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package mongoreplay
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// batchSizeOverride sets the batch size of the reads played with --batchSize,
+// keeping count of the ops of each kind it was set on to report them. It is
+// safe for concurrent use.
+type batchSizeOverride struct {
+	size int32
+
+	sync.Mutex
+	counts map[string]int64
+}
+
+func newBatchSizeOverride(size int32) *batchSizeOverride {
+	return &batchSizeOverride{size: size, counts: map[string]int64{}}
+}
+
+// setBatchSize sets the batch size of a find, aggregate or getmore op, in the
+// numberToReturn of legacy queries and getmores, in the batchSize of the
+// find and getMore commands, and in the cursor of aggregate commands. Legacy
+// queries asking for a single batch, with a negative or one numberToReturn,
+// are left as they are, as are aggregates that don't return a cursor.
+func (o *batchSizeOverride) setBatchSize(op Op) error {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			if castOp.Limit < 0 || castOp.Limit == 1 {
+				return nil
+			}
+			castOp.Limit = o.size
+			o.count("query")
+			return nil
+		}
+		doc, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		castOp.Query = o.setCommandBatchSize(doc)
+	case *GetMoreOp:
+		castOp.Limit = o.size
+		o.count("getmore")
+	case *CommandOp:
+		return o.setCommandOpBatchSize(castOp)
+	case *CommandGetMore:
+		return o.setCommandOpBatchSize(&castOp.CommandOp)
+	case *MsgOp:
+		return o.setMsgOpBatchSize(castOp)
+	case *MsgGetMore:
+		return o.setMsgOpBatchSize(&castOp.MsgOp)
+	}
+	return nil
+}
+
+func (o *batchSizeOverride) setMsgOpBatchSize(op *MsgOp) error {
+	return op.editBody(func(doc bson.D) (bson.D, error) {
+		return o.setCommandBatchSize(doc), nil
+	})
+}
+
+func (o *batchSizeOverride) setCommandOpBatchSize(op *CommandOp) error {
+	doc, err := toBSOND(op.CommandArgs)
+	if err != nil {
+		return err
+	}
+	// getMore cursors are rewritten in place, which needs a *bson.D
+	doc = o.setCommandBatchSize(doc)
+	op.CommandArgs = &doc
+	return nil
+}
+
+// setCommandBatchSize sets the batch size of a find, aggregate or getMore
+// command, replacing any it was recorded with.
+func (o *batchSizeOverride) setCommandBatchSize(doc bson.D) bson.D {
+	if len(doc) == 0 {
+		return doc
+	}
+	if doc[0].Name == "$query" || doc[0].Name == "query" {
+		// a command wrapped to carry a read preference
+		if inner, err := toBSOND(doc[0].Value); err == nil {
+			doc[0].Value = o.setCommandBatchSize(inner)
+		}
+		return doc
+	}
+
+	switch doc[0].Name {
+	case "find", "getMore":
+		doc = withField(doc, "batchSize", o.size)
+	case "aggregate":
+		i := fieldIndex(doc, "cursor")
+		if i < 0 {
+			return doc
+		}
+		cursor, err := toBSOND(doc[i].Value)
+		if err != nil {
+			return doc
+		}
+		doc[i].Value = withField(append(bson.D{}, cursor...), "batchSize", o.size)
+	default:
+		return doc
+	}
+	o.count(doc[0].Name)
+	return doc
+}
+
+// withField sets the field of the document to the value, adding it if the
+// document doesn't have it.
+func withField(doc bson.D, name string, value interface{}) bson.D {
+	if i := fieldIndex(doc, name); i >= 0 {
+		doc[i].Value = value
+		return doc
+	}
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
+// fieldIndex returns the index of the field of the document, or -1 if it
+// doesn't have it.
+func fieldIndex(doc bson.D, name string) int {
+	for i, elem := range doc {
+		if elem.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *batchSizeOverride) count(kind string) {
+	o.Lock()
+	o.counts[kind]++
+	o.Unlock()
+}
+
+// report logs the batch size the reads were played with, and the number of
+// ops of each kind it was set on.
+func (o *batchSizeOverride) report() {
+	o.Lock()
+	defer o.Unlock()
+	kinds := make([]string, 0, len(o.counts))
+	for kind := range o.counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	if len(kinds) == 0 {
+		userInfoLogger.Logvf(Always, "Warning: no find, aggregate or getmore ops were played with --batchSize")
+	}
+	for _, kind := range kinds {
+		userInfoLogger.Logvf(Always, "Played %v %v ops with a batch size of %v", o.counts[kind], kind, o.size)
+	}
+}
@@ -0,0 +1,73 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestSetBatchSize(t *testing.T) {
+	override := newBatchSizeOverride(10)
+	query := func(collection string, limit int32, doc bson.D) *QueryOp {
+		return &QueryOp{QueryOp: mgo.QueryOp{Collection: collection, Limit: limit, Query: doc}}
+	}
+
+	cases := []struct {
+		op    *QueryOp
+		limit int32
+		query bson.D
+	}{
+		{query("test.c", 0, bson.D{}), 10, bson.D{}},
+		{query("test.c", 101, bson.D{}), 10, bson.D{}},
+		// a single batch is left as it is
+		{query("test.c", -5, bson.D{}), -5, bson.D{}},
+		{query("test.c", 1, bson.D{}), 1, bson.D{}},
+		{query("test.$cmd", 0, bson.D{{Name: "find", Value: "c"}}), 0,
+			bson.D{{Name: "find", Value: "c"}, {Name: "batchSize", Value: int32(10)}}},
+		{query("test.$cmd", 0, bson.D{{Name: "find", Value: "c"}, {Name: "batchSize", Value: 2}}), 0,
+			bson.D{{Name: "find", Value: "c"}, {Name: "batchSize", Value: int32(10)}}},
+		{query("test.$cmd", 0, bson.D{{Name: "aggregate", Value: "c"}, {Name: "cursor", Value: bson.D{}}}), 0,
+			bson.D{{Name: "aggregate", Value: "c"}, {Name: "cursor", Value: bson.D{{Name: "batchSize", Value: int32(10)}}}}},
+		// an aggregate without a cursor returns its results inline
+		{query("test.$cmd", 0, bson.D{{Name: "aggregate", Value: "c"}}), 0, bson.D{{Name: "aggregate", Value: "c"}}},
+		{query("test.$cmd", 0, bson.D{{Name: "count", Value: "c"}}), 0, bson.D{{Name: "count", Value: "c"}}},
+		{query("test.$cmd", 0, bson.D{{Name: "$query", Value: bson.D{{Name: "getMore", Value: int64(5)}}}}), 0,
+			bson.D{{Name: "$query", Value: bson.D{{Name: "getMore", Value: int64(5)}, {Name: "batchSize", Value: int32(10)}}}}},
+	}
+	for _, c := range cases {
+		if err := override.setBatchSize(c.op); err != nil {
+			t.Fatal(err)
+		}
+		if c.op.Limit != c.limit {
+			t.Errorf("expected a numberToReturn of %v, got %v", c.limit, c.op.Limit)
+		}
+		if !reflect.DeepEqual(c.op.Query, c.query) {
+			t.Errorf("expected %#v, got %#v", c.query, c.op.Query)
+		}
+	}
+
+	getMore := &GetMoreOp{GetMoreOp: mgo.GetMoreOp{Collection: "test.c", Limit: 0}}
+	if err := override.setBatchSize(getMore); err != nil {
+		t.Fatal(err)
+	}
+	if getMore.Limit != 10 {
+		t.Errorf("expected a getmore with a numberToReturn of 10, got %v", getMore.Limit)
+	}
+
+	command := &CommandOp{CommandOp: mgo.CommandOp{Database: "test", CommandName: "find", CommandArgs: bson.D{{Name: "find", Value: "c"}}}}
+	if err := override.setBatchSize(command); err != nil {
+		t.Fatal(err)
+	}
+	expected := &bson.D{{Name: "find", Value: "c"}, {Name: "batchSize", Value: int32(10)}}
+	if !reflect.DeepEqual(command.CommandArgs, expected) {
+		t.Errorf("expected %#v, got %#v", expected, command.CommandArgs)
+	}
+
+	for kind, count := range map[string]int64{"query": 2, "getmore": 1, "find": 3, "aggregate": 1, "getMore": 1} {
+		if override.counts[kind] != count {
+			t.Errorf("expected %v %v ops with the batch size set, got %v", count, kind, override.counts[kind])
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// collationWireVersion is the wire version of the first server release (3.4)
+// that accepts a collation.
+const collationWireVersion = 5
+
+// collationFields are the fields of a collation document, in the order they
+// are sent, with the values each accepts.
+var collationFields = []struct {
+	name   string
+	kind   string
+	values []string
+}{
+	{"locale", "string", nil},
+	{"caseLevel", "bool", nil},
+	{"caseFirst", "string", []string{"upper", "lower", "off"}},
+	{"strength", "int", nil},
+	{"numericOrdering", "bool", nil},
+	{"alternate", "string", []string{"non-ignorable", "shifted"}},
+	{"maxVariable", "string", []string{"punct", "space"}},
+	{"normalization", "bool", nil},
+	{"backwards", "bool", nil},
+}
+
+// ParseCollation parses a collation given as a JSON document, such as
+// '{"locale": "fr", "strength": 2}', checking that it has a locale and only
+// the fields of a collation, with values of the right type.
+func ParseCollation(s string) (bson.D, error) {
+	given := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &given); err != nil {
+		return nil, fmt.Errorf("collation must be a JSON document: %v", err)
+	}
+	if _, ok := given["locale"]; !ok {
+		return nil, fmt.Errorf("collation must have a locale")
+	}
+
+	collation := bson.D{}
+	for _, field := range collationFields {
+		value, ok := given[field.name]
+		if !ok {
+			continue
+		}
+		delete(given, field.name)
+		switch field.kind {
+		case "string":
+			str, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("collation field %v must be a string", field.name)
+			}
+			if field.values != nil && !containsString(field.values, str) {
+				return nil, fmt.Errorf("collation field %v must be one of %v", field.name, field.values)
+			}
+		case "bool":
+			if _, ok := value.(bool); !ok {
+				return nil, fmt.Errorf("collation field %v must be true or false", field.name)
+			}
+		case "int":
+			num, ok := value.(float64)
+			if !ok || num != float64(int32(num)) || num < 1 || num > 5 {
+				return nil, fmt.Errorf("collation field %v must be an integer from 1 to 5", field.name)
+			}
+			value = int32(num)
+		}
+		collation = append(collation, bson.DocElem{Name: field.name, Value: value})
+	}
+	for name := range given {
+		return nil, fmt.Errorf("unknown collation field %v", name)
+	}
+	return collation, nil
+}
+
+// containsString returns whether the string is one of the values.
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setCollation adds the collation to the find and aggregate commands of the
+// op that don't already have one, so that they are played with the collation
+// of the recorded environment. Legacy queries can't carry a collation and are
+// left as they are.
+func (context *ExecutionContext) setCollation(op Op) error {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.Contains(castOp.Collection, ".$cmd") {
+			return nil
+		}
+		doc, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		if len(doc) > 0 && isCollatedCommand(doc[0].Name) {
+			castOp.Query = withCollation(doc, context.Collation)
+		}
+	case *CommandOp:
+		if !isCollatedCommand(castOp.CommandName) {
+			return nil
+		}
+		doc, err := toBSOND(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		castOp.CommandArgs = withCollation(doc, context.Collation)
+	case *MsgOp:
+		if !isCollatedCommand(castOp.commandName()) {
+			return nil
+		}
+		return castOp.editBody(func(doc bson.D) (bson.D, error) {
+			return withCollation(doc, context.Collation), nil
+		})
+	}
+	return nil
+}
+
+// isCollatedCommand returns whether the command is one that --collation is
+// added to.
+func isCollatedCommand(name string) bool {
+	return name == "find" || name == "aggregate"
+}
+
+// withCollation adds the collation to the command unless it has one.
+func withCollation(doc bson.D, collation bson.D) bson.D {
+	for _, elem := range doc {
+		if elem.Name == "collation" {
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{Name: "collation", Value: collation})
+}
@@ -0,0 +1,92 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseCollation(t *testing.T) {
+	collation, err := ParseCollation(`{"strength": 2, "locale": "fr", "caseFirst": "upper"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{Name: "locale", Value: "fr"},
+		{Name: "caseFirst", Value: "upper"},
+		{Name: "strength", Value: int32(2)},
+	}
+	if !reflect.DeepEqual(collation, expected) {
+		t.Errorf("expected %#v, got %#v", expected, collation)
+	}
+
+	for _, invalid := range []string{
+		`locale: fr`,
+		`{"strength": 2}`,
+		`{"locale": 1}`,
+		`{"locale": "fr", "strength": 6}`,
+		`{"locale": "fr", "strength": 1.5}`,
+		`{"locale": "fr", "caseFirst": "sideways"}`,
+		`{"locale": "fr", "backwards": "yes"}`,
+		`{"locale": "fr", "colour": "blue"}`,
+	} {
+		if _, err := ParseCollation(invalid); err == nil {
+			t.Errorf("expected an error parsing %v", invalid)
+		}
+	}
+}
+
+func TestSetCollation(t *testing.T) {
+	query := func(collection string, doc bson.D) *QueryOp {
+		return &QueryOp{QueryOp: mgo.QueryOp{Collection: collection, Query: doc}}
+	}
+	context := NewExecutionContext(&StatCollector{})
+	context.Collation = bson.D{{Name: "locale", Value: "fr"}}
+	recorded := bson.D{{Name: "locale", Value: "en"}}
+
+	cases := []struct {
+		op       Op
+		expected interface{}
+	}{
+		// find and aggregate commands get the collation
+		{query("test.$cmd", bson.D{{Name: "find", Value: "c"}}), bson.D{
+			{Name: "find", Value: "c"},
+			{Name: "collation", Value: context.Collation},
+		}},
+		{query("test.$cmd", bson.D{{Name: "aggregate", Value: "c"}}), bson.D{
+			{Name: "aggregate", Value: "c"},
+			{Name: "collation", Value: context.Collation},
+		}},
+		// a recorded collation is kept
+		{query("test.$cmd", bson.D{{Name: "find", Value: "c"}, {Name: "collation", Value: recorded}}), bson.D{
+			{Name: "find", Value: "c"},
+			{Name: "collation", Value: recorded},
+		}},
+		// other commands and legacy queries are left as they are
+		{query("test.$cmd", bson.D{{Name: "count", Value: "c"}}), bson.D{
+			{Name: "count", Value: "c"},
+		}},
+		{query("test.c", bson.D{{Name: "a", Value: 1}}), bson.D{
+			{Name: "a", Value: 1},
+		}},
+	}
+	for _, c := range cases {
+		if err := context.setCollation(c.op); err != nil {
+			t.Fatal(err)
+		}
+		if actual := c.op.(*QueryOp).Query; !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("expected %#v, got %#v", c.expected, actual)
+		}
+	}
+
+	command := &CommandOp{CommandOp: mgo.CommandOp{CommandName: "find", CommandArgs: bson.D{{Name: "find", Value: "c"}}}}
+	if err := context.setCollation(command); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "find", Value: "c"}, {Name: "collation", Value: context.Collation}}
+	if !reflect.DeepEqual(command.CommandArgs, expected) {
+		t.Errorf("expected %#v, got %#v", expected, command.CommandArgs)
+	}
+}
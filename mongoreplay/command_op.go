@@ -238,8 +238,6 @@ func (op *CommandOp) FromReader(r io.Reader) error {
 // Execute performs the CommandOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *CommandOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
-
 	before := time.Now()
 	metadata, commandReply, replyData, resultReply, err := mgo.ExecOpWithReply(session, &op.CommandOp)
 	after := time.Now()
@@ -265,23 +263,11 @@ func (op *CommandOp) Execute(session *mgo.Session) (Replyable, error) {
 		return nil, err
 	}
 	commandReplyOp.CommandReply = commandReplyAsRaw
-	doc := &struct {
-		Cursor struct {
-			FirstBatch []bson.Raw `bson:"firstBatch"`
-			NextBatch  []bson.Raw `bson:"nextBatch"`
-		} `bson:"cursor"`
-	}{}
-	err = commandReplyAsRaw.Unmarshal(&doc)
+	commandReplyOp.Docs, err = cursorBatch(commandReplyAsRaw)
 	if err != nil {
 		return nil, err
 	}
 
-	if doc.Cursor.FirstBatch != nil {
-		commandReplyOp.Docs = doc.Cursor.FirstBatch
-	} else if doc.Cursor.NextBatch != nil {
-		commandReplyOp.Docs = doc.Cursor.NextBatch
-	}
-
 	for _, d := range replyData {
 		dataDoc := &bson.Raw{}
 		err = bson.Unmarshal(d, &dataDoc)
@@ -294,3 +280,21 @@ func (op *CommandOp) Execute(session *mgo.Session) (Replyable, error) {
 	return commandReplyOp, nil
 
 }
+
+// cursorBatch returns the documents of the batch of a cursor that a command
+// reply returns, or nil if it returns none.
+func cursorBatch(commandReply *bson.Raw) ([]bson.Raw, error) {
+	doc := &struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NextBatch  []bson.Raw `bson:"nextBatch"`
+		} `bson:"cursor"`
+	}{}
+	if err := commandReply.Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Cursor.FirstBatch != nil {
+		return doc.Cursor.FirstBatch, nil
+	}
+	return doc.Cursor.NextBatch, nil
+}
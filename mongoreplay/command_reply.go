@@ -198,3 +198,16 @@ func (op *CommandReplyOp) getErrors() []error {
 	}
 	return extractErrorsFromDoc(&firstDoc)
 }
+
+func (op *CommandReplyOp) getWriteErrors() []error {
+	if len(op.Docs) == 0 {
+		return nil
+	}
+
+	firstDoc := bson.D{}
+	err := op.Docs[0].Unmarshal(&firstDoc)
+	if err != nil {
+		panic("failed to unmarshal Raw into bson.D")
+	}
+	return extractWriteErrorsFromDoc(&firstDoc)
+}
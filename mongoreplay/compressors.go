@@ -0,0 +1,474 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/golang/snappy"
+)
+
+// The ids of the compressors in the header of an OP_COMPRESSED.
+const (
+	noopCompressorID   = 0
+	snappyCompressorID = 1
+	zlibCompressorID   = 2
+)
+
+// supportedCompressors are the wire compressors mongoreplay can play with, by
+// their ids: those it can compress ops and decompress replies with. zstd isn't
+// among them, as neither the standard library nor the vendored packages
+// implement it.
+var supportedCompressors = map[string]uint8{
+	"snappy": snappyCompressorID,
+	"zlib":   zlibCompressorID,
+}
+
+// knownCompressors are the wire compressors of MongoDB, which mongoreplay
+// names in its error for those it can't play with.
+var knownCompressors = map[string]bool{
+	"snappy": true,
+	"zlib":   true,
+	"zstd":   true,
+}
+
+// uncompressedCommands are the commands that are never sent compressed, as
+// the server rejects compressed handshake and authentication commands.
+var uncompressedCommands = map[string]bool{
+	"isMaster":        true,
+	"ismaster":        true,
+	"hello":           true,
+	"saslStart":       true,
+	"saslContinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createUser":      true,
+	"updateUser":      true,
+	"copydbSaslStart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+// ParseCompressors parses the wire compressors given with --compressors, as
+// a list in order of preference that may be comma-separated. It returns the
+// compressors mongoreplay can play with, and those of MongoDB it can't, which
+// are left out of the handshakes as long as another is asked for.
+func ParseCompressors(values []string) ([]string, []string, error) {
+	compressors, unsupported := []string{}, []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			switch {
+			case name == "":
+				return nil, nil, fmt.Errorf("empty compressor in '%v'", value)
+			case !knownCompressors[name]:
+				return nil, nil, fmt.Errorf("unknown compressor '%v', expected snappy, zlib or zstd", name)
+			case seen[name]:
+				continue
+			}
+			seen[name] = true
+			if _, ok := supportedCompressors[name]; ok {
+				compressors = append(compressors, name)
+			} else {
+				unsupported = append(unsupported, name)
+			}
+		}
+	}
+	if len(compressors) == 0 && len(unsupported) > 0 {
+		return nil, nil, fmt.Errorf("%v isn't supported by mongoreplay, which can only compress with snappy "+
+			"or zlib", strings.Join(unsupported, ", "))
+	}
+	return compressors, unsupported, nil
+}
+
+// negotiatedCompressors counts the connections to the target by the wire
+// compressor the target agreed to in their handshake, to report once the
+// playback is done.
+type negotiatedCompressors struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newNegotiatedCompressors() *negotiatedCompressors {
+	return &negotiatedCompressors{counts: map[string]int64{}}
+}
+
+func (n *negotiatedCompressors) add(compressor string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.counts[compressor]++
+}
+
+// String lists the count of connections of each compressor, as in
+// "snappy on 12 connections, none on 1 connection".
+func (n *negotiatedCompressors) String() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	names := make([]string, 0, len(n.counts))
+	for name := range n.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		noun := "connections"
+		if n.counts[name] == 1 {
+			noun = "connection"
+		}
+		parts = append(parts, fmt.Sprintf("%v on %v %v", name, n.counts[name], noun))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// report logs the compressors negotiated, if compressors were requested.
+func (n *negotiatedCompressors) report() {
+	if n == nil {
+		return
+	}
+	if s := n.String(); s != "" {
+		userInfoLogger.Logvf(Always, "Compressors negotiated with the target: %v", s)
+	}
+}
+
+// compressingConn is a connection to the target that asks for wire
+// compression in each isMaster handshake sent as an OP_QUERY, whether the
+// driver's own or a recorded one, and once the target agrees, sends the ops
+// that follow compressed as OP_COMPRESSED. Recorded ops that were compressed
+// are played decompressed unless compression is negotiated this way.
+type compressingConn struct {
+	net.Conn
+	compressors []string
+	negotiated  *negotiatedCompressors
+
+	mu sync.Mutex
+	// compressor is the compressor the target agreed to, if any, and
+	// reported whether a compressor was negotiated yet
+	compressor string
+	reported   bool
+	// handshakes holds the request ids of the handshakes awaiting a reply
+	handshakes map[int32]bool
+
+	replies replyScanner
+}
+
+func newCompressingConn(conn net.Conn, compressors []string, negotiated *negotiatedCompressors) *compressingConn {
+	return &compressingConn{
+		Conn:        conn,
+		compressors: compressors,
+		negotiated:  negotiated,
+		handshakes:  map[int32]bool{},
+	}
+}
+
+// Write sends the messages in p, which the driver writes whole, rewriting
+// the handshakes and compressing the other messages as negotiated.
+func (c *compressingConn) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for rest := p; len(rest) > 0; {
+		if len(rest) < MsgHeaderLen || int(getInt32(rest, 0)) < MsgHeaderLen || int(getInt32(rest, 0)) > len(rest) {
+			// not whole messages; send the rest as it is
+			out = append(out, rest...)
+			break
+		}
+		size := int(getInt32(rest, 0))
+		out = append(out, c.outgoing(rest[:size])...)
+		rest = rest[size:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// outgoing returns the message to send in place of msg.
+func (c *compressingConn) outgoing(msg []byte) []byte {
+	name := messageCommandName(msg)
+	if name == "isMaster" || name == "ismaster" || name == "hello" {
+		rewritten, ok := withCompression(msg, c.compressors)
+		if ok {
+			c.mu.Lock()
+			c.handshakes[getInt32(msg, 4)] = true
+			c.mu.Unlock()
+			return rewritten
+		}
+		return msg
+	}
+	c.mu.Lock()
+	compressor := c.compressor
+	c.mu.Unlock()
+	if compressor == "" || uncompressedCommands[name] || OpCode(getInt32(msg, 12)) == OpCodeCompressed {
+		return msg
+	}
+	return compressMessage(msg, compressor)
+}
+
+// compressMessage wraps a message in an OP_COMPRESSED compressed with the
+// compressor, which must be supported. The driver's CompressMessage isn't
+// used, as it records the length of the message as its original op code, and
+// only compresses with snappy.
+func compressMessage(msg []byte, compressor string) []byte {
+	var compressed []byte
+	switch compressor {
+	case "zlib":
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		// writes to a bytes.Buffer don't fail
+		w.Write(msg[MsgHeaderLen:])
+		w.Close()
+		compressed = buf.Bytes()
+	default:
+		compressed = snappy.Encode(nil, msg[MsgHeaderLen:])
+	}
+	out := make([]byte, MsgHeaderLen+9, MsgHeaderLen+9+len(compressed))
+	copy(out, msg[:MsgHeaderLen])
+	SetInt32(out, 12, int32(OpCodeCompressed))
+	SetInt32(out, MsgHeaderLen, getInt32(msg, 12))
+	SetInt32(out, MsgHeaderLen+4, int32(len(msg)-MsgHeaderLen))
+	out[MsgHeaderLen+8] = supportedCompressors[compressor]
+	out = append(out, compressed...)
+	SetInt32(out, 0, int32(len(out)))
+	return out
+}
+
+// decompressMessage returns the message wrapped in an OP_COMPRESSED, header
+// included. The driver's DecompressMessage isn't used, as it only decompresses
+// snappy.
+func decompressMessage(msg []byte) ([]byte, error) {
+	if len(msg) < MsgHeaderLen+9 {
+		return nil, fmt.Errorf("OP_COMPRESSED of %v bytes is too short to hold its compression header", len(msg))
+	}
+	size := int(getInt32(msg, MsgHeaderLen+4))
+	if size < 0 || size > MaxMessageSize {
+		return nil, fmt.Errorf("OP_COMPRESSED of a message of %v bytes is out of range", size)
+	}
+	compressed := msg[MsgHeaderLen+9:]
+	var body []byte
+	var err error
+	switch id := msg[MsgHeaderLen+8]; id {
+	case noopCompressorID:
+		body = compressed
+	case snappyCompressorID:
+		body, err = snappy.Decode(nil, compressed)
+	case zlibCompressorID:
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			body, err = ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+			r.Close()
+		}
+	default:
+		return nil, fmt.Errorf("OP_COMPRESSED with unknown compressor id %v", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing OP_COMPRESSED: %v", err)
+	}
+	if len(body) != size {
+		return nil, fmt.Errorf("OP_COMPRESSED decompressed to %v bytes, but holds a message of %v", len(body), size)
+	}
+	out := make([]byte, MsgHeaderLen, MsgHeaderLen+len(body))
+	copy(out, msg[:MsgHeaderLen])
+	SetInt32(out, 0, int32(MsgHeaderLen+len(body)))
+	SetInt32(out, 12, getInt32(msg, MsgHeaderLen))
+	return append(out, body...), nil
+}
+
+// Read reads from the target, looking for the replies to the handshakes to
+// learn the compressor they negotiated.
+func (c *compressingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.replies.feed(p[:n], c.awaited, c.negotiate)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// awaited returns whether the message replying to the request id is the
+// reply to a handshake.
+func (c *compressingConn) awaited(responseTo int32) bool {
+	return c.handshakes[responseTo]
+}
+
+// negotiate sets the compressor of the connection from the reply to a
+// handshake, which lists the compressors the target accepts of those asked
+// for, the first of which is used.
+func (c *compressingConn) negotiate(reply []byte) {
+	delete(c.handshakes, getInt32(reply, 8))
+	compressor := "none"
+	if doc, ok := replyDocument(reply); ok {
+		if value, ok := FindValueByKey("compression", &doc); ok {
+			if accepted, ok := value.([]interface{}); ok && len(accepted) > 0 {
+				compressor = fmt.Sprintf("%v", accepted[0])
+			}
+		}
+	}
+	c.compressor = ""
+	if _, ok := supportedCompressors[compressor]; ok {
+		c.compressor = compressor
+	}
+	if !c.reported {
+		c.reported = true
+		c.negotiated.add(compressor)
+		userInfoLogger.Logvf(DebugLow, "Negotiated compressor %v with %v", compressor, c.Conn.RemoteAddr())
+	}
+}
+
+// replyScanner follows the messages read from a connection, across reads of
+// any size, to pass the whole of those awaited to a handler. The others are
+// skipped without being held.
+type replyScanner struct {
+	header    []byte
+	message   []byte
+	remaining int
+	keep      bool
+}
+
+// feed scans the bytes read next. awaited is called with the request id each
+// message replies to, and handle with each message it returns true for.
+func (s *replyScanner) feed(p []byte, awaited func(int32) bool, handle func([]byte)) {
+	for len(p) > 0 {
+		if len(s.header) < MsgHeaderLen {
+			n := MsgHeaderLen - len(s.header)
+			if n > len(p) {
+				n = len(p)
+			}
+			s.header = append(s.header, p[:n]...)
+			p = p[n:]
+			if len(s.header) < MsgHeaderLen {
+				return
+			}
+			s.remaining = int(getInt32(s.header, 0)) - MsgHeaderLen
+			s.keep = awaited(getInt32(s.header, 8))
+			if s.keep {
+				s.message = append([]byte{}, s.header...)
+			}
+		}
+		n := s.remaining
+		if n > len(p) {
+			n = len(p)
+		}
+		if s.keep {
+			s.message = append(s.message, p[:n]...)
+		}
+		s.remaining -= n
+		p = p[n:]
+		if s.remaining <= 0 {
+			if s.keep {
+				handle(s.message)
+			}
+			s.header, s.message, s.keep = s.header[:0], nil, false
+		}
+	}
+}
+
+// messageCommandName returns the name of the command sent by an OP_QUERY on
+// a $cmd collection or an OP_COMMAND, or "" for other messages.
+func messageCommandName(msg []byte) string {
+	switch OpCode(getInt32(msg, 12)) {
+	case OpCodeQuery:
+		doc, _, ok := queryDocument(msg)
+		if !ok || len(doc) == 0 {
+			return ""
+		}
+		if doc[0].Name == "$query" || doc[0].Name == "query" {
+			if inner, err := toBSOND(doc[0].Value); err == nil && len(inner) > 0 {
+				return inner[0].Name
+			}
+			return ""
+		}
+		return doc[0].Name
+	case OpCodeCommand:
+		pos := MsgHeaderLen
+		database := readCString(msg[pos:])
+		pos += len(database) + 1
+		if pos >= len(msg) {
+			return ""
+		}
+		return readCString(msg[pos:])
+	}
+	return ""
+}
+
+// queryDocument returns the query of an OP_QUERY on a $cmd collection, with
+// the offset of the query in the message.
+func queryDocument(msg []byte) (bson.D, int, bool) {
+	pos := MsgHeaderLen + 4
+	if pos >= len(msg) {
+		return nil, 0, false
+	}
+	collection := readCString(msg[pos:])
+	if !strings.HasSuffix(collection, ".$cmd") {
+		return nil, 0, false
+	}
+	pos += len(collection) + 1 + 8
+	if pos+4 > len(msg) {
+		return nil, 0, false
+	}
+	size := int(getInt32(msg, pos))
+	if size < 5 || pos+size > len(msg) {
+		return nil, 0, false
+	}
+	doc := bson.D{}
+	if err := bson.Unmarshal(msg[pos:pos+size], &doc); err != nil {
+		return nil, 0, false
+	}
+	return doc, pos, true
+}
+
+// withCompression returns a handshake sent as an OP_QUERY asking for the
+// compressors, replacing those it asked for if any.
+func withCompression(msg []byte, compressors []string) ([]byte, bool) {
+	doc, pos, ok := queryDocument(msg)
+	if !ok || len(doc) == 0 {
+		return msg, false
+	}
+	if doc[0].Name == "$query" || doc[0].Name == "query" {
+		// a handshake wrapped to carry a read preference
+		inner, err := toBSOND(doc[0].Value)
+		if err != nil {
+			return msg, false
+		}
+		doc[0].Value = withField(inner, "compression", compressors)
+	} else {
+		doc = withField(doc, "compression", compressors)
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return msg, false
+	}
+	size := int(getInt32(msg, pos))
+	rewritten := make([]byte, 0, len(msg)-size+len(data))
+	rewritten = append(rewritten, msg[:pos]...)
+	rewritten = append(rewritten, data...)
+	rewritten = append(rewritten, msg[pos+size:]...)
+	SetInt32(rewritten, 0, int32(len(rewritten)))
+	return rewritten, true
+}
+
+// replyDocument returns the first document of an OP_REPLY.
+func replyDocument(msg []byte) (bson.D, bool) {
+	if OpCode(getInt32(msg, 12)) != OpCodeReply {
+		return nil, false
+	}
+	pos := MsgHeaderLen + 20
+	if pos+4 > len(msg) {
+		return nil, false
+	}
+	size := int(getInt32(msg, pos))
+	if size < 5 || pos+size > len(msg) {
+		return nil, false
+	}
+	doc := bson.D{}
+	if err := bson.Unmarshal(msg[pos:pos+size], &doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
@@ -0,0 +1,207 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// opQuery builds an OP_QUERY of the document on the collection.
+func opQuery(t *testing.T, requestID int32, collection string, doc bson.D) []byte {
+	docBytes, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, MsgHeaderLen+4)
+	msg = append(msg, collection...)
+	msg = append(msg, 0)
+	msg = append(msg, make([]byte, 8)...)
+	msg = append(msg, docBytes...)
+	copy(msg, MsgHeader{MessageLength: int32(len(msg)), RequestID: requestID, OpCode: OpCodeQuery}.ToWire())
+	return msg
+}
+
+// opReply builds an OP_REPLY of the document to the request.
+func opReply(t *testing.T, responseTo int32, doc bson.D) []byte {
+	docBytes, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, MsgHeaderLen+20)
+	SetInt32(msg, MsgHeaderLen+16, 1)
+	msg = append(msg, docBytes...)
+	copy(msg, MsgHeader{MessageLength: int32(len(msg)), ResponseTo: responseTo, OpCode: OpCodeReply}.ToWire())
+	return msg
+}
+
+// pipeConn is a connection that records what is written to it and reads
+// what it is given.
+type pipeConn struct {
+	net.Conn
+	written bytes.Buffer
+	toRead  bytes.Buffer
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *pipeConn) Read(p []byte) (int, error)  { return c.toRead.Read(p) }
+func (c *pipeConn) RemoteAddr() net.Addr        { return &net.TCPAddr{} }
+
+func TestParseCompressors(t *testing.T) {
+	compressors, unsupported, err := ParseCompressors([]string{"snappy", " snappy"})
+	if err != nil || !reflect.DeepEqual(compressors, []string{"snappy"}) || len(unsupported) != 0 {
+		t.Errorf("expected snappy once, got %v %v %v", compressors, unsupported, err)
+	}
+	// zstd is left out as long as another compressor is asked for
+	compressors, unsupported, err = ParseCompressors([]string{"zstd,zlib", "snappy"})
+	if err != nil || !reflect.DeepEqual(compressors, []string{"zlib", "snappy"}) ||
+		!reflect.DeepEqual(unsupported, []string{"zstd"}) {
+		t.Errorf("expected zlib and snappy, leaving out zstd, got %v %v %v", compressors, unsupported, err)
+	}
+	for _, bad := range []string{"zstd", "lz4", "snappy,"} {
+		if _, _, err := ParseCompressors([]string{bad}); err == nil {
+			t.Errorf("expected an error for %v", bad)
+		}
+	}
+}
+
+func TestCompressingConn(t *testing.T) {
+	conn := &pipeConn{}
+	negotiated := newNegotiatedCompressors()
+	compressing := newCompressingConn(conn, []string{"snappy"}, negotiated)
+
+	handshake := opQuery(t, 7, "admin.$cmd", bson.D{{"isMaster", 1}, {"compression", []string{"zlib"}}})
+	insert := opQuery(t, 8, "test.$cmd", bson.D{{"insert", "c"}})
+
+	// before the handshake is answered, ops are sent as they are
+	if n, err := compressing.Write(append(append([]byte{}, handshake...), insert...)); err != nil || n != len(handshake)+len(insert) {
+		t.Fatalf("expected the whole write to be reported, got %v %v", n, err)
+	}
+	sent := conn.written.Bytes()
+	doc, _, ok := queryDocument(sent)
+	expected := bson.D{{"isMaster", 1}, {"compression", []interface{}{"snappy"}}}
+	if !ok || !reflect.DeepEqual(doc, expected) {
+		t.Errorf("expected the handshake to ask for snappy, got %v", doc)
+	}
+	if rest := sent[getInt32(sent, 0):]; !bytes.Equal(rest, insert) {
+		t.Errorf("expected the insert to be sent uncompressed before the handshake is answered")
+	}
+
+	// the reply is read back in pieces
+	reply := opReply(t, 7, bson.D{{"ismaster", true}, {"compression", []interface{}{"snappy"}}, {"ok", 1}})
+	conn.toRead.Write(reply)
+	buf := make([]byte, len(reply))
+	for read := 0; read < len(reply); {
+		end := read + 10
+		if end > len(reply) {
+			end = len(reply)
+		}
+		n, err := compressing.Read(buf[read:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	if !bytes.Equal(buf, reply) {
+		t.Errorf("expected the reply to be read as it is")
+	}
+	if negotiated.String() != "snappy on 1 connection" {
+		t.Errorf("expected snappy to be negotiated, got %v", negotiated)
+	}
+
+	// ops are then compressed, except for authentication commands
+	conn.written.Reset()
+	if _, err := compressing.Write(insert); err != nil {
+		t.Fatal(err)
+	}
+	sent = conn.written.Bytes()
+	if OpCode(getInt32(sent, 12)) != OpCodeCompressed {
+		t.Fatalf("expected the insert to be compressed, got op code %v", getInt32(sent, 12))
+	}
+	decompressed, err := decompressMessage(sent)
+	if err != nil || !bytes.Equal(decompressed, insert) {
+		t.Errorf("expected the insert to decompress to itself, got %v", err)
+	}
+
+	conn.written.Reset()
+	saslStart := opQuery(t, 9, "admin.$cmd", bson.D{{"saslStart", 1}})
+	if _, err := compressing.Write(saslStart); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), saslStart) {
+		t.Errorf("expected saslStart to be sent uncompressed")
+	}
+}
+
+func TestCompressingConnNotNegotiated(t *testing.T) {
+	conn := &pipeConn{}
+	negotiated := newNegotiatedCompressors()
+	compressing := newCompressingConn(conn, []string{"snappy"}, negotiated)
+
+	handshake := opQuery(t, 1, "admin.$cmd", bson.D{{"$query", bson.D{{"ismaster", 1}}}})
+	if _, err := compressing.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+	conn.toRead.Write(opReply(t, 1, bson.D{{"ismaster", true}, {"ok", 1}}))
+	if _, err := compressing.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if negotiated.String() != "none on 1 connection" {
+		t.Errorf("expected no compressor to be negotiated, got %v", negotiated)
+	}
+
+	conn.written.Reset()
+	insert := opQuery(t, 2, "test.$cmd", bson.D{{"insert", "c"}})
+	if _, err := compressing.Write(insert); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), insert) {
+		t.Errorf("expected the insert to be sent uncompressed")
+	}
+}
+
+func TestCompressMessage(t *testing.T) {
+	insert := opQuery(t, 8, "test.$cmd", bson.D{{"insert", "c"}, {"documents", []bson.D{{{"_id", 1}}}}})
+	for _, compressor := range []string{"snappy", "zlib"} {
+		compressed := compressMessage(insert, compressor)
+		if OpCode(getInt32(compressed, 12)) != OpCodeCompressed || compressed[MsgHeaderLen+8] != supportedCompressors[compressor] {
+			t.Errorf("%v: expected an OP_COMPRESSED with the id of the compressor", compressor)
+		}
+		decompressed, err := decompressMessage(compressed)
+		if err != nil || !bytes.Equal(decompressed, insert) {
+			t.Errorf("%v: expected the insert to decompress to itself, got %v", compressor, err)
+		}
+	}
+}
+
+func TestCompressingConnZlib(t *testing.T) {
+	conn := &pipeConn{}
+	negotiated := newNegotiatedCompressors()
+	compressing := newCompressingConn(conn, []string{"zlib", "snappy"}, negotiated)
+
+	if _, err := compressing.Write(opQuery(t, 1, "admin.$cmd", bson.D{{"isMaster", 1}})); err != nil {
+		t.Fatal(err)
+	}
+	conn.toRead.Write(opReply(t, 1, bson.D{{"ismaster", true}, {"compression", []interface{}{"zlib"}}, {"ok", 1}}))
+	if _, err := compressing.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	if negotiated.String() != "zlib on 1 connection" {
+		t.Errorf("expected zlib to be negotiated, got %v", negotiated)
+	}
+
+	conn.written.Reset()
+	insert := opQuery(t, 2, "test.$cmd", bson.D{{"insert", "c"}})
+	if _, err := compressing.Write(insert); err != nil {
+		t.Fatal(err)
+	}
+	sent := conn.written.Bytes()
+	if len(sent) < MsgHeaderLen+9 || sent[MsgHeaderLen+8] != supportedCompressors["zlib"] {
+		t.Fatalf("expected the insert to be compressed with zlib")
+	}
+	if decompressed, err := decompressMessage(sent); err != nil || !bytes.Equal(decompressed, insert) {
+		t.Errorf("expected the insert to decompress to itself, got %v", err)
+	}
+}
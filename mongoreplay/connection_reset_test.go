@@ -0,0 +1,86 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// resetStream is a tcpassembly.Stream that keeps what it is given.
+type resetStream struct {
+	data     []byte
+	skipped  int
+	complete bool
+}
+
+func (s *resetStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, reassembly := range reassemblies {
+		if reassembly.Skip > 0 {
+			s.skipped += reassembly.Skip
+		}
+		s.data = append(s.data, reassembly.Bytes...)
+	}
+}
+
+func (s *resetStream) ReassemblyComplete() {
+	s.complete = true
+}
+
+type resetStreamFactory struct {
+	stream *resetStream
+}
+
+func (f *resetStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	return f.stream
+}
+
+func TestAssemblerFlushesReset(t *testing.T) {
+	factory := &resetStreamFactory{&resetStream{}}
+	assembler := NewAssembler(NewStreamPool(factory))
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	now := time.Now()
+	segment := func(seq uint32, payload string) *layers.TCP {
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 27017, Seq: seq, ACK: true}
+		tcp.Payload = []byte(payload)
+		return tcp
+	}
+
+	syn := &layers.TCP{SrcPort: 50000, DstPort: 27017, Seq: 99, SYN: true}
+	assembler.AssembleWithTimestamp(netFlow, syn, now)
+	assembler.AssembleWithTimestamp(netFlow, segment(100, "aaaa"), now)
+	// the segment at 104 is never seen, so the one after it is buffered
+	assembler.AssembleWithTimestamp(netFlow, segment(108, "cccc"), now)
+	if string(factory.stream.data) != "aaaa" {
+		t.Fatalf("expected only the bytes before the gap to be reassembled, got %q", factory.stream.data)
+	}
+
+	reset := segment(112, "")
+	reset.ACK, reset.RST = false, true
+	assembler.AssembleWithTimestamp(netFlow, reset, now)
+	if string(factory.stream.data) != "aaaacccc" || factory.stream.skipped != 4 {
+		t.Errorf("expected the buffered bytes to be pushed through after skipping 4, got %q after skipping %v",
+			factory.stream.data, factory.stream.skipped)
+	}
+	if !factory.stream.complete {
+		t.Errorf("expected the reset to complete the stream")
+	}
+}
+
+func TestRecordConnectionReset(t *testing.T) {
+	// the fixture holds a ping and its reply, then a segment with an insert
+	// and a ping, and half of a find before the client resets the connection
+	ops := recordedOpsFromPcap(t, "reset_mid_session.pcap")
+	expected := []int32{1, 2, 3, 4}
+	if len(ops) != len(expected) {
+		t.Fatalf("expected the %v whole messages to be recorded, got %v ops", len(expected), len(ops))
+	}
+	for i, requestID := range expected {
+		if ops[i].Header.RequestID != requestID || len(ops[i].Body) != int(ops[i].Header.MessageLength) {
+			t.Errorf("expected op %v to be the whole message %v, got %v of %v bytes of message %v",
+				i, requestID, len(ops[i].Body), ops[i].Header.MessageLength, ops[i].Header.RequestID)
+		}
+	}
+}
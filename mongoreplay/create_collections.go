@@ -0,0 +1,139 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// namespaceExistsCode is the error code of a create command for a collection
+// that already exists.
+const namespaceExistsCode = 48
+
+// tapeCreates holds the create commands found in a tape, so that the
+// collections can be created with the same options on the target before
+// playback starts.
+type tapeCreates struct {
+	// namespaces holds the namespaces created, in the order they were first
+	// created
+	namespaces []string
+
+	// commands holds the first create command for each namespace
+	commands map[string]createCommand
+}
+
+// createCommand is a recorded create command and the database it was run on.
+type createCommand struct {
+	db      string
+	command bson.D
+}
+
+func newTapeCreates() *tapeCreates {
+	return &tapeCreates{commands: map[string]createCommand{}}
+}
+
+// observe records the op if it is the first create command for a namespace.
+func (creates *tapeCreates) observe(op *RecordedOp) {
+	if op.Header.OpCode != OpCodeQuery && op.Header.OpCode != OpCodeCommand {
+		return
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil || opCommandName(parsedOp) != "create" {
+		return
+	}
+	var db string
+	var args interface{}
+	switch castOp := parsedOp.(type) {
+	case *QueryOp:
+		db, args = strings.TrimSuffix(castOp.Collection, ".$cmd"), castOp.Query
+	case *CommandOp:
+		db, args = castOp.Database, castOp.CommandArgs
+	}
+	command, err := createOptions(args)
+	if err != nil {
+		toolDebugLogger.Logvf(DebugLow, "Ignoring create command: %v", err)
+		return
+	}
+	ns := fmt.Sprintf("%v.%v", db, command[0].Value)
+	if _, ok := creates.commands[ns]; ok {
+		return
+	}
+	creates.namespaces = append(creates.namespaces, ns)
+	creates.commands[ns] = createCommand{db: db, command: command}
+}
+
+// createOptions returns the create command with the fields that only apply to
+// the recorded connection, such as its session and cluster time, removed.
+func createOptions(args interface{}) (bson.D, error) {
+	doc, err := toBSOND(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) == 0 || doc[0].Name != "create" {
+		return nil, fmt.Errorf("not a create command")
+	}
+	if _, ok := doc[0].Value.(string); !ok {
+		return nil, fmt.Errorf("invalid collection name %#v", doc[0].Value)
+	}
+	command := bson.D{}
+	for _, elem := range doc {
+		switch {
+		case strings.HasPrefix(elem.Name, "$"),
+			elem.Name == "lsid", elem.Name == "txnNumber", elem.Name == "autocommit":
+			continue
+		}
+		command = append(command, elem)
+	}
+	return command, nil
+}
+
+// rename renames the recorded collections as their ops are renamed, so that
+// they are created where the ops are played.
+func (creates *tapeCreates) rename(renamer *nsRenamer) {
+	for i, ns := range creates.namespaces {
+		renamed := renamer.renamer.Get(ns)
+		if renamed == ns {
+			continue
+		}
+		parts := strings.SplitN(renamed, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		create := creates.commands[ns]
+		delete(creates.commands, ns)
+		create.db = parts[0]
+		create.command[0].Value = parts[1]
+		creates.namespaces[i] = renamed
+		creates.commands[renamed] = create
+	}
+}
+
+// apply creates the recorded collections on the target, leaving those that
+// already exist as they are.
+func (creates *tapeCreates) apply(session *mgo.Session) error {
+	for _, ns := range creates.namespaces {
+		create := creates.commands[ns]
+		err := session.DB(create.db).Run(create.command, &bson.M{})
+		if isNamespaceExists(err) {
+			userInfoLogger.Logvf(Info, "Collection %v already exists on the target", ns)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating collection %v: %v", ns, err)
+		}
+		userInfoLogger.Logvf(Info, "Created collection %v", ns)
+	}
+	return nil
+}
+
+// isNamespaceExists returns whether the error is from creating a collection
+// that already exists.
+func isNamespaceExists(err error) bool {
+	queryErr, ok := err.(*mgo.QueryError)
+	if !ok {
+		return false
+	}
+	return queryErr.Code == namespaceExistsCode || strings.Contains(queryErr.Message, "already exists")
+}
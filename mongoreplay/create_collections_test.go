@@ -0,0 +1,49 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTapeCreates(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	record := func(collection string, query bson.D) *RecordedOp {
+		op, err := generator.fetchRecordedOpsFromConn(&mgo.QueryOp{
+			Collection: collection,
+			Query:      query,
+			Limit:      -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+
+	creates := newTapeCreates()
+	creates.observe(record("test.$cmd", bson.D{
+		{Name: "create", Value: "events"},
+		{Name: "capped", Value: true},
+		{Name: "size", Value: 4096},
+		{Name: "lsid", Value: bson.D{{Name: "id", Value: 1}}},
+		{Name: "$clusterTime", Value: bson.D{{Name: "clusterTime", Value: 1}}},
+	}))
+	creates.observe(record("test.$cmd", bson.D{{Name: "create", Value: "events"}}))
+	creates.observe(record("other.$cmd", bson.D{{Name: "create", Value: "logs"}}))
+	creates.observe(record("test.$cmd", bson.D{{Name: "drop", Value: "events"}}))
+	creates.observe(record("test.create", bson.D{{Name: "create", Value: "x"}}))
+
+	if !reflect.DeepEqual(creates.namespaces, []string{"test.events", "other.logs"}) {
+		t.Fatalf("expected the created namespaces in order, got %v", creates.namespaces)
+	}
+	expected := bson.D{
+		{Name: "create", Value: "events"},
+		{Name: "capped", Value: true},
+		{Name: "size", Value: 4096},
+	}
+	if create := creates.commands["test.events"]; create.db != "test" || !reflect.DeepEqual(create.command, expected) {
+		t.Errorf("expected the first create command without session fields, got %#v", create)
+	}
+}
@@ -0,0 +1,102 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+const (
+	// replyCursorNotFound is the OP_REPLY flag set when a getmore's cursor
+	// doesn't exist
+	replyCursorNotFound = 1
+
+	// errCodeCursorNotFound is the error code of a getMore command whose
+	// cursor doesn't exist
+	errCodeCursorNotFound = 43
+)
+
+// isCursorNotFound returns whether a reply says that the cursor the op asked
+// for doesn't exist, as happens often when playing against a target whose
+// data differs from the recording's.
+func isCursorNotFound(reply Replyable) bool {
+	var docs []bson.Raw
+	switch castReply := reply.(type) {
+	case *ReplyOp:
+		if castReply.Flags&replyCursorNotFound != 0 {
+			return true
+		}
+		docs = castReply.Docs
+	case *CommandReplyOp:
+		docs = castReply.Docs
+	}
+	if len(docs) == 0 {
+		return false
+	}
+	doc := struct {
+		Code int `bson:"code"`
+	}{}
+	if err := docs[0].Unmarshal(&doc); err != nil {
+		return false
+	}
+	return doc.Code == errCodeCursorNotFound
+}
+
+// deadCursors holds the live cursors that the target said don't exist, so
+// that the later ops using them can be skipped instead of failing in turn. It
+// is safe for concurrent use.
+type deadCursors struct {
+	sync.Mutex
+	cursors map[int64]struct{}
+
+	// notFound counts the ops whose cursor wasn't found, and skipped the ops
+	// later skipped because their cursor was dead
+	notFound int64
+	skipped  int64
+}
+
+func newDeadCursors() *deadCursors {
+	return &deadCursors{cursors: map[int64]struct{}{}}
+}
+
+// markDead notes that the cursors used by the op weren't found.
+func (dead *deadCursors) markDead(op cursorsRewriteable) error {
+	cursorIDs, err := op.getCursorIDs()
+	if err != nil {
+		return err
+	}
+	dead.Lock()
+	defer dead.Unlock()
+	dead.notFound++
+	for _, cursorID := range cursorIDs {
+		dead.cursors[cursorID] = struct{}{}
+	}
+	return nil
+}
+
+// skip returns whether the op only uses dead cursors, counting it as skipped
+// if so.
+func (dead *deadCursors) skip(op cursorsRewriteable) (bool, error) {
+	cursorIDs, err := op.getCursorIDs()
+	if err != nil || len(cursorIDs) == 0 {
+		return false, err
+	}
+	dead.Lock()
+	defer dead.Unlock()
+	for _, cursorID := range cursorIDs {
+		if _, ok := dead.cursors[cursorID]; !ok {
+			return false, nil
+		}
+	}
+	dead.skipped++
+	return true, nil
+}
+
+// String summarizes the counts on a single line.
+func (dead *deadCursors) String() string {
+	dead.Lock()
+	defer dead.Unlock()
+	return fmt.Sprintf("%v ops found their cursor missing on the target, and %v later ops on those cursors were skipped",
+		dead.notFound, dead.skipped)
+}
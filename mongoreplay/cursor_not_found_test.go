@@ -0,0 +1,82 @@
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestIsCursorNotFound(t *testing.T) {
+	rawDoc := func(doc bson.D) bson.Raw {
+		raw := bson.Raw{}
+		bytes, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bson.Unmarshal(bytes, &raw); err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	notFound := rawDoc(bson.D{{"ok", 0}, {"errmsg", "cursor id 5 not found"}, {"code", 43}})
+	otherError := rawDoc(bson.D{{"ok", 0}, {"errmsg", "interrupted"}, {"code", 11601}})
+
+	tests := []struct {
+		reply    Replyable
+		notFound bool
+	}{
+		{&ReplyOp{ReplyOp: mgo.ReplyOp{Flags: replyCursorNotFound}}, true},
+		{&ReplyOp{ReplyOp: mgo.ReplyOp{CursorId: 5}}, false},
+		{&CommandReplyOp{Docs: []bson.Raw{notFound}}, true},
+		{&CommandReplyOp{Docs: []bson.Raw{otherError}}, false},
+		{&ReplyOp{Docs: []bson.Raw{notFound}}, true},
+	}
+	for i, test := range tests {
+		if isCursorNotFound(test.reply) != test.notFound {
+			t.Errorf("expected isCursorNotFound to be %v for reply %v", test.notFound, i)
+		}
+	}
+}
+
+func TestDeadCursorsSkipped(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateGetMore(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	getMore := generatedOps(generator)[0]
+
+	context := NewExecutionContext(nil)
+	context.CursorIDMap.SetCursor(5, 50)
+	if err := context.DeadCursors.markDead(&GetMoreOp{GetMoreOp: mgo.GetMoreOp{CursorId: 50}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the getmore on the dead cursor isn't sent, so no session is needed
+	parsedOp, reply, err := context.execute(getMore, nil)
+	if err != nil || reply != nil {
+		t.Errorf("expected the getmore to be skipped without error, got %v, %v", reply, err)
+	}
+	if parsedOp == nil {
+		t.Errorf("expected the skipped getmore to be parsed")
+	}
+	if context.DeadCursors.notFound != 1 || context.DeadCursors.skipped != 1 {
+		t.Errorf("unexpected dead cursor counts: %v", context.DeadCursors)
+	}
+
+	live := &GetMoreOp{GetMoreOp: mgo.GetMoreOp{CursorId: 51}}
+	if skip, err := context.DeadCursors.skip(live); skip || err != nil {
+		t.Errorf("expected ops on other cursors not to be skipped")
+	}
+}
+
+func TestCursorStatsNotFound(t *testing.T) {
+	stats := NewCursorStats()
+	stats.observe(&QueryOp{}, &ReplyOp{ReplyOp: mgo.ReplyOp{CursorId: 1}})
+	stats.observe(&GetMoreOp{GetMoreOp: mgo.GetMoreOp{CursorId: 1}},
+		&ReplyOp{ReplyOp: mgo.ReplyOp{Flags: replyCursorNotFound}})
+	stats.finish()
+	if stats.NotFound != 1 || stats.Exhausted != 0 || stats.LeftOpen != 0 {
+		t.Errorf("unexpected cursor counts: %v", stats)
+	}
+}
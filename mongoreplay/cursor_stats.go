@@ -0,0 +1,183 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// CursorStats counts the lifecycle events of the live cursors opened during
+// playback, to show whether a replay reproduced the cursor workload of the
+// recording.
+type CursorStats struct {
+	// Recorded is the number of cursors in the recording that are used by
+	// later ops, and RecordedUses the number of those uses, as found while
+	// preprocessing.
+	Recorded     int `json:"recorded"`
+	RecordedUses int `json:"recorded_uses"`
+
+	Opened    int64 `json:"opened"`
+	GetMores  int64 `json:"getmores"`
+	Exhausted int64 `json:"exhausted"`
+	Killed    int64 `json:"killed"`
+
+	// NotFound is the number of cursors the target said didn't exist when a
+	// getmore asked for them.
+	NotFound int64 `json:"not_found"`
+
+	// LeftOpen is the number of cursors still open when playback finished.
+	LeftOpen int `json:"left_open"`
+
+	// GetMoresPerCursor counts the closed cursors by the number of getmores
+	// each served.
+	GetMoresPerCursor map[int]int64 `json:"getmores_per_cursor"`
+
+	sync.Mutex
+
+	// open holds the number of getmores served by each open live cursor
+	open map[int64]int
+}
+
+// NewCursorStats initializes an empty CursorStats.
+func NewCursorStats() *CursorStats {
+	return &CursorStats{
+		GetMoresPerCursor: map[int]int64{},
+		open:              map[int64]int{},
+	}
+}
+
+// setRecorded notes the cursors found in the recording by the preprocessing
+// cursor manager.
+func (stats *CursorStats) setRecorded(cursors *preprocessCursorManager) {
+	if stats == nil {
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	cursors.RLock()
+	defer cursors.RUnlock()
+	stats.Recorded = len(cursors.cursorInfos)
+	stats.RecordedUses = 0
+	for _, info := range cursors.cursorInfos {
+		stats.RecordedUses += info.numUsesLeft
+	}
+}
+
+// observe counts the cursor events of an op played against the target with
+// the given reply. The cursor IDs of the op must already be rewritten to the
+// live cursor IDs.
+func (stats *CursorStats) observe(op Op, reply Replyable) {
+	if stats == nil || reply == nil {
+		return
+	}
+	replyCursorID, err := reply.getCursorID()
+	if err != nil {
+		return
+	}
+	var cursorIDs []int64
+	if rewriteable, ok := op.(cursorsRewriteable); ok {
+		if cursorIDs, err = rewriteable.getCursorIDs(); err != nil {
+			return
+		}
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+	switch op.(type) {
+	case *KillCursorsOp:
+		for _, cursorID := range cursorIDs {
+			if stats.close(cursorID) {
+				stats.Killed++
+			}
+		}
+		return
+	case cursorsRewriteable:
+		if len(cursorIDs) == 0 {
+			return
+		}
+		stats.GetMores++
+		if _, ok := stats.open[cursorIDs[0]]; ok {
+			stats.open[cursorIDs[0]]++
+		}
+		if isCursorNotFound(reply) {
+			stats.NotFound++
+			stats.close(cursorIDs[0])
+			return
+		}
+		if replyCursorID == 0 && stats.close(cursorIDs[0]) {
+			stats.Exhausted++
+		}
+		return
+	}
+	if replyCursorID == 0 {
+		return
+	}
+	if _, ok := stats.open[replyCursorID]; ok {
+		// a getMore command sent as a query continues a cursor
+		stats.GetMores++
+		stats.open[replyCursorID]++
+		return
+	}
+	stats.Opened++
+	stats.open[replyCursorID] = 0
+}
+
+// close removes an open cursor, counting the getmores it served, and returns
+// whether it was open.
+func (stats *CursorStats) close(cursorID int64) bool {
+	getMores, ok := stats.open[cursorID]
+	if !ok {
+		return false
+	}
+	delete(stats.open, cursorID)
+	stats.GetMoresPerCursor[getMores]++
+	return true
+}
+
+// finish notes the cursors left open at the end of playback.
+func (stats *CursorStats) finish() {
+	stats.Lock()
+	stats.LeftOpen = len(stats.open)
+	stats.Unlock()
+}
+
+// String summarizes the cursor counts on a single line.
+func (stats *CursorStats) String() string {
+	return fmt.Sprintf("cursors: %v recorded with %v uses, %v opened, %v getmores, %v exhausted, %v killed, %v not found, %v left open",
+		stats.Recorded, stats.RecordedUses, stats.Opened, stats.GetMores, stats.Exhausted, stats.Killed, stats.NotFound, stats.LeftOpen)
+}
+
+// cursorStatsRecorder is implemented by the StatRecorders that report the
+// CursorStats of a playback.
+type cursorStatsRecorder interface {
+	RecordCursorStats(stats *CursorStats)
+}
+
+// RecordCursorStats writes the cursor stats as a JSON line after the op stats.
+func (jsr *JSONStatRecorder) RecordCursorStats(stats *CursorStats) {
+	jsonBytes, err := json.Marshal(struct {
+		Cursors *CursorStats `json:"cursor_stats"`
+	}{stats})
+	if err == nil {
+		_, err = jsr.out.Write(append(jsonBytes, '\n'))
+	}
+	if err != nil {
+		toolDebugLogger.Logvf(Always, "error recording cursor stats: %v", err)
+	}
+}
+
+// RecordCursorStats adds the cursor stats to the aggregate.
+func (bsr *BufferedStatRecorder) RecordCursorStats(stats *CursorStats) {
+	bsr.mu.Lock()
+	defer bsr.mu.Unlock()
+	if bsr.Aggregate != nil {
+		bsr.Aggregate.Cursors = stats
+	}
+}
+
+// RecordCursorStats writes the cursor stats summary to the terminal.
+func (dsr *TerminalStatRecorder) RecordCursorStats(stats *CursorStats) {
+	if _, err := fmt.Fprintln(dsr.out, stats); err != nil {
+		toolDebugLogger.Logvf(Always, "error recording cursor stats: %v", err)
+	}
+}
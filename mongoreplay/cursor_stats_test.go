@@ -0,0 +1,63 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+func TestCursorStats(t *testing.T) {
+	stats := NewCursorStats()
+	query := &QueryOp{}
+	query.Collection = "test.test"
+	getMore := func(cursorID int64) *GetMoreOp {
+		return &GetMoreOp{GetMoreOp: mgo.GetMoreOp{CursorId: cursorID}}
+	}
+	reply := func(cursorID int64) *ReplyOp {
+		return &ReplyOp{ReplyOp: mgo.ReplyOp{CursorId: cursorID}}
+	}
+
+	// cursor 1 serves two getmores before it is exhausted, and cursor 2 is
+	// killed after one
+	stats.observe(query, reply(1))
+	stats.observe(query, reply(2))
+	stats.observe(query, reply(0))
+	stats.observe(getMore(1), reply(1))
+	stats.observe(getMore(2), reply(2))
+	stats.observe(getMore(1), reply(0))
+	stats.observe(&KillCursorsOp{KillCursorsOp: mgo.KillCursorsOp{CursorIds: []int64{2}}}, reply(0))
+	stats.observe(query, reply(3))
+	stats.finish()
+
+	if stats.Opened != 3 || stats.GetMores != 3 || stats.Exhausted != 1 || stats.Killed != 1 || stats.LeftOpen != 1 {
+		t.Errorf("unexpected cursor counts: %v", stats)
+	}
+	if stats.GetMoresPerCursor[2] != 1 || stats.GetMoresPerCursor[1] != 1 {
+		t.Errorf("unexpected getmores per cursor: %v", stats.GetMoresPerCursor)
+	}
+
+	out, err := ioutil.TempFile("", "cursor_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	recorder := &JSONStatRecorder{out: out}
+	recorder.RecordCursorStats(stats)
+	recorder.Close()
+	written, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := struct {
+		Cursors CursorStats `json:"cursor_stats"`
+	}{}
+	if err := json.Unmarshal(written, &report); err != nil {
+		t.Fatalf("error parsing JSON cursor stats %q: %v", written, err)
+	}
+	if report.Cursors.Opened != 3 || report.Cursors.GetMoresPerCursor[2] != 1 {
+		t.Errorf("unexpected JSON cursor stats %s", written)
+	}
+}
@@ -0,0 +1,234 @@
+package mongoreplay
+
+import (
+	"github.com/10gen/llmgo/bson"
+)
+
+// cursorTracker tracks the requests of a recording awaiting their replies, the
+// cursors opened in it that are still open and the transactions started in it
+// that haven't ended. It finds the points at which a recording can end, or
+// roll over to another file, without splitting the ops of a cursor or a
+// transaction, and the ops that finish those left unfinished.
+type cursorTracker struct {
+	// pending maps the recorded requests awaiting a reply to the cursorIDs
+	// they use, which only getmores have
+	pending map[opKey][]int64
+
+	// openCursors holds the cursorIDs returned in replies that have not yet
+	// been exhausted or killed
+	openCursors map[int64]struct{}
+
+	// openTransactions holds the keys of the transactions that have been
+	// started but not yet committed or aborted
+	openTransactions map[string]struct{}
+}
+
+func newCursorTracker() *cursorTracker {
+	return &cursorTracker{
+		pending:          make(map[opKey][]int64),
+		openCursors:      make(map[int64]struct{}),
+		openTransactions: make(map[string]struct{}),
+	}
+}
+
+// unfinished returns the number of requests awaiting replies, open cursors and
+// open transactions.
+func (c *cursorTracker) unfinished() int {
+	return len(c.pending) + len(c.openCursors) + len(c.openTransactions)
+}
+
+// finishes returns whether the op continues the ops tracked so far: a reply to
+// a pending request, a getmore or killcursors on an open cursor, or an op of
+// an open transaction.
+func (c *cursorTracker) finishes(op *RecordedOp) (bool, error) {
+	_, key, ok, err := transactionCommand(op)
+	if err != nil {
+		return false, err
+	}
+	if _, open := c.openTransactions[key]; ok && open {
+		return true, nil
+	}
+	parsedOp, err := parseCursorOp(op)
+	if err != nil {
+		return false, err
+	}
+	if castOp, ok := parsedOp.(cursorsRewriteable); ok {
+		cursorIDs, err := castOp.getCursorIDs()
+		if err != nil {
+			return false, err
+		}
+		for _, cursorID := range cursorIDs {
+			if _, ok := c.openCursors[cursorID]; ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if !op.EOF && !isRequest(op) {
+		_, ok := c.pending[replyKey(op)]
+		return ok, nil
+	}
+	return false, nil
+}
+
+// track updates the tracker with an op that has been recorded.
+func (c *cursorTracker) track(op *RecordedOp) error {
+	if op.EOF {
+		return nil
+	}
+	if err := c.trackTransaction(op); err != nil {
+		return err
+	}
+	parsedOp, err := parseCursorOp(op)
+	if err != nil {
+		return err
+	}
+	switch castOp := parsedOp.(type) {
+	case cursorsRewriteable:
+		cursorIDs, err := castOp.getCursorIDs()
+		if err != nil {
+			return err
+		}
+		if op.Header.OpCode == OpCodeKillCursors {
+			for _, cursorID := range cursorIDs {
+				delete(c.openCursors, cursorID)
+			}
+			return nil
+		}
+		c.pending[requestKey(op)] = cursorIDs
+	case Replyable:
+		key := replyKey(op)
+		cursorIDs, ok := c.pending[key]
+		if !ok {
+			// a reply to a request that wasn't tracked, such as one sent
+			// before the recording started or written to an earlier file
+			return nil
+		}
+		delete(c.pending, key)
+		cursorID, err := castOp.getCursorID()
+		if err != nil {
+			return err
+		}
+		if cursorID == 0 {
+			for _, usedID := range cursorIDs {
+				delete(c.openCursors, usedID)
+			}
+		} else {
+			c.openCursors[cursorID] = struct{}{}
+		}
+	default:
+		// other requests, and replies whose cursors aren't tracked, such as
+		// compressed ones
+		if !isRequest(op) {
+			delete(c.pending, replyKey(op))
+		} else if expectsReply(op) {
+			c.pending[requestKey(op)] = nil
+		}
+	}
+	return nil
+}
+
+// trackTransaction opens the transaction an op starts, or closes the one it
+// commits or aborts.
+func (c *cursorTracker) trackTransaction(op *RecordedOp) error {
+	command, key, ok, err := transactionCommand(op)
+	if err != nil || !ok {
+		return err
+	}
+	switch command[0].Name {
+	case "commitTransaction", "abortTransaction":
+		delete(c.openTransactions, key)
+		return nil
+	}
+	for _, elem := range command {
+		if elem.Name == "startTransaction" && elem.Value == true {
+			c.openTransactions[key] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// transactionCommand returns the command of a request that is part of a
+// transaction, and the key of the transaction, if it is in one.
+func transactionCommand(op *RecordedOp) (bson.D, string, bool, error) {
+	if !isRequest(op) {
+		return nil, "", false, nil
+	}
+	command, ok, err := msgCommand(&op.RawOp)
+	if err != nil || !ok || len(command) == 0 {
+		return nil, "", false, err
+	}
+	key, ok := transactionKey(command)
+	return command, key, ok, nil
+}
+
+// isRequest returns whether the op is a request sent by a driver, as opposed
+// to a reply or the end of a connection. A reply to a request with id 0 is
+// only told apart by its opcode.
+func isRequest(op *RecordedOp) bool {
+	return !op.EOF && op.Header.ResponseTo == 0 && !isReplyOpCode(op.RawOp)
+}
+
+// expectsReply returns whether the op is a request that the server replies
+// to, unlike legacy writes, killcursors and OP_MSGs sent with moreToCome.
+func expectsReply(op *RecordedOp) bool {
+	if !isRequest(op) || op.moreToCome() {
+		return false
+	}
+	opCode := op.Header.OpCode
+	if opCode == OpCodeCompressed && len(op.Body) >= MsgHeaderLen+4 {
+		opCode = OpCode(getInt32(op.Body, MsgHeaderLen))
+	}
+	switch opCode {
+	case OpCodeInsert, OpCodeUpdate, OpCodeDelete, OpCodeKillCursors:
+		return false
+	}
+	return true
+}
+
+// parseCursorOp parses the op if it may use or produce a cursor. It returns nil
+// for all other ops.
+func parseCursorOp(op *RecordedOp) (Op, error) {
+	switch op.Header.OpCode {
+	case OpCodeGetMore, OpCodeKillCursors, OpCodeReply, OpCodeCommandReply:
+	case OpCodeCommand:
+		commandName, err := getCommandName(&op.RawOp)
+		if err != nil {
+			return nil, err
+		}
+		if commandName != "getMore" && commandName != "getmore" {
+			return nil, nil
+		}
+	case OpCodeMsg:
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			return nil, err
+		}
+		// only getmores and replies, and not other commands
+		if _, ok := parsedOp.(*MsgOp); ok {
+			return nil, nil
+		}
+		return parsedOp, nil
+	default:
+		return nil, nil
+	}
+	return op.RawOp.Parse()
+}
+
+// requestKey returns the key of a request, which its reply is found by.
+func requestKey(op *RecordedOp) opKey {
+	return opKey{
+		driverEndpoint: op.SrcEndpoint,
+		serverEndpoint: op.DstEndpoint,
+		opID:           op.Header.RequestID,
+	}
+}
+
+// replyKey returns the key of the request a reply answers.
+func replyKey(op *RecordedOp) opKey {
+	return opKey{
+		driverEndpoint: op.DstEndpoint,
+		serverEndpoint: op.SrcEndpoint,
+		opID:           op.Header.ResponseTo,
+	}
+}
@@ -1,6 +1,7 @@
 package mongoreplay
 
 import (
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -149,74 +150,122 @@ func (p *preprocessCursorManager) MarkFailed(failedOp *RecordedOp) {
 	}
 }
 
-// newPreprocessCursorManager generates a map of cursorIDs that were found when
-// preprocessing the operations. To perform this, it checks to see if a reply
-// containing a given cursorID is seen and a corresponding getmore which uses
-// that cursorID is also seen. It adds these such cursorIDs to the map and
-// tracks how many uses they have had as well.
-func newPreprocessCursorManager(opChan <-chan *RecordedOp) (*preprocessCursorManager, error) {
-	userInfoLogger.Logvf(Always, "Preprocessing file")
-
-	result := preprocessCursorManager{
-		cursorInfos: make(map[int64]*preprocessCursorInfo),
-		opToCursors: make(map[opKey]int64),
+// merge adds the cursors tracked in another cursorsSeenMap, built from a
+// different part of the same ops, to this one. A cursor may be returned in
+// the ops of one part and used in those of another.
+func (c *cursorsSeenMap) merge(other cursorsSeenMap) {
+	for cursorID, counter := range other {
+		val, ok := (*c)[cursorID]
+		if !ok {
+			(*c)[cursorID] = counter
+			continue
+		}
+		val.usesSeen += counter.usesSeen
+		val.usesConn = append(val.usesConn, counter.usesConn...)
+		if counter.replySeen {
+			val.replySeen = true
+			val.replyConn = counter.replyConn
+			val.opOriginKey = counter.opOriginKey
+		}
+		(*c)[cursorID] = val
 	}
+}
 
-	cursorsSeen := &cursorsSeenMap{}
+// track notes the cursor returned in the op if it is a reply, or the cursors
+// used by it if it is a getmore or killcursors.
+func (c *cursorsSeenMap) track(op *RecordedOp) error {
+	// If they don't produce a cursor, skip them
+	if op.RawOp.Header.OpCode != OpCodeGetMore && op.RawOp.Header.OpCode != OpCodeKillCursors &&
+		op.RawOp.Header.OpCode != OpCodeReply && op.RawOp.Header.OpCode != OpCodeCommandReply && op.RawOp.Header.OpCode != OpCodeCommand {
+		return nil
+	}
+	if op.RawOp.Header.OpCode == OpCodeCommand {
+		commandName, err := getCommandName(&op.RawOp)
+		if err != nil {
+			return err
+		}
+		if commandName != "getMore" && commandName != "getmore" {
+			return nil
+		}
+	}
 
-	// Loop over all the ops found in the file
-	for op := range opChan {
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		return err
+	}
 
-		// If they don't produce a cursor, skip them
-		if op.RawOp.Header.OpCode != OpCodeGetMore && op.RawOp.Header.OpCode != OpCodeKillCursors &&
-			op.RawOp.Header.OpCode != OpCodeReply && op.RawOp.Header.OpCode != OpCodeCommandReply && op.RawOp.Header.OpCode != OpCodeCommand {
-			continue
+	switch castOp := parsedOp.(type) {
+	case cursorsRewriteable:
+		// If the op makes use of a cursor, such as a getmore or a killcursors,
+		// track this op and attemp to match it with the reply that contains its
+		// cursor
+		cursorIDs, err := castOp.getCursorIDs()
+		if err != nil {
+			return err
 		}
-		if op.RawOp.Header.OpCode == OpCodeCommand {
-			commandName, err := getCommandName(&op.RawOp)
-			if err != nil {
-				return nil, err
-			}
-			if commandName != "getMore" && commandName != "getmore" {
+		for _, cursorID := range cursorIDs {
+			if cursorID == 0 {
 				continue
 			}
+			c.trackSeen(cursorID, op.SeenConnectionNum)
 		}
 
-		parsedOp, err := op.RawOp.Parse()
+	case Replyable:
+		// If the op is a reply it may contain a cursorID. If so, track this
+		// op and attempt to pair it with the the op that requires its
+		// cursor id.
+		cursorID, err := castOp.getCursorID()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if cursorID == 0 {
+			return nil
 		}
+		c.trackReplied(cursorID, op)
+	}
+	return nil
+}
 
-		switch castOp := parsedOp.(type) {
-		case cursorsRewriteable:
-			// If the op makes use of a cursor, such as a getmore or a killcursors,
-			// track this op and attemp to match it with the reply that contains its
-			// cursor
-			cursorIDs, err := castOp.getCursorIDs()
-			if err != nil {
-				return nil, err
-			}
-			for _, cursorID := range cursorIDs {
-				if cursorID == 0 {
-					continue
-				}
-				cursorsSeen.trackSeen(cursorID, op.SeenConnectionNum)
-			}
+// newPreprocessCursorManager generates a map of cursorIDs that were found when
+// preprocessing the operations. To perform this, it checks to see if a reply
+// containing a given cursorID is seen and a corresponding getmore which uses
+// that cursorID is also seen. It adds these such cursorIDs to the map and
+// tracks how many uses they have had as well. The ops are parsed by a worker
+// per CPU, whose cursors are merged once all of the ops have been seen.
+func newPreprocessCursorManager(opChan <-chan *RecordedOp) (*preprocessCursorManager, error) {
+	userInfoLogger.Logvf(Always, "Preprocessing file")
 
-		case Replyable:
-			// If the op is a reply it may contain a cursorID. If so, track this
-			// op and attempt to pair it with the the op that requires its
-			// cursor id.
-			cursorID, err := castOp.getCursorID()
-			if err != nil {
-				return nil, err
-			}
-			if cursorID == 0 {
-				continue
+	result := preprocessCursorManager{
+		cursorInfos: make(map[int64]*preprocessCursorInfo),
+		opToCursors: make(map[opKey]int64),
+	}
+
+	numWorkers := runtime.GOMAXPROCS(0)
+	workerCursors := make([]cursorsSeenMap, numWorkers)
+	workerErrs := make([]error, numWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workerCursors[i] = cursorsSeenMap{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Loop over all the ops found in the file, draining the channel
+			// even after an error so that the reader isn't left blocked
+			for op := range opChan {
+				if workerErrs[i] == nil {
+					workerErrs[i] = workerCursors[i].track(op)
+				}
 			}
-			cursorsSeen.trackReplied(cursorID, op)
+		}(i)
+	}
+	wg.Wait()
 
+	cursorsSeen := &cursorsSeenMap{}
+	for i := 0; i < numWorkers; i++ {
+		if workerErrs[i] != nil {
+			return nil, workerErrs[i]
 		}
+		cursorsSeen.merge(workerCursors[i])
 	}
 
 	for cursorID, counter := range *cursorsSeen {
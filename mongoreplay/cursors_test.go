@@ -358,3 +358,69 @@ func TestSkipOnMarkFailed(t *testing.T) {
 		t.Errorf("Cursor %v was supposed fail", testCursorID)
 	}
 }
+
+// TestMergeCursorsSeen tests that the cursors tracked by separate preprocess
+// workers are reconciled when one worker saw the reply that returned a cursor
+// and others saw its uses.
+func TestMergeCursorsSeen(t *testing.T) {
+	reply := &RecordedOp{SrcEndpoint: "b", DstEndpoint: "a", SeenConnectionNum: 1}
+	reply.Header.ResponseTo = 10
+
+	replied := cursorsSeenMap{}
+	replied.trackReplied(1, reply)
+	used := cursorsSeenMap{}
+	used.trackSeen(1, 2)
+	used.trackSeen(1, 3)
+	used.trackSeen(2, 2)
+	usedAgain := cursorsSeenMap{}
+	usedAgain.trackSeen(1, 2)
+
+	merged := &cursorsSeenMap{}
+	merged.merge(used)
+	merged.merge(replied)
+	merged.merge(usedAgain)
+
+	counter := (*merged)[1]
+	if !counter.replySeen || counter.replyConn != 1 || counter.usesSeen != 3 {
+		t.Errorf("cursor 1 not reconciled across workers: %#v", counter)
+	}
+	if counter.opOriginKey.opID != 10 || counter.opOriginKey.driverEndpoint != "a" {
+		t.Errorf("cursor 1 has the wrong originating op: %#v", counter.opOriginKey)
+	}
+	if counter := (*merged)[2]; counter.replySeen || counter.usesSeen != 1 {
+		t.Errorf("cursor 2 should have a use but no reply: %#v", counter)
+	}
+}
+
+// BenchmarkPreprocessCursorManager measures preprocessing a tape of cursors
+// that are each returned in a reply and then used by a getmore.
+func BenchmarkPreprocessCursorManager(b *testing.B) {
+	const numCursors = 400
+	var ops []*RecordedOp
+	generator := newRecordedOpGenerator()
+	for i := int64(1); i <= numCursors; i++ {
+		if err := generator.generateReply(int32(i), i, 0); err != nil {
+			b.Fatal(err)
+		}
+		if err := generator.generateGetMore(i, 0); err != nil {
+			b.Fatal(err)
+		}
+		ops = append(ops, <-generator.opChan, <-generator.opChan)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		opChan := make(chan *RecordedOp, len(ops))
+		for _, op := range ops {
+			opChan <- op
+		}
+		close(opChan)
+		preprocessManager, err := newPreprocessCursorManager(opChan)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(preprocessManager.cursorInfos) != numCursors {
+			b.Fatalf("expected %v cursors, found %v", numCursors, len(preprocessManager.cursorInfos))
+		}
+	}
+}
@@ -93,7 +93,6 @@ func (op *DeleteOp) FromReader(r io.Reader) error {
 // Execute performs the DeleteOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *DeleteOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
 	if err := mgo.ExecOpWithoutReply(session, &op.DeleteOp); err != nil {
 		return nil, err
 	}
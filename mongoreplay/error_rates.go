@@ -0,0 +1,126 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// allOpTypes is the op type of an error rate threshold that applies to the
+// ops of every type together.
+const allOpTypes = "all"
+
+// ErrorRateThresholds holds the maximum percentage of ops of each op type that
+// may fail in a playback. The op types are named as in the stats: the op type
+// and, for commands, the command name, such as "query" or "command find".
+type ErrorRateThresholds map[string]float64
+
+// ErrErrorRateExceeded means that the ops of some op types failed more often
+// than their thresholds allow.
+type ErrErrorRateExceeded struct {
+	OpTypes []string
+}
+
+func (e ErrErrorRateExceeded) Error() string {
+	return fmt.Sprintf("error rate threshold exceeded for %v", strings.Join(e.OpTypes, ", "))
+}
+
+// ParseErrorRateThresholds parses thresholds given as <op type>=<percent>.
+func ParseErrorRateThresholds(thresholds []string) (ErrorRateThresholds, error) {
+	result := ErrorRateThresholds{}
+	for _, threshold := range thresholds {
+		i := strings.LastIndex(threshold, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid error rate threshold '%v', expected <op type>=<percent>", threshold)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(threshold[i+1:], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage in error rate threshold '%v'", threshold)
+		}
+		result[strings.TrimSpace(threshold[:i])] = percent
+	}
+	return result, nil
+}
+
+// errorRate is the error rate of an op type and its threshold. The ops whose
+// writes failed are counted apart from the ops that failed outright, and
+// only count towards the rate when countWriteErrors is set.
+type errorRate struct {
+	opType           string
+	ops              int64
+	errors           int64
+	writeErrors      int64
+	countWriteErrors bool
+	threshold        float64
+}
+
+func (rate errorRate) percent() float64 {
+	if rate.ops == 0 {
+		return 0
+	}
+	failed := rate.errors
+	if rate.countWriteErrors {
+		failed += rate.writeErrors
+	}
+	return 100 * float64(failed) / float64(rate.ops)
+}
+
+func (rate errorRate) exceeded() bool {
+	return rate.percent() > rate.threshold
+}
+
+func (rate errorRate) String() string {
+	result := "ok"
+	if rate.exceeded() {
+		result = "EXCEEDED"
+	}
+	writeErrors := "not counted"
+	if rate.countWriteErrors {
+		writeErrors = "counted"
+	}
+	return fmt.Sprintf("%v: %v errors and %v write errors (%v) in %v ops (%.2f%%), threshold %v%%: %v",
+		rate.opType, rate.errors, rate.writeErrors, writeErrors, rate.ops, rate.percent(), rate.threshold, result)
+}
+
+// check returns the error rate of each op type with a threshold, sorted by op
+// type, from the aggregated stats of a playback. The ops whose writes failed
+// count as failed if countWriteErrors is set.
+func (thresholds ErrorRateThresholds) check(agg *StatAggregate, countWriteErrors bool) []errorRate {
+	opTypes := make([]string, 0, len(thresholds))
+	for opType := range thresholds {
+		opTypes = append(opTypes, opType)
+	}
+	sort.Strings(opTypes)
+
+	rates := make([]errorRate, 0, len(opTypes))
+	for _, opType := range opTypes {
+		totals := &agg.Total
+		if opType != allOpTypes {
+			totals = agg.ByType[opType]
+		}
+		rate := errorRate{opType: opType, countWriteErrors: countWriteErrors, threshold: thresholds[opType]}
+		if totals != nil {
+			rate.ops, rate.errors, rate.writeErrors = totals.Count, totals.Errors, totals.WriteErrors
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// Check logs the error rate of each op type with a threshold, returning an
+// ErrErrorRateExceeded if any exceed it. The ops whose writes failed count as
+// failed if countWriteErrors is set.
+func (thresholds ErrorRateThresholds) Check(agg *StatAggregate, countWriteErrors bool) error {
+	exceeded := []string{}
+	for _, rate := range thresholds.check(agg, countWriteErrors) {
+		userInfoLogger.Logvf(Always, "Error rate of %v", rate)
+		if rate.exceeded() {
+			exceeded = append(exceeded, rate.opType)
+		}
+	}
+	if len(exceeded) > 0 {
+		return ErrErrorRateExceeded{OpTypes: exceeded}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseErrorRateThresholds(t *testing.T) {
+	thresholds, err := ParseErrorRateThresholds([]string{"query=5", "command find=0.5%", "all=10"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ErrorRateThresholds{"query": 5, "command find": 0.5, "all": 10}
+	if len(thresholds) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, thresholds)
+	}
+	for opType, percent := range expected {
+		if thresholds[opType] != percent {
+			t.Errorf("expected threshold %v for %v, got %v", percent, opType, thresholds[opType])
+		}
+	}
+
+	for _, invalid := range []string{"query", "=5", "query=", "query=five", "query=-1", "query=101"} {
+		if _, err := ParseErrorRateThresholds([]string{invalid}); err == nil {
+			t.Errorf("expected an error parsing '%v'", invalid)
+		}
+	}
+}
+
+func TestErrorRateThresholdsCheck(t *testing.T) {
+	agg := NewStatAggregate()
+	failed := []error{fmt.Errorf("failed")}
+	for i := 0; i < 10; i++ {
+		stat := &OpStat{OpType: "query"}
+		if i < 2 {
+			stat.Errors = failed
+		}
+		agg.Add(stat)
+	}
+	for i := 0; i < 10; i++ {
+		agg.Add(&OpStat{OpType: "command", Command: "find"})
+	}
+	// an insert that failed outright, and one whose writes partly failed
+	agg.Add(&OpStat{OpType: "command", Command: "insert", Errors: failed, WriteErrors: failed})
+	agg.Add(&OpStat{OpType: "command", Command: "insert", WriteErrors: failed})
+
+	thresholds := ErrorRateThresholds{"query": 20, "command find": 0, "all": 5, "getmore": 0}
+	rates := thresholds.check(agg, false)
+	expected := []errorRate{
+		{opType: "all", ops: 22, errors: 3, writeErrors: 1, threshold: 5},
+		{opType: "command find", ops: 10, errors: 0, threshold: 0},
+		{opType: "getmore", ops: 0, errors: 0, threshold: 0},
+		{opType: "query", ops: 10, errors: 2, threshold: 20},
+	}
+	if len(rates) != len(expected) {
+		t.Fatalf("expected %v rates, got %v", len(expected), rates)
+	}
+	for i := range expected {
+		if rates[i] != expected[i] {
+			t.Errorf("expected rate %v, got %v", expected[i], rates[i])
+		}
+	}
+
+	err := thresholds.Check(agg, false)
+	exceeded, ok := err.(ErrErrorRateExceeded)
+	if !ok {
+		t.Fatalf("expected ErrErrorRateExceeded, got %v", err)
+	}
+	if len(exceeded.OpTypes) != 1 || exceeded.OpTypes[0] != "all" {
+		t.Errorf("expected only 'all' to be exceeded, got %v", exceeded.OpTypes)
+	}
+
+	delete(thresholds, "all")
+	if err := thresholds.Check(agg, false); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// the partly failed insert only counts towards the rate when asked
+	thresholds = ErrorRateThresholds{"command insert": 50}
+	if err := thresholds.Check(agg, false); err != nil {
+		t.Errorf("expected no error without counting write errors, got %v", err)
+	}
+	if err := thresholds.Check(agg, true); err == nil {
+		t.Errorf("expected the threshold to be exceeded counting write errors")
+	}
+}
+
+func TestExtractWriteErrors(t *testing.T) {
+	partial := &bson.D{
+		{"n", 1},
+		{"writeErrors", []interface{}{
+			bson.D{{"index", 1}, {"code", 11000}, {"errmsg", "E11000 duplicate key error"}},
+		}},
+		{"writeConcernError", bson.D{{"code", 64}, {"errmsg", "waiting for replication timed out"}}},
+		{"ok", 1},
+	}
+	if errs := extractErrorsFromDoc(partial); len(errs) != 0 {
+		t.Errorf("expected no command errors, got %v", errs)
+	}
+	errs := extractWriteErrorsFromDoc(partial)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "E11000") ||
+		!strings.Contains(errs[1].Error(), "waiting for replication") {
+		t.Errorf("expected the write error and the write concern error, got %v", errs)
+	}
+
+	failed := &bson.D{{"ok", 0}, {"errmsg", "not master"}, {"code", 10107}}
+	if errs := extractErrorsFromDoc(failed); len(errs) != 1 {
+		t.Errorf("expected one command error, got %v", errs)
+	}
+	if errs := extractWriteErrorsFromDoc(failed); len(errs) != 0 {
+		t.Errorf("expected no write errors, got %v", errs)
+	}
+}
@@ -0,0 +1,38 @@
+package mongoreplay_test
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-tools/mongoreplay"
+)
+
+// This example counts the ops of a playback file by type, without playing
+// them.
+func ExampleTapeReader() {
+	reader, err := mongoreplay.OpenTape("playback.bson", false)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer reader.Close()
+
+	counts := map[string]int{}
+	for reader.Next() {
+		op := reader.Op()
+		if op.EOF {
+			continue
+		}
+		opType := op.OpType
+		if op.Command != "" {
+			opType += " " + op.Command
+		}
+		counts[opType]++
+	}
+	if err := reader.Err(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for opType, count := range counts {
+		fmt.Printf("%v: %v\n", opType, count)
+	}
+}
@@ -1,11 +1,13 @@
 package mongoreplay
 
 import (
+	"crypto/tls"
 	"fmt"
 	"sync"
 	"time"
 
 	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
 	"github.com/patrickmn/go-cache"
 )
 
@@ -36,6 +38,111 @@ type ExecutionContext struct {
 	// cursorIDs
 	CursorIDMap cursorManager
 
+	// AnonymizeValues indicates that the literal values in query filters
+	// should be replaced with placeholders before ops are executed
+	AnonymizeValues bool
+
+	// NamespaceSpeeds holds the speeds of the namespaces played at other than
+	// the speed of the rest of the tape
+	NamespaceSpeeds NamespaceSpeeds
+
+	// NamespaceLimits, if set, caps the ops in flight at once on some of the
+	// namespaces played
+	NamespaceLimits *namespaceLimits
+
+	// ReadPreference, if set, is the read preference reads are played with
+	ReadPreference *ReadPreference
+
+	// SkipHandshake indicates that the recorded handshake and authentication
+	// ops should be dropped, leaving the sessions as established by Play
+	SkipHandshake bool
+
+	// RunID, if set, is added as a comment to the ops that can carry one
+	RunID string
+
+	// ShardKeyDefaults, if set, holds the fields added to the documents
+	// inserted into some namespaces that lack them
+	ShardKeyDefaults ShardKeyDefaults
+
+	// Collation, if set, is added to the find and aggregate commands played
+	// without one
+	Collation bson.D
+
+	// Renamer, if set, renames the namespaces of the ops played
+	Renamer *nsRenamer
+
+	// BatchSize, if set, sets the batch size of the reads played
+	BatchSize *batchSizeOverride
+
+	// Checksum indicates that every OP_MSG should be sent ending in a
+	// checksum, not only those recorded with one
+	Checksum bool
+
+	// Transactions, if set, holds the transactions found in the tape, whose
+	// fragments are skipped
+	Transactions *transactionTracker
+
+	// TargetWireVersion is the max wire version of the target, or zero if it
+	// isn't known
+	TargetWireVersion int
+
+	// Serial indicates that all ops should be played one at a time on a
+	// single connection, in the order they were recorded
+	Serial bool
+
+	// Connections, if set, is the pool of connections the recorded
+	// connections are spread over, instead of each being played on its own
+	Connections *connectionPool
+
+	// TLSConfig, if set, is used to connect to the target with SSL
+	TLSConfig *tls.Config
+
+	// Credential, if set, is used to authenticate to the target
+	Credential *mgo.Credential
+
+	// Compressors, if set, are the wire compressors asked for in the
+	// handshake of each connection to the target, in order of preference,
+	// and Negotiated counts the connections by the one the target agreed to
+	Compressors []string
+	Negotiated  *negotiatedCompressors
+
+	// WarmSessions, if set, holds connections opened before playback for
+	// the connections of the playback to take
+	WarmSessions *warmPool
+
+	// Faults, if set, injects faults into the ops played
+	Faults *faultInjector
+
+	// DeadCursors holds the live cursors that the target didn't find, whose
+	// later ops are skipped
+	DeadCursors *deadCursors
+
+	// DialTimeout is the time allowed to connect to the target, or zero to
+	// use the default
+	DialTimeout time.Duration
+
+	// SocketTimeout is the time allowed for the target to answer on a
+	// connection, or zero to use the default of a minute
+	SocketTimeout time.Duration
+
+	// NegativeDeltas, if set, clamps the ops seen before the op ahead of
+	// them, or fails the playback on one
+	NegativeDeltas *negativeDeltas
+
+	// OpTimeout, if set, is the time limit of each op, given to the ops
+	// that accept one as their maxTimeMS, past which, with a grace period,
+	// the connection of an op is dropped and the op counted as timed out
+	OpTimeout time.Duration
+
+	// StartAt, if set, is the time to play the first op at
+	StartAt time.Time
+
+	// LoopCooldown is the pause between the repetitions of a repeated
+	// playback, and LoopCooldownCommand, if set, a command run on the target
+	// at the start of each pause
+	LoopCooldown        time.Duration
+	LoopCooldownCommand string
+
 	// lock synchronizes access to all of the caches and maps in the
 	// ExecutionContext
 	sync.Mutex
@@ -51,6 +158,7 @@ func NewExecutionContext(statColl *StatCollector) *ExecutionContext {
 		IncompleteReplies: cache.New(60*time.Second, 60*time.Second),
 		CompleteReplies:   map[string]*ReplyPair{},
 		CursorIDMap:       newCursorCache(),
+		DeadCursors:       newDeadCursors(),
 		StatCollector:     statColl,
 	}
 }
@@ -102,6 +210,12 @@ func (context *ExecutionContext) rewriteCursors(rewriteable cursorsRewriteable,
 	for _, cursorID := range cursorIDs {
 		userInfoLogger.Logvf(DebugLow, "Rewriting cursorID : %v", cursorID)
 		liveCursorID, ok := context.CursorIDMap.GetCursor(cursorID, connectionNum)
+		if ok && liveCursorID == 0 {
+			// the target returned every document of the cursor in fewer
+			// batches than were recorded, as with a larger --batchSize
+			userInfoLogger.Logvf(DebugLow, "Cursor for raw cursorID %v was exhausted on the target", cursorID)
+			ok = false
+		}
 		if ok {
 			cursorIDs[index] = liveCursorID
 			index++
@@ -149,8 +263,13 @@ func (context *ExecutionContext) newExecutionSession(url string, start time.Time
 		now := time.Now()
 		var connected bool
 		time.Sleep(start.Add(-5 * time.Second).Sub(now)) // Sleep until five seconds before the start time
-		session, err := mgo.Dial(url)
+		var sessions *playbackSessions
+		session, err := context.session(url)
 		if err == nil {
+			sessions = newPlaybackSessions(session, context.ReadPreference)
+			if sessions.readSession != nil {
+				sessions.readSession.SetSocketTimeout(context.opSocketTimeout())
+			}
 			userInfoLogger.Logvf(Info, "(Connection %v) New connection CREATED.", connectionNum)
 			connected = true
 		} else {
@@ -172,8 +291,8 @@ func (context *ExecutionContext) newExecutionSession(url string, start time.Time
 					}
 				}
 				userInfoLogger.Logvf(DebugHigh, "(Connection %v) op %v", connectionNum, recordedOp.String())
-				session.SetSocketTimeout(0)
-				parsedOp, reply, err = context.Execute(recordedOp, session)
+				session.SetSocketTimeout(context.opSocketTimeout())
+				parsedOp, reply, err = context.execute(recordedOp, sessions)
 				if err != nil {
 					toolDebugLogger.Logvf(Always, "context.Execute error: %v", err)
 				}
@@ -186,7 +305,7 @@ func (context *ExecutionContext) newExecutionSession(url string, start time.Time
 				msg = fmt.Sprintf("Skipped on non-connected session (Connection %v)", connectionNum)
 				toolDebugLogger.Logv(Always, msg)
 			}
-			if shouldCollectOp(parsedOp) {
+			if shouldCollectOp(parsedOp) && !context.isSkippedHandshake(parsedOp) {
 				context.Collect(recordedOp, parsedOp, reply, msg)
 			}
 		}
@@ -198,6 +317,13 @@ func (context *ExecutionContext) newExecutionSession(url string, start time.Time
 
 // Execute plays a particular command on an mgo session.
 func (context *ExecutionContext) Execute(op *RecordedOp, session *mgo.Session) (Op, Replyable, error) {
+	session.SetSocketTimeout(context.opSocketTimeout())
+	return context.execute(op, &playbackSessions{session: session})
+}
+
+// execute plays a particular command on the session of a connection that it
+// belongs on.
+func (context *ExecutionContext) execute(op *RecordedOp, sessions *playbackSessions) (Op, Replyable, error) {
 	opToExec, err := op.RawOp.Parse()
 	var reply Replyable
 
@@ -213,7 +339,11 @@ func (context *ExecutionContext) Execute(op *RecordedOp, session *mgo.Session) (
 	} else if recordedCommandReply, ok := opToExec.(*CommandReplyOp); ok {
 		context.AddFromFile(recordedCommandReply, op)
 	} else {
-		if IsDriverOp(opToExec) {
+		if IsDriverOp(opToExec) || context.isSkippedHandshake(opToExec) {
+			return opToExec, nil, nil
+		}
+		if context.Transactions.isOrphan(opToExec) {
+			toolDebugLogger.Logvf(DebugLow, "Skipping op of a transaction fragment: %v", op.String())
 			return opToExec, nil, nil
 		}
 
@@ -225,19 +355,104 @@ func (context *ExecutionContext) Execute(op *RecordedOp, session *mgo.Session) (
 			if !ok2 {
 				return opToExec, nil, nil
 			}
+			dead, err := context.DeadCursors.skip(rewriteable)
+			if err != nil {
+				return opToExec, nil, err
+			}
+			if dead {
+				toolDebugLogger.Logvf(DebugLow, "Skipping op on a cursor not found on the target: %v", op.String())
+				return opToExec, nil, nil
+			}
+		}
+
+		if context.Renamer != nil {
+			if err := context.Renamer.renameOp(opToExec); err != nil {
+				return opToExec, nil, err
+			}
 		}
 
+		if context.AnonymizeValues {
+			if err := anonymizeOp(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		// new _ids are given before shard key fields may copy them
+		if op.Synthetic {
+			if err := regenerateIDs(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		if err := context.ShardKeyDefaults.apply(opToExec); err != nil {
+			return opToExec, nil, err
+		}
+
+		if context.RunID != "" {
+			if err := context.tagRunID(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		if context.Collation != nil {
+			if err := context.setCollation(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		if context.BatchSize != nil {
+			if err := context.BatchSize.setBatchSize(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		if context.OpTimeout > 0 {
+			if err := context.setMaxTime(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+		}
+
+		if context.Checksum {
+			addChecksum(opToExec)
+		}
+
+		if injected, send := context.Faults.apply(op); !send {
+			context.CursorIDMap.MarkFailed(op)
+			return opToExec, injected, nil
+		}
+
+		session := sessions.sessionFor(opToExec)
+		release := context.NamespaceLimits.acquire(opToExec)
 		op.PlayedAt = &PreciseTime{time.Now()}
 
 		reply, err = opToExec.Execute(session)
+		release()
 
 		if err != nil {
 			context.CursorIDMap.MarkFailed(op)
+			if context.OpTimeout > 0 && isNetTimeout(err) {
+				// the timed out connection is dropped, for the later ops of
+				// the session to be played on a new one
+				session.Refresh()
+				return opToExec, newTimeoutReply(context.OpTimeout, op.PlayedAt.Time),
+					fmt.Errorf("op timed out after %v: %v", context.OpTimeout, err)
+			}
 			return opToExec, reply, fmt.Errorf("error executing op: %v", err)
 		}
 		if reply != nil {
+			if rewriteable, ok := opToExec.(cursorsRewriteable); ok && isCursorNotFound(reply) {
+				// carry on with the other ops, as the target's data needn't
+				// match the recording's
+				userInfoLogger.Logvf(Info, "(Connection %v) Cursor not found on the target for op %v", op.PlayedConnectionNum, op.String())
+				if err := context.DeadCursors.markDead(rewriteable); err != nil {
+					return opToExec, reply, err
+				}
+			}
+			context.Cursors.observe(opToExec, reply)
 			context.AddFromWire(reply, op)
-
+			if session == sessions.readSession {
+				sessions.trackCursor(opToExec, reply)
+			}
 		}
 
 	}
@@ -245,3 +460,18 @@ func (context *ExecutionContext) Execute(op *RecordedOp, session *mgo.Session) (
 
 	return opToExec, reply, nil
 }
+
+// opSocketTimeout returns the time allowed for the target to answer an op,
+// or zero for no limit.
+func (context *ExecutionContext) opSocketTimeout() time.Duration {
+	if context.OpTimeout > 0 {
+		return context.OpTimeout + opTimeoutGrace
+	}
+	return 0
+}
+
+// isSkippedHandshake returns whether the op is a handshake op that is not
+// played because of SkipHandshake.
+func (context *ExecutionContext) isSkippedHandshake(op Op) bool {
+	return context.SkipHandshake && op != nil && IsHandshakeOp(op)
+}
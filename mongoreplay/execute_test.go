@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
 )
 
 func TestCompleteReply(t *testing.T) {
@@ -57,3 +58,33 @@ func TestCompleteReply(t *testing.T) {
 		t.Errorf("looked up cursorID is wrong: %v, should be 2500", cursorIDLookup)
 	}
 }
+
+func TestSkipHandshake(t *testing.T) {
+	command := func(name string) *QueryOp {
+		op := &QueryOp{}
+		op.Collection = "admin.$cmd"
+		op.Query = bson.D{{Name: name, Value: 1}}
+		return op
+	}
+	find := &QueryOp{}
+	find.Collection = "test.test"
+	find.Query = bson.D{{Name: "authenticate", Value: 1}}
+
+	context := NewExecutionContext(&StatCollector{})
+	if context.isSkippedHandshake(command("authenticate")) {
+		t.Errorf("handshake ops should be played by default")
+	}
+
+	context.SkipHandshake = true
+	for _, name := range []string{"isMaster", "hello", "authenticate", "saslStart", "buildinfo"} {
+		if !context.isSkippedHandshake(command(name)) {
+			t.Errorf("%v should be skipped as a handshake op", name)
+		}
+	}
+	if context.isSkippedHandshake(command("count")) {
+		t.Errorf("count should not be skipped as a handshake op")
+	}
+	if context.isSkippedHandshake(find) {
+		t.Errorf("a query on a collection should not be skipped as a handshake op")
+	}
+}
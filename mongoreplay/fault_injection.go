@@ -0,0 +1,169 @@
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of fault that can be injected into a playback.
+const (
+	// faultDelay plays the op late
+	faultDelay = "delay"
+	// faultDrop doesn't send the op to the target
+	faultDrop = "drop"
+	// faultError doesn't send the op, and records a synthetic error for it
+	faultError = "error"
+)
+
+var faultTypes = []string{faultDelay, faultDrop, faultError}
+
+// faultInjector injects faults into a fraction of the ops of a playback, to
+// test how an application copes with a misbehaving database. Which ops are
+// faulted, and how, depends only on the seed and the op, so a playback with
+// the same seed injects the same faults however its connections are
+// scheduled.
+type faultInjector struct {
+	// rate is the fraction of the played ops to fault
+	rate  float64
+	types []string
+	delay time.Duration
+	seed  int64
+
+	// counts holds the number of faults injected of each type
+	counts map[string]int64
+	sync.Mutex
+}
+
+// newFaultInjector returns a faultInjector faulting the given percentage of
+// ops with faults of the given types, or all types if none are given. A seed of
+// zero picks a random seed.
+func newFaultInjector(percent float64, types []string, delay time.Duration, seed int64) (*faultInjector, error) {
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("fault rate must be a percentage between 0 and 100, not '%v'", percent)
+	}
+	if delay < 0 {
+		return nil, fmt.Errorf("fault delay must not be negative")
+	}
+	if len(types) == 0 {
+		types = faultTypes
+	}
+	for _, faultType := range types {
+		if !isFaultType(faultType) {
+			return nil, fmt.Errorf("unknown fault type '%v', expected one of %v", faultType, strings.Join(faultTypes, ", "))
+		}
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &faultInjector{
+		rate:   percent / 100,
+		types:  types,
+		delay:  delay,
+		seed:   seed,
+		counts: map[string]int64{},
+	}, nil
+}
+
+func isFaultType(faultType string) bool {
+	for _, known := range faultTypes {
+		if faultType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// choose returns the type of fault to inject into the op, or the empty string
+// if it should be played normally.
+func (f *faultInjector) choose(op *RecordedOp) string {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.LittleEndian, f.seed)
+	fmt.Fprintf(hash, "%v:%d:%d", op.ConnectionString(), op.Header.RequestID, op.Generation)
+	if float64(hash.Sum64()>>11)/(1<<53) >= f.rate {
+		return ""
+	}
+	// hash once more, so the type isn't tied to the draw against the rate
+	hash.Write([]byte{0})
+	return f.types[hash.Sum64()%uint64(len(f.types))]
+}
+
+// apply injects a fault into the op if one is chosen for it, returning whether
+// the op should still be sent to the target and, if not, the reply to record
+// for it instead. A nil faultInjector sends every op.
+func (f *faultInjector) apply(op *RecordedOp) (Replyable, bool) {
+	if f == nil {
+		return nil, true
+	}
+	fault := f.choose(op)
+	if fault == "" {
+		return nil, true
+	}
+	f.Lock()
+	f.counts[fault]++
+	f.Unlock()
+	toolDebugLogger.Logvf(DebugLow, "Injecting %v fault into op %v", fault, op.String())
+
+	switch fault {
+	case faultDelay:
+		time.Sleep(f.delay)
+		return nil, true
+	case faultError:
+		return &faultReply{err: fmt.Errorf("injected fault")}, false
+	}
+	return nil, false
+}
+
+// String returns the seed and the number of faults injected of each type.
+func (f *faultInjector) String() string {
+	f.Lock()
+	defer f.Unlock()
+	types := make([]string, 0, len(f.counts))
+	for faultType := range f.counts {
+		types = append(types, faultType)
+	}
+	sort.Strings(types)
+	counts := make([]string, 0, len(types))
+	for _, faultType := range types {
+		counts = append(counts, fmt.Sprintf("%v %v", f.counts[faultType], faultType))
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "none")
+	}
+	return fmt.Sprintf("%v (seed %v)", strings.Join(counts, ", "), f.seed)
+}
+
+// faultReply is the reply recorded for an op that an injected error kept from
+// being sent.
+type faultReply struct {
+	err error
+}
+
+func (reply *faultReply) getCursorID() (int64, error) {
+	return 0, nil
+}
+
+// Meta returns metadata about the faultReply.
+func (reply *faultReply) Meta() OpMetadata {
+	return OpMetadata{"reply", "", "", map[string]interface{}{"$err": reply.err.Error()}}
+}
+
+func (reply *faultReply) getLatencyMicros() int64 {
+	return 0
+}
+
+func (reply *faultReply) getNumReturned() int {
+	return 0
+}
+
+func (reply *faultReply) getErrors() []error {
+	return []error{reply.err}
+}
+
+func (reply *faultReply) getWriteErrors() []error {
+	return nil
+}
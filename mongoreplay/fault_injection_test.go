@@ -0,0 +1,137 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func faultTestOps(n int) []*RecordedOp {
+	ops := make([]*RecordedOp, n)
+	for i := range ops {
+		op := &RecordedOp{SrcEndpoint: "a", DstEndpoint: "b"}
+		op.Header.RequestID = int32(i)
+		ops[i] = op
+	}
+	return ops
+}
+
+func TestFaultInjectorIsReproducible(t *testing.T) {
+	ops := faultTestOps(1000)
+	first, err := newFaultInjector(20, nil, 0, 42)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, _ := newFaultInjector(20, nil, 0, 42)
+	other, _ := newFaultInjector(20, nil, 0, 43)
+
+	// choose in reverse order for the second injector, as concurrent
+	// connections may play ops in any order
+	again := make([]string, len(ops))
+	for i := len(ops) - 1; i >= 0; i-- {
+		again[i] = second.choose(ops[i])
+	}
+
+	faulted, differs := 0, false
+	seenTypes := map[string]bool{}
+	for i := range ops {
+		fault := first.choose(ops[i])
+		if again[i] != fault {
+			t.Errorf("expected the same fault for op %v with the same seed, got %q and %q", i, fault, again[i])
+		}
+		if other.choose(ops[i]) != fault {
+			differs = true
+		}
+		if fault != "" {
+			faulted++
+			seenTypes[fault] = true
+		}
+	}
+	if !differs {
+		t.Errorf("expected a different seed to fault different ops")
+	}
+	if faulted < 150 || faulted > 250 {
+		t.Errorf("expected about 200 of 1000 ops to be faulted at 20%%, got %v", faulted)
+	}
+	for _, faultType := range faultTypes {
+		if !seenTypes[faultType] {
+			t.Errorf("expected some %v faults", faultType)
+		}
+	}
+
+	// a later generation of a repeated playback is faulted independently
+	op := *ops[0]
+	differs = false
+	for generation := 1; generation < 50 && !differs; generation++ {
+		op.Generation = generation
+		differs = first.choose(&op) != first.choose(ops[0])
+	}
+	if !differs {
+		t.Errorf("expected the ops of other generations to be faulted differently")
+	}
+}
+
+func TestFaultInjectorApply(t *testing.T) {
+	var none *faultInjector
+	if reply, send := none.apply(faultTestOps(1)[0]); !send || reply != nil {
+		t.Errorf("expected a nil faultInjector to send ops")
+	}
+
+	tests := []struct {
+		faultType string
+		send      bool
+		errors    int
+	}{
+		{faultDelay, true, 0},
+		{faultDrop, false, 0},
+		{faultError, false, 1},
+	}
+	for _, test := range tests {
+		faults, err := newFaultInjector(100, []string{test.faultType}, time.Millisecond, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, op := range faultTestOps(3) {
+			reply, send := faults.apply(op)
+			if send != test.send {
+				t.Errorf("expected %v fault to send ops: %v, got %v", test.faultType, test.send, send)
+			}
+			errors := 0
+			if reply != nil {
+				errors = len(reply.getErrors())
+			}
+			if errors != test.errors {
+				t.Errorf("expected %v errors in the reply of a %v fault, got %v", test.errors, test.faultType, errors)
+			}
+		}
+		if faults.counts[test.faultType] != 3 {
+			t.Errorf("expected 3 %v faults to be counted, got %v", test.faultType, faults.counts)
+		}
+		expected := "3 " + test.faultType + " (seed 1)"
+		if faults.String() != expected {
+			t.Errorf("expected %q, got %q", expected, faults.String())
+		}
+	}
+
+	faults, _ := newFaultInjector(0, nil, 0, 1)
+	for _, op := range faultTestOps(100) {
+		if _, send := faults.apply(op); !send {
+			t.Errorf("expected no faults at a rate of 0")
+		}
+	}
+}
+
+func TestNewFaultInjectorErrors(t *testing.T) {
+	if _, err := newFaultInjector(101, nil, 0, 1); err == nil {
+		t.Errorf("expected an error for a rate over 100%%")
+	}
+	if _, err := newFaultInjector(10, []string{"crash"}, 0, 1); err == nil {
+		t.Errorf("expected an error for an unknown fault type")
+	}
+	if _, err := newFaultInjector(10, nil, -time.Second, 1); err == nil {
+		t.Errorf("expected an error for a negative delay")
+	}
+	faults, err := newFaultInjector(10, nil, 0, 0)
+	if err != nil || faults.seed == 0 {
+		t.Errorf("expected a random seed to be picked, got %v (%v)", faults, err)
+	}
+}
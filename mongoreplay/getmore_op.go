@@ -84,7 +84,6 @@ func (op *GetMoreOp) FromReader(r io.Reader) error {
 // Execute performs the GetMoreOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *GetMoreOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
 	before := time.Now()
 
 	_, _, data, resultReply, err := mgo.ExecOpWithReply(session, &op.GetMoreOp)
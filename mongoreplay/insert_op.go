@@ -76,6 +76,9 @@ func (op *InsertOp) FromReader(r io.Reader) error {
 	docLen := 0
 	for len(name)+1+4+docLen < int(op.Header.MessageLength)-MsgHeaderLen {
 		docAsSlice, err := ReadDocument(r)
+		if err != nil {
+			return fmt.Errorf("error reading document %v of insert into %v: %v", len(op.Documents)+1, op.Collection, err)
+		}
 		doc := &bson.D{}
 		err = bson.Unmarshal(docAsSlice, doc)
 		if err != nil {
@@ -90,7 +93,6 @@ func (op *InsertOp) FromReader(r io.Reader) error {
 // Execute performs the InsertOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *InsertOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
 	if err := mgo.ExecOpWithoutReply(session, &op.InsertOp); err != nil {
 		return nil, err
 	}
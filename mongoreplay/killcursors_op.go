@@ -66,7 +66,6 @@ func (op *KillCursorsOp) FromReader(r io.Reader) error {
 // Execute performs the KillCursorsOp on a given session, yielding the reply
 // when successful (and an error otherwise).
 func (op *KillCursorsOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
 	if err := mgo.ExecOpWithoutReply(session, &op.KillCursorsOp); err != nil {
 		return nil, err
 	}
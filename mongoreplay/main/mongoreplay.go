@@ -11,6 +11,8 @@ const (
 	ExitOk       = 0
 	ExitError    = 1
 	ExitNonFatal = 3
+	// ExitErrorRate means ops failed more often than a --maxErrorRate allows
+	ExitErrorRate = 4
 	// Go reserves exit code 2 for its own use
 )
 
@@ -37,6 +39,24 @@ func main() {
 		panic(err)
 	}
 
+	_, err = parser.AddCommand("diff", "Compare the mix of ops in two playback files", "",
+		&mongoreplay.DiffCommand{GlobalOpts: &opts})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = parser.AddCommand("estimate", "Estimate the throughput and concurrency needed to replay a playback file at its recorded pace", "",
+		&mongoreplay.EstimateCommand{GlobalOpts: &opts})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = parser.AddCommand("merge", "Merge playback files, such as the shards of a recording, into one in the order their ops were seen", "",
+		&mongoreplay.MergeCommand{GlobalOpts: &opts})
+	if err != nil {
+		panic(err)
+	}
+
 	parser.Options = flags.IgnoreUnknown
 	parser.Parse()
 	if opts.PrintVersion() {
@@ -50,6 +70,8 @@ func main() {
 		switch err.(type) {
 		case mongoreplay.ErrPacketsDropped:
 			os.Exit(ExitNonFatal)
+		case mongoreplay.ErrErrorRateExceeded:
+			os.Exit(ExitErrorRate)
 		default:
 			os.Exit(ExitError)
 		}
@@ -83,6 +83,7 @@ var goodOpCode = map[int32]bool{
 	2010: true, //OP_COMMAND        A new wire protocol message representing a command request
 	2011: true, //OP_COMMANDREPLY   A new wire protocol message representing a command
 	2012: true, //OP_COMPRESSED     Compressed op
+	2013: true, //OP_MSG            Extensible message format
 }
 
 // LooksReal does a best efffort to detect if a MsgHeadr is not invalid
@@ -101,6 +102,14 @@ func (m *MsgHeader) LooksReal() bool {
 	return goodOpCode[int32(m.OpCode)]
 }
 
+// tooLarge returns whether the MsgHeader would look real if it weren't for
+// its length, which is greater than MaxMessageSize, so that a message the
+// server would reject can be reported rather than silently dropped.
+func (m *MsgHeader) tooLarge() bool {
+	return m.MessageLength > MaxMessageSize && m.RequestID >= 0 && m.ResponseTo >= 0 &&
+		goodOpCode[int32(m.OpCode)]
+}
+
 // String returns a string representation of the message header.
 // Useful for debugging.
 func (m *MsgHeader) String() string {
@@ -0,0 +1,103 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// maxBSONObjectSize is the largest document a server accepts.
+const maxBSONObjectSize = 16 * 1024 * 1024
+
+// nearMaxSizeDoc returns a document just under the largest the server
+// accepts.
+func nearMaxSizeDoc(t *testing.T) bson.D {
+	doc := bson.D{{"_id", 1}, {"payload", ""}}
+	overhead, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc[1].Value = strings.Repeat("x", maxBSONObjectSize-len(overhead)-16)
+	return doc
+}
+
+func TestNearMaxSizeInsertRoundTrip(t *testing.T) {
+	doc := nearMaxSizeDoc(t)
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsert([]interface{}{doc}); err != nil {
+		t.Fatal(err)
+	}
+	ops := generatedOps(generator)
+	if len(ops) != 1 || int(ops[0].Header.MessageLength) != len(ops[0].Body) {
+		t.Fatalf("expected one whole recorded insert, got %v ops", len(ops))
+	}
+	if ops[0].Header.MessageLength <= maxBSONObjectSize-MsgHeaderLen {
+		t.Fatalf("expected the insert to be near the maximum size, got %v bytes", ops[0].Header.MessageLength)
+	}
+
+	// write the op to a tape and read it back
+	bsonBytes, err := bson.Marshal(ops[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &PlaybackFileReader{bytes.NewReader(bsonBytes)}
+	recordedOp, err := reader.NextRecordedOp()
+	if err != nil {
+		t.Fatalf("error reading near maximum size op from tape: %v", err)
+	}
+	parsedOp, err := recordedOp.Parse()
+	if err != nil {
+		t.Fatalf("error parsing near maximum size op: %v", err)
+	}
+	insertOp, ok := parsedOp.(*InsertOp)
+	if !ok || len(insertOp.Documents) != 1 {
+		t.Fatalf("expected an insert of one document, got %#v", parsedOp)
+	}
+	expected, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := bson.Marshal(insertOp.Documents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected the inserted document of %v bytes to be intact, got %v bytes", len(expected), len(actual))
+	}
+}
+
+func TestTruncatedInsert(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsert([]interface{}{bson.D{{"_id", 1}, {"payload", strings.Repeat("x", 1000)}}}); err != nil {
+		t.Fatal(err)
+	}
+	op := generatedOps(generator)[0]
+	op.Body = op.Body[:len(op.Body)-100]
+	if _, err := op.Parse(); err == nil {
+		t.Errorf("expected an error parsing a truncated insert")
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	tooLarge := MsgHeader{MessageLength: MaxMessageSize + 1, RequestID: 1, OpCode: OpCodeInsert}
+	if tooLarge.LooksReal() || !tooLarge.tooLarge() {
+		t.Errorf("expected a message of %v bytes to be too large", tooLarge.MessageLength)
+	}
+	largest := MsgHeader{MessageLength: MaxMessageSize, RequestID: 1, OpCode: OpCodeInsert}
+	if !largest.LooksReal() || largest.tooLarge() {
+		t.Errorf("expected a message of %v bytes not to be too large", largest.MessageLength)
+	}
+	garbage := MsgHeader{MessageLength: MaxMessageSize + 1, RequestID: 1, OpCode: 1234}
+	if garbage.tooLarge() {
+		t.Errorf("expected a header with an unknown opcode not to be reported as too large")
+	}
+
+	sizeRaw := make([]byte, 4)
+	SetInt32(sizeRaw, 0, maximumDocumentSize+1)
+	_, err := ReadDocument(bytes.NewReader(sizeRaw))
+	if err == nil || !strings.Contains(err.Error(), "greater than the maximum") {
+		t.Errorf("expected an error reading a document that is too large, got %v", err)
+	}
+}
@@ -10,13 +10,41 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 )
 
+// defaultSnapLen is the snapshot length used when capturing from a live
+// interface if none is given. It is the largest that libpcap allows, which
+// covers the largest packets produced by segmentation offload.
+const defaultSnapLen = 262144
+
 // OpStreamSettings stores settings for any command which may listen to an
 // opstream.
+//
+// SnapLen limits how many bytes of each packet are captured from a live
+// interface, not the size of a MongoDB message: messages that span several
+// packets are reassembled from them, so SnapLen only needs to cover a single
+// packet. A packet truncated by a smaller SnapLen leaves a gap in its stream,
+// and the op it belongs to can't be reassembled and is dropped.
 type OpStreamSettings struct {
-	PcapFile         string `short:"f" description:"path to the pcap file to be read"`
+	PcapFile         string `short:"f" description:"path to the pcap or pcapng file to be read"`
 	PacketBufSize    int    `short:"b" description:"Size of heap used to merge separate streams together"`
+	SnapLen          int    `long:"snaplen" description:"number of bytes to capture from each packet on a live interface (defaults to 262144)"`
 	Expression       string `short:"e" long:"expr" description:"BPF filter expression to apply to packets"`
 	NetworkInterface string `short:"i" description:"network interface to listen on"`
+	MaxOps           int    `long:"limit" description:"stop recording after this many requests have been written, not counting their replies, once any open cursors have been exhausted or twice as many requests have been seen (0 means no limit)"`
+}
+
+// validate checks that the buffer and capture sizes are usable, and fills in
+// the default snapshot length.
+func (settings *OpStreamSettings) validate() error {
+	switch {
+	case settings.PacketBufSize < 0:
+		return fmt.Errorf("Invalid setting for -b: '%v', value must be >=1", settings.PacketBufSize)
+	case settings.SnapLen < 0:
+		return fmt.Errorf("Invalid setting for --snaplen: '%v', value must be >=1", settings.SnapLen)
+	}
+	if settings.SnapLen == 0 {
+		settings.SnapLen = defaultSnapLen
+	}
+	return nil
 }
 
 // tcpassembly.Stream implementation.
@@ -29,6 +57,16 @@ type stream struct {
 	opTimeStamp      time.Time
 	state            streamState
 	netFlow, tcpFlow gopacket.Flow
+
+	// atStart is whether the stream was seen from the start of its
+	// connection and its first message hasn't been read yet, so that data
+	// that doesn't start with a valid header can't be MongoDB traffic
+	atStart bool
+
+	// resynced is whether the stream has just synchronized on what looks like
+	// a header after losing its place, so that the message read next must
+	// parse to be kept
+	resynced bool
 }
 
 // Reassembled receives the new slice of reassembled data and forwards it to the
@@ -65,6 +103,10 @@ type bidi struct {
 	responseStream   bool
 	sawStart         bool
 	connectionNumber int64
+
+	// notMongo is whether the connection was found not to carry MongoDB
+	// traffic, so that the rest of its data is discarded
+	notMongo bool
 }
 
 func newBidi(netFlow, tcpFlow gopacket.Flow, opStream *MongoOpStream, num int64) *bidi {
@@ -122,6 +164,12 @@ type MongoOpStream struct {
 	bidiMap           map[bidiKey]*bidi
 	connectionCounter chan int64
 	connectionNumber  int64
+
+	// skippedConnections and skippedMessages count the connections and
+	// messages skipped because they weren't MongoDB traffic, and are only
+	// accessed atomically
+	skippedConnections int64
+	skippedMessages    int64
 }
 
 // NewMongoOpStream initializes a new MongoOpStream
@@ -170,6 +218,12 @@ func (os *MongoOpStream) Close() error {
 	return nil
 }
 
+// skippedNonMongo returns the numbers of connections and messages skipped
+// because they weren't MongoDB traffic.
+func (os *MongoOpStream) skippedNonMongo() (connections, messages int64) {
+	return atomic.LoadInt64(&os.skippedConnections), atomic.LoadInt64(&os.skippedMessages)
+}
+
 // SetFirstSeen sets the time for the first message on the MongoOpStream.
 // All of this SetFirstSeen/FirstSeen/SetFirstseer stuff can go away ( from here
 // and from packet_handler.go ) it's a cruft and was how someone was trying to
@@ -238,10 +292,19 @@ func (bidi *bidi) handleStreamStateBeforeMessage(stream *stream) {
 		return
 	}
 	stream.op.Header.FromWire(stream.reassembly.Bytes)
+	if stream.op.Header.tooLarge() {
+		bidi.logvf(Always, "skipping %v message of %v bytes, which is greater than the maximum message size, %v bytes",
+			stream.op.Header.OpCode, stream.op.Header.MessageLength, MaxMessageSize)
+	}
+	atStart := stream.atStart
+	stream.atStart = false
 	if !stream.op.Header.LooksReal() {
-		// When we're here and stream.reassembly.Start is true we may be able to
-		// know that we're actually not looking at mongodb traffic and that this
-		// whole stream should be discarded.
+		if atStart && !stream.op.Header.tooLarge() {
+			// the first message of a connection seen from its start is
+			// always whole, so this connection isn't MongoDB traffic
+			bidi.skipNonMongo(stream)
+			return
+		}
 		bidi.logvf(DebugLow, "not a good header %#v", stream.op.Header)
 		bidi.logvf(Info, "Expected to, but didn't see a valid protocol message")
 		stream.state = streamStateOutOfSync
@@ -270,8 +333,18 @@ func (bidi *bidi) handleStreamStateInMessage(stream *stream) {
 	}
 	stream.reassembly.Bytes = stream.reassembly.Bytes[copySize:]
 	if len(stream.op.Body) == int(stream.op.Header.MessageLength) {
-		// TODO maybe remember if we were recently in streamStateOutOfSync,
-		// and if so, parse the raw op here.
+		if stream.resynced {
+			// a header found after losing sync may be chance bytes of some
+			// other traffic, so the message must parse to be kept
+			stream.resynced = false
+			if _, err := stream.op.Parse(); err != nil {
+				bidi.logvf(Info, "skipping %v message that doesn't parse after synchronizing: %v", stream.op.Header.OpCode, err)
+				atomic.AddInt64(&bidi.opStream.skippedMessages, 1)
+				stream.op = &RawOp{}
+				stream.state = streamStateOutOfSync
+				return
+			}
+		}
 
 		bidi.opStream.unorderedOps <- RecordedOp{
 			RawOp:             *stream.op,
@@ -300,6 +373,7 @@ func (bidi *bidi) handleStreamStateOutOfSync(stream *stream) {
 	bidi.logvf(DebugHigh, "possible message header %#v", stream.op.Header)
 	if stream.op.Header.LooksReal() {
 		stream.state = streamStateBeforeMessage
+		stream.resynced = true
 		bidi.logvf(DebugLow, "synchronized")
 		return
 	}
@@ -307,6 +381,31 @@ func (bidi *bidi) handleStreamStateOutOfSync(stream *stream) {
 	return
 }
 
+// skipNonMongo discards the rest of the data of a connection that was found
+// not to carry MongoDB traffic.
+func (bidi *bidi) skipNonMongo(stream *stream) {
+	bidi.logvf(Info, "skipping connection from %v, which doesn't look like MongoDB traffic", stream.netFlow.Src())
+	bidi.notMongo = true
+	atomic.AddInt64(&bidi.opStream.skippedConnections, 1)
+	stream.reassembly.Bytes = stream.reassembly.Bytes[:0]
+	for _, s := range bidi.streams {
+		s.op = &RawOp{}
+		s.state = streamStateBeforeMessage
+	}
+}
+
+// handleStreamEnd is called when a FIN or RST ends the stream. The whole
+// messages seen before it have already been sent on, so only a message cut
+// short by it is left, which is dropped.
+func (bidi *bidi) handleStreamEnd(stream *stream) {
+	if stream.state == streamStateInMessage {
+		bidi.logvf(Always, "warning: connection ended in the middle of a %v message from %v, dropping the %v of its %v bytes that were seen",
+			stream.op.Header.OpCode, stream.netFlow.Src(), len(stream.op.Body), stream.op.Header.MessageLength)
+	}
+	stream.op = &RawOp{}
+	stream.state = streamStateBeforeMessage
+}
+
 // streamOps reads tcpassembly.Reassembly[] blocks from the
 // stream's and tries to create whole protocol messages from them.
 func (bidi *bidi) streamOps() {
@@ -327,6 +426,12 @@ func (bidi *bidi) streamOps() {
 		stream := bidi.streams[reassembliesStream]
 
 		for _, stream.reassembly = range reassemblies {
+			if bidi.notMongo {
+				continue
+			}
+			if stream.reassembly.Start {
+				stream.atStart = true
+			}
 			// Skip > 0 means that we've missed something, and we have
 			// incomplete packets in hand.
 			if stream.reassembly.Skip > 0 {
@@ -345,7 +450,7 @@ func (bidi *bidi) streamOps() {
 				stream.state = streamStateOutOfSync
 			}
 
-			for len(stream.reassembly.Bytes) > 0 {
+			for len(stream.reassembly.Bytes) > 0 && !bidi.notMongo {
 				bidi.logvf(DebugHigh, "Connection %v: state '%v'", bidi.connectionNumber, stream.state)
 				switch stream.state {
 				case streamStateBeforeMessage:
@@ -356,6 +461,9 @@ func (bidi *bidi) streamOps() {
 					bidi.handleStreamStateOutOfSync(stream)
 				}
 			}
+			if stream.reassembly.End {
+				bidi.handleStreamEnd(stream)
+			}
 		}
 		// inform the tcpassembly that we've finished with the reassemblies.
 		stream.done <- nil
@@ -77,8 +77,10 @@ func (gen *RegularStatGenerator) ResolveOp(recordedReply *RecordedOp, reply Repl
 		result = replyStat
 	}
 	result.Errors = reply.getErrors()
+	result.WriteErrors = reply.getWriteErrors()
 	result.NumReturned = reply.getNumReturned()
 	result.ReplyData = replyStat.ReplyData
+	result.ReplyBytes = replyStat.ReplyBytes
 	result.LatencyMicros = int64(replyStat.Seen.Sub(*originalOpInfo.Stat.Seen) / (time.Microsecond))
 	delete(gen.UnresolvedOps, key)
 
@@ -175,6 +177,9 @@ func (monitor *MonitorCommand) ValidateParams(args []string) error {
 	case numInputTypes > 1:
 		return fmt.Errorf("must not specify more than one input")
 	}
+	if err := monitor.OpStreamSettings.validate(); err != nil {
+		return err
+	}
 
 	if monitor.OpStreamSettings.PacketBufSize == 0 {
 		// default heap size
@@ -0,0 +1,78 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// msgFlagChecksumPresent is the OP_MSG flag bit saying that the message
+	// ends in a CRC-32C checksum of the rest of it.
+	msgFlagChecksumPresent = 1 << 0
+
+	// msgFlagMoreToCome is the OP_MSG flag bit saying that the sender
+	// doesn't await a reply to the message.
+	msgFlagMoreToCome = 1 << 1
+
+	// msgChecksumLen is the length of an OP_MSG checksum.
+	msgChecksumLen = 4
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// msgChecksum returns the checksum of an OP_MSG, which covers every byte of
+// the message before it.
+func msgChecksum(msg []byte) uint32 {
+	return crc32.Checksum(msg, castagnoliTable)
+}
+
+// msgFlags returns the flag bits of an OP_MSG, and whether the op is a whole
+// OP_MSG with flag bits to read.
+func (op *RawOp) msgFlags() (uint32, bool) {
+	if op.Header.OpCode != OpCodeMsg || len(op.Body) < MsgHeaderLen+4 ||
+		len(op.Body) != int(op.Header.MessageLength) {
+		return 0, false
+	}
+	return uint32(getInt32(op.Body, MsgHeaderLen)), true
+}
+
+// hasChecksum returns whether the op is an OP_MSG that carries a checksum.
+func (op *RawOp) hasChecksum() bool {
+	flags, ok := op.msgFlags()
+	return ok && flags&msgFlagChecksumPresent != 0
+}
+
+// moreToCome returns whether the op is an OP_MSG sent without awaiting a
+// reply.
+func (op *RawOp) moreToCome() bool {
+	flags, ok := op.msgFlags()
+	return ok && flags&msgFlagMoreToCome != 0
+}
+
+// validateChecksum checks that the checksum of an OP_MSG that carries one
+// matches its contents. Other ops are always valid.
+func (op *RawOp) validateChecksum() error {
+	if !op.hasChecksum() {
+		return nil
+	}
+	if len(op.Body) < MsgHeaderLen+4+msgChecksumLen {
+		return fmt.Errorf("OP_MSG of %v bytes is too short to hold a checksum", len(op.Body))
+	}
+	end := len(op.Body) - msgChecksumLen
+	expected := msgChecksum(op.Body[:end])
+	if actual := uint32(getInt32(op.Body, end)); actual != expected {
+		return fmt.Errorf("OP_MSG checksum %08x doesn't match its contents, which have checksum %08x", actual, expected)
+	}
+	return nil
+}
+
+// addChecksum has an OP_MSG sent ending in a checksum. Other ops are left as
+// they are.
+func addChecksum(op Op) {
+	switch castOp := op.(type) {
+	case *MsgOp:
+		castOp.Flags |= msgFlagChecksumPresent
+	case *MsgGetMore:
+		castOp.Flags |= msgFlagChecksumPresent
+	}
+}
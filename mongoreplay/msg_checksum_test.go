@@ -0,0 +1,132 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// opMsg builds an OP_MSG with a single body section holding the document,
+// ending in a checksum if asked.
+func opMsg(t *testing.T, doc bson.D, checksum bool) *RawOp {
+	docBytes, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags int32
+	if checksum {
+		flags = msgFlagChecksumPresent
+	}
+	body := make([]byte, MsgHeaderLen+4, MsgHeaderLen+4+1+len(docBytes)+msgChecksumLen)
+	SetInt32(body, MsgHeaderLen, flags)
+	body = append(body, 0)
+	body = append(body, docBytes...)
+	if checksum {
+		body = append(body, make([]byte, msgChecksumLen)...)
+	}
+	op := &RawOp{Header: MsgHeader{MessageLength: int32(len(body)), RequestID: 1, OpCode: OpCodeMsg}, Body: body}
+	copy(op.Body, op.Header.ToWire())
+	if checksum {
+		end := len(body) - msgChecksumLen
+		SetInt32(body, end, int32(msgChecksum(body[:end])))
+	}
+	return op
+}
+
+func TestValidateChecksum(t *testing.T) {
+	doc := bson.D{{"ping", 1}, {"$db", "admin"}}
+
+	op := opMsg(t, doc, true)
+	if !op.hasChecksum() {
+		t.Fatalf("expected the op to carry a checksum")
+	}
+	if err := op.validateChecksum(); err != nil {
+		t.Errorf("expected a valid checksum, got %v", err)
+	}
+	op.Body[MsgHeaderLen+8] ^= 0xff
+	if err := op.validateChecksum(); err == nil {
+		t.Errorf("expected an error validating the checksum of a corrupted op")
+	}
+
+	op = opMsg(t, doc, false)
+	if op.hasChecksum() {
+		t.Errorf("expected the op not to carry a checksum")
+	}
+	op.Body[MsgHeaderLen+8] ^= 0xff
+	if err := op.validateChecksum(); err != nil {
+		t.Errorf("expected an op without a checksum to be valid, got %v", err)
+	}
+
+	// ops that were cut short, such as shortened replies, can't be checked
+	op = opMsg(t, doc, true)
+	op.Body = op.Body[:len(op.Body)-2]
+	if op.hasChecksum() {
+		t.Errorf("expected a truncated op not to be checked")
+	}
+}
+
+func TestRecordChecksums(t *testing.T) {
+	// the fixture holds a ping with a valid checksum, a reply to it corrupted
+	// after its checksum was computed, a ping without a checksum and a valid
+	// reply to it
+	ops := recordedOpsFromPcap(t, "checksummed_op_msg.pcap")
+	if len(ops) != 4 {
+		t.Fatalf("expected 4 ops to be recorded, got %v", len(ops))
+	}
+	for i, expected := range []bool{false, true, false, false} {
+		if ops[i].Header.OpCode != OpCodeMsg {
+			t.Errorf("expected op %v to be an OP_MSG, got %v", i, ops[i].Header.OpCode)
+		}
+		if ops[i].ChecksumMismatch != expected {
+			t.Errorf("expected op %v to be flagged as corrupt: %v, got %v", i, expected, ops[i].ChecksumMismatch)
+		}
+	}
+}
+
+func TestPlayChecksums(t *testing.T) {
+	server := newMsgServer(t)
+	defer server.listener.Close()
+
+	// play plays a find, recorded with a checksum or not, returning the
+	// OP_MSG the server received
+	play := func(recordedChecksum, checksumFlag bool) *RawOp {
+		context := NewExecutionContext(&StatCollector{noop: true})
+		context.Checksum = checksumFlag
+		session, err := context.dial("mongodb://" + server.listener.Addr().String() + "/?connect=direct")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		op := &RecordedOp{RawOp: *opMsg(t, bson.D{{"find", "coll"}, {"$db", "mongoreplay"}}, recordedChecksum)}
+		if _, _, err := context.Execute(op, session); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-server.received:
+			return <-server.raw
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the find")
+		}
+		return nil
+	}
+
+	// a checksum is computed afresh for the request id the op is played with
+	for _, test := range []struct {
+		recordedChecksum, checksumFlag, expected bool
+	}{
+		{true, false, true},
+		{false, true, true},
+		{false, false, false},
+	} {
+		raw := play(test.recordedChecksum, test.checksumFlag)
+		if raw.hasChecksum() != test.expected {
+			t.Errorf("recorded with a checksum: %v, played with --checksum: %v: expected a checksum to be sent: %v",
+				test.recordedChecksum, test.checksumFlag, test.expected)
+		}
+		if err := raw.validateChecksum(); err != nil {
+			t.Errorf("recorded with a checksum: %v, played with --checksum: %v: %v",
+				test.recordedChecksum, test.checksumFlag, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgCarrierDatabase is the database of the OP_COMMANDs that carry OP_MSGs
+// through the driver, which no real database can be named, as database names
+// can't hold a $.
+const msgCarrierDatabase = "$mongoreplay"
+
+// msgCarrierCommand is the name of the command of an OP_MSG carrier.
+const msgCarrierCommand = "opMsg"
+
+// newMsgCarrier returns the OP_COMMAND that carries an OP_MSG through the
+// driver, given the bytes of the OP_MSG after its header. The msgConn of the
+// connection sends the OP_MSG in its place.
+func newMsgCarrier(msg []byte) *mgo.CommandOp {
+	return &mgo.CommandOp{
+		Database:    msgCarrierDatabase,
+		CommandName: msgCarrierCommand,
+		CommandArgs: bson.D{{Name: "msg", Value: msg}},
+		Metadata:    bson.D{},
+	}
+}
+
+// msgConn is a connection to the target through which OP_MSGs are played,
+// although the driver only speaks the legacy op codes and OP_COMMAND. Each
+// OP_MSG carrier the driver writes is sent as the OP_MSG it carries, with the
+// request id the driver gave it and, if its flag is set, a checksum computed
+// for it. The OP_MSGs read back are handed to the driver as OP_COMMANDREPLYs
+// of the document of their body section, and compressed messages are handed
+// to it decompressed.
+type msgConn struct {
+	net.Conn
+
+	// in holds the bytes read from the target that don't yet make up a
+	// whole message, and out those of the messages not yet read by the
+	// driver
+	in  []byte
+	out []byte
+	buf []byte
+}
+
+func newMsgConn(conn net.Conn) *msgConn {
+	return &msgConn{Conn: conn, buf: make([]byte, 32*1024)}
+}
+
+// Write sends the messages in p, which the driver writes whole, sending the
+// OP_MSG of each carrier in its place.
+func (c *msgConn) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for rest := p; len(rest) > 0; {
+		if len(rest) < MsgHeaderLen || int(getInt32(rest, 0)) < MsgHeaderLen || int(getInt32(rest, 0)) > len(rest) {
+			// not whole messages; send the rest as it is
+			out = append(out, rest...)
+			break
+		}
+		size := int(getInt32(rest, 0))
+		msg, err := carriedMsg(rest[:size])
+		if err != nil {
+			return 0, err
+		}
+		out = append(out, msg...)
+		rest = rest[size:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// carriedMsg returns the OP_MSG carried by a message, header included, or
+// the message itself if it isn't a carrier.
+func carriedMsg(msg []byte) ([]byte, error) {
+	if OpCode(getInt32(msg, 12)) != OpCodeCommand {
+		return msg, nil
+	}
+	pos := MsgHeaderLen
+	database := readCString(msg[pos:])
+	if database != msgCarrierDatabase {
+		return msg, nil
+	}
+	pos += len(database) + 1
+	pos += len(readCString(msg[pos:])) + 1
+	if pos+4 > len(msg) {
+		return nil, fmt.Errorf("OP_MSG carrier is too short to hold its command")
+	}
+	args := struct {
+		Msg []byte `bson:"msg"`
+	}{}
+	if err := bson.Unmarshal(msg[pos:pos+int(getInt32(msg, pos))], &args); err != nil {
+		return nil, fmt.Errorf("error reading OP_MSG carrier: %v", err)
+	}
+	out := make([]byte, MsgHeaderLen, MsgHeaderLen+len(args.Msg))
+	out = append(out, args.Msg...)
+	SetInt32(out, 0, int32(len(out)))
+	SetInt32(out, 4, getInt32(msg, 4))
+	SetInt32(out, 12, int32(OpCodeMsg))
+	if len(args.Msg) >= 4 && uint32(getInt32(args.Msg, 0))&msgFlagChecksumPresent != 0 {
+		end := len(out) - msgChecksumLen
+		SetInt32(out, end, int32(msgChecksum(out[:end])))
+	}
+	return out, nil
+}
+
+// Read reads the messages from the target, handing OP_MSGs and compressed
+// messages to the driver in the forms it reads.
+func (c *msgConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if len(c.in) >= MsgHeaderLen && len(c.in) >= int(getInt32(c.in, 0)) {
+			size := int(getInt32(c.in, 0))
+			if size < MsgHeaderLen {
+				return 0, fmt.Errorf("message of %v bytes is too short to hold its header", size)
+			}
+			msg, err := driverMessage(c.in[:size])
+			if err != nil {
+				return 0, err
+			}
+			c.out = msg
+			c.in = c.in[size:]
+			continue
+		}
+		n, err := c.Conn.Read(c.buf)
+		c.in = append(c.in, c.buf[:n]...)
+		if err != nil && n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// driverMessage returns a message read from the target in the form the
+// driver reads it: decompressed, and as an OP_COMMANDREPLY if an OP_MSG.
+func driverMessage(msg []byte) ([]byte, error) {
+	if OpCode(getInt32(msg, 12)) == OpCodeCompressed {
+		decompressed, err := decompressMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		msg = decompressed
+	}
+	if OpCode(getInt32(msg, 12)) != OpCodeMsg {
+		// copied, as the bytes it was read into are reused
+		return append([]byte{}, msg...), nil
+	}
+	_, sections, err := readMsgSections(msg[MsgHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range sections {
+		if section.Kind != msgSectionBody {
+			continue
+		}
+		body := section.Body.(*bson.Raw).Data
+		reply := make([]byte, MsgHeaderLen, MsgHeaderLen+len(body)+5)
+		copy(reply, msg[:MsgHeaderLen])
+		// the body, then empty metadata
+		reply = append(append(reply, body...), 5, 0, 0, 0, 0)
+		SetInt32(reply, 0, int32(len(reply)))
+		SetInt32(reply, 12, int32(OpCodeCommandReply))
+		return reply, nil
+	}
+	return nil, fmt.Errorf("OP_MSG has no body section")
+}
@@ -0,0 +1,92 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgCarrierBytes builds the OP_COMMAND the driver sends for the carrier of
+// an OP_MSG, given the bytes of the OP_MSG after its header.
+func msgCarrierBytes(t *testing.T, requestID int32, msg []byte) []byte {
+	carrier := newMsgCarrier(msg)
+	args, err := bson.Marshal(carrier.CommandArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, MsgHeaderLen)
+	out = append(append(out, carrier.Database...), 0)
+	out = append(append(out, carrier.CommandName...), 0)
+	out = append(append(out, args...), 5, 0, 0, 0, 0)
+	copy(out, MsgHeader{MessageLength: int32(len(out)), RequestID: requestID, OpCode: OpCodeCommand}.ToWire())
+	return out
+}
+
+func TestMsgConnWrite(t *testing.T) {
+	conn := &pipeConn{}
+	msgs := newMsgConn(conn)
+
+	// the carrier is sent as its OP_MSG, with a checksum computed for it,
+	// while other messages are sent as they are
+	expected := opMsg(t, bson.D{{"find", "coll"}, {"$db", "mongoreplay"}}, true)
+	msg := append([]byte{}, expected.Body[MsgHeaderLen:]...)
+	SetInt32(msg, len(msg)-msgChecksumLen, 0)
+	query := opQuery(t, 2, "admin.$cmd", bson.D{{"isMaster", 1}})
+	p := append(msgCarrierBytes(t, 1, msg), query...)
+	if n, err := msgs.Write(p); err != nil || n != len(p) {
+		t.Fatalf("expected the whole write to be reported, got %v %v", n, err)
+	}
+	sent := conn.written.Bytes()
+	if !bytes.Equal(sent[:len(expected.Body)], expected.Body) {
+		t.Errorf("expected the carrier to be sent as its OP_MSG")
+	}
+	if !bytes.Equal(sent[len(expected.Body):], query) {
+		t.Errorf("expected the query to be sent as it is")
+	}
+}
+
+func TestMsgConnRead(t *testing.T) {
+	conn := &pipeConn{}
+	msgs := newMsgConn(conn)
+
+	// an OP_MSG reply, compressed and with a checksum, and an OP_REPLY
+	doc := bson.D{{"ok", 1}, {"n", 2}}
+	reply := opMsg(t, doc, true)
+	reply.Header.ResponseTo = 7
+	SetInt32(reply.Body, 8, 7)
+	conn.toRead.Write(compressMessage(reply.Body, "zlib"))
+	legacy := opReply(t, 8, bson.D{{"ok", 1}})
+	conn.toRead.Write(legacy)
+
+	// the messages are read back in pieces
+	var read []byte
+	buf := make([]byte, 7)
+	for {
+		n, err := msgs.Read(buf)
+		read = append(read, buf[:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header := MsgHeader{}
+	header.FromWire(read)
+	if header.OpCode != OpCodeCommandReply || header.ResponseTo != 7 {
+		t.Fatalf("expected an OP_COMMANDREPLY to request 7, got %#v", header)
+	}
+	commandReply := bson.D{}
+	if err := bson.Unmarshal(read[MsgHeaderLen:header.MessageLength-5], &commandReply); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(commandReply, doc) {
+		t.Errorf("expected the body of the OP_MSG as the reply, got %v", commandReply)
+	}
+	if !bytes.Equal(read[header.MessageLength:], legacy) {
+		t.Errorf("expected the OP_REPLY to be read as it is")
+	}
+}
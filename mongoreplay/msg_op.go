@@ -0,0 +1,430 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+const (
+	// msgSectionBody is the kind of the OP_MSG section holding the body of
+	// the message, which for a request is its command.
+	msgSectionBody = 0
+
+	// msgSectionSequence is the kind of an OP_MSG section holding a sequence
+	// of documents, such as those inserted by an insert command.
+	msgSectionSequence = 1
+)
+
+// MsgOp is a struct for parsing OP_MSG, in which clients send commands since
+// MongoDB 3.6, as defined here:
+// https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst.
+// The OP_MSGs replying to it are parsed into CommandReplyOps.
+type MsgOp struct {
+	Header   MsgHeader
+	Flags    uint32
+	Sections []MsgSection
+}
+
+// MsgSection is a section of an OP_MSG. A section of kind msgSectionBody holds
+// a single document as its Body, and one of kind msgSectionSequence a sequence
+// of Documents named by its Identifier.
+type MsgSection struct {
+	Kind       uint8
+	Body       interface{}
+	Identifier string
+	Documents  []interface{}
+}
+
+// MsgGetMore is a struct representing a special case of an OP_MSG whose
+// command is 'getMore'. It implements the cursorsRewriteable interface.
+type MsgGetMore struct {
+	MsgOp
+	cachedCursor *int64
+}
+
+// OpCode returns the OpCode for a MsgOp.
+func (op *MsgOp) OpCode() OpCode {
+	return OpCodeMsg
+}
+
+// moreToCome returns whether the op was sent without awaiting a reply.
+func (op *MsgOp) moreToCome() bool {
+	return op.Flags&msgFlagMoreToCome != 0
+}
+
+// body returns the document of the body section of the op, which holds its
+// command.
+func (op *MsgOp) body() (bson.D, error) {
+	for _, section := range op.Sections {
+		if section.Kind != msgSectionBody {
+			continue
+		}
+		doc := bson.D{}
+		switch t := section.Body.(type) {
+		case *bson.Raw:
+			if err := t.Unmarshal(&doc); err != nil {
+				return nil, err
+			}
+		case *bson.D:
+			doc = *t
+		default:
+			panic("not a *bson.D or *bson.Raw")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("OP_MSG has no body section")
+}
+
+// setBody replaces the document of the body section of the op.
+func (op *MsgOp) setBody(doc bson.D) {
+	for i := range op.Sections {
+		if op.Sections[i].Kind == msgSectionBody {
+			// getMore cursors are rewritten in place, which needs a *bson.D
+			op.Sections[i].Body = &doc
+			return
+		}
+	}
+}
+
+// editBody replaces the document of the body section of the op with the one
+// edit returns for it.
+func (op *MsgOp) editBody(edit func(bson.D) (bson.D, error)) error {
+	doc, err := op.body()
+	if err != nil {
+		return err
+	}
+	if doc, err = edit(doc); err != nil {
+		return err
+	}
+	op.setBody(doc)
+	return nil
+}
+
+// foldSequences moves the documents of each document sequence section of the
+// op into the array field of its body that the section stands for, which the
+// server takes the same, so that the whole command can be edited in the body.
+func (op *MsgOp) foldSequences() error {
+	doc, err := op.body()
+	if err != nil {
+		return err
+	}
+	for _, section := range op.Sections {
+		if section.Kind == msgSectionSequence {
+			doc = append(doc, bson.DocElem{Name: section.Identifier, Value: section.Documents})
+		}
+	}
+	op.Sections = []MsgSection{{Kind: msgSectionBody, Body: &doc}}
+	return nil
+}
+
+// commandName returns the name of the command of the op, which is the first
+// field of its body.
+func (op *MsgOp) commandName() string {
+	doc, err := op.body()
+	if err != nil || len(doc) == 0 {
+		return ""
+	}
+	return doc[0].Name
+}
+
+// database returns the database the command of the op runs on.
+func (op *MsgOp) database() string {
+	doc, err := op.body()
+	if err != nil {
+		return ""
+	}
+	db, _ := FindValueByKey("$db", &doc)
+	name, _ := db.(string)
+	return name
+}
+
+func (op *MsgOp) String() string {
+	bodyString, sequencesString, err := op.getOpBodyString()
+	if err != nil {
+		return fmt.Sprintf("%v", err)
+	}
+	return fmt.Sprintf("OpMsg %v %v %v", op.Flags, bodyString, sequencesString)
+}
+
+// Meta returns metadata about the operation, useful for analysis of traffic.
+func (op *MsgOp) Meta() OpMetadata {
+	var body interface{}
+	sequences := map[string]interface{}{}
+	for _, section := range op.Sections {
+		if section.Kind == msgSectionBody {
+			body = section.Body
+		} else {
+			sequences[section.Identifier] = section.Documents
+		}
+	}
+	return OpMetadata{"op_msg",
+		op.database(),
+		op.commandName(),
+		map[string]interface{}{
+			"flags":     op.Flags,
+			"body":      body,
+			"sequences": sequences,
+		},
+	}
+}
+
+// Abbreviated returns a serialization of the MsgOp, abbreviated so it doesn't
+// exceed the given number of characters.
+func (op *MsgOp) Abbreviated(chars int) string {
+	bodyString, sequencesString, err := op.getOpBodyString()
+	if err != nil {
+		return fmt.Sprintf("%v", err)
+	}
+	return fmt.Sprintf("OpMsg flags:%v body:%v sequences:%v", op.Flags,
+		Abbreviate(bodyString, chars), Abbreviate(sequencesString, chars))
+}
+
+func (op *MsgOp) getOpBodyString() (string, string, error) {
+	meta := op.Meta().Data.(map[string]interface{})
+	bodyDoc, err := ConvertBSONValueToJSON(meta["body"])
+	if err != nil {
+		return "", "", fmt.Errorf("ConvertBSONValueToJSON err: %#v - %v", op, err)
+	}
+	bodyAsJSON, err := json.Marshal(bodyDoc)
+	if err != nil {
+		return "", "", fmt.Errorf("json marshal err: %#v - %v", op, err)
+	}
+
+	var sequencesString string
+	if sequences := meta["sequences"].(map[string]interface{}); len(sequences) != 0 {
+		sequencesDoc, err := ConvertBSONValueToJSON(sequences)
+		if err != nil {
+			return "", "", fmt.Errorf("ConvertBSONValueToJSON err: %#v - %v", op, err)
+		}
+		sequencesAsJSON, err := json.Marshal(sequencesDoc)
+		if err != nil {
+			return "", "", fmt.Errorf("json marshal err: %#v - %v", op, err)
+		}
+		sequencesString = string(sequencesAsJSON)
+	}
+	return string(bodyAsJSON), sequencesString, nil
+}
+
+// FromReader extracts data from a serialized MsgOp into its concrete
+// structure. A checksum the op carries isn't kept, but its flag is, so that the
+// op is played with a checksum computed for it as it is sent.
+func (op *MsgOp) FromReader(r io.Reader) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	op.Flags, op.Sections, err = readMsgSections(msg)
+	return err
+}
+
+// readMsgSections reads the flags and the sections of an OP_MSG from the
+// bytes of the message after its header, leaving out any checksum.
+func readMsgSections(msg []byte) (uint32, []MsgSection, error) {
+	if len(msg) < 4 {
+		return 0, nil, fmt.Errorf("OP_MSG of %v bytes is too short to hold its flags", len(msg)+MsgHeaderLen)
+	}
+	flags := uint32(getInt32(msg, 0))
+	end := len(msg)
+	if flags&msgFlagChecksumPresent != 0 {
+		end -= msgChecksumLen
+	}
+	var sections []MsgSection
+	// both kinds of section start with their size after the kind byte
+	for pos := 4; pos < end; {
+		section := MsgSection{Kind: msg[pos]}
+		pos++
+		if pos+4 > end {
+			return 0, nil, fmt.Errorf("OP_MSG section overruns the message")
+		}
+		size := int(getInt32(msg, pos))
+		if size < 5 || pos+size > end {
+			return 0, nil, fmt.Errorf("OP_MSG section of %v bytes overruns the message", size)
+		}
+		switch section.Kind {
+		case msgSectionBody:
+			body := &bson.Raw{}
+			if err := bson.Unmarshal(msg[pos:pos+size], body); err != nil {
+				return 0, nil, err
+			}
+			section.Body = body
+		case msgSectionSequence:
+			r := bytes.NewReader(msg[pos+4 : pos+size])
+			identifier, err := readCStringFromReader(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			section.Identifier = string(identifier)
+			for r.Len() > 0 {
+				docAsSlice, err := ReadDocument(r)
+				if err != nil {
+					return 0, nil, err
+				}
+				doc := &bson.Raw{}
+				if err := bson.Unmarshal(docAsSlice, doc); err != nil {
+					return 0, nil, err
+				}
+				section.Documents = append(section.Documents, doc)
+			}
+		default:
+			return 0, nil, fmt.Errorf("unknown OP_MSG section kind %v", section.Kind)
+		}
+		sections = append(sections, section)
+		pos += size
+	}
+	return flags, sections, nil
+}
+
+// newMsgReplyOp returns the CommandReplyOp for an OP_MSG reply, given the
+// document of its body section. The documents of the batch of a cursor the
+// reply returns are its Docs.
+func newMsgReplyOp(header MsgHeader, body []byte) (*CommandReplyOp, error) {
+	reply := &CommandReplyOp{Header: header}
+	commandReply := &bson.Raw{}
+	if err := bson.Unmarshal(body, commandReply); err != nil {
+		return nil, err
+	}
+	reply.CommandReply = commandReply
+	docs, err := cursorBatch(commandReply)
+	if err != nil {
+		return nil, err
+	}
+	reply.Docs = docs
+	return reply, nil
+}
+
+// parseMsgReply parses an OP_MSG reply from the bytes of the message after its
+// header.
+func parseMsgReply(header MsgHeader, msg []byte) (*CommandReplyOp, error) {
+	_, sections, err := readMsgSections(msg)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range sections {
+		if section.Kind == msgSectionBody {
+			return newMsgReplyOp(header, section.Body.(*bson.Raw).Data)
+		}
+	}
+	return nil, fmt.Errorf("OP_MSG has no body section")
+}
+
+// toWire returns the bytes of the op after its header: its flags, its
+// sections and, if its flag is set, room for its checksum, which covers its
+// request id and so is only computed as it is sent.
+func (op *MsgOp) toWire() ([]byte, error) {
+	msg := make([]byte, 4)
+	SetInt32(msg, 0, int32(op.Flags))
+	for _, section := range op.Sections {
+		msg = append(msg, section.Kind)
+		switch section.Kind {
+		case msgSectionBody:
+			doc, err := marshalMsgDocument(section.Body)
+			if err != nil {
+				return nil, err
+			}
+			msg = append(msg, doc...)
+		case msgSectionSequence:
+			start := len(msg)
+			msg = append(msg, 0, 0, 0, 0)
+			msg = append(append(msg, section.Identifier...), 0)
+			for _, value := range section.Documents {
+				doc, err := marshalMsgDocument(value)
+				if err != nil {
+					return nil, err
+				}
+				msg = append(msg, doc...)
+			}
+			SetInt32(msg, start, int32(len(msg)-start))
+		default:
+			return nil, fmt.Errorf("unknown OP_MSG section kind %v", section.Kind)
+		}
+	}
+	if op.Flags&msgFlagChecksumPresent != 0 {
+		msg = append(msg, make([]byte, msgChecksumLen)...)
+	}
+	return msg, nil
+}
+
+// marshalMsgDocument returns the BSON of a document of an OP_MSG section,
+// which is left as it is if it was read as raw BSON.
+func marshalMsgDocument(doc interface{}) ([]byte, error) {
+	if raw, ok := doc.(*bson.Raw); ok {
+		return raw.Data, nil
+	}
+	return bson.Marshal(doc)
+}
+
+// Execute performs the MsgOp on a given session, yielding the reply when
+// successful (and an error otherwise). The driver doesn't speak OP_MSG, so the
+// op is handed to it in a carrier that the msgConn of the session sends as
+// the op. An op recorded with the moreToCome flag is sent without awaiting a
+// reply, as the server sends none, so it yields no reply and no latency.
+func (op *MsgOp) Execute(session *mgo.Session) (Replyable, error) {
+	msg, err := op.toWire()
+	if err != nil {
+		return nil, err
+	}
+	carrier := newMsgCarrier(msg)
+	if op.moreToCome() {
+		return nil, mgo.ExecOpWithoutReply(session, carrier)
+	}
+	before := time.Now()
+	_, commandReply, _, resultReply, err := mgo.ExecOpWithReply(session, carrier)
+	after := time.Now()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := resultReply.(*mgo.CommandReplyOp); !ok {
+		panic("reply from execution was not the correct type")
+	}
+	reply, err := newMsgReplyOp(MsgHeader{}, commandReply)
+	if err != nil {
+		return nil, err
+	}
+	reply.Latency = after.Sub(before)
+	return reply, nil
+}
+
+// getCursorIDs is an implementation of the cursorsRewriteable interface method.
+// It returns the cursor the getMore command asks for.
+func (gmMsg *MsgGetMore) getCursorIDs() ([]int64, error) {
+	if gmMsg.cachedCursor != nil {
+		return []int64{*gmMsg.cachedCursor}, nil
+	}
+	doc, err := gmMsg.body()
+	if err != nil {
+		return []int64{}, err
+	}
+	getmoreID, ok := doc[0].Value.(int64)
+	if !ok {
+		return []int64{}, fmt.Errorf("cursorID is not int64")
+	}
+	gmMsg.cachedCursor = &getmoreID
+	return []int64{getmoreID}, nil
+}
+
+// setCursorIDs is an implementation of the cusorsRewriteable interface method.
+// It takes the one cursor the getMore command asks for instead.
+func (gmMsg *MsgGetMore) setCursorIDs(newCursorIDs []int64) error {
+	if len(newCursorIDs) > 1 {
+		return fmt.Errorf("rewriting getmore command cursorIDs requires 1 id, received: %d", len(newCursorIDs))
+	}
+	var newCursorID int64
+	if len(newCursorIDs) == 1 {
+		newCursorID = newCursorIDs[0]
+	}
+	doc, err := gmMsg.body()
+	if err != nil {
+		return err
+	}
+	doc[0].Value = newCursorID
+	gmMsg.setBody(doc)
+	gmMsg.cachedCursor = &newCursorID
+	return nil
+}
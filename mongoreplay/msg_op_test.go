@@ -0,0 +1,256 @@
+package mongoreplay
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgFixtureOps returns the requests and replies recorded in the OP_MSG
+// fixture, which holds an insert sent with the moreToCome flag, then a find
+// and its reply, all on one connection.
+func msgFixtureOps(t *testing.T) []*RecordedOp {
+	var ops []*RecordedOp
+	for _, op := range recordedOpsFromPcap(t, "op_msg_more_to_come.pcapng") {
+		if !op.EOF {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 ops in the fixture, got %v", len(ops))
+	}
+	return ops
+}
+
+func TestParseMsgOp(t *testing.T) {
+	ops := msgFixtureOps(t)
+
+	insert, err := ops[0].Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertOp, ok := insert.(*MsgOp)
+	if !ok {
+		t.Fatalf("expected the insert to parse into a MsgOp, got %T", insert)
+	}
+	if !insertOp.moreToCome() || !ops[0].RawOp.moreToCome() {
+		t.Errorf("expected the insert to have been sent with moreToCome")
+	}
+	meta := insertOp.Meta()
+	if meta.Op != "op_msg" || meta.Ns != "mongoreplay" || meta.Command != "insert" {
+		t.Errorf("expected the metadata of an insert on mongoreplay, got %#v", meta)
+	}
+	if len(insertOp.Sections) != 2 || insertOp.Sections[1].Identifier != "documents" ||
+		len(insertOp.Sections[1].Documents) != 2 {
+		t.Errorf("expected a body and a sequence of 2 documents, got %#v", insertOp.Sections)
+	}
+	if isReply(ops[0]) || isReply(ops[1]) || !isReply(ops[2]) {
+		t.Errorf("expected only the last op to be a reply")
+	}
+
+	find, err := ops[1].Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findOp, ok := find.(*MsgOp); !ok || findOp.moreToCome() || findOp.commandName() != "find" {
+		t.Errorf("expected a find awaiting a reply, got %#v", find)
+	}
+
+	reply, err := ops[2].Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyOp, ok := reply.(*CommandReplyOp)
+	if !ok {
+		t.Fatalf("expected the reply to parse into a CommandReplyOp, got %T", reply)
+	}
+	if cursorID, err := replyOp.getCursorID(); err != nil || cursorID != 0 {
+		t.Errorf("expected an exhausted cursor, got %v (%v)", cursorID, err)
+	}
+	if replyOp.getNumReturned() != 2 {
+		t.Errorf("expected 2 documents returned, got %v", replyOp.getNumReturned())
+	}
+}
+
+func TestMsgGetMoreCursorIDs(t *testing.T) {
+	getMore := &MsgGetMore{MsgOp: MsgOp{Sections: []MsgSection{{
+		Body: &bson.D{{Name: "getMore", Value: int64(12)}, {Name: "collection", Value: "coll"}},
+	}}}}
+	cursorIDs, err := getMore.getCursorIDs()
+	if err != nil || !reflect.DeepEqual(cursorIDs, []int64{12}) {
+		t.Fatalf("expected cursor 12, got %v (%v)", cursorIDs, err)
+	}
+	if err := getMore.setCursorIDs([]int64{34}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := getMore.body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "getMore", Value: int64(34)}, {Name: "collection", Value: "coll"}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("expected %#v, got %#v", expected, doc)
+	}
+}
+
+// msgServer is a stand-in for a server that answers every OP_QUERY as a
+// primary would the driver's handshake and nonce requests, and every OP_MSG
+// awaiting a reply with a single document. It passes on the OP_MSGs it
+// receives, both parsed and as they were sent.
+type msgServer struct {
+	listener net.Listener
+	received chan *MsgOp
+	raw      chan *RawOp
+}
+
+func newMsgServer(t *testing.T) *msgServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &msgServer{listener: listener, received: make(chan *MsgOp, 10), raw: make(chan *RawOp, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *msgServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header, err := ReadHeader(conn)
+		if err != nil {
+			return
+		}
+		msg := make([]byte, header.MessageLength-MsgHeaderLen)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		var reply []byte
+		switch header.OpCode {
+		case OpCodeQuery:
+			doc, _ := bson.Marshal(bson.D{{Name: "ismaster", Value: true}, {Name: "maxWireVersion", Value: 6},
+				{Name: "nonce", Value: "2375531c32080ae8"}, {Name: "ok", Value: 1}})
+			reply = append(make([]byte, MsgHeaderLen+20), doc...)
+			SetInt32(reply, MsgHeaderLen+16, 1)
+			SetInt32(reply, 12, int32(OpCodeReply))
+		case OpCodeMsg:
+			op := &MsgOp{Header: *header}
+			op.Flags, op.Sections, _ = readMsgSections(msg)
+			server.received <- op
+			server.raw <- &RawOp{Header: *header, Body: append(header.ToWire(), msg...)}
+			if op.moreToCome() {
+				continue
+			}
+			doc, _ := bson.Marshal(bson.D{{Name: "cursor", Value: bson.D{
+				{Name: "firstBatch", Value: []interface{}{bson.D{{Name: "_id", Value: 1}}}},
+				{Name: "id", Value: int64(0)},
+			}}, {Name: "ok", Value: 1}})
+			reply = append(append(make([]byte, MsgHeaderLen+4), msgSectionBody), doc...)
+			SetInt32(reply, 12, int32(OpCodeMsg))
+		default:
+			return
+		}
+		SetInt32(reply, 0, int32(len(reply)))
+		SetInt32(reply, 8, header.RequestID)
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestPlayMsgOpMoreToCome(t *testing.T) {
+	ops := msgFixtureOps(t)
+	server := newMsgServer(t)
+	defer server.listener.Close()
+
+	context := NewExecutionContext(&StatCollector{noop: true})
+	session, err := context.dial("mongodb://" + server.listener.Addr().String() + "/?connect=direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	type result struct {
+		op    Op
+		reply Replyable
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		for _, op := range ops {
+			parsedOp, reply, err := context.Execute(op, session)
+			results <- result{parsedOp, reply, err}
+		}
+	}()
+	next := func() result {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out playing an op")
+		}
+		return result{}
+	}
+
+	// the insert is sent without awaiting a reply, and yields no latency
+	insert := next()
+	if insert.reply != nil {
+		t.Errorf("expected no reply to the insert, got %#v", insert.reply)
+	}
+	stat := (&ComparativeStatGenerator{}).GenerateOpStat(ops[0], insert.op, insert.reply, "")
+	if stat.LatencyMicros != 0 || stat.NumReturned != 0 {
+		t.Errorf("expected no latency or documents returned for the insert, got %v and %v",
+			stat.LatencyMicros, stat.NumReturned)
+	}
+	received := <-server.received
+	if !received.moreToCome() || len(received.Sections) != 2 || len(received.Sections[1].Documents) != 2 {
+		t.Errorf("expected the insert to be sent with moreToCome and its documents, got %#v", received)
+	}
+
+	// the find awaits its reply
+	find := next()
+	if find.reply == nil || find.reply.getNumReturned() != 1 {
+		t.Fatalf("expected a reply returning 1 document to the find, got %#v", find.reply)
+	}
+	if received := <-server.received; received.moreToCome() {
+		t.Errorf("expected the find to await a reply")
+	}
+
+	// the recorded reply isn't sent
+	if reply := next(); reply.reply != nil {
+		t.Errorf("expected nothing played for the recorded reply, got %#v", reply.reply)
+	}
+	select {
+	case op := <-server.received:
+		t.Errorf("expected only 2 ops to be sent, got %#v", op)
+	default:
+	}
+}
+
+func TestCursorTrackerMsgOps(t *testing.T) {
+	ops := msgFixtureOps(t)
+	cursors := newCursorTracker()
+	expected := []int{0, 1, 0}
+	for i, op := range ops {
+		if err := cursors.track(op); err != nil {
+			t.Fatal(err)
+		}
+		if cursors.unfinished() != expected[i] {
+			t.Errorf("expected %v unfinished ops after op %v, got %v", expected[i], i, cursors.unfinished())
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package mongoreplay
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keptDatabases are the databases whose names say nothing about the schema,
+// which are left as they are when namespaces are anonymized.
+var keptDatabases = map[string]bool{
+	"admin":  true,
+	"local":  true,
+	"config": true,
+}
+
+// nsAnonymizer replaces the names of databases and collections with
+// pseudonyms, hashed with a key chosen for each run, so that a name always
+// has the same pseudonym within a run but can't be guessed from it. The
+// pseudonyms of databases start with "db_" and those of collections with
+// "coll_". The $cmd and system collections, and the admin, local and config
+// databases and their collections, keep their names. It is safe for
+// concurrent use.
+type nsAnonymizer struct {
+	key []byte
+
+	// mapFile, if set, is where the map of pseudonyms to names is written
+	mapFile string
+
+	sync.Mutex
+	pseudonyms map[string]string
+	names      map[string]string
+
+	// namespaces holds the pseudonyms of the whole namespaces seen, for
+	// replacing them in error messages
+	namespaces map[string]string
+}
+
+func newNsAnonymizer(mapFile string) (*nsAnonymizer, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error choosing the key to anonymize namespaces with: %v", err)
+	}
+	return &nsAnonymizer{
+		key:        key,
+		mapFile:    mapFile,
+		pseudonyms: map[string]string{},
+		names:      map[string]string{},
+		namespaces: map[string]string{},
+	}, nil
+}
+
+// pseudonym returns the pseudonym of a name, with the given prefix. The
+// caller must hold the lock.
+func (a *nsAnonymizer) pseudonym(prefix, name string) string {
+	if pseudonym, ok := a.pseudonyms[prefix+name]; ok {
+		return pseudonym
+	}
+	hash := sha256.Sum256(append(append([]byte{}, a.key...), prefix+name...))
+	pseudonym := prefix + hex.EncodeToString(hash[:4])
+	// names whose hashes collide are told apart by a suffix
+	for i := 2; a.names[pseudonym] != ""; i++ {
+		pseudonym = fmt.Sprintf("%v%v_%v", prefix, hex.EncodeToString(hash[:4]), i)
+	}
+	a.pseudonyms[prefix+name] = pseudonym
+	a.names[pseudonym] = name
+	return pseudonym
+}
+
+func (a *nsAnonymizer) database(name string) string {
+	if name == "" || keptDatabases[name] {
+		return name
+	}
+	return a.pseudonym("db_", name)
+}
+
+func (a *nsAnonymizer) collection(name string) string {
+	if name == "" || name == "$cmd" || strings.HasPrefix(name, "system.") {
+		return name
+	}
+	return a.pseudonym("coll_", name)
+}
+
+// namespace returns the pseudonym of a namespace, made of the pseudonyms of
+// its database and collection.
+func (a *nsAnonymizer) namespace(ns string) string {
+	if ns == "" {
+		return ns
+	}
+	a.Lock()
+	defer a.Unlock()
+	if pseudonym, ok := a.namespaces[ns]; ok {
+		return pseudonym
+	}
+	parts := strings.SplitN(ns, ".", 2)
+	pseudonym := a.database(parts[0])
+	if len(parts) == 2 && keptDatabases[parts[0]] {
+		pseudonym += "." + parts[1]
+	} else if len(parts) == 2 {
+		pseudonym += "." + a.collection(parts[1])
+	}
+	a.namespaces[ns] = pseudonym
+	return pseudonym
+}
+
+// collectionName returns the pseudonym of a collection name.
+func (a *nsAnonymizer) collectionName(name string) string {
+	a.Lock()
+	defer a.Unlock()
+	return a.collection(name)
+}
+
+// anonymizeStat replaces the namespace of a stat with its pseudonym, and the
+// namespaces seen so far in its errors. The request and reply data, which
+// hold the names of collections in many ways, are left out.
+func (a *nsAnonymizer) anonymizeStat(stat *OpStat) {
+	stat.Ns = a.namespace(stat.Ns)
+	stat.RequestData = nil
+	stat.ReplyData = nil
+	stat.Errors = a.anonymizeErrors(stat.Errors)
+	stat.WriteErrors = a.anonymizeErrors(stat.WriteErrors)
+}
+
+func (a *nsAnonymizer) anonymizeErrors(errs []error) []error {
+	if len(errs) == 0 {
+		return errs
+	}
+	a.Lock()
+	defer a.Unlock()
+	// replace longer namespaces first, so that none is left half replaced
+	// as part of a shorter one
+	namespaces := make([]string, 0, len(a.namespaces))
+	for ns := range a.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Sort(byLengthDesc(namespaces))
+	anonymized := make([]error, len(errs))
+	for i, err := range errs {
+		msg := err.Error()
+		for _, ns := range namespaces {
+			msg = strings.Replace(msg, ns, a.namespaces[ns], -1)
+		}
+		anonymized[i] = errors.New(msg)
+	}
+	return anonymized
+}
+
+type byLengthDesc []string
+
+func (s byLengthDesc) Len() int           { return len(s) }
+func (s byLengthDesc) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLengthDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// writeMap writes the names of the pseudonyms given out to the map file, if
+// there is one, as a JSON object, for de-anonymizing the output later.
+func (a *nsAnonymizer) writeMap() error {
+	if a.mapFile == "" {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	data, err := json.MarshalIndent(a.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(a.mapFile, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing namespace map: %v", err)
+	}
+	return nil
+}
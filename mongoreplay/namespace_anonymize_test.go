@@ -0,0 +1,85 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestNsAnonymizer(t *testing.T) {
+	anonymizer, err := newNsAnonymizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := anonymizer.namespace("shop.users")
+	if users == "shop.users" || !strings.HasPrefix(users, "db_") || !strings.Contains(users, ".coll_") {
+		t.Errorf("expected a pseudonym for the namespace, got %v", users)
+	}
+	if again := anonymizer.namespace("shop.users"); again != users {
+		t.Errorf("expected the same pseudonym for the same namespace, got %v and %v", users, again)
+	}
+	orders := anonymizer.namespace("shop.orders")
+	if orders == users || strings.Split(orders, ".")[0] != strings.Split(users, ".")[0] {
+		t.Errorf("expected collections of the same database to share its pseudonym, got %v and %v", users, orders)
+	}
+	for _, ns := range []string{"admin.$cmd", "local.oplog.rs", "admin.system.users"} {
+		if anonymized := anonymizer.namespace(ns); anonymized != ns {
+			t.Errorf("expected %v to keep its name, got %v", ns, anonymized)
+		}
+	}
+	if cmd := anonymizer.namespace("shop.$cmd"); cmd != strings.Split(users, ".")[0]+".$cmd" {
+		t.Errorf("expected the $cmd collection to keep its name, got %v", cmd)
+	}
+
+	other, err := newNsAnonymizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.namespace("shop.users") == users {
+		t.Errorf("expected a different pseudonym in another run")
+	}
+}
+
+func TestAnonymizeStat(t *testing.T) {
+	mapFile := filepath.Join(os.TempDir(), "mongoreplay_ns_map_test.json")
+	defer os.Remove(mapFile)
+	anonymizer, err := newNsAnonymizer(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := &OpStat{
+		Ns:          "shop.users",
+		RequestData: bson.D{{"find", "users"}},
+		ReplyData:   bson.D{{"ok", 1}},
+		WriteErrors: []error{errors.New("E11000 duplicate key error collection: shop.users index: _id_")},
+	}
+	anonymizer.anonymizeStat(stat)
+	if stat.Ns == "shop.users" || stat.RequestData != nil || stat.ReplyData != nil {
+		t.Errorf("expected the namespace to be anonymized and the data left out, got %#v", stat)
+	}
+	if msg := stat.WriteErrors[0].Error(); strings.Contains(msg, "shop.users") || !strings.Contains(msg, stat.Ns) {
+		t.Errorf("expected the namespace in the error to be anonymized, got %v", msg)
+	}
+
+	if err := anonymizer.writeMap(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(stat.Ns, ".", 2)
+	if names[parts[0]] != "shop" || names[parts[1]] != "users" || len(names) != 2 {
+		t.Errorf("expected the map to name the pseudonyms of shop and users, got %v", names)
+	}
+}
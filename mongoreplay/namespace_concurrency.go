@@ -0,0 +1,104 @@
+package mongoreplay
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// namespaceLimits caps how many ops on each of some namespaces are in flight
+// on the target at once. An op over the limit of its namespace waits for one
+// of the others to be answered, holding up the later ops of its connection.
+type namespaceLimits struct {
+	limits map[string]*namespaceLimit
+}
+
+// namespaceLimit is the semaphore of a namespace, with counts of the ops that
+// had to wait for it.
+type namespaceLimit struct {
+	max   int
+	slots chan struct{}
+
+	sync.Mutex
+	waited  int
+	waiting time.Duration
+}
+
+// ParseNamespaceConcurrency parses limits given as <db>.<collection>=<count>,
+// several of which may be given in one string separated by commas.
+func ParseNamespaceConcurrency(limits []string) (map[string]int, error) {
+	result := map[string]int{}
+	err := parseNamespaceValues(limits, "limit", "count", "must be an integer >=1", func(ns, value string) bool {
+		count, err := strconv.Atoi(value)
+		result[ns] = count
+		return err == nil && count >= 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// newNamespaceLimits returns the limits of the namespaces, or nil if there are
+// none.
+func newNamespaceLimits(limits map[string]int) *namespaceLimits {
+	if len(limits) == 0 {
+		return nil
+	}
+	l := &namespaceLimits{limits: map[string]*namespaceLimit{}}
+	for ns, max := range limits {
+		l.limits[ns] = &namespaceLimit{max: max, slots: make(chan struct{}, max)}
+	}
+	return l
+}
+
+// namespaces returns the limited namespaces, sorted.
+func (l *namespaceLimits) namespaces() []string {
+	return sortedNamespaces(len(l.limits), func(add func(string)) {
+		for ns := range l.limits {
+			add(ns)
+		}
+	})
+}
+
+// acquire waits until the op may be sent under the limit of its namespace,
+// and returns the function to call once it has been answered. Ops on other
+// namespaces are sent at once.
+func (l *namespaceLimits) acquire(op Op) func() {
+	if l == nil {
+		return func() {}
+	}
+	limit, ok := l.limits[opNamespace(op)]
+	if !ok {
+		return func() {}
+	}
+	select {
+	case limit.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		limit.slots <- struct{}{}
+		limit.Lock()
+		limit.waited++
+		limit.waiting += time.Since(start)
+		limit.Unlock()
+	}
+	return func() { <-limit.slots }
+}
+
+// report logs how many ops waited on the limit of each namespace.
+func (l *namespaceLimits) report() {
+	if l == nil {
+		return
+	}
+	for _, ns := range l.namespaces() {
+		limit := l.limits[ns]
+		limit.Lock()
+		if limit.waited == 0 {
+			userInfoLogger.Logvf(Always, "The limit of %v ops at once on %v was never reached", limit.max, ns)
+		} else {
+			userInfoLogger.Logvf(Always, "The limit of %v ops at once on %v was reached by %v ops, which waited "+
+				"%v in all", limit.max, ns, limit.waited, limit.waiting)
+		}
+		limit.Unlock()
+	}
+}
@@ -0,0 +1,72 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseNamespaceConcurrency(t *testing.T) {
+	limits, err := ParseNamespaceConcurrency([]string{"mydb.hot=4,mydb.warm=8", "other.coll=1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]int{"mydb.hot": 4, "mydb.warm": 8, "other.coll": 1}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected %v, got %v", expected, limits)
+	}
+
+	for _, invalid := range []string{"mydb.hot", "=4", "mydb=4", "mydb.hot=0", "mydb.hot=-1",
+		"mydb.hot=1.5", "mydb.hot=many", "mydb.hot=4,mydb.hot=2"} {
+		if _, err := ParseNamespaceConcurrency([]string{invalid}); err == nil {
+			t.Errorf("expected an error parsing '%v'", invalid)
+		}
+	}
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	if newNamespaceLimits(nil) != nil {
+		t.Errorf("expected no limits without namespaces")
+	}
+	var none *namespaceLimits
+	none.acquire(&InsertOp{})()
+
+	ns := testDB + "." + testCollection
+	limits := newNamespaceLimits(map[string]int{ns: 2})
+	hot := &QueryOp{}
+	hot.Collection = ns
+	cold := &QueryOp{}
+	cold.Collection = testDB + ".cold"
+
+	first := limits.acquire(hot)
+	second := limits.acquire(hot)
+	// ops on other namespaces aren't held up
+	limits.acquire(cold)()
+
+	var wg sync.WaitGroup
+	acquired := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		release := limits.acquire(hot)
+		close(acquired)
+		release()
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the third op to wait for a slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	first()
+	wg.Wait()
+	second()
+
+	limit := limits.limits[ns]
+	if limit.waited != 1 || limit.waiting <= 0 {
+		t.Errorf("expected one op to have waited, got %v for %v", limit.waited, limit.waiting)
+	}
+	if len(limit.slots) != 0 {
+		t.Errorf("expected every slot to be released, got %v held", len(limit.slots))
+	}
+}
@@ -0,0 +1,247 @@
+package mongoreplay
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// NamespaceSpeeds holds the playback speed multipliers of namespaces whose ops
+// are played faster or slower than the rest of the tape.
+type NamespaceSpeeds map[string]float64
+
+// ParseNamespaceSpeeds parses multipliers given as <db>.<collection>=<speed>,
+// several of which may be given in one string separated by commas.
+func ParseNamespaceSpeeds(speeds []string) (NamespaceSpeeds, error) {
+	result := NamespaceSpeeds{}
+	err := parseNamespaceValues(speeds, "speed", "speed", "must be a number >0", func(ns, value string) bool {
+		multiplier, err := strconv.ParseFloat(value, 64)
+		result[ns] = multiplier
+		return err == nil && multiplier > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseNamespaceValues parses the values of namespaces given as
+// <db>.<collection>=<value>, several of which may be given in one string
+// separated by commas, handing each to parse, which returns whether it is
+// valid. what names the setting in errors, and value and valid its values and
+// the values it takes.
+func parseNamespaceValues(lists []string, what, value, valid string, parse func(ns, value string) bool) error {
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, entry := range strings.Split(list, ",") {
+			i := strings.LastIndex(entry, "=")
+			if i <= 0 {
+				return fmt.Errorf("invalid namespace %v '%v', expected <db>.<collection>=<%v>", what, entry, value)
+			}
+			ns := strings.TrimSpace(entry[:i])
+			db, collection, err := util.SplitAndValidateNamespace(ns)
+			if err != nil {
+				return err
+			}
+			if db == "" || collection == "" {
+				return fmt.Errorf("namespace '%v' must name a database and a collection", ns)
+			}
+			if seen[ns] {
+				return fmt.Errorf("%v of namespace '%v' given more than once", what, ns)
+			}
+			seen[ns] = true
+			if !parse(ns, strings.TrimSpace(entry[i+1:])) {
+				return fmt.Errorf("invalid %v in namespace %v '%v', %v", value, what, entry, valid)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedNamespaces returns the namespaces listed by each, sorted.
+func sortedNamespaces(count int, each func(func(ns string))) []string {
+	namespaces := make([]string, 0, count)
+	each(func(ns string) {
+		namespaces = append(namespaces, ns)
+	})
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// namespaces returns the namespaces with speeds, sorted.
+func (speeds NamespaceSpeeds) namespaces() []string {
+	return sortedNamespaces(len(speeds), func(add func(string)) {
+		for ns := range speeds {
+			add(ns)
+		}
+	})
+}
+
+// speed returns the speed to play the op at: the multiplier of its namespace,
+// or the given speed of the rest of the tape.
+func (speeds NamespaceSpeeds) speed(op *RecordedOp, speed float64) float64 {
+	if len(speeds) == 0 || op.EOF {
+		return speed
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil {
+		return speed
+	}
+	if multiplier, ok := speeds[opNamespace(parsedOp)]; ok {
+		return multiplier
+	}
+	return speed
+}
+
+// opNamespace returns the namespace an op acts on. For commands, that is the
+// database they are run on and the collection they name.
+func opNamespace(op Op) string {
+	var db string
+	var args interface{}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return castOp.Collection
+		}
+		db, args = strings.TrimSuffix(castOp.Collection, ".$cmd"), castOp.Query
+	case *CommandOp:
+		db, args = castOp.Database, castOp.CommandArgs
+	case *CommandGetMore:
+		db, args = castOp.Database, castOp.CommandArgs
+	case *MsgOp:
+		doc, _ := castOp.body()
+		db, args = castOp.database(), doc
+	case *MsgGetMore:
+		doc, _ := castOp.body()
+		db, args = castOp.database(), doc
+	default:
+		return op.Meta().Ns
+	}
+	doc, err := toBSOND(args)
+	if err != nil || len(doc) == 0 {
+		return db
+	}
+	field := doc[0]
+	if field.Name == "getMore" || field.Name == "getmore" {
+		// getMore names its cursor first, and its collection after
+		for _, elem := range doc {
+			if elem.Name == "collection" {
+				field = elem
+			}
+		}
+	}
+	if collection, ok := field.Value.(string); ok {
+		return db + "." + collection
+	}
+	return db
+}
+
+// playScheduleLimit is the most ops a play schedule holds back before
+// dispatching its earliest op whether or not a later one could still come
+// before it, which bounds how much of a tape is read ahead when some of its
+// namespaces are played much faster than the rest.
+const playScheduleLimit = 10 * queueGranularity
+
+// playSchedule orders the ops of a playback by the time they're played at,
+// which, with namespace speeds, is not the order they were recorded in: the
+// ops of a namespace played faster than the rest of the tape are dispatched
+// ahead of the ops recorded before them that are played later. Ops are held
+// until no op read after them can be played before them, which is known from
+// the fastest speed of the playback, and the ops of a recorded connection are
+// kept in order by playing none of them before the op ahead of it.
+type playSchedule struct {
+	maxSpeed float64
+	ordered  bool
+
+	ops    scheduledOps
+	count  int64
+	latest map[string]time.Time
+}
+
+// newPlaySchedule returns the schedule of a playback at the given speed,
+// which only reorders ops when some namespaces have speeds of their own.
+func newPlaySchedule(speeds NamespaceSpeeds, speed float64) *playSchedule {
+	schedule := &playSchedule{maxSpeed: speed, ordered: len(speeds) > 0, latest: map[string]time.Time{}}
+	for _, multiplier := range speeds {
+		if multiplier > schedule.maxSpeed {
+			schedule.maxSpeed = multiplier
+		}
+	}
+	return schedule
+}
+
+// add schedules an op, given the earliest time any op read after it can be
+// played at, and returns the ops that are due to be dispatched, in order.
+func (schedule *playSchedule) add(op *RecordedOp, earliest time.Time) []*RecordedOp {
+	if !schedule.ordered {
+		return []*RecordedOp{op}
+	}
+	connection := recordedConnection(op)
+	if latest, ok := schedule.latest[connection]; ok && op.PlayAt.Before(latest) {
+		op.PlayAt = &PreciseTime{latest}
+	}
+	if op.EOF {
+		delete(schedule.latest, connection)
+	} else {
+		schedule.latest[connection] = op.PlayAt.Time
+	}
+	heap.Push(&schedule.ops, scheduledOp{op: op, order: schedule.count})
+	schedule.count++
+
+	var due []*RecordedOp
+	for len(schedule.ops) > 0 &&
+		(!schedule.ops[0].op.PlayAt.After(earliest) || len(schedule.ops) > playScheduleLimit) {
+		due = append(due, heap.Pop(&schedule.ops).(scheduledOp).op)
+	}
+	return due
+}
+
+// flush returns the ops still held by the schedule, in order.
+func (schedule *playSchedule) flush() []*RecordedOp {
+	var due []*RecordedOp
+	for len(schedule.ops) > 0 {
+		due = append(due, heap.Pop(&schedule.ops).(scheduledOp).op)
+	}
+	return due
+}
+
+// scheduledOp is an op held by a play schedule, with its place in the tape,
+// which orders the ops played at the same time.
+type scheduledOp struct {
+	op    *RecordedOp
+	order int64
+}
+
+// scheduledOps is a heap of ops ordered by the time they're played at.
+type scheduledOps []scheduledOp
+
+func (o scheduledOps) Len() int {
+	return len(o)
+}
+
+func (o scheduledOps) Less(i, j int) bool {
+	if !o[i].op.PlayAt.Equal(o[j].op.PlayAt.Time) {
+		return o[i].op.PlayAt.Before(o[j].op.PlayAt.Time)
+	}
+	return o[i].order < o[j].order
+}
+
+func (o scheduledOps) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+func (o *scheduledOps) Pop() interface{} {
+	i := len(*o) - 1
+	op := (*o)[i]
+	*o = (*o)[:i]
+	return op
+}
+
+func (o *scheduledOps) Push(op interface{}) {
+	*o = append(*o, op.(scheduledOp))
+}
@@ -0,0 +1,115 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseNamespaceSpeeds(t *testing.T) {
+	speeds, err := ParseNamespaceSpeeds([]string{"mydb.hot=5,mydb.cold=0.5", "other.coll=2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := NamespaceSpeeds{"mydb.hot": 5, "mydb.cold": 0.5, "other.coll": 2}
+	if len(speeds) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, speeds)
+	}
+	for ns, speed := range expected {
+		if speeds[ns] != speed {
+			t.Errorf("expected speed %v for %v, got %v", speed, ns, speeds[ns])
+		}
+	}
+
+	for _, invalid := range []string{"mydb.hot", "=5", "mydb=5", "mydb.hot=0", "mydb.hot=-1",
+		"mydb.hot=fast", "my db.hot=5", "mydb.hot=5,mydb.hot=2"} {
+		if _, err := ParseNamespaceSpeeds([]string{invalid}); err == nil {
+			t.Errorf("expected an error parsing '%v'", invalid)
+		}
+	}
+}
+
+func TestNamespaceSpeedsSpeed(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateCommandFind(bson.D{}, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandGetMore(5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateInsert([]interface{}{bson.D{{"_id", 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandOp("ping", bson.D{{"ping", 1}}, 2); err != nil {
+		t.Fatal(err)
+	}
+	ops := generatedOps(generator)
+
+	ns := testDB + "." + testCollection
+	speeds := NamespaceSpeeds{ns: 5}
+	expected := []float64{5, 5, 5, 1}
+	for i, op := range ops {
+		if speed := speeds.speed(op, 1); speed != expected[i] {
+			t.Errorf("expected speed %v for op %v, got %v", expected[i], i, speed)
+		}
+	}
+
+	// ops on other namespaces are played at the speed of the rest of the tape
+	speeds = NamespaceSpeeds{testDB + ".other": 5}
+	for i, op := range ops {
+		if speed := speeds.speed(op, 2); speed != 2 {
+			t.Errorf("expected speed 2 for op %v, got %v", i, speed)
+		}
+	}
+}
+
+func TestPlayNamespaceSpeedsOrder(t *testing.T) {
+	// getLastErrors on admin, played at the speed of the tape, recorded
+	// alternately with queries on the test collection, played 4 times as
+	// fast, each on a connection of its own
+	generator := newRecordedOpGenerator()
+	for i := 0; i < 10; i++ {
+		if err := generator.generateGetLastError(); err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.generateQuery(bson.D{{"_id", i}}, 0, int32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops := generatedOps(generator)
+	opChan := make(chan *RecordedOp, len(ops))
+	start := time.Now()
+	for i, op := range ops {
+		op.SrcEndpoint = fmt.Sprintf("10.0.0.1:%v", 40000+i)
+		op.Seen = &PreciseTime{start.Add(time.Duration(i) * 10 * time.Millisecond)}
+		opChan <- op
+	}
+	close(opChan)
+
+	recorder := &BufferedStatRecorder{}
+	context := NewExecutionContext(&StatCollector{
+		StatGenerator: &ComparativeStatGenerator{},
+		StatRecorder:  recorder,
+	})
+	context.DialTimeout = 100 * time.Millisecond
+	context.NamespaceSpeeds = NamespaceSpeeds{testDB + "." + testCollection: 4}
+	if err := Play(context, opChan, 1, "mongodb://127.0.0.1:1", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Buffer) != len(ops) {
+		t.Fatalf("expected %v stats, got %v", len(ops), len(recorder.Buffer))
+	}
+
+	// the ops are dispatched in the order they're played in, not the one
+	// they were recorded in
+	for _, before := range recorder.Buffer {
+		for _, after := range recorder.Buffer {
+			if before.DispatchedAt.Before(*after.DispatchedAt) && after.PlayAt.Before(*before.PlayAt) {
+				t.Errorf("op %v on %v to be played at %v was dispatched before op %v on %v to be played at %v",
+					before.Order, before.Ns, before.PlayAt, after.Order, after.Ns, after.PlayAt)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"time"
+)
+
+// negativeDeltas finds the ops of a playback file seen before the op ahead of
+// them, whose delta from it is negative. Recording orders ops by the time they
+// were seen, so they come from a capture with out-of-order timestamps, such as
+// one merged from several interfaces with skewed clocks, and would be played
+// ahead of their turn. They are either clamped to the time of the op ahead of
+// them, playing them right after it, or fail the playback.
+type negativeDeltas struct {
+	fail bool
+
+	last    time.Time
+	count   int64
+	largest time.Duration
+}
+
+func newNegativeDeltas(fail bool) *negativeDeltas {
+	return &negativeDeltas{fail: fail}
+}
+
+// check clamps the time an op was seen at to that of the op ahead of it if it
+// is earlier, or returns an error if negative deltas fail the playback. A nil
+// negativeDeltas leaves every op as it is.
+func (n *negativeDeltas) check(op *RecordedOp) error {
+	if n == nil {
+		return nil
+	}
+	if op.Seen.Before(n.last) {
+		delta := n.last.Sub(op.Seen.Time)
+		if n.fail {
+			return fmt.Errorf("op %v on connection %v was seen %v before the op ahead of it in the playback "+
+				"file; the capture has out-of-order timestamps", op.Order, op.SeenConnectionNum, delta)
+		}
+		n.count++
+		if delta > n.largest {
+			n.largest = delta
+		}
+		op.Seen.Time = n.last
+		return nil
+	}
+	n.last = op.Seen.Time
+	return nil
+}
+
+// report logs how many ops were clamped, if any.
+func (n *negativeDeltas) report() {
+	if n == nil || n.count == 0 {
+		return
+	}
+	userInfoLogger.Logvf(Always, "Warning: %v ops were seen before the op ahead of them in the playback file, by up "+
+		"to %v, and were played right after it; the capture has out-of-order timestamps", n.count, n.largest)
+}
@@ -0,0 +1,72 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// outOfOrderTape returns a playback file whose third and fifth ops were seen
+// before the ops ahead of them, as in a capture merged from two interfaces
+// whose clocks are 300ms apart.
+func outOfOrderTape(t *testing.T) *PlaybackFileReader {
+	start := time.Unix(1500000000, 0)
+	var buf bytes.Buffer
+	for i, offset := range []time.Duration{0, 400, 100, 500, 200, 600} {
+		op := RecordedOp{
+			Seen:              &PreciseTime{start.Add(offset * time.Millisecond)},
+			SeenConnectionNum: int64(i % 2),
+		}
+		bsonBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(bsonBytes)
+	}
+	return &PlaybackFileReader{bytes.NewReader(buf.Bytes())}
+}
+
+func TestNegativeDeltasClamped(t *testing.T) {
+	opChan, errChan := NewOpChanFromFile(outOfOrderTape(t), 1)
+	deltas := newNegativeDeltas(false)
+	var last time.Time
+	for op := range opChan {
+		if err := deltas.check(op); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if op.Seen.Before(last) {
+			t.Errorf("op %v wasn't clamped: seen at %v, after %v", op.Order, op.Seen.Time, last)
+		}
+		last = op.Seen.Time
+	}
+	<-errChan
+	if deltas.count != 2 || deltas.largest != 300*time.Millisecond {
+		t.Errorf("expected 2 negative deltas of up to 300ms, got %v of up to %v", deltas.count, deltas.largest)
+	}
+}
+
+func TestNegativeDeltasFail(t *testing.T) {
+	opChan, errChan := NewOpChanFromFile(outOfOrderTape(t), 1)
+	deltas := newNegativeDeltas(true)
+	var err error
+	var failedAt int64
+	for op := range opChan {
+		if err == nil {
+			if err = deltas.check(op); err != nil {
+				failedAt = op.Order
+			}
+		}
+	}
+	<-errChan
+	if err == nil || failedAt != 2 {
+		t.Errorf("expected the third op to fail, got %v at op %v", err, failedAt)
+	}
+
+	var none *negativeDeltas
+	op := &RecordedOp{Seen: &PreciseTime{time.Unix(0, 0)}}
+	if err := none.check(op); err != nil {
+		t.Errorf("a nil negativeDeltas should leave every op as it is, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/mongorestore/ns"
+)
+
+// collectionCommands are the commands whose first field names the collection
+// they run on, which is renamed along with their database.
+var collectionCommands = map[string]bool{
+	"find":                   true,
+	"insert":                 true,
+	"update":                 true,
+	"delete":                 true,
+	"findAndModify":          true,
+	"findandmodify":          true,
+	"count":                  true,
+	"distinct":               true,
+	"aggregate":              true,
+	"mapReduce":              true,
+	"mapreduce":              true,
+	"geoNear":                true,
+	"create":                 true,
+	"drop":                   true,
+	"createIndexes":          true,
+	"dropIndexes":            true,
+	"deleteIndexes":          true,
+	"listIndexes":            true,
+	"killCursors":            true,
+	"collMod":                true,
+	"collStats":              true,
+	"validate":               true,
+	"compact":                true,
+	"reIndex":                true,
+	"convertToCapped":        true,
+	"parallelCollectionScan": true,
+}
+
+// nsRenamer renames the namespaces of the ops played with --nsFrom and --nsTo,
+// keeping count of the ops played on each renamed namespace to report them.
+// It is safe for concurrent use.
+type nsRenamer struct {
+	renamer *ns.Renamer
+
+	sync.Mutex
+	renamed map[string]*renamedNamespace
+}
+
+// renamedNamespace is where the ops of a recorded namespace were played.
+type renamedNamespace struct {
+	to  string
+	ops int64
+}
+
+// newNsRenamer returns a renamer for the namespace patterns given with
+// --nsFrom and --nsTo, which pair up in order. Patterns may use * and
+// $variable$ wildcards as in mongorestore, such as prod.* to test_prod.*.
+func newNsRenamer(from, to []string) (*nsRenamer, error) {
+	if len(from) != len(to) {
+		return nil, fmt.Errorf("--nsFrom and --nsTo must be given the same number of times")
+	}
+	renamer, err := ns.NewRenamer(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &nsRenamer{renamer: renamer, renamed: map[string]*renamedNamespace{}}, nil
+}
+
+// rename returns the namespace the ops recorded on a namespace are played on.
+func (r *nsRenamer) rename(namespace string) (string, error) {
+	to := r.renamer.Get(namespace)
+	if to == namespace {
+		return to, nil
+	}
+	if i := strings.Index(to, "."); i <= 0 || i == len(to)-1 {
+		return "", fmt.Errorf("%v is renamed to %v, which is not a valid namespace", namespace, to)
+	}
+	r.Lock()
+	defer r.Unlock()
+	renamed, ok := r.renamed[namespace]
+	if !ok {
+		renamed = &renamedNamespace{to: to}
+		r.renamed[namespace] = renamed
+	}
+	renamed.ops++
+	return to, nil
+}
+
+// renameOp renames the namespace of an op, and of the collections named by a
+// command, so that it is played on the renamed namespace. Commands that don't
+// run on a collection are played on the renamed database of their $cmd
+// namespace.
+func (r *nsRenamer) renameOp(op Op) error {
+	var err error
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			castOp.Collection, err = r.rename(castOp.Collection)
+			return err
+		}
+		doc, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		database, doc, err := r.renameCommand(strings.TrimSuffix(castOp.Collection, ".$cmd"), doc)
+		if err != nil {
+			return err
+		}
+		castOp.Collection, castOp.Query = database+".$cmd", doc
+	case *GetMoreOp:
+		castOp.Collection, err = r.rename(castOp.Collection)
+	case *InsertOp:
+		castOp.Collection, err = r.rename(castOp.Collection)
+	case *UpdateOp:
+		castOp.Collection, err = r.rename(castOp.Collection)
+	case *DeleteOp:
+		castOp.Collection, err = r.rename(castOp.Collection)
+	case *CommandOp:
+		return r.renameCommandOp(castOp)
+	case *CommandGetMore:
+		return r.renameCommandOp(&castOp.CommandOp)
+	case *MsgOp:
+		return r.renameMsgOp(castOp)
+	case *MsgGetMore:
+		return r.renameMsgOp(&castOp.MsgOp)
+	}
+	return err
+}
+
+func (r *nsRenamer) renameCommandOp(op *CommandOp) error {
+	doc, err := toBSOND(op.CommandArgs)
+	if err != nil {
+		return err
+	}
+	database, doc, err := r.renameCommand(op.Database, doc)
+	if err != nil {
+		return err
+	}
+	// getMore cursors are rewritten in place, which needs a *bson.D
+	op.Database, op.CommandArgs = database, &doc
+	return nil
+}
+
+// renameMsgOp renames the collections named by the command of an OP_MSG,
+// setting the database it names in $db to the one to run it on.
+func (r *nsRenamer) renameMsgOp(op *MsgOp) error {
+	database := op.database()
+	return op.editBody(func(doc bson.D) (bson.D, error) {
+		database, doc, err := r.renameCommand(database, doc)
+		if err != nil {
+			return nil, err
+		}
+		for i, elem := range doc {
+			if elem.Name == "$db" {
+				doc[i].Value = database
+			}
+		}
+		return doc, nil
+	})
+}
+
+// renameCommand renames the collections named by a command run on a
+// database, returning the database to run it on.
+func (r *nsRenamer) renameCommand(database string, doc bson.D) (string, bson.D, error) {
+	if len(doc) > 0 && (doc[0].Name == "$query" || doc[0].Name == "query") {
+		// a command wrapped to carry a read preference
+		if inner, err := toBSOND(doc[0].Value); err == nil {
+			database, inner, err = r.renameCommand(database, inner)
+			doc[0].Value = inner
+			return database, doc, err
+		}
+	}
+
+	field := -1
+	switch {
+	case len(doc) == 0:
+	case doc[0].Name == "renameCollection":
+		// run on admin with the whole namespaces of both collections
+		for i, elem := range doc {
+			if name, ok := elem.Value.(string); ok && (elem.Name == "renameCollection" || elem.Name == "to") {
+				renamed, err := r.rename(name)
+				if err != nil {
+					return "", nil, err
+				}
+				doc[i].Value = renamed
+			}
+		}
+		return database, doc, nil
+	case doc[0].Name == "getMore":
+		for i, elem := range doc {
+			if elem.Name == "collection" {
+				field = i
+			}
+		}
+	case collectionCommands[doc[0].Name]:
+		field = 0
+	}
+
+	if field >= 0 {
+		if collection, ok := doc[field].Value.(string); ok && collection != "" {
+			renamed, err := r.rename(database + "." + collection)
+			if err != nil {
+				return "", nil, err
+			}
+			parts := strings.SplitN(renamed, ".", 2)
+			doc[field].Value = parts[1]
+			return parts[0], doc, nil
+		}
+	}
+	renamed, err := r.rename(database + ".$cmd")
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.SplitN(renamed, ".", 2)[0], doc, nil
+}
+
+// report logs each renamed namespace and the number of ops played on it.
+func (r *nsRenamer) report() {
+	r.Lock()
+	defer r.Unlock()
+	namespaces := make([]string, 0, len(r.renamed))
+	for namespace := range r.renamed {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	if len(namespaces) == 0 {
+		userInfoLogger.Logvf(Always, "Warning: no namespaces of the playback file matched --nsFrom")
+	}
+	for _, namespace := range namespaces {
+		renamed := r.renamed[namespace]
+		userInfoLogger.Logvf(Always, "Played %v ops on %v as %v", renamed.ops, namespace, renamed.to)
+	}
+}
@@ -0,0 +1,107 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestNsRenamer(t *testing.T) {
+	renamer, err := newNsRenamer([]string{"prod.*"}, []string{"test_prod.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(collection string, doc bson.D) *QueryOp {
+		return &QueryOp{QueryOp: mgo.QueryOp{Collection: collection, Query: doc}}
+	}
+
+	cases := []struct {
+		op         *QueryOp
+		collection string
+		query      bson.D
+	}{
+		{query("prod.users", bson.D{{Name: "a", Value: 1}}), "test_prod.users", bson.D{{Name: "a", Value: 1}}},
+		{query("other.users", bson.D{{Name: "a", Value: 1}}), "other.users", bson.D{{Name: "a", Value: 1}}},
+		{query("prod.$cmd", bson.D{{Name: "find", Value: "users"}}), "test_prod.$cmd", bson.D{{Name: "find", Value: "users"}}},
+		{query("prod.$cmd", bson.D{{Name: "dbStats", Value: 1}}), "test_prod.$cmd", bson.D{{Name: "dbStats", Value: 1}}},
+		{query("prod.$cmd", bson.D{{Name: "getMore", Value: int64(5)}, {Name: "collection", Value: "users"}}), "test_prod.$cmd",
+			bson.D{{Name: "getMore", Value: int64(5)}, {Name: "collection", Value: "users"}}},
+		{query("admin.$cmd", bson.D{{Name: "renameCollection", Value: "prod.a"}, {Name: "to", Value: "prod.b"}}), "admin.$cmd",
+			bson.D{{Name: "renameCollection", Value: "test_prod.a"}, {Name: "to", Value: "test_prod.b"}}},
+		{query("prod.$cmd", bson.D{{Name: "$query", Value: bson.D{{Name: "count", Value: "users"}}}}), "test_prod.$cmd",
+			bson.D{{Name: "$query", Value: bson.D{{Name: "count", Value: "users"}}}}},
+	}
+	for _, c := range cases {
+		if err := renamer.renameOp(c.op); err != nil {
+			t.Fatal(err)
+		}
+		if c.op.Collection != c.collection {
+			t.Errorf("expected the op on %v, got %v", c.collection, c.op.Collection)
+		}
+		if !reflect.DeepEqual(c.op.Query, c.query) {
+			t.Errorf("expected %#v, got %#v", c.query, c.op.Query)
+		}
+	}
+
+	if renamed := renamer.renamed["prod.users"]; renamed == nil || renamed.to != "test_prod.users" || renamed.ops != 4 {
+		t.Errorf("expected 4 ops on prod.users renamed to test_prod.users, got %#v", renamed)
+	}
+	if _, ok := renamer.renamed["other.users"]; ok {
+		t.Errorf("expected other.users not to be renamed")
+	}
+}
+
+func TestNsRenamerCollection(t *testing.T) {
+	renamer, err := newNsRenamer([]string{"prod.users"}, []string{"staging.people"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &CommandOp{CommandOp: mgo.CommandOp{Database: "prod", CommandName: "find", CommandArgs: bson.D{{Name: "find", Value: "users"}}}}
+	if err := renamer.renameOp(op); err != nil {
+		t.Fatal(err)
+	}
+	expected := &bson.D{{Name: "find", Value: "people"}}
+	if op.Database != "staging" || !reflect.DeepEqual(op.CommandArgs, expected) {
+		t.Errorf("expected find on staging.people, got %v %#v", op.Database, op.CommandArgs)
+	}
+
+	insert := &InsertOp{InsertOp: mgo.InsertOp{Collection: "prod.users"}}
+	if err := renamer.renameOp(insert); err != nil {
+		t.Fatal(err)
+	}
+	if insert.Collection != "staging.people" {
+		t.Errorf("expected an insert into staging.people, got %v", insert.Collection)
+	}
+}
+
+func TestNewNsRenamerInvalid(t *testing.T) {
+	for _, c := range []struct {
+		from, to []string
+	}{
+		{[]string{"prod.*"}, nil},
+		{[]string{"prod.*"}, []string{"test_prod"}},
+		{[]string{"prod.$a$"}, []string{"test.$b$"}},
+	} {
+		if _, err := newNsRenamer(c.from, c.to); err == nil {
+			t.Errorf("expected an error renaming %v to %v", c.from, c.to)
+		}
+	}
+}
+
+func TestRenameCreates(t *testing.T) {
+	renamer, err := newNsRenamer([]string{"prod.*"}, []string{"test_prod.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creates := newTapeCreates()
+	creates.namespaces = []string{"prod.users"}
+	creates.commands["prod.users"] = createCommand{db: "prod", command: bson.D{{Name: "create", Value: "users"}}}
+	creates.rename(renamer)
+
+	create, ok := creates.commands["test_prod.users"]
+	if !ok || create.db != "test_prod" || create.command[0].Value != "users" {
+		t.Errorf("expected the create renamed to test_prod.users, got %#v", creates.commands)
+	}
+}
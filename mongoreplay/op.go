@@ -3,6 +3,7 @@ package mongoreplay
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/10gen/llmgo"
 )
@@ -74,6 +75,7 @@ type Replyable interface {
 	getLatencyMicros() int64
 	getNumReturned() int
 	getErrors() []error
+	getWriteErrors() []error
 }
 
 // ErrUnknownOpcode is an error that represents an unrecognized opcode.
@@ -88,21 +90,7 @@ func (e ErrUnknownOpcode) Error() string {
 // unmarshalled using its 'FromReader' method and checks if it is a command
 // matching the ones the driver generates.
 func IsDriverOp(op Op) bool {
-	var commandType string
-	var opType string
-	switch castOp := op.(type) {
-	case *QueryOp:
-		opType, commandType = extractOpType(castOp.QueryOp.Query)
-		if opType != "command" {
-			return false
-		}
-	case *CommandOp:
-		commandType = castOp.CommandName
-	default:
-		return false
-	}
-
-	switch commandType {
+	switch opCommandName(op) {
 	case "isMaster", "ismaster":
 		return true
 	case "getnonce":
@@ -117,3 +105,40 @@ func IsDriverOp(op Op) bool {
 		return false
 	}
 }
+
+// IsHandshakeOp checks if an operation is part of the handshake and
+// authentication a client performs on a new connection, which includes the
+// driver ops along with the commands that authenticate with credentials that
+// may not be valid on the target.
+func IsHandshakeOp(op Op) bool {
+	if IsDriverOp(op) {
+		return true
+	}
+	switch opCommandName(op) {
+	case "hello", "authenticate", "logout", "buildInfo", "buildinfo", "whatsmyuri":
+		return true
+	default:
+		return false
+	}
+}
+
+// opCommandName returns the name of the command the op runs, or an empty
+// string if it isn't a command.
+func opCommandName(op Op) string {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return ""
+		}
+		opType, commandType := extractOpType(castOp.QueryOp.Query)
+		if opType != "command" {
+			return ""
+		}
+		return commandType
+	case *CommandOp:
+		return castOp.CommandName
+	case *MsgOp:
+		return castOp.commandName()
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// opTimeoutGrace is how long past --opTimeout the target is given to answer
+// an op before its connection is dropped, so that the ops the target stops
+// with maxTimeMS report it themselves.
+const opTimeoutGrace = time.Second
+
+// maxTimeMSExpired is the code of the error of an op that exceeded its
+// maxTimeMS.
+const maxTimeMSExpired = 50
+
+// maxTimeCommands are the commands that accept a maxTimeMS on every server
+// version that mongoreplay plays to.
+var maxTimeCommands = map[string]bool{
+	"find":          true,
+	"aggregate":     true,
+	"count":         true,
+	"distinct":      true,
+	"findAndModify": true,
+	"findandmodify": true,
+	"mapReduce":     true,
+	"mapreduce":     true,
+}
+
+// opTimeoutError is the error of an op that exceeded its time limit, whether
+// the target stopped it with maxTimeMS or its connection was dropped for
+// taking longer than --opTimeout.
+type opTimeoutError struct {
+	msg string
+}
+
+func (err opTimeoutError) Error() string {
+	return err.msg
+}
+
+// isOpTimeout returns whether the error is that of an op that exceeded its
+// time limit.
+func isOpTimeout(err error) bool {
+	_, ok := err.(opTimeoutError)
+	return ok
+}
+
+// isNetTimeout returns whether the error is that of a connection that timed
+// out.
+func isNetTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// setMaxTime gives the op a maxTimeMS of --opTimeout, as $maxTimeMS for
+// legacy queries, unless it was recorded with a lower one. Ops that don't
+// accept one, such as writes and getmores, are left as they are, and are only
+// bounded by their connection being dropped.
+func (context *ExecutionContext) setMaxTime(op Op) error {
+	ms := int64(context.OpTimeout / time.Millisecond)
+	switch castOp := op.(type) {
+	case *QueryOp:
+		doc, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(castOp.Collection, ".$cmd") {
+			castOp.Query = setCommandMaxTime(doc, ms)
+			return nil
+		}
+		if fieldIndex(doc, "query") >= 0 {
+			// wrapped without the $, which can't be mixed with $maxTimeMS
+			return nil
+		}
+		if fieldIndex(doc, "$query") < 0 {
+			doc = bson.D{{Name: "$query", Value: doc}}
+		}
+		castOp.Query = withMaxTime(doc, "$maxTimeMS", ms)
+	case *CommandOp:
+		doc, err := toBSOND(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		castOp.CommandArgs = setCommandMaxTime(doc, ms)
+	case *MsgOp:
+		return castOp.editBody(func(doc bson.D) (bson.D, error) {
+			return setCommandMaxTime(doc, ms), nil
+		})
+	}
+	return nil
+}
+
+// setCommandMaxTime sets the maxTimeMS of a command that accepts one.
+func setCommandMaxTime(doc bson.D, ms int64) bson.D {
+	if len(doc) == 0 {
+		return doc
+	}
+	if doc[0].Name == "$query" || doc[0].Name == "query" {
+		// a command wrapped to carry a read preference
+		if inner, err := toBSOND(doc[0].Value); err == nil {
+			doc[0].Value = setCommandMaxTime(inner, ms)
+		}
+		return doc
+	}
+	if !maxTimeCommands[doc[0].Name] {
+		return doc
+	}
+	return withMaxTime(doc, "maxTimeMS", ms)
+}
+
+// withMaxTime sets the named time limit field of the document to ms, unless
+// it has a lower positive one.
+func withMaxTime(doc bson.D, name string, ms int64) bson.D {
+	if i := fieldIndex(doc, name); i >= 0 {
+		if recorded, ok := intValue(doc[i].Value); ok && recorded > 0 && int64(recorded) <= ms {
+			return doc
+		}
+	}
+	return withField(doc, name, ms)
+}
+
+// timeoutReply is the reply recorded for an op whose connection was dropped
+// for taking longer than --opTimeout.
+type timeoutReply struct {
+	timeout time.Duration
+	latency time.Duration
+}
+
+func newTimeoutReply(timeout time.Duration, playedAt time.Time) *timeoutReply {
+	return &timeoutReply{timeout: timeout, latency: time.Since(playedAt)}
+}
+
+func (reply *timeoutReply) err() error {
+	return opTimeoutError{fmt.Sprintf("op timed out after %v", reply.timeout)}
+}
+
+func (reply *timeoutReply) getCursorID() (int64, error) {
+	return 0, nil
+}
+
+// Meta returns metadata about the timeoutReply.
+func (reply *timeoutReply) Meta() OpMetadata {
+	return OpMetadata{"reply", "", "", map[string]interface{}{"$err": reply.err().Error()}}
+}
+
+func (reply *timeoutReply) getLatencyMicros() int64 {
+	return int64(reply.latency / time.Microsecond)
+}
+
+func (reply *timeoutReply) getNumReturned() int {
+	return 0
+}
+
+func (reply *timeoutReply) getErrors() []error {
+	return []error{reply.err()}
+}
+
+func (reply *timeoutReply) getWriteErrors() []error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestSetMaxTime(t *testing.T) {
+	context := &ExecutionContext{OpTimeout: 2 * time.Second}
+	query := func(collection string, doc bson.D) *QueryOp {
+		return &QueryOp{QueryOp: mgo.QueryOp{Collection: collection, Query: doc}}
+	}
+
+	cases := []struct {
+		op    *QueryOp
+		query bson.D
+	}{
+		{query("test.c", bson.D{{Name: "a", Value: 1}}),
+			bson.D{{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}}, {Name: "$maxTimeMS", Value: int64(2000)}}},
+		{query("test.c", bson.D{{Name: "$query", Value: bson.D{}}, {Name: "$maxTimeMS", Value: 500}}),
+			bson.D{{Name: "$query", Value: bson.D{}}, {Name: "$maxTimeMS", Value: 500}}},
+		{query("test.c", bson.D{{Name: "query", Value: bson.D{}}}), bson.D{{Name: "query", Value: bson.D{}}}},
+		{query("test.$cmd", bson.D{{Name: "count", Value: "c"}}),
+			bson.D{{Name: "count", Value: "c"}, {Name: "maxTimeMS", Value: int64(2000)}}},
+		{query("test.$cmd", bson.D{{Name: "find", Value: "c"}, {Name: "maxTimeMS", Value: 60000}}),
+			bson.D{{Name: "find", Value: "c"}, {Name: "maxTimeMS", Value: int64(2000)}}},
+		{query("test.$cmd", bson.D{{Name: "$query", Value: bson.D{{Name: "aggregate", Value: "c"}}}}),
+			bson.D{{Name: "$query", Value: bson.D{{Name: "aggregate", Value: "c"}, {Name: "maxTimeMS", Value: int64(2000)}}}}},
+		// writes and getMores don't accept a maxTimeMS
+		{query("test.$cmd", bson.D{{Name: "insert", Value: "c"}}), bson.D{{Name: "insert", Value: "c"}}},
+		{query("test.$cmd", bson.D{{Name: "getMore", Value: int64(5)}}), bson.D{{Name: "getMore", Value: int64(5)}}},
+	}
+	for _, c := range cases {
+		if err := context.setMaxTime(c.op); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.op.Query, c.query) {
+			t.Errorf("expected %#v, got %#v", c.query, c.op.Query)
+		}
+	}
+
+	command := &CommandOp{CommandOp: mgo.CommandOp{Database: "test", CommandName: "distinct",
+		CommandArgs: bson.D{{Name: "distinct", Value: "c"}}}}
+	if err := context.setMaxTime(command); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "distinct", Value: "c"}, {Name: "maxTimeMS", Value: int64(2000)}}
+	if !reflect.DeepEqual(command.CommandArgs, expected) {
+		t.Errorf("expected %#v, got %#v", expected, command.CommandArgs)
+	}
+}
+
+func TestOpTimeoutErrors(t *testing.T) {
+	errs := extractErrorsFromDoc(&bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: "operation exceeded time limit"},
+		{Name: "code", Value: 50},
+	})
+	if len(errs) != 1 || !isOpTimeout(errs[0]) {
+		t.Errorf("expected a timeout error, got %#v", errs)
+	}
+	errs = extractErrorsFromDoc(&bson.D{{Name: "ok", Value: 0}, {Name: "errmsg", Value: "bad"}, {Name: "code", Value: 2}})
+	if len(errs) != 1 || isOpTimeout(errs[0]) {
+		t.Errorf("expected an error other than a timeout, got %#v", errs)
+	}
+
+	agg := NewStatAggregate()
+	agg.Add(&OpStat{OpType: "command", Command: "find", Errors: errs})
+	agg.Add(&OpStat{OpType: "command", Command: "find", Errors: newTimeoutReply(time.Second, time.Now()).getErrors()})
+	agg.Add(&OpStat{OpType: "command", Command: "find"})
+	if agg.Total.Errors != 2 || agg.Total.Timeouts != 1 {
+		t.Errorf("expected 2 errors of which 1 timeout, got %v and %v", agg.Total.Errors, agg.Total.Timeouts)
+	}
+	summary := newPlaybackSummary("run", time.Now(), time.Now(), agg)
+	if summary.Timeouts != 1 || summary.ByType["command find"].Timeouts != 1 {
+		t.Errorf("expected the timeout in the summary, got %+v", summary)
+	}
+	if isOpTimeout(fmt.Errorf("op timed out")) {
+		t.Errorf("only timeout errors should be timeouts")
+	}
+}
@@ -31,6 +31,10 @@ func (c OpCode) String() string {
 		return "command"
 	case OpCodeCommandReply:
 		return "command_reply"
+	case OpCodeCompressed:
+		return "compressed"
+	case OpCodeMsg:
+		return "msg"
 	default:
 		return fmt.Sprintf("UNKNOWN(%d)", c)
 	}
@@ -51,4 +55,5 @@ const (
 	OpCodeCommand      = OpCode(2010)
 	OpCodeCommandReply = OpCode(2011)
 	OpCodeCompressed   = OpCode(2012)
+	OpCodeMsg          = OpCode(2013)
 )
@@ -10,19 +10,28 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 )
 
-// PacketHandler wraps pcap.Handle to maintain other useful information.
+// PacketHandler wraps pcap.Handle, or another source of packets, to maintain
+// other useful information.
 type PacketHandler struct {
 	Verbose    bool
-	pcap       *pcap.Handle
+	source     gopacket.PacketDataSource
+	decoder    gopacket.Decoder
 	numDropped int64
 	stop       chan struct{}
 }
 
 // NewPacketHandler initializes a new PacketHandler
 func NewPacketHandler(pcapHandle *pcap.Handle) *PacketHandler {
+	return newPacketHandler(pcapHandle, pcapHandle.LinkType())
+}
+
+// newPacketHandler initializes a new PacketHandler that reads packets from
+// the source, decoding them with the decoder.
+func newPacketHandler(source gopacket.PacketDataSource, decoder gopacket.Decoder) *PacketHandler {
 	return &PacketHandler{
-		pcap: pcapHandle,
-		stop: make(chan struct{}),
+		source:  source,
+		decoder: decoder,
+		stop:    make(chan struct{}, 1),
 	}
 }
 
@@ -38,9 +47,13 @@ type SetFirstSeener interface {
 	SetFirstSeen(t time.Time)
 }
 
-// Close stops the packetHandler
+// Close stops the packetHandler. It does not block, and may be safely called
+// more than once.
 func (p *PacketHandler) Close() {
-	p.stop <- struct{}{}
+	select {
+	case p.stop <- struct{}{}:
+	default:
+	}
 }
 
 func bookkeep(pktCount uint, pkt gopacket.Packet, assembler *Assembler) {
@@ -57,7 +70,7 @@ func (p *PacketHandler) Handle(streamHandler StreamHandler, numToHandle int) err
 	if p.Verbose && numToHandle > 0 {
 		userInfoLogger.Logvf(Always, "Processing", numToHandle, "packets")
 	}
-	source := gopacket.NewPacketSource(p.pcap, p.pcap.LinkType())
+	source := gopacket.NewPacketSource(p.source, p.decoder)
 	streamPool := NewStreamPool(streamHandler)
 	assembler := NewAssembler(streamPool)
 	defer func() {
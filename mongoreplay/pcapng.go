@@ -0,0 +1,283 @@
+package mongoreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapngMagic is the block type of a pcapng section header block, which
+// starts every pcapng file.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+const (
+	pcapngSectionHeaderBlock     = 0x0a0d0d0a
+	pcapngInterfaceBlock         = 1
+	pcapngObsoletePacketBlock    = 2
+	pcapngSimplePacketBlock      = 3
+	pcapngEnhancedPacketBlock    = 6
+	pcapngByteOrderMagic         = 0x1a2b3c4d
+	pcapngOptionTimestampRes     = 9
+	pcapngOptionTimestampOffset  = 14
+	pcapngMaxBlockLength         = 16 * 1024 * 1024
+	pcapngDefaultUnitsPerSecond  = 1000000
+	pcapngMaxDecimalResolution   = 19
+	pcapngMaxBinaryResolution    = 63
+	pcapngTimestampResBinaryFlag = 0x80
+)
+
+// isPcapngFile returns whether the file is in the pcapng format rather than
+// the classic pcap format, by its first bytes.
+func isPcapngFile(fname string) (bool, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, len(pcapngMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, pcapngMagic), nil
+}
+
+// pcapngInterface holds what is needed to read the packets captured on an
+// interface of a pcapng file.
+type pcapngInterface struct {
+	linkType        layers.LinkType
+	unitsPerSecond  uint64
+	timestampOffset int64
+}
+
+// timestamp converts a packet timestamp, in the units of the interface, to a
+// time, keeping nanoseconds where the interface records them.
+func (iface *pcapngInterface) timestamp(ts uint64) time.Time {
+	secs := ts / iface.unitsPerSecond
+	frac := ts % iface.unitsPerSecond
+	var nanos uint64
+	switch {
+	case 1e9%iface.unitsPerSecond == 0:
+		nanos = frac * (1e9 / iface.unitsPerSecond)
+	case iface.unitsPerSecond%1e9 == 0:
+		nanos = frac / (iface.unitsPerSecond / 1e9)
+	default:
+		nanos = uint64(float64(frac) * 1e9 / float64(iface.unitsPerSecond))
+	}
+	return time.Unix(int64(secs)+iface.timestampOffset, int64(nanos))
+}
+
+// pcapngReader reads the packets of a pcapng file, which may have been
+// captured on several interfaces with different link types. It is both the
+// source of the packets and the decoder for them, decoding each packet with
+// the link type of the interface it was read from.
+type pcapngReader struct {
+	file       *os.File
+	r          *bufio.Reader
+	byteOrder  binary.ByteOrder
+	interfaces []pcapngInterface
+	linkType   layers.LinkType
+
+	// filter, if set, is the BPF filter packets must match to be read
+	filter *pcap.BPF
+}
+
+// openPcapngFile opens a pcapng file, applying the BPF filter expression to
+// its packets if one is given.
+func openPcapngFile(fname string, expression string) (*pcapngReader, error) {
+	var filter *pcap.BPF
+	if expression != "" {
+		// compile the filter with libpcap, which can read the file but not
+		// its nanosecond timestamps or interfaces of different link types
+		handle, err := pcap.OpenOffline(fname)
+		if err != nil {
+			return nil, fmt.Errorf("error opening pcapng file to compile packet filter expression: %v", err)
+		}
+		filter, err = handle.NewBPF(expression)
+		handle.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error setting packet filter expression: %v", err)
+		}
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapngReader{file: file, r: bufio.NewReader(file), filter: filter}, nil
+}
+
+// ReadPacketData reads the next packet, skipping the blocks that don't hold
+// packets. It returns io.EOF at the end of the file, after which the file is
+// closed.
+func (reader *pcapngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := reader.readPacketData()
+		if err != nil {
+			reader.file.Close()
+			return nil, ci, err
+		}
+		if data == nil {
+			continue
+		}
+		if reader.filter != nil && (len(data) == 0 || !reader.filter.Matches(ci, data)) {
+			continue
+		}
+		return data, ci, nil
+	}
+}
+
+// Decode decodes a packet with the link type of the interface it was read
+// from.
+func (reader *pcapngReader) Decode(data []byte, p gopacket.PacketBuilder) error {
+	return reader.linkType.Decode(data, p)
+}
+
+// readPacketData reads the next block, returning its packet if it holds one.
+func (reader *pcapngReader) readPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	ci := gopacket.CaptureInfo{}
+	blockType, body, err := reader.readBlock()
+	if err != nil {
+		return nil, ci, err
+	}
+	switch blockType {
+	case pcapngSectionHeaderBlock:
+		return nil, ci, nil
+	case pcapngInterfaceBlock:
+		return nil, ci, reader.readInterface(body)
+	case pcapngEnhancedPacketBlock, pcapngObsoletePacketBlock:
+		var ifaceID, tsHigh, tsLow, capLen, length uint32
+		if len(body) < 20 {
+			return nil, ci, fmt.Errorf("pcapng packet block of %v bytes is too short", len(body))
+		}
+		if blockType == pcapngEnhancedPacketBlock {
+			ifaceID = reader.byteOrder.Uint32(body[0:])
+		} else {
+			ifaceID = uint32(reader.byteOrder.Uint16(body[0:]))
+		}
+		tsHigh = reader.byteOrder.Uint32(body[4:])
+		tsLow = reader.byteOrder.Uint32(body[8:])
+		capLen = reader.byteOrder.Uint32(body[12:])
+		length = reader.byteOrder.Uint32(body[16:])
+		if int(ifaceID) >= len(reader.interfaces) {
+			return nil, ci, fmt.Errorf("pcapng packet block for undescribed interface %v", ifaceID)
+		}
+		if uint64(capLen) > uint64(len(body)-20) {
+			return nil, ci, fmt.Errorf("pcapng packet block of %v bytes can't hold %v captured bytes", len(body), capLen)
+		}
+		iface := &reader.interfaces[ifaceID]
+		reader.linkType = iface.linkType
+		ci.Timestamp = iface.timestamp(uint64(tsHigh)<<32 | uint64(tsLow))
+		ci.CaptureLength = int(capLen)
+		ci.Length = int(length)
+		return body[20 : 20+capLen], ci, nil
+	case pcapngSimplePacketBlock:
+		// simple packets have no timestamp to assemble them by
+		toolDebugLogger.Logv(DebugHigh, "Skipping pcapng simple packet block")
+	}
+	return nil, ci, nil
+}
+
+// readInterface reads an interface description block, noting the link type
+// and timestamp resolution of the interface.
+func (reader *pcapngReader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("pcapng interface block of %v bytes is too short", len(body))
+	}
+	iface := pcapngInterface{
+		linkType:       layers.LinkType(reader.byteOrder.Uint16(body[0:])),
+		unitsPerSecond: pcapngDefaultUnitsPerSecond,
+	}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := reader.byteOrder.Uint16(options[0:])
+		length := int(reader.byteOrder.Uint16(options[2:]))
+		if 4+length > len(options) {
+			return fmt.Errorf("pcapng interface option %v of %v bytes overruns its block", code, length)
+		}
+		value := options[4 : 4+length]
+		switch {
+		case code == 0:
+			options = nil
+			continue
+		case code == pcapngOptionTimestampRes && length == 1:
+			resolution := uint(value[0] &^ pcapngTimestampResBinaryFlag)
+			if value[0]&pcapngTimestampResBinaryFlag != 0 {
+				if resolution > pcapngMaxBinaryResolution {
+					return fmt.Errorf("unsupported pcapng timestamp resolution 2^-%v", resolution)
+				}
+				iface.unitsPerSecond = 1 << resolution
+			} else {
+				if resolution > pcapngMaxDecimalResolution {
+					return fmt.Errorf("unsupported pcapng timestamp resolution 10^-%v", resolution)
+				}
+				iface.unitsPerSecond = 1
+				for i := uint(0); i < resolution; i++ {
+					iface.unitsPerSecond *= 10
+				}
+			}
+		case code == pcapngOptionTimestampOffset && length == 8:
+			iface.timestampOffset = int64(reader.byteOrder.Uint64(value))
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	reader.interfaces = append(reader.interfaces, iface)
+	return nil
+}
+
+// readBlock reads the next block, returning its type and body. A section
+// header block sets the byte order of the blocks of its section, and clears
+// the interfaces described in the previous one.
+func (reader *pcapngReader) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("pcapng file ends in a truncated block")
+		}
+		return 0, nil, err
+	}
+	if bytes.Equal(header[:4], pcapngMagic) {
+		// the byte order follows the length, so peek at it to read the length
+		magic, err := reader.r.Peek(4)
+		if err != nil {
+			return 0, nil, fmt.Errorf("pcapng file ends in a truncated section header: %v", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+			reader.byteOrder = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+			reader.byteOrder = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid pcapng byte order magic %x", magic)
+		}
+		reader.interfaces = nil
+	} else if reader.byteOrder == nil {
+		return 0, nil, fmt.Errorf("pcapng file doesn't start with a section header")
+	}
+
+	blockType := reader.byteOrder.Uint32(header[0:])
+	length := reader.byteOrder.Uint32(header[4:])
+	if length < 12 || length%4 != 0 || length > pcapngMaxBlockLength {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %v", length)
+	}
+	rest := make([]byte, length-8)
+	if _, err := io.ReadFull(reader.r, rest); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("pcapng file ends in a truncated block")
+		}
+		return 0, nil, err
+	}
+	if trailer := reader.byteOrder.Uint32(rest[len(rest)-4:]); trailer != length {
+		return 0, nil, fmt.Errorf("pcapng block length %v doesn't match its trailing length %v", length, trailer)
+	}
+	return blockType, rest[:len(rest)-4], nil
+}
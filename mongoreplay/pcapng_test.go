@@ -0,0 +1,140 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsPcapngFile(t *testing.T) {
+	for fname, expected := range map[string]bool{
+		"compressed.pcap":   false,
+		"compressed.pcapng": true,
+	} {
+		isPcapng, err := isPcapngFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isPcapng != expected {
+			t.Errorf("expected %v to be pcapng: %v, got %v", fname, expected, isPcapng)
+		}
+	}
+}
+
+func TestPcapngTimestamp(t *testing.T) {
+	cases := []struct {
+		iface    pcapngInterface
+		ts       uint64
+		expected time.Time
+	}{
+		{pcapngInterface{unitsPerSecond: 1000000}, 1500000123456, time.Unix(1500000, 123456000)},
+		{pcapngInterface{unitsPerSecond: 1000000000}, 1500000123456789, time.Unix(1500000, 123456789)},
+		{pcapngInterface{unitsPerSecond: 1000000000000}, 1500000123456789123, time.Unix(1500000, 123456789)},
+		{pcapngInterface{unitsPerSecond: 1 << 10}, 10*1024 + 512, time.Unix(10, 500000000)},
+		{pcapngInterface{unitsPerSecond: 1000000, timestampOffset: 100}, 1000000, time.Unix(101, 0)},
+	}
+	for _, c := range cases {
+		if actual := c.iface.timestamp(c.ts); !actual.Equal(c.expected) {
+			t.Errorf("expected %v at %v units per second to be %v, got %v", c.ts, c.iface.unitsPerSecond, c.expected, actual)
+		}
+	}
+}
+
+// recordedOpsFromPcap records the ops in a pcap file to a tape, and reads them
+// back.
+func recordedOpsFromPcap(t *testing.T, pcapFile string) []*RecordedOp {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tape := filepath.Join(dir, "tape")
+
+	ctx, err := getOpstream(OpStreamSettings{PcapFile: pcapFile, PacketBufSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackWriter, err := NewPlaybackWriter(tape, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(ctx, []*PlaybackWriter{playbackWriter}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewPlaybackFileReader(tape, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []*RecordedOp
+	for {
+		op, err := reader.NextRecordedOp()
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+func TestRecordPcapng(t *testing.T) {
+	// the pcapng fixture holds the packets of the pcap one, alternately on
+	// an ethernet interface with nanosecond timestamps and a raw IP
+	// interface with microsecond timestamps
+	pcapOps := recordedOpsFromPcap(t, "compressed.pcap")
+	pcapngOps := recordedOpsFromPcap(t, "compressed.pcapng")
+	if len(pcapOps) == 0 || len(pcapngOps) != len(pcapOps) {
+		t.Fatalf("expected the same ops from both files, got %v and %v", len(pcapOps), len(pcapngOps))
+	}
+	var nanos int
+	for i := range pcapOps {
+		if !bytes.Equal(pcapOps[i].Body, pcapngOps[i].Body) || pcapOps[i].ConnectionString() != pcapngOps[i].ConnectionString() {
+			t.Errorf("op %v differs between the pcap and pcapng files", i)
+		}
+		if delta := pcapngOps[i].Seen.Sub(pcapOps[i].Seen.Time); delta < 0 || delta >= time.Microsecond {
+			t.Errorf("expected op %v to be seen within a microsecond of %v, got %v", i, pcapOps[i].Seen, pcapngOps[i].Seen)
+		}
+		if pcapngOps[i].Seen.Nanosecond()%1000 != 0 {
+			nanos++
+		}
+	}
+	if nanos == 0 {
+		t.Errorf("expected some ops to be seen with nanosecond timestamps")
+	}
+}
+
+func TestPcapngErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixture, err := ioutil.ReadFile("compressed.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.pcapng")
+	if err := ioutil.WriteFile(truncated, fixture[:len(fixture)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := openPcapngFile(truncated, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err = reader.ReadPacketData()
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		t.Errorf("expected an error reading a truncated pcapng file")
+	}
+}
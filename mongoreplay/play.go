@@ -5,22 +5,89 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/options"
 )
 
 // PlayCommand stores settings for the mongoreplay 'play' subcommand
 type PlayCommand struct {
 	GlobalOpts *Options `no-flag:"true"`
 	StatOptions
-	PlaybackFile string  `description:"path to the playback file to play from" short:"p" long:"playback-file" required:"yes"`
-	Speed        float64 `description:"multiplier for playback speed (1.0 = real-time, .5 = half-speed, 3.0 = triple-speed, etc.)" long:"speed" default:"1.0"`
-	URL          string  `short:"h" long:"host" description:"Location of the host to play back against" default:"mongodb://localhost:27017"`
-	Repeat       int     `long:"repeat" description:"Number of times to play the playback file" default:"1"`
-	QueueTime    int     `long:"queueTime" description:"don't queue ops much further in the future than this number of seconds" default:"15"`
-	NoPreprocess bool    `long:"no-preprocess" description:"don't preprocess the input file to premap data such as mongo cursorIDs"`
-	Gzip         bool    `long:"gzip" description:"decompress gzipped input"`
+	options.Connection
+	options.SSL
+	TargetAuth
+	PlaybackFile    string  `description:"path to the playback file to play from" short:"p" long:"playback-file" required:"yes"`
+	Speed           float64 `description:"multiplier for playback speed (1.0 = real-time, .5 = half-speed, 3.0 = triple-speed, etc.)" long:"speed" default:"1.0"`
+	Repeat          int     `long:"repeat" description:"Number of times to play the playback file" default:"1"`
+	QueueTime       int     `long:"queueTime" description:"don't queue ops much further in the future than this number of seconds" default:"15"`
+	OpChanBuffer    int     `long:"opChanBuffer" value-name:"<ops>" description:"number of ops read from the playback file ahead of playing them, so that reading keeps up with fast targets; larger buffers hold more ops in memory at once" default:"1000"`
+	NoPreprocess    bool    `long:"no-preprocess" description:"don't preprocess the input file to premap data such as mongo cursorIDs, or check that the target supports the ops in it"`
+	Gzip            bool    `long:"gzip" description:"decompress gzipped input"`
+	AnonymizeValues bool    `long:"anonymizeValues" description:"replace literal values in query filters with placeholders of the same type, keeping the leading anchor of regular expressions, and the JavaScript of $where clauses with one matching every document"`
+	Serial          bool    `long:"serial" description:"play ops one at a time in recorded order on a single connection, waiting for each reply, instead of with their recorded concurrency"`
+	SkipHandshake   bool    `long:"skipHandshake" description:"drop the recorded connection handshake and authentication ops, relying on the connection to the target made with the credentials in a --host URI"`
+
+	AutoConcurrency bool `long:"autoConcurrency" description:"play the recorded connections over as many connections to the target as the most ops the playback file had in flight at once, found while preprocessing it, instead of each on its own connection"`
+	MaxConnections  int  `long:"maxConnections" value-name:"<count>" description:"most connections to the target to open with --autoConcurrency" default:"1000"`
+
+	WarmConnections bool `long:"warmConnections" description:"before playing the first op, open and authenticate the connections the playback will use on the target, one for each recorded connection unless --serial or --autoConcurrency play them on fewer, so that connection and TLS or authentication handshakes aren't timed as part of the first ops"`
+
+	NamespaceSpeeds []string `long:"nsSpeed" value-name:"<db>.<collection>=<speed>" description:"play the ops on this namespace at this speed multiplier instead of --speed, keeping the ops of each connection in order (may be given multiple times, or as a comma-separated list)"`
+	NamespaceLimits []string `long:"nsMaxConcurrency" value-name:"<db>.<collection>=<count>" description:"have at most this many ops on this namespace, as played after any --nsFrom renaming, in flight on the target at once; an op over the limit waits for another to be answered, holding up the later ops of its connection, and the ops that waited are reported at the end (may be given multiple times, or as a comma-separated list)"`
+
+	Plan               bool  `long:"plan" description:"print a summary of the ops that would be played, their namespaces and connections, and the recorded and estimated replay durations, without playing them"`
+	ConnectionID       int64 `long:"connectionId" value-name:"<id>" description:"only play the ops of the recorded connection with this id, as shown in the connection_num of the stats of monitor" default:"-1" default-mask:"-"`
+	MinRecordedLatency int   `long:"minRecordedLatency" value-name:"<ms>" description:"only play the ops whose recorded reply came more than this number of milliseconds after them in the capture"`
+
+	ReadPreference     string   `long:"readPreference" value-name:"<mode>" description:"play queries and their cursors with this read preference mode (primary, primaryPreferred, secondary, secondaryPreferred or nearest); all other ops go to the primary; may also be given as readPreference in a --host URI" default:"primary"`
+	ReadPreferenceTags []string `long:"readPreferenceTags" value-name:"<name:value,...>" description:"tag set to select members for reads with --readPreference (may be given multiple times, in order of preference)"`
+
+	RunID             string   `long:"runId" value-name:"<id>" description:"id of this playback, added as a comment to played queries (and on 4.4+ targets, all commands) to tell its ops apart on the target (defaults to a random UUID)"`
+	MaxErrorRate      []string `long:"maxErrorRate" value-name:"<op type>=<percent>" description:"exit with an error if more than this percentage of the ops of an op type fail, naming op types as in the stats (e.g. 'query' or 'command find'), or 'all' for every op (may be given multiple times)"`
+	CreateCollections bool     `long:"createCollections" description:"before playing, create the collections created in the playback file on the target with the same options, such as capped, size and validator"`
+	Collation         string   `long:"collation" value-name:"<json>" description:"collation document, e.g. '{\"locale\": \"fr\", \"strength\": 2}', added to the find and aggregate commands played without one, so that they match the results of the recorded environment when the target has a different default collation"`
+
+	CheckShardKeys string   `long:"checkShardKeys" value-name:"<action>" description:"before playing, fetch the shard keys of the sharded collections of a mongos target and check while preprocessing that the documents inserted into them carry every field of their key, which the target would reject them without: warn (log the namespaces whose inserts lack fields of their key) or abort (also refuse to play)" choice:"warn" choice:"abort"`
+	AddShardKey    []string `long:"addShardKey" value-name:"<db>.<collection>=<json>" description:"fields to add to the documents inserted into a namespace that lack them, e.g. 'app.users={\"tenant\": \"replay\"}', to play inserts into a target sharded on a key the recorded documents don't carry; a string value starting with $, e.g. '{\"userId\": \"$_id\"}', copies the value of that field of the document instead (may be given multiple times)"`
+
+	BatchSize int `long:"batchSize" value-name:"<docs>" description:"play finds, aggregates and getmores with this batch size instead of the recorded one, to see how the target copes with smaller or larger batches; only the recorded getmores are played, so with smaller batches a cursor may be left open, and with larger ones the getmores on a cursor the target has run out of are skipped"`
+
+	Compressors []string `long:"compressors" value-name:"<compressor>[,<compressor>...]" description:"ask the target for wire compression with these compressors, in order of preference, in the handshake of each connection, and send the ops compressed with the one it agrees to, reporting which it was; recorded compressed ops are otherwise played decompressed. Only snappy and zlib are supported: zstd, which no package available to mongoreplay implements, is left out of the handshakes, and can't be given alone (may be given multiple times, or as a comma-separated list; may also be given as compressors in a --host URI)"`
+
+	Checksum bool `long:"checksum" description:"send every OP_MSG ending in a CRC-32C checksum, for targets that expect one; the OP_MSGs recorded with a checksum are always sent with one, computed afresh as they are played with new request ids"`
+
+	OpTimeout time.Duration `long:"opTimeout" value-name:"<duration>" description:"time limit of each played op (e.g. 5s), given as maxTimeMS to the finds, aggregates and other commands that accept one unless recorded with a lower one; an op still unanswered a second past it has its connection dropped, and ops over the limit are counted as timeouts apart from other errors, so that a few slow ops can't stall the playback"`
+
+	NSFrom []string `long:"nsFrom" value-name:"<namespace-pattern>" description:"play the ops on namespaces matching this pattern, e.g. 'prod.*', on the namespace given by the matching --nsTo, e.g. 'test_prod.*', renaming the collections named by commands too (may be given multiple times, paired with --nsTo in order)"`
+	NSTo   []string `long:"nsTo" value-name:"<namespace-pattern>" description:"namespace to play the ops matched by the --nsFrom in the same position on"`
+
+	CountWriteErrors bool `long:"countWriteErrors" description:"count the ops that succeeded but had some of their writes fail, or their write concern unsatisfied, as failed for --maxErrorRate; they are always reported apart from the ops that failed"`
+
+	FaultRate  float64  `long:"faultRate" value-name:"<percent>" description:"inject a fault into this percentage of the played ops, to test how an application copes with a misbehaving database"`
+	FaultTypes []string `long:"faultType" value-name:"<type>" description:"type of fault to inject with --faultRate: delay (play the op late), drop (don't send the op) or error (don't send the op and record a synthetic error for it); may be given multiple times, and defaults to all types"`
+	FaultDelay int      `long:"faultDelay" value-name:"<ms>" description:"number of milliseconds to delay ops by with the delay fault type" default:"1000"`
+	FaultSeed  int64    `long:"faultSeed" value-name:"<seed>" description:"seed choosing the ops to fault and how, to inject the same faults as an earlier playback (defaults to a random seed, which is logged)"`
+
+	SummaryFile string `long:"summaryFile" value-name:"<filename>" description:"when done, write a JSON summary of the playback to this file, or to stdout if '-': the counts of ops, errors and write errors, latency percentiles, duration and settings, and whether it completed, was interrupted, exceeded --maxErrorRate or failed"`
+
+	SnapshotFile string `long:"snapshotFile" value-name:"<filename>" description:"on each SIGUSR1, write a JSON summary of the playback so far to this file, in the format of --summaryFile with an exit_reason of running, replacing the last one, without stopping the playback (not supported on Windows)"`
+
+	OnNegativeDelta string `long:"onNegativeDelta" description:"what to do with ops seen before the op ahead of them in the playback file, as in a capture with out-of-order timestamps: clamp (play them right after it, and report how many there were) or fail (stop the playback)" choice:"clamp" choice:"fail" default:"clamp"`
+
+	StartAt string `long:"startAt" value-name:"<time>" description:"wait until this RFC3339 time (e.g. 2017-03-04T05:06:07Z) to play the first op, to start several playbacks together"`
+
+	LoopCooldown        time.Duration `long:"loopCooldown" value-name:"<duration>" description:"with --repeat, once the ops of a repetition have been sent, pause for this long (e.g. 30s) before playing the next, so that the target can settle between them; the stats of each repetition are reported separately"`
+	LoopCooldownCommand string        `long:"loopCooldownCommand" description:"command to run on the target at the start of each --loopCooldown: fsync to flush writes to disk, flushRouterConfig to reload the config of a mongos, or none" choice:"none" choice:"fsync" choice:"flushRouterConfig" default:"none"`
+
+	Synthesize         bool          `long:"synthesize" description:"instead of replaying the recorded ops, learn the mix of op types, namespaces and query shapes of the playback file while preprocessing it, and play copies of its ops in that mix at --rate, giving the documents they insert or upsert new _ids; getmores, killcursors and handshakes aren't synthesized"`
+	Rate               float64       `long:"rate" value-name:"<ops/sec>" description:"number of ops per second to play with --synthesize, spread over as many connections as the playback file has"`
+	SynthesizeDuration time.Duration `long:"synthesizeDuration" value-name:"<duration>" description:"how long to play synthetic ops for with --synthesize (e.g. 10m; defaults to the recorded duration of the playback file)"`
+	SynthesizeSeed     int64         `long:"synthesizeSeed" value-name:"<seed>" description:"seed choosing the synthetic ops, to play the same ops as an earlier playback of the same file (defaults to a random seed, which is logged)"`
 }
 
 const queueGranularity = 1000
@@ -31,7 +98,15 @@ const queueGranularity = 1000
 // returned by the function.
 // The error chan won't be readable until the recorded op chan gets closed.
 func NewOpChanFromFile(file *PlaybackFileReader, repeat int) (<-chan *RecordedOp, <-chan error) {
-	ch := make(chan *RecordedOp)
+	return NewBufferedOpChanFromFile(file, repeat, 0)
+}
+
+// NewBufferedOpChanFromFile is like NewOpChanFromFile, but lets the reading
+// goroutine get up to buffer ops ahead of the reader of the recorded op chan,
+// so that reading and unmarshaling the file overlaps with what is done with
+// the ops. At most buffer ops are held in memory beyond those being handled.
+func NewBufferedOpChanFromFile(file *PlaybackFileReader, repeat, buffer int) (<-chan *RecordedOp, <-chan error) {
+	ch := make(chan *RecordedOp, buffer)
 	e := make(chan error)
 
 	var last time.Time
@@ -61,6 +136,7 @@ func NewOpChanFromFile(file *PlaybackFileReader, repeat int) (<-chan *RecordedOp
 					if first.IsZero() {
 						first = recordedOp.Seen.Time
 					}
+					recordedOp.RecordedAt = &PreciseTime{recordedOp.Seen.Time}
 					recordedOp.Seen.Time = recordedOp.Seen.Add(loopDelta)
 					recordedOp.Generation = generation
 					recordedOp.Order = order
@@ -85,6 +161,44 @@ func NewOpChanFromFile(file *PlaybackFileReader, repeat int) (<-chan *RecordedOp
 	return ch, e
 }
 
+// observeOps passes the ops from opChan through to the returned channel,
+// calling each of the observers on them.
+func observeOps(opChan <-chan *RecordedOp, observers ...func(*RecordedOp)) <-chan *RecordedOp {
+	out := make(chan *RecordedOp)
+	go func() {
+		defer close(out)
+		for op := range opChan {
+			for _, observe := range observers {
+				observe(op)
+			}
+			out <- op
+		}
+	}()
+	return out
+}
+
+// filterOps passes on only the ops from opChan that keep returns true for.
+func filterOps(opChan <-chan *RecordedOp, keep func(*RecordedOp) bool) <-chan *RecordedOp {
+	out := make(chan *RecordedOp)
+	go func() {
+		defer close(out)
+		for op := range opChan {
+			if keep(op) {
+				out <- op
+			}
+		}
+	}()
+	return out
+}
+
+// connectionFilter returns a filter for filterOps that keeps the ops of the
+// recorded connection with the given id.
+func connectionFilter(connectionID int64) func(*RecordedOp) bool {
+	return func(op *RecordedOp) bool {
+		return op.SeenConnectionNum == connectionID
+	}
+}
+
 // GzipReadSeeker wraps an io.ReadSeeker for gzip reading
 type GzipReadSeeker struct {
 	readSeeker io.ReadSeeker
@@ -114,14 +228,57 @@ func (g *GzipReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return 0, nil
 }
 
+// Close closes the gzip reader and the underlying file.
+func (g *GzipReadSeeker) Close() error {
+	err := g.Reader.Close()
+	if closer, ok := g.readSeeker.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // PlaybackFileReader stores the necessary information for a playback source,
 // which is just an io.ReadCloser.
 type PlaybackFileReader struct {
 	io.ReadSeeker
 }
 
-// NewPlaybackFileReader initializes a new PlaybackFileReader
+// Close closes the playback file, or each of a series of them.
+func (file *PlaybackFileReader) Close() error {
+	if closer, ok := file.ReadSeeker.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewPlaybackFileReader initializes a new PlaybackFileReader. If there is no
+// file by the given name, but a series of files recorded with it as the base
+// name of --maxOpsPerFile or --maxBytesPerFile, they are read in order.
 func NewPlaybackFileReader(filename string, gzip bool) (*PlaybackFileReader, error) {
+	filenames := playbackFileNames(filename)
+	if len(filenames) == 1 {
+		readSeeker, err := openPlaybackFile(filenames[0], gzip)
+		if err != nil {
+			return nil, err
+		}
+		return &PlaybackFileReader{readSeeker}, nil
+	}
+
+	userInfoLogger.Logvf(Info, "Reading playback files %v.0 to %v.%d", filename, filename, len(filenames)-1)
+	series := &playbackFileSeries{}
+	for _, name := range filenames {
+		readSeeker, err := openPlaybackFile(name, gzip)
+		if err != nil {
+			return nil, err
+		}
+		series.files = append(series.files, readSeeker)
+	}
+	return &PlaybackFileReader{series}, nil
+}
+
+func openPlaybackFile(filename string, gzip bool) (io.ReadSeeker, error) {
 	var readSeeker io.ReadSeeker
 
 	readSeeker, err := os.Open(filename)
@@ -136,7 +293,7 @@ func NewPlaybackFileReader(filename string, gzip bool) (*PlaybackFileReader, err
 		}
 	}
 
-	return &PlaybackFileReader{readSeeker}, nil
+	return readSeeker, nil
 }
 
 // NextRecordedOp iterates through the PlaybackFileReader to yield the next
@@ -154,6 +311,9 @@ func (file *PlaybackFileReader) NextRecordedOp() (*RecordedOp, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unmarshal RecordedOp Error: %v\n", err)
 	}
+	if doc.TapeVersion > currentTapeVersion {
+		return nil, fmt.Errorf("playback file is in tape format version %v, but only versions up to %v can be read", doc.TapeVersion, currentTapeVersion)
+	}
 
 	return doc, nil
 }
@@ -167,38 +327,415 @@ func (play *PlayCommand) ValidateParams(args []string) error {
 		return fmt.Errorf("Invalid setting for --speed: '%v'", play.Speed)
 	case play.Repeat < 1:
 		return fmt.Errorf("Invalid setting for --repeat: '%v', value must be >=1", play.Repeat)
+	case play.ConnectionID < -1:
+		return fmt.Errorf("Invalid setting for --connectionId: '%v', value must be >=0", play.ConnectionID)
+	case play.OpChanBuffer < 0:
+		return fmt.Errorf("Invalid setting for --opChanBuffer: '%v', value must be >=0", play.OpChanBuffer)
+	case play.OpTimeout < 0:
+		return fmt.Errorf("Invalid setting for --opTimeout: '%v', value must be >=0", play.OpTimeout)
+	case play.OpTimeout > 0 && play.OpTimeout < time.Millisecond:
+		return fmt.Errorf("Invalid setting for --opTimeout: '%v', value must be at least 1ms", play.OpTimeout)
+	case play.BatchSize < 0:
+		return fmt.Errorf("Invalid setting for --batchSize: '%v', value must be >=0", play.BatchSize)
+	case play.MinRecordedLatency < 0:
+		return fmt.Errorf("Invalid setting for --minRecordedLatency: '%v', value must be >=0", play.MinRecordedLatency)
+	case play.CreateCollections && play.NoPreprocess:
+		return fmt.Errorf("--createCollections can't be used with --no-preprocess")
+	case len(play.MaxErrorRate) > 0 && play.Collect == "none":
+		return fmt.Errorf("--maxErrorRate can't be used with --collect none")
+	case play.CheckShardKeys != "" && (play.NoPreprocess || play.Plan):
+		return fmt.Errorf("--checkShardKeys can't be used with --no-preprocess or --plan")
+	case play.SummaryFile != "" && (play.Collect == "none" || play.Plan):
+		return fmt.Errorf("--summaryFile can't be used with --collect none or --plan")
+	case play.SnapshotFile != "" && (play.Collect == "none" || play.Plan):
+		return fmt.Errorf("--snapshotFile can't be used with --collect none or --plan")
+	case play.SnapshotFile == "-":
+		return fmt.Errorf("Invalid setting for --snapshotFile: '-', value must name a file")
+	case play.SnapshotFile != "" && len(snapshotSignals) == 0:
+		return fmt.Errorf("--snapshotFile isn't supported on this platform")
+	case play.CountWriteErrors && len(play.MaxErrorRate) == 0:
+		return fmt.Errorf("--countWriteErrors can only be used with --maxErrorRate")
+	case len(play.FaultTypes) > 0 && play.FaultRate == 0:
+		return fmt.Errorf("--faultType can only be used with --faultRate")
+	case play.LoopCooldown < 0:
+		return fmt.Errorf("Invalid setting for --loopCooldown: '%v', value must be >=0", play.LoopCooldown)
+	case play.LoopCooldown > 0 && play.Repeat < 2:
+		return fmt.Errorf("--loopCooldown can only be used with --repeat")
+	case play.LoopCooldownCommand != "" && play.LoopCooldownCommand != "none" && play.LoopCooldown == 0:
+		return fmt.Errorf("--loopCooldownCommand can only be used with --loopCooldown")
+	case play.Synthesize && play.Rate <= 0:
+		return fmt.Errorf("--synthesize needs a positive --rate of ops per second")
+	case !play.Synthesize && (play.Rate != 0 || play.SynthesizeDuration != 0 || play.SynthesizeSeed != 0):
+		return fmt.Errorf("--rate, --synthesizeDuration and --synthesizeSeed can only be used with --synthesize")
+	case play.Synthesize && (play.NoPreprocess || play.Plan || play.Repeat > 1):
+		return fmt.Errorf("--synthesize can't be used with --no-preprocess, --plan or --repeat")
+	case play.AutoConcurrency && (play.Serial || play.NoPreprocess):
+		return fmt.Errorf("--autoConcurrency can't be used with --serial or --no-preprocess")
+	case play.WarmConnections && (play.NoPreprocess || play.Plan):
+		return fmt.Errorf("--warmConnections can't be used with --no-preprocess or --plan")
+	case play.MaxConnections < 1:
+		return fmt.Errorf("Invalid setting for --maxConnections: '%v', value must be >=1", play.MaxConnections)
+	case play.SynthesizeDuration < 0:
+		return fmt.Errorf("Invalid setting for --synthesizeDuration: '%v', value must be >=0", play.SynthesizeDuration)
+	}
+	if _, err := ParseReadPreference(play.ReadPreference, play.ReadPreferenceTags); err != nil {
+		return fmt.Errorf("Invalid setting for --readPreference: %v", err)
+	}
+	url, err := targetURL(play.Host, play.Port)
+	if err != nil {
+		return err
+	}
+	_, uriOpts, _, err := parseTargetURI(url)
+	if err != nil {
+		return fmt.Errorf("Invalid setting for --host: %v", err)
+	}
+	if uriOpts.ReadPreference != "" && (play.ReadPreference != "" && play.ReadPreference != "primary" ||
+		len(play.ReadPreferenceTags) > 0) {
+		return fmt.Errorf("--readPreference and --readPreferenceTags can't be used with a readPreference in the --host URI")
+	}
+	if _, err := newTLSConfig(play.SSL); err != nil {
+		return err
+	}
+	if err := play.TargetAuth.validate(play.SSL); err != nil {
+		return err
+	}
+	if _, err := ParseErrorRateThresholds(play.MaxErrorRate); err != nil {
+		return fmt.Errorf("Invalid setting for --maxErrorRate: %v", err)
+	}
+	if _, err := ParseNamespaceSpeeds(play.NamespaceSpeeds); err != nil {
+		return fmt.Errorf("Invalid setting for --nsSpeed: %v", err)
+	}
+	if _, err := ParseNamespaceConcurrency(play.NamespaceLimits); err != nil {
+		return fmt.Errorf("Invalid setting for --nsMaxConcurrency: %v", err)
+	}
+	if _, err := play.faultInjector(); err != nil {
+		return fmt.Errorf("Invalid setting for fault injection: %v", err)
+	}
+	if _, _, err := ParseCompressors(play.Compressors); err != nil {
+		return fmt.Errorf("Invalid setting for --compressors: %v", err)
+	}
+	if play.Collation != "" {
+		if _, err := ParseCollation(play.Collation); err != nil {
+			return fmt.Errorf("Invalid setting for --collation: %v", err)
+		}
+	}
+	if len(play.NSFrom) > 0 || len(play.NSTo) > 0 {
+		if _, err := newNsRenamer(play.NSFrom, play.NSTo); err != nil {
+			return fmt.Errorf("Invalid setting for --nsFrom and --nsTo: %v", err)
+		}
+	}
+	if _, err := play.startTime(); err != nil {
+		return fmt.Errorf("Invalid setting for --startAt: %v", err)
+	}
+	if _, err := ParseShardKeyDefaults(play.AddShardKey); err != nil {
+		return fmt.Errorf("Invalid setting for --addShardKey: %v", err)
 	}
 	return nil
 }
 
+// startTime returns the time to play the first op at, or the zero time if
+// playback should start straight away.
+func (play *PlayCommand) startTime() (time.Time, error) {
+	if play.StartAt == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, play.StartAt)
+}
+
+// faultInjector returns the faultInjector for the fault injection settings, or
+// nil if no faults should be injected.
+func (play *PlayCommand) faultInjector() (*faultInjector, error) {
+	if play.FaultRate == 0 {
+		return nil, nil
+	}
+	return newFaultInjector(play.FaultRate, play.FaultTypes,
+		time.Duration(play.FaultDelay)*time.Millisecond, play.FaultSeed)
+}
+
 // Execute runs the program for the 'play' subcommand
-func (play *PlayCommand) Execute(args []string) error {
-	err := play.ValidateParams(args)
+func (play *PlayCommand) Execute(args []string) (err error) {
+	err = play.ValidateParams(args)
 	if err != nil {
 		return err
 	}
 	play.GlobalOpts.SetLogging()
+	started := time.Now()
+
+	// write the summary however the playback ends, once it is set up
+	var summarize func(exitErr error) error
+	defer func() {
+		if summarize != nil {
+			if summaryErr := summarize(err); err == nil {
+				err = summaryErr
+			}
+		}
+	}()
+
+	playbackFileReader, err := NewPlaybackFileReader(play.PlaybackFile, play.Gzip)
+	if err != nil {
+		return err
+	}
+
+	var opChan <-chan *RecordedOp
+	var errChan <-chan error
+
+	// find the slow ops in the tape, to play only those
+	var slow *slowOps
+	if play.MinRecordedLatency > 0 {
+		opChan, errChan = NewOpChanFromFile(playbackFileReader, 1)
+		slow = newSlowOps(opChan, time.Duration(play.MinRecordedLatency)*time.Millisecond)
+		if err := <-errChan; err != io.EOF {
+			return fmt.Errorf("OpChan: %v", err)
+		}
+		if _, err := playbackFileReader.Seek(0, 0); err != nil {
+			return err
+		}
+	}
+
+	// filter keeps only the ops selected to be played
+	filter := func(opChan <-chan *RecordedOp) <-chan *RecordedOp {
+		if slow != nil {
+			opChan = slow.filter(opChan)
+		}
+		if play.ConnectionID >= 0 {
+			opChan = filterOps(opChan, connectionFilter(play.ConnectionID))
+		}
+		return opChan
+	}
+
+	// summarize the ops that would be played, without playing them
+	if play.Plan {
+		opChan, errChan = NewOpChanFromFile(playbackFileReader, 1)
+		opChan = filter(opChan)
+		plan := newReplayPlan()
+		for op := range opChan {
+			plan.observe(op)
+		}
+		if err := <-errChan; err != io.EOF {
+			return fmt.Errorf("OpChan: %v", err)
+		}
+		return plan.write(os.Stdout, play.Speed, play.Repeat)
+	}
 
 	statColl, err := newStatCollector(play.StatOptions, true, true)
 	if err != nil {
 		return err
 	}
+	thresholds, err := ParseErrorRateThresholds(play.MaxErrorRate)
+	if err != nil {
+		return err
+	}
+	if len(thresholds) > 0 || play.SummaryFile != "" || play.SnapshotFile != "" {
+		statColl.Totals = NewStatAggregate()
+	}
+	if play.Repeat > 1 {
+		statColl.aggregateByGeneration()
+	}
 	userInfoLogger.Logvf(Always, "Doing playback at %.2fx speed", play.Speed)
 
-	playbackFileReader, err := NewPlaybackFileReader(play.PlaybackFile, play.Gzip)
+	context := NewExecutionContext(statColl)
+	context.NamespaceSpeeds, err = ParseNamespaceSpeeds(play.NamespaceSpeeds)
 	if err != nil {
 		return err
 	}
+	for _, ns := range context.NamespaceSpeeds.namespaces() {
+		userInfoLogger.Logvf(Always, "Playing ops on %v at %.2fx speed", ns, context.NamespaceSpeeds[ns])
+	}
+	namespaceLimits, err := ParseNamespaceConcurrency(play.NamespaceLimits)
+	if err != nil {
+		return err
+	}
+	context.NamespaceLimits = newNamespaceLimits(namespaceLimits)
+	if context.NamespaceLimits != nil {
+		for _, ns := range context.NamespaceLimits.namespaces() {
+			userInfoLogger.Logvf(Always, "Playing at most %v ops at once on %v", namespaceLimits[ns], ns)
+		}
+	}
+	context.AnonymizeValues = play.AnonymizeValues
+	context.SkipHandshake = play.SkipHandshake
+	context.Serial = play.Serial
+	context.RunID = play.RunID
+	if context.RunID == "" {
+		if context.RunID, err = newRunID(); err != nil {
+			return err
+		}
+	}
+	userInfoLogger.Logvf(Always, "Playback run id: %v", context.RunID)
+	if context.ShardKeyDefaults, err = ParseShardKeyDefaults(play.AddShardKey); err != nil {
+		return err
+	}
 
-	context := NewExecutionContext(statColl)
+	var playErr error
+	if play.SummaryFile != "" {
+		summarize = func(exitErr error) error {
+			summary := newPlaybackSummary(context.RunID, started, time.Now(), statColl.snapshotTotals())
+			summary.Config = play.config()
+			if exitErr == nil {
+				exitErr = playErr
+			}
+			summary.setExit(exitErr)
+			return summary.write(play.SummaryFile)
+		}
 
-	var opChan <-chan *RecordedOp
-	var errChan <-chan error
+		// an interrupted playback writes its summary before exiting
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+		go func() {
+			s := <-sigChan
+			userInfoLogger.Logvf(Always, "Got signal %v, stopping playback", s)
+			summary := newPlaybackSummary(context.RunID, started, time.Now(), statColl.snapshotTotals())
+			summary.Config = play.config()
+			summary.ExitReason = exitInterrupted
+			if err := summary.write(play.SummaryFile); err != nil {
+				userInfoLogger.Logvf(Always, "%v", err)
+			}
+			os.Exit(128 + int(s.(syscall.Signal)))
+		}()
+	}
+	if play.SnapshotFile != "" {
+		snapshots := watchSnapshots(play.SnapshotFile, func() *playbackSummary {
+			summary := newPlaybackSummary(context.RunID, started, time.Now(), statColl.snapshotTotals())
+			summary.Config = play.config()
+			return summary
+		})
+		defer snapshots.stop()
+		userInfoLogger.Logvf(Always, "Send SIGUSR1 to process %v to write a snapshot of the playback to %v",
+			os.Getpid(), play.SnapshotFile)
+	}
+	if play.Collation != "" {
+		if context.Collation, err = ParseCollation(play.Collation); err != nil {
+			return err
+		}
+	}
+	if play.BatchSize > 0 {
+		context.BatchSize = newBatchSizeOverride(int32(play.BatchSize))
+	}
+	if len(play.NSFrom) > 0 {
+		if context.Renamer, err = newNsRenamer(play.NSFrom, play.NSTo); err != nil {
+			return err
+		}
+	}
+	context.ReadPreference, err = ParseReadPreference(play.ReadPreference, play.ReadPreferenceTags)
+	if err != nil {
+		return err
+	}
+	context.TLSConfig, err = newTLSConfig(play.SSL)
+	if err != nil {
+		return err
+	}
+	context.Credential, err = play.TargetAuth.credential(play.SSL)
+	if err != nil {
+		return err
+	}
+	context.Faults, err = play.faultInjector()
+	if err != nil {
+		return err
+	}
+	if context.Faults != nil {
+		userInfoLogger.Logvf(Always, "Injecting faults into %v%% of ops (seed %v)", play.FaultRate, context.Faults.seed)
+	}
+	context.DialTimeout = time.Duration(play.Timeout) * time.Second
+	var unsupported []string
+	context.Compressors, unsupported, err = ParseCompressors(play.Compressors)
+	if err != nil {
+		return err
+	}
+	if len(unsupported) > 0 {
+		userInfoLogger.Logvf(Always, "Warning: not asking the target for %v, which mongoreplay can't compress with",
+			strings.Join(unsupported, ", "))
+	}
+	context.StartAt, err = play.startTime()
+	if err != nil {
+		return err
+	}
+	context.LoopCooldown = play.LoopCooldown
+	context.OpTimeout = play.OpTimeout
+	context.Checksum = play.Checksum
+	context.NegativeDeltas = newNegativeDeltas(play.OnNegativeDelta == "fail")
+	if play.LoopCooldownCommand != "none" {
+		context.LoopCooldownCommand = play.LoopCooldownCommand
+	}
+	url, err := targetURL(play.Host, play.Port)
+	if err != nil {
+		return err
+	}
+	url, uriOpts, warnings, err := parseTargetURI(url)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		userInfoLogger.Logvf(Always, "Warning: %v", warning)
+	}
+	if err := context.applyURIOptions(uriOpts); err != nil {
+		return err
+	}
+	if len(context.Compressors) > 0 {
+		userInfoLogger.Logvf(Always, "Asking the target for wire compression with %v", strings.Join(context.Compressors, ", "))
+		context.Negotiated = newNegotiatedCompressors()
+	}
+
+	// find the version of the target, to check that it can play the tape and
+	// to report alongside the results; failing to is only a warning
+	versions := &ServerVersions{}
+	versions.Target, versions.TargetWireVersion, err = context.targetServerVersion(url)
+	if err != nil {
+		userInfoLogger.Logvf(Always, "Warning: %v", err)
+	}
+	context.TargetWireVersion = versions.TargetWireVersion
+	statColl.Versions = versions
+	if context.Collation != nil && versions.TargetWireVersion != 0 && versions.TargetWireVersion < collationWireVersion {
+		return fmt.Errorf("--collation needs a target of MongoDB 3.4 or later, but the target is %v", describeVersion(versions.Target, versions.TargetWireVersion))
+	}
+
+	// learn the mix of ops to synthesize while preprocessing
+	var model *loadModel
+	if play.Synthesize {
+		model = newLoadModel(play.SynthesizeSeed)
+	}
+
+	// fetch the shard keys of the target, to check that the tape's inserts
+	// carry them while preprocessing
+	var shardKeys *shardKeyCheck
+	if play.CheckShardKeys != "" {
+		keys, sharded, err := context.targetShardKeys(url)
+		switch {
+		case err != nil && play.CheckShardKeys == "abort":
+			return err
+		case err != nil:
+			userInfoLogger.Logvf(Always, "Warning: not checking shard keys: %v", err)
+		case !sharded:
+			userInfoLogger.Logvf(Always, "Warning: not checking shard keys, as the target isn't a mongos")
+		default:
+			shardKeys = newShardKeyCheck(keys, context.ShardKeyDefaults, context.Renamer)
+		}
+	}
 
 	if !play.NoPreprocess {
 		opChan, errChan = NewOpChanFromFile(playbackFileReader, 1)
+		opChan = filter(opChan)
 
-		preprocessMap, err := newPreprocessCursorManager(opChan)
+		// note the op codes in the tape while preprocessing, to make sure
+		// that the target can play them, and the collections it creates
+		opCodes := tapeOpCodes{}
+		creates := newTapeCreates()
+		transactions := newTransactionTracker()
+		truncated := &truncatedOps{}
+		observers := []func(*RecordedOp){opCodes.observe, versions.observe, transactions.observe, truncated.observe}
+		if shardKeys != nil {
+			observers = append(observers, shardKeys.observe)
+		}
+		if play.CreateCollections {
+			observers = append(observers, creates.observe)
+		}
+		if model != nil {
+			observers = append(observers, model.observe)
+		}
+		var estimate *tapeEstimate
+		if play.AutoConcurrency || play.WarmConnections {
+			estimate = newTapeEstimate()
+			observers = append(observers, estimate.observe)
+		}
+		preprocessMap, err := newPreprocessCursorManager(observeOps(opChan, observers...))
 
 		if err != nil {
 			return fmt.Errorf("PreprocessMap: %v", err)
@@ -208,28 +745,212 @@ func (play *PlayCommand) Execute(args []string) error {
 		if err != io.EOF {
 			return fmt.Errorf("OpChan: %v", err)
 		}
+		if shardKeys != nil {
+			if err := shardKeys.report(play.CheckShardKeys == "abort"); err != nil {
+				return err
+			}
+		}
+		if err := truncated.err(); err != nil {
+			return err
+		}
 
 		_, err = playbackFileReader.Seek(0, 0)
 		if err != nil {
 			return err
 		}
 		context.CursorIDMap = preprocessMap
+		context.Cursors.setRecorded(preprocessMap)
+		context.Transactions = transactions
+		transactions.warn()
+
+		if play.AutoConcurrency {
+			peak := estimate.peakInFlight()
+			context.Connections = newConnectionPool(autoConcurrency(peak, play.MaxConnections))
+			userInfoLogger.Logvf(Always, "Playing on %v connections, for the %v ops in flight at once at the peak of the recording (at most %v)",
+				context.Connections.size(), peak, play.MaxConnections)
+		}
+
+		if versions.TargetWireVersion != 0 {
+			if err := opCodes.checkTarget(versions.TargetWireVersion); err != nil {
+				return err
+			}
+		}
+
+		if play.CreateCollections {
+			session, err := context.dial(url)
+			if err != nil {
+				return fmt.Errorf("error connecting to target: %v", err)
+			}
+			if context.Renamer != nil {
+				creates.rename(context.Renamer)
+			}
+			err = creates.apply(session)
+			session.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		if play.WarmConnections {
+			// one connection is opened for each recorded connection unless
+			// they are played on fewer
+			warm := len(estimate.connections)
+			switch {
+			case play.Serial:
+				warm = 1
+			case context.Connections != nil:
+				warm = context.Connections.size()
+			}
+			if err := context.warmConnections(url, warm); err != nil {
+				return err
+			}
+			defer context.WarmSessions.close()
+		}
 	}
 
-	opChan, errChan = NewOpChanFromFile(playbackFileReader, play.Repeat)
+	versions.warn()
 
-	if err := Play(context, opChan, play.Speed, play.URL, play.Repeat, play.QueueTime); err != nil {
-		userInfoLogger.Logvf(Always, "Play: %v\n", err)
+	var synth *synthesizer
+	if model != nil {
+		synth, err = newSynthesizer(model, play.Rate, play.SynthesizeDuration)
+		if err != nil {
+			return err
+		}
+		userInfoLogger.Logvf(Always, "Synthesizing %v ops/sec for %v from %v kinds of op (seed %v)",
+			play.Rate, synth.duration, len(model.classes), model.seed)
+		opChan = synth.ops()
+	} else {
+		opChan, errChan = NewBufferedOpChanFromFile(playbackFileReader, play.Repeat, play.OpChanBuffer)
+		opChan = filter(opChan)
 	}
 
+	if playErr = Play(context, opChan, play.Speed, url, play.Repeat, play.QueueTime); playErr != nil {
+		userInfoLogger.Logvf(Always, "Play: %v\n", playErr)
+	}
+	if context.Renamer != nil {
+		context.Renamer.report()
+	}
+	if context.BatchSize != nil {
+		context.BatchSize.report()
+	}
+	context.Negotiated.report()
+	context.NamespaceLimits.report()
+
 	//handle the error from the errchan
-	err = <-errChan
-	if err != nil && err != io.EOF {
-		userInfoLogger.Logvf(Always, "OpChan: %v", err)
+	if synth != nil {
+		userInfoLogger.Logvf(Always, "Synthesized ops: %v", synth)
+	} else {
+		err = <-errChan
+		if err != nil && err != io.EOF {
+			userInfoLogger.Logvf(Always, "OpChan: %v", err)
+			if playErr == nil {
+				playErr = fmt.Errorf("OpChan: %v", err)
+			}
+		}
+	}
+	if context.Faults != nil {
+		userInfoLogger.Logvf(Always, "Injected faults: %v", context.Faults)
+	}
+	if play.ConnectionID >= 0 {
+		userInfoLogger.Logvf(Always, "Only the ops of recorded connection %v were played", play.ConnectionID)
+	}
+	if len(thresholds) > 0 {
+		return thresholds.Check(statColl.Totals, play.CountWriteErrors)
 	}
 	return nil
 }
 
+// serialConnection is the connection all ops are played on in serial mode.
+const serialConnection = "serial"
+
+// playbackConnection returns the recorded connection an op belongs to, whose
+// ops are played in order on a single connection to the target. In serial
+// mode, all ops are played on the same connection, and with a connection pool
+// on the pooled connection of the recorded one.
+func (context *ExecutionContext) playbackConnection(op *RecordedOp) string {
+	recorded := recordedConnection(op)
+	switch {
+	case context.Serial:
+		return serialConnection
+	case context.Connections != nil:
+		return context.Connections.connection(recorded)
+	}
+	return recorded
+}
+
+// recordedConnection returns the connection an op was recorded on, keyed by
+// its driver and server endpoints whichever way the op went.
+func recordedConnection(op *RecordedOp) string {
+	if isReply(op) {
+		return op.ReversedConnectionString()
+	}
+	return op.ConnectionString()
+}
+
+// coolDown pauses a repeated playback between repetitions, once the ops of
+// the last one, which was due to end at lastPlayAt, have all been handed to
+// their sessions. The cooldown command, if set, is run on the target at the
+// start of the pause. It returns how much later than scheduled the next
+// repetition starts.
+func (context *ExecutionContext) coolDown(sessionChans map[string]chan<- *RecordedOp, lastPlayAt time.Time, url string) time.Duration {
+	time.Sleep(lastPlayAt.Sub(time.Now()))
+	for _, sessionChan := range sessionChans {
+		for len(sessionChan) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	start := time.Now()
+	userInfoLogger.Logvf(Always, "Cooling down for %v", context.LoopCooldown)
+	if context.LoopCooldownCommand != "" {
+		if err := context.runCooldownCommand(url); err != nil {
+			userInfoLogger.Logvf(Always, "Warning: error running %v during cooldown: %v", context.LoopCooldownCommand, err)
+		}
+	}
+	time.Sleep(context.LoopCooldown - time.Since(start))
+	return time.Since(lastPlayAt)
+}
+
+// runCooldownCommand runs the cooldown command on the target.
+func (context *ExecutionContext) runCooldownCommand(url string) error {
+	session, err := context.dial(url)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run(bson.D{{Name: context.LoopCooldownCommand, Value: 1}}, &bson.M{})
+}
+
+// waitUntil sleeps until the start time of a scheduled playback, logging how
+// long it waited, or that the time had already passed.
+func waitUntil(start time.Time) {
+	wait := start.Sub(time.Now())
+	if wait <= 0 {
+		userInfoLogger.Logvf(Always, "Start time %v had already passed %v ago, starting playback now", start.Format(time.RFC3339), -wait)
+		return
+	}
+	userInfoLogger.Logvf(Always, "Waiting %v to start playback at %v", wait, start.Format(time.RFC3339))
+	begin := time.Now()
+	time.Sleep(wait)
+	userInfoLogger.Logvf(Always, "Waited %v, starting playback", time.Since(begin))
+}
+
+// playAt returns the time to play an op seen at the given time in the
+// recording. Only the time since the recording began matters, so pacing is the
+// same whatever the clock of the capture machine said: the first op plays at
+// the start of playback however far off its timestamp is.
+func playAt(seen, recordingStart, playbackStart time.Time, speed float64) time.Time {
+	// opDelta is the difference in time between when the file's recording
+	// began and and when this particular op is played. For the first
+	// operation in the playback, it's 0.
+	opDelta := seen.Sub(recordingStart)
+
+	// Adjust the opDelta for playback by dividing it by playback speed setting;
+	// e.g. 2x speed means the delta is half as long.
+	scaledDelta := float64(opDelta) / (speed)
+	return playbackStart.Add(time.Duration(int64(scaledDelta)))
+}
+
 // Play is responsible for playing ops from a RecordedOp channel to the
 // given url.
 func Play(context *ExecutionContext,
@@ -242,26 +963,17 @@ func Play(context *ExecutionContext,
 	sessionChans := make(map[string]chan<- *RecordedOp)
 	var playbackStartTime, recordingStartTime time.Time
 	var connectionID int64
-	var opCounter int
-	for op := range opChan {
-		opCounter++
-		if op.Seen.IsZero() {
-			return fmt.Errorf("Can't play operation found with zero-timestamp: %#v", op)
-		}
-		if recordingStartTime.IsZero() {
-			recordingStartTime = op.Seen.Time
-			playbackStartTime = time.Now()
-		}
+	var opCounter, dispatched int
+	var generation, generationOps int
+	var lastPlayAt time.Time
 
-		// opDelta is the difference in time between when the file's recording
-		// began and and when this particular op is played. For the first
-		// operation in the playback, it's 0.
-		opDelta := op.Seen.Sub(recordingStartTime)
-
-		// Adjust the opDelta for playback by dividing it by playback speed setting;
-		// e.g. 2x speed means the delta is half as long.
-		scaledDelta := float64(opDelta) / (speed)
-		op.PlayAt = &PreciseTime{playbackStartTime.Add(time.Duration(int64(scaledDelta)))}
+	// dispatch hands an op to the session of its connection, in the order
+	// of the schedule
+	dispatch := func(op *RecordedOp) {
+		dispatched++
+		if op.PlayAt.After(lastPlayAt) {
+			lastPlayAt = op.PlayAt.Time
+		}
 
 		// Every queueGranularity ops make sure that we're no more then
 		// QueueTime seconds ahead Which should mean that the maximum that we're
@@ -270,17 +982,17 @@ func Play(context *ExecutionContext,
 		// don't sleep after every read, and generally read and queue
 		// queueGranularity number of ops at a time and then sleep until the
 		// last read op is QueueTime ahead.
-		if opCounter%queueGranularity == 0 {
+		if dispatched%queueGranularity == 0 {
 			toolDebugLogger.Logvf(DebugHigh, "Waiting to prevent excess buffering with opCounter: %v", opCounter)
 			time.Sleep(op.PlayAt.Add(time.Duration(-queueTime) * time.Second).Sub(time.Now()))
 		}
 
-		var connectionString string
-		if op.OpCode() == OpCodeReply || op.OpCode() == OpCodeCommandReply {
-			connectionString = op.ReversedConnectionString()
-		} else {
-			connectionString = op.ConnectionString()
+		if op.EOF && context.Connections != nil {
+			// the pooled connections outlive the recorded ones
+			context.Connections.release(op)
+			return
 		}
+		connectionString := context.playbackConnection(op)
 		sessionChan, ok := sessionChans[connectionString]
 		if !ok {
 			connectionID++
@@ -289,13 +1001,65 @@ func Play(context *ExecutionContext,
 		}
 		if op.EOF {
 			userInfoLogger.Logv(DebugLow, "EOF Seen in playback")
+			if context.Serial {
+				// the single connection outlives the recorded ones
+				return
+			}
 			close(sessionChan)
 			delete(sessionChans, connectionString)
 		} else {
+			op.DispatchedAt = &PreciseTime{time.Now()}
 			sessionChan <- op
 
 		}
 	}
+
+	schedule := newPlaySchedule(context.NamespaceSpeeds, speed)
+	for op := range opChan {
+		opCounter++
+		if op.Seen.IsZero() {
+			return fmt.Errorf("Can't play operation found with zero-timestamp: %#v", op)
+		}
+		if op.TruncatedDocs > 0 {
+			return fmt.Errorf("Can't play operation whose documents were truncated to %v bytes with record --truncateDocs: %v",
+				op.TruncatedDocs, op.String())
+		}
+		if recordingStartTime.IsZero() {
+			if !context.StartAt.IsZero() {
+				waitUntil(context.StartAt)
+			}
+			recordingStartTime = op.Seen.Time
+			playbackStartTime = time.Now()
+		}
+		if op.Generation != generation {
+			for _, scheduled := range schedule.flush() {
+				dispatch(scheduled)
+			}
+			userInfoLogger.Logvf(Always, "Repetition %v of %v: %v ops dispatched", generation+1, repeat, generationOps)
+			if context.LoopCooldown > 0 {
+				// push the rest of the playback back by the pause
+				playbackStartTime = playbackStartTime.Add(context.coolDown(sessionChans, lastPlayAt, url))
+			}
+			generation, generationOps = op.Generation, 0
+		}
+		generationOps++
+
+		if err := context.NegativeDeltas.check(op); err != nil {
+			return err
+		}
+		opSpeed := context.NamespaceSpeeds.speed(op, speed)
+		op.PlayAt = &PreciseTime{playAt(op.Seen.Time, recordingStartTime, playbackStartTime, opSpeed)}
+		earliest := playAt(op.Seen.Time, recordingStartTime, playbackStartTime, schedule.maxSpeed)
+		for _, scheduled := range schedule.add(op, earliest) {
+			dispatch(scheduled)
+		}
+	}
+	for _, scheduled := range schedule.flush() {
+		dispatch(scheduled)
+	}
+	if repeat > 1 {
+		userInfoLogger.Logvf(Always, "Repetition %v of %v: %v ops dispatched", generation+1, repeat, generationOps)
+	}
 	for connectionString, sessionChan := range sessionChans {
 		close(sessionChan)
 		delete(sessionChans, connectionString)
@@ -304,6 +1068,10 @@ func Play(context *ExecutionContext,
 	context.SessionChansWaitGroup.Wait()
 
 	context.StatCollector.Close()
+	context.NegativeDeltas.report()
+	if context.DeadCursors.notFound > 0 {
+		userInfoLogger.Logvf(Always, "Cursors not found: %v", context.DeadCursors)
+	}
 	toolDebugLogger.Logvf(Always, "%v ops played back in %v seconds over %v connections", opCounter, time.Now().Sub(playbackStartTime), connectionID)
 	if repeat > 1 {
 		toolDebugLogger.Logvf(Always, "%v ops per generation for %v generations", opCounter/repeat, repeat)
@@ -245,6 +245,50 @@ func TestOpInsertLiveDB(t *testing.T) {
 	}
 }
 
+// TestLargeInsertLiveDB tests that mongoreplay replays an insert of a document
+// just under the maximum size intact, by querying for it afterwards.
+func TestLargeInsertLiveDB(t *testing.T) {
+	if err := teardownDB(); err != nil {
+		t.Error(err)
+	}
+
+	doc := nearMaxSizeDoc(t)
+	generator := newRecordedOpGenerator()
+	go func() {
+		defer close(generator.opChan)
+		if err := generator.generateInsert([]interface{}{doc}); err != nil {
+			t.Error(err)
+		}
+		if err := generator.generateGetLastError(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	statCollector, _ := newStatCollector(testCollectorOpts, true, true)
+	context := NewExecutionContext(statCollector)
+	if err := Play(context, generator.opChan, testSpeed, currentTestURL, 1, 10); err != nil {
+		t.Errorf("Error Playing traffic: %v\n", err)
+	}
+
+	session, err := mgo.Dial(currentTestURL)
+	if err != nil {
+		t.Fatalf("Error connecting to test server: %v", err)
+	}
+	defer session.Close()
+	result := bson.D{}
+	if err := session.DB(testDB).C(testCollection).FindId(1).One(&result); err != nil {
+		t.Fatalf("Error finding the inserted document: %v", err)
+	}
+	expected, _ := bson.Marshal(doc)
+	actual, _ := bson.Marshal(result)
+	if len(actual) != len(expected) || result[1].Value != doc[1].Value {
+		t.Errorf("Inserted document of %v bytes was not intact; found %v bytes", len(expected), len(actual))
+	}
+	if err := teardownDB(); err != nil {
+		t.Error(err)
+	}
+}
+
 // TestUpdateOpLiveDB tests the functionality of mongoreplay replaying an update
 // against a live database Generates 20 recorded inserts and an update and
 // passes them to the main execution of mongoreplay and queries the database to
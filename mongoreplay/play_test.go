@@ -2,6 +2,7 @@ package mongoreplay
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"testing"
 	"time"
@@ -96,3 +97,333 @@ func TestPlayOpEOF(t *testing.T) {
 		t.Errorf("should have eof at end, but got %v", err)
 	}
 }
+
+func TestRecordedTimestamps(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	ops := []RecordedOp{{
+		Seen: &PreciseTime{start},
+	}, {
+		Seen: &PreciseTime{start.Add(time.Second)},
+	}}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		bsonBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatalf("couldn't marshal op %v", err)
+		}
+		buf.Write(bsonBytes)
+	}
+	playbackReader := &PlaybackFileReader{bytes.NewReader(buf.Bytes())}
+
+	opChan, errChan := NewOpChanFromFile(playbackReader, 2)
+	var played []*RecordedOp
+	for op := range opChan {
+		played = append(played, op)
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatalf("should have eof at end, but got %v", err)
+	}
+	if len(played) != 4 {
+		t.Fatalf("expected 4 ops, got %v", len(played))
+	}
+
+	// the second generation is shifted, but keeps its recorded time
+	repeated := played[3]
+	if !repeated.Seen.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("repeated op should be seen at %v, got %v", start.Add(2*time.Second), repeated.Seen.Time)
+	}
+	if !repeated.RecordedAt.Equal(start.Add(time.Second)) {
+		t.Errorf("repeated op should be recorded at %v, got %v", start.Add(time.Second), repeated.RecordedAt.Time)
+	}
+
+	dispatched := start.Add(time.Minute)
+	repeated.DispatchedAt = &PreciseTime{dispatched}
+	gen := &ComparativeStatGenerator{}
+	stat := gen.GenerateOpStat(repeated, &QueryOp{}, nil, "")
+	if stat.RecordedAt == nil || !stat.RecordedAt.Equal(start.Add(time.Second)) {
+		t.Errorf("stat should be recorded at %v, got %v", start.Add(time.Second), stat.RecordedAt)
+	}
+	if stat.DispatchedAt == nil || !stat.DispatchedAt.Equal(dispatched) {
+		t.Errorf("stat should be dispatched at %v, got %v", dispatched, stat.DispatchedAt)
+	}
+}
+
+func TestSerialPlaybackConnection(t *testing.T) {
+	query := &RecordedOp{SrcEndpoint: "a", DstEndpoint: "b"}
+	query.RawOp.Header.OpCode = OpCodeQuery
+	reply := &RecordedOp{SrcEndpoint: "b", DstEndpoint: "a"}
+	reply.RawOp.Header.OpCode = OpCodeReply
+	other := &RecordedOp{SrcEndpoint: "c", DstEndpoint: "b"}
+	other.RawOp.Header.OpCode = OpCodeQuery
+
+	context := NewExecutionContext(&StatCollector{})
+	if context.playbackConnection(query) != context.playbackConnection(reply) {
+		t.Errorf("a reply should be played on the connection of its request")
+	}
+	if context.playbackConnection(query) == context.playbackConnection(other) {
+		t.Errorf("ops of different connections should be played on different connections")
+	}
+
+	context.Serial = true
+	for _, op := range []*RecordedOp{query, reply, other} {
+		if connection := context.playbackConnection(op); connection != serialConnection {
+			t.Errorf("expected all ops on the serial connection, got %v", connection)
+		}
+	}
+}
+
+func TestPlayAtIgnoresCaptureClock(t *testing.T) {
+	playbackStart := time.Now()
+	for _, recordingStart := range []time.Time{
+		time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+		playbackStart.Add(-3 * time.Hour),
+		playbackStart.Add(72 * time.Hour),
+	} {
+		if at := playAt(recordingStart, recordingStart, playbackStart, 1); !at.Equal(playbackStart) {
+			t.Errorf("first op recorded at %v should play at the start, got %v", recordingStart, at)
+		}
+		at := playAt(recordingStart.Add(4*time.Second), recordingStart, playbackStart, 2)
+		if expected := playbackStart.Add(2 * time.Second); !at.Equal(expected) {
+			t.Errorf("op 4s in recorded at %v should play 2s in at 2x speed, got %v", recordingStart, at.Sub(playbackStart))
+		}
+	}
+}
+
+func TestConnectionFilter(t *testing.T) {
+	opChan := make(chan *RecordedOp, 4)
+	for _, connectionNum := range []int64{0, 1, 2, 1} {
+		opChan <- &RecordedOp{SeenConnectionNum: connectionNum}
+	}
+	close(opChan)
+
+	var played []*RecordedOp
+	for op := range filterOps(opChan, connectionFilter(1)) {
+		played = append(played, op)
+	}
+	if len(played) != 2 {
+		t.Fatalf("expected 2 ops of connection 1, got %v", len(played))
+	}
+	for _, op := range played {
+		if op.SeenConnectionNum != 1 {
+			t.Errorf("played an op of connection %v", op.SeenConnectionNum)
+		}
+	}
+}
+
+// tapeOfOps returns a playback file of n query ops, a millisecond apart.
+func tapeOfOps(t testing.TB, n int) []byte {
+	generator := newRecordedOpGenerator()
+	for i := 0; i < n; i++ {
+		if err := generator.generateQuery(bson.D{{"_id", i}}, 0, int32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for i, op := range generatedOps(generator) {
+		op.Seen = &PreciseTime{start.Add(time.Duration(i) * time.Millisecond)}
+		bsonBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(bsonBytes)
+	}
+	return buf.Bytes()
+}
+
+func TestBufferedOpChan(t *testing.T) {
+	tape := tapeOfOps(t, 10)
+	playbackReader := &PlaybackFileReader{bytes.NewReader(tape)}
+	opChan, errChan := NewBufferedOpChanFromFile(playbackReader, 1, 4)
+
+	// the reader gets ahead by the size of the buffer, and no further
+	deadline := time.Now().Add(5 * time.Second)
+	for len(opChan) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(opChan) != 4 || cap(opChan) != 4 {
+		t.Errorf("expected 4 ops to be buffered, got %v of %v", len(opChan), cap(opChan))
+	}
+
+	var order int64
+	for op := range opChan {
+		if op.Order != order {
+			t.Errorf("expected op %v, got %v", order, op.Order)
+		}
+		order++
+	}
+	if order != 10 {
+		t.Errorf("expected 10 ops, got %v", order)
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Errorf("should have eof at end, but got %v", err)
+	}
+}
+
+// benchmarkOpChanBuffer reads a tape through an op chan with the buffer size,
+// doing a little work for each op as dispatch would.
+func benchmarkOpChanBuffer(b *testing.B, buffer int) {
+	tape := tapeOfOps(b, 1000)
+	b.SetBytes(int64(len(tape)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		playbackReader := &PlaybackFileReader{bytes.NewReader(tape)}
+		opChan, errChan := NewBufferedOpChanFromFile(playbackReader, 1, buffer)
+		for op := range opChan {
+			if _, err := op.RawOp.Parse(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := <-errChan; err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOpChanBuffer0(b *testing.B)    { benchmarkOpChanBuffer(b, 0) }
+func BenchmarkOpChanBuffer10(b *testing.B)   { benchmarkOpChanBuffer(b, 10) }
+func BenchmarkOpChanBuffer100(b *testing.B)  { benchmarkOpChanBuffer(b, 100) }
+func BenchmarkOpChanBuffer1000(b *testing.B) { benchmarkOpChanBuffer(b, 1000) }
+
+func TestPlayManyConnections(t *testing.T) {
+	const connections, opsPerConnection = 50, 20
+	generator := newRecordedOpGenerator()
+	for i := 0; i < connections*opsPerConnection; i++ {
+		if err := generator.generateQuery(bson.D{{"_id", i}}, 0, int32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opChan := make(chan *RecordedOp, connections*opsPerConnection)
+	start := time.Now()
+	for i, op := range generatedOps(generator) {
+		op.SrcEndpoint = fmt.Sprintf("10.0.0.1:%v", 40000+i%connections)
+		op.Seen = &PreciseTime{start.Add(time.Duration(i) * time.Microsecond)}
+		opChan <- op
+	}
+	close(opChan)
+
+	recorder := &BufferedStatRecorder{Aggregate: NewStatAggregate()}
+	statColl := &StatCollector{
+		StatGenerator: &ComparativeStatGenerator{},
+		StatRecorder:  recorder,
+	}
+	context := NewExecutionContext(statColl)
+	// nothing listens here, so every connection records its ops as skipped
+	context.DialTimeout = 100 * time.Millisecond
+
+	// read the stats while the connections are still recording them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			recorder.Stats()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := Play(context, opChan, 1, "mongodb://127.0.0.1:1", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(recorder.Buffer) != connections*opsPerConnection {
+		t.Errorf("expected %v stats, got %v", connections*opsPerConnection, len(recorder.Buffer))
+	}
+	if count := recorder.Aggregate.Total.Count; count != connections*opsPerConnection {
+		t.Errorf("expected the aggregate to count %v ops, got %v", connections*opsPerConnection, count)
+	}
+}
+
+func TestPlayStartAt(t *testing.T) {
+	if _, err := (&PlayCommand{StartAt: "tomorrow"}).startTime(); err == nil {
+		t.Errorf("expected an error for a --startAt that isn't RFC3339")
+	}
+	start, err := (&PlayCommand{StartAt: "2017-03-04T05:06:07+01:00"}).startTime()
+	if err != nil || !start.Equal(time.Date(2017, 3, 4, 4, 6, 7, 0, time.UTC)) {
+		t.Errorf("unexpected start time %v: %v", start, err)
+	}
+
+	opChan := make(chan *RecordedOp, 10)
+	for _, op := range generatedOps(func() *recordedOpGenerator {
+		generator := newRecordedOpGenerator()
+		for i := 0; i < 10; i++ {
+			if err := generator.generateQuery(bson.D{{"_id", i}}, 0, int32(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return generator
+	}()) {
+		op.Seen = &PreciseTime{time.Now()}
+		opChan <- op
+	}
+	close(opChan)
+
+	recorder := &BufferedStatRecorder{}
+	context := NewExecutionContext(&StatCollector{
+		StatGenerator: &ComparativeStatGenerator{},
+		StatRecorder:  recorder,
+	})
+	context.DialTimeout = 100 * time.Millisecond
+	context.StartAt = time.Now().Add(300 * time.Millisecond)
+	if err := Play(context, opChan, 1, "mongodb://127.0.0.1:1", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Buffer) != 10 {
+		t.Fatalf("expected 10 stats, got %v", len(recorder.Buffer))
+	}
+	for _, stat := range recorder.Buffer {
+		if stat.DispatchedAt == nil || stat.DispatchedAt.Before(context.StartAt) {
+			t.Errorf("op %v was dispatched at %v, before the start time %v", stat.Order, stat.DispatchedAt, context.StartAt)
+		}
+	}
+}
+
+func TestPlayLoopCooldown(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	for i := 0; i < 5; i++ {
+		if err := generator.generateQuery(bson.D{{"_id", i}}, 0, int32(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops := generatedOps(generator)
+	opChan := make(chan *RecordedOp, 2*len(ops))
+	start := time.Now()
+	for generation := 0; generation < 2; generation++ {
+		for i, op := range ops {
+			op := *op
+			op.Seen = &PreciseTime{start.Add(time.Duration(generation*len(ops)+i) * time.Millisecond)}
+			op.Generation = generation
+			opChan <- &op
+		}
+	}
+	close(opChan)
+
+	recorder := &BufferedStatRecorder{Aggregate: NewStatAggregate()}
+	statColl := &StatCollector{
+		StatGenerator: &ComparativeStatGenerator{},
+		StatRecorder:  recorder,
+	}
+	statColl.aggregateByGeneration()
+	context := NewExecutionContext(statColl)
+	context.DialTimeout = 100 * time.Millisecond
+	context.LoopCooldown = 300 * time.Millisecond
+	if err := Play(context, opChan, 1, "mongodb://127.0.0.1:1", 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var lastFirst, firstSecond time.Time
+	for _, stat := range recorder.Buffer {
+		switch {
+		case stat.Generation == 0 && stat.DispatchedAt.After(lastFirst):
+			lastFirst = *stat.DispatchedAt
+		case stat.Generation == 1 && (firstSecond.IsZero() || stat.DispatchedAt.Before(firstSecond)):
+			firstSecond = *stat.DispatchedAt
+		}
+	}
+	if gap := firstSecond.Sub(lastFirst); gap < context.LoopCooldown {
+		t.Errorf("expected the repetitions to be %v apart, got %v", context.LoopCooldown, gap)
+	}
+	byGeneration := recorder.Aggregate.ByGeneration
+	if len(byGeneration) != 2 || byGeneration[0].Count != 5 || byGeneration[1].Count != 5 {
+		t.Errorf("expected 5 ops in each of 2 generations, got %v", byGeneration)
+	}
+}
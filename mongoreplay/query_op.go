@@ -150,10 +150,82 @@ func (op *QueryOp) FromReader(r io.Reader) error {
 	return nil
 }
 
+// hoistModifiers moves the query modifiers of a recorded query that wraps its
+// filter in $query, such as $comment, into the options mgo sends along with the
+// query. When a slaveOk query is sent to a mongos, mgo wraps the query itself
+// to add $readPreference, which would otherwise bury the recorded modifiers
+// inside the filter. Queries with modifiers mgo can't send are left unchanged.
+func (op *QueryOp) hoistModifiers() {
+	if op.Flags&querySlaveOkFlag == 0 || op.HasOptions {
+		return
+	}
+	if options, ok := unwrapQuery(op.Query); ok {
+		op.Query = options.Query
+		op.Options = options
+		op.HasOptions = true
+	}
+}
+
+// unwrapQuery splits a query document whose filter is wrapped in $query into
+// the filter and its modifiers. It returns false if the query isn't wrapped or
+// has modifiers that can't be represented in an mgo.QueryWrapper.
+func unwrapQuery(query interface{}) (mgo.QueryWrapper, bool) {
+	var options mgo.QueryWrapper
+	doc, err := toBSOND(query)
+	if err != nil {
+		return options, false
+	}
+	wrapped := false
+	for _, elem := range doc {
+		ok := true
+		switch elem.Name {
+		case "$query":
+			options.Query, wrapped = elem.Value, true
+		case "$orderby":
+			options.OrderBy = elem.Value
+		case "$hint":
+			options.Hint = elem.Value
+		case "$explain":
+			options.Explain, ok = elem.Value.(bool)
+		case "$snapshot":
+			options.Snapshot, ok = elem.Value.(bool)
+		case "$readPreference":
+			options.ReadPreference, ok = elem.Value.(bson.D)
+		case "$maxScan":
+			options.MaxScan, ok = intValue(elem.Value)
+		case "$maxTimeMS":
+			options.MaxTimeMS, ok = intValue(elem.Value)
+		case "$comment":
+			options.Comment, ok = elem.Value.(string)
+		default:
+			ok = false
+		}
+		if !ok {
+			return options, false
+		}
+	}
+	return options, wrapped
+}
+
+// intValue returns the value of a BSON number as an int.
+func intValue(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
 // Execute performs the QueryOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *QueryOp) Execute(session *mgo.Session) (Replyable, error) {
-	session.SetSocketTimeout(0)
+	op.hoistModifiers()
 	before := time.Now()
 	_, _, replyData, resultReply, err := mgo.ExecOpWithReply(session, &op.QueryOp)
 	after := time.Now()
@@ -0,0 +1,98 @@
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// TestQueryCommentReplayed verifies that the $comment of a recorded query is
+// kept in the recording and sent unchanged when the query is played, including
+// when mgo wraps the query itself to add a read preference.
+func TestQueryCommentReplayed(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	query := &mgo.QueryOp{
+		Collection: "test.test",
+		Query: bson.D{
+			{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+			{Name: "$comment", Value: "report-42"},
+		},
+		Limit: 1,
+	}
+	recordedOp, err := generator.fetchRecordedOpsFromConn(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip the op through the format of the recording
+	raw, err := bson.Marshal(recordedOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taped := &RecordedOp{}
+	if err := bson.Unmarshal(raw, taped); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := taped.RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	played, ok := parsed.(*QueryOp)
+	if !ok {
+		t.Fatalf("expected a *QueryOp, got %T", parsed)
+	}
+
+	// play the op as a slaveOk query, which mgo wraps with its own options
+	played.Flags |= querySlaveOkFlag
+	played.hoistModifiers()
+	if !played.HasOptions || played.Options.Comment != "report-42" {
+		t.Fatalf("expected comment 'report-42' in the played options, got %#v", played.Options)
+	}
+	// the stub socket has no server to check for a mongos, so send the
+	// options without the flag
+	played.Flags &^= querySlaveOkFlag
+	sent, err := generator.fetchRecordedOpsFromConn(&played.QueryOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = sent.RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := toBSOND(parsed.(*QueryOp).Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, ok := unwrapQuery(doc)
+	if !ok {
+		t.Fatalf("expected a wrapped query to be sent, got %#v", doc)
+	}
+	if options.Comment != "report-42" {
+		t.Errorf("expected comment 'report-42' to be sent, got '%v'", options.Comment)
+	}
+	if filter, err := toBSOND(options.Query); err != nil || len(filter) != 1 || filter[0].Name != "a" {
+		t.Errorf("expected the recorded filter to be sent unwrapped, got %#v", options.Query)
+	}
+}
+
+func TestUnwrapQuery(t *testing.T) {
+	if _, ok := unwrapQuery(bson.D{{Name: "a", Value: 1}}); ok {
+		t.Errorf("a bare filter should not be unwrapped")
+	}
+	unknown := bson.D{
+		{Name: "$query", Value: bson.D{}},
+		{Name: "$returnKey", Value: true},
+	}
+	if _, ok := unwrapQuery(unknown); ok {
+		t.Errorf("a query with a modifier mgo can't send should not be unwrapped")
+	}
+	options, ok := unwrapQuery(bson.D{
+		{Name: "$query", Value: bson.D{}},
+		{Name: "$maxTimeMS", Value: int32(50)},
+		{Name: "$comment", Value: "x"},
+	})
+	if !ok || options.MaxTimeMS != 50 || options.Comment != "x" {
+		t.Errorf("unexpected options %#v", options)
+	}
+}
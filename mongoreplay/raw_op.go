@@ -4,14 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-
-	mgo "github.com/10gen/llmgo"
 )
 
 // RawOp may be exactly the same as OpUnknown.
 type RawOp struct {
+	// Header is the header of the wire message.
 	Header MsgHeader
-	Body   []byte
+
+	// Body is the whole wire message, header included, which for a reply
+	// recorded without --full-replies is cut short after its first document.
+	Body []byte
 }
 
 func (op *RawOp) String() string {
@@ -88,10 +90,13 @@ func (op *RawOp) ShortenReply() error {
 // Parse returns the underlying op from its given RawOp form.
 func (op *RawOp) Parse() (Op, error) {
 	if op.Header.OpCode == OpCodeCompressed {
-		newMsg, err := mgo.DecompressMessage(op.Body)
+		newMsg, err := decompressMessage(op.Body)
 		if err != nil {
 			return nil, err
 		}
+		if len(newMsg) > MaxMessageSize {
+			return nil, fmt.Errorf("decompressed wire message size, %v, was greater than the maximum, %v bytes", len(newMsg), MaxMessageSize)
+		}
 		op.Header.FromWire(newMsg)
 		op.Body = newMsg
 	}
@@ -116,6 +121,13 @@ func (op *RawOp) Parse() (Op, error) {
 		parsedOp = &CommandOp{Header: op.Header}
 	case OpCodeCommandReply:
 		parsedOp = &CommandReplyOp{Header: op.Header}
+	case OpCodeMsg:
+		// requests and replies share the opcode, and only replies respond
+		// to a request
+		if op.Header.ResponseTo != 0 {
+			return parseMsgReply(op.Header, op.Body[MsgHeaderLen:])
+		}
+		parsedOp = &MsgOp{Header: op.Header}
 	default:
 		return nil, nil
 	}
@@ -133,6 +145,9 @@ func (op *RawOp) Parse() (Op, error) {
 			}, nil
 		}
 	}
+	if msgOp, ok := parsedOp.(*MsgOp); ok && msgOp.commandName() == "getMore" {
+		return &MsgGetMore{MsgOp: *msgOp}, nil
+	}
 	return parsedOp, nil
 
 }
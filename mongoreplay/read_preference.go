@@ -0,0 +1,157 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+
+	mgo "github.com/10gen/llmgo"
+	bson "github.com/10gen/llmgo/bson"
+)
+
+// querySlaveOkFlag is the OP_QUERY flag allowing a query to run on a
+// secondary.
+const querySlaveOkFlag = mgo.QueryOpFlags(1 << 2)
+
+// readPreferenceModes maps the names of the read preference modes to their
+// mgo equivalents.
+var readPreferenceModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// readCommands are the commands, sent as OP_QUERY on $cmd, that are played
+// with the read preference.
+var readCommands = map[string]bool{
+	"find":     true,
+	"count":    true,
+	"distinct": true,
+}
+
+// ReadPreference describes the replica set members that recorded reads are
+// played against.
+type ReadPreference struct {
+	Mode mgo.Mode
+	Tags []bson.D
+}
+
+// ParseReadPreference parses a read preference mode and tag sets, each given
+// as a comma separated list of name:value pairs. It returns nil if reads should
+// be played against the primary along with all other ops.
+func ParseReadPreference(mode string, tagSets []string) (*ReadPreference, error) {
+	if mode == "" {
+		mode = "primary"
+	}
+	mgoMode, ok := readPreferenceModes[mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown read preference mode '%v'", mode)
+	}
+	if mgoMode == mgo.Primary {
+		if len(tagSets) > 0 {
+			return nil, fmt.Errorf("read preference tags can't be used with mode 'primary'")
+		}
+		return nil, nil
+	}
+
+	pref := &ReadPreference{Mode: mgoMode}
+	for _, tagSet := range tagSets {
+		tags := bson.D{}
+		for _, pair := range strings.Split(tagSet, ",") {
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid read preference tag '%v', expected name:value", pair)
+			}
+			tags = append(tags, bson.DocElem{kv[0], kv[1]})
+		}
+		pref.Tags = append(pref.Tags, tags)
+	}
+	return pref, nil
+}
+
+// playbackSessions holds the sessions that the ops of a single recorded
+// connection are played on.
+type playbackSessions struct {
+	session *mgo.Session
+
+	// readSession plays reads with the configured read preference, or is nil
+	// if reads are played on session
+	readSession *mgo.Session
+
+	// readCursors holds the live IDs of the cursors opened on readSession,
+	// whose getmores and killcursors must follow them there
+	readCursors map[int64]bool
+}
+
+func newPlaybackSessions(session *mgo.Session, pref *ReadPreference) *playbackSessions {
+	sessions := &playbackSessions{session: session}
+	if pref != nil {
+		sessions.readSession = session.Copy()
+		sessions.readSession.SetMode(pref.Mode, true)
+		sessions.readSession.SelectServers(pref.Tags...)
+		sessions.readCursors = map[int64]bool{}
+	}
+	return sessions
+}
+
+// sessionFor returns the session the op should be played on, preparing the op
+// for it if needed.
+func (sessions *playbackSessions) sessionFor(op Op) *mgo.Session {
+	if sessions.readSession == nil {
+		return sessions.session
+	}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !isReadQuery(castOp) {
+			return sessions.session
+		}
+		castOp.Flags |= querySlaveOkFlag
+		return sessions.readSession
+	case cursorsRewriteable:
+		cursorIDs, err := castOp.getCursorIDs()
+		if err != nil || len(cursorIDs) == 0 || !sessions.readCursors[cursorIDs[0]] {
+			return sessions.session
+		}
+		if _, ok := op.(*KillCursorsOp); ok {
+			for _, cursorID := range cursorIDs {
+				delete(sessions.readCursors, cursorID)
+			}
+		}
+		return sessions.readSession
+	}
+	return sessions.session
+}
+
+// trackCursor records the cursor opened or continued by an op played on
+// readSession, so that later ops on the cursor are played there too.
+func (sessions *playbackSessions) trackCursor(op Op, reply Replyable) {
+	cursorID, err := reply.getCursorID()
+	if err != nil {
+		return
+	}
+	if cursorID != 0 {
+		sessions.readCursors[cursorID] = true
+		return
+	}
+	// an exhausted cursor is closed by the server
+	if rewriteable, ok := op.(cursorsRewriteable); ok {
+		cursorIDs, _ := rewriteable.getCursorIDs()
+		for _, id := range cursorIDs {
+			delete(sessions.readCursors, id)
+		}
+	}
+}
+
+// isReadQuery returns whether the OP_QUERY is a query on a collection or a
+// read command.
+func isReadQuery(op *QueryOp) bool {
+	if !strings.HasSuffix(op.Collection, ".$cmd") {
+		return true
+	}
+	_, commandName := extractOpType(op.Query)
+	return readCommands[commandName]
+}
@@ -0,0 +1,96 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseReadPreference(t *testing.T) {
+	pref, err := ParseReadPreference("primary", nil)
+	if err != nil || pref != nil {
+		t.Errorf("primary should play reads with other ops, got %v, %v", pref, err)
+	}
+	if _, err := ParseReadPreference("primary", []string{"dc:east"}); err == nil {
+		t.Errorf("tags with mode primary should be rejected")
+	}
+	if _, err := ParseReadPreference("bogus", nil); err == nil {
+		t.Errorf("unknown mode should be rejected")
+	}
+	if _, err := ParseReadPreference("secondary", []string{"dc"}); err == nil {
+		t.Errorf("tag without value should be rejected")
+	}
+
+	pref, err = ParseReadPreference("secondary", []string{"dc:east,use:analytics", ""})
+	if err != nil {
+		t.Fatalf("couldn't parse read preference: %v", err)
+	}
+	if pref.Mode != mgo.Secondary {
+		t.Errorf("mode should be secondary, got %v", pref.Mode)
+	}
+	expected := []bson.D{
+		{{Name: "dc", Value: "east"}, {Name: "use", Value: "analytics"}},
+		{},
+	}
+	if !reflect.DeepEqual(pref.Tags, expected) {
+		t.Errorf("tags should be %v, got %v", expected, pref.Tags)
+	}
+}
+
+func TestReadPreferenceRouting(t *testing.T) {
+	sessions := &playbackSessions{
+		session:     &mgo.Session{},
+		readSession: &mgo.Session{},
+		readCursors: map[int64]bool{},
+	}
+
+	query := &QueryOp{}
+	query.Collection = "test.test"
+	query.Query = bson.D{{Name: "x", Value: 1}}
+	if sessions.sessionFor(query) != sessions.readSession {
+		t.Errorf("query should be played on the read session")
+	}
+	if query.Flags&querySlaveOkFlag == 0 {
+		t.Errorf("query on the read session should allow secondaries")
+	}
+
+	find := &QueryOp{}
+	find.Collection = "test.$cmd"
+	find.Query = bson.D{{Name: "find", Value: "test"}}
+	if sessions.sessionFor(find) != sessions.readSession {
+		t.Errorf("find command should be played on the read session")
+	}
+
+	insert := &QueryOp{}
+	insert.Collection = "test.$cmd"
+	insert.Query = bson.D{{Name: "insert", Value: "test"}}
+	if sessions.sessionFor(insert) != sessions.session {
+		t.Errorf("insert command should be played on the primary session")
+	}
+
+	reply := &ReplyOp{}
+	reply.CursorId = 1234
+	sessions.trackCursor(query, reply)
+
+	getMore := &GetMoreOp{}
+	getMore.CursorId = 1234
+	if sessions.sessionFor(getMore) != sessions.readSession {
+		t.Errorf("getmore of a read cursor should be played on the read session")
+	}
+	other := &GetMoreOp{}
+	other.CursorId = 5678
+	if sessions.sessionFor(other) != sessions.session {
+		t.Errorf("getmore of another cursor should be played on the primary session")
+	}
+
+	killCursors := &KillCursorsOp{}
+	killCursors.CursorIds = []int64{1234}
+	if sessions.sessionFor(killCursors) != sessions.readSession {
+		t.Errorf("killcursors of a read cursor should be played on the read session")
+	}
+	if sessions.readCursors[1234] {
+		t.Errorf("killed cursor should no longer be tracked")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	"github.com/10gen/llmgo/bson"
@@ -19,6 +20,19 @@ type RecordCommand struct {
 	Gzip         bool   `long:"gzip" description:"compress output file with Gzip"`
 	FullReplies  bool   `long:"full-replies" description:"save full reply payload in playback file"`
 	PlaybackFile string `short:"p" description:"path to playback file to record to" long:"playback-file" required:"yes"`
+	NumWriters   int    `long:"numWriters" description:"number of playback files to shard the recording across by connection, each written on its own goroutine (files are suffixed with .shard0, .shard1, etc., unlike the .0, .1, etc. of files rolled over with --maxOpsPerFile, and can be recombined with merge)" default:"1"`
+
+	MaxOpsPerFile   int64 `long:"maxOpsPerFile" value-name:"<count>" description:"roll over to a new playback file, suffixed with .0, .1, etc., once one holds this many ops and none of its cursors or transactions are open"`
+	MaxBytesPerFile int64 `long:"maxBytesPerFile" value-name:"<bytes>" description:"roll over to a new playback file, suffixed with .0, .1, etc., once one holds this many bytes (before compression) and none of its cursors are open"`
+
+	DedupRetries bool `long:"dedupRetries" description:"drop the writes retried by drivers as retryable writes, identified by their session and txnNumber, along with their replies, so that a playback doesn't apply them twice (only OP_MSG writes carry a session; retried legacy OP_INSERT, OP_UPDATE and OP_DELETE writes can't be told apart from new ones, and are all kept)"`
+
+	MaxBytesPerSecond int64 `long:"maxBytesPerSecond" value-name:"<bytes>" description:"limit the ops written to the playback file to this many bytes per second of capture, dropping (and counting) the ops beyond it to cap the overhead of recording"`
+
+	CaptureResponses bool     `long:"captureResponses" description:"keep every document of the recorded replies in the playback file, for comparison with those of a playback, truncated to the fields given with --responseField unless --full-replies is set; the playback file is written in a newer tape format"`
+	ResponseFields   []string `long:"responseField" value-name:"<field>" description:"dot-delimited field kept in the documents of replies captured with --captureResponses, where a field of an array applies to each of its documents (may be given multiple times; defaults to _id, ok, n, nModified, code, codeName, errmsg, writeErrors, writeConcernError, cursor.ns, cursor.firstBatch._id and cursor.nextBatch._id, and cursor.id is always kept)"`
+
+	TruncateDocs int `long:"truncateDocs" value-name:"<bytes>" description:"keep only the fields of each document of the recorded ops that fit within this many bytes, and always the first and those naming the namespace, to record the shapes of a workload's ops in a much smaller playback file; the op types and namespaces can still be seen with monitor, diff and estimate, but play refuses to play the truncated ops"`
 }
 
 // ErrPacketsDropped means that some packets were dropped
@@ -34,22 +48,54 @@ type packetHandlerContext struct {
 	packetHandler *PacketHandler
 	mongoOpStream *MongoOpStream
 	pcapHandle    *pcap.Handle
+	maxOps        int
+
+	// budget, if set, limits the rate at which ops are written
+	budget *byteBudget
+
+	// responses, if set, keeps the replies in the tape
+	responses *responseCapture
+
+	// dedup, if set, drops retried writes
+	dedup *retryDedup
+
+	// truncation, if set, cuts down the documents of the ops
+	truncation *docTruncation
 }
 
 func getOpstream(cfg OpStreamSettings) (*packetHandlerContext, error) {
 	if cfg.PacketBufSize < 1 {
 		return nil, fmt.Errorf("invalid packet buffer size")
 	}
+	snapLen := cfg.SnapLen
+	if snapLen == 0 {
+		snapLen = defaultSnapLen
+	}
 
 	var pcapHandle *pcap.Handle
-	var err error
+	var h *PacketHandler
 	if len(cfg.PcapFile) > 0 {
-		pcapHandle, err = pcap.OpenOffline(cfg.PcapFile)
+		isPcapng, err := isPcapngFile(cfg.PcapFile)
 		if err != nil {
 			return nil, fmt.Errorf("error opening pcap file: %v", err)
 		}
+		if isPcapng {
+			// read pcapng files ourselves, to keep their nanosecond
+			// timestamps and the link type of each interface
+			reader, err := openPcapngFile(cfg.PcapFile, cfg.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("error opening pcapng file: %v", err)
+			}
+			h = newPacketHandler(reader, reader)
+		} else {
+			pcapHandle, err = pcap.OpenOffline(cfg.PcapFile)
+			if err != nil {
+				return nil, fmt.Errorf("error opening pcap file: %v", err)
+			}
+		}
 	} else if len(cfg.NetworkInterface) > 0 {
-		pcapHandle, err = pcap.OpenLive(cfg.NetworkInterface, 32*1024*1024, false, pcap.BlockForever)
+		var err error
+		pcapHandle, err = pcap.OpenLive(cfg.NetworkInterface, int32(snapLen), false, pcap.BlockForever)
 		if err != nil {
 			return nil, fmt.Errorf("error listening to network interface: %v", err)
 		}
@@ -57,19 +103,20 @@ func getOpstream(cfg OpStreamSettings) (*packetHandlerContext, error) {
 		return nil, fmt.Errorf("must specify either a pcap file or network interface to record from")
 	}
 
-	if len(cfg.Expression) > 0 {
-		err = pcapHandle.SetBPFFilter(cfg.Expression)
-		if err != nil {
-			return nil, fmt.Errorf("error setting packet filter expression: %v", err)
+	if pcapHandle != nil {
+		if len(cfg.Expression) > 0 {
+			err := pcapHandle.SetBPFFilter(cfg.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("error setting packet filter expression: %v", err)
+			}
 		}
+		h = NewPacketHandler(pcapHandle)
 	}
-
-	h := NewPacketHandler(pcapHandle)
 	h.Verbose = userInfoLogger.isInVerbosity(DebugLow)
 
 	toolDebugLogger.Logvf(Info, "Created packet buffer size %d", cfg.PacketBufSize)
 	m := NewMongoOpStream(cfg.PacketBufSize)
-	return &packetHandlerContext{h, m, pcapHandle}, nil
+	return &packetHandlerContext{h, m, pcapHandle, cfg.MaxOps, nil, nil, nil, nil}, nil
 }
 
 // PlaybackWriter stores the necessary information for a playback destination,
@@ -77,6 +124,14 @@ func getOpstream(cfg OpStreamSettings) (*packetHandlerContext, error) {
 type PlaybackWriter struct {
 	io.WriteCloser
 	fname string
+	file  *os.File
+
+	// opCount is the number of ops written to this playback file
+	opCount int64
+
+	// rotation, if set, rolls the writer over to a new playback file once
+	// this one is full
+	rotation *rotation
 }
 
 // NewPlaybackWriter initializes a new PlaybackWriter
@@ -89,6 +144,7 @@ func NewPlaybackWriter(playbackFileName string, isGzipWriter bool) (*PlaybackWri
 	if err != nil {
 		return nil, fmt.Errorf("error opening playback file to write to: %v", err)
 	}
+	pbWriter.file = file
 	if isGzipWriter {
 		pbWriter.WriteCloser = gzip.NewWriter(file)
 	} else {
@@ -97,6 +153,133 @@ func NewPlaybackWriter(playbackFileName string, isGzipWriter bool) (*PlaybackWri
 	return pbWriter, nil
 }
 
+// shardFileName returns the name of the playback file of a shard of a
+// recording. Shards are named apart from rotated files, so play never takes
+// them for a series.
+func shardFileName(playbackFileName string, index int) string {
+	return fmt.Sprintf("%v.shard%d", playbackFileName, index)
+}
+
+// NewPlaybackWriters initializes numWriters PlaybackWriters. When numWriters
+// is greater than one, each playback file name is suffixed with the index of
+// its shard.
+func NewPlaybackWriters(playbackFileName string, isGzipWriter bool, numWriters int) ([]*PlaybackWriter, error) {
+	if numWriters == 1 {
+		pbWriter, err := NewPlaybackWriter(playbackFileName, isGzipWriter)
+		if err != nil {
+			return nil, err
+		}
+		return []*PlaybackWriter{pbWriter}, nil
+	}
+	pbWriters := make([]*PlaybackWriter, 0, numWriters)
+	for i := 0; i < numWriters; i++ {
+		pbWriter, err := NewPlaybackWriter(shardFileName(playbackFileName, i), isGzipWriter)
+		if err != nil {
+			for _, w := range pbWriters {
+				w.Close()
+			}
+			return nil, err
+		}
+		pbWriters = append(pbWriters, pbWriter)
+	}
+	return pbWriters, nil
+}
+
+// Close flushes and closes the playback file.
+func (pbWriter *PlaybackWriter) Close() error {
+	err := pbWriter.WriteCloser.Close()
+	if pbWriter.file != nil && pbWriter.WriteCloser != io.WriteCloser(pbWriter.file) {
+		if fileErr := pbWriter.file.Close(); err == nil {
+			err = fileErr
+		}
+	}
+	return err
+}
+
+// shardWriteQueueSize is the number of ops queued for each playback file
+// before recording waits for its writer to catch up.
+const shardWriteQueueSize = 1000
+
+// shardWrite is an op queued to be written to a playback file.
+type shardWrite struct {
+	op        *RecordedOp
+	bsonBytes []byte
+}
+
+// shardedWriters writes ops to one or more playback files, sharded by their
+// connection number. Each playback file is written by a goroutine of its own,
+// so that compressing one doesn't hold up recording into the others.
+type shardedWriters struct {
+	writers []*PlaybackWriter
+	queues  []chan shardWrite
+
+	// errs holds the errors of the writers that failed, each of which stops
+	// writing and drains its queue
+	errs chan error
+	done sync.WaitGroup
+}
+
+func newShardedWriters(playbackWriters []*PlaybackWriter) *shardedWriters {
+	s := &shardedWriters{
+		writers: playbackWriters,
+		queues:  make([]chan shardWrite, len(playbackWriters)),
+		errs:    make(chan error, len(playbackWriters)),
+	}
+	for i, playbackWriter := range playbackWriters {
+		s.queues[i] = make(chan shardWrite, shardWriteQueueSize)
+		s.done.Add(1)
+		go s.run(playbackWriter, s.queues[i])
+	}
+	return s
+}
+
+// run writes the ops queued for a playback file until the queue is closed.
+func (s *shardedWriters) run(playbackWriter *PlaybackWriter, queue <-chan shardWrite) {
+	defer s.done.Done()
+	failed := false
+	for write := range queue {
+		if failed {
+			continue
+		}
+		if err := playbackWriter.writeOp(write.op, write.bsonBytes); err != nil {
+			s.errs <- fmt.Errorf("error writing message to %v: %v", playbackWriter.fname, err)
+			failed = true
+		}
+	}
+}
+
+// write queues the op for the playback file of its connection, or returns
+// the error of a writer that has failed.
+func (s *shardedWriters) write(op *RecordedOp, bsonBytes []byte) error {
+	select {
+	case err := <-s.errs:
+		return err
+	default:
+	}
+	s.queues[op.SeenConnectionNum%int64(len(s.queues))] <- shardWrite{op, bsonBytes}
+	return nil
+}
+
+// close waits for the queued ops to be written and closes the playback files,
+// returning the error of a writer that failed.
+func (s *shardedWriters) close() error {
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.done.Wait()
+	var err error
+	select {
+	case err = <-s.errs:
+	default:
+	}
+	for _, playbackWriter := range s.writers {
+		if closeErr := playbackWriter.Close(); closeErr != nil {
+			toolDebugLogger.Logvf(Always, "Warning: error closing playback file %v: %v", playbackWriter.fname, closeErr)
+		}
+	}
+	return err
+}
+
 // ValidateParams validates the settings described in the RecordCommand struct.
 func (record *RecordCommand) ValidateParams(args []string) error {
 	switch {
@@ -104,6 +287,25 @@ func (record *RecordCommand) ValidateParams(args []string) error {
 		return fmt.Errorf("unknown argument: %s", args[0])
 	case record.PcapFile != "" && record.NetworkInterface != "":
 		return fmt.Errorf("must only specify an interface or a pcap file")
+	case record.MaxOps < 0:
+		return fmt.Errorf("Invalid setting for --limit: '%v', value must be >=0", record.MaxOps)
+	case record.NumWriters < 1:
+		return fmt.Errorf("Invalid setting for --numWriters: '%v', value must be >=1", record.NumWriters)
+	case record.MaxOpsPerFile < 0:
+		return fmt.Errorf("Invalid setting for --maxOpsPerFile: '%v', value must be >=0", record.MaxOpsPerFile)
+	case record.MaxBytesPerFile < 0:
+		return fmt.Errorf("Invalid setting for --maxBytesPerFile: '%v', value must be >=0", record.MaxBytesPerFile)
+	case (record.MaxOpsPerFile > 0 || record.MaxBytesPerFile > 0) && record.NumWriters > 1:
+		return fmt.Errorf("--maxOpsPerFile and --maxBytesPerFile can't be used with --numWriters")
+	case record.MaxBytesPerSecond < 0:
+		return fmt.Errorf("Invalid setting for --maxBytesPerSecond: '%v', value must be >=0", record.MaxBytesPerSecond)
+	case len(record.ResponseFields) > 0 && !record.CaptureResponses:
+		return fmt.Errorf("--responseField can only be used with --captureResponses")
+	case record.TruncateDocs < 0:
+		return fmt.Errorf("Invalid setting for --truncateDocs: '%v', value must be >=0", record.TruncateDocs)
+	}
+	if err := record.OpStreamSettings.validate(); err != nil {
+		return err
 	}
 	if record.OpStreamSettings.PacketBufSize == 0 {
 		// default heap size
@@ -124,6 +326,18 @@ func (record *RecordCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	if record.MaxBytesPerSecond > 0 {
+		ctx.budget = newByteBudget(record.MaxBytesPerSecond)
+	}
+	if record.CaptureResponses {
+		ctx.responses = newResponseCapture(record.ResponseFields, record.FullReplies)
+	}
+	if record.DedupRetries {
+		ctx.dedup = newRetryDedup()
+	}
+	if record.TruncateDocs > 0 {
+		ctx.truncation = newDocTruncation(record.TruncateDocs)
+	}
 
 	// When a signal is received to kill the process, stop the packet handler so
 	// we gracefully flush all ops being processed before exiting.
@@ -135,56 +349,255 @@ func (record *RecordCommand) Execute(args []string) error {
 		toolDebugLogger.Logvf(Info, "Got signal %v, closing PCAP handle", s)
 		ctx.packetHandler.Close()
 	}()
-	playbackWriter, err := NewPlaybackWriter(record.PlaybackFile, record.Gzip)
-	if err != nil {
-		return err
+	var playbackWriters []*PlaybackWriter
+	if record.MaxOpsPerFile > 0 || record.MaxBytesPerFile > 0 {
+		playbackWriter, err := NewRotatingPlaybackWriter(record.PlaybackFile, record.Gzip,
+			record.MaxOpsPerFile, record.MaxBytesPerFile)
+		if err != nil {
+			return err
+		}
+		playbackWriters = []*PlaybackWriter{playbackWriter}
+	} else {
+		playbackWriters, err = NewPlaybackWriters(record.PlaybackFile, record.Gzip, record.NumWriters)
+		if err != nil {
+			return err
+		}
 	}
 
-	return Record(ctx, playbackWriter, record.FullReplies)
+	return Record(ctx, playbackWriters, record.FullReplies)
 
 }
 
-// Record writes pcap data into a playback file
+// Record writes pcap data into one or more playback files. When given more
+// than one PlaybackWriter, ops are sharded across them by their connection
+// number so that all of the ops for a connection, and therefore its cursors,
+// end up in the same playback file, and each is written on a goroutine of its
+// own. The playback files are closed once all ops have been written, even if
+// packet handling fails.
 func Record(ctx *packetHandlerContext,
-	playbackWriter *PlaybackWriter,
+	playbackWriters []*PlaybackWriter,
 	noShortenReply bool) error {
 
+	if len(playbackWriters) == 0 {
+		return fmt.Errorf("record: no playback file to write to")
+	}
+
+	var limiter *opLimiter
+	if ctx.maxOps > 0 {
+		limiter = newOpLimiter(ctx.maxOps)
+	}
+
+	// corruptOps counts the ops whose checksums don't match their contents,
+	// and is read once the ops have all been written
+	var corruptOps int
+	writers := newShardedWriters(playbackWriters)
 	ch := make(chan error)
 	go func() {
 		defer close(ch)
+		// fail stops the recording on an error, but keeps draining the op
+		// stream so that packet handling can shut down cleanly
+		var err error
+		fail := func(e error) {
+			if err == nil {
+				err = e
+				ctx.packetHandler.Close()
+			}
+		}
+		// stopAtLimit stops the recording once the op limit is done with
+		stopAtLimit := func() {
+			if !limiter.done() {
+				return
+			}
+			if unfinished := limiter.unfinished(); unfinished > 0 {
+				userInfoLogger.Logvf(Always, "Reached twice the limit of %v ops with %v unfinished cursor or transaction ops, "+
+					"which may fail when played; stopping recording", ctx.maxOps, unfinished)
+			} else {
+				userInfoLogger.Logvf(Always, "Reached limit of %v ops, stopping recording", ctx.maxOps)
+			}
+			ctx.packetHandler.Close()
+		}
 		for op := range ctx.mongoOpStream.Ops {
-			if (op.Header.OpCode == OpCodeReply || op.Header.OpCode == OpCodeCommandReply) &&
+			if err != nil {
+				continue
+			}
+			ok, dedupErr := ctx.dedup.allow(op)
+			if dedupErr != nil {
+				toolDebugLogger.Logvf(Info, "Warning: connection %v: error checking for a retried write: %v",
+					op.SeenConnectionNum, dedupErr)
+			} else if !ok {
+				continue
+			}
+			if limiter != nil {
+				// once the limit has been reached, keep draining the op stream
+				// so that packet handling can shut down cleanly
+				if limiter.done() {
+					continue
+				}
+				ok, limitErr := limiter.shouldWrite(op)
+				if limitErr != nil {
+					fail(fmt.Errorf("error tracking op limit: %v", limitErr))
+					continue
+				}
+				if !ok {
+					stopAtLimit()
+					continue
+				}
+			}
+			if err := op.validateChecksum(); err != nil {
+				toolDebugLogger.Logvf(Info, "Warning: connection %v: %v", op.SeenConnectionNum, err)
+				op.ChecksumMismatch = true
+				corruptOps++
+			}
+			if ctx.responses != nil {
+				if err := ctx.responses.capture(op); err != nil {
+					toolDebugLogger.Logvf(Always, "Warning: error capturing reply: %v", err)
+				}
+			} else if (op.Header.OpCode == OpCodeReply || op.Header.OpCode == OpCodeCommandReply) &&
 				!noShortenReply {
 				op.ShortenReply()
 			}
-			bsonBytes, err := bson.Marshal(op)
-			if err != nil {
-				ch <- fmt.Errorf("error marshaling message: %v", err)
-				return
+			if err := ctx.truncation.truncate(op); err != nil {
+				toolDebugLogger.Logvf(Always, "Warning: connection %v: error truncating documents: %v",
+					op.SeenConnectionNum, err)
 			}
-			_, err = playbackWriter.Write(bsonBytes)
-			if err != nil {
-				ch <- fmt.Errorf("error writing message: %v", err)
-				return
+			bsonBytes, marshalErr := bson.Marshal(op)
+			if marshalErr != nil {
+				fail(fmt.Errorf("error marshaling message: %v", marshalErr))
+				continue
+			}
+			if !ctx.budget.allow(op, len(bsonBytes)) {
+				continue
+			}
+			// the op is tracked before it's handed to its writer, which may
+			// parse it on another goroutine
+			if limiter != nil {
+				if limitErr := limiter.track(op); limitErr != nil {
+					fail(fmt.Errorf("error tracking op limit: %v", limitErr))
+					continue
+				}
 			}
+			if writeErr := writers.write(op, bsonBytes); writeErr != nil {
+				fail(writeErr)
+				continue
+			}
+			if limiter != nil {
+				stopAtLimit()
+			}
+		}
+		// the playback files are only closed once their writers are done
+		if writeErr := writers.close(); err == nil {
+			err = writeErr
 		}
-		ch <- nil
+		ch <- err
 	}()
 
 	if err := ctx.packetHandler.Handle(ctx.mongoOpStream, -1); err != nil {
+		// the op stream is closed once packet handling stops, so wait for
+		// the ops already handled to be written and the files closed
+		<-ch
 		return fmt.Errorf("record: error handling packet stream: %s", err)
 	}
 
-	stats, err := ctx.pcapHandle.Stats()
-	if err != nil {
-		toolDebugLogger.Logvf(Always, "Warning: got err %v getting pcap handle stats", err)
-	} else {
-		toolDebugLogger.Logvf(Info, "PCAP stats: %#v", stats)
+	// pcapng files are read without a pcap handle, and have no stats
+	var stats *pcap.Stats
+	if ctx.pcapHandle != nil {
+		var err error
+		stats, err = ctx.pcapHandle.Stats()
+		if err != nil {
+			toolDebugLogger.Logvf(Always, "Warning: got err %v getting pcap handle stats", err)
+		} else {
+			toolDebugLogger.Logvf(Info, "PCAP stats: %#v", stats)
+		}
 	}
 
-	err = <-ch
+	err := <-ch
+	for _, playbackWriter := range playbackWriters {
+		userInfoLogger.Logvf(Info, "%v ops recorded to %v", playbackWriter.opCount, playbackWriter.fname)
+	}
+	if ctx.budget != nil && ctx.budget.droppedOps > 0 {
+		userInfoLogger.Logvf(Always, "%v ops (%v bytes) dropped to stay within --maxBytesPerSecond of %v",
+			ctx.budget.droppedOps, ctx.budget.droppedBytes, ctx.budget.bytesPerSecond)
+	}
+	if ctx.dedup != nil {
+		userInfoLogger.Logvf(Always, "%v retried writes dropped with --dedupRetries", ctx.dedup.droppedOps)
+	}
+	if ctx.truncation != nil {
+		userInfoLogger.Logvf(Always, "%v ops had documents truncated to %v bytes with --truncateDocs, saving %v bytes",
+			ctx.truncation.truncatedOps, ctx.truncation.limit, ctx.truncation.savedBytes)
+	}
+	if connections, messages := ctx.mongoOpStream.skippedNonMongo(); connections > 0 || messages > 0 {
+		userInfoLogger.Logvf(Always, "Skipped %v connections and %v messages that weren't MongoDB traffic",
+			connections, messages)
+	}
+	if corruptOps > 0 {
+		userInfoLogger.Logvf(Always, "Warning: %v ops were recorded with checksums that don't match their contents, "+
+			"and are flagged as corrupt in the playback file; the capture may be corrupted", corruptOps)
+	}
 	if err == nil && stats != nil && stats.PacketsDropped != 0 {
 		err = ErrPacketsDropped{stats.PacketsDropped}
 	}
 	return err
 }
+
+// opLimiter keeps track of how many requests have been recorded so that
+// recording can be stopped after a fixed number of them. Once the limit is
+// reached, only the replies to the requests already recorded, and getmores and
+// killcursors on cursors that were opened during the recording along with
+// their replies, and the ops of transactions started during the recording,
+// are written so the resulting tape does not contain cursors or transactions
+// that are missing their final uses. Cursors and transactions are only waited
+// on until twice the limit of requests have been seen, so that one left open
+// doesn't keep the recording going forever.
+type opLimiter struct {
+	maxOps int
+
+	// requestsWritten counts the requests recorded, and requestsSeen those
+	// offered to the limiter; replies count towards neither
+	requestsWritten int
+	requestsSeen    int
+
+	// cursors tracks the recorded requests awaiting a reply, and the cursors
+	// and transactions left open
+	cursors *cursorTracker
+}
+
+func newOpLimiter(maxOps int) *opLimiter {
+	return &opLimiter{
+		maxOps:  maxOps,
+		cursors: newCursorTracker(),
+	}
+}
+
+func (l *opLimiter) limitReached() bool {
+	return l.requestsWritten >= l.maxOps
+}
+
+// unfinished returns the number of requests awaiting replies and open cursors.
+func (l *opLimiter) unfinished() int {
+	return l.cursors.unfinished()
+}
+
+// done returns whether the limit has been reached and no cursors remain open,
+// or twice the limit of requests have been seen.
+func (l *opLimiter) done() bool {
+	return l.limitReached() && (l.unfinished() == 0 || l.requestsSeen >= 2*l.maxOps)
+}
+
+// shouldWrite returns whether the op should be recorded.
+func (l *opLimiter) shouldWrite(op *RecordedOp) (bool, error) {
+	if isRequest(op) {
+		l.requestsSeen++
+	}
+	if !l.limitReached() {
+		return true, nil
+	}
+	return l.cursors.finishes(op)
+}
+
+// track updates the state of the opLimiter with an op that has been recorded.
+func (l *opLimiter) track(op *RecordedOp) error {
+	if isRequest(op) {
+		l.requestsWritten++
+	}
+	return l.cursors.track(op)
+}
@@ -0,0 +1,89 @@
+package mongoreplay
+
+import (
+	"time"
+)
+
+// byteBudget limits the rate at which ops are written to the playback file to
+// a number of bytes per second of capture, allowing bursts of up to a second's
+// worth. Ops beyond the budget are dropped and counted, along with the replies
+// to dropped requests, so that recording can't use more than a fixed share of
+// the host's disk or the tool's own CPU.
+type byteBudget struct {
+	bytesPerSecond int64
+
+	// available is the number of bytes that can be written now, and last the
+	// time it was last refilled
+	available float64
+	last      time.Time
+
+	droppedOps   int64
+	droppedBytes int64
+
+	// droppedRequests holds the requests that were dropped, so that their
+	// replies are dropped too
+	droppedRequests map[opKey]struct{}
+}
+
+func newByteBudget(bytesPerSecond int64) *byteBudget {
+	return &byteBudget{
+		bytesPerSecond:  bytesPerSecond,
+		available:       float64(bytesPerSecond),
+		droppedRequests: make(map[opKey]struct{}),
+	}
+}
+
+// allow returns whether an op of the given size in bytes may be written,
+// spending the budget for it if so. A nil byteBudget allows every op.
+func (b *byteBudget) allow(op *RecordedOp, size int) bool {
+	if b == nil || op.EOF {
+		// connection ends are always written, for playback to close them
+		return true
+	}
+	isReply := op.Header.OpCode == OpCodeReply || op.Header.OpCode == OpCodeCommandReply
+	if isReply {
+		key := opKey{
+			driverEndpoint: op.DstEndpoint,
+			serverEndpoint: op.SrcEndpoint,
+			opID:           op.Header.ResponseTo,
+		}
+		if _, ok := b.droppedRequests[key]; ok {
+			delete(b.droppedRequests, key)
+			b.drop(size)
+			return false
+		}
+	}
+
+	b.refill(op.Seen.Time)
+	if float64(size) > b.available {
+		if !isReply {
+			b.droppedRequests[opKey{
+				driverEndpoint: op.SrcEndpoint,
+				serverEndpoint: op.DstEndpoint,
+				opID:           op.Header.RequestID,
+			}] = struct{}{}
+		}
+		b.drop(size)
+		return false
+	}
+	b.available -= float64(size)
+	return true
+}
+
+// refill adds the budget earned since it was last refilled.
+func (b *byteBudget) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.available += float64(b.bytesPerSecond) * now.Sub(b.last).Seconds()
+		if b.available > float64(b.bytesPerSecond) {
+			b.available = float64(b.bytesPerSecond)
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+func (b *byteBudget) drop(size int) {
+	b.droppedOps++
+	b.droppedBytes += int64(size)
+}
@@ -0,0 +1,76 @@
+package mongoreplay
+
+// retryableWriteCommands are the commands drivers retry as retryable writes.
+var retryableWriteCommands = map[string]bool{
+	"insert":        true,
+	"update":        true,
+	"delete":        true,
+	"findAndModify": true,
+	"findandmodify": true,
+}
+
+// retryDedup drops the writes retried by drivers from a recording, so that a
+// playback doesn't apply them twice. A retryable write is sent with the lsid
+// of its session and a txnNumber, which the driver increments for each new
+// write and keeps for the retries of the same write, so a write whose txnNumber
+// isn't above the highest seen for its session is a retry. The replies to
+// dropped writes are dropped too. Writes in multi-document transactions share
+// the txnNumber of the transaction, and are always kept.
+type retryDedup struct {
+	// txnNumbers holds the highest txnNumber of the retryable writes of each
+	// session
+	txnNumbers map[string]int64
+
+	// droppedRequests holds the retries that were dropped, so that their
+	// replies are dropped too
+	droppedRequests map[opKey]struct{}
+
+	droppedOps int64
+}
+
+func newRetryDedup() *retryDedup {
+	return &retryDedup{
+		txnNumbers:      make(map[string]int64),
+		droppedRequests: make(map[opKey]struct{}),
+	}
+}
+
+// allow returns whether an op is written rather than dropped as a retry, or as
+// the reply to one. A nil retryDedup allows every op.
+func (d *retryDedup) allow(op *RecordedOp) (bool, error) {
+	if d == nil || op.EOF {
+		return true, nil
+	}
+	if op.Header.ResponseTo != 0 {
+		key := opKey{
+			driverEndpoint: op.DstEndpoint,
+			serverEndpoint: op.SrcEndpoint,
+			opID:           op.Header.ResponseTo,
+		}
+		if _, ok := d.droppedRequests[key]; ok {
+			delete(d.droppedRequests, key)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	command, ok, err := msgCommand(&op.RawOp)
+	if err != nil || !ok || len(command) == 0 || !retryableWriteCommands[command[0].Name] {
+		return true, err
+	}
+	session, ok := commandTxnSession(command)
+	if !ok || session.inTransaction {
+		return true, nil
+	}
+	if highest, seen := d.txnNumbers[session.lsid]; seen && session.txnNumber <= highest {
+		d.droppedRequests[opKey{
+			driverEndpoint: op.SrcEndpoint,
+			serverEndpoint: op.DstEndpoint,
+			opID:           op.Header.RequestID,
+		}] = struct{}{}
+		d.droppedOps++
+		return false, nil
+	}
+	d.txnNumbers[session.lsid] = session.txnNumber
+	return true, nil
+}
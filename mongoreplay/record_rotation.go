@@ -0,0 +1,177 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// rotation holds the limits at which a PlaybackWriter rolls over to a new
+// playback file, and the cursors of the current file that keep it from rolling
+// over until they are finished.
+type rotation struct {
+	baseName string
+	gzip     bool
+	maxOps   int64
+	maxBytes int64
+
+	// index is the number of the current file in the series
+	index   int
+	bytes   int64
+	cursors *cursorTracker
+}
+
+// rotationFileName returns the name of a file in a series of rotated playback
+// files.
+func rotationFileName(baseName string, index int) string {
+	return fmt.Sprintf("%v.%d", baseName, index)
+}
+
+// NewRotatingPlaybackWriter initializes a PlaybackWriter that writes to a
+// series of playback files named with the base name suffixed with .0, .1, etc.,
+// rolling over to the next once a file holds maxOps ops or maxBytes bytes. A
+// limit of zero is no limit. Files only roll over once every query, command and
+// getmore written to them has its reply, every cursor opened in them is
+// exhausted or killed, and every transaction started in them is committed or
+// aborted, so that the ops of a cursor or a transaction are all in the same
+// file.
+func NewRotatingPlaybackWriter(baseName string, isGzipWriter bool, maxOps, maxBytes int64) (*PlaybackWriter, error) {
+	pbWriter, err := NewPlaybackWriter(rotationFileName(baseName, 0), isGzipWriter)
+	if err != nil {
+		return nil, err
+	}
+	pbWriter.rotation = &rotation{
+		baseName: baseName,
+		gzip:     isGzipWriter,
+		maxOps:   maxOps,
+		maxBytes: maxBytes,
+		cursors:  newCursorTracker(),
+	}
+	return pbWriter, nil
+}
+
+// limitReached returns whether the current file has reached a limit, after
+// writing opCount ops to it, or has gone as far past it again. Past that, a
+// file rolls over even with unfinished cursors, such as ones abandoned by
+// their clients, rather than growing without bound.
+func (r *rotation) limitReached(opCount int64, factor int64) bool {
+	return (r.maxOps > 0 && opCount >= factor*r.maxOps) ||
+		(r.maxBytes > 0 && r.bytes >= factor*r.maxBytes)
+}
+
+// writeOp writes a marshaled op to the playback file, rolling over to the next
+// file of a rotating PlaybackWriter afterwards if the current one is full.
+func (pbWriter *PlaybackWriter) writeOp(op *RecordedOp, bsonBytes []byte) error {
+	if _, err := pbWriter.Write(bsonBytes); err != nil {
+		return err
+	}
+	pbWriter.opCount++
+	r := pbWriter.rotation
+	if r == nil {
+		return nil
+	}
+	r.bytes += int64(len(bsonBytes))
+	if err := r.cursors.track(op); err != nil {
+		return fmt.Errorf("error tracking cursors for rotation: %v", err)
+	}
+	switch {
+	case !r.limitReached(pbWriter.opCount, 1):
+		return nil
+	case r.cursors.unfinished() > 0 && !r.limitReached(pbWriter.opCount, 2):
+		return nil
+	case r.cursors.unfinished() > 0:
+		userInfoLogger.Logvf(Always, "Rolling over %v with %v unfinished cursor ops, which may fail when played",
+			pbWriter.fname, r.cursors.unfinished())
+	}
+	return pbWriter.rotate()
+}
+
+// rotate closes the current playback file and opens the next in the series.
+func (pbWriter *PlaybackWriter) rotate() error {
+	r := pbWriter.rotation
+	userInfoLogger.Logvf(Info, "%v ops recorded to %v", pbWriter.opCount, pbWriter.fname)
+	if err := pbWriter.Close(); err != nil {
+		return fmt.Errorf("error closing playback file %v: %v", pbWriter.fname, err)
+	}
+	r.index++
+	next, err := NewPlaybackWriter(rotationFileName(r.baseName, r.index), r.gzip)
+	if err != nil {
+		return err
+	}
+	next.rotation = r
+	*pbWriter = *next
+	r.bytes = 0
+	r.cursors = newCursorTracker()
+	return nil
+}
+
+// playbackFileNames returns the files to play for a playback file name: the
+// file itself or, if there is none by that name, the series of rotated files
+// recorded with it as their base name.
+func playbackFileNames(filename string) []string {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return []string{filename}
+	}
+	var names []string
+	for i := 0; ; i++ {
+		name := rotationFileName(filename, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return []string{filename}
+	}
+	return names
+}
+
+// playbackFileSeries reads a series of playback files one after another, as if
+// they were a single file. It can only seek to the beginning of the series.
+type playbackFileSeries struct {
+	files   []io.ReadSeeker
+	current int
+}
+
+func (series *playbackFileSeries) Read(p []byte) (int, error) {
+	for series.current < len(series.files) {
+		n, err := series.files[series.current].Read(p)
+		if err == io.EOF {
+			series.current++
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+// Seek sets the offset for the next Read, and can only seek to the beginning
+// of the series.
+func (series *playbackFileSeries) Seek(offset int64, whence int) (int64, error) {
+	if whence != 0 || offset != 0 {
+		return 0, fmt.Errorf("playbackFileSeries can only seek to beginning of file")
+	}
+	for _, file := range series.files {
+		if _, err := file.Seek(0, 0); err != nil {
+			return 0, err
+		}
+	}
+	series.current = 0
+	return 0, nil
+}
+
+// Close closes each of the playback files.
+func (series *playbackFileSeries) Close() error {
+	var err error
+	for _, file := range series.files {
+		if closer, ok := file.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
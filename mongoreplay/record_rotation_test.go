@@ -0,0 +1,148 @@
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// readPlaybackFile returns the ops of a playback file, or series of files.
+func readPlaybackFile(t *testing.T, filename string) []*RecordedOp {
+	reader, err := NewPlaybackFileReader(filename, false)
+	if err != nil {
+		t.Fatalf("error opening %v: %v", filename, err)
+	}
+	var ops []*RecordedOp
+	for {
+		op, err := reader.NextRecordedOp()
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatalf("error reading %v: %v", filename, err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+// writeRecordedOps writes the ops with the writer, closing it when done.
+func writeRecordedOps(t *testing.T, writer *PlaybackWriter, ops []*RecordedOp) {
+	for _, op := range ops {
+		bsonBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatalf("error marshaling op: %v", err)
+		}
+		if err := writer.writeOp(op, bsonBytes); err != nil {
+			t.Fatalf("error writing op: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("error closing playback file: %v", err)
+	}
+}
+
+func generatedOps(generator *recordedOpGenerator) []*RecordedOp {
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestRotatingPlaybackWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "tape")
+
+	generator := newRecordedOpGenerator()
+	if err := generator.generateQuery(bson.D{}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateReply(1, 7, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateGetMore(7, 2); err != nil {
+		t.Fatal(err)
+	}
+	ops := generatedOps(generator)
+	getMoreID := ops[2].Header.RequestID
+
+	generator = newRecordedOpGenerator()
+	if err := generator.generateReply(getMoreID, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops = append(ops, generatedOps(generator)...)
+
+	writer, err := NewRotatingPlaybackWriter(base, false, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecordedOps(t, writer, ops)
+
+	// the first file holds the whole cursor, past the limit of 2 ops
+	expected := []int{4, 2, 0}
+	for i, count := range expected {
+		if got := len(readPlaybackFile(t, rotationFileName(base, i))); got != count {
+			t.Errorf("expected %v ops in %v, got %v", count, rotationFileName(base, i), got)
+		}
+	}
+	if _, err := os.Stat(rotationFileName(base, len(expected))); !os.IsNotExist(err) {
+		t.Errorf("expected no more than %v files, got %v", len(expected), err)
+	}
+
+	// the series is read in order by its base name
+	read := readPlaybackFile(t, base)
+	if len(read) != len(ops) {
+		t.Fatalf("expected %v ops read from the series, got %v", len(ops), len(read))
+	}
+	for i, op := range read {
+		if op.Header.RequestID != ops[i].Header.RequestID || op.Header.OpCode != ops[i].Header.OpCode {
+			t.Errorf("expected op %v to be %v, got %v", i, ops[i], op)
+		}
+	}
+}
+
+func TestRotatingPlaybackWriterUnfinishedCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "tape")
+
+	// a query whose reply never comes keeps the file from rolling over, but
+	// only until it's twice the limit
+	generator := newRecordedOpGenerator()
+	if err := generator.generateQuery(bson.D{}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer, err := NewRotatingPlaybackWriter(base, false, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecordedOps(t, writer, generatedOps(generator))
+
+	for i, count := range []int{2, 1} {
+		if got := len(readPlaybackFile(t, rotationFileName(base, i))); got != count {
+			t.Errorf("expected %v ops in %v, got %v", count, rotationFileName(base, i), got)
+		}
+	}
+}
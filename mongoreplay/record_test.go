@@ -0,0 +1,392 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestRecordValidateStreamSettings(t *testing.T) {
+	record := &RecordCommand{NumWriters: 1}
+	if err := record.ValidateParams(nil); err != nil {
+		t.Fatalf("default settings should be valid: %v", err)
+	}
+	if record.SnapLen != defaultSnapLen {
+		t.Errorf("snaplen should default to %v, got %v", defaultSnapLen, record.SnapLen)
+	}
+	if record.PacketBufSize != 1000 {
+		t.Errorf("packet buffer size should default to 1000, got %v", record.PacketBufSize)
+	}
+
+	record = &RecordCommand{NumWriters: 1}
+	record.PacketBufSize = -1
+	if err := record.ValidateParams(nil); err == nil {
+		t.Errorf("negative packet buffer size should be rejected")
+	}
+
+	record = &RecordCommand{NumWriters: 1}
+	record.SnapLen = -1
+	if err := record.ValidateParams(nil); err == nil {
+		t.Errorf("negative snaplen should be rejected")
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	start := time.Now()
+	op := func(opCode OpCode, requestID, responseTo int32, after time.Duration) *RecordedOp {
+		recordedOp := &RecordedOp{Seen: &PreciseTime{start.Add(after)}, SrcEndpoint: "a", DstEndpoint: "b"}
+		if opCode == OpCodeReply {
+			recordedOp.SrcEndpoint, recordedOp.DstEndpoint = "b", "a"
+		}
+		recordedOp.Header.OpCode = opCode
+		recordedOp.Header.RequestID = requestID
+		recordedOp.Header.ResponseTo = responseTo
+		return recordedOp
+	}
+
+	budget := newByteBudget(100)
+	if !budget.allow(op(OpCodeQuery, 1, 0, 0), 60) {
+		t.Errorf("op within the budget should be allowed")
+	}
+	if budget.allow(op(OpCodeQuery, 2, 0, 0), 60) {
+		t.Errorf("op over the budget should be dropped")
+	}
+	// the reply to the dropped request is dropped even once there is budget
+	if budget.allow(op(OpCodeReply, 10, 2, time.Second), 10) {
+		t.Errorf("reply to a dropped request should be dropped")
+	}
+	if !budget.allow(op(OpCodeReply, 11, 1, time.Second), 10) {
+		t.Errorf("reply to a written request should be allowed once the budget refills")
+	}
+	eof := op(OpCodeQuery, 0, 0, time.Second)
+	eof.EOF = true
+	if !budget.allow(eof, 1000) {
+		t.Errorf("connection ends should always be allowed")
+	}
+	// the budget refills to at most a second's worth
+	if budget.allow(op(OpCodeQuery, 3, 0, 10*time.Second), 101) {
+		t.Errorf("op larger than a second's budget should be dropped")
+	}
+	if budget.droppedOps != 3 || budget.droppedBytes != 171 {
+		t.Errorf("expected 3 ops and 171 bytes dropped, got %v and %v", budget.droppedOps, budget.droppedBytes)
+	}
+
+	var unlimited *byteBudget
+	if !unlimited.allow(op(OpCodeQuery, 4, 0, 0), 1<<20) {
+		t.Errorf("a nil budget should allow every op")
+	}
+}
+
+func TestRetryDedup(t *testing.T) {
+	write := func(requestID int32, name string, session, txnNumber int) *RecordedOp {
+		op := msgOp(t, bson.D{{name, "test"}, {"lsid", bson.D{{"id", session}}}, {"txnNumber", int64(txnNumber)}})
+		op.Header.RequestID = requestID
+		op.SrcEndpoint, op.DstEndpoint = "a", "b"
+		return op
+	}
+	reply := func(responseTo int32) *RecordedOp {
+		op := &RecordedOp{SrcEndpoint: "b", DstEndpoint: "a"}
+		op.Header.OpCode = OpCodeMsg
+		op.Header.ResponseTo = responseTo
+		return op
+	}
+	transactionOp := msgOp(t, bson.D{{"insert", "test"}, {"lsid", bson.D{{"id", 1}}}, {"txnNumber", int64(1)},
+		{"autocommit", false}})
+
+	dedup := newRetryDedup()
+	for i, c := range []struct {
+		op      *RecordedOp
+		allowed bool
+	}{
+		{write(1, "insert", 1, 1), true},
+		{reply(1), true},
+		// the retry of the insert, and its reply
+		{write(2, "insert", 1, 1), false},
+		{reply(2), false},
+		// the next write of the session, and the same txnNumber on another
+		{write(3, "update", 1, 2), true},
+		{write(4, "delete", 2, 1), true},
+		// a stale retry
+		{write(5, "findAndModify", 1, 1), false},
+		// commands other than writes, and writes in transactions, are kept
+		{write(6, "find", 1, 1), true},
+		{transactionOp, true},
+		// legacy writes carry no session, so their retries are kept
+		{&RecordedOp{RawOp: RawOp{Header: MsgHeader{OpCode: OpCodeInsert}}}, true},
+	} {
+		allowed, err := dedup.allow(c.op)
+		if err != nil {
+			t.Fatalf("op %v: unexpected error: %v", i, err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("op %v: expected allowed to be %v, got %v", i, c.allowed, allowed)
+		}
+	}
+	if dedup.droppedOps != 2 {
+		t.Errorf("expected 2 retried writes dropped, got %v", dedup.droppedOps)
+	}
+
+	var none *retryDedup
+	if allowed, _ := none.allow(write(7, "insert", 1, 1)); !allowed {
+		t.Errorf("a nil retryDedup should allow every op")
+	}
+}
+
+func TestRecordMixedTraffic(t *testing.T) {
+	// the mixed traffic fixture holds the packets of the compressed one, and
+	// those of an HTTP connection and of a connection seen mid-stream whose
+	// data starts with what looks like a message header but doesn't parse
+	mongoOps := recordedOpsFromPcap(t, "compressed.pcap")
+	mixedOps := recordedOpsFromPcap(t, "mixed_traffic.pcap")
+	if len(mongoOps) == 0 || len(mixedOps) != len(mongoOps) {
+		t.Fatalf("expected only the %v MongoDB ops to be recorded, got %v", len(mongoOps), len(mixedOps))
+	}
+	for i := range mongoOps {
+		if !bytes.Equal(mongoOps[i].Body, mixedOps[i].Body) {
+			t.Errorf("op %v differs between the fixtures", i)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, err := getOpstream(OpStreamSettings{PcapFile: "mixed_traffic.pcap", PacketBufSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackWriter, err := NewPlaybackWriter(filepath.Join(dir, "tape"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(ctx, []*PlaybackWriter{playbackWriter}, false); err != nil {
+		t.Fatal(err)
+	}
+	if connections, messages := ctx.mongoOpStream.skippedNonMongo(); connections != 1 || messages != 1 {
+		t.Errorf("expected 1 connection and 1 message skipped, got %v and %v", connections, messages)
+	}
+}
+
+func TestRecordNumWriters(t *testing.T) {
+	// the fixture holds the same ops on three connections
+	expected := recordedOpsFromPcap(t, "multi_connection.pcapng")
+	opsPerConnection := map[int64]int{}
+	for _, op := range expected {
+		opsPerConnection[op.SeenConnectionNum]++
+	}
+	if len(opsPerConnection) != 3 {
+		t.Fatalf("expected ops on 3 connections, got %v", opsPerConnection)
+	}
+
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tape := filepath.Join(dir, "tape")
+	ctx, err := getOpstream(OpStreamSettings{PcapFile: "multi_connection.pcapng", PacketBufSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackWriters, err := NewPlaybackWriters(tape, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(ctx, playbackWriters, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shards aren't taken for a series of rotated files
+	if names := playbackFileNames(tape); !reflect.DeepEqual(names, []string{tape}) {
+		t.Errorf("expected the shards not to be played as a series, got %v", names)
+	}
+
+	// each connection is recorded whole into the shard of its number
+	var shards []string
+	recorded := map[int64]int{}
+	for i, playbackWriter := range playbackWriters {
+		if playbackWriter.fname != tape+".shard"+strconv.Itoa(i) {
+			t.Errorf("expected shard %v to be named with a .shard%v suffix, got %v", i, i, playbackWriter.fname)
+		}
+		shards = append(shards, playbackWriter.fname)
+		for _, op := range readPlaybackFile(t, playbackWriter.fname) {
+			if op.SeenConnectionNum%2 != int64(i) {
+				t.Errorf("op of connection %v recorded to shard %v", op.SeenConnectionNum, i)
+			}
+			recorded[op.SeenConnectionNum]++
+		}
+	}
+	if !reflect.DeepEqual(recorded, opsPerConnection) {
+		t.Errorf("expected the shards to hold %v ops per connection, got %v", opsPerConnection, recorded)
+	}
+
+	// merging the shards gives back every op in the order they were seen
+	var readers []*PlaybackFileReader
+	for _, shard := range shards {
+		reader, err := NewPlaybackFileReader(shard, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	merged := filepath.Join(dir, "merged")
+	writer, err := NewPlaybackWriter(merged, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mergePlaybackFiles(shards, readers, writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ops := readPlaybackFile(t, merged)
+	if len(ops) != len(expected) {
+		t.Fatalf("expected %v merged ops, got %v", len(expected), len(ops))
+	}
+	for i := 1; i < len(ops); i++ {
+		if ops[i].Seen.Before(ops[i-1].Seen.Time) {
+			t.Errorf("merged op %v was seen before the op ahead of it", i)
+		}
+	}
+	for i, op := range ops {
+		if !bytes.Equal(op.Body, expected[i].Body) || op.SeenConnectionNum != expected[i].SeenConnectionNum {
+			t.Errorf("merged op %v differs from the op recorded into one playback file", i)
+		}
+	}
+}
+
+// limitOps passes the ops through the limiter as Record does, returning those
+// that are written.
+func limitOps(t *testing.T, limiter *opLimiter, ops []*RecordedOp) []*RecordedOp {
+	var written []*RecordedOp
+	for _, op := range ops {
+		if limiter.done() {
+			continue
+		}
+		ok, err := limiter.shouldWrite(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			continue
+		}
+		if err := limiter.track(op); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, op)
+	}
+	return written
+}
+
+func TestOpLimiter(t *testing.T) {
+	// a query opening a cursor and two inserts reach the limit, after which
+	// only the getmore exhausting the cursor and its reply are written
+	generator := newRecordedOpGenerator()
+	if err := generator.generateQuery(bson.D{}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateReply(1, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := generator.generateGetMore(5, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateReply(10, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateInsert([]interface{}{bson.D{{"_id", 3}}}); err != nil {
+		t.Fatal(err)
+	}
+	ops := generatedOps(generator)
+	ops[5].Header.RequestID = 10
+
+	limiter := newOpLimiter(3)
+	written := limitOps(t, limiter, ops)
+	expected := []*RecordedOp{ops[0], ops[1], ops[2], ops[3], ops[5], ops[6]}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("expected ops 0 to 3, 5 and 6 to be written, got %v of them", len(written))
+	}
+	if !limiter.done() || limiter.requestsWritten != 4 {
+		t.Errorf("expected the limiter to be done after 4 requests, got done %v after %v",
+			limiter.done(), limiter.requestsWritten)
+	}
+
+	// a cursor left open is only waited on until twice the limit of requests
+	// have been seen
+	generator = newRecordedOpGenerator()
+	if err := generator.generateQuery(bson.D{}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateReply(1, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	limiter = newOpLimiter(2)
+	if written := limitOps(t, limiter, generatedOps(generator)); len(written) != 3 {
+		t.Errorf("expected 3 ops to be written, got %v", len(written))
+	}
+	if !limiter.done() || limiter.unfinished() != 1 {
+		t.Errorf("expected the limiter to be done with the cursor open, got done %v with %v unfinished",
+			limiter.done(), limiter.unfinished())
+	}
+}
+
+func TestRecordLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tape := filepath.Join(dir, "tape")
+	ctx, err := getOpstream(OpStreamSettings{PcapFile: "multi_connection.pcapng", PacketBufSize: 1000, MaxOps: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackWriter, err := NewPlaybackWriter(tape, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(ctx, []*PlaybackWriter{playbackWriter}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit counts requests, and each of them is recorded with its reply
+	requests := map[opKey]bool{}
+	var replies int
+	for _, op := range readPlaybackFile(t, tape) {
+		if op.EOF {
+			continue
+		}
+		if isReplyOpCode(op.RawOp) {
+			key := opKey{driverEndpoint: op.DstEndpoint, serverEndpoint: op.SrcEndpoint, opID: op.Header.ResponseTo}
+			if !requests[key] {
+				t.Errorf("reply to a request that wasn't recorded")
+			}
+			replies++
+			continue
+		}
+		requests[requestKey(op)] = true
+	}
+	if len(requests) != 4 || replies != 4 {
+		t.Errorf("expected 4 requests and their replies, got %v requests and %v replies", len(requests), replies)
+	}
+}
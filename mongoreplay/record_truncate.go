@@ -0,0 +1,268 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// docTruncation cuts the documents of recorded ops down to a number of bytes,
+// for tapes that only need the shapes of a workload's ops. Each document keeps
+// its leading fields, whole, up to the limit, and always its first field, its
+// $db and the fields naming a command's collection, so that the op type,
+// command and namespace of an op can still be read. Ops
+// whose documents were cut are marked as truncated, and can't be played.
+type docTruncation struct {
+	limit int
+
+	truncatedOps int64
+	savedBytes   int64
+}
+
+func newDocTruncation(limit int) *docTruncation {
+	return &docTruncation{limit: limit}
+}
+
+// truncate cuts down the documents of the op, marking it if any were too
+// large. A nil docTruncation keeps every op whole.
+func (t *docTruncation) truncate(op *RecordedOp) error {
+	if t == nil || op.EOF {
+		return nil
+	}
+	size := len(op.Body)
+	truncated, err := op.RawOp.truncateDocs(t.limit)
+	if err != nil || !truncated {
+		return err
+	}
+	op.TruncatedDocs = t.limit
+	t.truncatedOps++
+	t.savedBytes += int64(size - len(op.Body))
+	return nil
+}
+
+// truncateDocs cuts each document of the op down to the limit, returning
+// whether any was cut. Compressed ops are decompressed first, and an OP_MSG
+// loses its checksum, which no longer matches it. Ops whose documents all fit
+// are left as they are.
+func (op *RawOp) truncateDocs(limit int) (bool, error) {
+	msg := op.Body
+	if op.Header.OpCode == OpCodeCompressed {
+		var err error
+		if msg, err = decompressMessage(op.Body); err != nil {
+			return false, err
+		}
+	}
+	if len(msg) < MsgHeaderLen {
+		return false, fmt.Errorf("message of %v bytes is too short to hold its header", len(msg))
+	}
+	header := MsgHeader{}
+	header.FromWire(msg)
+
+	var body []byte
+	var truncated bool
+	var err error
+	if header.OpCode == OpCodeMsg {
+		body, truncated, err = truncateMsgDocs(msg, limit)
+	} else {
+		start, ok, startErr := docsStart(msg, header.OpCode)
+		if startErr != nil || !ok {
+			return false, startErr
+		}
+		body, truncated, err = appendTruncatedDocs(append([]byte{}, msg[:start]...), msg[start:], limit)
+	}
+	if err != nil || !truncated {
+		return false, err
+	}
+	SetInt32(body, 0, int32(len(body)))
+	header.MessageLength = int32(len(body))
+	op.Header = header
+	op.Body = body
+	return true, nil
+}
+
+// docsStart returns the offset of the first document of a message of the op
+// code, after the fields of its own, or false if it holds no documents.
+func docsStart(msg []byte, opCode OpCode) (int, bool, error) {
+	var before, cStrings, after int
+	switch opCode {
+	case OpCodeQuery:
+		before, cStrings, after = 4, 1, 8
+	case OpCodeInsert:
+		before, cStrings = 4, 1
+	case OpCodeUpdate, OpCodeDelete:
+		before, cStrings, after = 4, 1, 4
+	case OpCodeReply:
+		before = 20
+	case OpCodeCommand:
+		cStrings = 2
+	case OpCodeCommandReply:
+	default:
+		return 0, false, nil
+	}
+	pos := MsgHeaderLen + before
+	for i := 0; i < cStrings; i++ {
+		if pos > len(msg) {
+			break
+		}
+		end := bytes.IndexByte(msg[pos:], 0)
+		if end < 0 {
+			return 0, false, fmt.Errorf("unterminated string at offset %v", pos)
+		}
+		pos += end + 1
+	}
+	pos += after
+	if pos > len(msg) {
+		return 0, false, fmt.Errorf("message of %v bytes is too short for its fields", len(msg))
+	}
+	return pos, true, nil
+}
+
+// truncateMsgDocs returns the OP_MSG with the documents of its sections cut
+// down to the limit and without its checksum, and whether any were cut.
+func truncateMsgDocs(msg []byte, limit int) ([]byte, bool, error) {
+	if len(msg) < MsgHeaderLen+4 {
+		return nil, false, fmt.Errorf("OP_MSG of %v bytes is too short to hold its flags", len(msg))
+	}
+	flags := uint32(getInt32(msg, MsgHeaderLen))
+	end := len(msg)
+	if flags&msgFlagChecksumPresent != 0 {
+		end -= msgChecksumLen
+	}
+	body := append([]byte{}, msg[:MsgHeaderLen+4]...)
+	SetInt32(body, MsgHeaderLen, int32(flags&^msgFlagChecksumPresent))
+
+	var truncated bool
+	for pos := MsgHeaderLen + 4; pos < end; {
+		kind := msg[pos]
+		pos++
+		if pos+4 > end {
+			return nil, false, fmt.Errorf("truncated section at offset %v", pos)
+		}
+		size := int(getInt32(msg, pos))
+		if size < 5 || pos+size > end {
+			return nil, false, fmt.Errorf("invalid section size %v at offset %v", size, pos)
+		}
+		body = append(body, kind)
+		var cut bool
+		var err error
+		if kind == msgSectionBody {
+			body, cut, err = appendTruncatedDocs(body, msg[pos:pos+size], limit)
+		} else {
+			// a document sequence is its size and identifier, then its
+			// documents
+			idEnd := bytes.IndexByte(msg[pos+4:pos+size], 0)
+			if idEnd < 0 {
+				return nil, false, fmt.Errorf("unterminated document sequence identifier at offset %v", pos+4)
+			}
+			docsAt := pos + 4 + idEnd + 1
+			sizeAt := len(body)
+			body = append(body, msg[pos:docsAt]...)
+			body, cut, err = appendTruncatedDocs(body, msg[docsAt:pos+size], limit)
+			SetInt32(body, sizeAt, int32(len(body)-sizeAt))
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		truncated = truncated || cut
+		pos += size
+	}
+	return body, truncated, nil
+}
+
+// appendTruncatedDocs appends the documents to body, each cut down to the
+// limit, and returns whether any were cut.
+func appendTruncatedDocs(body, docs []byte, limit int) ([]byte, bool, error) {
+	var truncated bool
+	for pos := 0; pos < len(docs); {
+		if pos+4 > len(docs) {
+			return nil, false, fmt.Errorf("truncated document at offset %v", pos)
+		}
+		size := int(getInt32(docs, pos))
+		if size < 5 || pos+size > len(docs) {
+			return nil, false, fmt.Errorf("invalid document size %v at offset %v", size, pos)
+		}
+		doc, cut, err := truncateDocument(docs[pos:pos+size], limit)
+		if err != nil {
+			return nil, false, err
+		}
+		body = append(body, doc...)
+		truncated = truncated || cut
+		pos += size
+	}
+	return body, truncated, nil
+}
+
+// truncateDocument returns the document with the fields that don't fit within
+// the limit removed, and whether any were. Its first field, its $db and the
+// fields naming the collection of a command are kept however large, so that a
+// truncated command still names its namespace.
+func truncateDocument(doc []byte, limit int) ([]byte, bool, error) {
+	if len(doc) <= limit {
+		return doc, false, nil
+	}
+	raw := bson.RawD{}
+	if err := bson.Unmarshal(doc, &raw); err != nil {
+		return nil, false, err
+	}
+	// a document is its length, its fields and a terminating byte, and a
+	// field is its type, its name, the name's terminator and its value
+	elemSize := func(elem bson.RawDocElem) int {
+		return 1 + len(elem.Name) + 1 + len(elem.Value.Data)
+	}
+	size := 5
+	for i, elem := range raw {
+		if keptField(i, elem.Name) {
+			size += elemSize(elem)
+		}
+	}
+	// the other fields are kept up to the first that doesn't fit
+	kept := bson.RawD{}
+	full := false
+	for i, elem := range raw {
+		if !keptField(i, elem.Name) {
+			if full = full || size+elemSize(elem) > limit; full {
+				continue
+			}
+			size += elemSize(elem)
+		}
+		kept = append(kept, elem)
+	}
+	if len(kept) == len(raw) {
+		return doc, false, nil
+	}
+	truncated, err := bson.Marshal(kept)
+	if err != nil {
+		return nil, false, err
+	}
+	return truncated, true, nil
+}
+
+// keptField returns whether the field at position i of a document is kept
+// when the document is truncated.
+func keptField(i int, name string) bool {
+	return i == 0 || name == "$db" || name == "getMore" || name == "collection" || collectionCommands[name]
+}
+
+// truncatedOps counts the truncated ops of a playback file while it is
+// preprocessed, so that play can refuse it before playing any op.
+type truncatedOps struct {
+	count int
+	limit int
+}
+
+func (t *truncatedOps) observe(op *RecordedOp) {
+	if op.TruncatedDocs > 0 {
+		t.count++
+		t.limit = op.TruncatedDocs
+	}
+}
+
+// err returns an error if the playback file holds truncated ops.
+func (t *truncatedOps) err() error {
+	if t.count == 0 {
+		return nil
+	}
+	return fmt.Errorf("playback file holds %v ops whose documents were truncated to %v bytes with record "+
+		"--truncateDocs, which can't be played", t.count, t.limit)
+}
@@ -0,0 +1,184 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTruncateDocument(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{{"insert", "c"}, {"small", 1}, {"big", strings.Repeat("x", 200)}, {"after", 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, cut, err := truncateDocument(doc, 64)
+	if err != nil || !cut {
+		t.Fatalf("expected the document to be cut, got %v %v", cut, err)
+	}
+	kept := bson.D{}
+	if err := bson.Unmarshal(truncated, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (bson.D{{"insert", "c"}, {"small", 1}}); !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, kept)
+	}
+
+	// the first field is kept however large
+	truncated, cut, err = truncateDocument(doc, 5)
+	if err != nil || !cut {
+		t.Fatalf("expected the document to be cut, got %v %v", cut, err)
+	}
+	kept = bson.D{}
+	if err := bson.Unmarshal(truncated, &kept); err != nil || len(kept) != 1 || kept[0].Name != "insert" {
+		t.Errorf("expected only the first field to be kept, got %v %v", kept, err)
+	}
+
+	if same, cut, err := truncateDocument(doc, len(doc)); err != nil || cut || !bytes.Equal(same, doc) {
+		t.Errorf("expected a document within the limit to be kept whole")
+	}
+}
+
+func TestTruncateDocumentKeepsNamespace(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{"find", "c"},
+		{"filter", bson.D{{"a", strings.Repeat("x", 200)}}},
+		{"limit", 1},
+		{"$db", "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, cut, err := truncateDocument(doc, 64)
+	if err != nil || !cut {
+		t.Fatalf("expected the document to be cut, got %v %v", cut, err)
+	}
+	kept := bson.D{}
+	if err := bson.Unmarshal(truncated, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (bson.D{{"find", "c"}, {"$db", "test"}}); !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, kept)
+	}
+
+	// the collection of a command is kept wherever it is
+	doc, err = bson.Marshal(bson.D{
+		{"$db", "test"},
+		{"comment", strings.Repeat("x", 200)},
+		{"getMore", int64(5)},
+		{"collection", "c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, _, err = truncateDocument(doc, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept = bson.D{}
+	if err := bson.Unmarshal(truncated, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (bson.D{{"$db", "test"}, {"getMore", int64(5)}, {"collection", "c"}}); !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected %v to be kept, got %v", expected, kept)
+	}
+}
+
+func TestTruncateDocsQuery(t *testing.T) {
+	big := strings.Repeat("x", 1000)
+	msg := opQuery(t, 3, "test.$cmd", bson.D{{"find", "coll"}, {"filter", bson.D{{"name", big}}}})
+	op := &RecordedOp{RawOp: RawOp{Body: msg}}
+	op.Header.FromWire(msg)
+
+	truncation := newDocTruncation(100)
+	if err := truncation.truncate(op); err != nil {
+		t.Fatal(err)
+	}
+	if op.TruncatedDocs != 100 || truncation.truncatedOps != 1 || truncation.savedBytes <= 1000 {
+		t.Errorf("expected the op to be marked truncated, got %v, %v ops, %v bytes",
+			op.TruncatedDocs, truncation.truncatedOps, truncation.savedBytes)
+	}
+	if int(op.Header.MessageLength) != len(op.Body) || int(getInt32(op.Body, 0)) != len(op.Body) {
+		t.Errorf("expected the message length to match the truncated body")
+	}
+
+	// the op can still be parsed, and its namespace read
+	parsed, err := op.RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := opNamespace(parsed); ns != "test.coll" {
+		t.Errorf("expected namespace test.coll, got %v", ns)
+	}
+
+	small := &RecordedOp{RawOp: RawOp{Body: opQuery(t, 4, "test.$cmd", bson.D{{"ping", 1}})}}
+	small.Header.FromWire(small.Body)
+	if err := truncation.truncate(small); err != nil || small.TruncatedDocs != 0 {
+		t.Errorf("expected a small op to be kept whole, got %v %v", small.TruncatedDocs, err)
+	}
+}
+
+func TestTruncateDocsMsg(t *testing.T) {
+	body, err := bson.Marshal(bson.D{{"insert", "coll"}, {"$db", "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := bson.Marshal(bson.D{{"_id", 1}, {"payload", strings.Repeat("x", 500)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, MsgHeaderLen+4)
+	SetInt32(msg, MsgHeaderLen, msgFlagChecksumPresent)
+	msg = append(msg, msgSectionBody)
+	msg = append(msg, body...)
+	sequence := append([]byte{0, 0, 0, 0}, "documents\x00"...)
+	sequence = append(sequence, doc...)
+	sequence = append(sequence, doc...)
+	SetInt32(sequence, 0, int32(len(sequence)))
+	msg = append(msg, 1)
+	msg = append(msg, sequence...)
+	msg = append(msg, 0, 0, 0, 0)
+	copy(msg, MsgHeader{MessageLength: int32(len(msg)), RequestID: 1, OpCode: OpCodeMsg}.ToWire())
+	SetInt32(msg, len(msg)-msgChecksumLen, int32(msgChecksum(msg[:len(msg)-msgChecksumLen])))
+
+	op := &RawOp{Body: msg}
+	op.Header.FromWire(msg)
+	truncated, err := op.truncateDocs(64)
+	if err != nil || !truncated {
+		t.Fatalf("expected the op to be truncated, got %v %v", truncated, err)
+	}
+	if op.hasChecksum() {
+		t.Errorf("expected the checksum to be dropped")
+	}
+	command, ok, err := msgCommand(op)
+	if err != nil || !ok || !reflect.DeepEqual(command, bson.D{{"insert", "coll"}, {"$db", "test"}}) {
+		t.Errorf("expected the body section to be kept whole, got %v %v", command, err)
+	}
+	sequenceAt := MsgHeaderLen + 4 + 1 + len(body) + 1
+	sequenceSize := int(getInt32(op.Body, sequenceAt))
+	if sequenceAt+sequenceSize != len(op.Body) {
+		t.Fatalf("expected the document sequence to end the message")
+	}
+	docs, _, err := appendTruncatedDocs(nil, op.Body[sequenceAt+4+len("documents\x00"):], 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bson.D{}
+	if err := bson.Unmarshal(docs, &first); err != nil || !reflect.DeepEqual(first, bson.D{{"_id", 1}}) {
+		t.Errorf("expected the documents to keep only their _id, got %v %v", first, err)
+	}
+}
+
+func TestTruncatedOps(t *testing.T) {
+	truncated := &truncatedOps{}
+	truncated.observe(&RecordedOp{})
+	if truncated.err() != nil {
+		t.Errorf("expected a whole tape to be playable")
+	}
+	truncated.observe(&RecordedOp{TruncatedDocs: 100})
+	if truncated.err() == nil {
+		t.Errorf("expected a truncated tape to be refused")
+	}
+}
@@ -0,0 +1,84 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"time"
+)
+
+// slowOps holds the requests in a tape whose recorded reply came later than a
+// threshold, found from the times the request and its reply were seen in the
+// capture.
+type slowOps struct {
+	threshold time.Duration
+
+	// pending holds the time each request without a reply yet was seen
+	pending map[string]time.Time
+
+	// slow holds the requests whose reply came later than the threshold
+	slow map[string]bool
+}
+
+// newSlowOps reads the ops of a tape, finding the requests whose recorded
+// latency exceeds the threshold.
+func newSlowOps(opChan <-chan *RecordedOp, threshold time.Duration) *slowOps {
+	userInfoLogger.Logvf(Always, "Finding ops with a recorded latency above %v", threshold)
+	slow := &slowOps{
+		threshold: threshold,
+		pending:   map[string]time.Time{},
+		slow:      map[string]bool{},
+	}
+	for op := range opChan {
+		slow.observe(op)
+	}
+	userInfoLogger.Logvf(Always, "Found %v ops with a recorded latency above %v", len(slow.slow), threshold)
+	return slow
+}
+
+// latencyKey identifies a request by its connection and request id, or for a
+// reply, the request it answers. Unlike cacheKey, it is the same for every
+// generation of a repeated playback.
+func latencyKey(op *RecordedOp, response bool) string {
+	if response {
+		return fmt.Sprintf("%v:%d", op.ReversedConnectionString(), op.Header.ResponseTo)
+	}
+	return fmt.Sprintf("%v:%d", op.ConnectionString(), op.Header.RequestID)
+}
+
+// isReply returns whether the op is a reply. OP_MSG is used for both requests
+// and replies, and its replies are those responding to a request.
+func isReply(op *RecordedOp) bool {
+	return op.OpCode() == OpCodeReply || op.OpCode() == OpCodeCommandReply ||
+		(op.OpCode() == OpCodeMsg && op.Header.ResponseTo != 0)
+}
+
+// observe notes the time a request was seen, or for a reply, whether its
+// request was slow.
+func (s *slowOps) observe(op *RecordedOp) {
+	if op.EOF || op.Seen == nil {
+		return
+	}
+	if !isReply(op) {
+		s.pending[latencyKey(op, false)] = op.Seen.Time
+		return
+	}
+	key := latencyKey(op, true)
+	seen, ok := s.pending[key]
+	if !ok {
+		return
+	}
+	delete(s.pending, key)
+	if op.Seen.Sub(seen) > s.threshold {
+		s.slow[key] = true
+	}
+}
+
+// keep returns whether the op should be played: a slow request, the recorded
+// reply to one, or the end of a connection.
+func (s *slowOps) keep(op *RecordedOp) bool {
+	return op.EOF || s.slow[latencyKey(op, isReply(op))]
+}
+
+// filter passes on only the ops of the channel that should be played.
+func (s *slowOps) filter(opChan <-chan *RecordedOp) <-chan *RecordedOp {
+	return filterOps(opChan, s.keep)
+}
@@ -0,0 +1,63 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowOps(t *testing.T) {
+	start := time.Now()
+	op := func(opCode OpCode, requestID, responseTo int32, src, dst string, after time.Duration) *RecordedOp {
+		recordedOp := &RecordedOp{
+			Seen:        &PreciseTime{start.Add(after)},
+			SrcEndpoint: src,
+			DstEndpoint: dst,
+		}
+		recordedOp.Header.OpCode = opCode
+		recordedOp.Header.RequestID = requestID
+		recordedOp.Header.ResponseTo = responseTo
+		return recordedOp
+	}
+
+	fastQuery := op(OpCodeQuery, 1, 0, "a", "b", 0)
+	fastReply := op(OpCodeReply, 10, 1, "b", "a", 5*time.Millisecond)
+	slowQuery := op(OpCodeQuery, 2, 0, "a", "b", 10*time.Millisecond)
+	slowCommand := op(OpCodeCommand, 2, 0, "c", "b", 10*time.Millisecond)
+	slowCommandReply := op(OpCodeCommandReply, 11, 2, "b", "c", 40*time.Millisecond)
+	slowReply := op(OpCodeReply, 12, 2, "b", "a", 60*time.Millisecond)
+	unanswered := op(OpCodeInsert, 3, 0, "a", "b", 70*time.Millisecond)
+	eof := op(0, 0, 0, "a", "b", 80*time.Millisecond)
+	eof.EOF = true
+
+	ops := []*RecordedOp{fastQuery, fastReply, slowQuery, slowCommand,
+		slowCommandReply, slowReply, unanswered, eof}
+	opChan := make(chan *RecordedOp, len(ops))
+	for _, op := range ops {
+		opChan <- op
+	}
+	close(opChan)
+	slow := newSlowOps(opChan, 20*time.Millisecond)
+
+	expected := map[*RecordedOp]bool{
+		fastQuery:        false,
+		fastReply:        false,
+		slowQuery:        true,
+		slowCommand:      true,
+		slowCommandReply: true,
+		slowReply:        true,
+		unanswered:       false,
+		eof:              true,
+	}
+	for op, keep := range expected {
+		if slow.keep(op) != keep {
+			t.Errorf("expected keep to be %v for %v", keep, op.ConnectionString())
+		}
+	}
+
+	// the keys are the same for every generation of a repeated playback
+	repeated := *slowQuery
+	repeated.Generation = 1
+	if !slow.keep(&repeated) {
+		t.Errorf("expected a repeated slow op to be kept")
+	}
+}
@@ -3,16 +3,66 @@ package mongoreplay
 // RecordedOp stores an op in addition to record/playback -related metadata
 type RecordedOp struct {
 	RawOp
-	Seen                *PreciseTime
-	PlayAt              *PreciseTime `bson:",omitempty"`
-	EOF                 bool         `bson:",omitempty"`
-	SrcEndpoint         string
-	DstEndpoint         string
+
+	// Seen is the time the op was seen in the capture, shifted during
+	// playback for repeated generations.
+	Seen *PreciseTime
+
+	// PlayAt is the time the op is scheduled to be played at.
+	PlayAt *PreciseTime `bson:",omitempty"`
+
+	// EOF is set on the op marking the end of its connection, which holds no
+	// wire message.
+	EOF bool `bson:",omitempty"`
+
+	// SrcEndpoint and DstEndpoint are the host:port of the sender and the
+	// receiver of the op, so that the driver is the source of a request and
+	// the server the source of a reply.
+	SrcEndpoint string
+	DstEndpoint string
+
+	// SeenConnectionNum is the number of the connection the op was recorded
+	// on, numbered in the order the connections were seen, and
+	// PlayedConnectionNum that of the connection it was played on.
 	SeenConnectionNum   int64
 	PlayedConnectionNum int64
-	PlayedAt            *PreciseTime `bson:",omitempty"`
-	Generation          int
-	Order               int64
+
+	// PlayedAt is the time the op was played.
+	PlayedAt *PreciseTime `bson:",omitempty"`
+
+	// Generation is the repetition of the tape the op is played in with
+	// --repeat, and Order its position in the tape.
+	Generation int
+	Order      int64
+
+	// TapeVersion is the version of the tape format the op was written in,
+	// which is zero for tapes written without --captureResponses.
+	TapeVersion int `bson:",omitempty"`
+
+	// ResponseFields holds the fields that a captured reply was truncated
+	// to, and is empty if the reply was kept whole.
+	ResponseFields []string `bson:",omitempty"`
+
+	// ChecksumMismatch is set on an OP_MSG recorded with a checksum that
+	// doesn't match its contents, as happens in a corrupted capture.
+	ChecksumMismatch bool `bson:",omitempty"`
+
+	// TruncatedDocs is the number of bytes the documents of the op were cut
+	// down to with --truncateDocs, and is zero if they were kept whole. A
+	// truncated op can be inspected but not played.
+	TruncatedDocs int `bson:",omitempty"`
+
+	// RecordedAt is the time the op was originally seen in the capture. It is
+	// set during playback, when Seen is shifted for repeated generations.
+	RecordedAt *PreciseTime `bson:"-"`
+
+	// DispatchedAt is the time the op was handed to the session that plays
+	// it, which happens ahead of PlayAt.
+	DispatchedAt *PreciseTime `bson:"-"`
+
+	// Synthetic is set on the copies of recorded ops played with
+	// --synthesize, whose inserted documents get new _ids as they are played.
+	Synthetic bool `bson:"-"`
 }
 
 // ConnectionString gives a serialized representation of the endpoints
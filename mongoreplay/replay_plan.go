@@ -0,0 +1,115 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// replayPlan summarizes the ops a playback would send, found from a pass over
+// the tape, so that a replay can be checked before any load is sent to the
+// target.
+type replayPlan struct {
+	// ops counts the ops that would be played by op type and, for commands,
+	// the command name, as in the stats
+	ops map[string]int64
+
+	namespaces  map[string]struct{}
+	connections map[string]struct{}
+
+	// unparsed counts the ops that couldn't be parsed
+	unparsed int64
+
+	first, last time.Time
+}
+
+func newReplayPlan() *replayPlan {
+	return &replayPlan{
+		ops:         map[string]int64{},
+		namespaces:  map[string]struct{}{},
+		connections: map[string]struct{}{},
+	}
+}
+
+// observe adds an op of the tape to the plan. Replies and connection ends are
+// only used for the recorded duration, since they aren't played.
+func (plan *replayPlan) observe(op *RecordedOp) {
+	if op.Seen != nil {
+		if plan.first.IsZero() || op.Seen.Before(plan.first) {
+			plan.first = op.Seen.Time
+		}
+		if op.Seen.After(plan.last) {
+			plan.last = op.Seen.Time
+		}
+	}
+	if op.EOF || isReply(op) {
+		return
+	}
+	plan.connections[op.ConnectionString()] = struct{}{}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil {
+		plan.unparsed++
+		return
+	}
+	meta := parsedOp.Meta()
+	plan.ops[opTypeName(meta)]++
+	if meta.Ns != "" {
+		plan.namespaces[meta.Ns] = struct{}{}
+	}
+}
+
+// recordedDuration returns the time between the first and last ops seen.
+func (plan *replayPlan) recordedDuration() time.Duration {
+	return plan.last.Sub(plan.first)
+}
+
+// sortedKeys returns the keys of the set in sorted order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write prints the plan, estimating the duration of playing the tape repeat
+// times at the given speed.
+func (plan *replayPlan) write(out io.Writer, speed float64, repeat int) error {
+	opTypes := make([]string, 0, len(plan.ops))
+	var total int64
+	for opType, count := range plan.ops {
+		opTypes = append(opTypes, opType)
+		total += count
+	}
+	sort.Strings(opTypes)
+
+	recorded := plan.recordedDuration()
+	estimated := time.Duration(float64(recorded) / speed * float64(repeat))
+
+	lines := []string{
+		fmt.Sprintf("ops: %v", total),
+	}
+	for _, opType := range opTypes {
+		lines = append(lines, fmt.Sprintf("  %v: %v", opType, plan.ops[opType]))
+	}
+	if plan.unparsed > 0 {
+		lines = append(lines, fmt.Sprintf("unparsed ops: %v", plan.unparsed))
+	}
+	lines = append(lines, fmt.Sprintf("namespaces: %v", len(plan.namespaces)))
+	for _, ns := range sortedKeys(plan.namespaces) {
+		lines = append(lines, "  "+ns)
+	}
+	lines = append(lines,
+		fmt.Sprintf("connections: %v", len(plan.connections)),
+		fmt.Sprintf("recorded duration: %v", recorded),
+		fmt.Sprintf("estimated replay duration: %v (%vx speed, %v generations)", estimated, speed, repeat),
+	)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestReplayPlan(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	var ops []*RecordedOp
+	for _, op := range []interface{}{
+		&mgo.InsertOp{Collection: "mongoreplay.test", Documents: []interface{}{bson.D{{"a", 1}}}},
+		&mgo.InsertOp{Collection: "mongoreplay.other", Documents: []interface{}{bson.D{{"a", 1}}}},
+		&mgo.QueryOp{Collection: "mongoreplay.test", Query: bson.D{{"a", 1}}},
+	} {
+		recordedOp, err := generator.fetchRecordedOpsFromConn(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, recordedOp)
+	}
+	reply := &RecordedOp{Seen: &PreciseTime{ops[0].Seen.Add(10 * time.Second)}, SrcEndpoint: "b", DstEndpoint: "a"}
+	reply.Header.OpCode = OpCodeReply
+	ops = append(ops, reply)
+
+	plan := newReplayPlan()
+	for _, op := range ops {
+		plan.observe(op)
+	}
+	if plan.ops["insert"] != 2 || plan.ops["query"] != 1 || len(plan.ops) != 2 {
+		t.Errorf("unexpected op counts %v", plan.ops)
+	}
+	if len(plan.namespaces) != 2 || len(plan.connections) != 1 {
+		t.Errorf("unexpected namespaces %v or connections %v", plan.namespaces, plan.connections)
+	}
+	if plan.recordedDuration() != 10*time.Second {
+		t.Errorf("expected a recorded duration of 10s, got %v", plan.recordedDuration())
+	}
+
+	var out bytes.Buffer
+	if err := plan.write(&out, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"ops: 3",
+		"  insert: 2",
+		"namespaces: 2",
+		"  mongoreplay.other",
+		"connections: 1",
+		"estimated replay duration: 15s (2x speed, 3 generations)",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in plan:\n%v", line, out.String())
+		}
+	}
+}
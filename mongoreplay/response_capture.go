@@ -0,0 +1,172 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// responsesTapeVersion is the version of the tape format written with
+// --captureResponses, in which the replies of the recording are kept for
+// comparison with those of a playback, rather than shortened to what playback
+// needs. Ops written without it have no version.
+const responsesTapeVersion = 1
+
+// currentTapeVersion is the newest version of the tape format that can be
+// read.
+const currentTapeVersion = responsesTapeVersion
+
+// defaultResponseFields are the fields kept in the documents of captured
+// replies unless others are given: the ids of returned documents, and the
+// outcome of commands and writes.
+var defaultResponseFields = []string{
+	"_id", "ok", "n", "nModified", "code", "codeName", "errmsg",
+	"writeErrors", "writeConcernError",
+	"cursor.ns", "cursor.firstBatch._id", "cursor.nextBatch._id",
+}
+
+// cursorIDField is kept in every captured reply, since playback needs it to
+// map the cursors of the recording to those of the target.
+const cursorIDField = "cursor.id"
+
+// responseCapture keeps the replies of a recording in the tape.
+type responseCapture struct {
+	// fields holds the dot-delimited paths of the fields kept in each reply
+	// document, or nil to keep whole replies.
+	fields []string
+}
+
+// newResponseCapture returns a responseCapture that truncates the documents
+// of replies to the given fields, or keeps whole replies if full is set.
+func newResponseCapture(fields []string, full bool) *responseCapture {
+	if full {
+		return &responseCapture{}
+	}
+	if len(fields) == 0 {
+		fields = defaultResponseFields
+	}
+	return &responseCapture{fields: append([]string{cursorIDField}, fields...)}
+}
+
+// capture marks the op as written in the responses tape format, and truncates
+// it to the captured fields if it is a reply.
+func (capture *responseCapture) capture(op *RecordedOp) error {
+	op.TapeVersion = responsesTapeVersion
+	if capture.fields == nil || !isReplyOpCode(op.RawOp) {
+		return nil
+	}
+	if err := op.RawOp.truncateReply(capture.fields); err != nil {
+		return err
+	}
+	op.ResponseFields = capture.fields
+	return nil
+}
+
+// isReplyOpCode returns whether the op is a reply, looking at the op code a
+// compressed op wraps.
+func isReplyOpCode(op RawOp) bool {
+	opCode := op.Header.OpCode
+	if opCode == OpCodeCompressed && len(op.Body) >= MsgHeaderLen+4 {
+		opCode = OpCode(getInt32(op.Body, MsgHeaderLen))
+	}
+	return opCode == OpCodeReply || opCode == OpCodeCommandReply
+}
+
+// truncateReply replaces each document of a reply with one holding only the
+// given fields, keeping the number of documents. Compressed replies are
+// decompressed first.
+func (op *RawOp) truncateReply(fields []string) error {
+	if op.Header.OpCode == OpCodeCompressed {
+		newMsg, err := decompressMessage(op.Body)
+		if err != nil {
+			return err
+		}
+		op.Header.FromWire(newMsg)
+		op.Body = newMsg
+	}
+
+	var start int
+	switch op.Header.OpCode {
+	case OpCodeReply:
+		start = MsgHeaderLen + 20
+	case OpCodeCommandReply:
+		start = MsgHeaderLen
+	default:
+		return fmt.Errorf("unexpected op type : %v", op.Header.OpCode)
+	}
+	if len(op.Body) < start {
+		return fmt.Errorf("reply of %v bytes is too short", len(op.Body))
+	}
+
+	body := append([]byte{}, op.Body[:start]...)
+	for pos := start; pos < len(op.Body); {
+		if pos+4 > len(op.Body) {
+			return fmt.Errorf("truncated document at offset %v", pos)
+		}
+		size := int(getInt32(op.Body, pos))
+		if size < 5 || pos+size > len(op.Body) {
+			return fmt.Errorf("invalid document size %v at offset %v", size, pos)
+		}
+		doc := bson.D{}
+		if err := bson.Unmarshal(op.Body[pos:pos+size], &doc); err != nil {
+			return err
+		}
+		docBytes, err := bson.Marshal(projectFields(doc, fields))
+		if err != nil {
+			return err
+		}
+		body = append(body, docBytes...)
+		pos += size
+	}
+	SetInt32(body, 0, int32(len(body)))
+	op.Header.MessageLength = int32(len(body))
+	op.Body = body
+	return nil
+}
+
+// projectFields returns the elements of the document named by the
+// dot-delimited paths. A path into an array applies to each of its documents.
+func projectFields(doc bson.D, paths []string) bson.D {
+	kept := bson.D{}
+	for _, elem := range doc {
+		var whole bool
+		var subPaths []string
+		for _, path := range paths {
+			if path == elem.Name {
+				whole = true
+			} else if strings.HasPrefix(path, elem.Name+".") {
+				subPaths = append(subPaths, path[len(elem.Name)+1:])
+			}
+		}
+		if whole {
+			kept = append(kept, elem)
+		} else if value, ok := projectValue(elem.Value, subPaths); ok {
+			kept = append(kept, bson.DocElem{Name: elem.Name, Value: value})
+		}
+	}
+	return kept
+}
+
+// projectValue projects the fields of a document, or of each document in an
+// array, returning false if the value has no fields to project.
+func projectValue(value interface{}, paths []string) (interface{}, bool) {
+	if len(paths) == 0 {
+		return nil, false
+	}
+	switch v := value.(type) {
+	case bson.D:
+		return projectFields(v, paths), true
+	case []interface{}:
+		projected := make([]interface{}, len(v))
+		for i, elem := range v {
+			if doc, ok := elem.(bson.D); ok {
+				projected[i] = projectFields(doc, paths)
+			} else {
+				projected[i] = elem
+			}
+		}
+		return projected, true
+	}
+	return nil, false
+}
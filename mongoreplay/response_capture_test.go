@@ -0,0 +1,135 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestProjectFields(t *testing.T) {
+	doc := bson.D{
+		{"_id", 1},
+		{"ok", 1.0},
+		{"big", "payload"},
+		{"cursor", bson.D{
+			{"id", int64(5)},
+			{"firstBatch", []interface{}{
+				bson.D{{"_id", 2}, {"big", "payload"}},
+				"not a document",
+			}},
+		}},
+	}
+	projected := projectFields(doc, []string{"_id", "ok", "cursor.id", "cursor.firstBatch._id", "missing.field"})
+	expected := bson.D{
+		{"_id", 1},
+		{"ok", 1.0},
+		{"cursor", bson.D{
+			{"id", int64(5)},
+			{"firstBatch", []interface{}{
+				bson.D{{"_id", 2}},
+				"not a document",
+			}},
+		}},
+	}
+	if fmt.Sprint(projected) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, projected)
+	}
+}
+
+func TestCaptureCommandReply(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	op := CommandReplyOp{}
+	op.Metadata = bson.D{{"big", "metadata"}}
+	op.CommandReply = bson.D{
+		{"cursor", bson.D{
+			{"id", int64(42)},
+			{"ns", "mongoreplay.test"},
+			{"firstBatch", []interface{}{bson.D{{"_id", 1}, {"big", "payload"}}}},
+		}},
+		{"ok", 1.0},
+		{"big", "payload"},
+	}
+	op.OutputDocs = []interface{}{bson.D{{"_id", 2}, {"big", "payload"}}}
+	result, err := generator.fetchRecordedOpsFromConn(&op.CommandReplyOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullLength := result.Header.MessageLength
+
+	if err := newResponseCapture(nil, false).capture(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.TapeVersion != responsesTapeVersion || len(result.ResponseFields) == 0 {
+		t.Errorf("expected the reply to be marked as truncated, got version %v and fields %v", result.TapeVersion, result.ResponseFields)
+	}
+	if result.Header.MessageLength >= fullLength || int(result.Header.MessageLength) != len(result.Body) {
+		t.Errorf("expected a shorter, consistent message length, got %v (was %v) for a body of %v bytes",
+			result.Header.MessageLength, fullLength, len(result.Body))
+	}
+
+	parsed, err := result.RawOp.Parse()
+	if err != nil {
+		t.Fatalf("error parsing truncated reply: %v", err)
+	}
+	reply := parsed.(*CommandReplyOp)
+	if cursorID, _ := reply.getCursorID(); cursorID != 42 {
+		t.Errorf("expected the cursor id to be kept, got %v", cursorID)
+	}
+	commandReply := bson.D{}
+	if err := reply.CommandReply.(*bson.Raw).Unmarshal(&commandReply); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{"cursor", bson.D{
+			{"id", int64(42)},
+			{"ns", "mongoreplay.test"},
+			{"firstBatch", []interface{}{bson.D{{"_id", 1}}}},
+		}},
+		{"ok", 1.0},
+	}
+	if fmt.Sprint(commandReply) != fmt.Sprint(expected) {
+		t.Errorf("expected the command reply to be truncated to %v, got %v", expected, commandReply)
+	}
+	if len(reply.OutputDocs) != 1 {
+		t.Fatalf("expected the output doc to be kept, got %v", len(reply.OutputDocs))
+	}
+	outputDoc := bson.D{}
+	if err := reply.OutputDocs[0].(*bson.Raw).Unmarshal(&outputDoc); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(outputDoc) != fmt.Sprint(bson.D{{"_id", 2}}) {
+		t.Errorf("expected the output doc to be truncated to its _id, got %v", outputDoc)
+	}
+
+	// with --full-replies the reply is kept whole
+	result, err = generator.fetchRecordedOpsFromConn(&op.CommandReplyOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newResponseCapture(nil, true).capture(result); err != nil {
+		t.Fatal(err)
+	}
+	if result.TapeVersion != responsesTapeVersion || result.ResponseFields != nil || result.Header.MessageLength != fullLength {
+		t.Errorf("expected a whole reply, got version %v, fields %v and length %v",
+			result.TapeVersion, result.ResponseFields, result.Header.MessageLength)
+	}
+}
+
+func TestReadNewerTapeVersion(t *testing.T) {
+	for _, version := range []int{0, currentTapeVersion, currentTapeVersion + 1} {
+		bsonBytes, err := bson.Marshal(&RecordedOp{Seen: &PreciseTime{time.Now()}, TapeVersion: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := &PlaybackFileReader{bytes.NewReader(bsonBytes)}
+		_, err = reader.NextRecordedOp()
+		if version > currentTapeVersion && err == nil {
+			t.Errorf("expected an error reading tape format version %v", version)
+		} else if version <= currentTapeVersion && err != nil {
+			t.Errorf("unexpected error reading tape format version %v: %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package mongoreplay
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// commentAllCommandsWireVersion is the wire version of the first server
+// release (4.4) that accepts a comment on every command. Older servers only
+// accept one on find.
+const commentAllCommandsWireVersion = 9
+
+// newRunID returns a random version 4 UUID to identify a playback run.
+func newRunID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// runIDComment returns the comment that tags an op with the run id, keeping
+// any recorded string comment in front of it. Other recorded comments are left
+// as they are.
+func runIDComment(recorded interface{}, runID string) interface{} {
+	tag := "mongoreplay run " + runID
+	switch comment := recorded.(type) {
+	case nil:
+		return tag
+	case string:
+		return comment + " (" + tag + ")"
+	}
+	return recorded
+}
+
+// tagRunID adds the run id as a comment to the queries and, if the target
+// accepts it, commands of the op, so that the ops of a playback can be told
+// apart in the logs and currentOp of the target. Ops that can't carry a
+// comment, such as legacy writes, are left as they are.
+func (context *ExecutionContext) tagRunID(op Op) error {
+	commentAll := context.TargetWireVersion >= commentAllCommandsWireVersion
+	switch castOp := op.(type) {
+	case *QueryOp:
+		doc, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !strings.Contains(castOp.Collection, ".$cmd"):
+			castOp.Query = commentQuery(doc, context.RunID)
+		case commentAll || (len(doc) > 0 && doc[0].Name == "find"):
+			castOp.Query = commentCommand(doc, context.RunID)
+		}
+	case *CommandOp:
+		if castOp.CommandName != "find" && !commentAll {
+			return nil
+		}
+		doc, err := toBSOND(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		castOp.CommandArgs = commentCommand(doc, context.RunID)
+	case *MsgOp:
+		if castOp.commandName() != "find" && !commentAll {
+			return nil
+		}
+		return castOp.editBody(func(doc bson.D) (bson.D, error) {
+			return commentCommand(doc, context.RunID), nil
+		})
+	}
+	return nil
+}
+
+// commentQuery adds the run id comment to an OP_QUERY filter, wrapping it in
+// $query if it isn't already.
+func commentQuery(doc bson.D, runID string) bson.D {
+	for _, elem := range doc {
+		if elem.Name == "query" {
+			// wrapped without the $, which can't be mixed with $comment
+			return doc
+		}
+	}
+	for _, elem := range doc {
+		if elem.Name == "$query" {
+			return setComment(doc, "$comment", runID)
+		}
+	}
+	return setComment(bson.D{{Name: "$query", Value: doc}}, "$comment", runID)
+}
+
+// commentCommand adds the run id comment to a command.
+func commentCommand(doc bson.D, runID string) bson.D {
+	return setComment(doc, "comment", runID)
+}
+
+// setComment sets the named comment field of the document to the run id
+// comment.
+func setComment(doc bson.D, name string, runID string) bson.D {
+	for i, elem := range doc {
+		if elem.Name == name {
+			doc[i].Value = runIDComment(elem.Value, runID)
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{Name: name, Value: runIDComment(nil, runID)})
+}
@@ -0,0 +1,78 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestNewRunID(t *testing.T) {
+	id, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("expected a version 4 UUID, got %v", id)
+	}
+	if other, _ := newRunID(); other == id {
+		t.Errorf("expected run ids to differ")
+	}
+}
+
+func TestTagRunID(t *testing.T) {
+	query := func(collection string, doc bson.D) *QueryOp {
+		return &QueryOp{QueryOp: mgo.QueryOp{Collection: collection, Query: doc}}
+	}
+	context := NewExecutionContext(&StatCollector{})
+	context.RunID = "r1"
+	tag := "mongoreplay run r1"
+
+	cases := []struct {
+		op       Op
+		expected interface{}
+	}{
+		// a bare filter is wrapped to carry the comment
+		{query("test.c", bson.D{{Name: "a", Value: 1}}), bson.D{
+			{Name: "$query", Value: bson.D{{Name: "a", Value: 1}}},
+			{Name: "$comment", Value: tag},
+		}},
+		// a recorded comment is kept
+		{query("test.c", bson.D{
+			{Name: "$query", Value: bson.D{}},
+			{Name: "$comment", Value: "report"},
+		}), bson.D{
+			{Name: "$query", Value: bson.D{}},
+			{Name: "$comment", Value: "report (" + tag + ")"},
+		}},
+		// find takes a comment on every target
+		{query("test.$cmd", bson.D{{Name: "find", Value: "c"}}), bson.D{
+			{Name: "find", Value: "c"},
+			{Name: "comment", Value: tag},
+		}},
+		// other commands only do on 4.4 and later
+		{query("test.$cmd", bson.D{{Name: "count", Value: "c"}}), bson.D{
+			{Name: "count", Value: "c"},
+		}},
+	}
+	for _, c := range cases {
+		if err := context.tagRunID(c.op); err != nil {
+			t.Fatal(err)
+		}
+		if actual := c.op.(*QueryOp).Query; !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("expected %#v, got %#v", c.expected, actual)
+		}
+	}
+
+	context.TargetWireVersion = commentAllCommandsWireVersion
+	count := query("test.$cmd", bson.D{{Name: "count", Value: "c"}})
+	if err := context.tagRunID(count); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{Name: "count", Value: "c"}, {Name: "comment", Value: tag}}
+	if !reflect.DeepEqual(count.Query, expected) {
+		t.Errorf("expected %#v, got %#v", expected, count.Query)
+	}
+}
@@ -0,0 +1,164 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// wireChanges describes the changes in wire semantics made by the server
+// releases that introduced each wire version, which can make the results of
+// playing a tape against a server on the other side of them differ for
+// reasons other than performance.
+var wireChanges = map[int]string{
+	4:  "find and getMore commands replace legacy queries",
+	6:  "OP_MSG and sessions are introduced",
+	8:  "OP_COMMAND is removed",
+	14: "legacy op codes are removed",
+}
+
+// ServerVersions holds the versions of the server a tape was recorded against,
+// as found in the handshake replies it captured, and of the target it is
+// played against. A zero wire version is unknown.
+type ServerVersions struct {
+	Recorded            string `json:"recorded,omitempty"`
+	RecordedWireVersion int    `json:"recorded_wire_version,omitempty"`
+	Target              string `json:"target,omitempty"`
+	TargetWireVersion   int    `json:"target_wire_version,omitempty"`
+}
+
+// observe records the server version given by a buildInfo reply, or the wire
+// version given by an isMaster reply, in the tape. Once both are known, the
+// rest of the tape isn't parsed.
+func (versions *ServerVersions) observe(op *RecordedOp) {
+	if versions.Recorded != "" && versions.RecordedWireVersion != 0 {
+		return
+	}
+	if op.Header.OpCode != OpCodeReply && op.Header.OpCode != OpCodeCommandReply {
+		return
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		return
+	}
+	var reply *bson.Raw
+	switch castOp := parsedOp.(type) {
+	case *ReplyOp:
+		if len(castOp.Docs) > 0 {
+			reply = &castOp.Docs[0]
+		}
+	case *CommandReplyOp:
+		reply, _ = castOp.CommandReply.(*bson.Raw)
+	}
+	if reply == nil {
+		return
+	}
+	doc := struct {
+		Version        string `bson:"version"`
+		GitVersion     string `bson:"gitVersion"`
+		MaxWireVersion int    `bson:"maxWireVersion"`
+	}{}
+	if err := reply.Unmarshal(&doc); err != nil {
+		return
+	}
+	if doc.GitVersion != "" && versions.Recorded == "" {
+		versions.Recorded = doc.Version
+	}
+	if doc.MaxWireVersion > versions.RecordedWireVersion {
+		versions.RecordedWireVersion = doc.MaxWireVersion
+	}
+}
+
+// crossedChanges returns the changes in wire semantics between the recorded
+// and target servers, or none if either wire version is unknown.
+func (versions *ServerVersions) crossedChanges() []string {
+	from, to := versions.RecordedWireVersion, versions.TargetWireVersion
+	if from == 0 || to == 0 {
+		return nil
+	}
+	if from > to {
+		from, to = to, from
+	}
+	wireVersions := []int{}
+	for wireVersion := range wireChanges {
+		if wireVersion > from && wireVersion <= to {
+			wireVersions = append(wireVersions, wireVersion)
+		}
+	}
+	sort.Ints(wireVersions)
+	changes := []string{}
+	for _, wireVersion := range wireVersions {
+		changes = append(changes, fmt.Sprintf("in %v, %v", serverVersion(wireVersion), wireChanges[wireVersion]))
+	}
+	return changes
+}
+
+// describeVersion names a server by its version if known, or else by the
+// release its wire version was introduced in.
+func describeVersion(version string, wireVersion int) string {
+	switch {
+	case version != "":
+		return fmt.Sprintf("%v (wire version %v)", version, wireVersion)
+	case wireVersion != 0:
+		return fmt.Sprintf("%v or later (wire version %v)", serverVersion(wireVersion), wireVersion)
+	}
+	return "unknown"
+}
+
+// String summarizes the versions on a single line.
+func (versions *ServerVersions) String() string {
+	return fmt.Sprintf("server versions: recorded %v, target %v",
+		describeVersion(versions.Recorded, versions.RecordedWireVersion),
+		describeVersion(versions.Target, versions.TargetWireVersion))
+}
+
+// warn logs the versions, with a warning if playing the tape crosses changes
+// in wire semantics.
+func (versions *ServerVersions) warn() {
+	userInfoLogger.Logvf(Always, "Playing a tape recorded against server %v on server %v",
+		describeVersion(versions.Recorded, versions.RecordedWireVersion),
+		describeVersion(versions.Target, versions.TargetWireVersion))
+	if changes := versions.crossedChanges(); len(changes) > 0 {
+		userInfoLogger.Logvf(Always, "Warning: the recorded and target servers differ in wire semantics, "+
+			"which can affect the comparison of results: %v", strings.Join(changes, "; "))
+	}
+}
+
+// serverVersionsRecorder is implemented by the StatRecorders that report the
+// ServerVersions of a playback.
+type serverVersionsRecorder interface {
+	RecordServerVersions(versions *ServerVersions)
+}
+
+// RecordServerVersions writes the server versions as a JSON line after the op
+// stats.
+func (jsr *JSONStatRecorder) RecordServerVersions(versions *ServerVersions) {
+	jsonBytes, err := json.Marshal(struct {
+		Versions *ServerVersions `json:"server_versions"`
+	}{versions})
+	if err == nil {
+		_, err = jsr.out.Write(append(jsonBytes, '\n'))
+	}
+	if err != nil {
+		toolDebugLogger.Logvf(Always, "error recording server versions: %v", err)
+	}
+}
+
+// RecordServerVersions adds the server versions to the aggregate.
+func (bsr *BufferedStatRecorder) RecordServerVersions(versions *ServerVersions) {
+	bsr.mu.Lock()
+	defer bsr.mu.Unlock()
+	if bsr.Aggregate != nil {
+		bsr.Aggregate.Versions = versions
+	}
+}
+
+// RecordServerVersions writes the server versions summary to the terminal.
+func (dsr *TerminalStatRecorder) RecordServerVersions(versions *ServerVersions) {
+	if _, err := fmt.Fprintln(dsr.out, versions); err != nil {
+		toolDebugLogger.Logvf(Always, "error recording server versions: %v", err)
+	}
+}
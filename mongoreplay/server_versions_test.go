@@ -0,0 +1,77 @@
+package mongoreplay
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestServerVersionsObserve(t *testing.T) {
+	reply := func(doc bson.D) *RecordedOp {
+		docBytes, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := append(make([]byte, MsgHeaderLen+20), docBytes...)
+		header := MsgHeader{MessageLength: int32(len(body)), OpCode: OpCodeReply}
+		return &RecordedOp{RawOp: RawOp{Header: header, Body: body}}
+	}
+
+	versions := &ServerVersions{}
+	versions.observe(reply(bson.D{{"ok", 1}, {"n", 5}}))
+	versions.observe(reply(bson.D{{"ismaster", true}, {"maxWireVersion", 6}}))
+	versions.observe(reply(bson.D{{"version", "3.6.8"}, {"gitVersion", "abc"}}))
+	// a document that only happens to have a version field isn't buildInfo
+	versions.observe(reply(bson.D{{"version", "1.0"}}))
+	if versions.Recorded != "3.6.8" || versions.RecordedWireVersion != 6 {
+		t.Errorf("unexpected recorded versions: %#v", versions)
+	}
+}
+
+func TestServerVersionsCrossedChanges(t *testing.T) {
+	versions := &ServerVersions{RecordedWireVersion: 5, TargetWireVersion: 8}
+	changes := versions.crossedChanges()
+	if len(changes) != 2 || !strings.Contains(changes[0], "3.6") || !strings.Contains(changes[1], "OP_COMMAND") {
+		t.Errorf("expected the 3.6 and 4.2 changes, got %v", changes)
+	}
+
+	// downgrading crosses the same changes
+	versions = &ServerVersions{RecordedWireVersion: 8, TargetWireVersion: 5}
+	if len(versions.crossedChanges()) != 2 {
+		t.Errorf("expected the 3.6 and 4.2 changes, got %v", versions.crossedChanges())
+	}
+
+	for _, versions := range []*ServerVersions{
+		{RecordedWireVersion: 6, TargetWireVersion: 7},
+		{TargetWireVersion: 13},
+	} {
+		if changes := versions.crossedChanges(); len(changes) != 0 {
+			t.Errorf("expected no changes for %#v, got %v", versions, changes)
+		}
+	}
+}
+
+func TestServerVersionsReported(t *testing.T) {
+	versions := &ServerVersions{RecordedWireVersion: 6, Target: "4.0.3", TargetWireVersion: 7}
+	expected := "server versions: recorded 3.6 or later (wire version 6), target 4.0.3 (wire version 7)"
+	if versions.String() != expected {
+		t.Errorf("expected %q, got %q", expected, versions.String())
+	}
+
+	recorder := &BufferedStatRecorder{Aggregate: NewStatAggregate()}
+	statColl := &StatCollector{
+		statStream:    make(chan *OpStat),
+		done:          make(chan struct{}),
+		StatGenerator: &ComparativeStatGenerator{},
+		StatRecorder:  recorder,
+		Versions:      versions,
+	}
+	close(statColl.done)
+	if err := statColl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Aggregate.Versions != versions {
+		t.Errorf("expected the versions in the aggregate, got %v", recorder.Aggregate.Versions)
+	}
+}
@@ -0,0 +1,359 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// ShardKeyDefaults holds the fields added to the documents inserted into some
+// namespaces that lack them, so that they carry the shard key of a sharded
+// collection on the target that the recorded environment didn't have. A
+// string value starting with $ names a field of the document to copy the
+// value of instead.
+type ShardKeyDefaults map[string]bson.D
+
+// ParseShardKeyDefaults parses fields given as <db>.<collection>=<json>, such
+// as 'app.users={"tenant": "replay"}', where the JSON document holds the
+// fields to add.
+func ParseShardKeyDefaults(values []string) (ShardKeyDefaults, error) {
+	result := ShardKeyDefaults{}
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid shard key fields '%v', expected <db>.<collection>=<json document>", value)
+		}
+		ns := strings.TrimSpace(value[:i])
+		db, collection, err := util.SplitAndValidateNamespace(ns)
+		if err != nil {
+			return nil, err
+		}
+		if db == "" || collection == "" {
+			return nil, fmt.Errorf("namespace '%v' must name a database and a collection", ns)
+		}
+		fields, err := parseShardKeyFields(value[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard key fields for '%v': %v", ns, err)
+		}
+		if _, ok := result[ns]; ok {
+			return nil, fmt.Errorf("shard key fields of namespace '%v' given more than once", ns)
+		}
+		result[ns] = fields
+	}
+	return result, nil
+}
+
+// parseShardKeyFields parses a JSON document of top-level fields with string,
+// number or boolean values, keeping their order. Integers are kept as 32-bit
+// integers where they fit, as the shell would insert them.
+func parseShardKeyFields(s string) (bson.D, error) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("must be a JSON document")
+	}
+	fields := bson.D{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := token.(string)
+		if name == "" || strings.ContainsAny(name, ".") || strings.HasPrefix(name, "$") {
+			return nil, fmt.Errorf("'%v' isn't a top-level field name", name)
+		}
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				if n == int64(int32(n)) {
+					value = int32(n)
+				} else {
+					value = n
+				}
+			} else if value, err = v.Float64(); err != nil {
+				return nil, err
+			}
+		case string, bool:
+		default:
+			return nil, fmt.Errorf("field '%v' must be a string, number or boolean", name)
+		}
+		fields = append(fields, bson.DocElem{Name: name, Value: value})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("must be a single JSON document")
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("must hold at least one field")
+	}
+	return fields, nil
+}
+
+// apply adds the fields of the namespace of an insert to its documents that
+// lack them. The namespace is that the op is played on.
+func (defaults ShardKeyDefaults) apply(op Op) error {
+	if len(defaults) == 0 {
+		return nil
+	}
+	return eachInsertedDoc(op, func(ns string, doc bson.D) bson.D {
+		return withShardKeyFields(doc, defaults[ns])
+	})
+}
+
+// withShardKeyFields returns the document with the fields it lacks added to
+// it. A field copying another the document lacks too is left out.
+func withShardKeyFields(doc bson.D, fields bson.D) bson.D {
+	for _, field := range fields {
+		if _, ok := FindValueByKey(field.Name, &doc); ok {
+			continue
+		}
+		value := field.Value
+		if from, ok := value.(string); ok && strings.HasPrefix(from, "$") {
+			if value, ok = FindValueByKey(from[1:], &doc); !ok {
+				continue
+			}
+		}
+		doc = append(doc, bson.DocElem{Name: field.Name, Value: value})
+	}
+	return doc
+}
+
+// eachInsertedDoc calls fn with the namespace and each document inserted by
+// an insert op or command, replacing the document with the one fn returns.
+// Other ops are left as they are.
+func eachInsertedDoc(op Op, fn func(ns string, doc bson.D) bson.D) error {
+	each := func(ns string, docs []interface{}) error {
+		for i, value := range docs {
+			doc, err := toBSOND(value)
+			if err != nil {
+				return err
+			}
+			docs[i] = fn(ns, doc)
+		}
+		return nil
+	}
+	switch castOp := op.(type) {
+	case *InsertOp:
+		return each(castOp.Collection, castOp.Documents)
+	case *QueryOp:
+		if !strings.Contains(castOp.Collection, ".$cmd") {
+			return nil
+		}
+		command, err := toBSOND(castOp.Query)
+		if err != nil || len(command) == 0 || command[0].Name != "insert" {
+			return err
+		}
+		db := strings.SplitN(castOp.Collection, ".", 2)[0]
+		if err := eachCommandDoc(db, command, each); err != nil {
+			return err
+		}
+		castOp.Query = command
+	case *CommandOp:
+		if castOp.CommandName != "insert" {
+			return nil
+		}
+		command, err := toBSOND(castOp.CommandArgs)
+		if err != nil || len(command) == 0 {
+			return err
+		}
+		if err := eachCommandDoc(castOp.Database, command, each); err != nil {
+			return err
+		}
+		castOp.CommandArgs = command
+		if collection, ok := command[0].Value.(string); ok {
+			// OP_COMMAND may carry the documents after the command
+			return each(castOp.Database+"."+collection, castOp.InputDocs)
+		}
+	case *MsgOp:
+		if castOp.commandName() != "insert" {
+			return nil
+		}
+		// the documents may be sent in a document sequence section
+		if err := castOp.foldSequences(); err != nil {
+			return err
+		}
+		db := castOp.database()
+		return castOp.editBody(func(command bson.D) (bson.D, error) {
+			return command, eachCommandDoc(db, command, each)
+		})
+	}
+	return nil
+}
+
+// eachCommandDoc calls each with the namespace and the documents of an insert
+// command run on the database.
+func eachCommandDoc(db string, command bson.D, each func(string, []interface{}) error) error {
+	collection, ok := command[0].Value.(string)
+	if !ok {
+		return nil
+	}
+	for _, elem := range command {
+		if elem.Name != "documents" {
+			continue
+		}
+		if docs, ok := elem.Value.([]interface{}); ok {
+			return each(db+"."+collection, docs)
+		}
+	}
+	return nil
+}
+
+// shardKeyCheck checks, while a tape is preprocessed, that the documents it
+// inserts into the sharded collections of the target carry every field of
+// their shard key, which a sharded cluster rejects an insert without.
+// Documents are checked as they are played: on the renamed namespace, with
+// the fields of any ShardKeyDefaults added.
+type shardKeyCheck struct {
+	keys     map[string]bson.D
+	defaults ShardKeyDefaults
+	renamer  *nsRenamer
+
+	// inserted counts the documents inserted into each sharded namespace,
+	// and missing those of them without every field of its shard key
+	inserted map[string]int
+	missing  map[string]*missingShardKey
+}
+
+// missingShardKey counts the documents inserted into a namespace without
+// some of the fields of its shard key.
+type missingShardKey struct {
+	docs   int
+	fields map[string]bool
+}
+
+func newShardKeyCheck(keys map[string]bson.D, defaults ShardKeyDefaults, renamer *nsRenamer) *shardKeyCheck {
+	return &shardKeyCheck{
+		keys:     keys,
+		defaults: defaults,
+		renamer:  renamer,
+		inserted: map[string]int{},
+		missing:  map[string]*missingShardKey{},
+	}
+}
+
+// observe checks the documents of the op if it is an insert.
+func (c *shardKeyCheck) observe(op *RecordedOp) {
+	switch op.Header.OpCode {
+	case OpCodeInsert, OpCodeQuery, OpCodeCommand, OpCodeMsg, OpCodeCompressed:
+	default:
+		return
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil {
+		return
+	}
+	eachInsertedDoc(parsedOp, func(ns string, doc bson.D) bson.D {
+		if c.renamer != nil {
+			ns = c.renamer.renamer.Get(ns)
+		}
+		key, ok := c.keys[ns]
+		if !ok {
+			return doc
+		}
+		c.inserted[ns]++
+		withDefaults := withShardKeyFields(doc, c.defaults[ns])
+		var lacking []string
+		for _, field := range key {
+			if !hasField(withDefaults, field.Name) {
+				lacking = append(lacking, field.Name)
+			}
+		}
+		if len(lacking) == 0 {
+			return doc
+		}
+		missing, ok := c.missing[ns]
+		if !ok {
+			missing = &missingShardKey{fields: map[string]bool{}}
+			c.missing[ns] = missing
+		}
+		missing.docs++
+		for _, name := range lacking {
+			missing.fields[name] = true
+		}
+		return doc
+	})
+}
+
+// hasField returns whether the document has the field, given as a
+// dot-delimited path into its subdocuments.
+func hasField(doc bson.D, path string) bool {
+	parts := strings.SplitN(path, ".", 2)
+	value, ok := FindValueByKey(parts[0], &doc)
+	if !ok || len(parts) == 1 {
+		return ok
+	}
+	subdoc, err := toBSOND(value)
+	return err == nil && hasField(subdoc, parts[1])
+}
+
+// report logs the namespaces whose inserts lack fields of their shard key,
+// and returns an error if there are any and abort is set.
+func (c *shardKeyCheck) report(abort bool) error {
+	namespaces := make([]string, 0, len(c.missing))
+	for ns := range c.missing {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		missing := c.missing[ns]
+		fields := make([]string, 0, len(missing.fields))
+		for field := range missing.fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		userInfoLogger.Logvf(Always, "Warning: %v of the %v documents inserted into %v lack %v of its shard key %v, "+
+			"and will be rejected by the target", missing.docs, c.inserted[ns], ns, strings.Join(fields, ", "), c.keys[ns])
+	}
+	if len(namespaces) > 0 && abort {
+		return fmt.Errorf("documents inserted into %v sharded collections lack fields of their shard key; add the "+
+			"fields with --addShardKey, or play with --checkShardKeys=warn", len(namespaces))
+	}
+	if len(namespaces) == 0 {
+		userInfoLogger.Logvf(Always, "The documents inserted into %v sharded collections carry their shard keys",
+			len(c.inserted))
+	}
+	return nil
+}
+
+// targetShardKeys returns the shard keys of the sharded collections of the
+// target, and whether it is a mongos, without which it has none.
+func (context *ExecutionContext) targetShardKeys(url string) (map[string]bson.D, bool, error) {
+	session, err := context.dial(url)
+	if err != nil {
+		return nil, false, fmt.Errorf("error connecting to target: %v", err)
+	}
+	defer session.Close()
+	isMaster := struct {
+		Msg string `bson:"msg"`
+	}{}
+	if err := session.Run("isMaster", &isMaster); err != nil {
+		return nil, false, fmt.Errorf("error checking whether the target is a mongos: %v", err)
+	}
+	if isMaster.Msg != "isdbgrid" {
+		return nil, false, nil
+	}
+	keys := map[string]bson.D{}
+	collection := struct {
+		ID  string `bson:"_id"`
+		Key bson.D `bson:"key"`
+	}{}
+	iter := session.DB("config").C("collections").Find(bson.M{"dropped": bson.M{"$ne": true}}).Iter()
+	for iter.Next(&collection) {
+		keys[collection.ID] = collection.Key
+	}
+	if err := iter.Close(); err != nil {
+		return nil, true, fmt.Errorf("error reading the shard keys of the target: %v", err)
+	}
+	return keys, true, nil
+}
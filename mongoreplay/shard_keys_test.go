@@ -0,0 +1,204 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseShardKeyDefaults(t *testing.T) {
+	defaults, err := ParseShardKeyDefaults([]string{
+		`app.users={"tenant": "replay", "region": 3, "big": 5000000000, "ratio": 0.5, "userId": "$_id"}`,
+		`app.events = {"active": true}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ShardKeyDefaults{
+		"app.users": bson.D{
+			{Name: "tenant", Value: "replay"},
+			{Name: "region", Value: int32(3)},
+			{Name: "big", Value: int64(5000000000)},
+			{Name: "ratio", Value: 0.5},
+			{Name: "userId", Value: "$_id"},
+		},
+		"app.events": bson.D{{Name: "active", Value: true}},
+	}
+	if !reflect.DeepEqual(defaults, expected) {
+		t.Errorf("expected %#v, got %#v", expected, defaults)
+	}
+
+	for _, invalid := range [][]string{
+		{`app.users`},
+		{`={"tenant": 1}`},
+		{`app={"tenant": 1}`},
+		{`app.users=tenant`},
+		{`app.users={}`},
+		{`app.users={"a.b": 1}`},
+		{`app.users={"$a": 1}`},
+		{`app.users={"a": {"b": 1}}`},
+		{`app.users={"a": [1]}`},
+		{`app.users={"a": null}`},
+		{`app.users={"a": 1} {"b": 2}`},
+		{`app.users={"a": 1}`, `app.users={"b": 2}`},
+	} {
+		if _, err := ParseShardKeyDefaults(invalid); err == nil {
+			t.Errorf("expected an error parsing %v", invalid)
+		}
+	}
+}
+
+func TestWithShardKeyFields(t *testing.T) {
+	fields := bson.D{
+		{Name: "tenant", Value: "replay"},
+		{Name: "userId", Value: "$_id"},
+		{Name: "owner", Value: "$missing"},
+	}
+	cases := []struct {
+		doc      bson.D
+		expected bson.D
+	}{
+		// the fields a document lacks are added, copying those named by $
+		{bson.D{{Name: "_id", Value: 1}}, bson.D{
+			{Name: "_id", Value: 1},
+			{Name: "tenant", Value: "replay"},
+			{Name: "userId", Value: 1},
+		}},
+		// those it has are kept
+		{bson.D{{Name: "_id", Value: 1}, {Name: "tenant", Value: "prod"}, {Name: "owner", Value: "a"}}, bson.D{
+			{Name: "_id", Value: 1},
+			{Name: "tenant", Value: "prod"},
+			{Name: "owner", Value: "a"},
+			{Name: "userId", Value: 1},
+		}},
+	}
+	for _, c := range cases {
+		if actual := withShardKeyFields(c.doc, fields); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("expected %#v, got %#v", c.expected, actual)
+		}
+	}
+}
+
+func TestShardKeyDefaultsApply(t *testing.T) {
+	defaults := ShardKeyDefaults{"app.users": bson.D{{Name: "tenant", Value: "replay"}}}
+	withTenant := bson.D{{Name: "_id", Value: 1}, {Name: "tenant", Value: "replay"}}
+
+	insert := &InsertOp{InsertOp: mgo.InsertOp{
+		Collection: "app.users",
+		Documents:  []interface{}{&bson.D{{Name: "_id", Value: 1}}},
+	}}
+	if err := defaults.apply(insert); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(insert.Documents, []interface{}{withTenant}) {
+		t.Errorf("expected the inserted document to get the field, got %#v", insert.Documents)
+	}
+
+	query := &QueryOp{QueryOp: mgo.QueryOp{Collection: "app.$cmd", Query: bson.D{
+		{Name: "insert", Value: "users"},
+		{Name: "documents", Value: []interface{}{bson.D{{Name: "_id", Value: 1}}}},
+	}}}
+	if err := defaults.apply(query); err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{Name: "insert", Value: "users"},
+		{Name: "documents", Value: []interface{}{withTenant}},
+	}
+	if !reflect.DeepEqual(query.Query, expected) {
+		t.Errorf("expected %#v, got %#v", expected, query.Query)
+	}
+
+	command := &CommandOp{CommandOp: mgo.CommandOp{
+		Database:    "app",
+		CommandName: "insert",
+		CommandArgs: bson.D{{Name: "insert", Value: "users"}},
+		InputDocs:   []interface{}{bson.D{{Name: "_id", Value: 1}}},
+	}}
+	if err := defaults.apply(command); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(command.InputDocs, []interface{}{withTenant}) {
+		t.Errorf("expected the input document to get the field, got %#v", command.InputDocs)
+	}
+
+	// inserts into other namespaces and other ops are left as they are
+	other := &InsertOp{InsertOp: mgo.InsertOp{
+		Collection: "app.events",
+		Documents:  []interface{}{bson.D{{Name: "_id", Value: 1}}},
+	}}
+	if err := defaults.apply(other); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(other.Documents, []interface{}{bson.D{{Name: "_id", Value: 1}}}) {
+		t.Errorf("expected the document to be left as it was, got %#v", other.Documents)
+	}
+	find := bson.D{{Name: "find", Value: "users"}}
+	query = &QueryOp{QueryOp: mgo.QueryOp{Collection: "app.$cmd", Query: find}}
+	if err := defaults.apply(query); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(query.Query, find) {
+		t.Errorf("expected the find to be left as it was, got %#v", query.Query)
+	}
+}
+
+func TestShardKeyCheck(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	insert := func(collection string, docs ...bson.D) *RecordedOp {
+		documents := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			documents[i] = doc
+		}
+		op, err := generator.fetchRecordedOpsFromConn(&mgo.QueryOp{
+			Collection: "app.$cmd",
+			Query: bson.D{
+				{Name: "insert", Value: collection},
+				{Name: "documents", Value: documents},
+			},
+			Limit: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+	renamer, err := newNsRenamer([]string{"app.users_old"}, []string{"app.users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bson.D{
+		"app.users":  {{Name: "tenant", Value: 1}, {Name: "address.zip", Value: 1}},
+		"app.events": {{Name: "userId", Value: "hashed"}},
+	}
+	check := newShardKeyCheck(keys, ShardKeyDefaults{"app.events": {{Name: "userId", Value: "$_id"}}}, renamer)
+
+	check.observe(insert("users",
+		bson.D{{Name: "tenant", Value: "a"}, {Name: "address", Value: bson.D{{Name: "zip", Value: "1"}}}},
+		bson.D{{Name: "tenant", Value: "a"}},
+		bson.D{{Name: "name", Value: "b"}},
+	))
+	check.observe(insert("users_old", bson.D{{Name: "address", Value: bson.D{{Name: "city", Value: "c"}}}}))
+	check.observe(insert("events", bson.D{{Name: "_id", Value: 1}}))
+	check.observe(insert("logs", bson.D{{Name: "_id", Value: 1}}))
+
+	if !reflect.DeepEqual(check.inserted, map[string]int{"app.users": 4, "app.events": 1}) {
+		t.Errorf("expected the inserts into the sharded namespaces to be counted, got %v", check.inserted)
+	}
+	if len(check.missing) != 1 {
+		t.Fatalf("expected only app.users to lack its shard key, got %v", check.missing)
+	}
+	missing := check.missing["app.users"]
+	expected := map[string]bool{"tenant": true, "address.zip": true}
+	if missing.docs != 3 || !reflect.DeepEqual(missing.fields, expected) {
+		t.Errorf("expected 3 documents lacking %v, got %v lacking %v", expected, missing.docs, missing.fields)
+	}
+	if err := check.report(false); err != nil {
+		t.Errorf("expected no error without abort, got %v", err)
+	}
+	if err := check.report(true); err == nil {
+		t.Errorf("expected an error with abort")
+	}
+}
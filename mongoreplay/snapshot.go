@@ -0,0 +1,70 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+)
+
+// snapshotWriter writes a summary of the playback so far to a file each time
+// the process gets one of snapshotSignals, without stopping the playback.
+type snapshotWriter struct {
+	filename string
+	summary  func() *playbackSummary
+	signals  chan os.Signal
+	done     chan struct{}
+}
+
+// watchSnapshots starts writing the summaries returned by summary to the file
+// on each snapshot signal, until stop is called.
+func watchSnapshots(filename string, summary func() *playbackSummary) *snapshotWriter {
+	snapshots := &snapshotWriter{
+		filename: filename,
+		summary:  summary,
+		signals:  make(chan os.Signal, 1),
+		done:     make(chan struct{}),
+	}
+	signal.Notify(snapshots.signals, snapshotSignals...)
+	go func() {
+		for {
+			select {
+			case s := <-snapshots.signals:
+				if err := snapshots.write(); err != nil {
+					userInfoLogger.Logvf(Always, "Got signal %v, but %v", s, err)
+					continue
+				}
+				userInfoLogger.Logvf(Always, "Got signal %v, wrote a snapshot of the playback so far to %v",
+					s, snapshots.filename)
+			case <-snapshots.done:
+				return
+			}
+		}
+	}()
+	return snapshots
+}
+
+// write writes a snapshot to a temporary file next to the snapshot file and
+// renames it over it, so that the file never holds half a snapshot.
+func (snapshots *snapshotWriter) write() error {
+	summary := snapshots.summary()
+	summary.ExitReason = exitRunning
+	temp := filepath.Join(filepath.Dir(snapshots.filename), "."+filepath.Base(snapshots.filename)+".tmp")
+	if err := summary.write(temp); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, snapshots.filename); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("error writing snapshot: %v", err)
+	}
+	return nil
+}
+
+// stop stops writing snapshots.
+func (snapshots *snapshotWriter) stop() {
+	if snapshots == nil {
+		return
+	}
+	signal.Stop(snapshots.signals)
+	close(snapshots.done)
+}
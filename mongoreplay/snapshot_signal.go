@@ -0,0 +1,12 @@
+// +build !windows
+
+package mongoreplay
+
+import (
+	"os"
+	"syscall"
+)
+
+// snapshotSignals are the signals that have a playback write a snapshot of
+// its summary with --snapshotFile.
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
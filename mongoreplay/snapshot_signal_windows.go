@@ -0,0 +1,7 @@
+package mongoreplay
+
+import "os"
+
+// snapshotSignals is empty, as Windows has no SIGUSR1 to ask a playback for
+// a snapshot with.
+var snapshotSignals []os.Signal
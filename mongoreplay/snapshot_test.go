@@ -0,0 +1,54 @@
+// +build !windows
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshotOnSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "snapshot.json")
+
+	agg := NewStatAggregate()
+	agg.Add(&OpStat{OpType: "op_command", Command: "find", LatencyMicros: 100})
+	started := time.Now()
+	snapshots := watchSnapshots(filename, func() *playbackSummary {
+		return newPlaybackSummary("run", started, time.Now(), agg.snapshot())
+	})
+	defer snapshots.stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	var summary playbackSummary
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		data, err := ioutil.ReadFile(filename)
+		if err == nil {
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatalf("expected the snapshot to be whole JSON, got %v", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a snapshot to be written: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if summary.ExitReason != exitRunning || summary.Ops != 1 || summary.RunID != "run" {
+		t.Errorf("expected a running snapshot of one op, got %+v", summary)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the snapshot to be left, got %v files", len(files))
+	}
+}
@@ -0,0 +1,250 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// histogramBuckets is the number of buckets in a latency or size histogram.
+// Bucket i counts values below 2^i, and the last bucket counts the rest.
+const histogramBuckets = 32
+
+// reportedPercentiles are the percentiles of the payload sizes included in
+// the report.
+var reportedPercentiles = []int{50, 90, 99}
+
+// StatAggregate holds running totals over the OpStats recorded so far, using
+// the same amount of memory however many ops are recorded. It can be used in
+// place of a buffer of every OpStat for long runs.
+type StatAggregate struct {
+	// Total aggregates every op.
+	Total OpStatTotals `json:"total"`
+
+	// ByType aggregates the ops of each op type, keyed by the op type and,
+	// for commands, the command name.
+	ByType map[string]*OpStatTotals `json:"by_type"`
+
+	// ByGeneration, if not nil, aggregates the ops of each generation of a
+	// repeated playback, in order.
+	ByGeneration []*OpStatTotals `json:"by_generation,omitempty"`
+
+	// Cursors, if set, holds the cursor counts of a playback.
+	Cursors *CursorStats `json:"cursors,omitempty"`
+
+	// Versions, if set, holds the recorded and target server versions of a
+	// playback.
+	Versions *ServerVersions `json:"server_versions,omitempty"`
+}
+
+// OpStatTotals holds the running totals for a group of ops.
+type OpStatTotals struct {
+	Count       int64 `json:"count"`
+	Errors      int64 `json:"errors"`
+	NumReturned int64 `json:"nreturned"`
+
+	// WriteErrors counts the ops without errors of their own whose writes
+	// partially failed, or whose write concern wasn't satisfied.
+	WriteErrors int64 `json:"write_errors"`
+
+	// Timeouts counts the ops among the Errors that exceeded their time
+	// limit.
+	Timeouts int64 `json:"timeouts"`
+
+	TotalLatencyMicros int64 `json:"total_latency_us"`
+	MaxLatencyMicros   int64 `json:"max_latency_us"`
+
+	MaxPlaybackLagMicros int64 `json:"max_playbacklag_us"`
+
+	// LatencyHistogram counts the ops by latency, in power of two buckets of
+	// microseconds.
+	LatencyHistogram [histogramBuckets]int64 `json:"latency_histogram_us"`
+
+	TotalRequestBytes int64 `json:"total_request_bytes"`
+	MaxRequestBytes   int64 `json:"max_request_bytes"`
+	TotalReplyBytes   int64 `json:"total_reply_bytes"`
+	MaxReplyBytes     int64 `json:"max_reply_bytes"`
+
+	// RequestBytesHistogram and ReplyBytesHistogram count the ops by the
+	// size of their request and reply, in power of two buckets of bytes.
+	RequestBytesHistogram [histogramBuckets]int64 `json:"request_bytes_histogram"`
+	ReplyBytesHistogram   [histogramBuckets]int64 `json:"reply_bytes_histogram"`
+}
+
+// opStatTotalsReport is the JSON form of OpStatTotals, which also includes
+// the percentiles of the payload sizes.
+type opStatTotalsReport struct {
+	opStatTotals
+	RequestBytesPercentiles map[string]int64 `json:"request_bytes_percentiles"`
+	ReplyBytesPercentiles   map[string]int64 `json:"reply_bytes_percentiles"`
+}
+
+// opStatTotals has the fields of OpStatTotals without its MarshalJSON.
+type opStatTotals OpStatTotals
+
+// MarshalJSON adds the percentiles of the payload sizes, derived from their
+// histograms, to the totals.
+func (totals OpStatTotals) MarshalJSON() ([]byte, error) {
+	report := opStatTotalsReport{
+		opStatTotals:            opStatTotals(totals),
+		RequestBytesPercentiles: map[string]int64{},
+		ReplyBytesPercentiles:   map[string]int64{},
+	}
+	for _, p := range reportedPercentiles {
+		key := fmt.Sprintf("p%d", p)
+		report.RequestBytesPercentiles[key] = totals.RequestBytesPercentile(p)
+		report.ReplyBytesPercentiles[key] = totals.ReplyBytesPercentile(p)
+	}
+	return json.Marshal(report)
+}
+
+// NewStatAggregate initializes an empty StatAggregate.
+func NewStatAggregate() *StatAggregate {
+	return &StatAggregate{ByType: map[string]*OpStatTotals{}}
+}
+
+// Add includes the stat in the totals.
+func (agg *StatAggregate) Add(stat *OpStat) {
+	key := stat.OpType
+	if stat.Command != "" {
+		key += " " + stat.Command
+	}
+	totals, ok := agg.ByType[key]
+	if !ok {
+		totals = &OpStatTotals{}
+		agg.ByType[key] = totals
+	}
+	agg.Total.add(stat)
+	totals.add(stat)
+	if agg.ByGeneration != nil {
+		for len(agg.ByGeneration) <= stat.Generation {
+			agg.ByGeneration = append(agg.ByGeneration, &OpStatTotals{})
+		}
+		agg.ByGeneration[stat.Generation].add(stat)
+	}
+}
+
+func (totals *OpStatTotals) add(stat *OpStat) {
+	totals.Count++
+	if len(stat.Errors) > 0 {
+		totals.Errors++
+		for _, err := range stat.Errors {
+			if isOpTimeout(err) {
+				totals.Timeouts++
+				break
+			}
+		}
+	} else if len(stat.WriteErrors) > 0 {
+		totals.WriteErrors++
+	}
+	totals.NumReturned += int64(stat.NumReturned)
+	totals.TotalLatencyMicros += stat.LatencyMicros
+	if stat.LatencyMicros > totals.MaxLatencyMicros {
+		totals.MaxLatencyMicros = stat.LatencyMicros
+	}
+	if stat.PlaybackLagMicros > totals.MaxPlaybackLagMicros {
+		totals.MaxPlaybackLagMicros = stat.PlaybackLagMicros
+	}
+	totals.LatencyHistogram[histogramBucket(stat.LatencyMicros)]++
+
+	totals.TotalRequestBytes += stat.RequestBytes
+	if stat.RequestBytes > totals.MaxRequestBytes {
+		totals.MaxRequestBytes = stat.RequestBytes
+	}
+	totals.TotalReplyBytes += stat.ReplyBytes
+	if stat.ReplyBytes > totals.MaxReplyBytes {
+		totals.MaxReplyBytes = stat.ReplyBytes
+	}
+	totals.RequestBytesHistogram[histogramBucket(stat.RequestBytes)]++
+	totals.ReplyBytesHistogram[histogramBucket(stat.ReplyBytes)]++
+}
+
+// histogramBucket returns the histogram bucket for the value.
+func histogramBucket(value int64) int {
+	bucket := 0
+	for value > 0 && bucket < histogramBuckets-1 {
+		value >>= 1
+		bucket++
+	}
+	return bucket
+}
+
+// histogramPercentile returns an upper bound of the pth percentile of the
+// values counted in the histogram: the top of the bucket holding it, or max
+// if that is lower.
+func histogramPercentile(histogram *[histogramBuckets]int64, count, max int64, p int) int64 {
+	if count == 0 {
+		return 0
+	}
+	rank := (count*int64(p) + 99) / 100
+	var seen int64
+	for bucket, n := range histogram {
+		seen += n
+		if seen >= rank {
+			bound := int64(1)<<uint(bucket) - 1
+			if bucket == histogramBuckets-1 || bound > max {
+				return max
+			}
+			return bound
+		}
+	}
+	return max
+}
+
+// MeanLatencyMicros returns the average latency of the ops, or 0 if there are
+// none.
+func (totals *OpStatTotals) MeanLatencyMicros() int64 {
+	if totals.Count == 0 {
+		return 0
+	}
+	return totals.TotalLatencyMicros / totals.Count
+}
+
+// LatencyPercentile returns an upper bound of the pth percentile of the
+// latencies in microseconds, accurate to within a power of two.
+func (totals *OpStatTotals) LatencyPercentile(p int) int64 {
+	return histogramPercentile(&totals.LatencyHistogram, totals.Count, totals.MaxLatencyMicros, p)
+}
+
+// RequestBytesPercentile returns an upper bound of the pth percentile of the
+// request sizes, accurate to within a power of two.
+func (totals *OpStatTotals) RequestBytesPercentile(p int) int64 {
+	return histogramPercentile(&totals.RequestBytesHistogram, totals.Count, totals.MaxRequestBytes, p)
+}
+
+// ReplyBytesPercentile returns an upper bound of the pth percentile of the
+// reply sizes, accurate to within a power of two.
+func (totals *OpStatTotals) ReplyBytesPercentile(p int) int64 {
+	return histogramPercentile(&totals.ReplyBytesHistogram, totals.Count, totals.MaxReplyBytes, p)
+}
+
+// snapshot returns a copy of the totals of the aggregate and of each op type.
+func (agg *StatAggregate) snapshot() *StatAggregate {
+	copied := &StatAggregate{Total: agg.Total, ByType: make(map[string]*OpStatTotals, len(agg.ByType))}
+	for opType, totals := range agg.ByType {
+		byType := *totals
+		copied.ByType[opType] = &byType
+	}
+	return copied
+}
+
+// Types returns the keys of ByType in sorted order.
+func (agg *StatAggregate) Types() []string {
+	types := make([]string, 0, len(agg.ByType))
+	for opType := range agg.ByType {
+		types = append(types, opType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// WriteReport writes the aggregate to out as JSON.
+func (agg *StatAggregate) WriteReport(out io.Writer) error {
+	jsonBytes, err := json.Marshal(agg)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(jsonBytes, '\n'))
+	return err
+}
@@ -0,0 +1,141 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBufferedStatRecorderLimit(t *testing.T) {
+	stats := []OpStat{
+		{OpType: "query", Ns: "test.test", LatencyMicros: 0, NumReturned: 1},
+		{OpType: "query", Ns: "test.test", LatencyMicros: 3, NumReturned: 2},
+		{OpType: "command", Command: "count", LatencyMicros: 1000},
+		{OpType: "insert", LatencyMicros: 10, Errors: []error{fmt.Errorf("E11000")}},
+	}
+
+	bounded := &BufferedStatRecorder{MaxBuffered: 2, Aggregate: NewStatAggregate()}
+	disabled := &BufferedStatRecorder{MaxBuffered: -1, Aggregate: NewStatAggregate()}
+	for i := range stats {
+		bounded.RecordStat(&stats[i])
+		disabled.RecordStat(&stats[i])
+	}
+	if len(bounded.Buffer) != 2 {
+		t.Errorf("bounded buffer should hold 2 stats, got %v", len(bounded.Buffer))
+	}
+	if len(disabled.Buffer) != 0 {
+		t.Errorf("disabled buffer should hold no stats, got %v", len(disabled.Buffer))
+	}
+
+	agg := disabled.Aggregate
+	if agg.Total.Count != 4 || agg.Total.Errors != 1 || agg.Total.NumReturned != 3 {
+		t.Errorf("unexpected totals: %#v", agg.Total)
+	}
+	if agg.Total.MaxLatencyMicros != 1000 {
+		t.Errorf("max latency should be 1000, got %v", agg.Total.MaxLatencyMicros)
+	}
+	expectedTypes := []string{"command count", "insert", "query"}
+	if types := agg.Types(); fmt.Sprint(types) != fmt.Sprint(expectedTypes) {
+		t.Errorf("op types should be %v, got %v", expectedTypes, types)
+	}
+	query := agg.ByType["query"]
+	if query.Count != 2 || query.MeanLatencyMicros() != 1 {
+		t.Errorf("unexpected query totals: %#v", query)
+	}
+	// latencies of 0, 3, 10 and 1000 microseconds
+	for bucket, count := range map[int]int64{0: 1, 2: 1, 4: 1, 10: 1} {
+		if agg.Total.LatencyHistogram[bucket] != count {
+			t.Errorf("latency bucket %v should hold %v ops, got %v", bucket, count, agg.Total.LatencyHistogram[bucket])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := agg.WriteReport(&buf); err != nil {
+		t.Fatalf("couldn't write report: %v", err)
+	}
+	report := StatAggregate{}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("couldn't parse report: %v", err)
+	}
+	if report.Total.Count != 4 || report.ByType["insert"].Errors != 1 {
+		t.Errorf("report should match the aggregate, got %#v", report)
+	}
+}
+
+func TestStatAggregatePayloadSizes(t *testing.T) {
+	agg := NewStatAggregate()
+	for i := int64(1); i <= 100; i++ {
+		agg.Add(&OpStat{OpType: "query", RequestBytes: 100, ReplyBytes: i * 100})
+	}
+	agg.Add(&OpStat{OpType: "insert", RequestBytes: 5000})
+
+	total := agg.Total
+	if total.TotalRequestBytes != 15000 || total.MaxRequestBytes != 5000 {
+		t.Errorf("unexpected request byte totals: %v, %v", total.TotalRequestBytes, total.MaxRequestBytes)
+	}
+	if total.TotalReplyBytes != 505000 || total.MaxReplyBytes != 10000 {
+		t.Errorf("unexpected reply byte totals: %v, %v", total.TotalReplyBytes, total.MaxReplyBytes)
+	}
+	// requests of 100 bytes fall in the bucket of values below 128
+	if total.RequestBytesHistogram[7] != 100 || total.RequestBytesHistogram[13] != 1 {
+		t.Errorf("unexpected request size histogram: %v", total.RequestBytesHistogram)
+	}
+
+	query := agg.ByType["query"]
+	for p, expected := range map[int]int64{50: 8191, 90: 10000, 99: 10000} {
+		if size := query.ReplyBytesPercentile(p); size != expected {
+			t.Errorf("expected p%v reply size %v, got %v", p, expected, size)
+		}
+	}
+	if size := query.RequestBytesPercentile(99); size != 100 {
+		t.Errorf("expected p99 request size 100, got %v", size)
+	}
+	if size := NewStatAggregate().Total.ReplyBytesPercentile(50); size != 0 {
+		t.Errorf("expected p50 of no ops to be 0, got %v", size)
+	}
+
+	var buf bytes.Buffer
+	if err := agg.WriteReport(&buf); err != nil {
+		t.Fatalf("couldn't write report: %v", err)
+	}
+	report := struct {
+		Total struct {
+			TotalReplyBytes       int64            `json:"total_reply_bytes"`
+			ReplyBytesPercentiles map[string]int64 `json:"reply_bytes_percentiles"`
+		} `json:"total"`
+	}{}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("couldn't parse report: %v", err)
+	}
+	if report.Total.TotalReplyBytes != 505000 || report.Total.ReplyBytesPercentiles["p99"] != 10000 {
+		t.Errorf("report should include the reply sizes, got %#v", report.Total)
+	}
+}
+
+func TestBufferedStatRecorderConcurrent(t *testing.T) {
+	const workers, statsPerWorker = 16, 500
+	recorder := &BufferedStatRecorder{MaxBuffered: workers * statsPerWorker / 2, Aggregate: NewStatAggregate()}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < statsPerWorker; i++ {
+				recorder.RecordStat(&OpStat{OpType: "query", ConnectionNum: int64(w), LatencyMicros: int64(i)})
+				if i%100 == 0 {
+					recorder.Stats()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(recorder.Buffer) != workers*statsPerWorker/2 {
+		t.Errorf("expected the buffer to fill to %v stats, got %v", workers*statsPerWorker/2, len(recorder.Buffer))
+	}
+	if count := recorder.Aggregate.Total.Count; count != workers*statsPerWorker {
+		t.Errorf("expected the aggregate to count %v stats, got %v", workers*statsPerWorker, count)
+	}
+}
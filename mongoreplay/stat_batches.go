@@ -0,0 +1,183 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// batchCommands are the commands whose replies hold a batch of a cursor.
+var batchCommands = map[string]bool{
+	"find":      true,
+	"getMore":   true,
+	"aggregate": true,
+}
+
+// BatchStatRecorder implements the StatRecorder interface by counting the
+// documents returned by each find and getmore, and writing a histogram of
+// them by op type when closed, to show how large the batches fetched by the
+// workload are.
+type BatchStatRecorder struct {
+	out io.WriteCloser
+
+	// Total counts every batch, and ByType the batches of each op type,
+	// keyed as in StatAggregate.
+	Total  *BatchHistogram
+	ByType map[string]*BatchHistogram
+}
+
+// BatchHistogram counts batches by the number of documents in them, in power
+// of two buckets: bucket 0 counts empty batches, and bucket i those of 2^(i-1)
+// to 2^i-1 documents.
+type BatchHistogram struct {
+	Batches   int64
+	Documents int64
+	Max       int64
+	Buckets   [histogramBuckets]int64
+}
+
+func newBatchStatRecorder(out io.WriteCloser) *BatchStatRecorder {
+	return &BatchStatRecorder{
+		out:    out,
+		Total:  &BatchHistogram{},
+		ByType: map[string]*BatchHistogram{},
+	}
+}
+
+// RecordStat adds the batch returned by the op of the stat to the histograms,
+// if it is a find or getmore.
+func (bsr *BatchStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil || len(stat.Errors) > 0 {
+		return
+	}
+	n, ok := batchLen(stat)
+	if !ok {
+		return
+	}
+	key := stat.OpType
+	if stat.Command != "" {
+		key += " " + stat.Command
+	}
+	histogram, ok := bsr.ByType[key]
+	if !ok {
+		histogram = &BatchHistogram{}
+		bsr.ByType[key] = histogram
+	}
+	bsr.Total.add(n)
+	histogram.add(n)
+}
+
+// batchLen returns the number of documents returned by the op of the stat,
+// and false if it isn't a find or getmore. Legacy queries and getmores return
+// their documents in the reply, while the find, getMore and aggregate
+// commands return them in the cursor of their reply document, which is only
+// counted if the stat holds the reply.
+func batchLen(stat *OpStat) (int64, bool) {
+	switch stat.OpType {
+	case "query", "getmore":
+		return int64(stat.NumReturned), true
+	case "command", "op_command":
+		if !batchCommands[stat.Command] {
+			return 0, false
+		}
+		return cursorBatchLen(stat.ReplyData)
+	}
+	return 0, false
+}
+
+// cursorBatchLen returns the number of documents in the cursor batch of a
+// command reply.
+func cursorBatchLen(data interface{}) (int64, bool) {
+	switch reply := data.(type) {
+	case map[string]interface{}:
+		return cursorBatchLen(reply["command_reply"])
+	case *bson.Raw:
+		if reply == nil {
+			return 0, false
+		}
+		return cursorBatchLen(*reply)
+	case bson.Raw:
+		doc := struct {
+			Cursor *struct {
+				FirstBatch []bson.Raw `bson:"firstBatch"`
+				NextBatch  []bson.Raw `bson:"nextBatch"`
+			} `bson:"cursor"`
+		}{}
+		if err := reply.Unmarshal(&doc); err != nil || doc.Cursor == nil {
+			return 0, false
+		}
+		return int64(len(doc.Cursor.FirstBatch) + len(doc.Cursor.NextBatch)), true
+	}
+	return 0, false
+}
+
+func (histogram *BatchHistogram) add(n int64) {
+	histogram.Batches++
+	histogram.Documents += n
+	if n > histogram.Max {
+		histogram.Max = n
+	}
+	histogram.Buckets[histogramBucket(n)]++
+}
+
+// String returns the histogram as a table of the buckets from the smallest
+// to the largest batch, with the share of the batches in each.
+func (histogram *BatchHistogram) String() string {
+	var buf bytes.Buffer
+	mean := int64(0)
+	if histogram.Batches > 0 {
+		mean = histogram.Documents / histogram.Batches
+	}
+	fmt.Fprintf(&buf, "%v batches, %v documents, mean %v, max %v\n",
+		histogram.Batches, histogram.Documents, mean, histogram.Max)
+	first, last := -1, -1
+	for bucket, count := range histogram.Buckets {
+		if count > 0 {
+			if first < 0 {
+				first = bucket
+			}
+			last = bucket
+		}
+	}
+	for bucket := first; bucket >= 0 && bucket <= last; bucket++ {
+		count := histogram.Buckets[bucket]
+		fmt.Fprintf(&buf, "  %15v  %10v  %5.1f%%\n", bucketRange(bucket), count,
+			100*float64(count)/float64(histogram.Batches))
+	}
+	return buf.String()
+}
+
+// bucketRange describes the sizes counted by a histogram bucket.
+func bucketRange(bucket int) string {
+	switch {
+	case bucket == 0:
+		return "0"
+	case bucket == 1:
+		return "1"
+	case bucket == histogramBuckets-1:
+		return fmt.Sprintf("%v+", int64(1)<<uint(bucket-1))
+	}
+	return fmt.Sprintf("%v-%v", int64(1)<<uint(bucket-1), int64(1)<<uint(bucket)-1)
+}
+
+// Close writes the histograms and closes the output.
+func (bsr *BatchStatRecorder) Close() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Documents returned per find and getmore: %v", bsr.Total)
+	types := make([]string, 0, len(bsr.ByType))
+	for opType := range bsr.ByType {
+		types = append(types, opType)
+	}
+	sort.Strings(types)
+	for _, opType := range types {
+		fmt.Fprintf(&buf, "%v: %v", opType, bsr.ByType[opType])
+	}
+	_, err := buf.WriteTo(bsr.out)
+	if closeErr := bsr.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error {
+	return nil
+}
+
+func TestBatchStatRecorder(t *testing.T) {
+	reply := func(doc interface{}) *bson.Raw {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &bson.Raw{Kind: 3, Data: data}
+	}
+	firstBatch := bson.M{"cursor": bson.M{"id": int64(5), "firstBatch": []bson.M{{"a": 1}, {"a": 2}, {"a": 3}}}}
+	nextBatch := bson.M{"cursor": bson.M{"id": int64(0), "nextBatch": []bson.M{}}}
+
+	stats := []OpStat{
+		{OpType: "query", NumReturned: 1},
+		{OpType: "query", NumReturned: 101},
+		{OpType: "getmore", NumReturned: 0},
+		{OpType: "command", Command: "find", ReplyData: *reply(firstBatch)},
+		{OpType: "op_command", Command: "getMore", ReplyData: map[string]interface{}{"command_reply": reply(nextBatch)}},
+		// neither is a batch of a cursor
+		{OpType: "command", Command: "count", NumReturned: 1},
+		{OpType: "insert"},
+		// nor is the reply to a failed find
+		{OpType: "query", NumReturned: 1, Errors: []error{fmt.Errorf("failed")}},
+	}
+	out := &bufferCloser{}
+	recorder := newBatchStatRecorder(out)
+	for i := range stats {
+		recorder.RecordStat(&stats[i])
+	}
+
+	total := recorder.Total
+	if total.Batches != 5 || total.Documents != 105 || total.Max != 101 {
+		t.Errorf("expected 5 batches of 105 documents at most 101 in one, got %#v", total)
+	}
+	// batches of 0, 0, 1, 3 and 101 documents
+	for bucket, count := range map[int]int64{0: 2, 1: 1, 2: 1, 7: 1} {
+		if total.Buckets[bucket] != count {
+			t.Errorf("bucket %v should hold %v batches, got %v", bucket, count, total.Buckets[bucket])
+		}
+	}
+	for key, batches := range map[string]int64{"query": 2, "getmore": 1, "command find": 1, "op_command getMore": 1} {
+		if histogram := recorder.ByType[key]; histogram == nil || histogram.Batches != batches {
+			t.Errorf("expected %v batches of %v, got %#v", batches, key, histogram)
+		}
+	}
+	if len(recorder.ByType) != 4 {
+		t.Errorf("expected batches of 4 op types, got %v", len(recorder.ByType))
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	for _, line := range []string{
+		"Documents returned per find and getmore: 5 batches, 105 documents, mean 21, max 101",
+		"            2-3           1   20.0%",
+		"         64-127           1   20.0%",
+		"query: 2 batches",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("expected the report to contain %q, got:\n%v", line, report)
+		}
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	for bucket, expected := range map[int]string{
+		0:                    "0",
+		1:                    "1",
+		2:                    "2-3",
+		10:                   "512-1023",
+		histogramBuckets - 1: "1073741824+",
+	} {
+		if got := bucketRange(bucket); got != expected {
+			t.Errorf("expected bucket %v to be %v, got %v", bucket, expected, got)
+		}
+	}
+}
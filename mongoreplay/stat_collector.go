@@ -3,6 +3,7 @@ package mongoreplay
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"sync"
@@ -18,12 +19,15 @@ const TruncateLength = 350
 // StatOptions stores settings for the mongoreplay subcommands which have stat
 // output
 type StatOptions struct {
-	Collect    string `long:"collect" description:"Stat collection format; 'format' option uses the --format string" choice:"json" choice:"format" choice:"none" default:"format"`
+	Collect    string `long:"collect" description:"Stat collection format; 'format' option uses the --format string, 'aggregate' writes only summary statistics when done, for long runs, 'batches' writes only a histogram of the documents returned by each find and getmore when done, to show the batch sizes of the workload, and 'sqlite' writes each op to the SQLite database named by --report if built with the sqlite build tag" choice:"json" choice:"format" choice:"aggregate" choice:"batches" choice:"sqlite" choice:"none" default:"format"`
 	Buffered   bool   `hidden:"yes"`
 	Report     string `long:"report" description:"Write report on execution to given output path"`
 	NoTruncate bool   `long:"no-truncate" description:"Disable truncation of large payload data in log output"`
-	Format     string `long:"format" description:"Format for terminal output, %-escaped. Arguments are provided immediately after the escape, surrounded in curly braces. Supported escapes are:\n	%n namespace\n%l latency\n%t time (optional arg -- specify date layout, e.g. '%t{3:04PM}')\n%T op type\n%c command\n%o number of connections\n%i request ID\n%q request (optional arg -- dot-delimited field within the JSON structure, e.g. '%q{command_args.documents}')\n%r response (optional arg -- same as %q)\n%Q{<arg>} conditionally show <arg> on presence of request data\n%R{<arg>} conditionally show <arg> on presence of response data\nANSI escape sequences, start/end:\n%B/%b bold\n%U/%u underline\n%S/%s standout\n%F/%f text color (required arg -- word or number, 8-color)\n%K/%k background color (required arg -- same as %F/%f)\n" default:"%F{blue}%t%f %F{cyan}(Connection: %o:%i)%f %F{yellow}%l%f %F{red}%T %c%f %F{white}%n%f %F{green}%Q{Request:}%f%q %F{green}%R{Response:}%f%r"`
+	Format     string `long:"format" description:"Format for terminal output, %-escaped. Arguments are provided immediately after the escape, surrounded in curly braces. Supported escapes are:\n	%n namespace\n%l latency\n%t time (optional arg -- specify date layout, e.g. '%t{3:04PM}')\n%T op type\n%c command\n%o number of connections\n%i request ID\n%z request size in bytes\n%Z response size in bytes\n%q request (optional arg -- dot-delimited field within the JSON structure, e.g. '%q{command_args.documents}')\n%r response (optional arg -- same as %q)\n%Q{<arg>} conditionally show <arg> on presence of request data\n%R{<arg>} conditionally show <arg> on presence of response data\nANSI escape sequences, start/end:\n%B/%b bold\n%U/%u underline\n%S/%s standout\n%F/%f text color (required arg -- word or number, 8-color)\n%K/%k background color (required arg -- same as %F/%f)\n" default:"%F{blue}%t%f %F{cyan}(Connection: %o:%i)%f %F{yellow}%l%f %F{red}%T %c%f %F{white}%n%f %F{green}%Q{Request:}%f%q %F{green}%R{Response:}%f%r"`
 	NoColors   bool   `long:"no-colors" description:"Remove colors from the default format"`
+
+	AnonymizeNamespaces bool   `long:"anonymizeNamespaces" description:"replace the names of databases and collections in the stats with pseudonyms, the same for a name throughout the run, and leave out the request and response data, which hold them too"`
+	NsMap               string `long:"nsMap" description:"with --anonymizeNamespaces, write the names of the pseudonyms to this file as JSON, to de-anonymize the stats later"`
 }
 
 // StatCollector is a struct that handles generation and recording of statistics
@@ -37,6 +41,21 @@ type StatCollector struct {
 	StatGenerator
 	StatRecorder
 	noop bool
+
+	// Cursors, if set, counts the cursor events of a playback, which are
+	// reported after the op stats.
+	Cursors *CursorStats
+	// Versions, if set, holds the server versions of a playback, which are
+	// reported after the op stats.
+	Versions *ServerVersions
+	// Totals, if set, aggregates every collected stat, whatever the
+	// StatRecorder does with them. It must only be read through
+	// snapshotTotals until the collector is closed.
+	Totals   *StatAggregate
+	totalsMu sync.Mutex
+	// Namespaces, if set, replaces the namespaces of the stats with
+	// pseudonyms before they are recorded.
+	Namespaces *nsAnonymizer
 }
 
 // Close implements the basic close method, stopping stat collection.
@@ -47,16 +66,63 @@ func (statColl *StatCollector) Close() error {
 	statColl.StatGenerator.Finalize(statColl.statStream)
 	close(statColl.statStream)
 	<-statColl.done
+	if recorder, ok := statColl.StatRecorder.(cursorStatsRecorder); ok && statColl.Cursors != nil {
+		statColl.Cursors.finish()
+		recorder.RecordCursorStats(statColl.Cursors)
+	}
+	if recorder, ok := statColl.StatRecorder.(serverVersionsRecorder); ok && statColl.Versions != nil {
+		recorder.RecordServerVersions(statColl.Versions)
+	}
+	if statColl.Namespaces != nil {
+		if err := statColl.Namespaces.writeMap(); err != nil {
+			statColl.StatRecorder.Close()
+			return err
+		}
+	}
 	return statColl.StatRecorder.Close()
 }
 
+// snapshotTotals returns a copy of the totals of the ops collected so far, or
+// nil if the collector has no Totals. It is safe to call while stats are
+// being collected.
+func (statColl *StatCollector) snapshotTotals() *StatAggregate {
+	if statColl.Totals == nil {
+		return nil
+	}
+	statColl.totalsMu.Lock()
+	defer statColl.totalsMu.Unlock()
+	return statColl.Totals.snapshot()
+}
+
+// aggregateByGeneration makes the aggregates of the collector also total the
+// ops of each generation of a repeated playback. It must be called before
+// any stats are collected.
+func (statColl *StatCollector) aggregateByGeneration() {
+	if statColl.Totals != nil {
+		statColl.Totals.ByGeneration = []*OpStatTotals{}
+	}
+	if recorder, ok := statColl.StatRecorder.(*BufferedStatRecorder); ok && recorder.Aggregate != nil {
+		recorder.Aggregate.ByGeneration = []*OpStatTotals{}
+	}
+}
+
 func newStatCollector(opts StatOptions, isPairedMode bool, isComparative bool) (*StatCollector, error) {
 	if opts.Buffered {
 		opts.Collect = "buffered"
 	}
+	if opts.NsMap != "" && !opts.AnonymizeNamespaces {
+		return nil, fmt.Errorf("--nsMap can only be used with --anonymizeNamespaces")
+	}
 	if opts.Collect == "none" {
 		return &StatCollector{noop: true}, nil
 	}
+	var namespaces *nsAnonymizer
+	if opts.AnonymizeNamespaces {
+		var err error
+		if namespaces, err = newNsAnonymizer(opts.NsMap); err != nil {
+			return nil, err
+		}
+	}
 
 	var statGen StatGenerator
 	if isComparative {
@@ -72,6 +138,15 @@ func newStatCollector(opts StatOptions, isPairedMode bool, isComparative bool) (
 		opts.Format = "%t (Connection: %o:%i) %l %T %c %n %Q{Request:}%q %R{Response:}%r"
 	}
 
+	// the SQLite database is opened by its driver rather than as a file
+	if opts.Collect == "sqlite" {
+		statRec, err := newSQLiteStatRecorder(opts.Report)
+		if err != nil {
+			return nil, err
+		}
+		return &StatCollector{StatGenerator: statGen, StatRecorder: statRec, Namespaces: namespaces}, nil
+	}
+
 	var o io.WriteCloser
 	var err error
 	if opts.Report != "" {
@@ -91,8 +166,17 @@ func newStatCollector(opts StatOptions, isPairedMode bool, isComparative bool) (
 		}
 	case "buffered":
 		statRec = &BufferedStatRecorder{
-			Buffer: []OpStat{},
+			Buffer:    []OpStat{},
+			Aggregate: NewStatAggregate(),
+		}
+	case "aggregate":
+		statRec = &BufferedStatRecorder{
+			MaxBuffered: -1,
+			Aggregate:   NewStatAggregate(),
+			out:         o,
 		}
+	case "batches":
+		statRec = newBatchStatRecorder(o)
 	case "format":
 		statRec = &TerminalStatRecorder{
 			out:      o,
@@ -101,10 +185,15 @@ func newStatCollector(opts StatOptions, isPairedMode bool, isComparative bool) (
 		}
 	}
 
-	return &StatCollector{
+	statColl := &StatCollector{
 		StatGenerator: statGen,
 		StatRecorder:  statRec,
-	}, nil
+		Namespaces:    namespaces,
+	}
+	if isComparative {
+		statColl.Cursors = NewCursorStats()
+	}
+	return statColl, nil
 }
 
 // StatGenerator is an interface that specifies how to accept operation
@@ -149,6 +238,14 @@ func (statColl *StatCollector) Collect(op *RecordedOp, replayedOp Op, reply Repl
 		statColl.done = make(chan struct{})
 		go func() {
 			for stat := range statColl.statStream {
+				if statColl.Namespaces != nil {
+					statColl.Namespaces.anonymizeStat(stat)
+				}
+				if statColl.Totals != nil {
+					statColl.totalsMu.Lock()
+					statColl.Totals.Add(stat)
+					statColl.totalsMu.Unlock()
+				}
 				statColl.StatRecorder.RecordStat(stat)
 			}
 			close(statColl.done)
@@ -176,13 +273,31 @@ type TerminalStatRecorder struct {
 // mongoreplay to be reviewed by a program directly following execution.
 //
 // BufferedStatCollector's main purpose is for asserting correct execution of
-// ops for testing
+// ops for testing. For long runs, the Buffer can be bounded or disabled with
+// MaxBuffered, leaving only the running totals in Aggregate. It is safe to
+// record into from several goroutines at once; Buffer and Aggregate should
+// only be read directly once recording has finished, or through Stats while
+// it is still going on.
 type BufferedStatRecorder struct {
+	mu sync.Mutex
+
 	// Buffer is a slice of OpStats that is appended to every time the Collect
 	// function makes a record It stores an in-order series of OpStats that
 	// store information about the commands mongoreplay ran as a result of reading
 	// a playback file
 	Buffer []OpStat
+
+	// MaxBuffered limits the number of OpStats kept in Buffer, after which
+	// stats are only aggregated. Zero keeps every OpStat, and a negative value
+	// keeps none.
+	MaxBuffered int
+
+	// Aggregate, if set, holds the running totals of every recorded OpStat,
+	// including those not kept in Buffer.
+	Aggregate *StatAggregate
+
+	// out, if set, is where the report of Aggregate is written on Close.
+	out io.WriteCloser
 }
 
 // NopRecorder implements the StatRecorder interface but doesn't do anything
@@ -228,11 +343,30 @@ func (jsr *JSONStatRecorder) RecordStat(stat *OpStat) {
 	}
 }
 
-// RecordStat records the stat into a buffer
+// RecordStat records the stat into a buffer and the aggregate
 func (bsr *BufferedStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	bsr.mu.Lock()
+	defer bsr.mu.Unlock()
+	if bsr.Aggregate != nil {
+		bsr.Aggregate.Add(stat)
+	}
+	if bsr.MaxBuffered < 0 || (bsr.MaxBuffered > 0 && len(bsr.Buffer) >= bsr.MaxBuffered) {
+		return
+	}
 	bsr.Buffer = append(bsr.Buffer, *stat)
 }
 
+// Stats returns a copy of the OpStats buffered so far, which can be read
+// while stats are still being recorded.
+func (bsr *BufferedStatRecorder) Stats() []OpStat {
+	bsr.mu.Lock()
+	defer bsr.mu.Unlock()
+	return append([]OpStat(nil), bsr.Buffer...)
+}
+
 // RecordStat records the stat into the terminal
 func (dsr *TerminalStatRecorder) RecordStat(stat *OpStat) {
 	if stat == nil {
@@ -287,9 +421,19 @@ func (jsr *JSONStatRecorder) Close() error {
 	return jsr.out.Close()
 }
 
-// Close closes the BufferedStatRecorder
+// Close closes the BufferedStatRecorder, writing the report of the aggregate
+// if it has an output
 func (bsr *BufferedStatRecorder) Close() error {
-	return nil
+	bsr.mu.Lock()
+	defer bsr.mu.Unlock()
+	if bsr.out == nil {
+		return nil
+	}
+	err := bsr.Aggregate.WriteReport(bsr.out)
+	if closeErr := bsr.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // Close closes the NopRecorder (i.e. does nothing)
@@ -313,6 +457,47 @@ type RegularStatGenerator struct {
 	UnresolvedOps map[opKey]UnresolvedOpInfo
 }
 
+// recordedAt returns the time the op was seen in the capture, which is Seen
+// unless it has been shifted for playback.
+func recordedAt(op *RecordedOp) *time.Time {
+	if op.RecordedAt != nil {
+		return &op.RecordedAt.Time
+	}
+	if op.Seen == nil {
+		return nil
+	}
+	return &op.Seen.Time
+}
+
+// replyBytes returns the size of the reply on the wire. Replies received
+// during playback don't keep their wire message, so their size is computed
+// from their documents.
+func replyBytes(reply Replyable) int64 {
+	switch castReply := reply.(type) {
+	case *ReplyOp:
+		if castReply.Header.MessageLength > 0 {
+			return int64(castReply.Header.MessageLength)
+		}
+		size := int64(MsgHeaderLen + 20)
+		for _, doc := range castReply.Docs {
+			size += int64(len(doc.Data))
+		}
+		return size
+	case *CommandReplyOp:
+		if castReply.Header.MessageLength > 0 {
+			return int64(castReply.Header.MessageLength)
+		}
+		size := int64(MsgHeaderLen)
+		for _, doc := range append([]interface{}{castReply.CommandReply, castReply.Metadata}, castReply.OutputDocs...) {
+			if raw, ok := doc.(*bson.Raw); ok && raw != nil {
+				size += int64(len(raw.Data))
+			}
+		}
+		return size
+	}
+	return 0
+}
+
 // GenerateOpStat creates an OpStat using the ComparativeStatGenerator
 func (gen *ComparativeStatGenerator) GenerateOpStat(op *RecordedOp, replayedOp Op, reply Replyable, msg string) *OpStat {
 	if replayedOp == nil || op == nil {
@@ -321,13 +506,19 @@ func (gen *ComparativeStatGenerator) GenerateOpStat(op *RecordedOp, replayedOp O
 	opMeta := replayedOp.Meta()
 	stat := &OpStat{
 		Order:         op.Order,
+		Generation:    op.Generation,
 		OpType:        opMeta.Op,
 		Ns:            opMeta.Ns,
 		RequestData:   opMeta.Data,
 		Command:       opMeta.Command,
 		ConnectionNum: op.PlayedConnectionNum,
 		Seen:          &op.Seen.Time,
+		RecordedAt:    recordedAt(op),
 		RequestID:     op.Header.RequestID,
+		RequestBytes:  int64(op.Header.MessageLength),
+	}
+	if op.DispatchedAt != nil && !op.DispatchedAt.IsZero() {
+		stat.DispatchedAt = &op.DispatchedAt.Time
 	}
 	var playAtHasVal bool
 	if op.PlayAt != nil && !op.PlayAt.IsZero() {
@@ -347,6 +538,8 @@ func (gen *ComparativeStatGenerator) GenerateOpStat(op *RecordedOp, replayedOp O
 		stat.NumReturned = reply.getNumReturned()
 		stat.LatencyMicros = reply.getLatencyMicros()
 		stat.Errors = reply.getErrors()
+		stat.WriteErrors = reply.getWriteErrors()
+		stat.ReplyBytes = replyBytes(reply)
 		replyMeta := reply.Meta()
 		stat.ReplyData = replyMeta.Data
 	}
@@ -371,6 +564,7 @@ func (gen *RegularStatGenerator) GenerateOpStat(recordedOp *RecordedOp, parsedOp
 		Command:       meta.Command,
 		ConnectionNum: recordedOp.SeenConnectionNum,
 		Seen:          &recordedOp.Seen.Time,
+		RecordedAt:    recordedAt(recordedOp),
 	}
 	if msg != "" {
 		stat.Message = msg
@@ -379,6 +573,7 @@ func (gen *RegularStatGenerator) GenerateOpStat(recordedOp *RecordedOp, parsedOp
 	case OpCodeQuery, OpCodeGetMore, OpCodeCommand:
 		stat.RequestData = meta.Data
 		stat.RequestID = recordedOp.Header.RequestID
+		stat.RequestBytes = int64(recordedOp.Header.MessageLength)
 		gen.AddUnresolvedOp(recordedOp, parsedOp, stat)
 		// In 'PairedMode', the stat is not considered completed at this point.
 		// We save the op as 'unresolved' and return nil. When the reply is seen
@@ -390,14 +585,33 @@ func (gen *RegularStatGenerator) GenerateOpStat(recordedOp *RecordedOp, parsedOp
 	case OpCodeReply, OpCodeCommandReply:
 		stat.RequestID = recordedOp.Header.ResponseTo
 		stat.ReplyData = meta.Data
+		stat.ReplyBytes = int64(recordedOp.Header.MessageLength)
 		switch t := parsedOp.(type) {
 		case *CommandReplyOp:
 			return gen.ResolveOp(recordedOp, t, stat)
 		case *ReplyOp:
 			return gen.ResolveOp(recordedOp, t, stat)
 		}
+	case OpCodeMsg:
+		if reply, ok := parsedOp.(*CommandReplyOp); ok {
+			stat.RequestID = recordedOp.Header.ResponseTo
+			stat.ReplyData = meta.Data
+			stat.ReplyBytes = int64(recordedOp.Header.MessageLength)
+			return gen.ResolveOp(recordedOp, reply, stat)
+		}
+		stat.RequestData = meta.Data
+		stat.RequestID = recordedOp.Header.RequestID
+		stat.RequestBytes = int64(recordedOp.Header.MessageLength)
+		// a moreToCome request gets no reply to be paired with
+		if !recordedOp.RawOp.moreToCome() {
+			gen.AddUnresolvedOp(recordedOp, parsedOp, stat)
+			if gen.PairedMode {
+				return nil
+			}
+		}
 	default:
 		stat.RequestData = meta.Data
+		stat.RequestBytes = int64(recordedOp.Header.MessageLength)
 	}
 	return stat
 }
@@ -15,6 +15,10 @@ type OpStat struct {
 	// Order is a number denoting the position in the traffic in which this operation appeared
 	Order int64 `json:"order"`
 
+	// Generation is the iteration of a repeated playback that the operation
+	// was played in, counting from zero.
+	Generation int `json:"generation,omitempty"`
+
 	// OpType is a string representation of the function of this operation. For example an 'insert'
 	// or a 'query'
 	OpType string `json:"op,omitempty"`
@@ -36,6 +40,14 @@ type OpStat struct {
 	// NumReturned is the number of documents that were fetched as a result of this operation.
 	NumReturned int `json:"nreturned,omitempty"`
 
+	// RequestBytes is the size of the request operation on the wire.
+	RequestBytes int64 `json:"request_bytes,omitempty"`
+
+	// ReplyBytes is the size of the reply on the wire. For replies received
+	// during playback, whose wire message isn't kept, it is computed from the
+	// reply's documents.
+	ReplyBytes int64 `json:"reply_bytes,omitempty"`
+
 	// PlayedAt is the time that this operation was replayed
 	PlayedAt *time.Time `json:"played_at,omitempty"`
 
@@ -63,11 +75,25 @@ type OpStat struct {
 	// If unset, the operation did not receive any errors from the server.
 	Errors []error `json:"errors,omitempty"`
 
+	// WriteErrors contains the errors of the writes of the operation that failed, and of
+	// an unsatisfied write concern, returned by a command that may itself have succeeded.
+	WriteErrors []error `json:"write_errors,omitempty"`
+
 	Message string `json:"msg,omitempty"`
 
-	// Seen is the time that this operation was originally seen.
+	// Seen is the time that this operation was originally seen. During
+	// playback with repeats, it is shifted forward for each generation.
 	Seen *time.Time `json:"seen,omitempty"`
 
+	// RecordedAt is the time that this operation was seen in the capture,
+	// regardless of the playback generation.
+	RecordedAt *time.Time `json:"recorded_at,omitempty"`
+
+	// DispatchedAt is the time that playback handed this operation to the
+	// connection playing it. Ops are dispatched ahead of PlayAt, by up to
+	// the play queue time.
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty"`
+
 	// RequestID is the ID of the mongodb operation as taken from the header.
 	// The RequestID for a request operation is the same as the ResponseID for
 	// the corresponding reply, so this field will be the same for request/reply pairs.
@@ -133,6 +159,8 @@ func (stat *OpStat) escaper(req, res <-chan *bytes.Buffer) *escaper.Escaper {
 	esc.Register('c', stat.getCommand)
 	esc.Register('o', stat.getConnectionNum)
 	esc.Register('i', stat.getRequestID)
+	esc.Register('z', stat.getRequestBytes)
+	esc.Register('Z', stat.getReplyBytes)
 	esc.RegisterArg('t', stat.getTime)
 	esc.RegisterArg('q', jsonGet(wReq))
 	esc.RegisterArg('r', jsonGet(wRes))
@@ -156,6 +184,12 @@ func (stat *OpStat) getConnectionNum() string {
 func (stat *OpStat) getRequestID() string {
 	return fmt.Sprintf("%d", stat.RequestID)
 }
+func (stat *OpStat) getRequestBytes() string {
+	return fmt.Sprintf("%d", stat.RequestBytes)
+}
+func (stat *OpStat) getReplyBytes() string {
+	return fmt.Sprintf("%d", stat.ReplyBytes)
+}
 func (stat *OpStat) getTime(layout string) string {
 	if layout == "" {
 		layout = "2/15 15:04:05.000"
@@ -0,0 +1,149 @@
+package mongoreplay
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteDriverName is the database/sql driver used to write SQLite stats. It
+// is only set when mongoreplay is built with the sqlite build tag, which
+// links in the driver.
+var sqliteDriverName string
+
+// sqliteBatchSize is the number of rows inserted in each transaction.
+const sqliteBatchSize = 1000
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS ops (
+	op_order INTEGER,
+	seen TEXT,
+	played_at TEXT,
+	op TEXT,
+	command TEXT,
+	ns TEXT,
+	connection_num INTEGER,
+	request_id INTEGER,
+	latency_us INTEGER,
+	playbacklag_us INTEGER,
+	nreturned INTEGER,
+	request_bytes INTEGER,
+	reply_bytes INTEGER,
+	errors TEXT,
+	msg TEXT
+)`
+
+const sqliteInsert = `INSERT INTO ops (op_order, seen, played_at, op, command, ns,
+	connection_num, request_id, latency_us, playbacklag_us, nreturned,
+	request_bytes, reply_bytes, errors, msg)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// SQLiteStatRecorder records each OpStat as a row of the ops table of a
+// SQLite database, so that a run can be analyzed with SQL afterwards. Rows are
+// inserted in transactions of sqliteBatchSize rows.
+type SQLiteStatRecorder struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+
+	// rows counts the rows inserted in the current transaction
+	rows int
+}
+
+// newSQLiteStatRecorder opens the SQLite database at path, creating it and
+// its ops table if needed.
+func newSQLiteStatRecorder(path string) (*SQLiteStatRecorder, error) {
+	if sqliteDriverName == "" {
+		return nil, fmt.Errorf("mongoreplay was built without SQLite support; rebuild it with the sqlite build tag")
+	}
+	if path == "" {
+		return nil, fmt.Errorf("--collect=sqlite requires --report to name the database file")
+	}
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening stats database: %v", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating stats table: %v", err)
+	}
+	return &SQLiteStatRecorder{db: db}, nil
+}
+
+// sqliteTime formats a time for the database, in a form SQLite's date and
+// time functions accept.
+func sqliteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// sqliteRow returns the values of the columns of the row for the stat.
+func sqliteRow(stat *OpStat) []interface{} {
+	var errors interface{}
+	if len(stat.Errors) > 0 {
+		messages := make([]string, len(stat.Errors))
+		for i, err := range stat.Errors {
+			messages[i] = err.Error()
+		}
+		errors = strings.Join(messages, "; ")
+	}
+	return []interface{}{
+		stat.Order, sqliteTime(stat.Seen), sqliteTime(stat.PlayedAt),
+		stat.OpType, stat.Command, stat.Ns,
+		stat.ConnectionNum, stat.RequestID, stat.LatencyMicros, stat.PlaybackLagMicros, stat.NumReturned,
+		stat.RequestBytes, stat.ReplyBytes, errors, stat.Message,
+	}
+}
+
+// RecordStat inserts the stat into the database
+func (ssr *SQLiteStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	if ssr.tx == nil {
+		tx, err := ssr.db.Begin()
+		if err != nil {
+			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+			return
+		}
+		insert, err := tx.Prepare(sqliteInsert)
+		if err != nil {
+			tx.Rollback()
+			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+			return
+		}
+		ssr.tx, ssr.insert = tx, insert
+	}
+	if _, err := ssr.insert.Exec(sqliteRow(stat)...); err != nil {
+		toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+		return
+	}
+	ssr.rows++
+	if ssr.rows >= sqliteBatchSize {
+		if err := ssr.commit(); err != nil {
+			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+		}
+	}
+}
+
+// commit commits the current transaction, if any.
+func (ssr *SQLiteStatRecorder) commit() error {
+	if ssr.tx == nil {
+		return nil
+	}
+	ssr.insert.Close()
+	err := ssr.tx.Commit()
+	ssr.tx, ssr.insert, ssr.rows = nil, nil, 0
+	return err
+}
+
+// Close commits the remaining rows and closes the database
+func (ssr *SQLiteStatRecorder) Close() error {
+	err := ssr.commit()
+	if closeErr := ssr.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
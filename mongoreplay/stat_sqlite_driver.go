@@ -0,0 +1,11 @@
+// +build sqlite
+
+package mongoreplay
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sqliteDriverName = "sqlite3"
+}
@@ -0,0 +1,53 @@
+// +build sqlite
+
+package mongoreplay
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStatRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.db")
+
+	collector, err := newStatCollector(StatOptions{Collect: "sqlite", Report: path}, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := collector.StatRecorder.(*SQLiteStatRecorder)
+	for i := 0; i < sqliteBatchSize+2; i++ {
+		recorder.RecordStat(&OpStat{Order: int64(i), OpType: "op_msg", Command: "find", Ns: "test.coll",
+			LatencyMicros: int64(i)})
+	}
+	recorder.RecordStat(nil)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rows, latency int64
+	var ns string
+	err = db.QueryRow("SELECT COUNT(*), SUM(latency_us), MAX(ns) FROM ops").Scan(&rows, &latency, &ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rows of the last, partial transaction are committed on Close
+	if rows != sqliteBatchSize+2 || ns != "test.coll" {
+		t.Errorf("expected %v rows on test.coll, got %v on %v", sqliteBatchSize+2, rows, ns)
+	}
+	if expected := int64(sqliteBatchSize+2) * int64(sqliteBatchSize+1) / 2; latency != expected {
+		t.Errorf("expected a total latency of %v, got %v", expected, latency)
+	}
+}
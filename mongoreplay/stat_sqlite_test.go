@@ -0,0 +1,51 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSQLiteRow(t *testing.T) {
+	seen := time.Date(2017, 3, 4, 5, 6, 7, 8000, time.UTC)
+	stat := &OpStat{
+		Order:         3,
+		OpType:        "op_command",
+		Command:       "find",
+		Ns:            "test.coll",
+		Seen:          &seen,
+		LatencyMicros: 250,
+		RequestBytes:  120,
+		ReplyBytes:    4096,
+		Errors:        []error{fmt.Errorf("first"), fmt.Errorf("second")},
+	}
+	row := sqliteRow(stat)
+	if len(row) != 15 {
+		t.Fatalf("expected a value for each of the 15 columns, got %v", len(row))
+	}
+	if row[1] != "2017-03-04 05:06:07.000008" || row[2] != nil {
+		t.Errorf("unexpected times: %v, %v", row[1], row[2])
+	}
+	if row[8] != int64(250) || row[11] != int64(120) || row[12] != int64(4096) {
+		t.Errorf("unexpected latency and sizes: %v", row)
+	}
+	if row[13] != "first; second" {
+		t.Errorf("expected the errors to be joined, got %v", row[13])
+	}
+	if row := sqliteRow(&OpStat{}); row[13] != nil {
+		t.Errorf("expected no errors to be NULL, got %v", row[13])
+	}
+}
+
+func TestSQLiteStatRecorderOptions(t *testing.T) {
+	_, err := newStatCollector(StatOptions{Collect: "sqlite"}, true, true)
+	if err == nil {
+		t.Errorf("expected an error without a database file")
+	}
+	if sqliteDriverName == "" {
+		_, err = newStatCollector(StatOptions{Collect: "sqlite", Report: "stats.db"}, true, true)
+		if err == nil {
+			t.Errorf("expected an error without the sqlite build tag")
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The reasons a playback ended, as given in its summary, or running in the
+// snapshot of a playback still going on.
+const (
+	exitCompleted         = "completed"
+	exitInterrupted       = "interrupted"
+	exitRunning           = "running"
+	exitErrorRateExceeded = "error_rate_exceeded"
+	exitError             = "error"
+)
+
+// summaryPercentiles are the percentiles of the latencies included in a
+// playback summary.
+var summaryPercentiles = []int{50, 90, 95, 99}
+
+// playbackSummary is the summary of a playback written with --summaryFile,
+// for scripts to decide whether it passed without parsing the logs.
+type playbackSummary struct {
+	RunID      string `json:"run_id"`
+	ExitReason string `json:"exit_reason"`
+	Error      string `json:"error,omitempty"`
+
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"duration_s"`
+
+	Ops         int64 `json:"ops"`
+	Errors      int64 `json:"errors"`
+	WriteErrors int64 `json:"write_errors"`
+
+	// Timeouts counts the ops among the errors that exceeded their time
+	// limit.
+	Timeouts int64 `json:"timeouts"`
+
+	MeanLatencyMicros        int64            `json:"mean_latency_us"`
+	MaxLatencyMicros         int64            `json:"max_latency_us"`
+	LatencyPercentilesMicros map[string]int64 `json:"latency_percentiles_us"`
+
+	// ByType holds the counts of the ops of each op type, named as in the
+	// stats.
+	ByType map[string]summaryCounts `json:"by_type"`
+
+	Config playbackConfig `json:"config"`
+}
+
+// summaryCounts holds the counts of a group of ops in a playback summary.
+type summaryCounts struct {
+	Ops         int64 `json:"ops"`
+	Errors      int64 `json:"errors"`
+	WriteErrors int64 `json:"write_errors"`
+	Timeouts    int64 `json:"timeouts"`
+}
+
+// playbackConfig holds the settings a playback was run with, as given in its
+// summary.
+type playbackConfig struct {
+	PlaybackFile     string   `json:"playback_file"`
+	Target           string   `json:"target"`
+	Speed            float64  `json:"speed"`
+	Repeat           int      `json:"repeat"`
+	Serial           bool     `json:"serial,omitempty"`
+	AutoConcurrency  bool     `json:"auto_concurrency,omitempty"`
+	ConnectionID     *int64   `json:"connection_id,omitempty"`
+	NamespaceSpeeds  []string `json:"ns_speeds,omitempty"`
+	NamespaceLimits  []string `json:"ns_max_concurrency,omitempty"`
+	NamespaceFrom    []string `json:"ns_from,omitempty"`
+	NamespaceTo      []string `json:"ns_to,omitempty"`
+	BatchSize        int      `json:"batch_size,omitempty"`
+	OpTimeout        string   `json:"op_timeout,omitempty"`
+	Compressors      []string `json:"compressors,omitempty"`
+	CheckShardKeys   string   `json:"check_shard_keys,omitempty"`
+	AddShardKey      []string `json:"add_shard_key,omitempty"`
+	MaxErrorRate     []string `json:"max_error_rate,omitempty"`
+	CountWriteErrors bool     `json:"count_write_errors,omitempty"`
+	FaultRate        float64  `json:"fault_rate,omitempty"`
+	Synthesize       bool     `json:"synthesize,omitempty"`
+	Rate             float64  `json:"rate,omitempty"`
+}
+
+// config returns the settings of the play command for its summary. The
+// credentials in a mongodb:// URI given as the host are left out.
+func (play *PlayCommand) config() playbackConfig {
+	config := playbackConfig{
+		PlaybackFile:     play.PlaybackFile,
+		Speed:            play.Speed,
+		Repeat:           play.Repeat,
+		Serial:           play.Serial,
+		AutoConcurrency:  play.AutoConcurrency,
+		NamespaceSpeeds:  play.NamespaceSpeeds,
+		NamespaceLimits:  play.NamespaceLimits,
+		NamespaceFrom:    play.NSFrom,
+		NamespaceTo:      play.NSTo,
+		BatchSize:        play.BatchSize,
+		Compressors:      play.Compressors,
+		CheckShardKeys:   play.CheckShardKeys,
+		AddShardKey:      play.AddShardKey,
+		MaxErrorRate:     play.MaxErrorRate,
+		CountWriteErrors: play.CountWriteErrors,
+		FaultRate:        play.FaultRate,
+		Synthesize:       play.Synthesize,
+		Rate:             play.Rate,
+	}
+	if play.OpTimeout > 0 {
+		config.OpTimeout = play.OpTimeout.String()
+	}
+	if play.ConnectionID >= 0 {
+		config.ConnectionID = &play.ConnectionID
+	}
+	if url, err := targetURL(play.Host, play.Port); err == nil {
+		config.Target = redactURL(url)
+	}
+	return config
+}
+
+// redactURL removes the credentials from a mongodb:// URI.
+func redactURL(url string) string {
+	const scheme = "mongodb://"
+	if !strings.HasPrefix(url, scheme) {
+		return url
+	}
+	rest := url[len(scheme):]
+	hosts := rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hosts = rest[:i]
+	}
+	if i := strings.LastIndex(hosts, "@"); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return scheme + rest
+}
+
+// newPlaybackSummary returns the summary of a playback from the totals of
+// its stats, which may be nil if no ops were collected.
+func newPlaybackSummary(runID string, started, finished time.Time, agg *StatAggregate) *playbackSummary {
+	summary := &playbackSummary{
+		RunID:                    runID,
+		Started:                  started,
+		Finished:                 finished,
+		DurationSeconds:          finished.Sub(started).Seconds(),
+		LatencyPercentilesMicros: map[string]int64{},
+		ByType:                   map[string]summaryCounts{},
+	}
+	if agg == nil {
+		agg = NewStatAggregate()
+	}
+	total := &agg.Total
+	summary.Ops, summary.Errors, summary.WriteErrors = total.Count, total.Errors, total.WriteErrors
+	summary.Timeouts = total.Timeouts
+	summary.MeanLatencyMicros = total.MeanLatencyMicros()
+	summary.MaxLatencyMicros = total.MaxLatencyMicros
+	for _, p := range summaryPercentiles {
+		summary.LatencyPercentilesMicros[fmt.Sprintf("p%d", p)] = total.LatencyPercentile(p)
+	}
+	for opType, totals := range agg.ByType {
+		summary.ByType[opType] = summaryCounts{
+			Ops:         totals.Count,
+			Errors:      totals.Errors,
+			WriteErrors: totals.WriteErrors,
+			Timeouts:    totals.Timeouts,
+		}
+	}
+	return summary
+}
+
+// setExit records why the playback ended, given the error it ended with.
+func (summary *playbackSummary) setExit(err error) {
+	switch err.(type) {
+	case nil:
+		summary.ExitReason = exitCompleted
+	case ErrErrorRateExceeded:
+		summary.ExitReason = exitErrorRateExceeded
+	default:
+		summary.ExitReason = exitError
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+}
+
+// write writes the summary as a single JSON object to the named file, or to
+// stdout if the name is "-".
+func (summary *playbackSummary) write(filename string) error {
+	var out io.Writer = os.Stdout
+	if filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("error writing summary: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	jsonBytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(jsonBytes, '\n')); err != nil {
+		return fmt.Errorf("error writing summary: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// synthesizeSamples is the most recorded ops kept as templates for each kind
+// of op in a load model, chosen at random from all the ops of that kind.
+const synthesizeSamples = 32
+
+// synthesizedServer is the server endpoint of synthetic ops, which are all
+// played on the target.
+const synthesizedServer = "synthetic:server"
+
+// updateFlagUpsert is the flag of a legacy OP_UPDATE that makes it an upsert.
+const updateFlagUpsert = 1 << 0
+
+// loadModel holds the mix of ops of a tape, learned while preprocessing it, to
+// generate synthetic ops in the same proportions at any rate. Ops are told
+// apart by their op type, namespace and query shape, and each synthetic op is
+// a copy of a recorded op of its kind, with new _ids for the documents it
+// inserts.
+type loadModel struct {
+	classes map[string]*opClass
+	total   int64
+
+	// connections holds the recorded connections that sent modeled ops
+	connections map[int64]bool
+	first, last time.Time
+
+	// seed seeds the sampling of templates and the generation of ops
+	seed int64
+	rand *rand.Rand
+}
+
+// opClass is a kind of op in a load model.
+type opClass struct {
+	opType string
+	ns     string
+	count  int64
+
+	// templates holds a random sample of the recorded ops of the kind
+	templates []*RecordedOp
+}
+
+// newLoadModel returns an empty load model. The ops synthesized from it depend
+// only on the seed and the tape, and a seed of zero picks a random seed.
+func newLoadModel(seed int64) *loadModel {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &loadModel{
+		classes:     map[string]*opClass{},
+		connections: map[int64]bool{},
+		seed:        seed,
+		rand:        rand.New(rand.NewSource(seed)),
+	}
+}
+
+// synthesizable returns whether copies of the op can be played on their own.
+// Handshakes are made by each connection as it is opened, and getmores and
+// killcursors need the ids of cursors opened on the target.
+func synthesizable(op Op) bool {
+	if IsHandshakeOp(op) {
+		return false
+	}
+	switch op.(type) {
+	case *GetMoreOp, *KillCursorsOp:
+		return false
+	}
+	switch opCommandName(op) {
+	case "getMore", "killCursors":
+		return false
+	}
+	return true
+}
+
+// observe adds an op of the tape to the model. Replies, connection ends and
+// ops that can't be synthesized aren't modeled.
+func (model *loadModel) observe(op *RecordedOp) {
+	if op.EOF || op.Seen == nil || isReplyOpCode(op.RawOp) {
+		return
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil || !synthesizable(parsedOp) {
+		return
+	}
+	meta := parsedOp.Meta()
+	key := fmt.Sprintf("%v %v", opTypeName(meta), meta.Ns)
+	if shape, ok, err := queryShape(parsedOp); err == nil && ok {
+		key += " " + shape
+	}
+	class, ok := model.classes[key]
+	if !ok {
+		class = &opClass{opType: opTypeName(meta), ns: meta.Ns}
+		model.classes[key] = class
+	}
+	class.count++
+	if len(class.templates) < synthesizeSamples {
+		class.templates = append(class.templates, op)
+	} else if i := model.rand.Int63n(class.count); i < synthesizeSamples {
+		class.templates[i] = op
+	}
+
+	model.total++
+	model.connections[op.SeenConnectionNum] = true
+	if model.first.IsZero() {
+		model.first = op.Seen.Time
+	}
+	model.last = op.Seen.Time
+}
+
+// duration returns the time from the first modeled op of the tape to the last.
+func (model *loadModel) duration() time.Duration {
+	return model.last.Sub(model.first)
+}
+
+// synthesizer generates the ops of a synthetic load from a load model.
+type synthesizer struct {
+	model       *loadModel
+	rate        float64
+	duration    time.Duration
+	connections int
+
+	// generated holds the number of ops generated of each op type and
+	// namespace
+	generated map[string]int64
+	total     int64
+	sync.Mutex
+}
+
+// newSynthesizer returns a synthesizer generating ops in the mix of the model
+// at the given rate per second for the given duration, spread over as many
+// connections as the tape sent modeled ops on. A zero duration uses the
+// duration of the tape.
+func newSynthesizer(model *loadModel, rate float64, duration time.Duration) (*synthesizer, error) {
+	if model.total == 0 {
+		return nil, fmt.Errorf("the playback file has no ops to synthesize a load from")
+	}
+	if duration == 0 {
+		duration = model.duration()
+	}
+	if int64(rate*duration.Seconds()) == 0 {
+		return nil, fmt.Errorf("no ops to synthesize at %v ops/sec for %v", rate, duration)
+	}
+	return &synthesizer{
+		model:       model,
+		rate:        rate,
+		duration:    duration,
+		connections: len(model.connections),
+		generated:   map[string]int64{},
+	}, nil
+}
+
+// ops runs a goroutine generating the synthetic ops, evenly spaced at the rate
+// and handed out to the connections in turn, and returns the channel they are
+// pushed to. Each connection ends once all the ops have been generated.
+func (s *synthesizer) ops() <-chan *RecordedOp {
+	ch := make(chan *RecordedOp)
+
+	// pick the kinds of op in a fixed order, so that a seed always generates
+	// the same ops
+	keys := make([]string, 0, len(s.model.classes))
+	for key := range s.model.classes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	go func() {
+		defer close(ch)
+		random := rand.New(rand.NewSource(s.model.seed))
+		count := int64(s.rate * s.duration.Seconds())
+		interval := time.Duration(float64(time.Second) / s.rate)
+		start := s.model.first
+		requestIDs := make([]int32, s.connections)
+		for i := int64(0); i < count; i++ {
+			pick := random.Int63n(s.model.total)
+			var class *opClass
+			for _, key := range keys {
+				class = s.model.classes[key]
+				if pick < class.count {
+					break
+				}
+				pick -= class.count
+			}
+			template := class.templates[random.Intn(len(class.templates))]
+			connection := int(i % int64(s.connections))
+			requestIDs[connection]++
+
+			op := &RecordedOp{
+				RawOp:             RawOp{Header: template.Header, Body: make([]byte, len(template.Body))},
+				Seen:              &PreciseTime{start.Add(time.Duration(i) * interval)},
+				SrcEndpoint:       fmt.Sprintf("synthetic:%d", connection),
+				DstEndpoint:       synthesizedServer,
+				SeenConnectionNum: int64(connection),
+				Order:             i,
+				Synthetic:         true,
+			}
+			op.RecordedAt = &PreciseTime{op.Seen.Time}
+			op.Header.RequestID = requestIDs[connection]
+			copy(op.Body, template.Body)
+			copy(op.Body, op.Header.ToWire())
+
+			s.Lock()
+			s.generated[strings.TrimSpace(class.opType+" "+class.ns)]++
+			s.total++
+			s.Unlock()
+			ch <- op
+		}
+
+		end := start.Add(time.Duration(count) * interval)
+		for connection := 0; connection < s.connections; connection++ {
+			ch <- &RecordedOp{
+				Seen:              &PreciseTime{end},
+				EOF:               true,
+				SrcEndpoint:       fmt.Sprintf("synthetic:%d", connection),
+				DstEndpoint:       synthesizedServer,
+				SeenConnectionNum: int64(connection),
+				Order:             count + int64(connection),
+			}
+		}
+	}()
+	return ch
+}
+
+// regenerateIDs gives the documents inserted by a synthetic copy of an op new
+// _ids, so that the copies of an insert aren't rejected as duplicates of each
+// other. An upsert that selects a document by its _id selects, and so may
+// insert, one with a new _id instead, and a replacement leaves the _id of the
+// document it replaces as it is. Other ops are left as they are.
+func regenerateIDs(op Op) error {
+	err := eachInsertedDoc(op, func(ns string, doc bson.D) bson.D {
+		return withID(doc, bson.NewObjectId())
+	})
+	if err != nil {
+		return err
+	}
+	switch castOp := op.(type) {
+	case *UpdateOp:
+		selector, err := toBSOND(castOp.Selector)
+		if err != nil {
+			return err
+		}
+		update, err := toBSOND(castOp.Update)
+		if err != nil {
+			return err
+		}
+		selector, update = updateWithNewIDs(selector, update, castOp.Flags&updateFlagUpsert != 0)
+		castOp.Selector, castOp.Update = &selector, &update
+	case *QueryOp:
+		if !strings.Contains(castOp.Collection, ".$cmd") {
+			return nil
+		}
+		command, err := toBSOND(castOp.Query)
+		if err != nil {
+			return err
+		}
+		if err := updateCommandWithNewIDs(command); err != nil {
+			return err
+		}
+		castOp.Query = command
+	case *CommandOp:
+		if castOp.CommandName != "update" {
+			return nil
+		}
+		command, err := toBSOND(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		if err := updateCommandWithNewIDs(command); err != nil {
+			return err
+		}
+		castOp.CommandArgs = command
+	case *MsgOp:
+		if castOp.commandName() != "update" {
+			return nil
+		}
+		// the statements may be sent in a document sequence section
+		if err := castOp.foldSequences(); err != nil {
+			return err
+		}
+		return castOp.editBody(func(command bson.D) (bson.D, error) {
+			return command, updateCommandWithNewIDs(command)
+		})
+	}
+	return nil
+}
+
+// updateCommandWithNewIDs gives each statement of an update command the new
+// _ids of updateWithNewIDs. Other commands are left as they are.
+func updateCommandWithNewIDs(command bson.D) error {
+	if len(command) == 0 || command[0].Name != "update" {
+		return nil
+	}
+	for _, elem := range command {
+		statements, ok := elem.Value.([]interface{})
+		if elem.Name != "updates" || !ok {
+			continue
+		}
+		for i, value := range statements {
+			statement, err := toBSOND(value)
+			if err != nil {
+				return err
+			}
+			q, u := -1, -1
+			var upsert bool
+			for j, field := range statement {
+				switch field.Name {
+				case "q":
+					q = j
+				case "u":
+					u = j
+				case "upsert":
+					upsert, _ = field.Value.(bool)
+				}
+			}
+			if q < 0 || u < 0 {
+				continue
+			}
+			selector, err := toBSOND(statement[q].Value)
+			if err != nil {
+				return err
+			}
+			// an update given as a pipeline sets no _id
+			update, err := toBSOND(statement[u].Value)
+			if err != nil {
+				continue
+			}
+			statement[q].Value, statement[u].Value = updateWithNewIDs(selector, update, upsert)
+			statements[i] = statement
+		}
+	}
+	return nil
+}
+
+// updateWithNewIDs returns the selector and update of an update with new _ids.
+// An upsert selecting by _id selects a new one, which its replacement document
+// or $setOnInsert, if either sets an _id, sets too. Any other upsert inserts a
+// document with a new _id, while a replacement document that isn't an upsert
+// by _id loses its _id, so that the server keeps that of the document it
+// replaces, or picks a new one.
+func updateWithNewIDs(selector, update bson.D, upsert bool) (bson.D, bson.D) {
+	id := bson.NewObjectId()
+	_, byID := FindValueByKey("_id", &selector)
+	replacement := len(update) > 0 && !strings.HasPrefix(update[0].Name, "$")
+	if upsert && byID {
+		selector = withID(selector, id)
+	}
+	switch {
+	case replacement && upsert && byID:
+		update = withID(update, id)
+	case replacement:
+		update = withoutID(update)
+	case upsert:
+		for i, elem := range update {
+			if elem.Name != "$setOnInsert" {
+				continue
+			}
+			if setOnInsert, err := toBSOND(elem.Value); err == nil {
+				update[i].Value = withID(setOnInsert, id)
+			}
+		}
+	}
+	return selector, update
+}
+
+// withID returns the document with its _id, if it has one, set to the id.
+func withID(doc bson.D, id interface{}) bson.D {
+	for i, elem := range doc {
+		if elem.Name == "_id" {
+			doc[i].Value = id
+		}
+	}
+	return doc
+}
+
+// withoutID returns the document without its _id.
+func withoutID(doc bson.D) bson.D {
+	for i, elem := range doc {
+		if elem.Name == "_id" {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+	}
+	return doc
+}
+
+// String returns the mix of the generated ops, with the number and share of
+// ops of each op type and namespace.
+func (s *synthesizer) String() string {
+	s.Lock()
+	defer s.Unlock()
+	names := make([]string, 0, len(s.generated))
+	for name := range s.generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mix := make([]string, 0, len(names))
+	for _, name := range names {
+		count := s.generated[name]
+		mix = append(mix, fmt.Sprintf("%v %v (%.1f%%)", count, name, 100*float64(count)/float64(s.total)))
+	}
+	if len(mix) == 0 {
+		mix = append(mix, "none")
+	}
+	return fmt.Sprintf("%v (seed %v)", strings.Join(mix, ", "), s.model.seed)
+}
@@ -0,0 +1,197 @@
+package mongoreplay
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// synthesisTape returns the ops of a tape of 30 inserts and 10 queries on two
+// connections over ten seconds, with a getmore that can't be synthesized.
+func synthesisTape(t *testing.T) []*RecordedOp {
+	generator := newRecordedOpGenerator()
+	for i := 0; i < 30; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := generator.generateQuery(bson.D{{"_id", i}}, 1, int32(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := generator.generateGetMore(1234, 1); err != nil {
+		t.Fatal(err)
+	}
+	ops := generatedOps(generator)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, op := range ops {
+		op.Seen = &PreciseTime{start.Add(time.Duration(i) * 10 * time.Second / time.Duration(len(ops)-1))}
+		op.SeenConnectionNum = int64(i % 2)
+		op.SrcEndpoint, op.DstEndpoint = "client", "server"
+	}
+	return ops
+}
+
+func TestLoadModel(t *testing.T) {
+	model := newLoadModel(1)
+	for _, op := range synthesisTape(t) {
+		model.observe(op)
+	}
+	if model.total != 40 || len(model.classes) != 2 || len(model.connections) != 2 {
+		t.Fatalf("expected 40 ops of 2 kinds on 2 connections to be modeled, got %v ops of %v kinds on %v connections",
+			model.total, len(model.classes), len(model.connections))
+	}
+	if model.duration() >= 10*time.Second {
+		t.Errorf("expected the getmore at the end of the tape not to be modeled, got a duration of %v", model.duration())
+	}
+	for _, class := range model.classes {
+		if len(class.templates) > synthesizeSamples {
+			t.Errorf("expected at most %v templates of %v, got %v", synthesizeSamples, class.opType, len(class.templates))
+		}
+	}
+}
+
+func TestSynthesizer(t *testing.T) {
+	synthesize := func(seed int64) ([]*RecordedOp, *synthesizer) {
+		model := newLoadModel(seed)
+		for _, op := range synthesisTape(t) {
+			model.observe(op)
+		}
+		synth, err := newSynthesizer(model, 200, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []*RecordedOp
+		for op := range synth.ops() {
+			ops = append(ops, op)
+		}
+		return ops, synth
+	}
+
+	ops, synth := synthesize(7)
+	if len(ops) != 2002 {
+		t.Fatalf("expected 2000 ops and 2 connection ends, got %v ops", len(ops))
+	}
+	inserts := 0
+	ids := map[interface{}]bool{}
+	for i, op := range ops[:2000] {
+		if op.EOF {
+			t.Fatalf("expected op %v not to end its connection", i)
+		}
+		if expected := ops[0].Seen.Add(time.Duration(i) * 5 * time.Millisecond); !op.Seen.Equal(expected) {
+			t.Errorf("expected op %v to be seen at %v, got %v", i, expected, op.Seen)
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatalf("error parsing synthetic op %v: %v", i, err)
+		}
+		if !op.Synthetic {
+			t.Errorf("expected op %v to be marked as synthetic", i)
+		}
+		if err := regenerateIDs(parsedOp); err != nil {
+			t.Fatalf("error regenerating the _ids of op %v: %v", i, err)
+		}
+		switch castOp := parsedOp.(type) {
+		case *InsertOp:
+			inserts++
+			for _, value := range castOp.Documents {
+				doc, err := toBSOND(value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				id, _ := FindValueByKey("_id", &doc)
+				ids[id] = true
+			}
+		case *QueryOp:
+		default:
+			t.Errorf("expected only inserts and queries to be synthesized, got %#v", parsedOp)
+		}
+	}
+	// three quarters of the modeled ops are inserts
+	if inserts < 1400 || inserts > 1600 {
+		t.Errorf("expected about 1500 inserts, got %v", inserts)
+	}
+	// copies of the same recorded insert insert documents with new _ids
+	if len(ids) != inserts {
+		t.Errorf("expected each of the %v inserts to have a distinct _id, got %v _ids", inserts, len(ids))
+	}
+	for _, op := range ops[2000:] {
+		if !op.EOF {
+			t.Errorf("expected the last ops to end the connections, got %#v", op)
+		}
+	}
+	if mix := synth.String(); !strings.Contains(mix, "insert mongoreplay.test") || !strings.HasSuffix(mix, "(seed 7)") {
+		t.Errorf("expected the mix of inserts and queries, got %v", mix)
+	}
+
+	// the same seed synthesizes the same ops
+	again, _ := synthesize(7)
+	for i := range ops {
+		if string(again[i].Body) != string(ops[i].Body) {
+			t.Fatalf("expected op %v to be the same with the same seed", i)
+		}
+	}
+
+	if _, err := newSynthesizer(newLoadModel(1), 200, time.Second); err == nil {
+		t.Errorf("expected an error synthesizing from an empty model")
+	}
+}
+
+func TestRegenerateUpdateIDs(t *testing.T) {
+	newID := func(value interface{}) bool {
+		_, ok := value.(bson.ObjectId)
+		return ok
+	}
+	get := func(doc interface{}, name string) interface{} {
+		d, err := toBSOND(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := FindValueByKey(name, &d)
+		return value
+	}
+
+	// an upsert by _id upserts a new _id, set by its replacement too
+	upsert := &UpdateOp{UpdateOp: mgo.UpdateOp{
+		Collection: "mongoreplay.test",
+		Selector:   &bson.D{{"_id", 1}},
+		Update:     &bson.D{{"_id", 1}, {"a", 1}},
+		Flags:      updateFlagUpsert,
+	}}
+	if err := regenerateIDs(upsert); err != nil {
+		t.Fatal(err)
+	}
+	if id := get(upsert.Selector, "_id"); !newID(id) || get(upsert.Update, "_id") != id {
+		t.Errorf("expected the upsert to select and set the same new _id, got %v and %v", upsert.Selector, upsert.Update)
+	}
+
+	// a replacement keeps the _id of the document it replaces
+	statement := bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"_id", 1}, {"a", 2}}}}
+	command := &CommandOp{CommandOp: mgo.CommandOp{
+		Database:    "mongoreplay",
+		CommandName: "update",
+		CommandArgs: bson.D{{"update", "test"}, {"updates", []interface{}{statement}}},
+	}}
+	if err := regenerateIDs(command); err != nil {
+		t.Fatal(err)
+	}
+	updates := get(command.CommandArgs, "updates").([]interface{})
+	if replacement := get(updates[0], "u"); get(replacement, "_id") != nil || get(replacement, "a") != 2 {
+		t.Errorf("expected the replacement to lose its _id, got %v", replacement)
+	}
+
+	// an upsert with $setOnInsert inserts a new _id
+	statement = bson.D{{"q", bson.D{{"a", 1}}}, {"u", bson.D{{"$setOnInsert", bson.D{{"_id", 1}}}}}, {"upsert", true}}
+	command.CommandArgs = bson.D{{"update", "test"}, {"updates", []interface{}{statement}}}
+	if err := regenerateIDs(command); err != nil {
+		t.Fatal(err)
+	}
+	updates = get(command.CommandArgs, "updates").([]interface{})
+	if id := get(get(get(updates[0], "u"), "$setOnInsert"), "_id"); !newID(id) {
+		t.Errorf("expected the upsert to insert a new _id, got %v", id)
+	}
+}
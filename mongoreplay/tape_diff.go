@@ -0,0 +1,368 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// DiffCommand stores settings for the mongoreplay 'diff' subcommand
+type DiffCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	Gzip       bool     `long:"gzip" description:"decompress gzipped input"`
+
+	AnonymizeNamespaces bool   `long:"anonymizeNamespaces" description:"replace the names of databases and collections in the comparison with pseudonyms, the same for a name in both files"`
+	NsMap               string `long:"nsMap" description:"with --anonymizeNamespaces, write the names of the pseudonyms to this file as JSON, to de-anonymize the comparison later"`
+}
+
+// shapedCommands are the commands whose query shapes are compared, mapped to
+// true if the first field of the command names a collection.
+var shapedCommands = map[string]bool{
+	"find":          true,
+	"count":         true,
+	"distinct":      true,
+	"findAndModify": true,
+	"findandmodify": true,
+	"aggregate":     true,
+	"update":        true,
+	"delete":        true,
+}
+
+// shapeIgnoredFields are the command fields that say nothing about the shape
+// of a query, such as those a driver adds to every command.
+var shapeIgnoredFields = map[string]bool{
+	"lsid":            true,
+	"txnNumber":       true,
+	"comment":         true,
+	"maxTimeMS":       true,
+	"$db":             true,
+	"$clusterTime":    true,
+	"$readPreference": true,
+}
+
+// opTypeName names the type of an op as in the stats: the op type and, for
+// commands, the command name.
+func opTypeName(meta OpMetadata) string {
+	if meta.Command != "" {
+		return meta.Op + " " + meta.Command
+	}
+	return meta.Op
+}
+
+// tapeProfile summarizes the mix of ops in a tape, for comparing it with
+// another.
+type tapeProfile struct {
+	total      int64
+	ops        map[string]int64
+	namespaces map[string]int64
+	shapes     map[string]int64
+
+	// unparsed counts the ops that couldn't be parsed
+	unparsed int64
+
+	// anonymizer, if set, replaces the namespaces of the ops with pseudonyms
+	anonymizer *nsAnonymizer
+}
+
+func newTapeProfile() *tapeProfile {
+	return &tapeProfile{
+		ops:        map[string]int64{},
+		namespaces: map[string]int64{},
+		shapes:     map[string]int64{},
+	}
+}
+
+// readTapeProfile reads the profile of the tape in the named file.
+func readTapeProfile(filename string, gzip bool, anonymizer *nsAnonymizer) (*tapeProfile, error) {
+	reader, err := NewPlaybackFileReader(filename, gzip)
+	if err != nil {
+		return nil, err
+	}
+	opChan, errChan := NewOpChanFromFile(reader, 1)
+	profile := newTapeProfile()
+	profile.anonymizer = anonymizer
+	var observeErr error
+	for op := range opChan {
+		// keep draining the channel after an error, so the reader finishes
+		if observeErr == nil {
+			observeErr = profile.observe(op)
+		}
+	}
+	if err := <-errChan; err != io.EOF {
+		return nil, fmt.Errorf("error reading %v: %v", filename, err)
+	}
+	if observeErr != nil {
+		return nil, fmt.Errorf("error reading %v: %v", filename, observeErr)
+	}
+	return profile, nil
+}
+
+// observe adds an op of the tape to the profile. Replies and connection ends
+// aren't counted.
+func (profile *tapeProfile) observe(op *RecordedOp) error {
+	if op.EOF || isReply(op) {
+		return nil
+	}
+	profile.total++
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil {
+		profile.unparsed++
+		return nil
+	}
+	meta := parsedOp.Meta()
+	opType := opTypeName(meta)
+	profile.ops[opType]++
+	ns := meta.Ns
+	var rename func(string) string
+	if profile.anonymizer != nil {
+		ns = profile.anonymizer.namespace(ns)
+		rename = profile.anonymizer.collectionName
+	}
+	if ns != "" {
+		profile.namespaces[ns]++
+	}
+	shape, ok, err := renamedQueryShape(parsedOp, rename)
+	if err != nil {
+		return err
+	}
+	if ok {
+		profile.shapes[fmt.Sprintf("%v %v %v", opType, ns, shape)]++
+	}
+	return nil
+}
+
+// queryShape returns the shape of the query of an op that has one: its
+// document with each value replaced by the name of its type, so that queries
+// differing only in their values have the same shape.
+func queryShape(op Op) (string, bool, error) {
+	return renamedQueryShape(op, nil)
+}
+
+// renamedQueryShape returns the shape of the query of an op as queryShape
+// does, with the collection a command runs on renamed by rename, if set.
+func renamedQueryShape(op Op, rename func(string) string) (string, bool, error) {
+	var query interface{}
+	var isCommand bool
+	switch castOp := op.(type) {
+	case *QueryOp:
+		query = castOp.Query
+		isCommand = strings.HasSuffix(castOp.Collection, "$cmd")
+	case *CommandOp:
+		query = castOp.CommandArgs
+		isCommand = true
+	case *UpdateOp:
+		query = castOp.Selector
+	case *DeleteOp:
+		query = castOp.Selector
+	default:
+		return "", false, nil
+	}
+	doc, err := toBSOND(query)
+	if err != nil {
+		return "", false, err
+	}
+	if !isCommand {
+		return shapeOf(doc), true, nil
+	}
+	if len(doc) == 0 || !shapedCommands[doc[0].Name] {
+		return "", false, nil
+	}
+	// keep the collection the command runs on, which is part of its shape
+	collection := doc[0].Value
+	if name, ok := collection.(string); ok && rename != nil {
+		collection = rename(name)
+	}
+	fields := []string{fmt.Sprintf("%v: %v", doc[0].Name, collection)}
+	for _, elem := range doc[1:] {
+		if !shapeIgnoredFields[elem.Name] {
+			fields = append(fields, fmt.Sprintf("%v: %v", elem.Name, shapeOf(elem.Value)))
+		}
+	}
+	return "{" + strings.Join(fields, ", ") + "}", true, nil
+}
+
+// shapeOf returns the shape of a bson value. Documents keep their field names,
+// arrays the distinct shapes of their elements, and other values become the
+// name of their type.
+func shapeOf(value interface{}) string {
+	switch v := value.(type) {
+	case bson.D:
+		fields := make([]string, 0, len(v))
+		for _, elem := range v {
+			fields = append(fields, fmt.Sprintf("%v: %v", elem.Name, shapeOf(elem.Value)))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case *bson.D, bson.Raw, *bson.Raw:
+		doc, err := toBSOND(v)
+		if err != nil {
+			return "document"
+		}
+		return shapeOf(doc)
+	case bson.M:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0, len(keys))
+		for _, key := range keys {
+			fields = append(fields, fmt.Sprintf("%v: %v", key, shapeOf(v[key])))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case []interface{}:
+		seen := map[string]bool{}
+		elems := []string{}
+		for _, elem := range v {
+			shape := shapeOf(elem)
+			if !seen[shape] {
+				seen[shape] = true
+				elems = append(elems, shape)
+			}
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case nil:
+		return "null"
+	case string, bson.Symbol:
+		return "string"
+	case int, int32, int64:
+		return "int"
+	case float64:
+		return "double"
+	case bool:
+		return "bool"
+	case time.Time:
+		return "date"
+	case bson.ObjectId:
+		return "objectId"
+	case bson.MongoTimestamp:
+		return "timestamp"
+	case []byte, bson.Binary:
+		return "binData"
+	case bson.RegEx:
+		return "regex"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// countDiff is the count of something in each of two tapes.
+type countDiff struct {
+	name   string
+	counts [2]int64
+}
+
+func (diff countDiff) String() string {
+	return fmt.Sprintf("%v: %v -> %v (%+d)", diff.name, diff.counts[0], diff.counts[1], diff.counts[1]-diff.counts[0])
+}
+
+// diffCounts returns the differing counts of the two maps, sorted by name, and
+// the number that are the same.
+func diffCounts(a, b map[string]int64) ([]countDiff, int) {
+	names := map[string]struct{}{}
+	for name := range a {
+		names[name] = struct{}{}
+	}
+	for name := range b {
+		names[name] = struct{}{}
+	}
+	diffs := []countDiff{}
+	same := 0
+	for _, name := range sortedKeys(names) {
+		if a[name] == b[name] {
+			same++
+			continue
+		}
+		diffs = append(diffs, countDiff{name, [2]int64{a[name], b[name]}})
+	}
+	return diffs, same
+}
+
+// onlyIn returns the sorted keys of a that aren't in b.
+func onlyIn(a, b map[string]int64) []string {
+	keys := []string{}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeTapeDiff prints the differences between the op mixes of two tapes.
+func writeTapeDiff(out io.Writer, names [2]string, profiles [2]*tapeProfile) error {
+	lines := []string{
+		fmt.Sprintf("--- %v", names[0]),
+		fmt.Sprintf("+++ %v", names[1]),
+		countDiff{"ops", [2]int64{profiles[0].total, profiles[1].total}}.String(),
+	}
+	if profiles[0].unparsed > 0 || profiles[1].unparsed > 0 {
+		lines = append(lines, countDiff{"unparsed ops", [2]int64{profiles[0].unparsed, profiles[1].unparsed}}.String())
+	}
+	sections := []struct {
+		title  string
+		counts [2]map[string]int64
+	}{
+		{"op types", [2]map[string]int64{profiles[0].ops, profiles[1].ops}},
+		{"namespaces", [2]map[string]int64{profiles[0].namespaces, profiles[1].namespaces}},
+	}
+	for _, section := range sections {
+		diffs, same := diffCounts(section.counts[0], section.counts[1])
+		lines = append(lines, fmt.Sprintf("%v: %v changed, %v unchanged", section.title, len(diffs), same))
+		for _, diff := range diffs {
+			lines = append(lines, "  "+diff.String())
+		}
+	}
+	for i, prefix := range []string{"-", "+"} {
+		only := onlyIn(profiles[i].shapes, profiles[1-i].shapes)
+		lines = append(lines, fmt.Sprintf("query shapes only in %v: %v", names[i], len(only)))
+		for _, shape := range only {
+			lines = append(lines, fmt.Sprintf("%v %v (%v ops)", prefix, shape, profiles[i].shapes[shape]))
+		}
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute runs the program for the 'diff' subcommand
+func (diff *DiffCommand) Execute(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("need the two playback files to compare")
+	}
+	diff.GlobalOpts.SetLogging()
+	if diff.NsMap != "" && !diff.AnonymizeNamespaces {
+		return fmt.Errorf("--nsMap can only be used with --anonymizeNamespaces")
+	}
+	var anonymizer *nsAnonymizer
+	if diff.AnonymizeNamespaces {
+		var err error
+		if anonymizer, err = newNsAnonymizer(diff.NsMap); err != nil {
+			return err
+		}
+	}
+
+	var names [2]string
+	var profiles [2]*tapeProfile
+	for i, filename := range args {
+		profile, err := readTapeProfile(filename, diff.Gzip, anonymizer)
+		if err != nil {
+			return err
+		}
+		names[i], profiles[i] = filename, profile
+	}
+	if err := writeTapeDiff(os.Stdout, names, profiles); err != nil {
+		return err
+	}
+	if anonymizer != nil {
+		return anonymizer.writeMap()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestShapeOf(t *testing.T) {
+	same := []bson.D{
+		{{"name", "alice"}, {"age", bson.D{{"$gt", 30}}}, {"tags", bson.D{{"$in", []interface{}{"a", "b"}}}}},
+		{{"name", "bob"}, {"age", bson.D{{"$gt", int64(5)}}}, {"tags", bson.D{{"$in", []interface{}{"c"}}}}},
+	}
+	if shapeOf(same[0]) != shapeOf(same[1]) {
+		t.Errorf("expected queries differing in values to have the same shape, got %v and %v",
+			shapeOf(same[0]), shapeOf(same[1]))
+	}
+	expected := "{name: string, age: {$gt: int}, tags: {$in: [string]}}"
+	if shapeOf(same[0]) != expected {
+		t.Errorf("expected shape %v, got %v", expected, shapeOf(same[0]))
+	}
+
+	different := bson.D{{"age", bson.D{{"$gt", 30}}}, {"name", "alice"}}
+	if shapeOf(different) == shapeOf(same[0]) {
+		t.Errorf("expected queries with different fields to have different shapes")
+	}
+}
+
+func TestAnonymizedTapeProfile(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateCommandFind(bson.D{{"name", "alice"}}, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	anonymizer, err := newNsAnonymizer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := newTapeProfile()
+	profile.anonymizer = anonymizer
+	for _, op := range generatedOps(generator) {
+		if err := profile.observe(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for shape := range profile.shapes {
+		if strings.Contains(shape, testDB) || strings.Contains(shape, testCollection) {
+			t.Errorf("expected the namespace and collection in the shape to be anonymized, got %v", shape)
+		}
+	}
+	for ns := range profile.namespaces {
+		if strings.Contains(ns, testDB) {
+			t.Errorf("expected the namespace to be anonymized, got %v", ns)
+		}
+	}
+}
+
+func TestTapeDiff(t *testing.T) {
+	profile := func(generate func(*recordedOpGenerator) error) *tapeProfile {
+		generator := newRecordedOpGenerator()
+		if err := generate(generator); err != nil {
+			t.Fatalf("error generating ops: %v", err)
+		}
+		profile := newTapeProfile()
+		for _, op := range generatedOps(generator) {
+			if err := profile.observe(op); err != nil {
+				t.Fatalf("error observing op: %v", err)
+			}
+		}
+		return profile
+	}
+
+	before := profile(func(generator *recordedOpGenerator) error {
+		for i := 0; i < 3; i++ {
+			if err := generator.generateCommandFind(bson.D{{"name", "alice"}}, 0, int32(i)); err != nil {
+				return err
+			}
+		}
+		return generator.generateInsert([]interface{}{bson.D{{"_id", 1}}})
+	})
+	after := profile(func(generator *recordedOpGenerator) error {
+		for i := 0; i < 3; i++ {
+			if err := generator.generateCommandFind(bson.D{{"name", "bob"}}, 0, int32(i)); err != nil {
+				return err
+			}
+		}
+		if err := generator.generateCommandFind(bson.D{{"email", "bob@example.com"}}, 0, 3); err != nil {
+			return err
+		}
+		return generator.generateInsert([]interface{}{bson.D{{"_id", 1}}})
+	})
+
+	out := &bytes.Buffer{}
+	if err := writeTapeDiff(out, [2]string{"before", "after"}, [2]*tapeProfile{before, after}); err != nil {
+		t.Fatalf("error writing diff: %v", err)
+	}
+	expected := []string{
+		"ops: 4 -> 5 (+1)",
+		"op types: 1 changed, 1 unchanged",
+		"  op_command find: 3 -> 4 (+1)",
+		"query shapes only in before: 0",
+		"query shapes only in after: 1",
+		"+ op_command find mongoreplay {find: test, filter: {email: string}} (1 ops)",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected line %q in diff:\n%v", line, out.String())
+		}
+	}
+}
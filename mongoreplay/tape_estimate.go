@@ -0,0 +1,226 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// EstimateCommand stores settings for the mongoreplay 'estimate' subcommand
+type EstimateCommand struct {
+	GlobalOpts *Options      `no-flag:"true"`
+	Gzip       bool          `long:"gzip" description:"decompress gzipped input"`
+	Speed      float64       `long:"speed" description:"playback speed multiplier to estimate the throughput needed for, as for play" default:"1.0"`
+	Window     time.Duration `long:"window" value-name:"<duration>" description:"length of the window over which the peak ops per second is measured" default:"1s"`
+}
+
+// tapeEstimate holds what is needed from a pass over a tape to estimate the
+// resources needed to replay it at its recorded pace.
+type tapeEstimate struct {
+	// seen holds the time each played op was seen
+	seen []time.Time
+
+	// inFlight holds the start and end of each op that was in flight, from
+	// when it was seen to when its reply was seen, if any was
+	inFlight []timeEvent
+
+	// requests holds when the requests still waiting for a reply were seen
+	requests map[opKey]time.Time
+
+	// connections holds when each connection was first and last seen
+	connections map[int64]*timeSpan
+}
+
+// timeSpan is the time from a start to an end.
+type timeSpan struct {
+	start, end time.Time
+}
+
+// timeEvent is the start or end of something that lasts a while, such as an
+// op in flight.
+type timeEvent struct {
+	at    time.Time
+	delta int
+}
+
+// timeEvents sorts events in time order, with starts before ends at the same
+// time so that what starts and ends at once is counted.
+type timeEvents []timeEvent
+
+func (e timeEvents) Len() int      { return len(e) }
+func (e timeEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e timeEvents) Less(i, j int) bool {
+	if !e[i].at.Equal(e[j].at) {
+		return e[i].at.Before(e[j].at)
+	}
+	return e[i].delta > e[j].delta
+}
+
+// times sorts times in increasing order.
+type times []time.Time
+
+func (t times) Len() int           { return len(t) }
+func (t times) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t times) Less(i, j int) bool { return t[i].Before(t[j]) }
+
+func newTapeEstimate() *tapeEstimate {
+	return &tapeEstimate{
+		requests:    map[opKey]time.Time{},
+		connections: map[int64]*timeSpan{},
+	}
+}
+
+// observe adds an op of the tape to the estimate.
+func (estimate *tapeEstimate) observe(op *RecordedOp) {
+	if op.Seen == nil {
+		return
+	}
+	seen := op.Seen.Time
+	span, ok := estimate.connections[op.SeenConnectionNum]
+	if !ok {
+		span = &timeSpan{start: seen, end: seen}
+		estimate.connections[op.SeenConnectionNum] = span
+	} else if seen.After(span.end) {
+		span.end = seen
+	}
+	if op.EOF {
+		return
+	}
+	if isReplyOpCode(op.RawOp) {
+		key := replyKey(op)
+		if start, ok := estimate.requests[key]; ok {
+			delete(estimate.requests, key)
+			estimate.addInFlight(start, seen)
+		}
+		return
+	}
+	estimate.seen = append(estimate.seen, seen)
+	estimate.requests[requestKey(op)] = seen
+}
+
+// addInFlight adds an op that was in flight from start to end.
+func (estimate *tapeEstimate) addInFlight(start, end time.Time) {
+	estimate.inFlight = append(estimate.inFlight, timeEvent{start, 1}, timeEvent{end, -1})
+}
+
+// finish counts the requests that never got a reply, which are in flight
+// only for the moment they are seen.
+func (estimate *tapeEstimate) finish() {
+	for _, start := range estimate.requests {
+		estimate.addInFlight(start, start)
+	}
+	estimate.requests = map[opKey]time.Time{}
+}
+
+// peakInFlight returns the most ops that were in flight at once.
+func (estimate *tapeEstimate) peakInFlight() int {
+	estimate.finish()
+	peak, _ := peakConcurrency(estimate.inFlight)
+	return peak
+}
+
+// peakConcurrency returns the most things that were underway at once, given
+// the events of their starts and ends, and the span over which that peak was
+// first held.
+func peakConcurrency(events []timeEvent) (int, timeSpan) {
+	sort.Sort(timeEvents(events))
+	var current, peak int
+	var peakSpan timeSpan
+	for i, event := range events {
+		current += event.delta
+		if current > peak {
+			peak = current
+			peakSpan = timeSpan{start: event.at, end: event.at}
+			if i+1 < len(events) {
+				peakSpan.end = events[i+1].at
+			}
+		}
+	}
+	return peak, peakSpan
+}
+
+// peakRate returns the most times that fall within a window of the given
+// length, and the window in which they first do.
+func peakRate(seen []time.Time, window time.Duration) (int, timeSpan) {
+	sort.Sort(times(seen))
+	var peak int
+	var peakSpan timeSpan
+	end := 0
+	for start := range seen {
+		windowEnd := seen[start].Add(window)
+		for end < len(seen) && seen[end].Before(windowEnd) {
+			end++
+		}
+		if end-start > peak {
+			peak = end - start
+			peakSpan = timeSpan{start: seen[start], end: windowEnd}
+		}
+	}
+	return peak, peakSpan
+}
+
+// formatSpan formats a span of the capture in UTC.
+func formatSpan(span timeSpan) string {
+	return fmt.Sprintf("from %v to %v", span.start.UTC().Format(time.RFC3339Nano), span.end.UTC().Format(time.RFC3339Nano))
+}
+
+// write prints the estimate: the peak rate of ops over the window, scaled to
+// the given speed, the peak number of ops in flight and the peak number of
+// open connections, each with when they were reached in the capture.
+func (estimate *tapeEstimate) write(out io.Writer, speed float64, window time.Duration) error {
+	estimate.finish()
+
+	connectionEvents := make([]timeEvent, 0, 2*len(estimate.connections))
+	for _, span := range estimate.connections {
+		connectionEvents = append(connectionEvents, timeEvent{span.start, 1}, timeEvent{span.end, -1})
+	}
+	peakOps, opsSpan := peakRate(estimate.seen, window)
+	peakInFlight, inFlightSpan := peakConcurrency(estimate.inFlight)
+	peakConnections, connectionsSpan := peakConcurrency(connectionEvents)
+	perSecond := float64(peakOps) / window.Seconds()
+
+	lines := []string{fmt.Sprintf("ops: %v", len(estimate.seen))}
+	if peakOps > 0 {
+		lines = append(lines,
+			fmt.Sprintf("peak ops/sec: %.1f (%v ops %v)", perSecond, peakOps, formatSpan(opsSpan)),
+			fmt.Sprintf("peak ops/sec to replay at %vx speed: %.1f", speed, perSecond*speed),
+			fmt.Sprintf("peak ops in flight: %v (%v)", peakInFlight, formatSpan(inFlightSpan)),
+			fmt.Sprintf("peak open connections: %v (%v)", peakConnections, formatSpan(connectionsSpan)),
+		)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Execute runs the program for the 'estimate' subcommand
+func (estimate *EstimateCommand) Execute(args []string) error {
+	switch {
+	case len(args) != 1:
+		return fmt.Errorf("need the playback file to estimate")
+	case estimate.Speed <= 0:
+		return fmt.Errorf("Invalid setting for --speed: '%v'", estimate.Speed)
+	case estimate.Window <= 0:
+		return fmt.Errorf("Invalid setting for --window: '%v', value must be positive", estimate.Window)
+	}
+	estimate.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(args[0], estimate.Gzip)
+	if err != nil {
+		return err
+	}
+	opChan, errChan := NewOpChanFromFile(reader, 1)
+	tape := newTapeEstimate()
+	for op := range opChan {
+		tape.observe(op)
+	}
+	if err := <-errChan; err != io.EOF {
+		return fmt.Errorf("error reading %v: %v", args[0], err)
+	}
+	return tape.write(os.Stdout, estimate.Speed, estimate.Window)
+}
@@ -0,0 +1,73 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTapeEstimate(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) *PreciseTime {
+		return &PreciseTime{start.Add(time.Duration(ms) * time.Millisecond)}
+	}
+	request := func(ms int, connection int64, requestID int32) *RecordedOp {
+		op := &RecordedOp{Seen: at(ms), SeenConnectionNum: connection, SrcEndpoint: "client", DstEndpoint: "server"}
+		op.SrcEndpoint += string('0' + byte(connection))
+		op.Header.OpCode = OpCodeQuery
+		op.Header.RequestID = requestID
+		return op
+	}
+	reply := func(ms int, to *RecordedOp) *RecordedOp {
+		op := &RecordedOp{Seen: at(ms), SeenConnectionNum: to.SeenConnectionNum, SrcEndpoint: to.DstEndpoint, DstEndpoint: to.SrcEndpoint}
+		op.Header.OpCode = OpCodeReply
+		op.Header.ResponseTo = to.Header.RequestID
+		return op
+	}
+
+	// three connections: the first sends a slow op and a fast one, the second
+	// a burst of four ops in 100ms while the slow op is in flight, and the
+	// third an op that gets no reply, after the first has gone
+	slow := request(0, 1, 1)
+	fast := request(2000, 1, 2)
+	burst := []*RecordedOp{request(500, 2, 1), request(530, 2, 2), request(560, 2, 3), request(600, 2, 4)}
+	ops := []*RecordedOp{slow, burst[0], reply(510, burst[0]), burst[1], burst[2], reply(570, burst[2]), burst[3],
+		reply(580, burst[1]), reply(650, burst[3]), reply(1000, slow), fast, reply(2010, fast),
+		{Seen: at(2050), SeenConnectionNum: 1, EOF: true}, request(3000, 3, 1)}
+
+	estimate := newTapeEstimate()
+	for _, op := range ops {
+		estimate.observe(op)
+	}
+	var out bytes.Buffer
+	if err := estimate.write(&out, 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"ops: 7",
+		"peak ops/sec: 5.0 (5 ops from 2017-01-01T00:00:00Z to 2017-01-01T00:00:01Z)",
+		"peak ops/sec to replay at 2x speed: 10.0",
+		"peak ops in flight: 3 (from 2017-01-01T00:00:00.56Z to 2017-01-01T00:00:00.57Z)",
+		"peak open connections: 2 (from 2017-01-01T00:00:00.5Z to 2017-01-01T00:00:00.65Z)",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in estimate:\n%v", line, out.String())
+		}
+	}
+}
+
+func TestPeakRate(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	var seen []time.Time
+	for _, ms := range []int{900, 0, 100, 1000, 1100, 1200, 1300, 2500} {
+		seen = append(seen, start.Add(time.Duration(ms)*time.Millisecond))
+	}
+	peak, span := peakRate(seen, time.Second)
+	if peak != 5 || !span.start.Equal(start.Add(900*time.Millisecond)) {
+		t.Errorf("expected a peak of 5 ops from 900ms, got %v from %v", peak, span.start)
+	}
+	if peak, _ := peakRate(nil, time.Second); peak != 0 {
+		t.Errorf("expected no peak without ops, got %v", peak)
+	}
+}
@@ -0,0 +1,124 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// MergeCommand stores settings for the mongoreplay 'merge' subcommand
+type MergeCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input, and compress the merged playback file with Gzip"`
+	PlaybackFile string   `short:"p" long:"playback-file" description:"path to the playback file to write the merged ops to" required:"yes"`
+}
+
+// mergeSource is a playback file being merged, along with the next of its
+// ops to be written.
+type mergeSource struct {
+	name   string
+	reader *PlaybackFileReader
+	next   *RecordedOp
+}
+
+// advance reads the next op of the playback file, leaving next nil once the
+// file has been read through.
+func (source *mergeSource) advance() error {
+	op, err := source.reader.NextRecordedOp()
+	switch {
+	case err == io.EOF:
+		source.next = nil
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading %v: %v", source.name, err)
+	}
+	source.next = op
+	return nil
+}
+
+// seen returns the time the next op of the playback file was seen.
+func (source *mergeSource) seen() time.Time {
+	if source.next.Seen == nil {
+		return time.Time{}
+	}
+	return source.next.Seen.Time
+}
+
+// mergePlaybackFiles writes the ops of the playback files to the writer in
+// the order they were seen in, as for the shards of a recording made with
+// --numWriters. The ops of each file are kept in the order they were written
+// in, so those of a connection, which are all in one shard, stay in order.
+// Ops seen at the same time are taken from the earlier file first.
+func mergePlaybackFiles(names []string, readers []*PlaybackFileReader, writer *PlaybackWriter) error {
+	sources := make([]*mergeSource, len(readers))
+	for i, reader := range readers {
+		sources[i] = &mergeSource{name: names[i], reader: reader}
+		if err := sources[i].advance(); err != nil {
+			return err
+		}
+	}
+	for {
+		var earliest *mergeSource
+		for _, source := range sources {
+			if source.next != nil && (earliest == nil || source.seen().Before(earliest.seen())) {
+				earliest = source
+			}
+		}
+		if earliest == nil {
+			return nil
+		}
+		bsonBytes, err := bson.Marshal(earliest.next)
+		if err != nil {
+			return fmt.Errorf("error marshaling message: %v", err)
+		}
+		if err := writer.writeOp(earliest.next, bsonBytes); err != nil {
+			return fmt.Errorf("error writing message: %v", err)
+		}
+		if err := earliest.advance(); err != nil {
+			return err
+		}
+	}
+}
+
+// Execute runs the program for the 'merge' subcommand
+func (merge *MergeCommand) Execute(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("need at least two playback files to merge")
+	}
+	for _, name := range args {
+		if name == merge.PlaybackFile {
+			return fmt.Errorf("can't merge %v into itself", name)
+		}
+	}
+	merge.GlobalOpts.SetLogging()
+
+	readers := make([]*PlaybackFileReader, 0, len(args))
+	defer func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+	for _, name := range args {
+		reader, err := NewPlaybackFileReader(name, merge.Gzip)
+		if err != nil {
+			return fmt.Errorf("error opening playback file %v: %v", name, err)
+		}
+		readers = append(readers, reader)
+	}
+	writer, err := NewPlaybackWriter(merge.PlaybackFile, merge.Gzip)
+	if err != nil {
+		return err
+	}
+	err = mergePlaybackFiles(args, readers, writer)
+	if closeErr := writer.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing playback file %v: %v", merge.PlaybackFile, closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "%v ops from %v playback files merged into %v", writer.opCount, len(args),
+		merge.PlaybackFile)
+	return nil
+}
@@ -0,0 +1,150 @@
+package mongoreplay
+
+import (
+	"io"
+	"time"
+)
+
+// TapeOp is an op read from a playback file by a TapeReader, decoded from the
+// wire message it was recorded as, along with what is known of it from the
+// recording.
+type TapeOp struct {
+	// Recorded is the op as it is stored in the playback file, holding its
+	// wire message and the metadata recorded with it.
+	Recorded *RecordedOp
+
+	// Op is the op decoded from the wire message, or nil for the ops that
+	// mongoreplay doesn't decode and for the end of a connection.
+	Op Op
+
+	// Seen is the time the op was seen in the capture.
+	Seen time.Time
+
+	// ConnectionID is the number of the connection the op was recorded on,
+	// numbered in the order the connections were seen.
+	ConnectionID int64
+
+	// OpType is the type of the op, as given in the stats of a playback, such
+	// as "query", "insert", "command", "op_msg" or "reply", or the name of
+	// its wire protocol opcode for ops that aren't decoded. It is empty for
+	// the end of a connection.
+	OpType string
+
+	// Namespace is the namespace the op runs against, or the database of a
+	// command, and is empty when not applicable.
+	Namespace string
+
+	// Command is the name of the command of a command op, including an
+	// OP_MSG request, and is empty for other ops.
+	Command string
+
+	// EOF is set on the op marking the end of its connection, which holds no
+	// wire message.
+	EOF bool
+}
+
+// TapeReader reads the ops of a playback file in the order they were recorded,
+// decoding each, for tools that analyze a tape without playing it:
+//
+//	reader, err := OpenTape("playback.bson", false)
+//	if err != nil {
+//		return err
+//	}
+//	defer reader.Close()
+//	for reader.Next() {
+//		op := reader.Op()
+//		...
+//	}
+//	return reader.Err()
+//
+// A TapeReader isn't safe for concurrent use.
+type TapeReader struct {
+	file *PlaybackFileReader
+	op   *TapeOp
+	err  error
+}
+
+// OpenTape opens a playback file to read its ops with a TapeReader, which must
+// be closed once done. As with play, a series of playback files recorded with
+// --maxOpsPerFile or --maxBytesPerFile is read in order from its base name.
+func OpenTape(filename string, gzip bool) (*TapeReader, error) {
+	file, err := NewPlaybackFileReader(filename, gzip)
+	if err != nil {
+		return nil, err
+	}
+	return NewTapeReader(file), nil
+}
+
+// NewTapeReader returns a TapeReader reading the ops of an open playback file
+// from where it is, which it closes when closed.
+func NewTapeReader(file *PlaybackFileReader) *TapeReader {
+	return &TapeReader{file: file}
+}
+
+// Next reads and decodes the next op of the tape, returning false once there
+// are none left or reading fails, as reported by Err. An op whose wire message
+// can't be decoded is an error.
+func (reader *TapeReader) Next() bool {
+	reader.op = nil
+	if reader.err != nil {
+		return false
+	}
+	recordedOp, err := reader.file.NextRecordedOp()
+	if err != nil {
+		if err != io.EOF {
+			reader.err = err
+		}
+		return false
+	}
+	op, err := decodeTapeOp(recordedOp)
+	if err != nil {
+		reader.err = err
+		return false
+	}
+	reader.op = op
+	return true
+}
+
+// Op returns the op read by the last call to Next, or nil if there is none.
+func (reader *TapeReader) Op() *TapeOp {
+	return reader.op
+}
+
+// Err returns the error that stopped the reading, or nil if the tape was read
+// to its end.
+func (reader *TapeReader) Err() error {
+	return reader.err
+}
+
+// Close closes the playback file.
+func (reader *TapeReader) Close() error {
+	return reader.file.Close()
+}
+
+// decodeTapeOp decodes a recorded op, leaving it as it was read.
+func decodeTapeOp(recordedOp *RecordedOp) (*TapeOp, error) {
+	op := &TapeOp{
+		Recorded:     recordedOp,
+		Seen:         recordedOp.Seen.Time,
+		ConnectionID: recordedOp.SeenConnectionNum,
+		EOF:          recordedOp.EOF,
+	}
+	if recordedOp.EOF {
+		return op, nil
+	}
+	// parsing decompresses a compressed op in place
+	rawOp := recordedOp.RawOp
+	parsedOp, err := rawOp.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if parsedOp != nil {
+		meta := parsedOp.Meta()
+		op.Op = parsedOp
+		op.OpType, op.Namespace, op.Command = meta.Op, meta.Ns, meta.Command
+		return op, nil
+	}
+
+	op.OpType = rawOp.Header.OpCode.String()
+	return op, nil
+}
@@ -0,0 +1,67 @@
+package mongoreplay
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTapeReader(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	query, err := generator.fetchRecordedOpsFromConn(&mgo.QueryOp{
+		Collection: "mongoreplay.test",
+		Query:      bson.D{{"_id", 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.Seen = &PreciseTime{time.Unix(100, 0)}
+	query.SeenConnectionNum = 3
+	msg := msgOp(t, bson.D{{"insert", "test"}, {"$db", "mongoreplay"}}, bson.D{{"_id", 1}})
+	msg.Seen = &PreciseTime{time.Unix(101, 0)}
+	eof := &RecordedOp{Seen: &PreciseTime{time.Unix(102, 0)}, EOF: true, SeenConnectionNum: 3}
+
+	var buf bytes.Buffer
+	for _, op := range []*RecordedOp{query, msg, eof} {
+		bsonBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(bsonBytes)
+	}
+	reader := NewTapeReader(&PlaybackFileReader{bytes.NewReader(buf.Bytes())})
+	defer reader.Close()
+
+	ops := []*TapeOp{}
+	for reader.Next() {
+		ops = append(ops, reader.Op())
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ops) != 3 {
+		t.Fatalf("expected 3 ops, got %v", len(ops))
+	}
+	if _, ok := ops[0].Op.(*QueryOp); !ok || ops[0].OpType != "query" || ops[0].Namespace != "mongoreplay.test" ||
+		ops[0].ConnectionID != 3 || !ops[0].Seen.Equal(time.Unix(100, 0)) {
+		t.Errorf("wrong query op: %#v", ops[0])
+	}
+	if _, ok := ops[1].Op.(*MsgOp); !ok || ops[1].OpType != "op_msg" || ops[1].Command != "insert" ||
+		ops[1].Namespace != "mongoreplay" {
+		t.Errorf("wrong OP_MSG op: %#v", ops[1])
+	}
+	if !ops[2].EOF || ops[2].OpType != "" {
+		t.Errorf("wrong end of connection: %#v", ops[2])
+	}
+	if reader.Next() || reader.Op() != nil {
+		t.Errorf("expected no ops past the end of the tape")
+	}
+
+	reader = NewTapeReader(&PlaybackFileReader{bytes.NewReader([]byte{1, 2, 3, 4, 5})})
+	if reader.Next() || reader.Err() == nil {
+		t.Errorf("expected an error reading a corrupt tape")
+	}
+}
@@ -0,0 +1,268 @@
+package mongoreplay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/mongodb/mongo-tools/common/options"
+	"github.com/mongodb/mongo-tools/common/password"
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// x509Mechanism is the authentication mechanism that uses the client
+// certificate given with --sslPEMKeyFile.
+const x509Mechanism = "MONGODB-X509"
+
+// TargetAuth holds the credentials to authenticate to the target with, as an
+// alternative to credentials in a --host URI, which would show in process
+// listings.
+type TargetAuth struct {
+	Username     string `short:"u" long:"username" value-name:"<username>" description:"username for authenticating to the target (defaults to the subject of the --sslPEMKeyFile certificate with MONGODB-X509)"`
+	Password     string `long:"password" value-name:"<password>" description:"password for authenticating to the target; prompted for if --username is given without it or --passwordFile"`
+	PasswordFile string `long:"passwordFile" value-name:"<filename>" description:"read the password for authenticating to the target from the first line of this file"`
+	Source       string `long:"authenticationDatabase" value-name:"<database-name>" description:"database that holds the user's credentials"`
+	Mechanism    string `long:"authenticationMechanism" value-name:"<mechanism>" description:"authentication mechanism to use: SCRAM-SHA-1, MONGODB-CR, PLAIN or MONGODB-X509"`
+}
+
+// validate checks that the credentials are complete and consistent with the
+// SSL options, without reading or prompting for a password.
+func (auth *TargetAuth) validate(ssl options.SSL) error {
+	switch auth.Mechanism {
+	case "", "SCRAM-SHA-1", "MONGODB-CR", "PLAIN":
+	case x509Mechanism:
+		switch {
+		case !ssl.UseSSL || ssl.SSLPEMKeyFile == "":
+			return fmt.Errorf("--authenticationMechanism %v requires --ssl and --sslPEMKeyFile", x509Mechanism)
+		case auth.Password != "" || auth.PasswordFile != "":
+			return fmt.Errorf("--authenticationMechanism %v doesn't use a password", x509Mechanism)
+		}
+		return nil
+	default:
+		return fmt.Errorf("--authenticationMechanism %v is not supported by mongoreplay", auth.Mechanism)
+	}
+	switch {
+	case auth.Username == "" && (auth.Password != "" || auth.PasswordFile != "" ||
+		auth.Source != "" || auth.Mechanism != ""):
+		return fmt.Errorf("authenticating to the target requires --username")
+	case auth.Password != "" && auth.PasswordFile != "":
+		return fmt.Errorf("can only specify one of --password and --passwordFile")
+	}
+	return nil
+}
+
+// credential returns the credential to authenticate to the target with, or
+// nil if none was given, reading the password from the password file or
+// prompting for it if needed.
+func (auth *TargetAuth) credential(ssl options.SSL) (*mgo.Credential, error) {
+	if err := auth.validate(ssl); err != nil {
+		return nil, err
+	}
+	cred := &mgo.Credential{
+		Username:  auth.Username,
+		Password:  auth.Password,
+		Source:    auth.Source,
+		Mechanism: auth.Mechanism,
+	}
+	switch {
+	case auth.Mechanism == x509Mechanism:
+		if cred.Username == "" {
+			subject, err := certificateSubject(ssl.SSLPEMKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			cred.Username = subject
+		}
+		if cred.Source == "" {
+			cred.Source = "$external"
+		}
+	case auth.Username == "":
+		return nil, nil
+	case auth.PasswordFile != "":
+		contents, err := ioutil.ReadFile(auth.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading --passwordFile: %v", err)
+		}
+		cred.Password = strings.SplitN(string(contents), "\n", 2)[0]
+		cred.Password = strings.TrimSuffix(cred.Password, "\r")
+	case auth.Password == "":
+		cred.Password = password.Prompt()
+	}
+	return cred, nil
+}
+
+// certificateSubject returns the subject of the client certificate in the PEM
+// file, which is the user name for MONGODB-X509 authentication.
+func certificateSubject(pemFile string) (string, error) {
+	pem, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading --sslPEMKeyFile: %v", err)
+	}
+	cert, err := tls.X509KeyPair(pem, pem)
+	if err != nil {
+		return "", fmt.Errorf("error loading --sslPEMKeyFile: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", fmt.Errorf("error parsing --sslPEMKeyFile certificate: %v", err)
+	}
+	return leaf.Subject.String(), nil
+}
+
+// defaultDialTimeout is the time allowed to connect to the target when no
+// timeout is given, as with mgo.Dial.
+const defaultDialTimeout = 10 * time.Second
+
+// targetURL builds a mongodb:// URI from a --host and --port, or returns the
+// host itself if it's already a URI.
+func targetURL(host, port string) (string, error) {
+	if strings.HasPrefix(host, "mongodb://") {
+		if port != "" {
+			return "", fmt.Errorf("--port can't be used with a mongodb:// URI in --host")
+		}
+		return host, nil
+	}
+	addrs := util.CreateConnectionAddrs(host, port)
+	url := "mongodb://" + strings.Join(addrs, ",")
+	if _, setName := util.ParseConnectionString(host); setName != "" {
+		url += "/?replicaSet=" + setName
+	}
+	return url, nil
+}
+
+// newTLSConfig returns the TLS configuration described by the SSL options, or
+// nil if SSL isn't enabled.
+func newTLSConfig(ssl options.SSL) (*tls.Config, error) {
+	if !ssl.UseSSL {
+		return nil, nil
+	}
+	switch {
+	case ssl.SSLCRLFile != "":
+		return nil, fmt.Errorf("--sslCRLFile is not supported by mongoreplay")
+	case ssl.SSLFipsMode:
+		return nil, fmt.Errorf("--sslFIPSMode is not supported by mongoreplay")
+	case ssl.SSLPEMKeyPassword != "":
+		return nil, fmt.Errorf("--sslPEMKeyPassword is not supported by mongoreplay")
+	}
+
+	config := &tls.Config{}
+	if ssl.SSLCAFile != "" {
+		pem, err := ioutil.ReadFile(ssl.SSLCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading --sslCAFile: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in --sslCAFile '%v'", ssl.SSLCAFile)
+		}
+	}
+	if ssl.SSLPEMKeyFile != "" {
+		pem, err := ioutil.ReadFile(ssl.SSLPEMKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading --sslPEMKeyFile: %v", err)
+		}
+		cert, err := tls.X509KeyPair(pem, pem)
+		if err != nil {
+			return nil, fmt.Errorf("error loading --sslPEMKeyFile: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case ssl.SSLAllowInvalidCert:
+		config.InsecureSkipVerify = true
+	case ssl.SSLAllowInvalidHost:
+		// verify the certificate chain ourselves, without the host name
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	}
+	return config, nil
+}
+
+// verifyChain verifies that the certificates presented by a server chain up to
+// the given roots, or to the system roots if nil.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server presented no certificates")
+	}
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+// dial connects to the target at url, with the same timeouts as mgo.Dial
+// unless a dial timeout is set, over SSL if a TLS configuration is set,
+// authenticating with the credential if one is set, and asking for the wire
+// compressors if any are set.
+func (context *ExecutionContext) dial(url string) (*mgo.Session, error) {
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if cred := context.Credential; cred != nil {
+		if info.Username != "" {
+			return nil, fmt.Errorf("credentials can't be given both in the --host URI and with --username")
+		}
+		info.Username, info.Password = cred.Username, cred.Password
+		info.Source, info.Mechanism = cred.Source, cred.Mechanism
+	}
+	info.Timeout = context.DialTimeout
+	if info.Timeout == 0 {
+		info.Timeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: info.Timeout}
+	if tlsConfig := context.TLSConfig; tlsConfig != nil {
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), tlsConfig)
+		}
+	}
+	dial := info.DialServer
+	if dial == nil {
+		dial = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return dialer.Dial("tcp", addr.String())
+		}
+	}
+	// OP_MSGs are played through a msgConn, which sends them compressed
+	// through a compressingConn if asked to
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(context.Compressors) > 0 {
+			conn = newCompressingConn(conn, context.Compressors, context.Negotiated)
+		}
+		return newMsgConn(conn), nil
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	socketTimeout := context.SocketTimeout
+	if socketTimeout == 0 {
+		socketTimeout = 1 * time.Minute
+	}
+	session.SetSyncTimeout(1 * time.Minute)
+	session.SetSocketTimeout(socketTimeout)
+	return session, nil
+}
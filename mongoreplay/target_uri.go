@@ -0,0 +1,151 @@
+package mongoreplay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// driverURIOptions are the connection string options of a --host URI that
+// the driver reads itself when dialing the target.
+var driverURIOptions = map[string]bool{
+	"authSource":        true,
+	"authMechanism":     true,
+	"gssapiServiceName": true,
+	"replicaSet":        true,
+	"maxPoolSize":       true,
+	"connect":           true,
+}
+
+// unhonoredURIOptions are standard connection string options that can't be
+// honored by playback, with the reason why.
+var unhonoredURIOptions = map[string]string{
+	"w":                    "ops are played with the write concern they were recorded with",
+	"journal":              "ops are played with the write concern they were recorded with",
+	"wtimeoutMS":           "ops are played with the write concern they were recorded with",
+	"readConcernLevel":     "ops are played with the read concern they were recorded with",
+	"retryWrites":          "mongoreplay plays each op once, as it was recorded",
+	"retryReads":           "mongoreplay plays each op once, as it was recorded",
+	"zlibCompressionLevel": "mongoreplay compresses with zlib at its default level",
+	"appName":              "ops are played with the handshakes they were recorded with",
+	"minPoolSize":          "each recorded connection is played on a connection of its own",
+	"maxIdleTimeMS":        "each recorded connection is played on a connection of its own",
+}
+
+// targetURIOptions holds the connection string options of a --host URI that
+// mongoreplay honors itself, rather than leaving them to the driver:
+// connectTimeoutMS and socketTimeoutMS, readPreference and
+// readPreferenceTags, which are played as with --readPreference and
+// --readPreferenceTags, ssl or tls, and compressors, which are asked for as
+// with --compressors.
+type targetURIOptions struct {
+	ConnectTimeout     time.Duration
+	SocketTimeout      time.Duration
+	ReadPreference     string
+	ReadPreferenceTags []string
+	SSL                bool
+	Compressors        []string
+}
+
+// parseTargetURI splits the connection string options of a mongodb:// URI
+// between those the driver reads, which are left in the returned URI, and
+// those honored by mongoreplay, which are returned. Options that can't be
+// honored and unknown options are left out, with a warning for each.
+func parseTargetURI(uri string) (string, *targetURIOptions, []string, error) {
+	opts := &targetURIOptions{}
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri, opts, nil, nil
+	}
+	base, query := uri[:i], uri[i+1:]
+
+	kept := []string{}
+	warnings := []string{}
+	for _, pair := range strings.FieldsFunc(query, func(r rune) bool { return r == '&' || r == ';' }) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, nil, fmt.Errorf("connection string option must be name=value: %v", pair)
+		}
+		name := kv[0]
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("invalid value for connection string option %v: %v", name, err)
+		}
+		switch name {
+		case "connectTimeoutMS", "socketTimeoutMS":
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 0 {
+				return "", nil, nil, fmt.Errorf("connection string option %v must be a number of milliseconds, got '%v'", name, value)
+			}
+			if name == "connectTimeoutMS" {
+				opts.ConnectTimeout = time.Duration(ms) * time.Millisecond
+			} else {
+				opts.SocketTimeout = time.Duration(ms) * time.Millisecond
+			}
+		case "readPreference":
+			opts.ReadPreference = value
+		case "readPreferenceTags":
+			opts.ReadPreferenceTags = append(opts.ReadPreferenceTags, value)
+		case "ssl", "tls":
+			ssl, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("connection string option %v must be true or false, got '%v'", name, value)
+			}
+			opts.SSL = ssl
+		case "compressors":
+			var unsupported []string
+			if opts.Compressors, unsupported, err = ParseCompressors([]string{value}); err != nil {
+				return "", nil, nil, fmt.Errorf("invalid value for connection string option %v: %v", name, err)
+			}
+			if len(unsupported) > 0 {
+				warnings = append(warnings, fmt.Sprintf("connection string option %v: %v is ignored, as mongoreplay "+
+					"can't compress with it", name, strings.Join(unsupported, ", ")))
+			}
+		default:
+			if driverURIOptions[name] {
+				kept = append(kept, pair)
+			} else if reason, ok := unhonoredURIOptions[name]; ok {
+				warnings = append(warnings, fmt.Sprintf("connection string option %v is ignored: %v", name, reason))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("unknown connection string option %v is ignored", name))
+			}
+		}
+	}
+	if len(opts.ReadPreferenceTags) > 0 && opts.ReadPreference == "" {
+		return "", nil, nil, fmt.Errorf("connection string option readPreferenceTags needs a readPreference")
+	}
+	if _, err := ParseReadPreference(opts.ReadPreference, opts.ReadPreferenceTags); err != nil {
+		return "", nil, nil, err
+	}
+	if len(kept) > 0 {
+		base += "?" + strings.Join(kept, "&")
+	}
+	return base, opts, warnings, nil
+}
+
+// applyURIOptions sets up the playback with the options of the --host URI
+// that mongoreplay honors, which take precedence over --dialTimeout and
+// --compressors.
+func (context *ExecutionContext) applyURIOptions(opts *targetURIOptions) error {
+	if opts.ConnectTimeout > 0 {
+		context.DialTimeout = opts.ConnectTimeout
+	}
+	context.SocketTimeout = opts.SocketTimeout
+	if opts.ReadPreference != "" {
+		pref, err := ParseReadPreference(opts.ReadPreference, opts.ReadPreferenceTags)
+		if err != nil {
+			return err
+		}
+		context.ReadPreference = pref
+	}
+	if opts.SSL && context.TLSConfig == nil {
+		context.TLSConfig = &tls.Config{}
+	}
+	if len(opts.Compressors) > 0 {
+		context.Compressors = opts.Compressors
+	}
+	return nil
+}
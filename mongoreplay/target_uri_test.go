@@ -0,0 +1,85 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTargetURI(t *testing.T) {
+	uri, opts, warnings, err := parseTargetURI("mongodb://db1:28000,db2:28000/admin?replicaSet=rs&connectTimeoutMS=2500" +
+		"&socketTimeoutMS=30000&readPreference=secondary&readPreferenceTags=dc:ny&ssl=true&w=majority&foo=bar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if uri != "mongodb://db1:28000,db2:28000/admin?replicaSet=rs" {
+		t.Errorf("expected only the driver options to be kept, got %v", uri)
+	}
+	if opts.ConnectTimeout != 2500*time.Millisecond || opts.SocketTimeout != 30*time.Second {
+		t.Errorf("wrong timeouts: connect %v, socket %v", opts.ConnectTimeout, opts.SocketTimeout)
+	}
+	if opts.ReadPreference != "secondary" || len(opts.ReadPreferenceTags) != 1 || opts.ReadPreferenceTags[0] != "dc:ny" {
+		t.Errorf("wrong read preference: %v %v", opts.ReadPreference, opts.ReadPreferenceTags)
+	}
+	if !opts.SSL {
+		t.Errorf("expected ssl to be set")
+	}
+	if len(warnings) != 2 {
+		t.Errorf("expected warnings for w and foo, got %v", warnings)
+	}
+
+	_, opts, warnings, err = parseTargetURI("mongodb://db1?compressors=snappy&zlibCompressionLevel=6")
+	if err != nil || len(opts.Compressors) != 1 || opts.Compressors[0] != "snappy" || len(warnings) != 1 {
+		t.Errorf("expected snappy to be asked for, with a warning for zlibCompressionLevel, got %v %v %v",
+			opts.Compressors, warnings, err)
+	}
+
+	_, opts, warnings, err = parseTargetURI("mongodb://db1?compressors=zstd,zlib")
+	if err != nil || len(opts.Compressors) != 1 || opts.Compressors[0] != "zlib" || len(warnings) != 1 {
+		t.Errorf("expected zlib to be asked for, with a warning for zstd, got %v %v %v",
+			opts.Compressors, warnings, err)
+	}
+
+	uri, _, warnings, err = parseTargetURI("mongodb://db1:28000")
+	if err != nil || uri != "mongodb://db1:28000" || len(warnings) != 0 {
+		t.Errorf("expected a URI without options to be left as is, got %v %v %v", uri, warnings, err)
+	}
+
+	for _, bad := range []string{
+		"mongodb://db1?connectTimeoutMS=soon",
+		"mongodb://db1?socketTimeoutMS=-1",
+		"mongodb://db1?readPreference=fastest",
+		"mongodb://db1?readPreferenceTags=dc:ny",
+		"mongodb://db1?ssl=maybe",
+		"mongodb://db1?replicaSet",
+		"mongodb://db1?compressors=zstd",
+	} {
+		if _, _, _, err := parseTargetURI(bad); err == nil {
+			t.Errorf("expected an error for %v", bad)
+		}
+	}
+}
+
+func TestApplyURIOptions(t *testing.T) {
+	context := &ExecutionContext{DialTimeout: 10 * time.Second}
+	_, opts, _, err := parseTargetURI("mongodb://db1?connectTimeoutMS=500&socketTimeoutMS=2000&readPreference=nearest&tls=true")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := context.applyURIOptions(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if context.DialTimeout != 500*time.Millisecond || context.SocketTimeout != 2*time.Second {
+		t.Errorf("wrong timeouts: dial %v, socket %v", context.DialTimeout, context.SocketTimeout)
+	}
+	if context.ReadPreference == nil || context.TLSConfig == nil {
+		t.Errorf("expected the read preference and TLS to be set")
+	}
+
+	context = &ExecutionContext{DialTimeout: 10 * time.Second}
+	if err := context.applyURIOptions(&targetURIOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if context.DialTimeout != 10*time.Second || context.ReadPreference != nil || context.TLSConfig != nil {
+		t.Errorf("expected a URI without options to leave the context as is")
+	}
+}
@@ -0,0 +1,211 @@
+package mongoreplay
+
+import (
+	"fmt"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgCommand returns the command of an OP_MSG request, read from the body
+// section of the message. Compressed OP_MSGs are decompressed first. Ops
+// other than OP_MSG have no command to return.
+func msgCommand(op *RawOp) (bson.D, bool, error) {
+	msg := op.Body
+	if op.Header.OpCode == OpCodeCompressed {
+		if len(msg) < MsgHeaderLen+4 || OpCode(getInt32(msg, MsgHeaderLen)) != OpCodeMsg {
+			return nil, false, nil
+		}
+		decompressed, err := decompressMessage(msg)
+		if err != nil {
+			return nil, false, err
+		}
+		msg = decompressed
+	} else if op.Header.OpCode != OpCodeMsg {
+		return nil, false, nil
+	}
+	if len(msg) < MsgHeaderLen {
+		return nil, false, fmt.Errorf("OP_MSG of %v bytes is too short to hold its header", len(msg))
+	}
+	_, sections, err := readMsgSections(msg[MsgHeaderLen:])
+	if err != nil {
+		return nil, false, err
+	}
+	for _, section := range sections {
+		if section.Kind == msgSectionBody {
+			command := bson.D{}
+			if err := section.Body.(*bson.Raw).Unmarshal(&command); err != nil {
+				return nil, false, err
+			}
+			return command, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("OP_MSG has no body section")
+}
+
+// transaction is a multi-document transaction seen in a tape.
+type transaction struct {
+	ops int
+
+	// started is whether the op starting the transaction was recorded, and
+	// ended whether the op committing or aborting it was
+	started, ended bool
+}
+
+// transactionTracker finds the multi-document transactions in a tape while it
+// is preprocessed. The ops of a transaction share the lsid and txnNumber of
+// their session, and its first op starts it while the last commits or aborts
+// it. Transactions whose first or last op wasn't recorded, such as those
+// running when the recording started or stopped, are orphaned fragments.
+type transactionTracker struct {
+	transactions map[string]*transaction
+}
+
+func newTransactionTracker() *transactionTracker {
+	return &transactionTracker{transactions: map[string]*transaction{}}
+}
+
+// txnSession holds the session a command was sent on and its txnNumber, which
+// both retryable writes and the ops of multi-document transactions carry.
+type txnSession struct {
+	lsid      string
+	txnNumber int64
+
+	// inTransaction is whether the command was sent with autocommit false,
+	// as part of a multi-document transaction rather than a retryable write
+	inTransaction bool
+}
+
+// commandTxnSession returns the session and txnNumber of a command, if it was
+// sent with both.
+func commandTxnSession(command bson.D) (txnSession, bool) {
+	var session txnSession
+	var lsid interface{}
+	hasTxnNumber := false
+	for _, elem := range command {
+		switch elem.Name {
+		case "lsid":
+			lsid = elem.Value
+		case "txnNumber":
+			switch value := elem.Value.(type) {
+			case int64:
+				session.txnNumber, hasTxnNumber = value, true
+			case int:
+				session.txnNumber, hasTxnNumber = int64(value), true
+			case int32:
+				session.txnNumber, hasTxnNumber = int64(value), true
+			}
+		case "autocommit":
+			session.inTransaction = elem.Value == false
+		}
+	}
+	if lsid == nil || !hasTxnNumber {
+		return txnSession{}, false
+	}
+	session.lsid = fmt.Sprintf("%v", lsid)
+	return session, true
+}
+
+// transactionKey returns the key of the transaction the command is part of,
+// made of its session id and transaction number, if it is in one.
+func transactionKey(command bson.D) (string, bool) {
+	// retryable writes have a txnNumber too, but commit on their own
+	session, ok := commandTxnSession(command)
+	if !ok || !session.inTransaction {
+		return "", false
+	}
+	return fmt.Sprintf("%v:%v", session.lsid, session.txnNumber), true
+}
+
+// observe records an op of the tape that is part of a transaction.
+func (tracker *transactionTracker) observe(op *RecordedOp) {
+	if op.EOF || isReplyOpCode(op.RawOp) {
+		return
+	}
+	command, ok, err := msgCommand(&op.RawOp)
+	if err != nil || !ok || len(command) == 0 {
+		return
+	}
+	key, ok := transactionKey(command)
+	if !ok {
+		return
+	}
+	txn, ok := tracker.transactions[key]
+	if !ok {
+		txn = &transaction{}
+		tracker.transactions[key] = txn
+		for _, elem := range command {
+			if elem.Name == "startTransaction" && elem.Value == true {
+				txn.started = true
+			}
+		}
+	}
+	txn.ops++
+	switch command[0].Name {
+	case "commitTransaction", "abortTransaction":
+		txn.ended = true
+	}
+}
+
+// orphaned returns the number of transactions whose first or last op wasn't
+// recorded.
+func (tracker *transactionTracker) orphaned() int {
+	orphaned := 0
+	for _, txn := range tracker.transactions {
+		if !txn.started || !txn.ended {
+			orphaned++
+		}
+	}
+	return orphaned
+}
+
+// isOrphan returns whether the op is part of a transaction whose first or
+// last op wasn't recorded. Such ops are skipped, as they would fail on the
+// target, or leave a transaction open on its session until it times out.
+func (tracker *transactionTracker) isOrphan(op Op) bool {
+	if tracker == nil {
+		return false
+	}
+	var command bson.D
+	var err error
+	switch castOp := op.(type) {
+	case *MsgOp:
+		command, err = castOp.body()
+	case *MsgGetMore:
+		command, err = castOp.body()
+	default:
+		return false
+	}
+	if err != nil {
+		return false
+	}
+	key, ok := transactionKey(command)
+	if !ok {
+		return false
+	}
+	txn, ok := tracker.transactions[key]
+	return ok && (!txn.started || !txn.ended)
+}
+
+// ops returns the number of ops in the transactions.
+func (tracker *transactionTracker) ops() int {
+	ops := 0
+	for _, txn := range tracker.transactions {
+		ops += txn.ops
+	}
+	return ops
+}
+
+// warn logs the transactions found in the tape. The ops of transactions are
+// played as they were recorded, with the lsid and txnNumber of their session,
+// on the connection they were recorded on, while fragments are skipped.
+func (tracker *transactionTracker) warn() {
+	if len(tracker.transactions) == 0 {
+		return
+	}
+	userInfoLogger.Logvf(Always, "Warning: the playback file holds %v transactions of %v ops in all, "+
+		"which are played with the sessions they were recorded on", len(tracker.transactions), tracker.ops())
+	if orphaned := tracker.orphaned(); orphaned > 0 {
+		userInfoLogger.Logvf(Always, "Warning: %v of the transactions are fragments whose start or end wasn't "+
+			"recorded, whose ops are skipped", orphaned)
+	}
+}
@@ -0,0 +1,209 @@
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgOp returns an OP_MSG request of the command, after a document sequence
+// section holding the documents.
+func msgOp(t *testing.T, command bson.D, documents ...bson.D) *RecordedOp {
+	body, err := bson.Marshal(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, MsgHeaderLen+4)
+	if len(documents) > 0 {
+		sequence := append([]byte{0, 0, 0, 0}, []byte("documents\x00")...)
+		for _, doc := range documents {
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sequence = append(sequence, raw...)
+		}
+		SetInt32(sequence, 0, int32(len(sequence)))
+		msg = append(append(msg, 1), sequence...)
+	}
+	msg = append(append(msg, msgSectionBody), body...)
+	header := MsgHeader{MessageLength: int32(len(msg)), RequestID: 1, OpCode: OpCodeMsg}
+	copy(msg, header.ToWire())
+	return &RecordedOp{RawOp: RawOp{Header: header, Body: msg}}
+}
+
+func TestMsgCommand(t *testing.T) {
+	op := msgOp(t, bson.D{{"insert", "test"}, {"$db", "mongoreplay"}}, bson.D{{"_id", 1}})
+	command, ok, err := msgCommand(&op.RawOp)
+	if err != nil || !ok {
+		t.Fatalf("expected the command of the OP_MSG, got %v, %v", ok, err)
+	}
+	if len(command) != 2 || command[0].Name != "insert" || command[0].Value != "test" {
+		t.Errorf("expected the insert command after the document sequence, got %v", command)
+	}
+
+	query := &RawOp{Header: MsgHeader{OpCode: OpCodeQuery}}
+	if _, ok, err := msgCommand(query); ok || err != nil {
+		t.Errorf("expected no command from an OP_QUERY, got %v, %v", ok, err)
+	}
+}
+
+func TestTransactionTracker(t *testing.T) {
+	lsid := func(id int) bson.D { return bson.D{{"id", id}} }
+	txnOp := func(name string, session, txnNumber int, start bool) *RecordedOp {
+		command := bson.D{{name, "test"}, {"lsid", lsid(session)}, {"txnNumber", int64(txnNumber)},
+			{"autocommit", false}}
+		if start {
+			command = append(command, bson.DocElem{"startTransaction", true})
+		}
+		return msgOp(t, command)
+	}
+
+	tracker := newTransactionTracker()
+	for _, op := range []*RecordedOp{
+		// a whole transaction
+		txnOp("insert", 1, 1, true),
+		txnOp("update", 1, 1, false),
+		txnOp("commitTransaction", 1, 1, false),
+		// the end of a transaction started before the recording
+		txnOp("delete", 2, 5, false),
+		txnOp("abortTransaction", 2, 5, false),
+		// the start of a transaction still running when it stopped
+		txnOp("insert", 1, 2, true),
+		// a retryable write, which isn't in a transaction
+		msgOp(t, bson.D{{"insert", "test"}, {"lsid", lsid(3)}, {"txnNumber", int64(1)}}),
+	} {
+		tracker.observe(op)
+	}
+
+	if len(tracker.transactions) != 3 || tracker.ops() != 6 {
+		t.Errorf("expected 3 transactions of 6 ops, got %v of %v ops", len(tracker.transactions), tracker.ops())
+	}
+	if orphaned := tracker.orphaned(); orphaned != 2 {
+		t.Errorf("expected 2 orphaned transactions, got %v", orphaned)
+	}
+}
+
+// transactionFixtureOps returns the requests and replies recorded in the
+// transactions fixture. On one connection, it holds a transaction inserting
+// the documents with _ids 1 and 2 and committing, the insert of _id 3 and
+// commit of a transaction started before the recording, and the insert of
+// _id 4 starting a transaction still running when the recording stopped.
+// Each request is followed by its reply.
+func transactionFixtureOps(t *testing.T) []*RecordedOp {
+	var ops []*RecordedOp
+	for _, op := range recordedOpsFromPcap(t, "transactions.pcapng") {
+		if !op.EOF {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) != 12 {
+		t.Fatalf("expected 12 ops in the fixture, got %v", len(ops))
+	}
+	return ops
+}
+
+func TestPlayTransactions(t *testing.T) {
+	ops := transactionFixtureOps(t)
+	tracker := newTransactionTracker()
+	for _, op := range ops {
+		tracker.observe(op)
+	}
+	if len(tracker.transactions) != 3 || tracker.orphaned() != 2 {
+		t.Fatalf("expected 3 transactions, 2 of them orphaned, got %v and %v",
+			len(tracker.transactions), tracker.orphaned())
+	}
+
+	server := newMsgServer(t)
+	defer server.listener.Close()
+	context := NewExecutionContext(&StatCollector{noop: true})
+	context.Transactions = tracker
+	session, err := context.dial("mongodb://" + server.listener.Addr().String() + "/?connect=direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// the server keeps the documents inserted in each transaction, and
+	// those of the transactions it commits
+	inserted := map[string][]interface{}{}
+	var committed []interface{}
+	var commands []string
+	for _, op := range ops {
+		done := make(chan error)
+		go func() {
+			_, _, err := context.Execute(op, session)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out playing an op")
+		}
+		select {
+		case received := <-server.received:
+			if err := received.foldSequences(); err != nil {
+				t.Fatal(err)
+			}
+			command, err := received.body()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, ok := transactionKey(command)
+			if !ok {
+				t.Fatalf("expected the %v to be played in its transaction", command[0].Name)
+			}
+			commands = append(commands, command[0].Name)
+			switch command[0].Name {
+			case "insert":
+				docs, _ := FindValueByKey("documents", &command)
+				for _, doc := range docs.([]interface{}) {
+					doc, err := toBSOND(doc)
+					if err != nil {
+						t.Fatal(err)
+					}
+					id, _ := FindValueByKey("_id", &doc)
+					inserted[key] = append(inserted[key], id)
+				}
+			case "commitTransaction":
+				committed = append(committed, inserted[key]...)
+			}
+		default:
+		}
+	}
+
+	expected := []string{"insert", "insert", "commitTransaction"}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected only the whole transaction to be played, as %v, got %v", expected, commands)
+	}
+	if !reflect.DeepEqual(committed, []interface{}{1, 2}) {
+		t.Errorf("expected the documents with _ids 1 and 2 to be committed, got %v", committed)
+	}
+}
+
+func TestCursorTrackerTransactions(t *testing.T) {
+	ops := transactionFixtureOps(t)
+	cursors := newCursorTracker()
+	// the transaction started by the first insert is open until its commit
+	// is answered, and the one started by the last insert stays open, while
+	// the fragment started before the recording is never tracked
+	expected := []int{2, 1, 2, 1, 1, 0, 1, 0, 1, 0, 2, 1}
+	for i, op := range ops {
+		if i > 0 && i < 3 {
+			if finishes, err := cursors.finishes(op); err != nil || !finishes {
+				t.Errorf("expected op %v to finish the transaction, got %v (%v)", i, finishes, err)
+			}
+		}
+		if err := cursors.track(op); err != nil {
+			t.Fatal(err)
+		}
+		if cursors.unfinished() != expected[i] {
+			t.Errorf("expected %v unfinished ops after op %v, got %v", expected[i], i, cursors.unfinished())
+		}
+	}
+}
@@ -71,10 +71,14 @@ func ReadDocument(r io.Reader) (doc []byte, err error) {
 	}
 
 	size := getInt32(sizeRaw, 0)
-	if size < 5 || size > maximumDocumentSize {
+	if size < 5 {
 		err = ErrInvalidSize
 		return
 	}
+	if size > maximumDocumentSize {
+		err = fmt.Errorf("document size, %v, was greater than the maximum, %v bytes", size, maximumDocumentSize)
+		return
+	}
 	doc = make([]byte, size)
 	if size < 4 {
 		return
@@ -118,22 +122,45 @@ func cacheKey(op *RecordedOp, response bool) string {
 	return fmt.Sprintf("%v:%v:%d:%v", src, dst, id, op.Generation)
 }
 
-// extractErrors inspects a bson doc and returns all of the mongodb errors contained within.
+// extractErrors inspects a bson doc and returns the mongodb errors of the
+// command itself contained within.
 func extractErrorsFromDoc(doc *bson.D) []error {
 	// errors may exist in the following places in the returned document:
 	// - the "$err" field, which is set if bit #1 is set on the responseFlags
 	// - the "errmsg" field on the top-level returned document
-	// - the "writeErrors" and "writeConcernErrors" arrays, which contain objects
-	//   that each have an "errmsg" field
+	// errors of ops that exceeded their maxTimeMS are told apart as timeouts
 	errors := []error{}
+	newError := func(val interface{}) error {
+		return fmt.Errorf("%v", val)
+	}
+	if code, ok := FindValueByKey("code", doc); ok {
+		if n, ok := intValue(code); ok && n == maxTimeMSExpired {
+			newError = func(val interface{}) error {
+				return opTimeoutError{fmt.Sprintf("%v", val)}
+			}
+		}
+	}
 
 	if val, ok := FindValueByKey("$err", doc); ok {
-		errors = append(errors, fmt.Errorf("%v", val))
+		errors = append(errors, newError(val))
 	}
 
 	if val, ok := FindValueByKey("errmsg", doc); ok {
-		errors = append(errors, fmt.Errorf("%v", val))
+		errors = append(errors, newError(val))
 	}
+	return errors
+}
+
+// extractWriteErrorsFromDoc inspects a bson doc and returns the errors of the
+// writes of a command contained within, which a command that succeeded can
+// return when some of its writes failed.
+func extractWriteErrorsFromDoc(doc *bson.D) []error {
+	// write errors may exist in the following places in the returned document:
+	// - the "writeErrors" array, which contains an object with an "errmsg"
+	//   field for each write that failed
+	// - the "writeConcernError" object, which is set if the write concern
+	//   wasn't satisfied, and the "writeConcernErrors" array of older servers
+	errors := []error{}
 
 	if val, ok := FindValueByKey("writeErrors", doc); ok {
 		if reflect.TypeOf(val).Kind() == reflect.Slice {
@@ -144,6 +171,10 @@ func extractErrorsFromDoc(doc *bson.D) []error {
 		}
 	}
 
+	if val, ok := FindValueByKey("writeConcernError", doc); ok {
+		errors = append(errors, fmt.Errorf("%v", val))
+	}
+
 	if val, ok := FindValueByKey("writeConcernErrors", doc); ok {
 		if reflect.TypeOf(val).Kind() == reflect.Slice {
 			s := reflect.ValueOf(val)
@@ -0,0 +1,111 @@
+package mongoreplay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+// warmDialers is the most connections to the target opened at once while
+// warming connections.
+const warmDialers = 16
+
+// warmPool holds connections to the target opened and authenticated before
+// playback starts, which the connections of the playback take instead of
+// dialing the target when their first op is due. It is safe for concurrent
+// use.
+type warmPool struct {
+	sync.Mutex
+	sessions []*mgo.Session
+}
+
+// warmConnections opens the given number of connections to the target, each
+// authenticated and with its socket in use, so that the ops played first
+// don't wait on connection and authentication handshakes.
+func (context *ExecutionContext) warmConnections(url string, count int) error {
+	start := time.Now()
+	sessions := make([]*mgo.Session, count)
+	errs := make([]error, count)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < warmDialers && i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				sessions[i], errs[i] = warmSession(context, url)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			(&warmPool{sessions: sessions}).close()
+			return fmt.Errorf("error warming connections to the target: %v", err)
+		}
+	}
+	context.WarmSessions = &warmPool{sessions: sessions}
+	userInfoLogger.Logvf(Always, "Opened %v warm connections to the target in %v, ready to play",
+		count, time.Now().Sub(start))
+	return nil
+}
+
+// warmSession opens a connection to the target and pings it, which
+// authenticates the socket the connection's ops will be played on.
+func warmSession(context *ExecutionContext, url string) (*mgo.Session, error) {
+	session, err := context.dial(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Ping(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// take returns a warm connection, or nil if none are left.
+func (pool *warmPool) take() *mgo.Session {
+	if pool == nil {
+		return nil
+	}
+	pool.Lock()
+	defer pool.Unlock()
+	if len(pool.sessions) == 0 {
+		return nil
+	}
+	session := pool.sessions[len(pool.sessions)-1]
+	pool.sessions = pool.sessions[:len(pool.sessions)-1]
+	return session
+}
+
+// close closes the warm connections that were never taken.
+func (pool *warmPool) close() {
+	if pool == nil {
+		return
+	}
+	pool.Lock()
+	defer pool.Unlock()
+	for _, session := range pool.sessions {
+		if session != nil {
+			session.Close()
+		}
+	}
+	pool.sessions = nil
+}
+
+// session returns a connection to the target for a connection of the
+// playback, taking a warm one if any are left.
+func (context *ExecutionContext) session(url string) (*mgo.Session, error) {
+	if session := context.WarmSessions.take(); session != nil {
+		return session, nil
+	}
+	return context.dial(url)
+}
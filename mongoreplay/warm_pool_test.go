@@ -0,0 +1,40 @@
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+func TestWarmPool(t *testing.T) {
+	var none *warmPool
+	if session := none.take(); session != nil {
+		t.Errorf("expected no connection from a missing pool, got %v", session)
+	}
+	none.close()
+
+	first, second := &mgo.Session{}, &mgo.Session{}
+	pool := &warmPool{sessions: []*mgo.Session{first, second}}
+	if session := pool.take(); session != second {
+		t.Errorf("expected the last warm connection, got %v", session)
+	}
+	if session := pool.take(); session != first {
+		t.Errorf("expected the first warm connection, got %v", session)
+	}
+	if session := pool.take(); session != nil {
+		t.Errorf("expected no connections left, got %v", session)
+	}
+}
+
+func TestWarmConnectionsFails(t *testing.T) {
+	context := NewExecutionContext(&StatCollector{})
+	// nothing listens here
+	context.DialTimeout = 100 * time.Millisecond
+	if err := context.warmConnections("mongodb://127.0.0.1:1", 3); err == nil {
+		t.Errorf("expected an error warming connections to a target that isn't there")
+	}
+	if context.WarmSessions != nil {
+		t.Errorf("expected no warm connections to be kept after an error")
+	}
+}
@@ -0,0 +1,132 @@
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// serverVersions names the server release that introduced each wire version.
+var serverVersions = map[int]string{
+	0:  "2.4",
+	2:  "2.6",
+	3:  "3.0",
+	4:  "3.2",
+	5:  "3.4",
+	6:  "3.6",
+	7:  "4.0",
+	8:  "4.2",
+	9:  "4.4",
+	13: "5.0",
+	14: "5.1",
+}
+
+// opCodeWireVersions gives the range of wire versions of the servers that
+// accept each op code: OP_COMMAND was added in 3.2 and removed in 4.2, and the
+// legacy ops were removed in 5.1. The op codes not listed are either replies,
+// which aren't played, or not played at all.
+var opCodeWireVersions = map[OpCode][2]int{
+	OpCodeQuery:       {0, 13},
+	OpCodeGetMore:     {0, 13},
+	OpCodeInsert:      {0, 13},
+	OpCodeUpdate:      {0, 13},
+	OpCodeDelete:      {0, 13},
+	OpCodeKillCursors: {0, 13},
+	OpCodeCommand:     {4, 7},
+}
+
+// serverVersion returns the server release that introduced the wire version.
+func serverVersion(wireVersion int) string {
+	for v := wireVersion; v >= 0; v-- {
+		if name, ok := serverVersions[v]; ok {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// tapeOpCodes records the op codes played from a tape, so that the target can be
+// checked for support of all of them before playback starts.
+type tapeOpCodes map[OpCode]bool
+
+// observe records the op code of the op. Compressed ops are played
+// uncompressed, so the op code they wrap is recorded instead.
+func (opCodes tapeOpCodes) observe(op *RecordedOp) {
+	opCode := op.Header.OpCode
+	if opCode == OpCodeCompressed && len(op.Body) >= MsgHeaderLen+4 {
+		opCode = OpCode(int32(binary.LittleEndian.Uint32(op.Body[MsgHeaderLen:])))
+	}
+	opCodes[opCode] = true
+}
+
+// wireVersionRange returns the range of wire versions of the servers that
+// accept every op code in the tape.
+func (opCodes tapeOpCodes) wireVersionRange() (min, max int) {
+	min, max = 0, -1
+	for opCode := range opCodes {
+		versions, ok := opCodeWireVersions[opCode]
+		if !ok {
+			continue
+		}
+		if versions[0] > min {
+			min = versions[0]
+		}
+		if max < 0 || versions[1] < max {
+			max = versions[1]
+		}
+	}
+	return min, max
+}
+
+// limitedBy returns the sorted names of the op codes in the tape whose range of
+// wire versions satisfies the bound.
+func (opCodes tapeOpCodes) limitedBy(bound func(versions [2]int) bool) string {
+	names := []string{}
+	for opCode := range opCodes {
+		if versions, ok := opCodeWireVersions[opCode]; ok && bound(versions) {
+			names = append(names, opCode.String())
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkTarget returns an error naming the server versions the tape needs if a
+// target with the given max wire version can't play every op in the tape.
+func (opCodes tapeOpCodes) checkTarget(targetMax int) error {
+	min, max := opCodes.wireVersionRange()
+	if targetMax < min {
+		return fmt.Errorf("the tape requires a server of version %v or later for its %v ops, but the target is version %v",
+			serverVersion(min), opCodes.limitedBy(func(v [2]int) bool { return v[0] > targetMax }), serverVersion(targetMax))
+	}
+	if max >= 0 && targetMax > max {
+		return fmt.Errorf("the tape requires a server older than version %v for its %v ops, but the target is version %v",
+			serverVersion(max+1), opCodes.limitedBy(func(v [2]int) bool { return v[1] < targetMax }), serverVersion(targetMax))
+	}
+	return nil
+}
+
+// targetServerVersion connects to the target and returns its version and the
+// max wire version it supports. The version is empty if buildInfo fails, as
+// the wire version is enough to check the target.
+func (context *ExecutionContext) targetServerVersion(url string) (string, int, error) {
+	session, err := context.dial(url)
+	if err != nil {
+		return "", 0, fmt.Errorf("error connecting to target: %v", err)
+	}
+	defer session.Close()
+	result := struct {
+		MaxWireVersion int `bson:"maxWireVersion"`
+	}{}
+	if err := session.Run("isMaster", &result); err != nil {
+		return "", 0, fmt.Errorf("error getting target version: %v", err)
+	}
+	buildInfo := struct {
+		Version string `bson:"version"`
+	}{}
+	if err := session.Run("buildInfo", &buildInfo); err != nil {
+		toolDebugLogger.Logvf(DebugLow, "error running buildInfo on target: %v", err)
+	}
+	return buildInfo.Version, result.MaxWireVersion, nil
+}
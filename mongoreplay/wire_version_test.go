@@ -0,0 +1,54 @@
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestTapeOpCodesCheckTarget(t *testing.T) {
+	opCodes := tapeOpCodes{}
+	opCodes.observe(&RecordedOp{RawOp: RawOp{Header: MsgHeader{OpCode: OpCodeQuery}}})
+	opCodes.observe(&RecordedOp{RawOp: RawOp{Header: MsgHeader{OpCode: OpCodeReply}}})
+
+	// a compressed OP_COMMAND is played as an OP_COMMAND
+	body := make([]byte, MsgHeaderLen+9)
+	binary.LittleEndian.PutUint32(body[MsgHeaderLen:], uint32(OpCodeCommand))
+	opCodes.observe(&RecordedOp{RawOp: RawOp{Header: MsgHeader{OpCode: OpCodeCompressed}, Body: body}})
+	if !opCodes[OpCodeCommand] || opCodes[OpCodeCompressed] {
+		t.Errorf("compressed op should be recorded as its original op code, got %v", opCodes)
+	}
+
+	min, max := opCodes.wireVersionRange()
+	if min != 4 || max != 7 {
+		t.Errorf("wire version range should be 4 to 7, got %v to %v", min, max)
+	}
+
+	if err := opCodes.checkTarget(5); err != nil {
+		t.Errorf("3.4 target should be able to play the tape: %v", err)
+	}
+
+	err := opCodes.checkTarget(3)
+	if err == nil {
+		t.Fatalf("3.0 target should be rejected")
+	}
+	if !strings.Contains(err.Error(), "version 3.2 or later") || !strings.Contains(err.Error(), "command") {
+		t.Errorf("error should name the required version and op, got: %v", err)
+	}
+
+	err = opCodes.checkTarget(8)
+	if err == nil {
+		t.Fatalf("4.2 target should be rejected")
+	}
+	if !strings.Contains(err.Error(), "older than version 4.2") {
+		t.Errorf("error should name the version that removed the op, got: %v", err)
+	}
+
+	legacy := tapeOpCodes{OpCodeInsert: true}
+	if err := legacy.checkTarget(13); err != nil {
+		t.Errorf("5.0 target should be able to play legacy ops: %v", err)
+	}
+	if err := legacy.checkTarget(17); err == nil {
+		t.Errorf("target without legacy op support should be rejected")
+	}
+}